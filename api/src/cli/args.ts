@@ -0,0 +1,225 @@
+import { parseArgs } from 'node:util';
+import type { IsolationLevel, Language, LintOptions, RunLimits, RunMode, SqlOptions } from '../core/types.js';
+
+export interface CliRunOptions {
+  // Entry file first; the rest are written next to it as extra sources.
+  files: string[];
+  language?: Language;
+  mode: RunMode;
+  // File whose contents become the program's stdin; `-` reads the CLI's own stdin.
+  stdin?: string;
+  // Files staged read-only under inputs/, as the API does for uploaded files.
+  inputs: string[];
+  args: string[];
+  env: Record<string, string>;
+  limits: Partial<RunLimits>;
+  version?: string;
+  // Static checks before the build, reported as diagnostics; none when unset.
+  lint?: LintOptions;
+  // Measure line coverage of a test-mode run.
+  coverage: boolean;
+  // Database engine of a sql run; the runner's default when unset.
+  sqlEngine?: SqlOptions['engine'];
+  // File of SQL run before a sql submission to set up its database.
+  fixture?: string;
+  // The configured sandbox.backend when unset.
+  backend?: 'docker' | 'process';
+  // Container, or the language's only level (wasm), when unset.
+  isolation?: IsolationLevel;
+  json: boolean;
+  watch: boolean;
+  // Leave the run directory in place so outputs/ can be inspected.
+  keep: boolean;
+  // Server configuration file whose sandbox settings apply; CONFIG_FILE when unset.
+  config?: string;
+}
+
+export interface CliReplayOptions {
+  // Tarball from GET /v1/runs/{id}/bundle.
+  bundle: string;
+  backend?: 'docker' | 'process';
+  json: boolean;
+  keep: boolean;
+  config?: string;
+}
+
+export const USAGE = `usage: codexec run [options] <entry file> [source files...] [-- program args]
+       codexec replay [options] <bundle.tar.gz>
+
+options:
+  --lang <language>      runner to use; guessed from the entry file's extension when omitted
+  --mode <mode>          run the entry file (default), the submission's tests (test), or only
+                         build (compile) or syntax-check (check) it
+  --stdin <file>         feed the file to the program's stdin; - reads this process's stdin
+  --input <file>         stage a file under inputs/ (repeatable)
+  --env <KEY=VALUE>      set an environment variable for the program (repeatable)
+  --timeout <duration>   wall-clock limit, e.g. 500ms, 5s or 1m
+  --kill-grace <duration> time a program past the limit gets to exit after SIGTERM
+  --cpu <duration>       CPU time limit
+  --memory <mb>          memory limit in MiB
+  --toolchain <version>  toolchain version (docker backend)
+  --lint                 run go vet before the build and print its diagnostics
+  --staticcheck          run staticcheck too, when the runner has it (implies --lint)
+  --coverage             measure line coverage of the tests (with --mode test)
+  --engine <name>        database of a sql run: sqlite (default) or postgres
+  --fixture <file>       SQL that sets up a sql run's database before the submission
+  --backend <name>       docker or process (default: the configured sandbox.backend)
+  --isolation <level>    container, gvisor or microvm (docker backend), or wasm
+  --json                 print the result as JSON instead of streaming output
+  --watch                re-run whenever one of the files changes
+  --keep                 keep the run directory and print its path
+  --config <file>        server configuration file to take sandbox settings from (default: CONFIG_FILE)`;
+
+export const REPLAY_USAGE = `usage: codexec replay [options] <bundle.tar.gz>
+
+Re-runs an execution exported with GET /v1/runs/{id}/bundle, with the request and limits it
+ran with, and compares the result with the original's.
+
+options:
+  --backend <name>       docker or process (default: the configured sandbox.backend)
+  --json                 print the replay and the original result as JSON
+  --keep                 keep the run directory and print its path
+  --config <file>        server configuration file to take sandbox settings from (default: CONFIG_FILE)`;
+
+// Accepts a bare number of milliseconds or a number suffixed with ms, s or m.
+export function parseDuration(value: string): number {
+  const match = /^(\d+(?:\.\d+)?)(ms|s|m)?$/.exec(value.trim());
+  if (!match) {
+    throw new Error(`invalid duration: ${value}`);
+  }
+  const scale = { ms: 1, s: 1000, m: 60000 }[match[2] ?? 'ms'] ?? 1;
+  return Math.round(Number(match[1]) * scale);
+}
+
+function positiveInteger(name: string, value: string): number {
+  const parsed = Number(value);
+  if (!Number.isInteger(parsed) || parsed <= 0) {
+    throw new Error(`--${name} must be a positive integer`);
+  }
+  return parsed;
+}
+
+// Parses the arguments after `codexec run`. Everything after a literal `--` goes to the program.
+export function parseRunArgs(argv: string[], env: NodeJS.ProcessEnv = process.env): CliRunOptions {
+  const separator = argv.indexOf('--');
+  const own = separator === -1 ? argv : argv.slice(0, separator);
+  const { values, positionals } = parseArgs({
+    args: own,
+    allowPositionals: true,
+    options: {
+      lang: { type: 'string' },
+      mode: { type: 'string' },
+      stdin: { type: 'string' },
+      input: { type: 'string', multiple: true },
+      env: { type: 'string', multiple: true },
+      timeout: { type: 'string' },
+      'kill-grace': { type: 'string' },
+      cpu: { type: 'string' },
+      memory: { type: 'string' },
+      toolchain: { type: 'string' },
+      lint: { type: 'boolean' },
+      staticcheck: { type: 'boolean' },
+      coverage: { type: 'boolean' },
+      engine: { type: 'string' },
+      fixture: { type: 'string' },
+      backend: { type: 'string' },
+      isolation: { type: 'string' },
+      json: { type: 'boolean' },
+      watch: { type: 'boolean' },
+      keep: { type: 'boolean' },
+      config: { type: 'string' }
+    }
+  });
+  if (positionals.length === 0) {
+    throw new Error('an entry file is required');
+  }
+  const mode = (values.mode ?? 'run') as RunMode;
+  if (!['run', 'test', 'compile', 'check'].includes(mode)) {
+    throw new Error('--mode must be run, test, compile or check');
+  }
+  if (values.coverage && mode !== 'test') {
+    throw new Error('--coverage requires --mode test');
+  }
+  const backend = parseBackend(values.backend);
+  const isolation = values.isolation;
+  if (isolation !== undefined && !['container', 'gvisor', 'microvm', 'wasm'].includes(isolation)) {
+    throw new Error('--isolation must be container, gvisor, microvm or wasm');
+  }
+  const engine = values.engine;
+  if (engine !== undefined && engine !== 'sqlite' && engine !== 'postgres') {
+    throw new Error('--engine must be sqlite or postgres');
+  }
+  const programEnv: Record<string, string> = {};
+  for (const entry of values.env ?? []) {
+    const equals = entry.indexOf('=');
+    if (equals <= 0) {
+      throw new Error(`--env expects KEY=VALUE, got ${entry}`);
+    }
+    programEnv[entry.slice(0, equals)] = entry.slice(equals + 1);
+  }
+  const limits: Partial<RunLimits> = {};
+  if (values.timeout) {
+    limits.timeout_ms = parseDuration(values.timeout);
+  }
+  if (values['kill-grace']) {
+    limits.kill_grace_ms = parseDuration(values['kill-grace']);
+  }
+  if (values.cpu) {
+    limits.cpu_ms = parseDuration(values.cpu);
+  }
+  if (values.memory) {
+    limits.memory_mb = positiveInteger('memory', values.memory);
+  }
+  return {
+    files: positionals,
+    language: values.lang,
+    mode,
+    stdin: values.stdin,
+    inputs: values.input ?? [],
+    args: separator === -1 ? [] : argv.slice(separator + 1),
+    env: programEnv,
+    limits,
+    version: values.toolchain,
+    lint: values.lint || values.staticcheck ? { staticcheck: values.staticcheck ?? false } : undefined,
+    coverage: values.coverage ?? false,
+    sqlEngine: engine,
+    fixture: values.fixture,
+    backend,
+    isolation: isolation as IsolationLevel | undefined,
+    json: values.json ?? false,
+    watch: values.watch ?? false,
+    keep: values.keep ?? false,
+    config: values.config ?? env.CONFIG_FILE
+  };
+}
+
+// Parses the arguments after `codexec replay`.
+export function parseReplayArgs(argv: string[], env: NodeJS.ProcessEnv = process.env): CliReplayOptions {
+  const { values, positionals } = parseArgs({
+    args: argv,
+    allowPositionals: true,
+    options: {
+      backend: { type: 'string' },
+      json: { type: 'boolean' },
+      keep: { type: 'boolean' },
+      config: { type: 'string' }
+    }
+  });
+  if (positionals.length !== 1) {
+    throw new Error('exactly one bundle is required');
+  }
+  return {
+    bundle: positionals[0],
+    backend: parseBackend(values.backend),
+    json: values.json ?? false,
+    keep: values.keep ?? false,
+    config: values.config ?? env.CONFIG_FILE
+  };
+}
+
+function parseBackend(backend: string | undefined): 'docker' | 'process' | undefined {
+  if (backend !== undefined && backend !== 'docker' && backend !== 'process') {
+    throw new Error('--backend must be docker or process');
+  }
+  return backend;
+}
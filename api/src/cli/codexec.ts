@@ -0,0 +1,475 @@
+#!/usr/bin/env node
+import crypto from 'node:crypto';
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { fileURLToPath } from 'node:url';
+import Boom from '@hapi/boom';
+import { Logger } from '../util/logger.js';
+import { DockerSandbox } from '../core/sandbox.js';
+import { ProcessSandbox } from '../core/process_sandbox.js';
+import { WasmSandbox } from '../core/wasm_sandbox.js';
+import { VersionManager } from '../core/versions.js';
+import { loadProcessSeccomp } from '../core/seccomp.js';
+import { mergeLimits } from '../core/limits.js';
+import { loadConfig } from '../config/index.js';
+import type { AppConfig } from '../config/index.js';
+import { DEFAULT_ISOLATION_LEVELS, runnerRegistry } from '../core/runners.js';
+import { readBundle } from '../core/bundle.js';
+import { detectLanguage } from '../core/detect.js';
+import { SCHEMA_VERSION } from '../core/schema.js';
+import { classifyTermination } from '../core/termination.js';
+import type { ReplayBundle } from '../core/bundle.js';
+import { parseReplayArgs, parseRunArgs, REPLAY_USAGE, USAGE } from './args.js';
+import type { CliReplayOptions, CliRunOptions } from './args.js';
+import type { NetworkPolicy, SandboxResult, SandboxRunner, SandboxRunSpec } from '../core/types.js';
+
+// Runs a submission through the same sandbox backends the API uses, without the server, queue
+// or store in between. Meant for trying out runners and their entrypoints locally, and for
+// replaying bundles exported from the API to debug a reported failure.
+
+// Both src/cli and dist/cli sit three levels below the repository root.
+const repoRoot = fileURLToPath(new URL('../../../', import.meta.url));
+
+// The sandboxes log JSON lines to stdout; here only their warnings are of interest, on stderr.
+class CliLogger extends Logger {
+  public child() {
+    return this;
+  }
+
+  public info() {
+    // Launch details are noise for a single local run.
+  }
+
+  public warn(message: string) {
+    process.stderr.write(`codexec: ${message}\n`);
+  }
+
+  public error(message: string) {
+    process.stderr.write(`codexec: ${message}\n`);
+  }
+}
+
+// Runs with isolation wasm go to sandbox.wasm.runtime whichever backend is selected.
+function createSandbox(options: Pick<CliRunOptions, 'backend'>, config: AppConfig): SandboxRunner {
+  const logger = new CliLogger();
+  const settings = config.sandbox;
+  return new WasmSandbox(
+    {
+      runtime: settings.wasm.runtime,
+      wasiSdk: settings.wasm.wasi_sdk,
+      fuel: settings.wasm.fuel,
+      cacheDir: settings.wasm.cache_dir,
+      registry: runnerRegistry,
+      next: createBackend(options, config, logger)
+    },
+    logger
+  );
+}
+
+function createBackend(options: Pick<CliRunOptions, 'backend'>, config: AppConfig, logger: CliLogger): SandboxRunner {
+  const settings = config.sandbox;
+  if ((options.backend ?? settings.backend) === 'process') {
+    return new ProcessSandbox(
+      {
+        runnersDir: settings.runners_dir,
+        registry: runnerRegistry,
+        seccomp: settings.disable_security ? undefined : loadProcessSeccomp(settings.process_seccomp_profile),
+        confine: !settings.disable_security
+      },
+      logger
+    );
+  }
+  return new DockerSandbox(
+    {
+      workRoot: settings.work_root,
+      hostWorkRoot: settings.host_work_root,
+      seccompProfile: settings.seccomp_profile,
+      appArmorProfile: settings.apparmor_profile,
+      disableSecurity: settings.disable_security,
+      registry: runnerRegistry,
+      cli: settings.cli,
+      runtimes: { gvisor: settings.gvisor_runtime, microvm: settings.microvm_runtime },
+      versions: new VersionManager({ cli: settings.cli, pull: settings.pull_versions }, logger)
+    },
+    logger
+  );
+}
+
+// `--stdin -` is read once, so watch mode feeds every re-run the same input.
+let ownStdin: string | null = null;
+function readStdin(file: string | undefined): string {
+  if (file !== '-') {
+    return file ? fs.readFileSync(file, 'utf8') : '';
+  }
+  ownStdin ??= fs.readFileSync(0, 'utf8');
+  return ownStdin;
+}
+
+function buildSpec(options: CliRunOptions, config: AppConfig, signal: AbortSignal): SandboxRunSpec {
+  const [entry, ...rest] = options.files;
+  const runner = options.language
+    ? runnerRegistry.require(options.language)
+    : runnerRegistry.forExtension(path.extname(entry)) ?? detectRunner(entry);
+  const sources: Record<string, string> = {};
+  for (const file of rest) {
+    // Extra files keep their place relative to the entry file.
+    sources[path.relative(path.dirname(entry), file)] = fs.readFileSync(file, 'utf8');
+  }
+  const id = crypto.randomBytes(6).toString('hex');
+  return {
+    id,
+    language: runner.language,
+    mode: options.mode,
+    // Modules are binary; the wasm runtime decodes base64 code as the API accepts it.
+    code: runner.language === 'wasm' ? fs.readFileSync(entry).toString('base64') : fs.readFileSync(entry, 'utf8'),
+    sources,
+    stdin: readStdin(options.stdin),
+    build: {},
+    lint: options.lint,
+    coverage: options.coverage,
+    sql: options.sqlEngine || options.fixture
+      ? { engine: options.sqlEngine, fixture: options.fixture ? fs.readFileSync(options.fixture, 'utf8') : undefined }
+      : undefined,
+    isolation: options.isolation ?? (runner.isolation ?? DEFAULT_ISOLATION_LEVELS)[0],
+    network: { mode: 'none' },
+    version: options.version,
+    args: options.args,
+    env: options.env,
+    workdir: path.join(config.sandbox.work_root, `run_${id}`),
+    limits: mergeLimits(options.limits, { maxProcesses: runner.pidsLimit, maxOpenFiles: runner.openFilesLimit, policy: config.limits, language: runner.language }),
+    stagedFiles: options.inputs.map((input) => ({ sourcePath: input, destPath: path.basename(input) })),
+    mounts: [],
+    // Text output streams the program's output as it runs; JSON prints it once at the end.
+    onOutput: options.json ? undefined : (stream, chunk) => process[stream].write(chunk),
+    signal
+  };
+}
+
+// Scripts without a known extension, e.g. executables named after their command, are told
+// apart by shebang and content.
+function detectRunner(entry: string) {
+  try {
+    return runnerRegistry.require(detectLanguage({ code: fs.readFileSync(entry, 'utf8') }).language);
+  } catch (err) {
+    const candidates: Array<{ language: string }> = Boom.isBoom(err) ? err.data?.candidates ?? [] : [];
+    const between = candidates.length > 1 ? ` (${candidates.map((candidate) => candidate.language).join(' or ')})` : '';
+    throw new Error(`cannot tell the language of ${entry}${between}; pass --lang`);
+  }
+}
+
+function termination(result: SandboxResult, spec: SandboxRunSpec) {
+  const { status, exitCode, compile } = result;
+  return classifyTermination(
+    { status, exitCode, limitExceeded: result.limitExceeded ?? null, exitSignal: result.exitSignal ?? null, compile: compile ?? null },
+    spec.limits
+  );
+}
+
+function summary(result: SandboxResult, spec: SandboxRunSpec): string {
+  const parts = [
+    `status=${result.status}`,
+    `exit=${result.exitCode ?? '-'}`,
+    `wall=${result.usage.wall_ms}ms`,
+    `cpu=${result.usage.cpu_ms}ms`,
+    `rss=${result.usage.max_rss_mb}MB`
+  ];
+  if (result.limitExceeded) {
+    parts.push(`limit=${result.limitExceeded}`);
+  }
+  const lines = [`--- ${parts.join(' ')}`];
+  const outcome = termination(result, spec);
+  if (!['exited', 'exited_nonzero', 'compile_error'].includes(outcome.verdict)) {
+    lines.push(outcome.explanation);
+  }
+  if (result.compile && result.compile.exit_code !== 0) {
+    lines.push(`compile failed with exit code ${result.compile.exit_code}`);
+  }
+  if (result.timeout) {
+    const { stage, grace_ms: graceMs, flushed_bytes: flushed } = result.timeout;
+    const ended = stage === 'soft' ? 'exited' : 'killed';
+    lines.push(`${ended} ${graceMs}ms after SIGTERM at the time limit, writing ${flushed} more bytes of output`);
+  }
+  for (const diagnostic of result.diagnostics ?? []) {
+    const position = [diagnostic.file, diagnostic.line, diagnostic.column].filter((part) => part !== null).join(':');
+    const code = diagnostic.code ? ` (${diagnostic.source} ${diagnostic.code})` : ` (${diagnostic.source})`;
+    lines.push(`${position}: ${diagnostic.severity}: ${diagnostic.message}${code}`);
+  }
+  for (const query of result.results ?? []) {
+    if (query.error) {
+      lines.push(`line ${query.line}: error: ${query.error}`);
+    } else {
+      const rows = query.columns ? `${query.rows.length} rows${query.truncated ? ' (truncated)' : ''}` : `${query.rows_affected ?? 0} rows affected`;
+      lines.push(`line ${query.line}: ${rows}`);
+    }
+  }
+  for (const test of result.tests ?? []) {
+    lines.push(`${test.status.padEnd(7)} ${test.name}${test.message ? `: ${test.message}` : ''}`);
+  }
+  if (result.coverage) {
+    for (const file of result.coverage.files) {
+      lines.push(`coverage ${file.percent}% ${file.file} (${file.covered_lines}/${file.total_lines} lines)`);
+    }
+    const { percent, covered_lines: covered, total_lines: total } = result.coverage;
+    lines.push(`coverage ${percent}% total (${covered}/${total} lines)`);
+  }
+  for (const artifact of result.artifacts) {
+    lines.push(`artifact ${artifact.name} (${artifact.size} bytes)`);
+  }
+  return `${lines.join('\n')}\n`;
+}
+
+function render(result: SandboxResult, spec: SandboxRunSpec, options: Pick<CliRunOptions, 'json' | 'keep'>) {
+  if (!options.json) {
+    process.stderr.write(summary(result, spec));
+    if (options.keep) {
+      process.stderr.write(`run directory kept at ${spec.workdir}\n`);
+    }
+    return;
+  }
+  process.stdout.write(`${JSON.stringify(resultJson(result, spec, options.keep), null, 2)}\n`);
+}
+
+function resultJson(result: SandboxResult, spec: SandboxRunSpec, keep: boolean) {
+  return {
+    schema_version: SCHEMA_VERSION,
+    language: spec.language,
+    status: result.status,
+    exit_code: result.exitCode,
+    limit_exceeded: result.limitExceeded ?? null,
+    timeout: result.timeout ?? null,
+    termination: termination(result, spec),
+    stdout: result.stdout.toString('utf8'),
+    stderr: result.stderr.toString('utf8'),
+    dropped_bytes: result.droppedBytes ?? { stdout: 0, stderr: 0 },
+    compile: result.compile ?? null,
+    toolchain: result.toolchain ?? null,
+    tests: result.tests ?? null,
+    coverage: result.coverage ?? null,
+    diagnostics: result.diagnostics ?? null,
+    results: result.results ?? null,
+    usage: result.usage,
+    memory: result.memory ?? null,
+    artifacts: result.artifacts.map(({ name, size, contentType }) => ({ name, size, content_type: contentType ?? null })),
+    ...(keep ? { workdir: spec.workdir } : {})
+  };
+}
+
+// The exit status mirrors the program's; runs stopped by a limit or that never produced a code exit 1.
+function exitStatus(result: SandboxResult): number {
+  if (result.status === 'succeeded') {
+    return 0;
+  }
+  return result.exitCode && result.status === 'failed' ? result.exitCode : 1;
+}
+
+async function runOnce(options: CliRunOptions, sandbox: SandboxRunner, config: AppConfig, signal: AbortSignal) {
+  const spec = buildSpec(options, config, signal);
+  try {
+    const result = await sandbox.run(spec);
+    render(result, spec, options);
+    return result;
+  } finally {
+    if (!options.keep) {
+      fs.rmSync(spec.workdir, { recursive: true, force: true });
+    }
+  }
+}
+
+// Builds the run a bundle records: its request, the limits it ran with and its staged inputs,
+// which are written to a directory of their own as uploads are staged from storage. Parts of the
+// original setup a local run cannot provide are reported and left out.
+function replaySpec(bundle: ReplayBundle, options: CliReplayOptions, config: AppConfig, signal: AbortSignal) {
+  const { manifest } = bundle;
+  const request = manifest.request;
+  const warn = (message: string) => process.stderr.write(`codexec: ${message}\n`);
+  const backend = options.backend ?? config.sandbox.backend;
+  if (backend !== manifest.sandbox.backend) {
+    warn(`the original ran on the ${manifest.sandbox.backend} backend, this replay on ${backend}`);
+  }
+  if (request.mounts?.length) {
+    warn('mounts are not part of the bundle; replaying without them');
+  }
+  for (const file of manifest.missing_files) {
+    warn(`input ${file} was no longer stored when the bundle was exported`);
+  }
+  let network: NetworkPolicy = request.network ?? { mode: 'none' };
+  if (network.mode === 'allowlist') {
+    warn('network allowlists need the API\'s egress proxy; replaying offline');
+    network = { mode: 'none' };
+  }
+  const runner = runnerRegistry.require(manifest.language);
+  const id = crypto.randomBytes(6).toString('hex');
+  const inputsDir = path.join(config.sandbox.work_root, `bundle_${id}`);
+  const stagedFiles = Object.entries(bundle.inputs).map(([destPath, data]) => {
+    const sourcePath = path.join(inputsDir, destPath);
+    fs.mkdirSync(path.dirname(sourcePath), { recursive: true });
+    fs.writeFileSync(sourcePath, data);
+    return { sourcePath, destPath };
+  });
+  const spec: SandboxRunSpec = {
+    id,
+    language: runner.language,
+    mode: request.mode ?? 'run',
+    code: bundle.code,
+    sources: bundle.sources,
+    stdin: bundle.stdin,
+    build: request.build ?? {},
+    lint: request.lint,
+    sql: request.sql,
+    profile: request.profile,
+    coverage: request.coverage,
+    isolation: request.isolation ?? manifest.sandbox.default_isolation,
+    network,
+    version: request.version,
+    args: request.args ?? [],
+    // HOME and TMPDIR as the server sets them for every run.
+    env: { ...request.env, HOME: '/work', TMPDIR: '/work/tmp' },
+    workdir: path.join(config.sandbox.work_root, `run_${id}`),
+    limits: manifest.limits ?? mergeLimits(request.limits, { maxProcesses: runner.pidsLimit, maxOpenFiles: runner.openFilesLimit, policy: config.limits, language: runner.language }),
+    stagedFiles,
+    mounts: [],
+    onOutput: options.json ? undefined : (stream, chunk) => process[stream].write(chunk),
+    onOutputLimit: request.on_output_limit,
+    signal
+  };
+  return { spec, inputsDir };
+}
+
+// What the replay did differently from the original; exit codes are compared as the API records
+// them, with 0 for runs that ended without one.
+function differences(result: SandboxResult, bundle: ReplayBundle): string[] {
+  const original = bundle.manifest.result;
+  const reported = bundle.manifest.toolchain.reported;
+  const checks: Array<[string, boolean]> = [
+    ['status', result.status === original.status],
+    ['exit_code', (result.exitCode ?? 0) === original.exit_code],
+    ['stdout', result.stdout.toString('utf8') === bundle.stdout],
+    ['stderr', result.stderr.toString('utf8') === bundle.stderr],
+    ['toolchain', !reported || !result.toolchain || result.toolchain === reported]
+  ];
+  return checks.filter(([, same]) => !same).map(([name]) => name);
+}
+
+async function replay(options: CliReplayOptions, sandbox: SandboxRunner, config: AppConfig, signal: AbortSignal) {
+  const bundle = readBundle(fs.readFileSync(options.bundle));
+  const { spec, inputsDir } = replaySpec(bundle, options, config, signal);
+  let result: SandboxResult;
+  try {
+    result = await sandbox.run(spec);
+  } finally {
+    fs.rmSync(inputsDir, { recursive: true, force: true });
+    if (!options.keep) {
+      fs.rmSync(spec.workdir, { recursive: true, force: true });
+    }
+  }
+  const original = bundle.manifest.result;
+  // Executions that never finished, or ended in an error, have no result to compare with.
+  const changed = original.status === 'pending' || original.status === 'error' ? null : differences(result, bundle);
+  if (options.json) {
+    const output = {
+      id: bundle.manifest.id,
+      replay: resultJson(result, spec, options.keep),
+      original: { ...original, stdout: bundle.stdout, stderr: bundle.stderr, toolchain: bundle.manifest.toolchain.reported },
+      differences: changed
+    };
+    process.stdout.write(`${JSON.stringify(output, null, 2)}\n`);
+    return result;
+  }
+  render(result, spec, options);
+  const lines = [`--- original ${bundle.manifest.id}: status=${original.status} exit=${original.exit_code ?? '-'}`];
+  if (original.error) {
+    lines.push(`original error: ${original.error}`);
+  }
+  if (changed) {
+    lines.push(changed.length === 0 ? 'replay matches the original' : `replay differs from the original in ${changed.join(', ')}`);
+  }
+  process.stderr.write(`${lines.join('\n')}\n`);
+  return result;
+}
+
+// Re-runs on every change to the given files, canceling a run that is still going. Their
+// directories are watched because editors often save by replacing the file, through several
+// writes, so changes are also debounced.
+function watch(options: CliRunOptions, sandbox: SandboxRunner, config: AppConfig) {
+  let controller: AbortController | null = null;
+  let timer: NodeJS.Timeout | null = null;
+  const start = () => {
+    controller?.abort();
+    const current = new AbortController();
+    controller = current;
+    if (!options.json) {
+      process.stderr.write(`--- running ${options.files[0]} (${new Date().toLocaleTimeString()})\n`);
+    }
+    runOnce(options, sandbox, config, current.signal).catch((err: Error) => {
+      process.stderr.write(`codexec: ${err.message}\n`);
+    });
+  };
+  const files = [...options.files, ...options.inputs, ...(options.stdin && options.stdin !== '-' ? [options.stdin] : [])]
+    .map((file) => path.resolve(file));
+  for (const dir of new Set(files.map((file) => path.dirname(file)))) {
+    fs.watch(dir, (_event, name) => {
+      if (name && !files.includes(path.join(dir, name.toString()))) {
+        return;
+      }
+      if (timer) {
+        clearTimeout(timer);
+      }
+      timer = setTimeout(start, 200);
+    });
+  }
+  start();
+}
+
+// Paths the server's defaults assume inside its container are replaced with local ones.
+function loadCliConfig(file: string | undefined): AppConfig {
+  const config = loadConfig({
+    file,
+    defaults: {
+      'sandbox.work_root': path.join(os.tmpdir(), 'codexec'),
+      'sandbox.seccomp_profile': path.join(repoRoot, 'seccomp', 'default.json'),
+      'sandbox.runners_dir': path.join(repoRoot, 'runners')
+    }
+  });
+  fs.mkdirSync(config.sandbox.work_root, { recursive: true });
+  return config;
+}
+
+async function main(argv: string[]) {
+  const [command, ...rest] = argv;
+  const own = rest.includes('--') ? rest.slice(0, rest.indexOf('--')) : rest;
+  const known = command === 'run' || command === 'replay';
+  if (!known || own.includes('--help') || own.includes('-h')) {
+    process.stderr.write(`${command === 'replay' ? REPLAY_USAGE : USAGE}\n`);
+    return known || command === '--help' || command === '-h' ? 0 : 2;
+  }
+  if (command === 'replay') {
+    const options = parseReplayArgs(rest);
+    const config = loadCliConfig(options.config);
+    const controller = new AbortController();
+    process.once('SIGINT', () => controller.abort());
+    return exitStatus(await replay(options, createSandbox(options, config), config, controller.signal));
+  }
+  const options = parseRunArgs(rest);
+  const config = loadCliConfig(options.config);
+  const sandbox = createSandbox(options, config);
+  if (options.watch) {
+    watch(options, sandbox, config);
+    return null;
+  }
+  const controller = new AbortController();
+  process.once('SIGINT', () => controller.abort());
+  return exitStatus(await runOnce(options, sandbox, config, controller.signal));
+}
+
+main(process.argv.slice(2)).then(
+  (code) => {
+    if (code !== null) {
+      process.exitCode = code;
+    }
+  },
+  (err: Error) => {
+    process.stderr.write(`codexec: ${err.message}\n`);
+    process.exitCode = 2;
+  }
+);
@@ -0,0 +1,193 @@
+import fs from 'node:fs';
+import path from 'node:path';
+import YAML from 'yaml';
+import { parse as parseToml } from 'smol-toml';
+import { runnerRegistry } from '../core/runners.js';
+import { METADATA_KEY_PATTERN } from '../store/store.js';
+import { SETTINGS } from './settings.js';
+import type { AppConfig, Setting } from './settings.js';
+
+export type { AppConfig, ApiKeyConfig } from './settings.js';
+
+export interface LoadConfigOptions {
+  // YAML (.yaml, .yml), TOML (.toml) or JSON (.json) file; only defaults and the environment
+  // apply when unset.
+  file?: string;
+  env?: NodeJS.ProcessEnv;
+  // Replacements for built-in defaults by setting path, e.g. for tools run outside the server's
+  // container; the file and the environment still take precedence.
+  defaults?: Record<string, unknown>;
+}
+
+// Settings resolve in order: built-in defaults, then the configuration file, then environment
+// variables, so a deployment can keep one file and still override single values per host.
+// Every problem found is reported at once, naming the setting and where its value came from.
+export function loadConfig(options: LoadConfigOptions = {}): AppConfig {
+  const env = options.env ?? process.env;
+  const file = options.file ? readConfigFile(options.file) : {};
+  const config: Record<string, unknown> = {};
+  const errors: string[] = [];
+  for (const setting of SETTINGS) {
+    // Settings without a default are still created, so every section exists.
+    const value = options.defaults?.[setting.path] ?? setting.default;
+    setPath(config, setting.path, typeof value === 'function' ? value() : value);
+  }
+  for (const setting of SETTINGS) {
+    const fromFile = getPath(file, setting.path);
+    if (fromFile !== undefined && fromFile !== null) {
+      apply(config, setting, () => setting.kind.fromFile(fromFile), `${setting.path} in ${options.file}`, errors);
+    }
+    const fromEnv = setting.env ? env[setting.env] : undefined;
+    if (setting.env && fromEnv) {
+      apply(config, setting, () => setting.kind.fromEnv(fromEnv), setting.env, errors);
+    }
+  }
+  for (const key of leafPaths(file)) {
+    if (!SETTINGS.some((setting) => setting.path === key)) {
+      errors.push(`${key} in ${options.file}: unknown setting`);
+    }
+  }
+  const loaded = config as unknown as AppConfig;
+  const known = new Set(runnerRegistry.list().map((runner) => runner.language));
+  for (const language of [...(loaded.languages.enabled ?? []), ...loaded.sandbox.warm_pool.languages, ...Object.keys(loaded.limits.languages)]) {
+    if (!known.has(language)) {
+      errors.push(`unknown language: ${language}`);
+    }
+  }
+  for (const language of loaded.sandbox.warm_pool.languages) {
+    if (loaded.languages.enabled && !loaded.languages.enabled.includes(language)) {
+      errors.push(`sandbox.warm_pool.languages: ${language} is not enabled`);
+    }
+  }
+  for (const [name, limit] of Object.entries(loaded.limits.defaults)) {
+    if (limit > loaded.limits.max[name as keyof typeof loaded.limits.max]) {
+      errors.push(`limits.defaults.${name} exceeds limits.max.${name}`);
+    }
+  }
+  for (const [language, overrides] of Object.entries(loaded.limits.languages)) {
+    for (const name of Object.keys({ ...overrides.defaults, ...overrides.max }) as Array<keyof typeof loaded.limits.max>) {
+      const limit = overrides.defaults?.[name] ?? loaded.limits.defaults[name];
+      if (limit > (overrides.max?.[name] ?? loaded.limits.max[name])) {
+        errors.push(`limits.languages.${language}: defaults.${name} exceeds max.${name}`);
+      }
+    }
+  }
+  for (const threshold of loaded.sandbox.memory_warnings) {
+    if (threshold < 1 || threshold > 99) {
+      errors.push(`sandbox.memory_warnings: ${threshold} must be a percentage from 1 to 99`);
+    }
+  }
+  if (loaded.sandbox.max_usage_samples < 2) {
+    errors.push('sandbox.max_usage_samples must be at least 2');
+  }
+  if (loaded.cache.build_layers === 'overlay' && (!loaded.cache.build_dir || loaded.sandbox.backend !== 'docker')) {
+    errors.push('cache.build_layers overlay requires cache.build_dir and sandbox.backend docker');
+  }
+  for (const key of loaded.store.metadata_indexes) {
+    if (!METADATA_KEY_PATTERN.test(key)) {
+      errors.push(`store.metadata_indexes: ${key} is not a valid metadata key`);
+    }
+  }
+  if (loaded.faults.rate > 1) {
+    errors.push('faults.rate must be a share of runs from 0 to 1');
+  }
+  if (loaded.faults.rate > 0 && !loaded.faults.enabled) {
+    errors.push('faults.rate requires faults.enabled');
+  }
+  const storage = loaded.storage;
+  const required = storage.backend === 's3'
+    ? { bucket: storage.bucket, 's3.region': storage.s3.region, 's3.access_key_id': storage.s3.access_key_id, 's3.secret_access_key': storage.s3.secret_access_key }
+    : storage.backend === 'gcs' ? { bucket: storage.bucket, 'gcs.credentials_file': storage.gcs.credentials_file } : {};
+  for (const [name, value] of Object.entries(required)) {
+    if (!value) {
+      errors.push(`storage.${name} is required with storage.backend ${storage.backend}`);
+    }
+  }
+  const retention = loaded.retention;
+  if (retention.days > 0 && (retention.interval_ms === 0 || retention.batch_size === 0)) {
+    errors.push('retention.interval_ms and retention.batch_size must be positive with retention.days set');
+  }
+  const schedules = loaded.schedules;
+  if (schedules.interval_ms > 0 && (schedules.max_per_key === 0 || schedules.history === 0)) {
+    errors.push('schedules.max_per_key and schedules.history must be positive with schedules.interval_ms set');
+  }
+  const cluster = loaded.cluster;
+  if (cluster.role !== 'standalone' && !cluster.token) {
+    errors.push(`cluster.token is required with cluster.role ${cluster.role}`);
+  }
+  if (cluster.role === 'worker' && !cluster.coordinator) {
+    errors.push('cluster.coordinator is required with cluster.role worker');
+  }
+  if (errors.length > 0) {
+    throw new Error(`invalid configuration:\n  ${errors.join('\n  ')}`);
+  }
+  return loaded;
+}
+
+// What --print-config shows: the resolved settings with secrets and API key tokens hidden.
+export function formatConfig(config: AppConfig): string {
+  const copy = JSON.parse(JSON.stringify(config)) as Record<string, unknown>;
+  for (const setting of SETTINGS.filter((entry) => entry.secret)) {
+    const value = getPath(copy, setting.path);
+    if (Array.isArray(value)) {
+      setPath(copy, setting.path, value.map((key) => ({ ...key, token: '<redacted>' })));
+    } else if (value !== undefined) {
+      setPath(copy, setting.path, '<redacted>');
+    }
+  }
+  return `${JSON.stringify(copy, null, 2)}\n`;
+}
+
+function readConfigFile(file: string): Record<string, unknown> {
+  const text = fs.readFileSync(file, 'utf8');
+  const extension = path.extname(file).toLowerCase();
+  const parsed: unknown = extension === '.toml'
+    ? parseToml(text)
+    : extension === '.json'
+      ? JSON.parse(text)
+      : YAML.parse(text);
+  if (parsed === null || parsed === undefined) {
+    return {};
+  }
+  if (typeof parsed !== 'object' || Array.isArray(parsed)) {
+    throw new Error(`invalid configuration: ${file} must hold a table of settings`);
+  }
+  return parsed as Record<string, unknown>;
+}
+
+function apply(config: Record<string, unknown>, setting: Setting, read: () => unknown, source: string, errors: string[]) {
+  try {
+    setPath(config, setting.path, read());
+  } catch (err) {
+    errors.push(`${source}: ${(err as Error).message}`);
+  }
+}
+
+function getPath(target: Record<string, unknown>, dotted: string): unknown {
+  let current: unknown = target;
+  for (const key of dotted.split('.')) {
+    if (typeof current !== 'object' || current === null) {
+      return undefined;
+    }
+    current = (current as Record<string, unknown>)[key];
+  }
+  return current;
+}
+
+function setPath(target: Record<string, unknown>, dotted: string, value: unknown) {
+  const keys = dotted.split('.');
+  let current = target;
+  for (const key of keys.slice(0, -1)) {
+    current[key] ??= {};
+    current = current[key] as Record<string, unknown>;
+  }
+  current[keys[keys.length - 1]] = value;
+}
+
+// Dotted paths of a parsed file's values; tables stop at the settings whose value is a table.
+function leafPaths(value: unknown, prefix = ''): string[] {
+  if (typeof value !== 'object' || value === null || Array.isArray(value) || SETTINGS.some((setting) => setting.path === prefix)) {
+    return prefix ? [prefix] : [];
+  }
+  return Object.entries(value).flatMap(([key, child]) => leafPaths(child, prefix ? `${prefix}.${key}` : key));
+}
@@ -0,0 +1,778 @@
+import os from 'node:os';
+import path from 'node:path';
+import { DEFAULT_LIMITS, MAX_LIMITS } from '../core/limits.js';
+import type { LanguageLimits } from '../core/limits.js';
+import { parseGpuDevices } from '../core/gpu.js';
+import type { GpuDevice } from '../core/gpu.js';
+import { FAULT_KINDS } from '../core/faults.js';
+import { HOOK_EVENTS } from '../core/hooks.js';
+import { parsePolicyRules } from '../core/policy_scanner.js';
+import type { PolicyRule } from '../core/policy_scanner.js';
+import type { HookEvent } from '../core/hooks.js';
+import type { FaultKind, IsolationLevel, Language, RunAsUser, RunLimits } from '../core/types.js';
+import { LOG_LEVELS } from '../util/logger.js';
+import type { LogLevel } from '../util/logger.js';
+
+export interface ApiKeyConfig {
+  token: string;
+  label: string;
+  rate_limit_rps: number;
+  burst: number;
+  // Tier settings, only available in the file.
+  monthly_executions?: number;
+  max_timeout_ms?: number;
+  max_memory_mb?: number;
+  tenant?: string;
+  max_concurrent?: number;
+}
+
+// Everything the server reads at startup, grouped the way the configuration file is.
+export interface AppConfig {
+  server: {
+    port: number;
+    public_base_url: string;
+    admin_ui_path?: string;
+    // The gRPC API is only served when a port is set.
+    grpc_port?: number;
+    grpc_proto_path: string;
+    // The OpenAPI spec /openapi.json is built from and request bodies are checked against.
+    openapi_spec_path: string;
+    // Whether request bodies with fields the spec doesn't know are refused or have them ignored.
+    unknown_fields: 'reject' | 'ignore';
+    metrics_enabled: boolean;
+    api_keys: ApiKeyConfig[];
+    // Bearer token for the /admin API-key routes, which are off when unset.
+    admin_token?: string;
+    signing_key: string;
+    // How long a shutdown waits for in-flight executions before canceling them.
+    drain_timeout_ms: number;
+    // How often /readyz re-runs every runner's probe program; never probed when 0.
+    readiness_probe_interval_ms: number;
+  };
+  store: {
+    url?: string;
+    // Metadata keys given an index in the SQLite and PostgreSQL stores, for the ones listings
+    // filter by most.
+    metadata_indexes: string[];
+    // Keep a fingerprint of every submission's sources, for /v1/executions/:id/similar.
+    fingerprints: boolean;
+  };
+  storage: {
+    dir: string;
+    host_dir?: string;
+    // Where run artifacts are kept: `dir`, served on /v1/files, or a bucket of S3 or GCS whose
+    // signed URLs the records link to directly.
+    backend: 'filesystem' | 's3' | 'gcs';
+    bucket?: string;
+    prefix?: string;
+    url_ttl_seconds: number;
+    // Largest artifact `inline_artifacts` returns in the record; unlimited when unset.
+    max_inline_bytes?: number;
+    s3: {
+      region?: string;
+      // S3-compatible services, addressed path-style; AWS when unset.
+      endpoint?: string;
+      access_key_id?: string;
+      secret_access_key?: string;
+      session_token?: string;
+    };
+    gcs: {
+      // Service account key file.
+      credentials_file?: string;
+      endpoint?: string;
+    };
+  };
+  languages: {
+    // Runners requests may use; every registered runner when unset.
+    enabled?: Language[];
+    go: {
+      // GOPROXY for module downloads; Go's own default when unset.
+      proxy?: string;
+      // Never download modules, so go.mod submissions build against the shared module cache as
+      // seeded by the operator, or their own vendor/ directory.
+      offline: boolean;
+    };
+    shell: {
+      // Run bash scripts as a restricted shell (rbash), confined to the runner's toolbox.
+      restricted: boolean;
+    };
+  };
+  limits: {
+    defaults: RunLimits;
+    max: RunLimits;
+    // Keyed by language; limits a language leaves out are those above.
+    languages: Record<string, LanguageLimits>;
+  };
+  sandbox: {
+    backend: 'docker' | 'process';
+    work_root: string;
+    host_work_root?: string;
+    cli?: string;
+    seccomp_profile: string;
+    apparmor_profile?: string;
+    process_seccomp_profile?: string;
+    disable_security: boolean;
+    runners_dir: string;
+    default_isolation?: IsolationLevel;
+    run_as?: RunAsUser;
+    userns?: string;
+    gvisor_runtime?: string;
+    microvm_runtime?: string;
+    // GPUs runs may reserve; requests for a GPU are refused when empty.
+    gpus: GpuDevice[];
+    gpu_runtime: string;
+    pull_versions: boolean;
+    // Runner images by `language` or `language@version`, pulled and pinned by digest at startup.
+    images: {
+      catalog: Record<string, string>;
+      pull: boolean;
+      gc: boolean;
+    };
+    // Directories requests may mount by host_path, mapped to where the Docker daemon sees them.
+    mount_roots: Record<string, string>;
+    warm_pool: {
+      size: number;
+      isolation?: IsolationLevel[];
+      refill: 'eager' | 'lazy';
+      max_idle_ms?: number;
+      languages: string[];
+    };
+    // The WASI runtime behind isolation `wasm`; that level is refused while runtime is unset.
+    wasm: {
+      runtime?: string;
+      wasi_sdk?: string;
+      fuel?: number;
+      cache_dir?: string;
+    };
+    egress: {
+      network?: string;
+      proxy_host: string;
+      proxy_port: number;
+      allowlist: string[];
+    };
+    // Percentages of memory_mb at which a run's stream and trail get a memory_pressure warning;
+    // none are sent when empty.
+    memory_warnings: number[];
+    // Samples a run's usage_samples keeps before it thins them out.
+    max_usage_samples: number;
+    // The host's cgroup v2 hierarchy as the API sees it, which the docker backend samples
+    // containers' memory and CPU time from.
+    cgroup_root: string;
+  };
+  cache: {
+    dependency_dir?: string;
+    host_dependency_dir?: string;
+    build_dir?: string;
+    build_max_mb: number;
+    // How cached builds reach their runs; `overlay` mounts them rather than copying and needs the
+    // docker backend.
+    build_layers: 'copy' | 'overlay';
+    host_build_dir?: string;
+    // Results of `deterministic` runs kept in memory; none are cached when 0.
+    results_max_entries: number;
+    results_ttl_ms: number;
+  };
+  // Removes work directories, sandbox containers and cache entries that crashed executions left
+  // behind; off when interval_ms is 0.
+  janitor: {
+    interval_ms: number;
+    ttl_ms: number;
+    cache_ttl_ms: number;
+  };
+  // Takes executions that finished more than `days` ago out of the execution store, archiving
+  // them to object storage or deleting them; executions are kept for good when days is 0.
+  retention: {
+    days: number;
+    action: 'archive' | 'delete';
+    interval_ms: number;
+    batch_size: number;
+  };
+  // Runs stored submissions on cron expressions; no schedules run, and /v1/schedules isn't
+  // served, when interval_ms is 0.
+  schedules: {
+    interval_ms: number;
+    max_per_key: number;
+    // Occurrences kept in each schedule's history.
+    history: number;
+  };
+  queue: {
+    concurrency: number;
+    max_depth: number;
+    // Runs one tenant may execute at once unless its key sets max_concurrent; uncapped when unset.
+    tenant_concurrency?: number;
+    // Workers kept for each priority class that no other class may take.
+    reservations: {
+      interactive: number;
+      normal: number;
+      batch: number;
+    };
+    // A queued run counts as one priority class more urgent for every aging_ms it waits; 0 turns
+    // aging off.
+    aging_ms: number;
+  };
+  // Distributed mode. A coordinator accepts submissions and hands their runs to the workers
+  // connected to its port; a worker runs them and serves no API of its own.
+  cluster: {
+    role: 'standalone' | 'coordinator' | 'worker';
+    port: number;
+    // Shared by the coordinator and its workers; required in either role.
+    token?: string;
+    // The coordinator's host:port, for workers.
+    coordinator?: string;
+    worker_id: string;
+    // Runs a worker takes at once; queue.concurrency when unset.
+    capacity?: number;
+    heartbeat_ms: number;
+    reconnect_ms: number;
+    worker_timeout_ms: number;
+    dispatch_timeout_ms: number;
+    max_attempts: number;
+  };
+  judge: {
+    concurrency: number;
+    max_cases: number;
+  };
+  benchmark: {
+    max_iterations: number;
+  };
+  compare: {
+    max_runs: number;
+  };
+  fuzz: {
+    max_runs: number;
+    max_budget_ms: number;
+    concurrency: number;
+  };
+  // Compute units a run's cost counts per CPU-second, per GB-second of its memory limit and per
+  // second of sandbox time.
+  cost: {
+    cpu_second_units: number;
+    gb_second_units: number;
+    sandbox_second_units: number;
+  };
+  // Fault injection for test deployments; see FaultInjector.
+  faults: {
+    enabled: boolean;
+    rate: number;
+    kinds: FaultKind[];
+    delay_ms: number;
+  };
+  pipeline: {
+    max_stages: number;
+  };
+  batch: {
+    concurrency: number;
+    max_submissions: number;
+    max_body: string;
+  };
+  // Archives uploaded to /v1/datasets and what they may extract to.
+  datasets: {
+    max_archive_bytes: number;
+    max_bytes: number;
+    max_files: number;
+  };
+  submission: {
+    max_files: number;
+    max_bytes: number;
+    max_file_bytes?: number;
+    allow_binary: boolean;
+    // What submissions may not contain, only available in the file.
+    rules: PolicyRule[];
+  };
+  env_policy: {
+    allowlist?: string[];
+    deny_prefixes?: string[];
+    max_bytes?: number;
+  };
+  webhooks: {
+    secret?: string;
+    allowed_hosts?: string[];
+    max_attempts: number;
+    timeout_ms: number;
+  };
+  // Ed25519 signing of run records and judge results.
+  result_signing: {
+    // PKCS#8 PEM; results go out unsigned without one.
+    private_key_file?: string;
+  };
+  // Programs called around every run, by hook name.
+  hooks: {
+    commands: Record<string, { command: string[]; events?: HookEvent[] }>;
+    timeout_ms: number;
+    fail_open: boolean;
+  };
+  tracing: {
+    endpoint?: string;
+    traces_endpoint?: string;
+    service_name: string;
+  };
+  logging: {
+    level: LogLevel;
+    // Whether a request's X-Log-Level: debug header turns on debug logging for it and its runs.
+    request_debug: boolean;
+  };
+}
+
+// How a setting is read: from the configuration file's own types, or from the string form an
+// environment variable holds. Either returns the value or throws a message naming the problem.
+export interface SettingKind {
+  fromFile(value: unknown): unknown;
+  fromEnv(value: string): unknown;
+}
+
+export interface Setting {
+  // Dotted location in AppConfig and in the configuration file.
+  path: string;
+  env?: string;
+  kind: SettingKind;
+  default?: unknown | (() => unknown);
+  // Values printed as <redacted> by --print-config.
+  secret?: boolean;
+}
+
+const string: SettingKind = {
+  fromFile(value) {
+    if (typeof value !== 'string') {
+      throw new Error('expected a string');
+    }
+    return value;
+  },
+  fromEnv: (value) => value
+};
+
+const integer: SettingKind = {
+  fromFile(value) {
+    if (typeof value !== 'number' || !Number.isInteger(value) || value < 0) {
+      throw new Error('expected a non-negative integer');
+    }
+    return value;
+  },
+  fromEnv(value) {
+    return integer.fromFile(/^\d+$/.test(value) ? Number(value) : value);
+  }
+};
+
+const decimal: SettingKind = {
+  fromFile(value) {
+    if (typeof value !== 'number' || !Number.isFinite(value) || value < 0) {
+      throw new Error('expected a non-negative number');
+    }
+    return value;
+  },
+  fromEnv(value) {
+    return decimal.fromFile(/^\d+(\.\d+)?$/.test(value) ? Number(value) : value);
+  }
+};
+
+const boolean: SettingKind = {
+  fromFile(value) {
+    if (typeof value !== 'boolean') {
+      throw new Error('expected true or false');
+    }
+    return value;
+  },
+  fromEnv(value) {
+    if (['1', 'true', 'yes'].includes(value.toLowerCase())) {
+      return true;
+    }
+    if (['0', 'false', 'no'].includes(value.toLowerCase())) {
+      return false;
+    }
+    throw new Error('expected 1/true or 0/false');
+  }
+};
+
+function oneOf(...values: string[]): SettingKind {
+  const check = (value: unknown) => {
+    if (typeof value !== 'string' || !values.includes(value)) {
+      throw new Error(`expected one of ${values.join(', ')}`);
+    }
+    return value;
+  };
+  return { fromFile: check, fromEnv: check };
+}
+
+// Lists are arrays in the file and comma-separated in the environment, as before.
+function listOf(item: SettingKind = string): SettingKind {
+  return {
+    fromFile(value) {
+      if (!Array.isArray(value)) {
+        throw new Error('expected a list');
+      }
+      return value.map((entry) => item.fromFile(entry));
+    },
+    fromEnv: (value) => value.split(',').map((entry) => entry.trim()).filter(Boolean).map((entry) => item.fromEnv(entry))
+  };
+}
+
+// `token:label:rps:burst` entries in API_KEYS; objects with the same fields in the file.
+const apiKeys: SettingKind = {
+  fromFile(value) {
+    if (!Array.isArray(value)) {
+      throw new Error('expected a list of keys');
+    }
+    return value.map((entry: Partial<ApiKeyConfig>) => {
+      if (typeof entry?.token !== 'string' || !entry.token) {
+        throw new Error('every key needs a token');
+      }
+      if (entry.tenant !== undefined && (typeof entry.tenant !== 'string' || !entry.tenant)) {
+        throw new Error('tenant must be a non-empty string');
+      }
+      for (const name of ['rate_limit_rps', 'burst', 'monthly_executions', 'max_timeout_ms', 'max_memory_mb', 'max_concurrent'] as const) {
+        if (entry[name] !== undefined && (typeof entry[name] !== 'number' || entry[name] <= 0)) {
+          throw new Error(`${name} must be a positive number`);
+        }
+      }
+      return {
+        token: entry.token,
+        label: entry.label ?? 'default',
+        rate_limit_rps: entry.rate_limit_rps ?? 5,
+        burst: entry.burst ?? 10,
+        monthly_executions: entry.monthly_executions,
+        max_timeout_ms: entry.max_timeout_ms,
+        max_memory_mb: entry.max_memory_mb,
+        tenant: entry.tenant,
+        max_concurrent: entry.max_concurrent
+      };
+    });
+  },
+  fromEnv(value) {
+    return value.split(',').filter(Boolean).map((entry) => {
+      const [token, label = 'default', rps = '5', burst = '10'] = entry.split(':');
+      return { token, label, rate_limit_rps: Number(rps), burst: Number(burst) };
+    });
+  }
+};
+
+// MOUNT_ROOTS entries are `path` or `path=host_path` when the Docker daemon sees the directory
+// somewhere else than the API does; the file takes the same strings or a path-to-host map.
+const mountRoots: SettingKind = {
+  fromFile(value) {
+    if (Array.isArray(value)) {
+      return mountRoots.fromEnv(listOf().fromFile(value).join(','));
+    }
+    if (typeof value !== 'object' || value === null) {
+      throw new Error('expected a list or a map of paths');
+    }
+    return Object.fromEntries(Object.entries(value).map(([apiPath, hostPath]) => [apiPath, string.fromFile(hostPath)]));
+  },
+  fromEnv(value) {
+    const roots: Record<string, string> = {};
+    for (const entry of listOf().fromEnv(value) as string[]) {
+      const [apiPath, hostPath = apiPath] = entry.split('=');
+      roots[apiPath] = hostPath;
+    }
+    return roots;
+  }
+};
+
+// `uid` or `uid:gid`, the group defaulting to the uid.
+const runAs: SettingKind = {
+  fromFile(value) {
+    return runAs.fromEnv(typeof value === 'number' ? String(value) : string.fromFile(value) as string);
+  },
+  fromEnv(value) {
+    const match = /^(\d+)(?::(\d+))?$/.exec(value);
+    if (!match) {
+      throw new Error('expected uid or uid:gid');
+    }
+    return { uid: Number(match[1]), gid: Number(match[2] ?? match[1]) };
+  }
+};
+
+// SANDBOX_IMAGES entries are `language=image` or `language@version=image`; the file takes a table.
+const imageCatalog: SettingKind = {
+  fromFile(value) {
+    if (typeof value !== 'object' || value === null || Array.isArray(value)) {
+      throw new Error('expected a table of images');
+    }
+    return Object.fromEntries(Object.entries(value).map(([key, image]) => [key, string.fromFile(image)]));
+  },
+  fromEnv(value) {
+    const catalog: Record<string, string> = {};
+    for (const entry of listOf().fromEnv(value) as string[]) {
+      const at = entry.indexOf('=');
+      if (at <= 0 || at === entry.length - 1) {
+        throw new Error('expected language=image or language@version=image');
+      }
+      catalog[entry.slice(0, at)] = entry.slice(at + 1);
+    }
+    return catalog;
+  }
+};
+
+// HOOK_COMMANDS entries are `name=program args…`, called for every event; the file takes a
+// table of commands, as strings, argument lists or {command, events} tables.
+const hookCommands: SettingKind = {
+  fromFile(value) {
+    if (typeof value !== 'object' || value === null || Array.isArray(value)) {
+      throw new Error('expected a table of hook commands');
+    }
+    return Object.fromEntries(
+      Object.entries(value).map(([name, hook]) => {
+        const table = typeof hook === 'object' && hook !== null && !Array.isArray(hook) ? (hook as Record<string, unknown>) : { command: hook };
+        const command = (typeof table.command === 'string' ? table.command.trim().split(/\s+/) : listOf().fromFile(table.command)) as string[];
+        if (!command[0]) {
+          throw new Error(`hook ${name} needs a command`);
+        }
+        const events = table.events === undefined ? undefined : listOf(oneOf(...HOOK_EVENTS)).fromFile(table.events);
+        return [name, events ? { command, events } : { command }];
+      })
+    );
+  },
+  fromEnv(value) {
+    const commands: Record<string, string> = {};
+    for (const entry of listOf().fromEnv(value) as string[]) {
+      const at = entry.indexOf('=');
+      if (at <= 0 || at === entry.length - 1) {
+        throw new Error('expected name=command');
+      }
+      commands[entry.slice(0, at)] = entry.slice(at + 1);
+    }
+    return hookCommands.fromFile(commands);
+  }
+};
+
+// SANDBOX_GPUS entries are `id:vram_mb`; the file takes the same strings or {id, vram_mb} tables.
+const gpuDevices: SettingKind = {
+  fromFile(value) {
+    if (!Array.isArray(value)) {
+      throw new Error('expected a list of GPUs');
+    }
+    return value.flatMap((entry) => {
+      if (typeof entry === 'string') {
+        return parseGpuDevices(entry);
+      }
+      if (typeof entry !== 'object' || entry === null || typeof entry.id !== 'string' || !Number.isInteger(entry.vram_mb) || entry.vram_mb <= 0) {
+        throw new Error('expected id:vram_mb or a table with id and vram_mb');
+      }
+      return [{ id: entry.id, vram_mb: entry.vram_mb }];
+    });
+  },
+  fromEnv(value) {
+    return parseGpuDevices(value);
+  }
+};
+
+// A table of run limits; keys it leaves out keep the built-in value.
+function limitsOver(base: RunLimits): SettingKind {
+  return {
+    fromFile(value) {
+      if (typeof value !== 'object' || value === null || Array.isArray(value)) {
+        throw new Error('expected a table of limits');
+      }
+      const limits = { ...base };
+      for (const [name, limit] of Object.entries(value)) {
+        if (!(name in base)) {
+          throw new Error(`unknown limit ${name}`);
+        }
+        if (typeof limit !== 'number' || !Number.isInteger(limit) || limit <= 0) {
+          throw new Error(`${name} must be a positive integer`);
+        }
+        limits[name as keyof RunLimits] = limit;
+      }
+      return limits;
+    },
+    fromEnv() {
+      throw new Error('limits can only be set in the configuration file');
+    }
+  };
+}
+
+// Per-language `defaults` and `max` tables, each holding only the limits that language changes.
+const languageLimits: SettingKind = {
+  fromFile(value) {
+    if (typeof value !== 'object' || value === null || Array.isArray(value)) {
+      throw new Error('expected a table of languages');
+    }
+    const languages: Record<string, LanguageLimits> = {};
+    for (const [language, entry] of Object.entries(value)) {
+      if (typeof entry !== 'object' || entry === null || Array.isArray(entry)) {
+        throw new Error(`${language}: expected a table with defaults and max`);
+      }
+      languages[language] = {};
+      for (const [section, limits] of Object.entries(entry)) {
+        if (section !== 'defaults' && section !== 'max') {
+          throw new Error(`${language}: unknown section ${section}`);
+        }
+        try {
+          const merged = limitsOver(MAX_LIMITS).fromFile(limits) as RunLimits;
+          languages[language][section] = Object.fromEntries(Object.keys(limits as object).map((name) => [name, merged[name as keyof RunLimits]]));
+        } catch (err) {
+          throw new Error(`${language}.${section}: ${(err as Error).message}`);
+        }
+      }
+    }
+    return languages;
+  },
+  fromEnv: limitsOver(MAX_LIMITS).fromEnv
+};
+
+// Policy rules are tables in the file; see PolicyRule.
+const policyRules: SettingKind = {
+  fromFile: parsePolicyRules,
+  fromEnv: (value) => parsePolicyRules(JSON.parse(value))
+};
+
+const isolation = oneOf('container', 'gvisor', 'microvm');
+
+export const SETTINGS: Setting[] = [
+  { path: 'server.port', env: 'PORT', kind: integer, default: 8080 },
+  { path: 'server.public_base_url', env: 'PUBLIC_BASE_URL', kind: string, default: 'http://localhost:8080' },
+  { path: 'server.admin_ui_path', env: 'ADMIN_UI_PATH', kind: string },
+  { path: 'server.grpc_port', env: 'GRPC_PORT', kind: integer },
+  { path: 'server.grpc_proto_path', env: 'GRPC_PROTO_PATH', kind: string, default: () => path.join(process.cwd(), 'proto', 'executor.proto') },
+  { path: 'server.openapi_spec_path', env: 'OPENAPI_SPEC_PATH', kind: string, default: () => path.join(process.cwd(), 'openapi', 'spec.yaml') },
+  { path: 'server.unknown_fields', env: 'UNKNOWN_FIELDS', kind: oneOf('reject', 'ignore'), default: 'reject' },
+  { path: 'server.metrics_enabled', env: 'METRICS_ENABLED', kind: boolean, default: false },
+  {
+    path: 'server.api_keys',
+    env: 'API_KEYS',
+    kind: apiKeys,
+    default: () => [{ token: 'dev_123', label: 'default', rate_limit_rps: 5, burst: 10 }],
+    secret: true
+  },
+  { path: 'server.admin_token', env: 'ADMIN_TOKEN', kind: string, secret: true },
+  { path: 'server.signing_key', env: 'SIGNING_KEY', kind: string, default: 'changeme-signing-key', secret: true },
+  { path: 'server.drain_timeout_ms', env: 'DRAIN_TIMEOUT_MS', kind: integer, default: 30000 },
+  { path: 'server.readiness_probe_interval_ms', env: 'READINESS_PROBE_INTERVAL_MS', kind: integer, default: 300000 },
+  { path: 'store.url', env: 'STORE_URL', kind: string, secret: true },
+  { path: 'store.metadata_indexes', env: 'STORE_METADATA_INDEXES', kind: listOf(), default: () => [] },
+  { path: 'store.fingerprints', env: 'STORE_FINGERPRINTS', kind: boolean, default: false },
+  { path: 'storage.dir', env: 'STORAGE_DIR', kind: string, default: () => path.join(process.cwd(), 'data') },
+  { path: 'storage.host_dir', env: 'HOST_STORAGE_DIR', kind: string },
+  { path: 'storage.backend', env: 'ARTIFACT_STORE', kind: oneOf('filesystem', 's3', 'gcs'), default: 'filesystem' },
+  { path: 'storage.bucket', env: 'ARTIFACT_BUCKET', kind: string },
+  { path: 'storage.prefix', env: 'ARTIFACT_PREFIX', kind: string },
+  { path: 'storage.url_ttl_seconds', env: 'ARTIFACT_URL_TTL_SECONDS', kind: integer, default: 600 },
+  { path: 'storage.max_inline_bytes', env: 'ARTIFACT_MAX_INLINE_BYTES', kind: integer },
+  { path: 'storage.s3.region', env: 'AWS_REGION', kind: string },
+  { path: 'storage.s3.endpoint', env: 'S3_ENDPOINT', kind: string },
+  { path: 'storage.s3.access_key_id', env: 'AWS_ACCESS_KEY_ID', kind: string },
+  { path: 'storage.s3.secret_access_key', env: 'AWS_SECRET_ACCESS_KEY', kind: string, secret: true },
+  { path: 'storage.s3.session_token', env: 'AWS_SESSION_TOKEN', kind: string, secret: true },
+  { path: 'storage.gcs.credentials_file', env: 'GOOGLE_APPLICATION_CREDENTIALS', kind: string },
+  { path: 'storage.gcs.endpoint', env: 'GCS_ENDPOINT', kind: string },
+  { path: 'languages.enabled', env: 'ENABLED_LANGUAGES', kind: listOf() },
+  { path: 'languages.go.proxy', env: 'GO_MODULE_PROXY', kind: string },
+  { path: 'languages.go.offline', env: 'GO_MODULES_OFFLINE', kind: boolean, default: false },
+  { path: 'languages.shell.restricted', env: 'SHELL_RESTRICTED', kind: boolean, default: true },
+  { path: 'limits.defaults', kind: limitsOver(DEFAULT_LIMITS), default: () => ({ ...DEFAULT_LIMITS }) },
+  { path: 'limits.max', kind: limitsOver(MAX_LIMITS), default: () => ({ ...MAX_LIMITS }) },
+  { path: 'limits.languages', kind: languageLimits, default: () => ({}) },
+  { path: 'sandbox.backend', env: 'SANDBOX_BACKEND', kind: oneOf('docker', 'process'), default: 'docker' },
+  { path: 'sandbox.work_root', env: 'SANDBOX_WORKDIR', kind: string, default: '/sandbox' },
+  { path: 'sandbox.host_work_root', env: 'HOST_SANDBOX_DIR', kind: string },
+  { path: 'sandbox.cli', env: 'SANDBOX_CLI', kind: string },
+  { path: 'sandbox.seccomp_profile', env: 'SECCOMP_PROFILE', kind: string, default: '/seccomp/default.json' },
+  { path: 'sandbox.apparmor_profile', env: 'APPARMOR_PROFILE', kind: string },
+  { path: 'sandbox.process_seccomp_profile', env: 'PROCESS_SECCOMP_PROFILE', kind: string },
+  { path: 'sandbox.disable_security', env: 'DISABLE_SANDBOX_SECURITY', kind: boolean, default: false },
+  { path: 'sandbox.runners_dir', env: 'RUNNERS_DIR', kind: string, default: () => path.join(process.cwd(), '..', 'runners') },
+  { path: 'sandbox.default_isolation', env: 'DEFAULT_ISOLATION', kind: isolation },
+  { path: 'sandbox.run_as', env: 'SANDBOX_RUN_AS', kind: runAs },
+  { path: 'sandbox.userns', env: 'SANDBOX_USERNS', kind: string },
+  { path: 'sandbox.gvisor_runtime', env: 'GVISOR_RUNTIME', kind: string },
+  { path: 'sandbox.microvm_runtime', env: 'MICROVM_RUNTIME', kind: string },
+  { path: 'sandbox.gpus', env: 'SANDBOX_GPUS', kind: gpuDevices, default: () => [] },
+  { path: 'sandbox.gpu_runtime', env: 'SANDBOX_GPU_RUNTIME', kind: string, default: 'nvidia' },
+  { path: 'sandbox.pull_versions', env: 'RUNNER_PULL_VERSIONS', kind: boolean, default: false },
+  { path: 'sandbox.images.catalog', env: 'SANDBOX_IMAGES', kind: imageCatalog, default: () => ({}) },
+  { path: 'sandbox.images.pull', env: 'SANDBOX_IMAGES_PULL', kind: boolean, default: true },
+  { path: 'sandbox.images.gc', env: 'SANDBOX_IMAGES_GC', kind: boolean, default: true },
+  { path: 'sandbox.mount_roots', env: 'MOUNT_ROOTS', kind: mountRoots, default: () => ({}) },
+  { path: 'sandbox.warm_pool.size', env: 'SANDBOX_WARM_POOL_SIZE', kind: integer, default: 0 },
+  { path: 'sandbox.warm_pool.isolation', env: 'SANDBOX_WARM_POOL_ISOLATION', kind: listOf(isolation) },
+  { path: 'sandbox.warm_pool.refill', env: 'SANDBOX_WARM_POOL_REFILL', kind: oneOf('eager', 'lazy'), default: 'eager' },
+  { path: 'sandbox.warm_pool.max_idle_ms', env: 'SANDBOX_WARM_POOL_MAX_IDLE_MS', kind: integer },
+  { path: 'sandbox.warm_pool.languages', env: 'SANDBOX_WARM_POOL_LANGUAGES', kind: listOf(), default: () => [] },
+  { path: 'sandbox.wasm.runtime', env: 'WASM_RUNTIME', kind: string },
+  { path: 'sandbox.wasm.wasi_sdk', env: 'WASI_SDK_PATH', kind: string },
+  { path: 'sandbox.wasm.fuel', env: 'WASM_FUEL', kind: integer },
+  { path: 'sandbox.wasm.cache_dir', env: 'WASM_CACHE_DIR', kind: string },
+  { path: 'sandbox.egress.network', env: 'SANDBOX_EGRESS_NETWORK', kind: string },
+  { path: 'sandbox.egress.proxy_host', env: 'EGRESS_PROXY_HOST', kind: string, default: 'api' },
+  { path: 'sandbox.egress.proxy_port', env: 'EGRESS_PROXY_PORT', kind: integer, default: 3128 },
+  { path: 'sandbox.egress.allowlist', env: 'EGRESS_ALLOWLIST', kind: listOf(), default: () => [] },
+  { path: 'sandbox.memory_warnings', env: 'SANDBOX_MEMORY_WARNINGS', kind: listOf(integer), default: () => [80, 95] },
+  { path: 'sandbox.max_usage_samples', env: 'SANDBOX_MAX_USAGE_SAMPLES', kind: integer, default: 1000 },
+  { path: 'sandbox.cgroup_root', env: 'SANDBOX_CGROUP_ROOT', kind: string, default: '/sys/fs/cgroup' },
+  { path: 'cache.dependency_dir', env: 'DEPENDENCY_CACHE_DIR', kind: string },
+  { path: 'cache.host_dependency_dir', env: 'HOST_CACHE_DIR', kind: string },
+  { path: 'cache.build_dir', env: 'BUILD_CACHE_DIR', kind: string },
+  { path: 'cache.build_max_mb', env: 'BUILD_CACHE_MAX_MB', kind: integer, default: 1024 },
+  { path: 'cache.build_layers', env: 'BUILD_CACHE_LAYERS', kind: oneOf('copy', 'overlay'), default: 'copy' },
+  { path: 'cache.host_build_dir', env: 'HOST_BUILD_CACHE_DIR', kind: string },
+  { path: 'cache.results_max_entries', env: 'RESULT_CACHE_MAX_ENTRIES', kind: integer, default: 10000 },
+  { path: 'cache.results_ttl_ms', env: 'RESULT_CACHE_TTL_MS', kind: integer, default: 24 * 3600000 },
+  { path: 'janitor.interval_ms', env: 'JANITOR_INTERVAL_MS', kind: integer, default: 600000 },
+  { path: 'janitor.ttl_ms', env: 'JANITOR_TTL_MS', kind: integer, default: 3600000 },
+  { path: 'janitor.cache_ttl_ms', env: 'JANITOR_CACHE_TTL_MS', kind: integer, default: 7 * 24 * 3600000 },
+  { path: 'retention.days', env: 'RETENTION_DAYS', kind: integer, default: 0 },
+  { path: 'retention.action', env: 'RETENTION_ACTION', kind: oneOf('archive', 'delete'), default: 'archive' },
+  { path: 'retention.interval_ms', env: 'RETENTION_INTERVAL_MS', kind: integer, default: 3600000 },
+  { path: 'retention.batch_size', env: 'RETENTION_BATCH_SIZE', kind: integer, default: 500 },
+  { path: 'schedules.interval_ms', env: 'SCHEDULE_INTERVAL_MS', kind: integer, default: 15000 },
+  { path: 'schedules.max_per_key', env: 'SCHEDULE_MAX_PER_KEY', kind: integer, default: 20 },
+  { path: 'schedules.history', env: 'SCHEDULE_HISTORY', kind: integer, default: 100 },
+  { path: 'queue.concurrency', env: 'QUEUE_CONCURRENCY', kind: integer, default: 4 },
+  { path: 'queue.max_depth', env: 'QUEUE_MAX_DEPTH', kind: integer, default: 100 },
+  { path: 'queue.tenant_concurrency', env: 'QUEUE_TENANT_CONCURRENCY', kind: integer },
+  { path: 'queue.reservations.interactive', env: 'QUEUE_RESERVED_INTERACTIVE', kind: integer, default: 0 },
+  { path: 'queue.reservations.normal', env: 'QUEUE_RESERVED_NORMAL', kind: integer, default: 0 },
+  { path: 'queue.reservations.batch', env: 'QUEUE_RESERVED_BATCH', kind: integer, default: 0 },
+  { path: 'queue.aging_ms', env: 'QUEUE_AGING_MS', kind: integer, default: 30000 },
+  { path: 'cluster.role', env: 'CLUSTER_ROLE', kind: oneOf('standalone', 'coordinator', 'worker'), default: 'standalone' },
+  { path: 'cluster.port', env: 'CLUSTER_PORT', kind: integer, default: 7070 },
+  { path: 'cluster.token', env: 'CLUSTER_TOKEN', kind: string, secret: true },
+  { path: 'cluster.coordinator', env: 'CLUSTER_COORDINATOR', kind: string },
+  { path: 'cluster.worker_id', env: 'CLUSTER_WORKER_ID', kind: string, default: () => os.hostname() },
+  { path: 'cluster.capacity', env: 'CLUSTER_WORKER_CAPACITY', kind: integer },
+  { path: 'cluster.heartbeat_ms', env: 'CLUSTER_HEARTBEAT_MS', kind: integer, default: 5000 },
+  { path: 'cluster.reconnect_ms', env: 'CLUSTER_RECONNECT_MS', kind: integer, default: 2000 },
+  { path: 'cluster.worker_timeout_ms', env: 'CLUSTER_WORKER_TIMEOUT_MS', kind: integer, default: 15000 },
+  { path: 'cluster.dispatch_timeout_ms', env: 'CLUSTER_DISPATCH_TIMEOUT_MS', kind: integer, default: 30000 },
+  { path: 'cluster.max_attempts', env: 'CLUSTER_MAX_ATTEMPTS', kind: integer, default: 3 },
+  { path: 'judge.concurrency', env: 'JUDGE_CONCURRENCY', kind: integer, default: 4 },
+  { path: 'judge.max_cases', env: 'JUDGE_MAX_CASES', kind: integer, default: 100 },
+  { path: 'benchmark.max_iterations', env: 'BENCHMARK_MAX_ITERATIONS', kind: integer, default: 100 },
+  { path: 'compare.max_runs', env: 'COMPARE_MAX_RUNS', kind: integer, default: 100 },
+  { path: 'fuzz.max_runs', env: 'FUZZ_MAX_RUNS', kind: integer, default: 1000 },
+  { path: 'fuzz.max_budget_ms', env: 'FUZZ_MAX_BUDGET_MS', kind: integer, default: 300000 },
+  { path: 'fuzz.concurrency', env: 'FUZZ_CONCURRENCY', kind: integer, default: 4 },
+  { path: 'cost.cpu_second_units', env: 'COST_CPU_SECOND_UNITS', kind: decimal, default: 1 },
+  { path: 'cost.gb_second_units', env: 'COST_GB_SECOND_UNITS', kind: decimal, default: 1 },
+  { path: 'cost.sandbox_second_units', env: 'COST_SANDBOX_SECOND_UNITS', kind: decimal, default: 0 },
+  { path: 'faults.enabled', env: 'FAULTS_ENABLED', kind: boolean, default: false },
+  { path: 'faults.rate', env: 'FAULTS_RATE', kind: decimal, default: 0 },
+  { path: 'faults.kinds', env: 'FAULTS_KINDS', kind: listOf(oneOf(...FAULT_KINDS)), default: () => [...FAULT_KINDS] },
+  { path: 'faults.delay_ms', env: 'FAULTS_DELAY_MS', kind: integer, default: 5000 },
+  { path: 'pipeline.max_stages', env: 'PIPELINE_MAX_STAGES', kind: integer, default: 10 },
+  { path: 'batch.concurrency', env: 'BATCH_CONCURRENCY', kind: integer, default: 4 },
+  { path: 'batch.max_submissions', env: 'BATCH_MAX_SUBMISSIONS', kind: integer, default: 100 },
+  { path: 'batch.max_body', env: 'BATCH_MAX_BODY', kind: string, default: '10mb' },
+  { path: 'datasets.max_archive_bytes', env: 'DATASET_MAX_ARCHIVE_BYTES', kind: integer, default: 2 * 1024 ** 3 },
+  { path: 'datasets.max_bytes', env: 'DATASET_MAX_BYTES', kind: integer, default: 8 * 1024 ** 3 },
+  { path: 'datasets.max_files', env: 'DATASET_MAX_FILES', kind: integer, default: 100_000 },
+  { path: 'submission.max_files', env: 'SUBMISSION_MAX_FILES', kind: integer, default: 100 },
+  { path: 'submission.max_bytes', env: 'SUBMISSION_MAX_BYTES', kind: integer, default: 200 * 1024 },
+  { path: 'submission.max_file_bytes', env: 'SUBMISSION_MAX_FILE_BYTES', kind: integer },
+  { path: 'submission.allow_binary', env: 'SUBMISSION_ALLOW_BINARY', kind: boolean, default: false },
+  { path: 'submission.rules', kind: policyRules, default: () => [] },
+  { path: 'env_policy.allowlist', env: 'ENV_ALLOWLIST', kind: listOf() },
+  { path: 'env_policy.deny_prefixes', env: 'ENV_DENY_PREFIXES', kind: listOf() },
+  { path: 'env_policy.max_bytes', env: 'ENV_MAX_BYTES', kind: integer },
+  { path: 'webhooks.secret', env: 'WEBHOOK_SECRET', kind: string, secret: true },
+  { path: 'webhooks.allowed_hosts', env: 'WEBHOOK_ALLOWED_HOSTS', kind: listOf() },
+  { path: 'webhooks.max_attempts', env: 'WEBHOOK_MAX_ATTEMPTS', kind: integer, default: 5 },
+  { path: 'webhooks.timeout_ms', env: 'WEBHOOK_TIMEOUT_MS', kind: integer, default: 10_000 },
+  { path: 'result_signing.private_key_file', env: 'RESULT_SIGNING_KEY_FILE', kind: string },
+  { path: 'hooks.commands', env: 'HOOK_COMMANDS', kind: hookCommands, default: () => ({}) },
+  { path: 'hooks.timeout_ms', env: 'HOOK_TIMEOUT_MS', kind: integer, default: 10_000 },
+  { path: 'hooks.fail_open', env: 'HOOK_FAIL_OPEN', kind: boolean, default: false },
+  { path: 'tracing.endpoint', env: 'OTEL_EXPORTER_OTLP_ENDPOINT', kind: string },
+  { path: 'tracing.traces_endpoint', env: 'OTEL_EXPORTER_OTLP_TRACES_ENDPOINT', kind: string },
+  { path: 'tracing.service_name', env: 'OTEL_SERVICE_NAME', kind: string, default: 'code-executor-api' },
+  { path: 'logging.level', env: 'LOG_LEVEL', kind: oneOf(...LOG_LEVELS), default: 'info' },
+  { path: 'logging.request_debug', env: 'LOG_REQUEST_DEBUG', kind: boolean, default: true }
+];
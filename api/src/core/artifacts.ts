@@ -0,0 +1,72 @@
+import fs from 'node:fs';
+import path from 'node:path';
+import { isRelativeInside } from './run_dir.js';
+import type { RunLimits, SandboxResult, SkippedArtifact } from './types.js';
+
+// Collection of the files a program leaves under outputs/. Backends list what is there after the
+// run; the orchestrator then decides which files to keep under the run's limits.
+
+export type OutputFile = SandboxResult['artifacts'][number];
+
+// Lists regular files under <runDir>/outputs, descending into subdirectories. Names are relative
+// to outputs/. Symlinks are skipped: the API reads these files on the host, where a link planted
+// by the program could point anywhere.
+export function listOutputs(runDir: string): OutputFile[] {
+  const outputsDir = path.join(runDir, 'outputs');
+  if (!fs.existsSync(outputsDir)) {
+    return [];
+  }
+  const files: OutputFile[] = [];
+  const walk = (relativeDir: string) => {
+    for (const entry of fs.readdirSync(path.join(outputsDir, relativeDir), { withFileTypes: true })) {
+      const name = relativeDir ? `${relativeDir}/${entry.name}` : entry.name;
+      if (entry.isDirectory()) {
+        walk(name);
+      } else if (entry.isFile()) {
+        const fullPath = path.join(outputsDir, name);
+        files.push({ path: fullPath, name, size: fs.lstatSync(fullPath).size });
+      }
+    }
+  };
+  walk('');
+  return files.sort((a, b) => a.name.localeCompare(b.name));
+}
+
+export interface ArtifactSelection {
+  kept: OutputFile[];
+  skipped: SkippedArtifact[];
+}
+
+// Applies the per-file, total size and file count caps in name order. Files outside the run's
+// outputs/ directory, and links or other entries that are not regular files, are never kept but
+// are listed as skipped like the rest.
+export function selectArtifacts(files: OutputFile[], workdir: string, limits: RunLimits): ArtifactSelection {
+  const outputsDir = path.join(workdir, 'outputs');
+  const selection: ArtifactSelection = { kept: [], skipped: [] };
+  let totalBytes = 0;
+  for (const file of files) {
+    const stat = fs.lstatSync(file.path, { throwIfNoEntry: false });
+    if (!stat) {
+      continue;
+    }
+    let reason: SkippedArtifact['reason'] | null = null;
+    if (!isRelativeInside(path.relative(outputsDir, file.path))) {
+      reason = 'outside_outputs';
+    } else if (!stat.isFile()) {
+      reason = 'not_a_file';
+    } else if (stat.size > limits.max_artifact_file_bytes) {
+      reason = 'file_too_large';
+    } else if (selection.kept.length >= limits.max_artifact_files) {
+      reason = 'too_many_files';
+    } else if (totalBytes + stat.size > limits.max_artifact_bytes) {
+      reason = 'total_too_large';
+    }
+    if (reason) {
+      selection.skipped.push({ name: file.name, size: stat.size, reason });
+      continue;
+    }
+    selection.kept.push({ ...file, size: stat.size });
+    totalBytes += stat.size;
+  }
+  return selection;
+}
@@ -0,0 +1,34 @@
+import type { Logger } from '../util/logger.js';
+import type { ExecutionStore } from '../store/store.js';
+import type { ExecutionEvent, ExecutionEventType } from './types.js';
+
+// Numbers an execution's events and appends them to the store one after another, so the trail
+// keeps its order even when the store is slow. A failed write is logged and the trail goes on;
+// without a store events are only counted. A resumed execution's trail carries on from `seq`.
+export class AuditTrail {
+  private written: Promise<void> = Promise.resolve();
+
+  constructor(
+    private readonly id: string,
+    private readonly store: ExecutionStore | undefined,
+    private readonly logger: Logger,
+    private seq = 0
+  ) { }
+
+  // `at` is for steps known only after the fact, such as phases the backend reports durations of.
+  public record(type: ExecutionEventType, data: Record<string, unknown> = {}, at = new Date()) {
+    const event: ExecutionEvent = { seq: this.seq++, type, at: at.toISOString(), data };
+    const store = this.store;
+    if (!store) {
+      return;
+    }
+    this.written = this.written
+      .then(() => store.appendEvent(this.id, event))
+      .catch((err: Error) => this.logger.error('execution event write failed', { runId: this.id, type, message: err.message }));
+  }
+
+  // Resolves once every event recorded so far is stored.
+  public flush() {
+    return this.written;
+  }
+}
@@ -1,26 +1,196 @@
+import crypto from 'node:crypto';
 import Boom from '@hapi/boom';
 import type { Request, Response, NextFunction } from 'express';
+import { TokenBucketLimiter } from './rate_limit.js';
+import type { TenantSlot } from './queue.js';
+import type { RunLimits } from './types.js';
+import type { ApiKeyRecord, ApiKeyStore, ExecutionStore } from '../store/store.js';
+
+// What a key may do: its rate limit and, for tiered access, a monthly quota and its own maxima.
+export interface ApiKeyPolicy {
+  // Issued keys' ID; keys from the configuration have none.
+  id?: string;
+  label: string;
+  rateLimitRps: number;
+  burst: number;
+  // Executions per calendar month (UTC); unlimited when unset.
+  monthlyExecutions?: number;
+  // Replace the server's limits.max for the key's runs.
+  maxLimits?: Partial<RunLimits>;
+  // Keys with the same tenant share one rate-limit bucket and one concurrency cap; each key is
+  // its own tenant when unset.
+  tenant?: string;
+  // Runs of the tenant that may execute at once; AuthConfig.maxConcurrent when unset.
+  maxConcurrent?: number;
+}
 
 export interface AuthConfig {
-  tokens: Record<string, { label: string; rateLimitRps: number; burst: number }>;
+  // Keys from the server configuration, by token.
+  tokens: Record<string, ApiKeyPolicy>;
+  limiter?: TokenBucketLimiter;
+  // Runs a tenant may execute at once unless its key says otherwise; unlimited when unset.
+  maxConcurrent?: number;
+  // Where issued keys and this month's submissions are read from; only configured keys are
+  // accepted and quotas count from zero when unset.
+  store?: ApiKeyStore & Pick<ExecutionStore, 'countSubmissions'>;
+}
+
+export interface KeyUsage {
+  label: string;
+  monthly_executions: number | null;
+  used: number;
+  period_start: string;
+}
+
+export interface KeyDescription {
+  fingerprint: string;
+  id: string | null;
+  label: string | null;
+}
+
+export function hashToken(token: string): string {
+  return crypto.createHash('sha256').update(token).digest('hex');
 }
 
+// Issued keys and usage are loaded from the store by refresh(), which the server calls on an
+// interval, so authenticating stays synchronous for the HTTP, websocket and gRPC paths alike.
+// The interval bounds how long a deleted key keeps working and how far instances sharing a
+// store can overshoot a quota between them.
 export class Authenticator {
-  constructor(private readonly config: AuthConfig) {}
+  private readonly limiter: TokenBucketLimiter;
+  // Issued keys by token hash.
+  private issued = new Map<string, ApiKeyPolicy>();
+  // Runs started this period, by API key.
+  private usage = new Map<string, number>();
+  private periodStart = monthStart(new Date());
+
+  constructor(private readonly config: AuthConfig) {
+    this.limiter = config.limiter ?? new TokenBucketLimiter(5, 10);
+  }
+
+  public async refresh() {
+    const store = this.config.store;
+    if (!store) {
+      return;
+    }
+    const periodStart = monthStart(new Date());
+    const [keys, counts] = await Promise.all([store.listApiKeys(), store.countSubmissions(periodStart)]);
+    this.issued = new Map(keys.map((key) => [key.token_sha256, { ...policyOf(key), id: key.id }]));
+    this.usage = new Map(Object.entries(counts));
+    this.periodStart = periodStart;
+  }
 
   public middleware() {
     return (req: Request, _res: Response, next: NextFunction) => {
-      const header = req.headers['authorization'];
-      if (!header?.startsWith('Bearer ')) {
-        return next(Boom.unauthorized('missing bearer token'));
-      }
-      const token = header.slice('Bearer '.length).trim();
-      const entry = this.config.tokens[token];
-      if (!entry) {
-        return next(Boom.unauthorized('invalid token'));
+      try {
+        (req as Request & { apiKey?: string }).apiKey = this.authenticate(req.headers['authorization']);
+      } catch (err) {
+        return next(err);
       }
-      (req as Request & { apiKey?: string }).apiKey = token;
       return next();
     };
   }
+
+  // Resolves an `Authorization` header value to its API key; shared by the HTTP and gRPC servers.
+  public authenticate(header: string | undefined): string {
+    if (!header?.startsWith('Bearer ')) {
+      throw Boom.unauthorized('missing bearer token');
+    }
+    const token = header.slice('Bearer '.length).trim();
+    if (!this.policy(token)) {
+      throw Boom.unauthorized('invalid token');
+    }
+    return token;
+  }
+
+  public policy(apiKey: string): ApiKeyPolicy | undefined {
+    return this.config.tokens[apiKey] ?? this.issued.get(hashToken(apiKey));
+  }
+
+  // Applies the rate limit of the key's tenant to a request.
+  public throttle(apiKey: string) {
+    const policy = this.policy(apiKey);
+    this.limiter.check(policy?.tenant ?? apiKey, policy?.rateLimitRps, policy?.burst);
+  }
+
+  // Counts a run against the key's monthly quota, refusing it once the quota is used up. The
+  // orchestrator calls this for every run, so each batch submission and judge case counts.
+  public admitRun(apiKey: string) {
+    this.rollPeriod();
+    const quota = this.policy(apiKey)?.monthlyExecutions;
+    const used = this.usage.get(apiKey) ?? 0;
+    if (quota !== undefined && used >= quota) {
+      throw Boom.tooManyRequests('monthly execution quota exceeded', { quota, period_start: this.periodStart });
+    }
+    this.usage.set(apiKey, used + 1);
+  }
+
+  public maxLimits(apiKey: string): Partial<RunLimits> | undefined {
+    return this.policy(apiKey)?.maxLimits;
+  }
+
+  public tenantOf(apiKey: string): TenantSlot | undefined {
+    const policy = this.policy(apiKey);
+    const maxRunning = policy?.maxConcurrent ?? this.config.maxConcurrent;
+    return maxRunning ? { id: policy?.tenant ?? apiKey, maxRunning } : undefined;
+  }
+
+  // Names the key's tenant in logs by its tenant or label, so logs never carry the token.
+  public tenantName(apiKey: string): string {
+    const policy = this.policy(apiKey);
+    return policy?.tenant ?? policy?.label ?? 'default';
+  }
+
+  // Names a key in reports without its token: the issued key's ID and its label, both null for a
+  // key that is gone, and a fingerprint (the start of the token's SHA-256) that tells keys apart.
+  public describeKey(apiKey: string): KeyDescription {
+    const policy = this.policy(apiKey);
+    return { fingerprint: hashToken(apiKey).slice(0, 16), id: policy?.id ?? null, label: policy?.label ?? null };
+  }
+
+  public usageOf(apiKey: string): KeyUsage {
+    this.rollPeriod();
+    const policy = this.policy(apiKey);
+    return {
+      label: policy?.label ?? 'default',
+      monthly_executions: policy?.monthlyExecutions ?? null,
+      used: this.usage.get(apiKey) ?? 0,
+      period_start: this.periodStart
+    };
+  }
+
+  private rollPeriod() {
+    const current = monthStart(new Date());
+    if (current !== this.periodStart) {
+      this.periodStart = current;
+      this.usage.clear();
+    }
+  }
+}
+
+// Builds a policy from the snake_case fields shared by configured and issued keys.
+export function policyOf(
+  key: Pick<ApiKeyRecord, 'label' | 'rate_limit_rps' | 'burst'> &
+    Partial<Pick<ApiKeyRecord, 'monthly_executions' | 'max_timeout_ms' | 'max_memory_mb' | 'tenant' | 'max_concurrent'>>
+): ApiKeyPolicy {
+  const maxLimits: Partial<RunLimits> = {};
+  if (key.max_timeout_ms != null) {
+    maxLimits.timeout_ms = key.max_timeout_ms;
+  }
+  if (key.max_memory_mb != null) {
+    maxLimits.memory_mb = key.max_memory_mb;
+  }
+  return {
+    label: key.label,
+    rateLimitRps: key.rate_limit_rps,
+    burst: key.burst,
+    monthlyExecutions: key.monthly_executions ?? undefined,
+    maxLimits: Object.keys(maxLimits).length > 0 ? maxLimits : undefined,
+    tenant: key.tenant ?? undefined,
+    maxConcurrent: key.max_concurrent ?? undefined
+  };
+}
+
+function monthStart(now: Date): string {
+  return new Date(Date.UTC(now.getUTCFullYear(), now.getUTCMonth(), 1)).toISOString();
 }
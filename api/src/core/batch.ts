@@ -0,0 +1,109 @@
+import Boom from '@hapi/boom';
+import { Logger } from '../util/logger.js';
+import type { Orchestrator } from './orchestrator.js';
+import type { SpanContext } from '../tracing/tracer.js';
+import type { RunRecord, RunRequest } from './types.js';
+
+// A run request labelled with a caller-chosen tag its result is returned under, e.g. a student
+// id when regrading an assignment or a cell of a benchmark matrix.
+export interface BatchSubmission extends RunRequest {
+  tag: string;
+}
+
+export interface BatchRequest {
+  submissions: BatchSubmission[];
+  // Lowers how many submissions of this batch run at once; capped by the server's setting.
+  concurrency?: number;
+}
+
+// Exactly one of `run` and `error` is set: a submission the orchestrator rejected or could not
+// run reports why instead of failing the whole batch.
+export interface BatchItemResult {
+  tag: string;
+  run: RunRecord | null;
+  error: string | null;
+}
+
+export interface BatchResult {
+  total: number;
+  // Submissions whose run finished with status `succeeded`.
+  succeeded: number;
+  errors: number;
+  results: Record<string, BatchItemResult>;
+}
+
+export interface BatchOptions {
+  orchestrator: Orchestrator;
+  logger: Logger;
+  // Submissions of one batch that may run at once.
+  concurrency?: number;
+  maxSubmissions?: number;
+}
+
+const TAG_PATTERN = /^[A-Za-z0-9._:/@-]{1,128}$/;
+
+// Runs many independent submissions with bounded concurrency and collects their results by tag.
+// Every submission still goes through the orchestrator's queue, so a batch shares workers with
+// other traffic instead of taking them over.
+export class BatchRunner {
+  private readonly concurrency: number;
+  private readonly maxSubmissions: number;
+
+  constructor(private readonly options: BatchOptions) {
+    this.concurrency = Math.max(1, options.concurrency ?? 4);
+    this.maxSubmissions = options.maxSubmissions ?? 100;
+  }
+
+  public async run(request: BatchRequest, apiKey: string, traceParent?: SpanContext | null): Promise<BatchResult> {
+    this.validate(request);
+    const submissions = request.submissions;
+    const concurrency = Math.min(this.concurrency, request.concurrency ?? this.concurrency, submissions.length);
+    const results: BatchItemResult[] = new Array(submissions.length);
+    let next = 0;
+    const worker = async () => {
+      while (next < submissions.length) {
+        const index = next++;
+        const { tag, ...submission } = submissions[index];
+        try {
+          // Bulk work waits behind interactive and normal runs, whatever the submission asked for.
+          const run = await this.options.orchestrator.createRun({ ...submission, priority: 'batch' }, apiKey, { traceParent });
+          results[index] = { tag, run, error: null };
+        } catch (err) {
+          if (!Boom.isBoom(err)) {
+            this.options.logger.error('batch submission failed', { tag, message: (err as Error).message });
+          }
+          results[index] = { tag, run: null, error: Boom.isBoom(err) ? err.message : 'internal_error' };
+        }
+      }
+    };
+    await Promise.all(Array.from({ length: concurrency }, worker));
+    return {
+      total: results.length,
+      succeeded: results.filter((result) => result.run?.status === 'succeeded').length,
+      errors: results.filter((result) => result.error !== null).length,
+      results: Object.fromEntries(results.map((result) => [result.tag, result]))
+    };
+  }
+
+  private validate(request: BatchRequest) {
+    if (!Array.isArray(request?.submissions) || request.submissions.length === 0) {
+      throw Boom.badRequest('submissions is required');
+    }
+    if (request.submissions.length > this.maxSubmissions) {
+      throw Boom.badRequest(`submissions exceeds ${this.maxSubmissions}`);
+    }
+    if (request.concurrency !== undefined && !(Number.isInteger(request.concurrency) && request.concurrency >= 1)) {
+      throw Boom.badRequest('concurrency must be a positive integer');
+    }
+    const tags = new Set<string>();
+    request.submissions.forEach((submission, index) => {
+      if (typeof submission?.tag !== 'string' || !TAG_PATTERN.test(submission.tag)) {
+        throw Boom.badRequest(`submissions[${index}].tag must be 1-128 letters, digits or ._:/@-`);
+      }
+      if (tags.has(submission.tag)) {
+        throw Boom.badRequest(`duplicate tag: ${submission.tag}`);
+      }
+      tags.add(submission.tag);
+    });
+  }
+}
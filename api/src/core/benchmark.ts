@@ -0,0 +1,154 @@
+import Boom from '@hapi/boom';
+import { Logger } from '../util/logger.js';
+import type { Orchestrator } from './orchestrator.js';
+import type { SpanContext } from '../tracing/tracer.js';
+import { RunnerRegistry, runnerRegistry } from './runners.js';
+import { detectLanguage } from './detect.js';
+import type { PhaseResult, RunRecord, RunRequest, RunStatus } from './types.js';
+
+// One submission run over and over with the same stdin; the fields are those of a run request.
+export interface BenchmarkRequest extends Omit<RunRequest, 'mode' | 'deterministic'> {
+  // Timed runs, 10 unless set.
+  iterations?: number;
+  // Runs before the timed ones whose figures are discarded, 1 unless set. The first run of a
+  // compiled language also builds the program for the others.
+  warmup?: number;
+}
+
+// Summary of one measurement over the timed runs. p95 is the nearest-rank percentile.
+export interface BenchmarkStats {
+  mean: number;
+  median: number;
+  p95: number;
+  min: number;
+  max: number;
+  stddev: number;
+}
+
+export interface BenchmarkRun {
+  run_id: string;
+  warmup: boolean;
+  wall_ms: number;
+  cpu_ms: number;
+  max_rss_mb: number;
+}
+
+export interface BenchmarkResult {
+  // `succeeded` once every run did; otherwise the status of the run that stopped the benchmark.
+  status: RunStatus;
+  failed_run_id: string | null;
+  iterations: number;
+  warmup: number;
+  // Compile phase of the first run, null for interpreted languages.
+  compile: PhaseResult | null;
+  // Null when the benchmark stopped before any timed run finished.
+  wall_ms: BenchmarkStats | null;
+  cpu_ms: BenchmarkStats | null;
+  max_rss_mb: BenchmarkStats | null;
+  runs: BenchmarkRun[];
+}
+
+export interface BenchmarkOptions {
+  orchestrator: Orchestrator;
+  logger: Logger;
+  registry?: RunnerRegistry;
+  // Most runs, warmup included, one request may ask for.
+  maxIterations: number;
+  // Receives every run record as it finishes.
+  onRun?: (run: RunRecord) => void;
+}
+
+const DEFAULT_ITERATIONS = 10;
+const DEFAULT_WARMUP = 1;
+
+// Times a submission over repeated runs so solutions can be compared on more than one noisy
+// sample. Runs go one after another, never side by side, so they don't compete for the same
+// cores; every figure is the program's own (the entrypoint's wall clock starts after the build,
+// and later runs of a compiled language reuse the first one's build from the compilation cache
+// when the backend has one).
+export class Benchmark {
+  private readonly registry: RunnerRegistry;
+
+  constructor(private readonly options: BenchmarkOptions) {
+    this.registry = options.registry ?? runnerRegistry;
+  }
+
+  // Every run joins the caller's trace when `traceParent` is given.
+  public async benchmark(original: BenchmarkRequest, apiKey: string, traceParent?: SpanContext | null): Promise<BenchmarkResult> {
+    this.validate(original);
+    // Detected once up front so that every run is of the same language.
+    const request = original.language ? original : { ...original, language: detectLanguage(original, this.registry).language };
+    const { iterations = DEFAULT_ITERATIONS, warmup = DEFAULT_WARMUP, ...submission } = request;
+    this.registry.require(request.language);
+    const runs: BenchmarkRun[] = [];
+    let compile: PhaseResult | null = null;
+    let failed: RunRecord | null = null;
+    for (let index = 0; index < warmup + iterations; index++) {
+      // Never answered from the result cache, which would time nothing.
+      const run = await this.options.orchestrator.createRun({ ...submission, mode: 'run', deterministic: false }, apiKey, {
+        traceParent
+      });
+      this.options.onRun?.(run);
+      compile = index === 0 ? run.phases.compile : compile;
+      if (run.status !== 'succeeded') {
+        failed = run;
+        this.options.logger.info('benchmark run failed', { runId: run.id, status: run.status, iteration: index, apiKey });
+        break;
+      }
+      runs.push({
+        run_id: run.id,
+        warmup: index < warmup,
+        wall_ms: run.usage.wall_ms,
+        cpu_ms: run.usage.cpu_ms,
+        max_rss_mb: run.usage.max_rss_mb
+      });
+    }
+    const timed = runs.filter((run) => !run.warmup);
+    return {
+      status: failed?.status ?? 'succeeded',
+      failed_run_id: failed?.id ?? null,
+      iterations,
+      warmup,
+      compile,
+      wall_ms: summarize(timed.map((run) => run.wall_ms)),
+      cpu_ms: summarize(timed.map((run) => run.cpu_ms)),
+      max_rss_mb: summarize(timed.map((run) => run.max_rss_mb)),
+      runs
+    };
+  }
+
+  private validate(request: BenchmarkRequest) {
+    const { iterations, warmup } = request;
+    if (iterations !== undefined && (!Number.isInteger(iterations) || iterations < 1)) {
+      throw Boom.badRequest('iterations must be a positive integer');
+    }
+    if (warmup !== undefined && (!Number.isInteger(warmup) || warmup < 0)) {
+      throw Boom.badRequest('warmup must be a non-negative integer');
+    }
+    if ((iterations ?? DEFAULT_ITERATIONS) + (warmup ?? DEFAULT_WARMUP) > this.options.maxIterations) {
+      throw Boom.badRequest(`iterations and warmup exceed ${this.options.maxIterations} runs`);
+    }
+  }
+}
+
+export function summarize(samples: number[]): BenchmarkStats | null {
+  if (samples.length === 0) {
+    return null;
+  }
+  const sorted = [...samples].sort((a, b) => a - b);
+  const mean = samples.reduce((sum, value) => sum + value, 0) / samples.length;
+  const middle = Math.floor(sorted.length / 2);
+  const variance = samples.reduce((sum, value) => sum + (value - mean) ** 2, 0) / samples.length;
+  return {
+    mean: round(mean),
+    median: sorted.length % 2 === 1 ? sorted[middle] : round((sorted[middle - 1] + sorted[middle]) / 2),
+    p95: sorted[Math.ceil(0.95 * sorted.length) - 1],
+    min: sorted[0],
+    max: sorted[sorted.length - 1],
+    stddev: round(Math.sqrt(variance))
+  };
+}
+
+function round(value: number) {
+  return Math.round(value * 100) / 100;
+}
@@ -0,0 +1,247 @@
+import crypto from 'node:crypto';
+import fs from 'node:fs';
+import path from 'node:path';
+import { Logger } from '../util/logger.js';
+
+export interface BuildCacheOptions {
+  // API-side directory holding one subdirectory of build outputs per cache key.
+  dir: string;
+  // Total size the cache may grow to before least recently used entries are evicted.
+  maxBytes: number;
+}
+
+export interface BuildCacheStats {
+  entries: number;
+  bytes: number;
+  max_bytes: number;
+  hits: number;
+  misses: number;
+  evictions: number;
+}
+
+export interface BuildKeyParts {
+  language: string;
+  // Test mode builds a test binary instead of the program.
+  mode: string;
+  image: string;
+  toolchain: string;
+  code: string;
+  sources: Record<string, string>;
+  build: unknown;
+  profile?: unknown;
+  coverage?: boolean;
+}
+
+interface CacheEntry {
+  bytes: number;
+  lastUsed: number;
+  // Runs using the entry's directory in place through lease(); never removed while any do.
+  leases: number;
+}
+
+// A cached build handed out in place, e.g. as the read-only lower layer of an overlay.
+export interface BuildLayer {
+  dir: string;
+  release(): void;
+}
+
+// Marks an entry whose copy finished, so interrupted stores are never served.
+const COMPLETE_MARKER = '.complete';
+
+// Caches compiled outputs (binaries, class files) keyed by everything that determines them, so
+// identical resubmissions skip the compile phase. Entries are evicted least recently used first
+// once the cache outgrows maxBytes.
+export class BuildCache {
+  private readonly entries = new Map<string, CacheEntry>();
+  private bytes = 0;
+  private hits = 0;
+  private misses = 0;
+  private evictions = 0;
+
+  constructor(private readonly options: BuildCacheOptions, private readonly logger: Logger) {
+    fs.mkdirSync(options.dir, { recursive: true });
+    this.loadExisting();
+  }
+
+  public key(parts: BuildKeyParts): string {
+    const hash = crypto.createHash('sha256');
+    hash.update(`${parts.language}\0${parts.mode}\0${parts.image}\0${parts.toolchain}\0${JSON.stringify(parts.build ?? {})}\0`);
+    hash.update(`${parts.code}\0`);
+    for (const name of Object.keys(parts.sources).sort()) {
+      hash.update(`${name}\0${parts.sources[name]}\0`);
+    }
+    // Left out when unset so that builds cached before profiling and coverage existed keep their keys.
+    if (parts.profile) {
+      hash.update(`profile\0${JSON.stringify(parts.profile)}\0`);
+    }
+    if (parts.coverage) {
+      hash.update('coverage\0');
+    }
+    return hash.digest('hex');
+  }
+
+  // Copies a cached build into destDir; returns false on a miss. Files are cloned where the
+  // filesystem supports it (btrfs, XFS, APFS), which takes milliseconds however large the build,
+  // and copied byte by byte elsewhere.
+  public restore(key: string, destDir: string): boolean {
+    const entry = this.hit(key);
+    if (!entry) {
+      return false;
+    }
+    fs.cpSync(path.join(this.options.dir, key), destDir, {
+      recursive: true,
+      mode: fs.constants.COPYFILE_FICLONE,
+      filter: (source) => path.basename(source) !== COMPLETE_MARKER
+    });
+    return true;
+  }
+
+  // Hands out a cached build's own directory, which the caller must not write to, instead of a
+  // copy; null on a miss. The entry is kept until every lease is released.
+  public lease(key: string): BuildLayer | null {
+    const entry = this.hit(key);
+    if (!entry) {
+      return null;
+    }
+    entry.leases++;
+    let released = false;
+    return {
+      dir: path.join(this.options.dir, key),
+      release: () => {
+        if (!released) {
+          released = true;
+          entry.leases--;
+        }
+      }
+    };
+  }
+
+  private hit(key: string): CacheEntry | null {
+    const entry = this.entries.get(key);
+    if (!entry) {
+      this.misses++;
+      return null;
+    }
+    entry.lastUsed = Date.now();
+    // The marker's mtime is when the entry was last used, for the next process to pick up.
+    const now = new Date(entry.lastUsed);
+    fs.utimesSync(path.join(this.options.dir, key, COMPLETE_MARKER), now, now);
+    this.hits++;
+    return entry;
+  }
+
+  // Removes entries last used before `before` (epoch ms), however much room is left.
+  public expire(before: number) {
+    let entries = 0;
+    let bytes = 0;
+    for (const [key, entry] of this.entries) {
+      if (entry.lastUsed >= before || entry.leases > 0) {
+        continue;
+      }
+      fs.rmSync(path.join(this.options.dir, key), { recursive: true, force: true });
+      this.entries.delete(key);
+      this.bytes -= entry.bytes;
+      entries++;
+      bytes += entry.bytes;
+    }
+    return { entries, bytes };
+  }
+
+  // Stores the build outputs in srcDir, provided they still match the digest the runner took
+  // before any submission code ran; anything else may have been rewritten by the program.
+  public store(key: string, srcDir: string, digest: string) {
+    if (this.entries.has(key) || !fs.existsSync(srcDir)) {
+      return;
+    }
+    if (buildDigest(srcDir) !== digest) {
+      this.logger.warn('build outputs changed after compilation; not caching', { key });
+      return;
+    }
+    const bytes = directorySize(srcDir);
+    if (bytes > this.options.maxBytes) {
+      return;
+    }
+    const entryDir = path.join(this.options.dir, key);
+    fs.rmSync(entryDir, { recursive: true, force: true });
+    fs.cpSync(srcDir, entryDir, { recursive: true });
+    fs.writeFileSync(path.join(entryDir, COMPLETE_MARKER), new Date().toISOString());
+    this.entries.set(key, { bytes, lastUsed: Date.now(), leases: 0 });
+    this.bytes += bytes;
+    this.evict();
+  }
+
+  public stats(): BuildCacheStats {
+    return {
+      entries: this.entries.size,
+      bytes: this.bytes,
+      max_bytes: this.options.maxBytes,
+      hits: this.hits,
+      misses: this.misses,
+      evictions: this.evictions
+    };
+  }
+
+  private evict() {
+    const oldestFirst = [...this.entries.entries()].sort((a, b) => a[1].lastUsed - b[1].lastUsed);
+    for (const [key, entry] of oldestFirst) {
+      if (this.bytes <= this.options.maxBytes) {
+        break;
+      }
+      if (entry.leases > 0) {
+        continue;
+      }
+      fs.rmSync(path.join(this.options.dir, key), { recursive: true, force: true });
+      this.entries.delete(key);
+      this.bytes -= entry.bytes;
+      this.evictions++;
+    }
+  }
+
+  // Picks up entries left by a previous process, dropping incomplete ones.
+  private loadExisting() {
+    for (const dirent of fs.readdirSync(this.options.dir, { withFileTypes: true })) {
+      if (!dirent.isDirectory()) {
+        continue;
+      }
+      const entryDir = path.join(this.options.dir, dirent.name);
+      const marker = path.join(entryDir, COMPLETE_MARKER);
+      if (!fs.existsSync(marker)) {
+        fs.rmSync(entryDir, { recursive: true, force: true });
+        continue;
+      }
+      const bytes = directorySize(entryDir);
+      this.entries.set(dirent.name, { bytes, lastUsed: fs.statSync(marker).mtimeMs, leases: 0 });
+      this.bytes += bytes;
+    }
+    this.evict();
+  }
+}
+
+// Digest over every file under dir, matching the runners' build_digest: one
+// "<relative path>\0<sha256 of contents>\n" line per file in sorted path order.
+export function buildDigest(dir: string): string {
+  const lines = listFiles(dir)
+    .sort()
+    .map((relative) => {
+      const contents = crypto.createHash('sha256').update(fs.readFileSync(path.join(dir, relative))).digest('hex');
+      return `${relative}\0${contents}\n`;
+    });
+  return crypto.createHash('sha256').update(lines.join('')).digest('hex');
+}
+
+function listFiles(dir: string, prefix = ''): string[] {
+  const files: string[] = [];
+  for (const dirent of fs.readdirSync(path.join(dir, prefix), { withFileTypes: true })) {
+    const relative = prefix ? `${prefix}/${dirent.name}` : dirent.name;
+    if (dirent.isDirectory()) {
+      files.push(...listFiles(dir, relative));
+    } else if (dirent.isFile()) {
+      files.push(relative);
+    }
+  }
+  return files;
+}
+
+export function directorySize(dir: string): number {
+  return listFiles(dir).reduce((total, relative) => total + fs.statSync(path.join(dir, relative)).size, 0);
+}
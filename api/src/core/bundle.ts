@@ -0,0 +1,190 @@
+import fs from 'node:fs';
+import path from 'node:path';
+import Boom from '@hapi/boom';
+import { packTarGz, unpackTarGz } from '../util/tar.js';
+import type { TarEntry } from '../util/tar.js';
+import { imageRepository } from './versions.js';
+import type { ArtifactStorage } from './storage.js';
+import type { RunnerRegistry } from './runners.js';
+import type { ExecutionStore } from '../store/store.js';
+import type { IsolationLevel, LimitKind, RunAsUser, RunLimits, RunRequest, RunStatus } from './types.js';
+
+export const BUNDLE_FORMAT = 1;
+
+// How the exporting server ran submissions, for comparison with wherever the bundle is replayed.
+export interface SandboxDescription {
+  backend: 'docker' | 'process';
+  default_isolation: IsolationLevel;
+  // Profile path, or `built-in` for the process backend's own deny-list; null when disabled.
+  seccomp_profile: string | null;
+  apparmor_profile: string | null;
+  disable_security: boolean;
+  runtimes: { gvisor: string | null; microvm: string | null; wasm?: string | null };
+  userns: string | null;
+  run_as: RunAsUser | null;
+}
+
+// bundle.json, next to source/ (the entry file and the request's sources), stdin, inputs/ (the
+// uploaded files the request staged) and result/stdout and result/stderr of the original run.
+export interface BundleManifest {
+  format: number;
+  id: string;
+  created_at: string;
+  exported_at: string;
+  language: string;
+  // The request's `code` is source/<entry_file>; null when the request had none.
+  entry_file: string | null;
+  // The request without code, sources and stdin, which are files of the bundle.
+  request: Omit<RunRequest, 'code' | 'sources' | 'stdin'>;
+  // Limits the run executed with; null when it never produced a record.
+  limits: RunLimits | null;
+  toolchain: {
+    // Version the request asked for, null for the default.
+    version: string | null;
+    // Version the runner reported, null when the run produced no record.
+    reported: string | null;
+    // Runner image on the docker backend.
+    image: string | null;
+  };
+  sandbox: SandboxDescription;
+  // `pending` while the execution is still in flight, `error` when it ended without a record.
+  result: {
+    status: RunStatus | 'pending' | 'error';
+    exit_code: number | null;
+    limit_exceeded: LimitKind | null;
+    error: string | null;
+  };
+  // Request files whose upload no longer exists, so they are missing from inputs/.
+  missing_files: string[];
+}
+
+export interface ReplayBundle {
+  manifest: BundleManifest;
+  code: string;
+  sources: Record<string, string>;
+  stdin: string;
+  // Uploaded files by their path under inputs/.
+  inputs: Record<string, Buffer>;
+  // The original run's output, empty when it produced no record.
+  stdout: string;
+  stderr: string;
+}
+
+export interface BundleExporterOptions {
+  store: ExecutionStore;
+  artifactStorage: ArtifactStorage;
+  registry: RunnerRegistry;
+  sandbox: SandboxDescription;
+}
+
+// Packs what is needed to reproduce an execution offline with `codexec replay` into a gzipped
+// tarball. Read-only mounts are listed in the request but their data is not included.
+export class BundleExporter {
+  constructor(private readonly options: BundleExporterOptions) {}
+
+  // Bundles carry the submission's code and environment, so only the key that submitted it may
+  // export one; any other key gets the same 404 as an unknown ID.
+  public async export(id: string, apiKey: string): Promise<Buffer> {
+    const store = this.options.store;
+    const submission = await store.getSubmission(id);
+    if (!submission || submission.api_key !== apiKey) {
+      throw Boom.notFound('execution not found');
+    }
+    const run = await store.get(id);
+    const error = run ? null : await store.getError(id);
+    const { code, sources = {}, stdin = '', ...request } = submission.request;
+    const runner = this.options.registry.require(submission.language);
+    const entryFile = code === undefined ? null : runner.entryFile;
+
+    const entries: TarEntry[] = [];
+    if (entryFile !== null) {
+      entries.push({ name: `source/${entryFile}`, data: Buffer.from(code ?? '') });
+    }
+    for (const [sourcePath, contents] of Object.entries(sources)) {
+      // The entry file takes the place of a source with its name, as in the run's workdir.
+      if (sourcePath !== entryFile) {
+        entries.push({ name: `source/${sourcePath}`, data: Buffer.from(contents) });
+      }
+    }
+    entries.push({ name: 'stdin', data: Buffer.from(stdin) });
+    const missing: string[] = [];
+    for (const file of request.files ?? []) {
+      try {
+        const uploaded = this.options.artifactStorage.getUploadedFile(file.id);
+        entries.push({ name: `inputs/${file.path}`, data: fs.readFileSync(uploaded.path) });
+      } catch {
+        missing.push(file.path);
+      }
+    }
+    entries.push({ name: 'result/stdout', data: Buffer.from(run?.stdout ?? '') });
+    entries.push({ name: 'result/stderr', data: Buffer.from(run?.stderr ?? '') });
+
+    const version = request.version ?? null;
+    const manifest: BundleManifest = {
+      format: BUNDLE_FORMAT,
+      id,
+      created_at: submission.created_at,
+      exported_at: new Date().toISOString(),
+      language: submission.language,
+      entry_file: entryFile,
+      request,
+      limits: run?.limits ?? null,
+      toolchain: {
+        version,
+        reported: run?.toolchain ?? null,
+        image: this.options.sandbox.backend === 'docker'
+          ? version ? `${imageRepository(runner.image)}:${version}` : runner.image
+          : null
+      },
+      sandbox: this.options.sandbox,
+      result: {
+        status: run?.status ?? (error === null ? 'pending' : 'error'),
+        exit_code: run?.exit_code ?? null,
+        limit_exceeded: run?.limit_exceeded ?? null,
+        error
+      },
+      missing_files: missing
+    };
+    return packTarGz([{ name: 'bundle.json', data: Buffer.from(`${JSON.stringify(manifest, null, 2)}\n`) }, ...entries]);
+  }
+}
+
+// Unpacks a bundle written by BundleExporter. Entry names are checked because the replay
+// writes them into a run directory.
+export function readBundle(archive: Buffer): ReplayBundle {
+  const files = new Map<string, Buffer>();
+  for (const entry of unpackTarGz(archive)) {
+    const name = path.posix.normalize(entry.name);
+    if (path.posix.isAbsolute(name) || name.split('/').includes('..')) {
+      throw new Error(`invalid bundle entry: ${entry.name}`);
+    }
+    files.set(name, entry.data);
+  }
+  const manifestFile = files.get('bundle.json');
+  if (!manifestFile) {
+    throw new Error('not an execution bundle: bundle.json is missing');
+  }
+  const manifest = JSON.parse(manifestFile.toString('utf8')) as BundleManifest;
+  if (manifest.format !== BUNDLE_FORMAT) {
+    throw new Error(`unsupported bundle format: ${manifest.format}`);
+  }
+  const sources: Record<string, string> = {};
+  const inputs: Record<string, Buffer> = {};
+  for (const [name, data] of files) {
+    if (name.startsWith('source/') && name !== `source/${manifest.entry_file}`) {
+      sources[name.slice('source/'.length)] = data.toString('utf8');
+    } else if (name.startsWith('inputs/')) {
+      inputs[name.slice('inputs/'.length)] = data;
+    }
+  }
+  const text = (name: string) => files.get(name)?.toString('utf8') ?? '';
+  return {
+    manifest,
+    code: manifest.entry_file === null ? '' : text(`source/${manifest.entry_file}`),
+    sources,
+    stdin: text('stdin'),
+    inputs,
+    stdout: text('result/stdout'),
+    stderr: text('result/stderr')
+  };
+}
@@ -0,0 +1,288 @@
+import Boom from '@hapi/boom';
+import { Logger } from '../util/logger.js';
+import type { Orchestrator } from './orchestrator.js';
+import type { SpanContext } from '../tracing/tracer.js';
+import { RunnerRegistry, runnerRegistry } from './runners.js';
+import { detectLanguage } from './detect.js';
+import { summarize, type BenchmarkStats } from './benchmark.js';
+import { outputMatches, runFailure, type Comparison, type Verdict } from './judge.js';
+import { diffOutput, type OutputDiff } from './output_diff.js';
+import type { PhaseResult, RunLimits, RunRecord, RunRequest, RunStatus } from './types.js';
+
+// One side of a comparison; the fields are those of a run request, while the input and limits
+// come from the comparison so that both sides get the same.
+export type ComparedSubmission = Omit<RunRequest, 'stdin' | 'limits' | 'mode' | 'deterministic'>;
+
+export interface ComparisonCase {
+  stdin?: string;
+  // When set, each side's output is also judged against it.
+  expected_stdout?: string;
+}
+
+export interface ComparisonRequest {
+  // The reference, e.g. the solution before an optimization.
+  baseline: ComparedSubmission;
+  candidate: ComparedSubmission;
+  // One case with empty stdin unless set.
+  cases?: ComparisonCase[];
+  limits?: Partial<RunLimits>;
+  // How outputs are compared, with each other and with expected_stdout; `trimmed` unless set.
+  comparison?: Comparison;
+  tolerance?: number;
+  // Times each side runs every case, 1 unless set; more make the time and memory figures less noisy.
+  iterations?: number;
+}
+
+export interface ComparedRun {
+  // The first iteration's run; null once the side failed to compile and its remaining runs were skipped.
+  run_id: string | null;
+  status: RunStatus | null;
+  // Of the first iteration: the run's failure, WA for output that differs from expected_stdout,
+  // otherwise AC.
+  verdict: Verdict;
+  exit_code: number | null;
+  // Medians over the iterations.
+  wall_ms: number;
+  cpu_ms: number;
+  max_rss_mb: number;
+}
+
+export interface ComparisonCaseResult {
+  index: number;
+  baseline: ComparedRun;
+  candidate: ComparedRun;
+  // Whether the candidate's stdout of its first iteration matches the baseline's.
+  outputs_match: boolean;
+  // From the baseline's output, as `expected`, to the candidate's, null when they match.
+  diff: OutputDiff | null;
+}
+
+export interface ComparedSide {
+  // Compile phase of the side's first run, null for interpreted languages.
+  compile: PhaseResult | null;
+  passed: number;
+  // Over the iterations, of every timed case's figures added up (the peak for max_rss_mb).
+  wall_ms: BenchmarkStats | null;
+  cpu_ms: BenchmarkStats | null;
+  max_rss_mb: BenchmarkStats | null;
+}
+
+// How the candidate's median differs from the baseline's.
+export interface ComparisonDelta {
+  baseline: number;
+  candidate: number;
+  // Candidate minus baseline; negative is less time or memory.
+  delta: number;
+  // The delta relative to the baseline, null when the baseline is 0.
+  change_pct: number | null;
+  // Whether the delta is no larger than either side's standard deviation, null with a single iteration.
+  within_noise: boolean | null;
+}
+
+export interface ComparisonResult {
+  // `same` when every case got the same verdict on both sides and the outputs match.
+  outcome: 'same' | 'different';
+  total: number;
+  iterations: number;
+  // Cases the baseline passed and the candidate didn't, and the other way round.
+  regressions: number[];
+  fixes: number[];
+  output_differences: number;
+  // Cases both sides passed every iteration of; the time and memory figures are theirs.
+  timed_cases: number;
+  baseline: ComparedSide;
+  candidate: ComparedSide;
+  // Null when no case is timed.
+  deltas: { wall_ms: ComparisonDelta; cpu_ms: ComparisonDelta; max_rss_mb: ComparisonDelta } | null;
+  cases: ComparisonCaseResult[];
+}
+
+export interface ComparerOptions {
+  orchestrator: Orchestrator;
+  logger: Logger;
+  registry?: RunnerRegistry;
+  // Most runs, both sides together, one request may take.
+  maxRuns: number;
+  // Receives every run record as it finishes.
+  onRun?: (run: RunRecord) => void;
+}
+
+type Side = 'baseline' | 'candidate';
+
+const SIDES: Side[] = ['baseline', 'candidate'];
+const DEFAULT_TOLERANCE = 1e-6;
+const METRICS = ['wall_ms', 'cpu_ms', 'max_rss_mb'] as const;
+// Fields of a run request the comparison sets for both sides.
+const SHARED_FIELDS = ['stdin', 'limits', 'mode', 'deterministic'];
+
+// Runs two submissions against the same cases and limits and reports where they differ: the
+// verdicts, the output and how much time and memory each took, for telling whether an
+// optimization helped or a reference solution regressed. Runs go one at a time, alternating
+// between the sides case by case, so neither competes with the other for cores or gets the
+// quieter half of a noisy machine; none is answered from the result cache.
+export class Comparer {
+  private readonly registry: RunnerRegistry;
+
+  constructor(private readonly options: ComparerOptions) {
+    this.registry = options.registry ?? runnerRegistry;
+  }
+
+  // Every run joins the caller's trace when `traceParent` is given.
+  public async compare(request: ComparisonRequest, apiKey: string, traceParent?: SpanContext | null): Promise<ComparisonResult> {
+    this.validate(request);
+    const { cases = [{}], limits, comparison = 'trimmed', tolerance = DEFAULT_TOLERANCE, iterations = 1 } = request;
+    // Detected once up front so that every run of a side is of the same language.
+    const submissions = Object.fromEntries(SIDES.map((side) => {
+      const submission = request[side];
+      const detected = submission.language ? submission : { ...submission, language: detectLanguage(submission, this.registry).language };
+      this.registry.require(detected.language);
+      // Both sides are checked before either runs.
+      this.options.orchestrator.checkRequest({ ...detected, limits });
+      return [side, detected];
+    })) as Record<Side, ComparedSubmission>;
+
+    const runs: Record<Side, Array<Array<RunRecord | null>>> = {
+      baseline: cases.map(() => []),
+      candidate: cases.map(() => [])
+    };
+    const compile: Record<Side, PhaseResult | null> = { baseline: null, candidate: null };
+    const failedBuild = new Set<Side>();
+    for (let iteration = 0; iteration < iterations; iteration++) {
+      for (let index = 0; index < cases.length; index++) {
+        for (const side of SIDES) {
+          if (failedBuild.has(side)) {
+            runs[side][index].push(null);
+            continue;
+          }
+          const run = await this.options.orchestrator.createRun(
+            { ...submissions[side], limits, mode: 'run', deterministic: false, stdin: cases[index].stdin ?? '' },
+            apiKey,
+            { traceParent }
+          );
+          this.options.onRun?.(run);
+          compile[side] = compile[side] ?? run.phases.compile;
+          if (runFailure(run) === 'CE') {
+            // The build is the same for every case, so the side's other runs would fail the same way.
+            failedBuild.add(side);
+            this.options.logger.info('compared submission failed to compile', { side, runId: run.id, apiKey });
+          }
+          runs[side][index].push(run);
+        }
+      }
+    }
+
+    const verdictOf = (run: RunRecord | null, testCase: ComparisonCase): Verdict => {
+      if (!run) {
+        return 'CE';
+      }
+      const failure = runFailure(run);
+      if (failure) {
+        return failure;
+      }
+      const expected = testCase.expected_stdout;
+      return expected === undefined || outputMatches(run.stdout, expected, comparison, tolerance) ? 'AC' : 'WA';
+    };
+    const results: ComparisonCaseResult[] = cases.map((testCase, index) => {
+      const [baseline, candidate] = SIDES.map((side) => comparedRun(runs[side][index], verdictOf(runs[side][index][0], testCase)));
+      const baselineOutput = runs.baseline[index][0]?.stdout ?? '';
+      const candidateOutput = runs.candidate[index][0]?.stdout ?? '';
+      const outputsMatch = outputMatches(candidateOutput, baselineOutput, comparison, tolerance);
+      return {
+        index,
+        baseline,
+        candidate,
+        outputs_match: outputsMatch,
+        diff: outputsMatch ? null : diffOutput(candidateOutput, baselineOutput, comparison, tolerance)
+      };
+    });
+
+    // Only cases both sides passed every time are timed, so that a crash doesn't pass for a speedup.
+    const timed = cases.map((_, index) => index).filter((index) =>
+      SIDES.every((side) => runs[side][index].every((run) => run && verdictOf(run, cases[index]) === 'AC')));
+    const sideSummary = (side: Side): ComparedSide => {
+      const perIteration = (metric: (typeof METRICS)[number]) => timed.length === 0 ? [] : Array.from({ length: iterations }, (_, iteration) => {
+        const values = timed.map((index) => runs[side][index][iteration]!.usage[metric]);
+        return metric === 'max_rss_mb' ? Math.max(...values) : values.reduce((sum, value) => sum + value, 0);
+      });
+      return {
+        compile: compile[side],
+        passed: results.filter((result) => result[side].verdict === 'AC').length,
+        wall_ms: summarize(perIteration('wall_ms')),
+        cpu_ms: summarize(perIteration('cpu_ms')),
+        max_rss_mb: summarize(perIteration('max_rss_mb'))
+      };
+    };
+    const baseline = sideSummary('baseline');
+    const candidate = sideSummary('candidate');
+    const regressions = results.filter((result) => result.baseline.verdict === 'AC' && result.candidate.verdict !== 'AC').map((result) => result.index);
+    const fixes = results.filter((result) => result.baseline.verdict !== 'AC' && result.candidate.verdict === 'AC').map((result) => result.index);
+    const same = results.every((result) => result.outputs_match && result.baseline.verdict === result.candidate.verdict);
+    return {
+      outcome: same ? 'same' : 'different',
+      total: cases.length,
+      iterations,
+      regressions,
+      fixes,
+      output_differences: results.filter((result) => !result.outputs_match).length,
+      timed_cases: timed.length,
+      baseline,
+      candidate,
+      deltas: timed.length === 0 ? null : {
+        wall_ms: delta(baseline.wall_ms!, candidate.wall_ms!, iterations),
+        cpu_ms: delta(baseline.cpu_ms!, candidate.cpu_ms!, iterations),
+        max_rss_mb: delta(baseline.max_rss_mb!, candidate.max_rss_mb!, iterations)
+      },
+      cases: results
+    };
+  }
+
+  private validate(request: ComparisonRequest) {
+    for (const side of SIDES) {
+      const submission = request[side];
+      if (typeof submission !== 'object' || submission === null || Array.isArray(submission)) {
+        throw Boom.badRequest(`${side} must be a submission`);
+      }
+      const shared = SHARED_FIELDS.find((field) => field in submission);
+      if (shared) {
+        throw Boom.badRequest(`${side}.${shared} cannot be set; the comparison sets it for both sides`);
+      }
+    }
+    const { cases, iterations } = request;
+    if (cases !== undefined && (!Array.isArray(cases) || cases.length === 0)) {
+      throw Boom.badRequest('cases must be a non-empty array');
+    }
+    if (iterations !== undefined && (!Number.isInteger(iterations) || iterations < 1)) {
+      throw Boom.badRequest('iterations must be a positive integer');
+    }
+    const total = (cases?.length ?? 1) * (iterations ?? 1) * SIDES.length;
+    if (total > this.options.maxRuns) {
+      throw Boom.badRequest(`cases and iterations exceed ${this.options.maxRuns} runs for both sides together`);
+    }
+  }
+}
+
+function comparedRun(runs: Array<RunRecord | null>, verdict: Verdict): ComparedRun {
+  const first = runs[0];
+  const finished = runs.filter((run): run is RunRecord => run !== null);
+  const median = (metric: (typeof METRICS)[number]) => summarize(finished.map((run) => run.usage[metric]))?.median ?? 0;
+  return {
+    run_id: first?.id ?? null,
+    status: first?.status ?? null,
+    verdict,
+    exit_code: first?.exit_code ?? null,
+    wall_ms: median('wall_ms'),
+    cpu_ms: median('cpu_ms'),
+    max_rss_mb: median('max_rss_mb')
+  };
+}
+
+function delta(baseline: BenchmarkStats, candidate: BenchmarkStats, iterations: number): ComparisonDelta {
+  const difference = Math.round((candidate.median - baseline.median) * 100) / 100;
+  return {
+    baseline: baseline.median,
+    candidate: candidate.median,
+    delta: difference,
+    change_pct: baseline.median === 0 ? null : Math.round((difference / baseline.median) * 10000) / 100,
+    within_noise: iterations < 2 ? null : Math.abs(difference) <= Math.max(baseline.stddev, candidate.stddev)
+  };
+}
@@ -0,0 +1,513 @@
+import fs from 'node:fs';
+import path from 'node:path';
+import Boom from '@hapi/boom';
+import { canceledResult, isRelativeInside } from './run_dir.js';
+import type { MemoryWarning, OutputStream, RunRetry, SandboxResult, SandboxRunSpec, SandboxRunner, UsageSample } from './types.js';
+import { Logger, currentLogContext } from '../util/logger.js';
+import type { LogContext } from '../util/logger.js';
+import { GpuPool } from './gpu.js';
+import type { GpuDevice, GpuDeviceStats, GpuLease } from './gpu.js';
+
+// What a worker needs to run a spec that the coordinator's run directory doesn't carry over: the
+// files are shipped, the callbacks and streams are relayed as messages.
+export type RemoteSpec = Omit<
+  SandboxRunSpec,
+  'workdir' | 'stagedFiles' | 'onOutput' | 'onRunStart' | 'onMemoryPressure' | 'onUsageSample' | 'signal' | 'input'
+>;
+
+// A sandbox result with its output base64-encoded; artifacts travel as files next to it.
+export type RemoteResult = Omit<SandboxResult, 'stdout' | 'stderr' | 'artifacts'> & { stdout: string; stderr: string };
+
+// A file relative to the run directory, e.g. `inputs/case.txt` or an artifact's name under
+// outputs/. Artifacts the worker left out for the run's limits are `omitted` and carry only their size.
+export interface JobFile {
+  path: string;
+  data?: Buffer;
+  content_type?: string;
+  size?: number;
+  omitted?: boolean;
+}
+
+// Messages a worker sends. The first must be `register`; every message counts as a heartbeat.
+export interface WorkerMessage {
+  register?: { worker_id: string; languages: string[]; capacity: number; gpus?: GpuDevice[] };
+  heartbeat?: { running: number };
+  output?: { job_id: string; stream: OutputStream; data: Buffer };
+  // The build of a compiled language is done and the program has started.
+  started?: { job_id: string };
+  // The run passed one of the spec's memoryWarnings.
+  memory?: MemoryWarning & { job_id: string };
+  // A sample of the run's usage, for specs that set usageIntervalMs.
+  usage?: Omit<UsageSample, 'cpu_ms' | 'cpu_pct'> & { job_id: string; cpu_ms?: number | null; cpu_pct?: number | null };
+  result?: { job_id: string; result_json: string; artifacts?: JobFile[] };
+  // `status_code` is the HTTP status of a rejected spec, e.g. 400 when the worker refused the
+  // isolation level; 0 for other failures. `infrastructure` marks failures of the worker rather
+  // than the run, such as a sandbox that did not start, which another worker may not have.
+  failure?: { job_id: string; error: string; status_code?: number; infrastructure?: boolean };
+}
+
+export interface CoordinatorMessage {
+  job?: {
+    job_id: string;
+    attempt: number;
+    spec_json: string;
+    files?: JobFile[];
+    interactive?: boolean;
+    request_id?: string;
+    debug?: boolean;
+  };
+  cancel?: { job_id: string };
+  stdin?: { job_id: string; data?: Buffer; close?: boolean };
+}
+
+// One worker's connection to the coordinator, whatever carries it; the gRPC transport in
+// grpc/workers.ts is one.
+export interface WorkerLink<In, Out> {
+  send(message: Out): void;
+  onMessage(listener: (message: In) => void): void;
+  // Called once when the connection ends, from either side.
+  onClose(listener: (reason: string) => void): void;
+  close(): void;
+}
+
+export type CoordinatorLink = WorkerLink<WorkerMessage, CoordinatorMessage>;
+
+export interface CoordinatorOptions {
+  // A worker that has sent nothing for this long is presumed dead and its jobs are re-dispatched.
+  workerTimeoutMs: number;
+  // How long a job waits for a worker that runs its language before the run fails with 503.
+  dispatchTimeoutMs: number;
+  // Dispatches of one job before a run whose workers keep dying or failing to run it fails.
+  maxAttempts: number;
+}
+
+export interface WorkerStats {
+  id: string;
+  languages: string[];
+  capacity: number;
+  running: number;
+  gpus: GpuDeviceStats[];
+  connected_at: string;
+  last_seen_at: string;
+}
+
+export interface CoordinatorStats {
+  workers: WorkerStats[];
+  // Jobs waiting for a worker with a free slot.
+  waiting: number;
+  // Jobs handed to another worker after theirs was lost or could not run them.
+  redispatched: number;
+}
+
+interface ConnectedWorker {
+  id: string;
+  languages: Set<string>;
+  capacity: number;
+  jobs: Set<RemoteJob>;
+  gpus: GpuPool;
+  link: CoordinatorLink;
+  connectedAt: number;
+  lastSeen: number;
+}
+
+interface RemoteJob {
+  spec: SandboxRunSpec;
+  files: JobFile[];
+  attempts: number;
+  // Attempts given up on, and the workers they failed on, which the job avoids from then on.
+  retries: RunRetry[];
+  worker: ConnectedWorker | null;
+  // Devices reserved on the worker for a run that asked for GPUs.
+  gpus: GpuLease | null;
+  timer: NodeJS.Timeout | null;
+  settled: boolean;
+  // The run's log context, whose request ID and debug logging the worker takes over.
+  log: LogContext;
+  resolve: (result: SandboxResult) => void;
+  reject: (err: Error) => void;
+}
+
+// Hands runs to the workers connected to it instead of a local backend, so one API server can
+// accept submissions for many machines. Workers advertise their languages, how many runs they
+// take at once and their GPUs; each job goes to the least loaded worker that runs its language
+// and, for runs asking for GPUs, has enough of them free, whose devices the coordinator reserves
+// for the run. The jobs of a worker that disconnects or stops sending heartbeats go to another,
+// as do jobs that fail on a worker for reasons of its own; failures of the run's code or request
+// are final. The orchestrator, queue and store stay on the coordinator, which sees workers as one
+// more SandboxRunner.
+export class Coordinator implements SandboxRunner {
+  private readonly workers = new Map<string, ConnectedWorker>();
+  private readonly jobs = new Map<string, RemoteJob>();
+  private waiting: RemoteJob[] = [];
+  private redispatched = 0;
+  private monitor: NodeJS.Timeout | null = null;
+
+  constructor(private readonly options: CoordinatorOptions, private readonly logger: Logger) { }
+
+  // Checks for silent workers a few times per timeout.
+  public start() {
+    this.monitor = setInterval(() => this.expireWorkers(), Math.max(100, Math.floor(this.options.workerTimeoutMs / 3)));
+    this.monitor.unref();
+  }
+
+  public stop() {
+    if (this.monitor) {
+      clearInterval(this.monitor);
+      this.monitor = null;
+    }
+    for (const worker of [...this.workers.values()]) {
+      this.lose(worker, 'coordinator shutting down');
+    }
+  }
+
+  // Adopts a new worker connection once it has registered.
+  public connect(link: CoordinatorLink) {
+    let worker: ConnectedWorker | null = null;
+    link.onMessage((message) => {
+      if (!worker) {
+        if (!message.register?.worker_id || !(message.register.capacity > 0)) {
+          this.logger.warn('worker connection did not register', {});
+          link.close();
+          return;
+        }
+        worker = this.register(link, message.register);
+        return;
+      }
+      this.receive(worker, message);
+    });
+    link.onClose((reason) => {
+      if (worker && this.workers.get(worker.id) === worker) {
+        this.lose(worker, reason);
+      }
+    });
+  }
+
+  public run(spec: SandboxRunSpec): Promise<SandboxResult> {
+    if (spec.signal?.aborted) {
+      return Promise.resolve(canceledResult());
+    }
+    const files = collectFiles(spec);
+    return new Promise<SandboxResult>((resolve, reject) => {
+      const job: RemoteJob = {
+        spec,
+        files,
+        attempts: 0,
+        retries: [],
+        worker: null,
+        gpus: null,
+        timer: null,
+        settled: false,
+        log: currentLogContext(),
+        resolve,
+        reject
+      };
+      this.jobs.set(spec.id, job);
+      spec.signal?.addEventListener('abort', () => this.cancel(job), { once: true });
+      this.enqueue(job);
+      this.pump();
+    });
+  }
+
+  public stats(): CoordinatorStats {
+    return {
+      workers: [...this.workers.values()].map((worker) => ({
+        id: worker.id,
+        languages: [...worker.languages],
+        capacity: worker.capacity,
+        running: worker.jobs.size,
+        gpus: worker.gpus.stats(),
+        connected_at: new Date(worker.connectedAt).toISOString(),
+        last_seen_at: new Date(worker.lastSeen).toISOString()
+      })),
+      waiting: this.waiting.length,
+      redispatched: this.redispatched
+    };
+  }
+
+  private register(link: CoordinatorLink, registration: NonNullable<WorkerMessage['register']>) {
+    // A worker that reconnects under its old ID replaces its lost connection.
+    const previous = this.workers.get(registration.worker_id);
+    if (previous) {
+      this.lose(previous, 'replaced by a new connection');
+    }
+    const now = Date.now();
+    const worker: ConnectedWorker = {
+      id: registration.worker_id,
+      languages: new Set(registration.languages),
+      capacity: registration.capacity,
+      jobs: new Set(),
+      gpus: new GpuPool(registration.gpus ?? []),
+      link,
+      connectedAt: now,
+      lastSeen: now
+    };
+    this.workers.set(worker.id, worker);
+    this.logger.info('worker registered', {
+      worker: worker.id,
+      capacity: worker.capacity,
+      languages: registration.languages.join(','),
+      gpus: worker.gpus.size
+    });
+    this.pump();
+    return worker;
+  }
+
+  private receive(worker: ConnectedWorker, message: WorkerMessage) {
+    worker.lastSeen = Date.now();
+    const jobId =
+      message.output?.job_id ??
+      message.started?.job_id ??
+      message.memory?.job_id ??
+      message.usage?.job_id ??
+      message.result?.job_id ??
+      message.failure?.job_id;
+    const job = jobId === undefined ? undefined : this.jobs.get(jobId);
+    // Late messages for jobs that have since gone elsewhere are dropped.
+    if (!job || job.worker !== worker) {
+      return;
+    }
+    if (message.output) {
+      job.spec.onOutput?.(message.output.stream, message.output.data);
+    } else if (message.started) {
+      job.spec.onRunStart?.();
+    } else if (message.memory) {
+      const { job_id: _jobId, ...warning } = message.memory;
+      job.spec.onMemoryPressure?.(warning);
+    } else if (message.usage) {
+      // Unset optional fields are left out of decoded messages.
+      const { elapsed_ms: elapsedMs, memory_mb: memoryMb, cpu_ms: cpuMs, cpu_pct: cpuPct } = message.usage;
+      job.spec.onUsageSample?.({ elapsed_ms: elapsedMs, memory_mb: memoryMb, cpu_ms: cpuMs ?? null, cpu_pct: cpuPct ?? null });
+    } else if (message.result) {
+      let result: SandboxResult;
+      try {
+        result = this.decodeResult(job.spec, message.result.result_json, message.result.artifacts ?? []);
+      } catch (err) {
+        this.finish(job, null, err as Error);
+        return;
+      }
+      this.finish(job, result);
+    } else if (message.failure) {
+      const { error, status_code: statusCode, infrastructure } = message.failure;
+      const err = statusCode ? new Boom.Boom(error, { statusCode }) : new Error(error);
+      if (infrastructure) {
+        this.retry(job, worker, err);
+        this.pump();
+      } else {
+        this.finish(job, null, err);
+      }
+    }
+  }
+
+  private enqueue(job: RemoteJob, front = false) {
+    if (front) {
+      this.waiting.unshift(job);
+    } else {
+      this.waiting.push(job);
+    }
+    job.timer = setTimeout(() => {
+      this.waiting = this.waiting.filter((waiting) => waiting !== job);
+      const wanted = job.spec.gpu ? `${job.spec.language} with ${job.spec.gpu.count} free GPU(s)` : job.spec.language;
+      this.finish(job, null, Boom.serverUnavailable(`no worker available for ${wanted}`, { code: 'no_worker' }));
+    }, this.options.dispatchTimeoutMs);
+  }
+
+  // Dispatches waiting jobs, oldest first, while any worker that runs their language has room.
+  // A job waiting for GPUs does not hold up the jobs behind it.
+  private pump() {
+    const still: RemoteJob[] = [];
+    for (const job of this.waiting) {
+      const picked = this.pick(job);
+      if (picked) {
+        this.dispatch(job, picked.worker, picked.gpus);
+      } else {
+        still.push(job);
+      }
+    }
+    this.waiting = still;
+  }
+
+  // The least loaded worker that can take the job, with its GPUs reserved when it asked for any.
+  // A retried job waits for a worker it has not failed on while one that runs its language is
+  // connected, and goes back to the others only when none is.
+  private pick(job: RemoteJob): { worker: ConnectedWorker; gpus: GpuLease | null } | null {
+    const spec = job.spec;
+    const capable = [...this.workers.values()].filter((worker) => worker.languages.has(spec.language));
+    const untried = capable.filter((worker) => !job.retries.some((retry) => retry.worker === worker.id));
+    const candidates = (untried.length > 0 ? untried : capable)
+      .filter((worker) => worker.jobs.size < worker.capacity)
+      .sort((a, b) => a.jobs.size / a.capacity - b.jobs.size / b.capacity);
+    for (const worker of candidates) {
+      const gpus = spec.gpu ? worker.gpus.tryAcquire(spec.gpu) : null;
+      if (!spec.gpu || gpus) {
+        return { worker, gpus };
+      }
+    }
+    return null;
+  }
+
+  private dispatch(job: RemoteJob, worker: ConnectedWorker, gpus: GpuLease | null) {
+    if (job.timer) {
+      clearTimeout(job.timer);
+      job.timer = null;
+    }
+    job.attempts++;
+    job.worker = worker;
+    job.gpus = gpus;
+    worker.jobs.add(job);
+    const {
+      workdir: _workdir,
+      stagedFiles: _staged,
+      onOutput: _onOutput,
+      onRunStart: _onRunStart,
+      onMemoryPressure: _onMemoryPressure,
+      onUsageSample: _onUsageSample,
+      signal: _signal,
+      input,
+      ...remote
+    } = job.spec;
+    const spec: RemoteSpec = gpus ? { ...remote, gpuDevices: gpus.devices } : remote;
+    worker.link.send({
+      job: {
+        job_id: job.spec.id,
+        attempt: job.attempts,
+        spec_json: JSON.stringify(spec),
+        files: job.files,
+        interactive: Boolean(input),
+        request_id: job.log.requestId,
+        debug: job.log.debug
+      }
+    });
+    if (input && job.attempts === 1) {
+      input.on('data', (chunk: Buffer | string) => {
+        job.worker?.link.send({ stdin: { job_id: job.spec.id, data: Buffer.from(chunk) } });
+      });
+      input.on('end', () => job.worker?.link.send({ stdin: { job_id: job.spec.id, close: true } }));
+    }
+  }
+
+  private cancel(job: RemoteJob) {
+    if (job.settled) {
+      return;
+    }
+    if (job.worker) {
+      // The worker stops the run and reports it canceled.
+      job.worker.link.send({ cancel: { job_id: job.spec.id } });
+      return;
+    }
+    this.waiting = this.waiting.filter((waiting) => waiting !== job);
+    this.finish(job, canceledResult());
+  }
+
+  private finish(job: RemoteJob, result: SandboxResult | null, err?: Error) {
+    if (job.settled) {
+      return;
+    }
+    job.settled = true;
+    if (job.timer) {
+      clearTimeout(job.timer);
+    }
+    job.worker?.jobs.delete(job);
+    job.worker = null;
+    job.gpus?.release();
+    job.gpus = null;
+    this.jobs.delete(job.spec.id);
+    if (result) {
+      job.resolve(job.retries.length > 0 ? { ...result, retries: job.retries } : result);
+    } else {
+      job.reject(err ?? new Error('job failed'));
+    }
+    this.pump();
+  }
+
+  private lose(worker: ConnectedWorker, reason: string) {
+    this.workers.delete(worker.id);
+    worker.link.close();
+    const jobs = [...worker.jobs];
+    this.logger.warn('worker lost', { worker: worker.id, reason, jobs: jobs.length });
+    for (const job of jobs) {
+      this.retry(job, worker, new Error(`worker ${worker.id} was lost: ${reason}`));
+    }
+    this.pump();
+  }
+
+  // Takes a job back from a worker that could not finish it, failing the run with `err` unless
+  // it can go to another. A run is dispatched again unless it was canceled, is an interactive
+  // session whose input can't be replayed, or has used up its attempts. Output the worker
+  // streamed is not retracted, so followers of a re-dispatched run see it from the start again.
+  private retry(job: RemoteJob, worker: ConnectedWorker, err: Error) {
+    worker.jobs.delete(job);
+    job.worker = null;
+    job.gpus?.release();
+    job.gpus = null;
+    if (job.spec.signal?.aborted) {
+      this.finish(job, canceledResult());
+    } else if (job.spec.input || job.attempts >= this.options.maxAttempts) {
+      this.finish(job, null, err);
+    } else {
+      job.retries.push({ attempt: job.attempts, worker: worker.id, error: err.message });
+      this.logger.warn('run dispatched again', { runId: job.spec.id, worker: worker.id, attempt: job.attempts, error: err.message });
+      this.redispatched++;
+      this.enqueue(job, true);
+    }
+  }
+
+  private expireWorkers() {
+    const deadline = Date.now() - this.options.workerTimeoutMs;
+    for (const worker of [...this.workers.values()]) {
+      if (worker.lastSeen < deadline) {
+        this.lose(worker, 'heartbeat timed out');
+      }
+    }
+  }
+
+  // Artifacts are written into the coordinator's run directory, where the orchestrator collects
+  // them as if the run had been local. Files the worker left out for the run's limits come back
+  // as sparse files of their size, so the orchestrator's own selection skips them for the same reason.
+  private decodeResult(spec: SandboxRunSpec, json: string, files: JobFile[]): SandboxResult {
+    const remote = JSON.parse(json) as RemoteResult;
+    const outputsDir = path.join(spec.workdir, 'outputs');
+    const artifacts: SandboxResult['artifacts'] = [];
+    for (const file of files) {
+      const dest = path.join(outputsDir, file.path);
+      if (!file.path || !isRelativeInside(path.relative(outputsDir, dest)) || path.isAbsolute(file.path)) {
+        continue;
+      }
+      fs.mkdirSync(path.dirname(dest), { recursive: true });
+      if (file.omitted) {
+        fs.writeFileSync(dest, '');
+        fs.truncateSync(dest, file.size ?? 0);
+      } else {
+        fs.writeFileSync(dest, file.data ?? Buffer.alloc(0));
+      }
+      artifacts.push({ path: dest, name: file.path, size: file.size ?? file.data?.length ?? 0, contentType: file.content_type || undefined });
+    }
+    return {
+      ...remote,
+      stdout: Buffer.from(remote.stdout, 'base64'),
+      stderr: Buffer.from(remote.stderr, 'base64'),
+      artifacts
+    };
+  }
+}
+
+// The inputs/ directory as the orchestrator left it, with the uploaded files it names copied in,
+// since workers see neither the coordinator's work root nor its storage directory.
+function collectFiles(spec: SandboxRunSpec): JobFile[] {
+  const files: JobFile[] = [];
+  const inputsDir = path.join(spec.workdir, 'inputs');
+  if (fs.existsSync(inputsDir)) {
+    for (const entry of fs.readdirSync(inputsDir, { recursive: true, withFileTypes: true })) {
+      if (entry.isFile()) {
+        const full = path.join(entry.parentPath, entry.name);
+        files.push({ path: path.relative(spec.workdir, full), data: fs.readFileSync(full) });
+      }
+    }
+  }
+  for (const staged of spec.stagedFiles) {
+    if (!isRelativeInside(staged.destPath)) {
+      continue;
+    }
+    files.push({ path: path.join('inputs', staged.destPath), data: fs.readFileSync(staged.sourcePath) });
+  }
+  return files;
+}
@@ -0,0 +1,31 @@
+import type { RunCost, RunLimits, RunUsage } from './types.js';
+
+// Compute units charged per CPU-second, per GB-second of memory and per second of sandbox time.
+export interface CostWeights {
+  cpu_second: number;
+  gb_second: number;
+  sandbox_second: number;
+}
+
+export const DEFAULT_COST_WEIGHTS: CostWeights = { cpu_second: 1, gb_second: 1, sandbox_second: 0 };
+
+export const NO_COST: RunCost = { cpu_seconds: 0, memory_gb_seconds: 0, sandbox_seconds: 0, units: 0 };
+
+// Memory is charged by the limit rather than the peak, as the limit is what the sandbox holds
+// the host to for as long as it exists.
+export function runCost(usage: RunUsage, limits: RunLimits, sandboxMs: number, weights: CostWeights): RunCost {
+  const cpuSeconds = usage.cpu_ms / 1000;
+  const sandboxSeconds = sandboxMs / 1000;
+  const gbSeconds = (limits.memory_mb / 1024) * sandboxSeconds;
+  return {
+    cpu_seconds: round(cpuSeconds),
+    memory_gb_seconds: round(gbSeconds),
+    sandbox_seconds: round(sandboxSeconds),
+    units: round(cpuSeconds * weights.cpu_second + gbSeconds * weights.gb_second + sandboxSeconds * weights.sandbox_second)
+  };
+}
+
+// Sums over many runs keep to the same precision as a run's own figures.
+export function round(value: number): number {
+  return Math.round(value * 1e6) / 1e6;
+}
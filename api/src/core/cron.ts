@@ -0,0 +1,125 @@
+import Boom from '@hapi/boom';
+
+// A five-field cron expression (minute, hour, day of month, month, day of week) evaluated in UTC.
+// Fields take `*`, single values, ranges and `/` steps, comma-separated, with month and day
+// names (`JAN`, `MON`) and 0 or 7 for Sunday; `@hourly`, `@daily`, `@weekly`, `@monthly` and
+// `@yearly` stand for the usual expressions. As in Vixie cron, a day matches when either the day
+// of month or the day of week does once both are restricted.
+export interface CronExpression {
+  source: string;
+  // The first time after `after`, to the minute, that the expression matches.
+  next(after: Date): Date;
+}
+
+interface Field {
+  name: string;
+  min: number;
+  max: number;
+  names?: string[];
+}
+
+const FIELDS: Field[] = [
+  { name: 'minute', min: 0, max: 59 },
+  { name: 'hour', min: 0, max: 23 },
+  { name: 'day of month', min: 1, max: 31 },
+  { name: 'month', min: 1, max: 12, names: ['JAN', 'FEB', 'MAR', 'APR', 'MAY', 'JUN', 'JUL', 'AUG', 'SEP', 'OCT', 'NOV', 'DEC'] },
+  { name: 'day of week', min: 0, max: 7, names: ['SUN', 'MON', 'TUE', 'WED', 'THU', 'FRI', 'SAT'] }
+];
+
+const MACROS: Record<string, string> = {
+  '@yearly': '0 0 1 1 *',
+  '@annually': '0 0 1 1 *',
+  '@monthly': '0 0 1 * *',
+  '@weekly': '0 0 * * 0',
+  '@daily': '0 0 * * *',
+  '@midnight': '0 0 * * *',
+  '@hourly': '0 * * * *'
+};
+
+const MINUTE_MS = 60_000;
+// Long enough for every day that exists to come round, 29 February included.
+const SEARCH_YEARS = 8;
+
+export function parseCron(source: unknown): CronExpression {
+  if (typeof source !== 'string' || !source.trim()) {
+    throw Boom.badRequest('cron must be a cron expression such as "0 3 * * *"');
+  }
+  const expanded = MACROS[source.trim().toLowerCase()] ?? source.trim();
+  const parts = expanded.split(/\s+/);
+  if (parts.length !== FIELDS.length) {
+    throw Boom.badRequest(`cron must have ${FIELDS.length} fields (minute hour day-of-month month day-of-week), got ${parts.length}`);
+  }
+  const [minutes, hours, daysOfMonth, months, rawDaysOfWeek] = parts.map((part, index) => parseField(part, FIELDS[index]));
+  // 7 is another name for Sunday.
+  const daysOfWeek = new Set([...rawDaysOfWeek].map((day) => day % 7));
+  const anyDayOfMonth = parts[2] === '*' || parts[2] === '?';
+  const anyDayOfWeek = parts[4] === '*' || parts[4] === '?';
+  const dayMatches = (date: Date) => {
+    const byMonth = daysOfMonth.has(date.getUTCDate());
+    const byWeek = daysOfWeek.has(date.getUTCDay());
+    if (anyDayOfMonth || anyDayOfWeek) {
+      return (anyDayOfMonth || byMonth) && (anyDayOfWeek || byWeek);
+    }
+    return byMonth || byWeek;
+  };
+  const next = (after: Date) => {
+    const limit = Date.UTC(after.getUTCFullYear() + SEARCH_YEARS, 0, 1);
+    let time = new Date(Math.floor(after.getTime() / MINUTE_MS) * MINUTE_MS + MINUTE_MS);
+    // Skips whole months, days and hours that can't match before stepping through minutes.
+    while (time.getTime() < limit) {
+      if (!months.has(time.getUTCMonth() + 1)) {
+        time = new Date(Date.UTC(time.getUTCFullYear(), time.getUTCMonth() + 1, 1));
+      } else if (!dayMatches(time)) {
+        time = new Date(Date.UTC(time.getUTCFullYear(), time.getUTCMonth(), time.getUTCDate() + 1));
+      } else if (!hours.has(time.getUTCHours())) {
+        time = new Date(Date.UTC(time.getUTCFullYear(), time.getUTCMonth(), time.getUTCDate(), time.getUTCHours() + 1));
+      } else if (!minutes.has(time.getUTCMinutes())) {
+        time = new Date(time.getTime() + MINUTE_MS);
+      } else {
+        return time;
+      }
+    }
+    throw Boom.badRequest(`cron expression ${source} never matches`);
+  };
+  const expression = { source: source.trim(), next };
+  // Refuses expressions such as "0 0 30 2 *" up front rather than when first due.
+  expression.next(new Date());
+  return expression;
+}
+
+function parseField(text: string, field: Field): Set<number> {
+  const values = new Set<number>();
+  for (const item of text.split(',')) {
+    const match = item.match(/^(\*|\?|[A-Za-z0-9]+(?:-[A-Za-z0-9]+)?)(?:\/(\d+))?$/);
+    if (!match || (match[1] === '?' && !field.name.startsWith('day'))) {
+      throw Boom.badRequest(`cron ${field.name} field is invalid: ${item}`);
+    }
+    const step = match[2] === undefined ? 1 : Number(match[2]);
+    let low: number;
+    let high: number;
+    if (match[1] === '*' || match[1] === '?') {
+      [low, high] = [field.min, field.max];
+    } else {
+      const [start, end] = match[1].split('-');
+      low = fieldValue(start, field);
+      // `5/15` runs from 5 to the end of the field.
+      high = end !== undefined ? fieldValue(end, field) : match[2] !== undefined ? field.max : low;
+    }
+    if (step < 1 || low > high) {
+      throw Boom.badRequest(`cron ${field.name} field is invalid: ${item}`);
+    }
+    for (let value = low; value <= high; value += step) {
+      values.add(value);
+    }
+  }
+  return values;
+}
+
+function fieldValue(text: string, field: Field): number {
+  const named = field.names?.indexOf(text.toUpperCase()) ?? -1;
+  const value = named >= 0 ? named + (field.name === 'month' ? 1 : 0) : /^\d+$/.test(text) ? Number(text) : NaN;
+  if (!(value >= field.min && value <= field.max)) {
+    throw Boom.badRequest(`cron ${field.name} must be from ${field.min} to ${field.max}, got ${text}`);
+  }
+  return value;
+}
@@ -0,0 +1,393 @@
+import crypto from 'node:crypto';
+import fs from 'node:fs';
+import path from 'node:path';
+import stream from 'node:stream';
+import { pipeline } from 'node:stream/promises';
+import zlib from 'node:zlib';
+import Boom from '@hapi/boom';
+import { listTarFile } from '../util/tar.js';
+import { listZipFile, openZipEntry } from '../util/zip.js';
+
+export type DatasetFormat = 'zip' | 'tar';
+
+export interface Dataset {
+  id: string;
+  name: string;
+  format: DatasetFormat;
+  // Content address of the extracted files: the same files under the same paths and modes give
+  // the same digest, whichever archive they came in.
+  digest: string;
+  files: number;
+  // Bytes of the extracted files.
+  size: number;
+  archive_size: number;
+  created_at: string;
+}
+
+export interface DatasetStoreOptions {
+  // Holds the dataset records, the extracted trees and the files they link to.
+  baseDir: string;
+  // Largest archive accepted for upload.
+  maxArchiveBytes?: number;
+  // Combined size of the extracted files, which bounds what a compressed archive may expand to.
+  maxBytes?: number;
+  maxFiles?: number;
+}
+
+interface ArchiveFile {
+  name: string;
+  mode: number;
+  size: number;
+  open(): stream.Readable;
+}
+
+const DEFAULT_MAX_ARCHIVE_BYTES = 2 * 1024 ** 3;
+const DEFAULT_MAX_BYTES = 8 * 1024 ** 3;
+const DEFAULT_MAX_FILES = 100_000;
+const NAME_PATTERN = /^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$/;
+const ID_PATTERN = /^ds_[0-9a-f]+$/;
+const MAX_PATH_LENGTH = 4096;
+// Room for the tar headers around the files when a gzipped tar is expanded before listing.
+const TAR_OVERHEAD_PER_FILE = 2048;
+
+// Named, immutable datasets, uploaded once as a zip or tar archive and mounted read-only into
+// any number of runs. Each extracted file is stored once per contents and mode under objects/
+// and hard-linked into a tree per distinct set of files under trees/<digest>, so uploading the
+// same fixtures again, under another name or in the other archive format costs no space, and a
+// new version shares its unchanged files with the old one. A tree is removed once no dataset
+// refers to it and no run has it mounted.
+export class DatasetStore {
+  public readonly maxArchiveBytes: number;
+  private readonly maxBytes: number;
+  private readonly maxFiles: number;
+  private datasets: Map<string, Dataset> | null = null;
+  // Runs holding each tree, by digest.
+  private readonly holds = new Map<string, number>();
+
+  constructor(private readonly options: DatasetStoreOptions) {
+    this.maxArchiveBytes = options.maxArchiveBytes ?? DEFAULT_MAX_ARCHIVE_BYTES;
+    this.maxBytes = options.maxBytes ?? DEFAULT_MAX_BYTES;
+    this.maxFiles = options.maxFiles ?? DEFAULT_MAX_FILES;
+  }
+
+  // Where uploads are spooled, on the same filesystem as the trees. Loads the records first, since
+  // that clears out this directory.
+  public get uploadDir() {
+    this.index();
+    return this.dir('tmp');
+  }
+
+  // Extracts the archive into a new dataset. Uploading a name again with the same contents
+  // returns the existing dataset with `created` false; different contents are refused, since a
+  // dataset never changes under the runs that mount it.
+  public async create(archivePath: string, name: unknown): Promise<{ dataset: Dataset; created: boolean }> {
+    if (typeof name !== 'string' || !NAME_PATTERN.test(name)) {
+      throw Boom.badRequest('name must be 1-64 letters, digits, dots, underscores or hyphens');
+    }
+    const index = this.index();
+    const archiveSize = fs.statSync(archivePath).size;
+    if (archiveSize > this.maxArchiveBytes) {
+      throw Boom.entityTooLarge(`dataset archive exceeds ${this.maxArchiveBytes} bytes`);
+    }
+    const scratch = fs.mkdtempSync(path.join(this.dir('tmp'), 'extract-'));
+    try {
+      const { format, files } = await this.openArchive(archivePath, scratch);
+      const tree = path.join(scratch, 'tree');
+      const { digest, size } = await this.extract(files, tree);
+      // Synchronous from here, so a concurrent upload or delete cannot interleave.
+      const existing = [...index.values()].find((dataset) => dataset.name === name);
+      if (existing) {
+        if (existing.digest === digest) {
+          return { dataset: existing, created: false };
+        }
+        throw Boom.conflict(`dataset ${name} already exists with different contents`, { code: 'dataset_exists' });
+      }
+      if (!fs.existsSync(this.treeDir(digest))) {
+        fs.renameSync(tree, this.treeDir(digest));
+      }
+      const dataset: Dataset = {
+        id: `ds_${crypto.randomBytes(12).toString('hex')}`,
+        name,
+        format,
+        digest,
+        files: files.length,
+        size,
+        archive_size: archiveSize,
+        created_at: new Date().toISOString()
+      };
+      fs.writeFileSync(this.recordPath(dataset.id), JSON.stringify(dataset));
+      index.set(dataset.id, dataset);
+      return { dataset, created: true };
+    } finally {
+      fs.rm(scratch, { recursive: true, force: true }, () => undefined);
+    }
+  }
+
+  public list(): Dataset[] {
+    return [...this.index().values()].sort((a, b) => a.created_at.localeCompare(b.created_at));
+  }
+
+  public get(id: string): Dataset {
+    const dataset = ID_PATTERN.test(id) ? this.index().get(id) : undefined;
+    if (!dataset) {
+      throw Boom.notFound('dataset not found');
+    }
+    return dataset;
+  }
+
+  // The extracted tree of the dataset, which runs mount as it is.
+  public pathOf(id: string) {
+    return this.treeDir(this.get(id).digest);
+  }
+
+  // Keeps the trees of these datasets while a run has them mounted, even if they are deleted
+  // meanwhile; call the returned function when the run ends.
+  public hold(ids: string[]): () => void {
+    const digests = ids.map((id) => this.get(id).digest);
+    for (const digest of digests) {
+      this.holds.set(digest, (this.holds.get(digest) ?? 0) + 1);
+    }
+    let released = false;
+    return () => {
+      if (released) {
+        return;
+      }
+      released = true;
+      for (const digest of digests) {
+        const remaining = (this.holds.get(digest) ?? 1) - 1;
+        if (remaining > 0) {
+          this.holds.set(digest, remaining);
+        } else {
+          this.holds.delete(digest);
+          this.collect(digest);
+        }
+      }
+    };
+  }
+
+  public delete(id: string) {
+    const dataset = this.get(id);
+    fs.rmSync(this.recordPath(id), { force: true });
+    this.index().delete(id);
+    this.collect(dataset.digest);
+  }
+
+  private async openArchive(archivePath: string, scratch: string): Promise<{ format: DatasetFormat; files: ArchiveFile[] }> {
+    const head = Buffer.alloc(512);
+    const fd = fs.openSync(archivePath, 'r');
+    try {
+      fs.readSync(fd, head, 0, head.length, 0);
+    } finally {
+      fs.closeSync(fd);
+    }
+    const magic = head.readUInt32LE(0);
+    if (magic === 0x04034b50 || magic === 0x06054b50) {
+      const entries = this.listing(() => listZipFile(archivePath));
+      return { format: 'zip', files: entries.map((entry) => ({ ...entry, open: () => openZipEntry(archivePath, entry) })) };
+    }
+    let tarPath = archivePath;
+    if (head[0] === 0x1f && head[1] === 0x8b) {
+      tarPath = path.join(scratch, 'archive.tar');
+      await this.archiveStep(pipeline(
+        fs.createReadStream(archivePath),
+        zlib.createGunzip(),
+        meter(this.maxBytes + this.maxFiles * TAR_OVERHEAD_PER_FILE, () => undefined),
+        fs.createWriteStream(tarPath)
+      ));
+    } else if (head.toString('ascii', 257, 262) !== 'ustar') {
+      throw Boom.badRequest('dataset archive must be a zip, tar or gzipped tar file');
+    }
+    const entries = this.listing(() => listTarFile(tarPath));
+    return {
+      format: 'tar',
+      files: entries.map((entry) => ({
+        ...entry,
+        open: () => (entry.size === 0 ? stream.Readable.from([]) : fs.createReadStream(tarPath, { start: entry.offset, end: entry.offset + entry.size - 1 }))
+      }))
+    };
+  }
+
+  // Writes every file under `tree`, linked to its stored object, and returns the digest of the
+  // whole listing.
+  private async extract(files: ArchiveFile[], tree: string) {
+    if (files.length === 0) {
+      throw Boom.badRequest('dataset archive contains no files');
+    }
+    if (files.length > this.maxFiles) {
+      throw Boom.badRequest(`dataset archive exceeds ${this.maxFiles} files`);
+    }
+    const names = files.map((file) => entryName(file.name));
+    checkConflicts(names);
+    let size = 0;
+    const listing: string[] = [];
+    for (const [index, file] of files.entries()) {
+      const target = path.join(tree, names[index]);
+      fs.mkdirSync(path.dirname(target), { recursive: true });
+      const hash = crypto.createHash('sha256');
+      const before = size;
+      await this.archiveStep(pipeline(
+        this.listing(() => file.open()),
+        meter(this.maxBytes - size, (chunk) => {
+          hash.update(chunk);
+          size += chunk.length;
+        }),
+        fs.createWriteStream(target, { flags: 'wx' })
+      ));
+      if (size - before !== file.size) {
+        throw Boom.badRequest(`invalid dataset archive: ${names[index]} is truncated`);
+      }
+      const executable = (file.mode & 0o111) !== 0;
+      const sha256 = hash.digest('hex');
+      this.linkObject(target, sha256, executable);
+      listing.push(`${executable ? 'x' : '-'} ${sha256} ${names[index]}`);
+    }
+    // By path, after the mode and hash.
+    listing.sort((a, b) => (a.slice(67) < b.slice(67) ? -1 : 1));
+    return { digest: crypto.createHash('sha256').update(listing.join('\n')).digest('hex'), size };
+  }
+
+  // Replaces the extracted file with a link to the stored copy of the same contents, or stores
+  // it as that copy when there is none yet. Stored files are read-only, so no holder of a link
+  // can change them for the others.
+  private linkObject(target: string, sha256: string, executable: boolean) {
+    const object = path.join(this.dir('objects'), sha256.slice(0, 2), executable ? `${sha256}.x` : sha256);
+    if (fs.existsSync(object)) {
+      fs.rmSync(target);
+      fs.linkSync(object, target);
+      return;
+    }
+    fs.chmodSync(target, executable ? 0o555 : 0o444);
+    fs.mkdirSync(path.dirname(object), { recursive: true });
+    fs.linkSync(target, object);
+  }
+
+  // Removes the tree once nothing refers to it, then every stored file no tree links to.
+  private collect(digest: string) {
+    if (this.holds.has(digest) || [...this.index().values()].some((dataset) => dataset.digest === digest)) {
+      return;
+    }
+    const tree = this.treeDir(digest);
+    if (!fs.existsSync(tree)) {
+      return;
+    }
+    // Moved aside first, so an upload of the same files meanwhile gets a tree of its own.
+    const trash = path.join(this.dir('trash'), `${digest}-${crypto.randomBytes(4).toString('hex')}`);
+    fs.renameSync(tree, trash);
+    fs.promises
+      .rm(trash, { recursive: true, force: true })
+      .then(() => this.sweepObjects())
+      .catch(() => undefined);
+  }
+
+  private sweepObjects() {
+    const objects = this.dir('objects');
+    for (const fanout of fs.readdirSync(objects)) {
+      for (const name of fs.readdirSync(path.join(objects, fanout))) {
+        const object = path.join(objects, fanout, name);
+        if (fs.statSync(object).nlink === 1) {
+          fs.rmSync(object, { force: true });
+        }
+      }
+    }
+  }
+
+  // Loads the records on first use, dropping what an interrupted upload or delete left behind.
+  private index(): Map<string, Dataset> {
+    if (this.datasets) {
+      return this.datasets;
+    }
+    for (const leftover of ['tmp', 'trash']) {
+      fs.rmSync(path.join(this.options.baseDir, leftover), { recursive: true, force: true });
+    }
+    this.datasets = new Map();
+    for (const file of fs.readdirSync(this.dir('records'))) {
+      const dataset = JSON.parse(fs.readFileSync(path.join(this.dir('records'), file), 'utf8')) as Dataset;
+      this.datasets.set(dataset.id, dataset);
+    }
+    this.sweepObjects();
+    return this.datasets;
+  }
+
+  private listing<T>(list: () => T): T {
+    try {
+      return list();
+    } catch (err) {
+      throw Boom.badRequest(`invalid dataset archive: ${(err as Error).message}`);
+    }
+  }
+
+  // Errors of the archive's own making, such as bad deflate data, are the client's; others, such
+  // as a full disk, are not.
+  private async archiveStep(step: Promise<void>) {
+    try {
+      await step;
+    } catch (err) {
+      const code = (err as NodeJS.ErrnoException).code;
+      throw Boom.isBoom(err) || (code && !code.startsWith('Z_')) ? err : Boom.badRequest(`invalid dataset archive: ${(err as Error).message}`);
+    }
+  }
+
+  private dir(name: 'records' | 'trees' | 'objects' | 'tmp' | 'trash') {
+    const dir = path.join(this.options.baseDir, name);
+    fs.mkdirSync(dir, { recursive: true });
+    return dir;
+  }
+
+  private treeDir(digest: string) {
+    return path.join(this.dir('trees'), digest);
+  }
+
+  private recordPath(id: string) {
+    return path.join(this.dir('records'), `${id}.json`);
+  }
+}
+
+// Passes chunks through until more than `limit` bytes have gone by.
+function meter(limit: number, onChunk: (chunk: Buffer) => void) {
+  let seen = 0;
+  return new stream.Transform({
+    transform(chunk: Buffer, _encoding, done) {
+      seen += chunk.length;
+      if (seen > limit) {
+        done(Boom.entityTooLarge('dataset archive expands beyond the maximum dataset size'));
+        return;
+      }
+      onChunk(chunk);
+      done(null, chunk);
+    }
+  });
+}
+
+// Relative and normalized, so that every entry lands inside the tree.
+function entryName(name: string) {
+  const normalized = name.replace(/^(\.\/)+/, '');
+  const segments = normalized.split('/');
+  if (
+    normalized.length === 0 ||
+    normalized.length > MAX_PATH_LENGTH ||
+    normalized.startsWith('/') ||
+    normalized.includes('\\') ||
+    /[\u0000-\u001F\u007F]/.test(normalized) ||
+    segments.some((segment) => segment === '' || segment === '.' || segment === '..')
+  ) {
+    throw Boom.badRequest(`invalid dataset archive: unsafe path ${JSON.stringify(name)}`);
+  }
+  return normalized;
+}
+
+function checkConflicts(names: string[]) {
+  const files = new Set<string>();
+  for (const name of names) {
+    if (files.has(name)) {
+      throw Boom.badRequest(`invalid dataset archive: ${name} appears more than once`);
+    }
+    files.add(name);
+  }
+  for (const name of names) {
+    for (let slash = name.indexOf('/'); slash !== -1; slash = name.indexOf('/', slash + 1)) {
+      if (files.has(name.slice(0, slash))) {
+        throw Boom.badRequest(`invalid dataset archive: ${name.slice(0, slash)} is both a file and a directory`);
+      }
+    }
+  }
+}
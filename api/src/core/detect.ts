@@ -0,0 +1,197 @@
+import path from 'node:path';
+import Boom from '@hapi/boom';
+import { runnerRegistry } from './runners.js';
+import type { RunnerRegistry } from './runners.js';
+import type { Language, LanguageDetection } from './types.js';
+
+export interface DetectionInput {
+  // Name of the submitted entry file, e.g. from an upload or an editor tab.
+  filename?: string;
+  code?: string;
+  sources?: Record<string, string>;
+}
+
+// Detections below this are reported as ambiguous rather than guessed.
+const MIN_CONFIDENCE = 0.6;
+// Content heuristics stay below the certainty of a file name or shebang.
+const MAX_CONTENT_CONFIDENCE = 0.9;
+// Content evidence weighing this much counts as conclusive on its own.
+const CONCLUSIVE_SCORE = 3;
+
+// Interpreters named by a shebang, matched on the command's base name without version suffixes.
+const INTERPRETERS: Record<string, Language> = {
+  python: 'python',
+  node: 'node',
+  nodejs: 'node',
+  'ts-node': 'typescript',
+  tsx: 'typescript',
+  deno: 'typescript',
+  ruby: 'ruby',
+  php: 'php',
+  bash: 'bash',
+  sh: 'sh',
+  dash: 'sh',
+  ash: 'sh',
+  sqlite3: 'sql',
+  psql: 'sql'
+};
+
+interface Hint {
+  language: Language;
+  pattern: RegExp;
+  weight: number;
+}
+
+// Evidence for each language, weighted by how much it gives the language away. Constructs several
+// languages share get a little weight each so that the more specific ones decide.
+const HINTS: Hint[] = [
+  { language: 'php', pattern: /^\s*<\?php/, weight: 5 },
+  { language: 'python', pattern: /^\s*def \w+\(.*\)\s*(->\s*[\w[\], .]+)?:\s*$/m, weight: 3 },
+  { language: 'python', pattern: /^if __name__ == ['"]__main__['"]:/m, weight: 4 },
+  { language: 'python', pattern: /^\s*(from [\w.]+ )?import [\w., ]+$/m, weight: 1 },
+  { language: 'python', pattern: /^\s*print\(/m, weight: 1 },
+  { language: 'python', pattern: /^\s*(elif .*|else|try|except.*|for .+ in .+|while .+):\s*$/m, weight: 2 },
+  { language: 'go', pattern: /^package \w+\s*$/m, weight: 3 },
+  { language: 'go', pattern: /^func (\(\w+ \*?\w+\) )?\w+\(/m, weight: 2 },
+  { language: 'go', pattern: /\bfmt\.Print/, weight: 2 },
+  { language: 'go', pattern: /\w+ := /, weight: 1 },
+  { language: 'rust', pattern: /\bfn main\(\)/, weight: 3 },
+  { language: 'rust', pattern: /\bprintln!\(/, weight: 3 },
+  { language: 'rust', pattern: /\blet mut \w+/, weight: 2 },
+  { language: 'rust', pattern: /^use (std|crate)::/m, weight: 3 },
+  { language: 'java', pattern: /\bpublic static void main\(String/, weight: 4 },
+  { language: 'java', pattern: /\bSystem\.out\.print/, weight: 3 },
+  { language: 'java', pattern: /^\s*(public |final |abstract )*class \w+/m, weight: 1 },
+  { language: 'java', pattern: /^import java\./m, weight: 3 },
+  { language: 'kotlin', pattern: /^fun main\(/m, weight: 4 },
+  { language: 'kotlin', pattern: /^\s*(val|var) \w+(: \w+)? = /m, weight: 1 },
+  { language: 'kotlin', pattern: /^import kotlin\./m, weight: 3 },
+  { language: 'c', pattern: /^#include <(stdio|stdlib|string|math|stdint|stdbool|unistd)\.h>/m, weight: 2 },
+  { language: 'c', pattern: /\bprintf\(/, weight: 1 },
+  { language: 'c', pattern: /\bmalloc\(/, weight: 1 },
+  { language: 'c', pattern: /^\s*int main\((void|int argc, char \*\*?argv(\[\])?)?\)/m, weight: 1 },
+  { language: 'cpp', pattern: /^\s*int main\((void|int argc, char \*\*?argv(\[\])?)?\)/m, weight: 1 },
+  { language: 'cpp', pattern: /^#include <(iostream|vector|string|map|algorithm|memory|bits\/stdc\+\+\.h)>/m, weight: 4 },
+  { language: 'cpp', pattern: /\bstd::\w+/, weight: 3 },
+  { language: 'cpp', pattern: /^using namespace std;/m, weight: 4 },
+  { language: 'cpp', pattern: /\b(cout|cin) (<<|>>)/, weight: 3 },
+  { language: 'typescript', pattern: /^\s*(export )?(interface|type) \w+(<[^>]*>)? (=|\{)/m, weight: 3 },
+  { language: 'typescript', pattern: /\b(const|let)\s+\w+:\s*(string|number|boolean|\w+\[\])\b/, weight: 5 },
+  { language: 'typescript', pattern: /\bfunction \w+\([^)]*\w+: \w+/, weight: 5 },
+  { language: 'typescript', pattern: /\bconsole\.log\(/, weight: 1 },
+  { language: 'node', pattern: /\bconsole\.log\(/, weight: 3 },
+  { language: 'node', pattern: /\brequire\(['"][\w./:@-]+['"]\)/, weight: 3 },
+  { language: 'node', pattern: /\bmodule\.exports\b/, weight: 3 },
+  { language: 'node', pattern: /^\s*(const|let|var) \w+ = /m, weight: 1 },
+  { language: 'ruby', pattern: /^\s*puts\b/m, weight: 2 },
+  { language: 'ruby', pattern: /^\s*def \w+[?!]?(\(.*\))?\s*$/m, weight: 2 },
+  { language: 'ruby', pattern: /\bdo \|\w+(, ?\w+)*\|/, weight: 3 },
+  { language: 'ruby', pattern: /^\s*end\s*$/m, weight: 1 },
+  { language: 'ruby', pattern: /^require ['"][\w/]+['"]\s*$/m, weight: 2 },
+  { language: 'sql', pattern: /^\s*(SELECT|WITH)\b[\s\S]*\bFROM\b/im, weight: 2 },
+  { language: 'sql', pattern: /^\s*(CREATE (TABLE|VIEW|INDEX)|INSERT INTO|UPDATE \w+ SET|DELETE FROM)\b/im, weight: 4 },
+  { language: 'sql', pattern: /^\s*SELECT\b[^;]*;\s*$/im, weight: 2 },
+  // Commands and syntax every shell shares count for both; bashisms only for bash.
+  { language: 'bash', pattern: /^\s*(echo|printf) /m, weight: 1 },
+  { language: 'sh', pattern: /^\s*(echo|printf) /m, weight: 1 },
+  { language: 'bash', pattern: /^\s*(fi|done|esac)\s*$/m, weight: 2 },
+  { language: 'sh', pattern: /^\s*(fi|done|esac)\s*$/m, weight: 2 },
+  { language: 'bash', pattern: /\[\[ |\bdeclare -[aAi]|\bfunction \w+ *\{|\$\{\w+\[@\]\}|<<<|\w+=\(/, weight: 3 }
+];
+
+// Infers a request's language from the entry file's name, or failing that the names of its
+// sources, then from a shebang, then from what the code looks like. When several languages fit
+// equally well it refuses to guess, listing the candidates, so callers can set `language`.
+export function detectLanguage(input: DetectionInput, registry: RunnerRegistry = runnerRegistry): LanguageDetection {
+  const enabled = registry.list().map((runner) => runner.language);
+  // Malformed fields are left to request validation and simply give no evidence here.
+  const text = typeof input.code === 'string'
+    ? input.code
+    : Object.values(input.sources ?? {}).filter((source) => typeof source === 'string').join('\n');
+  const byName = languagesFromNames(input, registry);
+  if (byName.length === 1) {
+    return { language: byName[0], confidence: 1, source: 'filename' };
+  }
+  const candidates = byName.length > 0 ? byName : enabled;
+  const fromShebang = shebangLanguage(text);
+  if (fromShebang && candidates.includes(fromShebang)) {
+    return { language: fromShebang, confidence: 1, source: 'shebang' };
+  }
+  // Modules arrive base64-encoded; `AGFzbQ` is the encoded `\0asm` magic number.
+  if (text.startsWith('AGFzbQ') && candidates.includes('wasm')) {
+    return { language: 'wasm', confidence: 1, source: 'content' };
+  }
+  const scores = new Map<Language, number>();
+  for (const hint of HINTS) {
+    if (candidates.includes(hint.language) && hint.pattern.test(text)) {
+      scores.set(hint.language, (scores.get(hint.language) ?? 0) + hint.weight);
+    }
+  }
+  // A language's share of the evidence against its strongest rival, scaled down while that
+  // evidence is thin.
+  const confidenceOf = (language: Language, score: number) => {
+    const rival = Math.max(0, ...[...scores].filter(([other]) => other !== language).map(([, other]) => other));
+    return round(Math.min(MAX_CONTENT_CONFIDENCE, (score / (score + rival)) * Math.min(1, score / CONCLUSIVE_SCORE)));
+  };
+  const ranked = [...scores.entries()]
+    .sort((a, b) => b[1] - a[1])
+    .map(([language, score]) => ({ language, confidence: confidenceOf(language, score) }));
+  if (ranked.length === 0 && byName.length > 0) {
+    throw ambiguous(byName.map((language) => ({ language, confidence: round(1 / byName.length) })));
+  }
+  if (ranked.length === 0 || (ranked.length === 1 && ranked[0].confidence < MIN_CONFIDENCE)) {
+    throw Boom.badRequest('language is required and could not be detected', { code: 'language_undetected', candidates: ranked });
+  }
+  if (ranked[0].confidence < MIN_CONFIDENCE) {
+    throw ambiguous(ranked.slice(0, 3));
+  }
+  return { ...ranked[0], source: 'content' };
+}
+
+// Languages whose runners claim the entry file's extension. Without a file name the sources decide:
+// a source named like a runner's entry file, otherwise the extensions most of them share.
+function languagesFromNames(input: DetectionInput, registry: RunnerRegistry): Language[] {
+  const runners = registry.list();
+  if (typeof input.filename === 'string' && input.filename) {
+    const extension = path.extname(input.filename).toLowerCase();
+    return extension ? runners.filter((runner) => runner.extensions.includes(extension)).map((runner) => runner.language) : [];
+  }
+  const names = typeof input.sources === 'object' && input.sources !== null ? Object.keys(input.sources) : [];
+  const entries = runners.filter((runner) => names.includes(runner.entryFile));
+  if (entries.length > 0) {
+    return entries.map((runner) => runner.language);
+  }
+  const votes = new Map<Language, number>();
+  for (const name of names) {
+    for (const runner of runners.filter((candidate) => candidate.extensions.includes(path.extname(name).toLowerCase()))) {
+      votes.set(runner.language, (votes.get(runner.language) ?? 0) + 1);
+    }
+  }
+  const most = Math.max(0, ...votes.values());
+  return [...votes.entries()].filter(([, count]) => count === most).map(([language]) => language);
+}
+
+// `#!/usr/bin/python3`, `#!/usr/bin/env node` and `#!/usr/bin/env -S deno run` all name their
+// interpreter; the version in names like python3.12 is ignored.
+function shebangLanguage(text: string): Language | null {
+  const match = /^#!\s*(\S+)(.*)$/m.exec(text.split('\n', 1)[0]);
+  if (!match) {
+    return null;
+  }
+  let command = path.basename(match[1]);
+  if (command === 'env') {
+    command = match[2].trim().split(/\s+/).find((word) => !word.startsWith('-') && !word.includes('=')) ?? '';
+  }
+  return INTERPRETERS[command.replace(/[\d.]+$/, '')] ?? null;
+}
+
+function ambiguous(candidates: Array<{ language: Language; confidence: number }>) {
+  return Boom.badRequest(`language is ambiguous between ${candidates.map((candidate) => candidate.language).join(', ')}; set language`, {
+    code: 'language_ambiguous',
+    candidates
+  });
+}
+
+function round(value: number) {
+  return Math.round(value * 100) / 100;
+}
@@ -0,0 +1,211 @@
+import crypto from 'node:crypto';
+import dns from 'node:dns/promises';
+import http from 'node:http';
+import net from 'node:net';
+import type { Duplex } from 'node:stream';
+import Boom from '@hapi/boom';
+import { Logger } from '../util/logger.js';
+
+export interface EgressProxyOptions {
+  port: number;
+  // Address the proxy listens on.
+  host?: string;
+  // Host name sandboxes use to reach the proxy on the egress network, e.g. the API's service name.
+  advertisedHost: string;
+}
+
+export interface EgressGrant {
+  // Proxy URL with the run's credentials, handed to the program as HTTP(S)_PROXY.
+  proxyUrl: string;
+  release(): void;
+}
+
+const MAX_ALLOWLIST_ENTRIES = 32;
+const HOST_PATTERN = /^(\*\.)?([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$/i;
+
+// Checks the syntax of a request's egress allowlist: host names, `*.` wildcard domains, IP
+// addresses and CIDR ranges.
+export function validateAllowlist(allow: unknown): string[] {
+  if (!Array.isArray(allow) || allow.length === 0) {
+    throw Boom.badRequest('network.allow must list at least one host or CIDR');
+  }
+  if (allow.length > MAX_ALLOWLIST_ENTRIES) {
+    throw Boom.badRequest(`network.allow exceeds ${MAX_ALLOWLIST_ENTRIES} entries`);
+  }
+  for (const entry of allow) {
+    if (typeof entry !== 'string' || !(HOST_PATTERN.test(entry) || parseCidr(entry))) {
+      throw Boom.badRequest(`invalid network.allow entry: ${String(entry)}`);
+    }
+  }
+  return allow as string[];
+}
+
+// Whether an operator allowlist covers a requested entry: listed verbatim, or a host name under
+// one of its wildcard domains.
+export function permits(operatorList: string[], entry: string): boolean {
+  return operatorList.includes(entry) || (!parseCidr(entry) && matchesHost(operatorList, entry));
+}
+
+// A sandbox on the egress network can reach nothing but this proxy, so it is the only way out.
+// Each run gets its own credentials tied to its allowlist; the proxy resolves the destination
+// itself and connects to the address it checked, so DNS answers cannot be swapped in between.
+// Both CONNECT tunnels (HTTPS and other TCP) and plain HTTP requests are supported.
+export class EgressProxy {
+  private readonly grants = new Map<string, { runId: string; allow: string[] }>();
+  private readonly server: http.Server;
+
+  constructor(private readonly options: EgressProxyOptions, private readonly logger: Logger) {
+    this.server = http.createServer((req, res) => void this.forward(req, res));
+    this.server.on('connect', (req: http.IncomingMessage, socket: Duplex, head: Buffer) => void this.tunnel(req, socket, head));
+  }
+
+  public listen(): Promise<number> {
+    return new Promise((resolve, reject) => {
+      this.server.once('error', reject);
+      this.server.listen(this.options.port, this.options.host ?? '0.0.0.0', () => {
+        resolve((this.server.address() as net.AddressInfo).port);
+      });
+    });
+  }
+
+  public close() {
+    this.server.close();
+  }
+
+  public grant(runId: string, allow: string[]): EgressGrant {
+    const token = crypto.randomBytes(18).toString('hex');
+    this.grants.set(token, { runId, allow });
+    const port = (this.server.address() as net.AddressInfo | null)?.port ?? this.options.port;
+    return {
+      proxyUrl: `http://${runId}:${token}@${this.options.advertisedHost}:${port}`,
+      release: () => {
+        this.grants.delete(token);
+      }
+    };
+  }
+
+  private async tunnel(req: http.IncomingMessage, socket: Duplex, head: Buffer) {
+    socket.on('error', () => socket.destroy());
+    const target = splitHostPort(req.url ?? '', 443);
+    const address = target && (await this.authorize(req, target.host));
+    if (!target || !address) {
+      socket.end('HTTP/1.1 403 Forbidden\r\n\r\n');
+      return;
+    }
+    const upstream = net.connect(target.port, address, () => {
+      socket.write('HTTP/1.1 200 Connection Established\r\n\r\n');
+      if (head.length) {
+        upstream.write(head);
+      }
+      upstream.pipe(socket);
+      socket.pipe(upstream);
+    });
+    upstream.on('error', () => socket.end('HTTP/1.1 502 Bad Gateway\r\n\r\n'));
+    socket.on('close', () => upstream.destroy());
+  }
+
+  private async forward(req: http.IncomingMessage, res: http.ServerResponse) {
+    let url: URL;
+    try {
+      url = new URL(req.url ?? '');
+    } catch {
+      res.writeHead(400).end();
+      return;
+    }
+    const address = url.protocol === 'http:' ? await this.authorize(req, url.hostname) : null;
+    if (!address) {
+      res.writeHead(403).end();
+      return;
+    }
+    const headers = { ...req.headers };
+    delete headers['proxy-authorization'];
+    delete headers['proxy-connection'];
+    const upstream = http.request(
+      { host: address, port: url.port || 80, method: req.method, path: `${url.pathname}${url.search}`, headers },
+      (upstreamRes) => {
+        res.writeHead(upstreamRes.statusCode ?? 502, upstreamRes.headers);
+        upstreamRes.pipe(res);
+      }
+    );
+    upstream.on('error', () => {
+      if (!res.headersSent) {
+        res.writeHead(502);
+      }
+      res.end();
+    });
+    req.pipe(upstream);
+  }
+
+  // Returns the address to connect to when the run's credentials allow the destination.
+  private async authorize(req: http.IncomingMessage, host: string): Promise<string | null> {
+    const grant = this.grantFor(req.headers['proxy-authorization']);
+    if (!grant) {
+      return null;
+    }
+    const bareHost = host.replace(/^\[|\]$/g, '');
+    let address = bareHost;
+    if (!net.isIP(bareHost)) {
+      try {
+        address = (await dns.lookup(bareHost)).address;
+      } catch {
+        return null;
+      }
+    }
+    const allowed = (!net.isIP(bareHost) && matchesHost(grant.allow, bareHost)) || matchesAddress(grant.allow, address);
+    this.logger.info('egress request', { runId: grant.runId, host: bareHost, address, allowed });
+    return allowed ? address : null;
+  }
+
+  private grantFor(header: string | undefined) {
+    const [scheme, encoded] = (header ?? '').split(' ');
+    if (scheme?.toLowerCase() !== 'basic' || !encoded) {
+      return null;
+    }
+    const credentials = Buffer.from(encoded, 'base64').toString('utf8');
+    const token = credentials.slice(credentials.indexOf(':') + 1);
+    return this.grants.get(token) ?? null;
+  }
+}
+
+function matchesHost(allow: string[], host: string): boolean {
+  const name = host.toLowerCase();
+  return allow.some((entry) => {
+    const pattern = entry.toLowerCase();
+    return pattern.startsWith('*.') ? name.endsWith(pattern.slice(1)) : name === pattern;
+  });
+}
+
+function matchesAddress(allow: string[], address: string): boolean {
+  const blockList = new net.BlockList();
+  for (const entry of allow) {
+    const cidr = parseCidr(entry);
+    if (cidr) {
+      blockList.addSubnet(cidr.network, cidr.prefix, cidr.family);
+    }
+  }
+  const family = net.isIP(address) === 6 ? 'ipv6' : 'ipv4';
+  return blockList.check(address, family);
+}
+
+// Parses an IP address or CIDR range; a bare address is a single-host range.
+function parseCidr(entry: string): { network: string; prefix: number; family: 'ipv4' | 'ipv6' } | null {
+  const [network, prefixText, ...rest] = entry.split('/');
+  const version = net.isIP(network);
+  if (!version || rest.length) {
+    return null;
+  }
+  const maxPrefix = version === 4 ? 32 : 128;
+  const prefix = prefixText === undefined ? maxPrefix : Number(prefixText);
+  if (!/^\d+$/.test(prefixText ?? String(maxPrefix)) || prefix > maxPrefix) {
+    return null;
+  }
+  return { network, prefix, family: version === 4 ? 'ipv4' : 'ipv6' };
+}
+
+function splitHostPort(authority: string, defaultPort: number): { host: string; port: number } | null {
+  const match = /^(\[[^\]]+\]|[^:]+)(?::(\d+))?$/.exec(authority);
+  if (!match) {
+    return null;
+  }
+  return { host: match[1], port: match[2] ? Number(match[2]) : defaultPort };
+}
@@ -0,0 +1,76 @@
+import Boom from '@hapi/boom';
+
+export interface EnvPolicyOptions {
+  // Names callers may set; an entry ending in `*` allows every name with that prefix. When unset
+  // any name that is not denied is accepted.
+  allow?: string[];
+  // Prefixes callers may never set, on top of DENIED_PREFIXES.
+  denyPrefixes?: string[];
+  // Upper bound on the combined size of names and values.
+  maxBytes?: number;
+  maxVars?: number;
+}
+
+// Loader variables can inject code into every process in the sandbox, including the runner
+// entrypoint's own helpers.
+const DENIED_PREFIXES = ['LD_', 'DYLD_'];
+// Set by the sandbox and the runners themselves to keep programs inside /work, or from the
+// request's `reproducible` options.
+const RESERVED_NAMES = new Set(['HOME', 'TMPDIR', 'PATH', 'EXECUTOR_FAKE_TIME', 'EXECUTOR_RANDOM_SEED']);
+const NAME_PATTERN = /^[A-Za-z_][A-Za-z0-9_]*$/;
+
+const DEFAULT_MAX_BYTES = 16 * 1024;
+const DEFAULT_MAX_VARS = 64;
+
+// Decides which environment variables a request may pass to its program. Violations are
+// request errors rather than silently dropped variables, so callers learn their configuration
+// did not reach the program.
+export class EnvPolicy {
+  private readonly denyPrefixes: string[];
+
+  constructor(private readonly options: EnvPolicyOptions = {}) {
+    this.denyPrefixes = [...DENIED_PREFIXES, ...(options.denyPrefixes ?? [])].map((prefix) => prefix.toUpperCase());
+  }
+
+  public validate(env: unknown): Record<string, string> {
+    if (env === undefined) {
+      return {};
+    }
+    if (typeof env !== 'object' || env === null || Array.isArray(env)) {
+      throw Boom.badRequest('env must be an object of strings');
+    }
+    const entries = Object.entries(env as Record<string, unknown>);
+    if (entries.length > (this.options.maxVars ?? DEFAULT_MAX_VARS)) {
+      throw Boom.badRequest(`env exceeds ${this.options.maxVars ?? DEFAULT_MAX_VARS} variables`);
+    }
+    let totalBytes = 0;
+    for (const [name, value] of entries) {
+      if (!NAME_PATTERN.test(name)) {
+        throw Boom.badRequest(`invalid env variable name: ${name}`);
+      }
+      if (typeof value !== 'string' || value.includes('\0')) {
+        throw Boom.badRequest(`env variable ${name} must be a string without NUL bytes`);
+      }
+      if (!this.allows(name)) {
+        throw Boom.badRequest(`env variable not allowed: ${name}`);
+      }
+      totalBytes += Buffer.byteLength(name, 'utf8') + Buffer.byteLength(value, 'utf8');
+    }
+    const maxBytes = this.options.maxBytes ?? DEFAULT_MAX_BYTES;
+    if (totalBytes > maxBytes) {
+      throw Boom.badRequest(`env exceeds ${maxBytes} bytes`);
+    }
+    return env as Record<string, string>;
+  }
+
+  private allows(name: string): boolean {
+    const upper = name.toUpperCase();
+    if (RESERVED_NAMES.has(upper) || this.denyPrefixes.some((prefix) => upper.startsWith(prefix))) {
+      return false;
+    }
+    if (!this.options.allow) {
+      return true;
+    }
+    return this.options.allow.some((entry) => (entry.endsWith('*') ? name.startsWith(entry.slice(0, -1)) : name === entry));
+  }
+}
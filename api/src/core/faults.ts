@@ -0,0 +1,147 @@
+import Boom from '@hapi/boom';
+import { Logger } from '../util/logger.js';
+import { infrastructureFailure } from './infrastructure.js';
+import type { FaultKind, OutputStream, SandboxResult, SandboxRunSpec, SandboxRunner } from './types.js';
+
+export const FAULT_KINDS: FaultKind[] = ['sandbox_create', 'slow_compile', 'worker_crash', 'output_stall'];
+
+export interface FaultInjectorOptions {
+  // Share of runs, from 0 to 1, that get one of `kinds` at random on top of any the request asked for.
+  rate: number;
+  kinds: FaultKind[];
+  delayMs: number;
+  next: SandboxRunner;
+  // Returns a number from 0 up to 1; Math.random unless set.
+  random?: () => number;
+}
+
+// Makes the executor misbehave on purpose so that integrators can check their retry and timeout
+// handling against the real API. Runs get the faults their request named in X-Fault-Injection
+// and, at `rate`, a random one; everything else is the backend's own run. Each fault fails or
+// delays the run the way the real failure would, so a coordinator retries a crash or a sandbox
+// that failed to start on another worker, while timeouts still count from the run's own limits.
+// Only for test deployments: it is off unless faults.enabled is set.
+export class FaultInjector implements SandboxRunner {
+  private readonly random: () => number;
+
+  constructor(private readonly options: FaultInjectorOptions, private readonly logger: Logger) {
+    this.random = options.random ?? Math.random;
+  }
+
+  public async run(spec: SandboxRunSpec): Promise<SandboxResult> {
+    const faults = new Set(spec.faults ?? []);
+    const { rate, kinds } = this.options;
+    if (kinds.length > 0 && rate > 0 && this.random() < rate) {
+      faults.add(kinds[Math.floor(this.random() * kinds.length)]);
+    }
+    if (faults.size === 0) {
+      return this.options.next.run(spec);
+    }
+    this.logger.warn('injecting faults', { runId: spec.id, faults: [...faults].join(',') });
+    if (faults.has('sandbox_create')) {
+      throw infrastructureFailure('sandbox failed to start: injected fault');
+    }
+    const delayMs = this.options.delayMs;
+    let stalled = spec;
+    let flush: () => Promise<void> = async () => undefined;
+    if (faults.has('output_stall')) {
+      ({ spec: stalled, flush } = stallOutput(spec, delayMs));
+    }
+    let compileMs = 0;
+    if (faults.has('slow_compile')) {
+      const started = Date.now();
+      await delay(delayMs, spec.signal);
+      compileMs = Date.now() - started;
+    }
+    const result = faults.has('worker_crash') ? await this.crash(stalled, delayMs) : await this.options.next.run(stalled);
+    await flush();
+    return result.compile && compileMs > 0
+      ? { ...result, compile: { ...result.compile, duration_ms: result.compile.duration_ms + compileMs } }
+      : result;
+  }
+
+  // The run is stopped as a canceled one would be, so the backend cleans up after it, and then
+  // fails; the output it wrote until then has already been streamed.
+  private async crash(spec: SandboxRunSpec, delayMs: number): Promise<SandboxResult> {
+    const controller = new AbortController();
+    const cancel = () => controller.abort();
+    spec.signal?.addEventListener('abort', cancel, { once: true });
+    const timer = setTimeout(cancel, delayMs);
+    try {
+      const result = await this.options.next.run({ ...spec, signal: controller.signal });
+      if (spec.signal?.aborted) {
+        return result;
+      }
+    } finally {
+      clearTimeout(timer);
+      spec.signal?.removeEventListener('abort', cancel);
+    }
+    throw infrastructureFailure('worker crashed mid-run: injected fault');
+  }
+}
+
+// Parses the X-Fault-Injection header (or gRPC metadata entry): fault kinds separated by commas.
+// Requests may only carry it to a server with fault injection enabled.
+export function parseFaultHeader(header: unknown, enabled: boolean): FaultKind[] | undefined {
+  const value = Array.isArray(header) ? header.join(',') : header;
+  if (value === undefined || value === null || value === '') {
+    return undefined;
+  }
+  if (!enabled) {
+    throw Boom.badRequest('fault injection is not enabled on this server');
+  }
+  const kinds = String(value).split(',').map((kind) => kind.trim()).filter(Boolean);
+  const unknown = kinds.find((kind) => !FAULT_KINDS.includes(kind as FaultKind));
+  if (unknown !== undefined) {
+    throw Boom.badRequest(`unknown fault: ${unknown}; expected one of ${FAULT_KINDS.join(', ')}`);
+  }
+  return [...new Set(kinds)] as FaultKind[];
+}
+
+// Forwards the first chunk of output and holds back what follows until `delayMs` after it; flush
+// waits out the stall and hands over what was held.
+function stallOutput(spec: SandboxRunSpec, delayMs: number) {
+  const held: Array<[OutputStream, Buffer]> = [];
+  let stall: Promise<void> | null = null;
+  let released = false;
+  const release = () => {
+    released = true;
+    for (const [stream, chunk] of held.splice(0)) {
+      spec.onOutput?.(stream, chunk);
+    }
+  };
+  const onOutput = (stream: OutputStream, chunk: Buffer) => {
+    if (released) {
+      spec.onOutput?.(stream, chunk);
+    } else if (stall) {
+      held.push([stream, chunk]);
+    } else {
+      spec.onOutput?.(stream, chunk);
+      stall = delay(delayMs, spec.signal).then(release);
+    }
+  };
+  return {
+    spec: { ...spec, onOutput },
+    flush: async () => {
+      await stall;
+      release();
+    }
+  };
+}
+
+// Resolves after `ms`, or as soon as the run is canceled.
+function delay(ms: number, signal?: AbortSignal) {
+  return new Promise<void>((resolve) => {
+    if (signal?.aborted) {
+      resolve();
+      return;
+    }
+    const done = () => {
+      clearTimeout(timer);
+      signal?.removeEventListener('abort', done);
+      resolve();
+    };
+    const timer = setTimeout(done, ms);
+    signal?.addEventListener('abort', done, { once: true });
+  });
+}
@@ -0,0 +1,76 @@
+import type { RunRequest } from './types.js';
+
+// Tokens a hashed k-gram spans; shared runs shorter than this are too common to count as copying.
+const KGRAM_TOKENS = 5;
+// K-grams each winnowing window picks its smallest hash from. Any run of KGRAM_TOKENS +
+// WINDOW - 1 tokens two submissions share gives them at least one hash in common.
+const WINDOW = 4;
+// Most hashes kept per submission; the smallest are kept, so every submission's cut is the same.
+export const MAX_FINGERPRINT_HASHES = 2000;
+
+// Languages whose comments start with `#` or `--` instead of `//` and `/* */`.
+const HASH_COMMENTS = new Set(['python', 'ruby', 'bash', 'sh', 'r', 'perl', 'elixir']);
+const DASH_COMMENTS = new Set(['sql', 'lua', 'haskell']);
+
+// Kept as they are, since they carry the program's structure; every other name becomes `V`.
+const KEYWORDS = new Set([
+  'and', 'async', 'await', 'break', 'case', 'catch', 'class', 'const', 'continue', 'def', 'default', 'defer', 'do', 'elif',
+  'else', 'end', 'enum', 'except', 'extends', 'finally', 'fn', 'for', 'func', 'function', 'go', 'if', 'impl', 'import',
+  'in', 'interface', 'lambda', 'let', 'loop', 'match', 'mut', 'new', 'not', 'or', 'package', 'pub', 'raise', 'return',
+  'select', 'static', 'struct', 'switch', 'throw', 'trait', 'try', 'type', 'var', 'while', 'with', 'yield', 'from', 'where'
+]);
+
+const STRING = String.raw`"""[\s\S]*?"""|'''[\s\S]*?'''|"(?:\\.|[^"\\\n])*"|'(?:\\.|[^'\\\n])*'|` + '`(?:\\\\.|[^`\\\\])*`';
+const TOKEN = String.raw`(?<string>${STRING})|(?<number>\d[\w.]*)|(?<name>[A-Za-z_$][\w$]*)|(?<punct>\S)`;
+
+// A winnowed fingerprint of the submission's own sources: `code` and `sources`, without the
+// template they are injected into, which every submission of an assignment shares. Comments,
+// whitespace, names and literals are normalized away first, so renaming variables or rewording
+// comments leaves the fingerprint as it was. The hashes are distinct and sorted; a submission of
+// fewer than KGRAM_TOKENS tokens has none.
+export function fingerprint(request: Pick<RunRequest, 'language' | 'code' | 'sources'>): number[] {
+  const files = [request.code ?? '', ...Object.keys(request.sources ?? {}).sort().map((name) => request.sources![name])];
+  const tokens = files.flatMap((file) => tokenize(file, request.language));
+  const grams: number[] = [];
+  for (let start = 0; start + KGRAM_TOKENS <= tokens.length; start++) {
+    grams.push(fnv1a(tokens.slice(start, start + KGRAM_TOKENS).join('\u0000')));
+  }
+  const chosen = new Set<number>();
+  for (let start = 0; start === 0 || start + WINDOW <= grams.length; start++) {
+    const window = grams.slice(start, start + WINDOW);
+    if (window.length > 0) {
+      chosen.add(Math.min(...window));
+    }
+  }
+  return [...chosen].sort((a, b) => a - b).slice(0, MAX_FINGERPRINT_HASHES);
+}
+
+// Shared hashes over the hashes of either, from 0 to 1; the Jaccard index of the two fingerprints.
+export function similarity(shared: number, size: number, otherSize: number): number {
+  const union = size + otherSize - shared;
+  return union === 0 ? 0 : shared / union;
+}
+
+function tokenize(source: string, language: string): string[] {
+  const comment = HASH_COMMENTS.has(language) ? String.raw`#[^\n]*` : DASH_COMMENTS.has(language) ? String.raw`--[^\n]*` : String.raw`\/\/[^\n]*|\/\*[\s\S]*?\*\/`;
+  const pattern = new RegExp(`(?<comment>${comment})|${TOKEN}`, 'g');
+  const tokens: string[] = [];
+  for (const match of source.matchAll(pattern)) {
+    const { comment: skipped, string, number, name } = match.groups!;
+    if (skipped !== undefined) {
+      continue;
+    }
+    tokens.push(string !== undefined ? 'S' : number !== undefined ? 'N' : name !== undefined ? (KEYWORDS.has(name) ? name : 'V') : match[0]);
+  }
+  return tokens;
+}
+
+// 32-bit FNV-1a, as an unsigned integer.
+function fnv1a(text: string): number {
+  let hash = 0x811c9dc5;
+  for (let i = 0; i < text.length; i++) {
+    hash ^= text.charCodeAt(i);
+    hash = Math.imul(hash, 0x01000193);
+  }
+  return hash >>> 0;
+}
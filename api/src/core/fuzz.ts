@@ -0,0 +1,362 @@
+import crypto from 'node:crypto';
+import Boom from '@hapi/boom';
+import { Logger } from '../util/logger.js';
+import type { Orchestrator } from './orchestrator.js';
+import type { SpanContext } from '../tracing/tracer.js';
+import { RunnerRegistry, runnerRegistry } from './runners.js';
+import { detectLanguage } from './detect.js';
+import { runFailure, type Verdict } from './judge.js';
+import type { PhaseResult, RunRecord, RunRequest, RunStatus } from './types.js';
+
+// One submission run over and over with generated stdin; the fields are those of a run request.
+export interface FuzzRequest extends Omit<RunRequest, 'stdin' | 'mode' | 'deterministic'> {
+  // Inputs the mutations start from, each also run as it is; one empty input unless set.
+  corpus?: string[];
+  // Wall time the fuzzing may take; runs started before it is up still finish. 60 s unless set.
+  budget_ms?: number;
+  // Most runs, the seeds included; the server's maximum unless set.
+  max_runs?: number;
+  // Seeds the choice of mutations, so that a fuzz over the same corpus can be repeated; random
+  // unless set.
+  seed?: number;
+  // Longest mutated input in characters, 4096 unless set; seeds may be longer.
+  max_input_length?: number;
+}
+
+// Inputs that failed the same way: with the same verdict, exit code and signal, and the same last
+// line of stderr once the numbers and quoted values in it are disregarded.
+export interface FuzzFinding {
+  // RE for a crash or a non-zero exit, TLE or MLE when a limit stopped the run.
+  verdict: Verdict;
+  status: RunStatus;
+  exit_code: number | null;
+  signal: string | null;
+  // The first input found that fails this way, and its run.
+  input: string;
+  run_id: string;
+  // Whether that input is one of the seeds rather than a mutation.
+  seed: boolean;
+  // Last non-empty line of the run's stderr, e.g. the exception.
+  stderr_tail: string;
+  // Inputs found that fail this way.
+  count: number;
+}
+
+export interface FuzzResult {
+  // `budget` or `max_runs` for whichever ran out first, `exhausted` when the mutations stopped
+  // producing inputs not already run, `compile_error` when the submission doesn't build.
+  stopped: 'budget' | 'max_runs' | 'exhausted' | 'compile_error';
+  runs: number;
+  elapsed_ms: number;
+  // The seed the mutations were chosen with, to repeat the fuzz.
+  seed: number;
+  // Compile phase of the first run, null for interpreted languages.
+  compile: PhaseResult | null;
+  // The seeds plus every mutation that made the program print something no earlier input did.
+  corpus_size: number;
+  // In the order they were found.
+  findings: FuzzFinding[];
+}
+
+export interface FuzzerOptions {
+  orchestrator: Orchestrator;
+  logger: Logger;
+  registry?: RunnerRegistry;
+  // Most runs and longest budget one request may ask for.
+  maxRuns: number;
+  maxBudgetMs: number;
+  // Runs of one request at the same time.
+  concurrency?: number;
+  // Receives every run record as it finishes.
+  onRun?: (run: RunRecord) => void;
+}
+
+const DEFAULT_BUDGET_MS = 60000;
+const DEFAULT_MAX_INPUT_LENGTH = 4096;
+// Beyond these the corpus stops growing and new kinds of failure are only logged.
+const MAX_CORPUS = 256;
+const MAX_FINDINGS = 50;
+// Attempts at a mutation that hasn't been run before.
+const MAX_ATTEMPTS = 16;
+// Values that commonly break parsing and arithmetic: bounds of the usual integer types, signs,
+// floats that don't parse as integers, empty and whitespace-only tokens.
+const INTERESTING = [
+  '0', '-1', '1', '-0', '2147483647', '-2147483648', '4294967296', '9223372036854775807', '-9223372036854775808',
+  '18446744073709551616', '99999999999999999999', '1e308', '0.5', 'NaN', '', ' ', '\n', '\t', '\0', 'a', '%s%n'
+];
+const SPECIAL_CHARACTERS = ['\0', '\n', '\r', ' ', '-', '.', 'é', '\u{1F600}', '\uFFFD', '\\', '"', "'"];
+
+// Runs a submission over and over on stdin mutated from a caller's corpus, within a time budget,
+// and reports the inputs that crash it, exit non-zero or run into a limit, for grading how
+// robust a solution is or finding inputs a judge's test cases miss. Nothing about the program is
+// instrumented, so it works for every language: the corpus grows by the mutations that change
+// what the program prints, which stands in for coverage. Runs go `concurrency` at a time after
+// the first, which builds compiled languages for the others through the build cache; none is
+// answered from the result cache.
+export class Fuzzer {
+  private readonly registry: RunnerRegistry;
+  private readonly concurrency: number;
+
+  constructor(private readonly options: FuzzerOptions) {
+    this.registry = options.registry ?? runnerRegistry;
+    this.concurrency = Math.max(1, options.concurrency ?? 4);
+  }
+
+  // Every run joins the caller's trace when `traceParent` is given.
+  public async fuzz(original: FuzzRequest, apiKey: string, traceParent?: SpanContext | null): Promise<FuzzResult> {
+    this.validate(original);
+    // Detected once up front so that every run is of the same language.
+    const request = original.language ? original : { ...original, language: detectLanguage(original, this.registry).language };
+    const {
+      corpus: seeds = [''],
+      budget_ms: budgetMs = Math.min(DEFAULT_BUDGET_MS, this.options.maxBudgetMs),
+      max_runs: maxRuns = this.options.maxRuns,
+      seed = crypto.randomInt(2 ** 31),
+      max_input_length: maxInputLength = DEFAULT_MAX_INPUT_LENGTH,
+      ...submission
+    } = request;
+    this.registry.require(request.language);
+    this.options.orchestrator.checkRequest(submission);
+
+    const started = Date.now();
+    const random = mulberry32(seed);
+    const corpus = [...new Set(seeds)];
+    const pending = [...corpus];
+    const tried = new Set<string>();
+    const outputs = new Set<string>();
+    const findings = new Map<string, FuzzFinding>();
+    const longest = Math.max(maxInputLength, ...corpus.map((input) => input.length));
+    let compile: PhaseResult | null = null;
+    let runs = 0;
+
+    const next = (): string | null => {
+      const seedInput = pending.shift();
+      if (seedInput !== undefined) {
+        return seedInput;
+      }
+      for (let attempt = 0; attempt < MAX_ATTEMPTS; attempt++) {
+        const input = mutate(corpus, random).slice(0, longest);
+        if (!tried.has(input)) {
+          return input;
+        }
+      }
+      return null;
+    };
+    const record = (input: string, run: RunRecord) => {
+      // Canceled runs say nothing about the program.
+      if (run.status === 'canceled') {
+        return;
+      }
+      const verdict = runFailure(run);
+      if (!verdict) {
+        const output = crypto.createHash('sha256').update(run.stdout).digest('hex');
+        if (!outputs.has(output)) {
+          outputs.add(output);
+          if (corpus.length < MAX_CORPUS && !corpus.includes(input)) {
+            corpus.push(input);
+          }
+        }
+        return;
+      }
+      const stderrTail = lastLine(run.stderr);
+      const signature = [verdict, run.exit_code, run.signal, normalize(stderrTail)].join('\u0000');
+      const known = findings.get(signature);
+      if (known) {
+        known.count++;
+      } else if (findings.size < MAX_FINDINGS) {
+        findings.set(signature, {
+          verdict,
+          status: run.status,
+          exit_code: run.exit_code,
+          signal: run.signal,
+          input,
+          run_id: run.id,
+          seed: seeds.includes(input),
+          stderr_tail: stderrTail,
+          count: 1
+        });
+      } else {
+        this.options.logger.info('fuzz finding dropped', { runId: run.id, verdict, apiKey });
+      }
+    };
+
+    let stopped: FuzzResult['stopped'] = 'max_runs';
+    while (runs < maxRuns) {
+      if (Date.now() - started >= budgetMs) {
+        stopped = 'budget';
+        break;
+      }
+      // The first run goes alone so that a compiled language builds once.
+      const size = runs === 0 ? 1 : Math.min(this.concurrency, maxRuns - runs);
+      const batch: string[] = [];
+      while (batch.length < size) {
+        const input = next();
+        if (input === null) {
+          break;
+        }
+        tried.add(input);
+        batch.push(input);
+      }
+      if (batch.length === 0) {
+        stopped = 'exhausted';
+        break;
+      }
+      // Never answered from the result cache, which would hide crashes that don't reproduce.
+      const results = await Promise.all(batch.map((input) =>
+        this.options.orchestrator.createRun({ ...submission, stdin: input, mode: 'run', deterministic: false }, apiKey, { traceParent })));
+      runs += results.length;
+      // Taken in the order the inputs were generated so that a seed repeats the fuzz.
+      for (const [index, run] of results.entries()) {
+        this.options.onRun?.(run);
+        record(batch[index], run);
+      }
+      if (runs === 1) {
+        compile = results[0].phases.compile;
+        if (runFailure(results[0]) === 'CE') {
+          // Every other input would fail the same way.
+          stopped = 'compile_error';
+          findings.clear();
+          this.options.logger.info('fuzzed submission failed to compile', { runId: results[0].id, apiKey });
+          break;
+        }
+      }
+    }
+    return {
+      stopped,
+      runs,
+      elapsed_ms: Date.now() - started,
+      seed,
+      compile,
+      corpus_size: corpus.length,
+      findings: [...findings.values()]
+    };
+  }
+
+  private validate(request: FuzzRequest) {
+    if ('stdin' in request) {
+      throw Boom.badRequest('stdin cannot be set; the fuzzer generates it from corpus');
+    }
+    const { corpus, budget_ms: budgetMs, max_runs: maxRuns, seed, max_input_length: maxInputLength } = request;
+    if (corpus !== undefined && (!Array.isArray(corpus) || corpus.length === 0 || !corpus.every((input) => typeof input === 'string'))) {
+      throw Boom.badRequest('corpus must be a non-empty array of strings');
+    }
+    if (budgetMs !== undefined && (!Number.isInteger(budgetMs) || budgetMs < 1 || budgetMs > this.options.maxBudgetMs)) {
+      throw Boom.badRequest(`budget_ms must be an integer from 1 to ${this.options.maxBudgetMs}`);
+    }
+    if (maxRuns !== undefined && (!Number.isInteger(maxRuns) || maxRuns < 1 || maxRuns > this.options.maxRuns)) {
+      throw Boom.badRequest(`max_runs must be an integer from 1 to ${this.options.maxRuns}`);
+    }
+    if (seed !== undefined && !Number.isSafeInteger(seed)) {
+      throw Boom.badRequest('seed must be an integer');
+    }
+    if (maxInputLength !== undefined && (!Number.isInteger(maxInputLength) || maxInputLength < 1)) {
+      throw Boom.badRequest('max_input_length must be a positive integer');
+    }
+  }
+}
+
+type Random = () => number;
+
+// One to three mutations stacked on an input picked from the corpus.
+function mutate(corpus: string[], random: Random): string {
+  let input = pick(corpus, random);
+  const count = 1 + Math.floor(random() * 3);
+  for (let index = 0; index < count; index++) {
+    input = pick(MUTATIONS, random)(input, random, corpus);
+  }
+  return input;
+}
+
+type Mutation = (input: string, random: Random, corpus: string[]) => string;
+
+const MUTATIONS: Mutation[] = [
+  // A number replaced by an interesting value or a neighbour; the most likely way into an edge case
+  // of a judge's input.
+  (input, random) => {
+    const numbers = [...input.matchAll(/-?\d+/g)];
+    if (numbers.length === 0) {
+      return insert(input, pick(INTERESTING, random), random);
+    }
+    const match = pick(numbers, random);
+    const value = BigInt(match[0]);
+    const replacement = random() < 0.5
+      ? pick(INTERESTING, random)
+      : pick([value + 1n, value - 1n, -value, value * 2n, 0n], random).toString();
+    return input.slice(0, match.index) + replacement + input.slice(match.index! + match[0].length);
+  },
+  (input, random) => insert(input, pick(INTERESTING, random), random),
+  // A character replaced.
+  (input, random) => {
+    if (input.length === 0) {
+      return pick(SPECIAL_CHARACTERS, random);
+    }
+    const at = Math.floor(random() * input.length);
+    const character = random() < 0.5 ? String.fromCharCode(Math.floor(random() * 128)) : pick(SPECIAL_CHARACTERS, random);
+    return input.slice(0, at) + character + input.slice(at + 1);
+  },
+  // A slice deleted.
+  (input, random) => {
+    const [start, end] = slice(input, random);
+    return input.slice(0, start) + input.slice(end);
+  },
+  // A slice repeated, for inputs larger than the program expects.
+  (input, random) => {
+    const [start, end] = slice(input, random);
+    return input.slice(0, end) + input.slice(start, end).repeat(1 + Math.floor(random() * 16)) + input.slice(end);
+  },
+  // Cut short, as by a missing last line.
+  (input, random) => input.slice(0, Math.floor(random() * input.length)),
+  // A line dropped or doubled.
+  (input, random) => {
+    const lines = input.split('\n');
+    const at = Math.floor(random() * lines.length);
+    if (random() < 0.5) {
+      lines.splice(at, 1);
+    } else {
+      lines.splice(at, 0, lines[at]);
+    }
+    return lines.join('\n');
+  },
+  // The start of this input followed by the end of another.
+  (input, random, corpus) => {
+    const other = pick(corpus, random);
+    return input.slice(0, Math.floor(random() * (input.length + 1))) + other.slice(Math.floor(random() * (other.length + 1)));
+  }
+];
+
+function insert(input: string, value: string, random: Random): string {
+  const at = Math.floor(random() * (input.length + 1));
+  return input.slice(0, at) + value + input.slice(at);
+}
+
+function slice(input: string, random: Random): [number, number] {
+  const start = Math.floor(random() * input.length);
+  return [start, start + 1 + Math.floor(random() * Math.min(32, input.length - start))];
+}
+
+function pick<T>(values: T[], random: Random): T {
+  return values[Math.floor(random() * values.length)];
+}
+
+function lastLine(stderr: string): string {
+  return stderr.trimEnd().split('\n').pop()?.trim() ?? '';
+}
+
+// Crashes that differ only in the value that caused them, such as
+// `ValueError: invalid literal for int() with base 10: 'x'`, are one kind of failure. Quoted
+// values run to the line's last quote, since the value may hold quotes of its own.
+function normalize(line: string): string {
+  return line.replace(/(['"]).*\1/, '""').replace(/0x[0-9a-f]+|\d+/gi, '0');
+}
+
+// A small seeded PRNG; Math.random can't be seeded.
+function mulberry32(seed: number): Random {
+  let state = seed >>> 0;
+  return () => {
+    state = (state + 0x6d2b79f5) >>> 0;
+    let value = state;
+    value = Math.imul(value ^ (value >>> 15), value | 1);
+    value ^= value + Math.imul(value ^ (value >>> 7), value | 61);
+    return ((value ^ (value >>> 14)) >>> 0) / 4294967296;
+  };
+}
@@ -0,0 +1,161 @@
+import Boom from '@hapi/boom';
+import type { GpuRequest, RunRequest } from './types.js';
+
+const MAX_GPUS_PER_RUN = 8;
+
+// A GPU of this host as the container runtime names it, e.g. `0` or a `GPU-<uuid>`.
+export interface GpuDevice {
+  id: string;
+  vram_mb: number;
+}
+
+export interface GpuDeviceStats extends GpuDevice {
+  free_vram_mb: number;
+  runs: number;
+}
+
+// Devices held by one run until it releases them. `vram_mb` is what the run may use of each, the
+// whole device when the request didn't say.
+export interface GpuLease {
+  devices: string[];
+  vram_mb: number | null;
+  release(): void;
+}
+
+interface DeviceState extends GpuDevice {
+  allocated: number;
+  runs: number;
+}
+
+interface Waiter {
+  request: GpuRequest;
+  resolve: (lease: GpuLease | null) => void;
+}
+
+// Hands out the GPUs of one host. A run asking for `vram_mb` shares a device with other such runs
+// for as long as their reservations fit in its memory; one that doesn't ask gets whole devices.
+// Devices are picked best fit, the fullest one with room first, so large requests still find
+// empty devices. Runs waiting for GPUs are served oldest first.
+export class GpuPool {
+  private readonly devices: DeviceState[];
+  private waiting: Waiter[] = [];
+
+  constructor(devices: GpuDevice[]) {
+    this.devices = devices.map((device) => ({ ...device, allocated: 0, runs: 0 }));
+  }
+
+  public get size() {
+    return this.devices.length;
+  }
+
+  // Whether the request could be served once every device is free.
+  public fits(request: GpuRequest) {
+    const needed = request.vram_mb ?? 0;
+    return this.devices.filter((device) => device.vram_mb >= needed).length >= request.count;
+  }
+
+  // The devices of `ids` when given, or the best free ones; null when they are not free now.
+  public tryAcquire(request: GpuRequest, ids?: string[]): GpuLease | null {
+    const candidates = ids ? this.devices.filter((device) => ids.includes(device.id)) : this.devices;
+    const chosen = candidates
+      .filter((device) => this.hasRoom(device, request))
+      .sort((a, b) => free(a) - free(b))
+      .slice(0, request.count);
+    if (chosen.length < request.count || (ids && chosen.length < ids.length)) {
+      return null;
+    }
+    for (const device of chosen) {
+      device.allocated += request.vram_mb ?? device.vram_mb;
+      device.runs++;
+    }
+    let released = false;
+    return {
+      devices: chosen.map((device) => device.id),
+      vram_mb: request.vram_mb ?? null,
+      release: () => {
+        if (released) {
+          return;
+        }
+        released = true;
+        for (const device of chosen) {
+          device.allocated -= request.vram_mb ?? device.vram_mb;
+          device.runs--;
+        }
+        this.serveWaiting();
+      }
+    };
+  }
+
+  // Waits for the devices; null when the signal aborts first.
+  public acquire(request: GpuRequest, signal?: AbortSignal): Promise<GpuLease | null> {
+    const lease = this.waiting.length === 0 ? this.tryAcquire(request) : null;
+    if (lease || signal?.aborted) {
+      return Promise.resolve(lease);
+    }
+    return new Promise((resolve) => {
+      const waiter: Waiter = { request, resolve };
+      this.waiting.push(waiter);
+      signal?.addEventListener(
+        'abort',
+        () => {
+          if (this.waiting.includes(waiter)) {
+            this.waiting = this.waiting.filter((other) => other !== waiter);
+            resolve(null);
+          }
+        },
+        { once: true }
+      );
+    });
+  }
+
+  public stats(): GpuDeviceStats[] {
+    return this.devices.map((device) => ({ id: device.id, vram_mb: device.vram_mb, free_vram_mb: free(device), runs: device.runs }));
+  }
+
+  private hasRoom(device: DeviceState, request: GpuRequest) {
+    return request.vram_mb === undefined ? device.allocated === 0 : free(device) >= request.vram_mb;
+  }
+
+  // The head of the queue goes first, so a run wanting a whole device is not starved by a stream
+  // of smaller reservations slipping past it.
+  private serveWaiting() {
+    while (this.waiting.length > 0) {
+      const lease = this.tryAcquire(this.waiting[0].request);
+      if (!lease) {
+        return;
+      }
+      (this.waiting.shift() as Waiter).resolve(lease);
+    }
+  }
+}
+
+function free(device: DeviceState) {
+  return device.vram_mb - device.allocated;
+}
+
+export function validateGpu(gpu: RunRequest['gpu']) {
+  if (gpu === undefined) {
+    return;
+  }
+  if (typeof gpu !== 'object' || gpu === null || Array.isArray(gpu)) {
+    throw Boom.badRequest('gpu must be an object');
+  }
+  if (gpu.count !== undefined && (!Number.isInteger(gpu.count) || gpu.count < 1 || gpu.count > MAX_GPUS_PER_RUN)) {
+    throw Boom.badRequest(`gpu.count must be an integer from 1 to ${MAX_GPUS_PER_RUN}`);
+  }
+  if (gpu.vram_mb !== undefined && (!Number.isInteger(gpu.vram_mb) || gpu.vram_mb < 1)) {
+    throw Boom.badRequest('gpu.vram_mb must be a positive integer');
+  }
+}
+
+// `id:vram_mb` per device, e.g. `0:24576,1:24576`.
+export function parseGpuDevices(value: string): GpuDevice[] {
+  return value.split(',').filter(Boolean).map((entry) => {
+    const [id, vram] = entry.split(':');
+    const vramMb = Number(vram);
+    if (!id || !Number.isInteger(vramMb) || vramMb <= 0) {
+      throw new Error(`expected id:vram_mb, got ${entry}`);
+    }
+    return { id, vram_mb: vramMb };
+  });
+}
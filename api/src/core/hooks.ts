@@ -0,0 +1,181 @@
+import childProcess from 'node:child_process';
+import Boom from '@hapi/boom';
+import { Logger } from '../util/logger.js';
+import type { Language, RunRecord, RunRequest } from './types.js';
+
+export type HookEvent = 'before_compile' | 'before_run' | 'after_completion';
+
+export const HOOK_EVENTS: HookEvent[] = ['before_compile', 'before_run', 'after_completion'];
+
+// What a hook is told about the run it is called for.
+export interface HookContext {
+  run_id: string;
+  language: Language;
+  // The key's tenant or label, never the key itself.
+  tenant: string | null;
+  request: RunRequest;
+}
+
+// Code a deployment runs around every execution, for policies such as plagiarism fingerprinting,
+// billing or enriching results, without changing the executor. Every method is optional.
+export interface ExecutionHook {
+  name: string;
+  // Before the sandbox starts, ahead of any compilation. Throwing refuses the run: with a Boom
+  // client error as it is, with anything else as a failure of the hook.
+  beforeCompile?(context: HookContext): Promise<void> | void;
+  // Once the program starts, after any compilation. The run does not wait for it, so it can only
+  // observe.
+  beforeRun?(context: HookContext): Promise<void> | void;
+  // Once the record is complete. Whatever it returns other than undefined is kept in the record's
+  // annotations under the hook's name.
+  afterCompletion?(context: HookContext, run: RunRecord): Promise<unknown> | unknown;
+}
+
+export interface HookRunnerOptions {
+  // How long each call may take before it counts as failed.
+  timeoutMs?: number;
+  // Start runs whose before_compile hook failed or timed out instead of refusing them; a hook
+  // that refuses a run still does.
+  failOpen?: boolean;
+}
+
+// Calls the deployment's hooks in the order they were registered. A hook that fails after the
+// run costs it its annotation, never its result.
+export class HookRunner {
+  constructor(
+    private readonly hooks: ExecutionHook[],
+    private readonly options: HookRunnerOptions,
+    private readonly logger: Logger
+  ) {}
+
+  public get size() {
+    return this.hooks.length;
+  }
+
+  public async beforeCompile(context: HookContext) {
+    for (const hook of this.hooks) {
+      if (!hook.beforeCompile) {
+        continue;
+      }
+      try {
+        await this.call(hook, () => hook.beforeCompile?.(context));
+      } catch (err) {
+        if (Boom.isBoom(err) && err.output.statusCode < 500) {
+          this.logger.info('run refused by hook', { hook: hook.name, reason: err.message });
+          throw err;
+        }
+        this.logger.error('hook failed', { hook: hook.name, event: 'before_compile', message: (err as Error).message });
+        if (!this.options.failOpen) {
+          throw Boom.serverUnavailable(`hook ${hook.name} failed`, { code: 'hook_failed', hook: hook.name });
+        }
+      }
+    }
+  }
+
+  public beforeRun(context: HookContext) {
+    for (const hook of this.hooks) {
+      if (hook.beforeRun) {
+        this.call(hook, () => hook.beforeRun?.(context)).catch((err: Error) => {
+          this.logger.error('hook failed', { hook: hook.name, event: 'before_run', message: err.message });
+        });
+      }
+    }
+  }
+
+  public async afterCompletion(context: HookContext, run: RunRecord): Promise<Record<string, unknown>> {
+    const annotations: Record<string, unknown> = {};
+    for (const hook of this.hooks) {
+      if (!hook.afterCompletion) {
+        continue;
+      }
+      try {
+        const annotation = await this.call(hook, () => hook.afterCompletion?.(context, run));
+        if (annotation !== undefined) {
+          annotations[hook.name] = annotation;
+        }
+      } catch (err) {
+        this.logger.error('hook failed', { hook: hook.name, event: 'after_completion', message: (err as Error).message });
+      }
+    }
+    return annotations;
+  }
+
+  private call<T>(hook: ExecutionHook, fn: () => T | Promise<T>): Promise<T> {
+    const timeoutMs = this.options.timeoutMs ?? 10_000;
+    let timer: NodeJS.Timeout | undefined;
+    const timeout = new Promise<never>((_, reject) => {
+      timer = setTimeout(() => reject(new Error(`hook ${hook.name} timed out after ${timeoutMs} ms`)), timeoutMs);
+    });
+    return Promise.race([Promise.resolve().then(fn), timeout]).finally(() => clearTimeout(timer));
+  }
+}
+
+export interface CommandHookOptions {
+  name: string;
+  // Program and arguments; run directly, without a shell.
+  command: string[];
+  // Events the program is called for; all of them when unset.
+  events?: HookEvent[];
+  // After which the program is killed.
+  timeoutMs?: number;
+}
+
+// A hook in another process, for deployments that write theirs in another language. The program
+// is started once per event with `{event, run_id, language, tenant, request, result}` as JSON on
+// stdin, `result` only after completion. It may print a JSON object: `{"reject": "reason"}` before
+// compiling refuses the run with that reason, and `{"annotation": …}` after completion becomes
+// the hook's annotation. A non-zero exit is a failure of the hook.
+export class CommandHook implements ExecutionHook {
+  public readonly name: string;
+  public readonly beforeCompile?: ExecutionHook['beforeCompile'];
+  public readonly beforeRun?: ExecutionHook['beforeRun'];
+  public readonly afterCompletion?: ExecutionHook['afterCompletion'];
+
+  constructor(private readonly options: CommandHookOptions) {
+    this.name = options.name;
+    const events = options.events ?? HOOK_EVENTS;
+    if (events.includes('before_compile')) {
+      this.beforeCompile = async (context) => {
+        const reply = await this.invoke('before_compile', context);
+        if (typeof reply?.reject === 'string') {
+          throw Boom.forbidden(reply.reject, { code: 'rejected_by_hook', hook: this.name });
+        }
+      };
+    }
+    if (events.includes('before_run')) {
+      this.beforeRun = async (context) => {
+        await this.invoke('before_run', context);
+      };
+    }
+    if (events.includes('after_completion')) {
+      this.afterCompletion = async (context, run) => (await this.invoke('after_completion', context, run))?.annotation;
+    }
+  }
+
+  private invoke(event: HookEvent, context: HookContext, result?: RunRecord): Promise<Record<string, unknown> | null> {
+    const [program, ...args] = this.options.command;
+    return new Promise((resolve, reject) => {
+      const options = { maxBuffer: 1024 * 1024, timeout: this.options.timeoutMs, killSignal: 'SIGKILL' as const };
+      const child = childProcess.execFile(program, args, options, (err, stdout) => {
+        if (err) {
+          reject(new Error(`${this.name} exited with ${err.code ?? err.signal ?? err.message}`));
+          return;
+        }
+        const output = stdout.toString().trim();
+        if (!output) {
+          resolve(null);
+          return;
+        }
+        try {
+          const reply = JSON.parse(output) as unknown;
+          resolve(typeof reply === 'object' && reply !== null && !Array.isArray(reply) ? (reply as Record<string, unknown>) : null);
+        } catch {
+          reject(new Error(`${this.name} printed something other than JSON`));
+        }
+      });
+      // A program that doesn't read its input closes the pipe; that is up to it.
+      child.stdin?.on('error', () => undefined);
+      child.stdin?.end(JSON.stringify({ event, ...context, ...(result ? { result } : {}) }));
+    });
+  }
+}
@@ -0,0 +1,90 @@
+import childProcess from 'node:child_process';
+import fs from 'node:fs';
+import path from 'node:path';
+import type { NetworkPolicy, RunLimits } from './types.js';
+import { seccompArch } from './seccomp.js';
+
+// How the process backend confines entrypoints on each host: the seccomp deny-list on Linux, a
+// sandbox-exec profile on macOS, and a job object with a restricted, low-integrity token on
+// Windows (runners/job_exec.py).
+export type ConfinementMechanism = 'seccomp' | 'sandbox-exec' | 'job-object';
+
+export interface HostConfinement {
+  platform: NodeJS.Platform;
+  // Null when the host offers none the backend knows how to use.
+  mechanism: ConfinementMechanism | null;
+  // What the mechanism leaves unenforced, or what the host lacks when there is none.
+  missing: string[];
+}
+
+export interface DetectConfinementOptions {
+  runnersDir: string;
+  platform?: NodeJS.Platform;
+  // Whether an executable or file exists; stubbed in tests.
+  exists?: (file: string) => boolean;
+  // Whether a command starts; stubbed in tests.
+  runs?: (command: string) => boolean;
+}
+
+export const SANDBOX_EXEC = '/usr/bin/sandbox-exec';
+export const JOB_LAUNCHER = 'job_exec.py';
+// Windows installs Python as python.exe; python3 is at most a Store alias.
+export const WINDOWS_PYTHON = 'python';
+
+export function detectConfinement(options: DetectConfinementOptions): HostConfinement {
+  const platform = options.platform ?? process.platform;
+  const exists = options.exists ?? fs.existsSync;
+  const runs = options.runs ?? commandRuns;
+  switch (platform) {
+    case 'linux':
+      return seccompArch()
+        ? { platform, mechanism: 'seccomp', missing: ['filesystem isolation'] }
+        : { platform, mechanism: null, missing: [`seccomp filtering on ${process.arch}`] };
+    case 'darwin':
+      // macOS ignores RLIMIT_AS, so memory_mb goes unenforced whatever the profile says.
+      return exists(SANDBOX_EXEC)
+        ? { platform, mechanism: 'sandbox-exec', missing: ['memory limits'] }
+        : { platform, mechanism: null, missing: [`${SANDBOX_EXEC}`] };
+    case 'win32':
+      return exists(path.join(options.runnersDir, JOB_LAUNCHER)) && runs(WINDOWS_PYTHON)
+        ? { platform, mechanism: 'job-object', missing: ['network isolation'] }
+        : { platform, mechanism: null, missing: [`Python to run ${JOB_LAUNCHER}`] };
+    default:
+      return { platform, mechanism: null, missing: [`a confinement mechanism for ${platform}`] };
+  }
+}
+
+// Sandbox profile for one run: writes only to the run directory, temporary directories and the
+// terminal devices, and no network beyond localhost. Reads stay allowed, since toolchains live
+// all over the host (Homebrew, rustup, SDKs under the user's home).
+export function sandboxExecProfile(runDir: string, network: NetworkPolicy): string {
+  const quoted = (value: string) => JSON.stringify(fs.realpathSync(value));
+  const rules = [
+    '(version 1)',
+    '(allow default)',
+    '(deny file-write*)',
+    `(allow file-write* (subpath ${quoted(runDir)}) (subpath "/private/tmp") (subpath "/private/var/folders")`,
+    '  (literal "/dev/null") (literal "/dev/zero") (regex #"^/dev/tty") (regex #"^/dev/fd/"))',
+    '(deny network*)',
+    // Unix sockets are how the entrypoints' own helpers and toolchain daemons talk to each other.
+    '(allow network* (remote unix-socket))'
+  ];
+  if (network.mode === 'loopback') {
+    rules.push('(allow network* (local ip "localhost:*") (remote ip "localhost:*"))');
+  }
+  return rules.join('\n');
+}
+
+// What job_exec.py enforces through the job object, in its own units.
+export function jobLimits(runDir: string, limits: RunLimits) {
+  return {
+    workdir: runDir,
+    memory_mb: limits.memory_mb,
+    max_processes: limits.max_processes,
+    cpu_ms: limits.cpu_ms
+  };
+}
+
+function commandRuns(command: string) {
+  return childProcess.spawnSync(command, ['--version'], { stdio: 'ignore', windowsHide: true }).status === 0;
+}
@@ -0,0 +1,43 @@
+import crypto from 'node:crypto';
+import Boom from '@hapi/boom';
+import type { RunRequest } from './types.js';
+
+// How long a key keeps pointing at its execution; the same key starts a new one afterwards.
+export const IDEMPOTENCY_TTL_MS = 24 * 60 * 60 * 1000;
+
+const MAX_KEY_LENGTH = 255;
+
+// Reads the key from the Idempotency-Key header or the request's `idempotency_key` field; when
+// both are given they must agree.
+export function parseIdempotencyKey(header: unknown, field: unknown): string | undefined {
+  if (header !== undefined && field !== undefined && header !== field) {
+    throw Boom.badRequest('Idempotency-Key header and idempotency_key differ');
+  }
+  const key = header ?? field;
+  if (key === undefined) {
+    return undefined;
+  }
+  if (typeof key !== 'string' || key.length === 0 || key.length > MAX_KEY_LENGTH) {
+    throw Boom.badRequest(`idempotency key must be 1 to ${MAX_KEY_LENGTH} characters`);
+  }
+  return key;
+}
+
+// Identifies a request by content regardless of key order, which JSONB columns do not keep.
+export function requestDigest(request: RunRequest): string {
+  return crypto.createHash('sha256').update(canonicalJson(request)).digest('hex');
+}
+
+// JSON with object keys sorted and no whitespace, so that equal values always encode the same way.
+export function canonicalJson(value: unknown): string {
+  if (Array.isArray(value)) {
+    return `[${value.map(canonicalJson).join(',')}]`;
+  }
+  if (typeof value === 'object' && value !== null) {
+    const entries = Object.entries(value)
+      .filter(([, entry]) => entry !== undefined)
+      .sort(([a], [b]) => (a < b ? -1 : a > b ? 1 : 0));
+    return `{${entries.map(([name, entry]) => `${JSON.stringify(name)}:${canonicalJson(entry)}`).join(',')}}`;
+  }
+  return JSON.stringify(value) ?? 'null';
+}
@@ -0,0 +1,307 @@
+import childProcess from 'node:child_process';
+import fs from 'node:fs';
+import path from 'node:path';
+import Boom from '@hapi/boom';
+import { Logger } from '../util/logger.js';
+import { infrastructureFailure } from './infrastructure.js';
+import { DEFAULT_ISOLATION_LEVELS, RunnerRegistry, runnerRegistry } from './runners.js';
+import type { Language } from './types.js';
+import { imageRepository } from './versions.js';
+
+export interface ImageManagerOptions {
+  // Docker-compatible CLI used to inspect, pull and remove images.
+  cli?: string;
+  registry?: RunnerRegistry;
+  // Images by `language` or `language@version`, replacing the runners' own defaults.
+  catalog?: Record<string, string>;
+  // Pull images that are not on the host yet, at startup and when one is added.
+  pull?: boolean;
+  // Remove images an update replaced once no entry uses them.
+  gc?: boolean;
+  // Where images added through the admin API and those waiting to be removed are kept across
+  // restarts; they last only as long as the process when unset.
+  stateFile?: string;
+}
+
+export type ImageStatus = 'pending' | 'ready' | 'failed';
+
+export interface ImageEntry {
+  language: Language;
+  // Null for the image runs use when they name no version.
+  version: string | null;
+  // Reference as configured, e.g. code-executor-runner-go:1.22.
+  image: string;
+  // What runs start from: the image's registry digest, e.g. code-executor-runner-go@sha256:…,
+  // or the configured reference for images built on the host, which have none.
+  pinned: string | null;
+  // ID of the image the entry was pinned to.
+  image_id: string | null;
+  // Where the entry comes from: the runner's own default, the deployment's configuration or the
+  // admin API.
+  source: 'runner' | 'config' | 'admin';
+  status: ImageStatus;
+  // Why the image could not be pulled or inspected, null once it is ready.
+  error: string | null;
+  updated_at: string;
+}
+
+interface PersistedState {
+  images: Array<{ language: Language; version: string | null; image: string }>;
+  retired: string[];
+}
+
+const PULL_TIMEOUT_MS = 10 * 60 * 1000;
+
+// Keeps the runner images on the host and runs on exactly the images they were checked against.
+// Every language's image, and those of the versions the catalogue lists, is pulled at startup
+// when missing and pinned by digest, so the first run of a language doesn't wait for a pull and
+// a tag moving in the registry doesn't change what later runs get until the image is updated
+// here. Images an update replaces are removed once nothing uses them.
+export class ImageManager {
+  private readonly registry: RunnerRegistry;
+  private readonly cli: string;
+  private readonly entries = new Map<string, ImageEntry>();
+  // Pinned references replaced since, waiting for removal.
+  private retired = new Set<string>();
+  private preparing: Promise<void> | null = null;
+
+  constructor(private readonly options: ImageManagerOptions, private readonly logger: Logger) {
+    this.registry = options.registry ?? runnerRegistry;
+    this.cli = options.cli ?? 'docker';
+    // Wasm-only runners never start a container.
+    for (const runner of this.registry.list()) {
+      if (!(runner.isolation ?? DEFAULT_ISOLATION_LEVELS).every((level) => level === 'wasm')) {
+        this.put(runner.language, null, runner.image, 'runner');
+      }
+    }
+    for (const [key, image] of Object.entries(options.catalog ?? {})) {
+      const [language, version = null] = key.split('@');
+      this.registry.require(language);
+      this.put(language, version, image, 'config');
+    }
+    const state = this.load();
+    for (const entry of state.images) {
+      if (this.registry.get(entry.language)) {
+        this.put(entry.language, entry.version, entry.image, 'admin');
+      }
+    }
+    this.retired = new Set(state.retired);
+  }
+
+  // Pulls and pins every entry, one image at a time, then removes the images left over from
+  // earlier updates. Entries whose image can't be had stay `failed`, and their runs use the
+  // reference as configured.
+  public prepare(): Promise<void> {
+    if (!this.preparing) {
+      this.preparing = (async () => {
+        for (const entry of [...this.entries.values()]) {
+          await this.ensure(entry).catch(() => undefined);
+        }
+        await this.collect();
+      })().finally(() => {
+        this.preparing = null;
+      });
+    }
+    return this.preparing;
+  }
+
+  public list(): ImageEntry[] {
+    return [...this.entries.values()]
+      .map((entry) => ({ ...entry }))
+      .sort((a, b) => a.language.localeCompare(b.language) || (a.version ?? '').localeCompare(b.version ?? ''));
+  }
+
+  // Versions of a language the catalogue names an image for.
+  public versions(language: Language): string[] {
+    return [...this.entries.values()]
+      .filter((entry) => entry.language === language && entry.version !== null)
+      .map((entry) => entry.version as string);
+  }
+
+  // What runs of a version start from; null when the catalogue doesn't list the version, which
+  // is then looked up by tag.
+  public lookup(language: Language, version: string): string | null {
+    const entry = this.entries.get(key(language, version));
+    return entry ? entry.pinned ?? entry.image : null;
+  }
+
+  // Adds or replaces the image of a language or one of its versions. The new image is pulled
+  // and pinned before it takes over, so runs never start from one that turned out to be missing;
+  // the one it replaces is removed once no run uses it.
+  public async set(language: Language, version: string | null, image: string): Promise<ImageEntry> {
+    this.registry.require(language);
+    if (typeof image !== 'string' || !/^[\w.\-/:@]+$/.test(image)) {
+      throw Boom.badRequest('image must be an image reference');
+    }
+    if (version !== null && (typeof version !== 'string' || !/^[\w.-]+$/.test(version))) {
+      throw Boom.badRequest('version must be a version tag');
+    }
+    const previous = this.entries.get(key(language, version));
+    const entry = this.entry(language, version, image, 'admin');
+    await this.ensure(entry, true);
+    this.entries.set(key(language, version), entry);
+    if (previous?.pinned && previous.pinned !== entry.pinned) {
+      this.retired.add(previous.pinned);
+    }
+    this.apply(entry);
+    this.save();
+    this.logger.info('runner image updated', { language, version: version ?? 'default', image, pinned: entry.pinned ?? image });
+    await this.collect();
+    return { ...entry };
+  }
+
+  // Drops a version from the catalogue; the default image of a language can only be replaced.
+  public async remove(language: Language, version: string) {
+    const entry = this.entries.get(key(language, version));
+    if (!entry) {
+      throw Boom.notFound('image not found');
+    }
+    this.entries.delete(key(language, version));
+    if (entry.pinned) {
+      this.retired.add(entry.pinned);
+    }
+    this.save();
+    await this.collect();
+  }
+
+  // Removes retired images that no entry has been pointed back at. Docker refuses to remove one
+  // a container still runs from; it is tried again in the next round.
+  public async collect(): Promise<{ removed: string[] }> {
+    const removed: string[] = [];
+    if (this.options.gc === false) {
+      return { removed };
+    }
+    const used = new Set([...this.entries.values()].flatMap((entry) => [entry.pinned, entry.image]));
+    for (const image of [...this.retired]) {
+      if (used.has(image)) {
+        this.retired.delete(image);
+        continue;
+      }
+      const result = await this.exec(['image', 'rm', image]);
+      if (result.ok || /no such image/i.test(result.stderr)) {
+        this.retired.delete(image);
+        removed.push(image);
+      } else {
+        this.logger.warn('unused runner image not removed', { image, error: result.stderr.trim() });
+      }
+    }
+    if (removed.length > 0) {
+      this.logger.info('unused runner images removed', { count: removed.length });
+      this.save();
+    }
+    return { removed };
+  }
+
+  private put(language: Language, version: string | null, image: string, source: ImageEntry['source']) {
+    this.entries.set(key(language, version), this.entry(language, version, image, source));
+    if (version === null) {
+      this.registry.configure(language, { image });
+    }
+  }
+
+  private entry(language: Language, version: string | null, image: string, source: ImageEntry['source']): ImageEntry {
+    return {
+      language,
+      version,
+      image,
+      pinned: null,
+      image_id: null,
+      source,
+      status: 'pending',
+      error: null,
+      updated_at: new Date().toISOString()
+    };
+  }
+
+  // Pulls the entry's image when the host doesn't have it and pins it to what the host has. A
+  // `refresh` pulls even then, for a tag that may have moved, and its failures throw for the
+  // caller to report; otherwise they are only recorded.
+  private async ensure(entry: ImageEntry, refresh = false) {
+    try {
+      let inspected = await this.inspect(entry.image);
+      if ((refresh || !inspected) && this.options.pull !== false) {
+        this.logger.info('pulling runner image', { language: entry.language, image: entry.image });
+        const pulled = await this.exec(['pull', entry.image], PULL_TIMEOUT_MS);
+        if (pulled.timedOut) {
+          throw infrastructureFailure(`timed out pulling ${entry.image}`);
+        }
+        // A refresh whose pull failed still has the image the host already holds.
+        inspected = pulled.ok || inspected ? await this.inspect(entry.image) : null;
+      }
+      if (!inspected) {
+        throw Boom.badRequest(`image ${entry.image} is not available`, { code: 'image_unavailable' });
+      }
+      const repository = imageRepository(entry.image);
+      entry.image_id = inspected.id;
+      entry.pinned = inspected.digests.find((digest) => digest.startsWith(`${repository}@`)) ?? entry.image;
+      entry.status = 'ready';
+      entry.error = null;
+    } catch (err) {
+      entry.status = 'failed';
+      entry.error = (err as Error).message;
+      this.logger.warn('runner image unavailable', { language: entry.language, image: entry.image, error: entry.error });
+      if (refresh) {
+        throw err;
+      }
+      return;
+    } finally {
+      entry.updated_at = new Date().toISOString();
+    }
+    if (this.entries.get(key(entry.language, entry.version)) === entry) {
+      this.apply(entry);
+    }
+  }
+
+  // Runs of the language's default image start from its pin through the registry, which every
+  // backend reads the image from.
+  private apply(entry: ImageEntry) {
+    if (entry.version === null) {
+      this.registry.configure(entry.language, { image: entry.pinned ?? entry.image });
+    }
+  }
+
+  private async inspect(image: string): Promise<{ id: string; digests: string[] } | null> {
+    const result = await this.exec(['image', 'inspect', '--format', '{{.Id}} {{join .RepoDigests " "}}', image]);
+    if (!result.ok) {
+      return null;
+    }
+    const [id, ...digests] = result.stdout.trim().split(/\s+/);
+    return { id, digests };
+  }
+
+  private load(): PersistedState {
+    if (!this.options.stateFile || !fs.existsSync(this.options.stateFile)) {
+      return { images: [], retired: [] };
+    }
+    const state = JSON.parse(fs.readFileSync(this.options.stateFile, 'utf8')) as Partial<PersistedState>;
+    return { images: state.images ?? [], retired: state.retired ?? [] };
+  }
+
+  private save() {
+    const file = this.options.stateFile;
+    if (!file) {
+      return;
+    }
+    const state: PersistedState = {
+      images: [...this.entries.values()]
+        .filter((entry) => entry.source === 'admin')
+        .map(({ language, version, image }) => ({ language, version, image })),
+      retired: [...this.retired]
+    };
+    fs.mkdirSync(path.dirname(file), { recursive: true });
+    fs.writeFileSync(`${file}.tmp`, JSON.stringify(state));
+    fs.renameSync(`${file}.tmp`, file);
+  }
+
+  private exec(args: string[], timeout = 30000): Promise<{ ok: boolean; timedOut: boolean; stdout: string; stderr: string }> {
+    return new Promise((resolve) => {
+      childProcess.execFile(this.cli, args, { timeout }, (err, stdout, stderr) =>
+        resolve({ ok: !err, timedOut: Boolean(err?.killed), stdout: stdout.toString(), stderr: stderr.toString() })
+      );
+    });
+  }
+}
+
+function key(language: Language, version: string | null) {
+  return version === null ? language : `${language}@${version}`;
+}
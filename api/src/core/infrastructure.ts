@@ -0,0 +1,15 @@
+import Boom from '@hapi/boom';
+
+// A run that could not be carried out for reasons of the machine it was given to, such as a
+// container that failed to start or an image pull that timed out, rather than anything in the
+// submission. The same run may well succeed elsewhere.
+export function infrastructureFailure(message: string) {
+  return Boom.serverUnavailable(message, { code: 'infrastructure_failure' });
+}
+
+// Whether an error that ended a run is the infrastructure's rather than the request's. Client
+// errors (4xx) mean the request itself was refused and would be refused again anywhere; anything
+// else that escapes a backend is taken for a fault of the machine.
+export function isInfrastructureFailure(err: Error) {
+  return !Boom.isBoom(err) || err.output.statusCode >= 500;
+}
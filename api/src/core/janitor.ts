@@ -0,0 +1,188 @@
+import fs from 'node:fs';
+import path from 'node:path';
+import { directorySize } from './build_cache.js';
+import { Logger } from '../util/logger.js';
+
+export interface SandboxContainer {
+  name: string;
+  // Epoch ms.
+  created_at: number;
+}
+
+// Where sandbox containers run, e.g. the Docker backend. Listing covers containers of earlier
+// processes too, which is what the janitor is after.
+export interface ContainerHost {
+  listContainers(): Promise<SandboxContainer[]>;
+  removeContainers(names: string[]): Promise<void>;
+}
+
+export interface CacheExpiry {
+  entries: number;
+  bytes: number;
+}
+
+// A cache whose entries the janitor expires once nothing has used them for cacheTtlMs.
+export interface ExpiringCache {
+  // Reported as the `cache` label, e.g. `build` or `dependencies`.
+  name: string;
+  // Removes entries last used before `before` (epoch ms).
+  expire(before: number): CacheExpiry;
+}
+
+export interface JanitorOptions {
+  // Work directories and containers older than this that no live execution owns are removed;
+  // longer than any run may take.
+  ttlMs: number;
+  // Cache entries unused for this long are removed.
+  cacheTtlMs: number;
+  // Directories holding run and warm sandbox work directories, e.g. sandbox.work_root.
+  workRoots: string[];
+  // Whether a live execution or warm sandbox owns the work directory or container of this name.
+  isLive: (name: string) => boolean;
+  // Containers are left alone when unset, e.g. on the process backend.
+  containers?: ContainerHost;
+  caches?: ExpiringCache[];
+}
+
+export interface SweepResult {
+  workdirs: number;
+  containers: number;
+  cache_entries: number;
+  // Bytes of the work directories and cache entries removed; containers are not measured.
+  reclaimed_bytes: number;
+}
+
+export interface JanitorStats {
+  sweeps: number;
+  removed: { workdirs: number; containers: number; cache_entries: number };
+  reclaimed_bytes: { workdirs: number; cache: number };
+  last_sweep_at: string | null;
+}
+
+// Work directories are named after their run (`run_<id>`) or warm container (`warm_<...>`);
+// anything else under a work root is not the janitor's to remove.
+const SANDBOX_NAME = /^(run|warm)_/;
+
+// Periodically removes what crashed or interrupted executions leave behind: work directories,
+// sandbox containers and cache entries nothing uses any more. Only leftovers older than the TTL
+// are touched, so a sandbox being set up is never mistaken for one.
+export class Janitor {
+  private timer: NodeJS.Timeout | null = null;
+  private sweeping: Promise<SweepResult> | null = null;
+  private readonly totals: JanitorStats = {
+    sweeps: 0,
+    removed: { workdirs: 0, containers: 0, cache_entries: 0 },
+    reclaimed_bytes: { workdirs: 0, cache: 0 },
+    last_sweep_at: null
+  };
+
+  constructor(private readonly options: JanitorOptions, private readonly logger: Logger) { }
+
+  // Sweeps every intervalMs, starting with one straight away for what the last process left.
+  public start(intervalMs: number) {
+    void this.sweep();
+    this.timer = setInterval(() => void this.sweep(), intervalMs);
+    this.timer.unref();
+  }
+
+  public stop() {
+    if (this.timer) {
+      clearInterval(this.timer);
+      this.timer = null;
+    }
+  }
+
+  // Overlapping calls share the sweep in progress.
+  public sweep(now = Date.now()): Promise<SweepResult> {
+    if (!this.sweeping) {
+      this.sweeping = this.collect(now).finally(() => {
+        this.sweeping = null;
+      });
+    }
+    return this.sweeping;
+  }
+
+  public stats(): JanitorStats {
+    return {
+      ...this.totals,
+      removed: { ...this.totals.removed },
+      reclaimed_bytes: { ...this.totals.reclaimed_bytes }
+    };
+  }
+
+  private async collect(now: number): Promise<SweepResult> {
+    const before = now - this.options.ttlMs;
+    const result: SweepResult = { workdirs: 0, containers: 0, cache_entries: 0, reclaimed_bytes: 0 };
+    for (const root of this.options.workRoots) {
+      const { count, bytes } = this.collectWorkdirs(root, before);
+      result.workdirs += count;
+      result.reclaimed_bytes += bytes;
+      this.totals.reclaimed_bytes.workdirs += bytes;
+    }
+    result.containers = await this.collectContainers(before);
+    for (const cache of this.options.caches ?? []) {
+      try {
+        const expired = cache.expire(now - this.options.cacheTtlMs);
+        result.cache_entries += expired.entries;
+        result.reclaimed_bytes += expired.bytes;
+        this.totals.reclaimed_bytes.cache += expired.bytes;
+      } catch (err) {
+        this.logger.warn('cache expiry failed', { cache: cache.name, message: (err as Error).message });
+      }
+    }
+    this.totals.sweeps++;
+    this.totals.removed.workdirs += result.workdirs;
+    this.totals.removed.containers += result.containers;
+    this.totals.removed.cache_entries += result.cache_entries;
+    this.totals.last_sweep_at = new Date(now).toISOString();
+    if (result.workdirs + result.containers + result.cache_entries > 0) {
+      this.logger.info('removed orphaned sandbox state', { ...result });
+    }
+    return result;
+  }
+
+  private collectWorkdirs(root: string, before: number) {
+    let count = 0;
+    let bytes = 0;
+    if (!fs.existsSync(root)) {
+      return { count, bytes };
+    }
+    for (const dirent of fs.readdirSync(root, { withFileTypes: true })) {
+      if (!dirent.isDirectory() || !SANDBOX_NAME.test(dirent.name) || this.options.isLive(dirent.name)) {
+        continue;
+      }
+      const dir = path.join(root, dirent.name);
+      try {
+        if (fs.statSync(dir).mtimeMs >= before) {
+          continue;
+        }
+        bytes += directorySize(dir);
+        fs.rmSync(dir, { recursive: true, force: true });
+        count++;
+      } catch (err) {
+        // E.g. files a sandbox user left unreadable; the next sweep tries again.
+        this.logger.warn('could not remove work directory', { dir, message: (err as Error).message });
+      }
+    }
+    return { count, bytes };
+  }
+
+  private async collectContainers(before: number) {
+    const host = this.options.containers;
+    if (!host) {
+      return 0;
+    }
+    try {
+      const orphans = (await host.listContainers())
+        .filter((container) => container.created_at < before && !this.options.isLive(container.name))
+        .map((container) => container.name);
+      if (orphans.length > 0) {
+        await host.removeContainers(orphans);
+      }
+      return orphans.length;
+    } catch (err) {
+      this.logger.warn('could not remove orphaned containers', { message: (err as Error).message });
+      return 0;
+    }
+  }
+}
@@ -0,0 +1,475 @@
+import { PassThrough } from 'node:stream';
+import Boom from '@hapi/boom';
+import { Logger } from '../util/logger.js';
+import type { Orchestrator, StartedRun } from './orchestrator.js';
+import type { SpanContext } from '../tracing/tracer.js';
+import { RunnerRegistry, runnerRegistry } from './runners.js';
+import { detectLanguage } from './detect.js';
+import { diffOutput, tokenMatches, trimLines, type OutputDiff } from './output_diff.js';
+import type { ResultSigner } from './result_signing.js';
+import type { PhaseResult, ResultSignature, RunRecord, RunRequest, RunStatus } from './types.js';
+
+// How a case's stdout is compared with the expected output: byte for byte, ignoring trailing
+// whitespace on each line and at the end, or token by token with numbers compared within a
+// tolerance.
+export type Comparison = 'exact' | 'trimmed' | 'float';
+
+// Accepted, wrong answer, time limit, memory limit, runtime error (non-zero exit), compile error,
+// judgement failed (the checker itself did not produce a verdict) and skipped (not run because an
+// earlier failure stopped a fail-fast request).
+export type Verdict = 'AC' | 'WA' | 'TLE' | 'MLE' | 'RE' | 'CE' | 'JF' | 'SK';
+
+// A program that grades each case instead of comparing output, for problems with more than one
+// valid answer. It runs with the case's input, the contestant's output and the reference answer
+// as inputs/input.txt, inputs/output.txt and inputs/answer.txt (also passed as its arguments) and
+// exits 0 to accept or 1 to reject; its stdout and stderr become the case's checker_message.
+export type JudgeChecker = Pick<RunRequest, 'language' | 'code' | 'sources' | 'build' | 'version' | 'limits' | 'deterministic'>;
+
+// A program that talks to the submission for interactive problems: its stdout is the
+// submission's stdin and the other way round. It gets the case's input and the reference answer
+// as inputs/input.txt and inputs/answer.txt (also its arguments) and exits like a testlib
+// interactor: 0 accepts, 1 or 2 rejects, anything else is a judgement failure.
+export type JudgeInteractor = JudgeChecker;
+
+// Which side a verdict other than AC is blamed on.
+export type JudgeFault = 'submission' | 'checker' | 'interactor';
+
+export interface JudgeCase {
+  stdin?: string;
+  expected_stdout: string;
+  // Overrides the request's comparison for this case.
+  comparison?: Comparison;
+  tolerance?: number;
+}
+
+// One submission judged against every case; the submission fields are those of a run request.
+export interface JudgeRequest extends Omit<RunRequest, 'stdin' | 'mode'> {
+  cases: JudgeCase[];
+  checker?: JudgeChecker;
+  // Replaces both the checker and output comparison.
+  interactor?: JudgeInteractor;
+  comparison?: Comparison;
+  // Allowed absolute or relative difference for `float` comparison.
+  tolerance?: number;
+  // Starts no more cases once one gets a verdict other than AC; those already running finish.
+  fail_fast?: boolean;
+}
+
+export interface JudgeCaseResult {
+  index: number;
+  verdict: Verdict;
+  // Null for cases skipped because the submission did not compile.
+  run_id: string | null;
+  status: RunStatus | null;
+  exit_code: number | null;
+  wall_ms: number;
+  cpu_ms: number;
+  max_rss_mb: number;
+  stdout: string;
+  stderr: string;
+  checker_run_id: string | null;
+  checker_message: string | null;
+  interactor_run_id: string | null;
+  // What the interactor wrote to stderr.
+  interactor_message: string | null;
+  // Null for AC.
+  fault: JudgeFault | null;
+  // How the output differs from the expected one, for wrong answers judged by comparison rather
+  // than by a checker or interactor.
+  diff: OutputDiff | null;
+}
+
+export interface JudgeResult {
+  // The first case's verdict that is not AC, or AC when every case passed.
+  verdict: Verdict;
+  passed: number;
+  total: number;
+  // Compile phase of the submission, null for interpreted languages.
+  compile: PhaseResult | null;
+  cases: JudgeCaseResult[];
+  // The deployment's signature over the rest of the result, null when it signs no results. The
+  // cases' runs are signed records of their own, which bind the verdicts to the submitted code.
+  signature: ResultSignature | null;
+}
+
+export interface JudgeOptions {
+  orchestrator: Orchestrator;
+  logger: Logger;
+  registry?: RunnerRegistry;
+  // Cases of one judge request that may run at once.
+  concurrency?: number;
+  // Cases one judge request may have.
+  maxCases?: number;
+  // Receives every run record as it finishes.
+  onRun?: (run: RunRecord) => void;
+  // Signs every result; results go out unsigned when unset.
+  signer?: ResultSigner;
+}
+
+const DEFAULT_MAX_CASES = 100;
+const DEFAULT_TOLERANCE = 1e-6;
+const CHECKER_ARGS = ['inputs/input.txt', 'inputs/output.txt', 'inputs/answer.txt'];
+const INTERACTOR_ARGS = ['inputs/input.txt', 'inputs/answer.txt'];
+
+// Runs one submission against a batch of stdin/expected-output cases, online judge style. Every
+// case is a run of its own in a fresh workdir, up to `concurrency` at once, and results come back
+// in case order however the runs finish. Compiled submissions run their first case alone so the
+// remaining cases reuse that build from the compilation cache (when the backend has one) and are
+// skipped entirely if it fails.
+export class Judge {
+  private readonly registry: RunnerRegistry;
+  private readonly concurrency: number;
+  private readonly maxCases: number;
+
+  constructor(private readonly options: JudgeOptions) {
+    this.registry = options.registry ?? runnerRegistry;
+    this.concurrency = Math.max(1, options.concurrency ?? 4);
+    this.maxCases = options.maxCases ?? DEFAULT_MAX_CASES;
+  }
+
+  // Every case and checker run joins the caller's trace when `traceParent` is given.
+  public async judge(original: JudgeRequest, apiKey: string, traceParent?: SpanContext | null): Promise<JudgeResult> {
+    this.validate(original);
+    // Detected once up front so that every case runs as the same language.
+    const request = original.language ? original : { ...original, language: detectLanguage(original, this.registry).language };
+    const { cases, checker, interactor, comparison, tolerance, fail_fast: failFast, ...submission } = request;
+    const runner = this.registry.require(request.language);
+    const runCase = async (index: number): Promise<{ run: RunRecord; result: JudgeCaseResult }> => {
+      const testCase = cases[index];
+      if (interactor) {
+        const interaction = await this.interact(interactor, testCase, submission, apiKey, traceParent);
+        return { run: interaction.run, result: { ...caseResult(index, interaction.verdict, interaction.run), ...interaction.report } };
+      }
+      const run = await this.options.orchestrator.createRun({ ...submission, mode: 'run', stdin: testCase.stdin ?? '' }, apiKey, {
+        traceParent
+      });
+      this.options.onRun?.(run);
+      let verdict = runFailure(run);
+      let checked: { verdict: Verdict; run: RunRecord } | null = null;
+      if (!verdict && checker) {
+        checked = await this.check(checker, testCase, run, apiKey, traceParent);
+        verdict = checked.verdict;
+      }
+      let diff: OutputDiff | null = null;
+      if (!verdict) {
+        const caseComparison = testCase.comparison ?? comparison ?? 'trimmed';
+        const caseTolerance = testCase.tolerance ?? tolerance ?? DEFAULT_TOLERANCE;
+        const matches = outputMatches(run.stdout, testCase.expected_stdout, caseComparison, caseTolerance);
+        verdict = matches ? 'AC' : 'WA';
+        diff = matches ? null : diffOutput(run.stdout, testCase.expected_stdout, caseComparison, caseTolerance);
+      }
+      return {
+        run,
+        result: {
+          ...caseResult(index, verdict, run),
+          checker_run_id: checked?.run.id ?? null,
+          checker_message: checked ? `${checked.run.stdout}${checked.run.stderr}`.trim() || null : null,
+          fault: verdict === 'AC' ? null : verdict === 'JF' ? 'checker' : 'submission',
+          diff
+        }
+      };
+    };
+    const results: JudgeCaseResult[] = new Array(cases.length);
+    let compile: PhaseResult | null = null;
+    let next = 0;
+    let failed = false;
+    const record = (result: JudgeCaseResult) => {
+      results[result.index] = result;
+      failed = failed || result.verdict !== 'AC';
+    };
+    if (runner.compiled) {
+      const first = await runCase(next++);
+      record(first.result);
+      compile = first.run.phases.compile;
+      if (first.result.verdict === 'CE') {
+        this.options.logger.info('judge submission failed to compile', { language: request.language, apiKey });
+        for (let index = 1; index < cases.length; index++) {
+          results[index] = { ...caseResult(index, 'CE', null), fault: 'submission' };
+        }
+        return summarize(results, compile, this.options.signer);
+      }
+    }
+    const worker = async () => {
+      while (next < cases.length && !(failFast && failed)) {
+        const { run, result } = await runCase(next++);
+        record(result);
+        compile = compile ?? run.phases.compile;
+      }
+    };
+    await Promise.all(Array.from({ length: Math.min(this.concurrency, cases.length - next) }, worker));
+    // Cases are started in order, so those skipped all come after the one that failed.
+    for (let index = next; index < cases.length; index++) {
+      results[index] = caseResult(index, 'SK', null);
+    }
+    return summarize(results, compile, this.options.signer);
+  }
+
+  // Runs the submission and the interactor side by side with each one's stdout piped into the
+  // other's stdin. The interactor starts once the submission leaves the queue and shares its
+  // worker. When either side exits the other's stdin is closed, and a side still running its
+  // kill grace after that is canceled: a submission that stops talking gets TLE, an interactor
+  // that does JF.
+  private async interact(
+    interactor: JudgeInteractor,
+    testCase: JudgeCase,
+    submission: Omit<JudgeRequest, 'cases' | 'checker' | 'interactor' | 'comparison' | 'tolerance' | 'fail_fast'>,
+    apiKey: string,
+    traceParent?: SpanContext | null
+  ) {
+    const orchestrator = this.options.orchestrator;
+    const toSubmission = new PassThrough();
+    const toInteractor = new PassThrough();
+    const relay = (target: PassThrough) => (stream: 'stdout' | 'stderr', data: Buffer) => {
+      if (stream === 'stdout' && !target.writableEnded) {
+        target.write(data);
+      }
+    };
+    let peer: StartedRun | null = null;
+    let startError: Error | null = null;
+    let interactorStarted!: (started: StartedRun | null) => void;
+    const whenStarted = new Promise<StartedRun | null>((resolve) => {
+      interactorStarted = resolve;
+    });
+    const finished: Array<'submission' | 'interactor'> = [];
+    const stopped = new Set<string>();
+    // Closes the other side's stdin once one side is done, and cancels the other side if it is
+    // still running after the finished one's kill grace.
+    const settle = async (side: 'submission' | 'interactor', done: Promise<RunRecord>, otherInput: PassThrough, other: () => StartedRun | null) => {
+      try {
+        const run = await done;
+        const target = other();
+        if (target) {
+          const timer = setTimeout(() => {
+            stopped.add(target.id);
+            orchestrator.cancelRun(target.id);
+          }, run.limits.kill_grace_ms);
+          target.done.catch(() => undefined).finally(() => clearTimeout(timer));
+        }
+        return run;
+      } catch (err) {
+        const target = other();
+        if (target) {
+          orchestrator.cancelRun(target.id);
+        }
+        throw err;
+      } finally {
+        finished.push(side);
+        otherInput.end();
+      }
+    };
+    const started = orchestrator.startRun({ ...submission, mode: 'run', stdin: '' }, apiKey, {
+      input: toSubmission,
+      piped: true,
+      onOutput: relay(toInteractor),
+      traceParent,
+      onStart: () => {
+        try {
+          peer = orchestrator.startRun({ ...interactor, mode: 'run', args: INTERACTOR_ARGS }, apiKey, {
+            input: toInteractor,
+            piped: true,
+            unqueued: true,
+            onOutput: relay(toSubmission),
+            inputs: { 'input.txt': testCase.stdin ?? '', 'answer.txt': testCase.expected_stdout },
+            traceParent
+          });
+        } catch (err) {
+          startError = err as Error;
+          toSubmission.end();
+          orchestrator.cancelRun(started.id);
+        }
+        interactorStarted(peer);
+      }
+    });
+    // A submission canceled while queued never starts its interactor.
+    started.done.catch(() => undefined).finally(() => interactorStarted(null));
+    const [run, interactorRun] = await Promise.all([
+      settle('submission', started.done, toInteractor, () => peer),
+      whenStarted.then((other) => (other ? settle('interactor', other.done, toSubmission, () => started) : null))
+    ]);
+    if (startError) {
+      throw startError;
+    }
+    this.options.onRun?.(run);
+    if (interactorRun) {
+      this.options.onRun?.(interactorRun);
+    }
+    const { verdict, fault } = interactionVerdict(run, interactorRun, stopped, finished[0]);
+    if (fault === 'interactor') {
+      this.options.logger.warn('judge interactor failed', { runId: interactorRun?.id, status: interactorRun?.status, apiKey });
+    }
+    return {
+      run,
+      verdict,
+      report: {
+        interactor_run_id: interactorRun?.id ?? null,
+        interactor_message: interactorRun?.stderr.trim() || null,
+        fault
+      }
+    };
+  }
+
+  private async check(checker: JudgeChecker, testCase: JudgeCase, run: RunRecord, apiKey: string, traceParent?: SpanContext | null) {
+    const checkRun = await this.options.orchestrator.createRun({ ...checker, mode: 'run', args: CHECKER_ARGS }, apiKey, {
+      inputs: { 'input.txt': testCase.stdin ?? '', 'output.txt': run.stdout, 'answer.txt': testCase.expected_stdout },
+      traceParent
+    });
+    this.options.onRun?.(checkRun);
+    const compileFailed = checkRun.phases.compile !== null && checkRun.phases.compile.exit_code !== 0;
+    let verdict: Verdict = 'JF';
+    if (checkRun.status === 'succeeded') {
+      verdict = 'AC';
+    } else if (checkRun.status === 'failed' && checkRun.exit_code === 1 && !compileFailed) {
+      verdict = 'WA';
+    }
+    if (verdict === 'JF') {
+      this.options.logger.warn('judge checker failed', { runId: checkRun.id, status: checkRun.status, apiKey });
+    }
+    return { verdict, run: checkRun };
+  }
+
+  private validate(request: JudgeRequest) {
+    if (!Array.isArray(request.cases) || request.cases.length === 0) {
+      throw Boom.badRequest('cases is required');
+    }
+    if (request.cases.length > this.maxCases) {
+      throw Boom.badRequest(`cases exceeds ${this.maxCases}`);
+    }
+    if (request.fail_fast !== undefined && typeof request.fail_fast !== 'boolean') {
+      throw Boom.badRequest('fail_fast must be a boolean');
+    }
+    if (request.checker !== undefined && (typeof request.checker !== 'object' || !request.checker?.language)) {
+      throw Boom.badRequest('checker.language is required');
+    }
+    if (request.interactor !== undefined) {
+      if (typeof request.interactor !== 'object' || !request.interactor?.language) {
+        throw Boom.badRequest('interactor.language is required');
+      }
+      if (request.checker !== undefined) {
+        throw Boom.badRequest('checker and interactor are mutually exclusive');
+      }
+    }
+    validateComparison(request.comparison, request.tolerance, 'request');
+    request.cases.forEach((testCase, index) => {
+      if (typeof testCase?.expected_stdout !== 'string') {
+        throw Boom.badRequest(`cases[${index}].expected_stdout must be a string`);
+      }
+      if (testCase.stdin !== undefined && typeof testCase.stdin !== 'string') {
+        throw Boom.badRequest(`cases[${index}].stdin must be a string`);
+      }
+      validateComparison(testCase.comparison, testCase.tolerance, `cases[${index}]`);
+    });
+  }
+}
+
+function validateComparison(comparison: unknown, tolerance: unknown, where: string) {
+  if (comparison !== undefined && !['exact', 'trimmed', 'float'].includes(comparison as string)) {
+    throw Boom.badRequest(`${where}: comparison must be exact, trimmed or float`);
+  }
+  if (tolerance !== undefined && (typeof tolerance !== 'number' || !(tolerance >= 0))) {
+    throw Boom.badRequest(`${where}: tolerance must be a non-negative number`);
+  }
+}
+
+// A case result as far as the submission's run goes, null for a case that never ran.
+function caseResult(index: number, verdict: Verdict, run: RunRecord | null): JudgeCaseResult {
+  return {
+    index,
+    verdict,
+    run_id: run?.id ?? null,
+    status: run?.status ?? null,
+    exit_code: run?.exit_code ?? null,
+    wall_ms: run?.usage.wall_ms ?? 0,
+    cpu_ms: run?.usage.cpu_ms ?? 0,
+    max_rss_mb: run?.usage.max_rss_mb ?? 0,
+    stdout: run?.stdout ?? '',
+    stderr: run?.stderr ?? '',
+    checker_run_id: null,
+    checker_message: null,
+    interactor_run_id: null,
+    interactor_message: null,
+    fault: null,
+    diff: null
+  };
+}
+
+// An interactor that exits first has the last word; otherwise a submission that failed is blamed
+// before the interactor, whose complaints may only be about the submission going quiet.
+function interactionVerdict(
+  run: RunRecord,
+  interactor: RunRecord | null,
+  stopped: Set<string>,
+  first: 'submission' | 'interactor' | undefined
+): { verdict: Verdict; fault: JudgeFault | null } {
+  const failure = stopped.has(run.id) ? 'TLE' : runFailure(run);
+  if (failure === 'CE') {
+    return { verdict: 'CE', fault: 'submission' };
+  }
+  let judged: Verdict = 'JF';
+  if (interactor && !stopped.has(interactor.id)) {
+    if (interactor.status === 'succeeded') {
+      judged = 'AC';
+    } else if (interactor.status === 'failed' && (interactor.exit_code === 1 || interactor.exit_code === 2) && interactor.phases.run) {
+      judged = 'WA';
+    }
+  }
+  if (first === 'interactor' && judged !== 'AC') {
+    return { verdict: judged, fault: judged === 'JF' ? 'interactor' : 'submission' };
+  }
+  if (failure) {
+    return { verdict: failure, fault: 'submission' };
+  }
+  if (judged === 'JF') {
+    return { verdict: 'JF', fault: 'interactor' };
+  }
+  return { verdict: judged, fault: judged === 'AC' ? null : 'submission' };
+}
+
+// The verdict for a run that did not get as far as producing an answer, null when it did.
+export function runFailure(run: RunRecord): Verdict | null {
+  if (run.phases.compile && run.phases.compile.exit_code !== 0) {
+    return 'CE';
+  }
+  if (run.status === 'timeout' || run.limit_exceeded === 'wall_time' || run.limit_exceeded === 'cpu_time') {
+    return 'TLE';
+  }
+  if (run.status === 'oom' || run.limit_exceeded === 'memory') {
+    return 'MLE';
+  }
+  if (run.status !== 'succeeded') {
+    return 'RE';
+  }
+  return null;
+}
+
+export function outputMatches(actual: string, expected: string, comparison: Comparison, tolerance = DEFAULT_TOLERANCE): boolean {
+  if (comparison === 'exact') {
+    return actual === expected;
+  }
+  if (comparison === 'trimmed') {
+    return trimOutput(actual) === trimOutput(expected);
+  }
+  const actualTokens = actual.split(/\s+/).filter(Boolean);
+  const expectedTokens = expected.split(/\s+/).filter(Boolean);
+  if (actualTokens.length !== expectedTokens.length) {
+    return false;
+  }
+  return expectedTokens.every((token, index) => tokenMatches(actualTokens[index], token, tolerance));
+}
+
+function trimOutput(output: string): string {
+  return trimLines(output).join('\n');
+}
+
+function summarize(cases: JudgeCaseResult[], compile: PhaseResult | null, signer: ResultSigner | undefined): JudgeResult {
+  const failed = cases.find((result) => result.verdict !== 'AC');
+  const summary: JudgeResult = {
+    verdict: failed?.verdict ?? 'AC',
+    passed: cases.filter((result) => result.verdict === 'AC').length,
+    total: cases.length,
+    compile,
+    cases,
+    signature: null
+  };
+  summary.signature = signer?.sign(summary) ?? null;
+  return summary;
+}
@@ -3,41 +3,123 @@ import { RunLimits } from './types.js';
 
 export const DEFAULT_LIMITS: RunLimits = {
   timeout_ms: 5000,
+  kill_grace_ms: 1000,
   memory_mb: 256,
   cpu_ms: 5000,
   max_output_bytes: 1024 * 1024,
+  max_stdout_bytes: 1024 * 1024,
+  max_stderr_bytes: 1024 * 1024,
   max_artifact_bytes: 5 * 1024 * 1024,
-  max_artifact_files: 10
+  max_artifact_files: 10,
+  max_artifact_file_bytes: 2 * 1024 * 1024,
+  disk_mb: 100,
+  max_processes: 32,
+  max_open_files: 256,
+  core_dump_mb: 0
 };
 
 export const MAX_LIMITS: RunLimits = {
   timeout_ms: 10000,
+  kill_grace_ms: 5000,
   memory_mb: 512,
   cpu_ms: 20000,
   max_output_bytes: 2 * 1024 * 1024,
+  max_stdout_bytes: 2 * 1024 * 1024,
+  max_stderr_bytes: 2 * 1024 * 1024,
   max_artifact_bytes: 20 * 1024 * 1024,
-  max_artifact_files: 10
+  max_artifact_files: 10,
+  max_artifact_file_bytes: 10 * 1024 * 1024,
+  disk_mb: 1024,
+  max_processes: 512,
+  max_open_files: 4096,
+  core_dump_mb: 10
 };
 
-export function mergeLimits(input: Partial<RunLimits> | undefined): RunLimits {
-  const merged: RunLimits = { ...DEFAULT_LIMITS, ...(input ?? {}) };
-  if (merged.timeout_ms > MAX_LIMITS.timeout_ms) {
-    throw Boom.badRequest('timeout_ms exceeds maximum');
-  }
-  if (merged.memory_mb > MAX_LIMITS.memory_mb) {
-    throw Boom.badRequest('memory_mb exceeds maximum');
-  }
-  if (merged.cpu_ms > MAX_LIMITS.cpu_ms) {
-    throw Boom.badRequest('cpu_ms exceeds maximum');
+// Interactive sessions sit idle waiting for input, so their wall-clock budget is much larger.
+export const SESSION_DEFAULT_TIMEOUT_MS = 60000;
+export const SESSION_MAX_TIMEOUT_MS = 300000;
+
+// Overrides of one language's defaults and maxima, e.g. more memory for the JVM or less CPU for
+// scripts; limits left out are the deployment's.
+export interface LanguageLimits {
+  defaults?: Partial<RunLimits>;
+  max?: Partial<RunLimits>;
+}
+
+// A deployment's own defaults and maxima, from the `limits` section of its configuration.
+export interface LimitPolicy {
+  defaults: RunLimits;
+  max: RunLimits;
+  // Keyed by language.
+  languages?: Record<string, LanguageLimits>;
+}
+
+const BUILT_IN_POLICY: LimitPolicy = { defaults: DEFAULT_LIMITS, max: MAX_LIMITS };
+
+// Applies an API key's own maxima, which replace the deployment's and its languages' so a tier may
+// allow more or less than limits.max; defaults above a lowered maximum come down to it.
+export function withKeyMaxima(policy: LimitPolicy | undefined, maxima: Partial<RunLimits>): LimitPolicy {
+  const { defaults, max, languages } = policy ?? BUILT_IN_POLICY;
+  const merged: LimitPolicy = { defaults: { ...defaults }, max: { ...max } };
+  for (const [name, limit] of Object.entries(maxima) as Array<[keyof RunLimits, number]>) {
+    merged.max[name] = limit;
+    merged.defaults[name] = Math.min(merged.defaults[name], limit);
   }
-  if (merged.max_output_bytes > MAX_LIMITS.max_output_bytes) {
-    throw Boom.badRequest('max_output_bytes exceeds maximum');
+  if (languages) {
+    merged.languages = {};
+    for (const [language, overrides] of Object.entries(languages)) {
+      const languageDefaults = { ...overrides.defaults };
+      for (const [name, limit] of Object.entries(maxima) as Array<[keyof RunLimits, number]>) {
+        if (languageDefaults[name] !== undefined) {
+          languageDefaults[name] = Math.min(languageDefaults[name] as number, limit);
+        }
+      }
+      merged.languages[language] = { defaults: languageDefaults, max: { ...overrides.max, ...maxima } };
+    }
   }
-  if (merged.max_artifact_bytes > MAX_LIMITS.max_artifact_bytes) {
-    throw Boom.badRequest('max_artifact_bytes exceeds maximum');
+  return merged;
+}
+
+// maxProcesses and maxOpenFiles are the runner's own defaults, since toolchains like the JVM or
+// the Go compiler start far more threads and open far more files than an interpreter; a
+// language's configured default still wins. With
+// `language`, that language's overrides in the policy apply and errors name it.
+export function mergeLimits(
+  input: Partial<RunLimits> | undefined,
+  options: { interactive?: boolean; maxProcesses?: number; maxOpenFiles?: number; policy?: LimitPolicy; language?: string } = {}
+): RunLimits {
+  const policy = options.policy ?? BUILT_IN_POLICY;
+  const overrides = options.language === undefined ? undefined : policy.languages?.[options.language];
+  const base: RunLimits = { ...policy.defaults, ...overrides?.defaults };
+  const max: RunLimits = { ...policy.max, ...overrides?.max };
+  const defaults: RunLimits = {
+    ...base,
+    ...(options.interactive ? { timeout_ms: SESSION_DEFAULT_TIMEOUT_MS } : {}),
+    max_processes: overrides?.defaults?.max_processes ?? options.maxProcesses ?? base.max_processes,
+    max_open_files: overrides?.defaults?.max_open_files ?? options.maxOpenFiles ?? base.max_open_files
+  };
+  const maxTimeout = options.interactive ? SESSION_MAX_TIMEOUT_MS : max.timeout_ms;
+  const merged: RunLimits = {
+    ...defaults,
+    max_stdout_bytes: input?.max_output_bytes ?? defaults.max_stdout_bytes,
+    max_stderr_bytes: input?.max_output_bytes ?? defaults.max_stderr_bytes,
+    ...(input ?? {})
+  };
+  const scope = overrides ? ` for ${options.language}` : '';
+  for (const name of Object.keys(MAX_LIMITS) as Array<keyof RunLimits>) {
+    const limit = name === 'timeout_ms' ? maxTimeout : max[name];
+    if (merged[name] > limit) {
+      throw Boom.badRequest(`${name} exceeds maximum of ${limit}${scope}`, { code: 'limit_exceeds_maximum', limit: name, maximum: limit });
+    }
   }
-  if (merged.max_artifact_files > MAX_LIMITS.max_artifact_files) {
-    throw Boom.badRequest('max_artifact_files exceeds maximum');
+  // A core comes back as the artifact `crash/core`, so it may be no larger than the run's artifacts.
+  const coreMaximum = Math.floor(merged.max_artifact_file_bytes / (1024 * 1024));
+  if (merged.core_dump_mb > coreMaximum) {
+    throw Boom.badRequest(`core_dump_mb exceeds maximum of ${coreMaximum}, the max_artifact_file_bytes of the run`, {
+      code: 'limit_exceeds_maximum',
+      limit: 'core_dump_mb',
+      maximum: coreMaximum
+    });
   }
   return merged;
 }
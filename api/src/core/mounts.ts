@@ -0,0 +1,95 @@
+import fs from 'node:fs';
+import path from 'node:path';
+import Boom from '@hapi/boom';
+import type { DatasetStore } from './datasets.js';
+import type { ArtifactStorage } from './storage.js';
+import type { Mount, SandboxRunSpec } from './types.js';
+
+export type ResolvedMount = SandboxRunSpec['mounts'][number];
+
+// Mounts live under /data so they can never shadow /work, the dependency layer or the image.
+const MOUNT_PREFIX = '/data';
+const MAX_MOUNTS = 16;
+const MOUNT_PATH_PATTERN = /^\/data(\/[A-Za-z0-9._-]+)+$/;
+const DATASET_ID_PATTERN = /^(file|ds)_[A-Za-z0-9]+$/;
+
+// Checks the shape of a request's mounts without touching the filesystem.
+export function validateMounts(mounts: unknown): Mount[] {
+  if (mounts === undefined) {
+    return [];
+  }
+  if (!Array.isArray(mounts)) {
+    throw Boom.badRequest('mounts must be an array');
+  }
+  if (mounts.length > MAX_MOUNTS) {
+    throw Boom.badRequest(`mounts exceeds ${MAX_MOUNTS} entries`);
+  }
+  const paths: string[] = [];
+  mounts.forEach((mount: Mount, index) => {
+    if (typeof mount !== 'object' || mount === null) {
+      throw Boom.badRequest(`mounts[${index}] must be an object`);
+    }
+    const target = mount.path;
+    if (typeof target !== 'string' || !MOUNT_PATH_PATTERN.test(target) || target.split('/').some((part) => part === '.' || part === '..')) {
+      throw Boom.badRequest(`mounts[${index}].path must be an absolute path under ${MOUNT_PREFIX}`);
+    }
+    // Nested mounts would let one source hide or replace part of another.
+    const overlapping = paths.find((other) => other === target || other.startsWith(`${target}/`) || target.startsWith(`${other}/`));
+    if (overlapping) {
+      throw Boom.badRequest(`mounts[${index}].path overlaps ${overlapping}`);
+    }
+    paths.push(target);
+    if ((mount.dataset_id === undefined) === (mount.host_path === undefined)) {
+      throw Boom.badRequest(`mounts[${index}] needs exactly one of dataset_id or host_path`);
+    }
+    if (mount.dataset_id !== undefined && (typeof mount.dataset_id !== 'string' || !DATASET_ID_PATTERN.test(mount.dataset_id))) {
+      throw Boom.badRequest(`mounts[${index}].dataset_id is invalid`);
+    }
+    if (mount.host_path !== undefined && (typeof mount.host_path !== 'string' || !path.posix.isAbsolute(mount.host_path))) {
+      throw Boom.badRequest(`mounts[${index}].host_path must be an absolute path`);
+    }
+    if (mount.read_only !== undefined && mount.read_only !== true) {
+      throw Boom.badRequest('mounts are always read-only');
+    }
+  });
+  return mounts as Mount[];
+}
+
+// Resolves validated mounts to the files and directories the API sees. Host paths are followed
+// through symlinks before the containment check, so a link inside a root cannot expose anything
+// outside it; the resolved path is what gets mounted. Datasets from /v1/datasets are refused when
+// there is no dataset store.
+export function resolveMounts(mounts: Mount[], roots: string[], storage: ArtifactStorage, datasets?: DatasetStore): ResolvedMount[] {
+  const realRoots = roots.flatMap((root) => {
+    const real = realpath(root);
+    return real ? [real] : [];
+  });
+  return mounts.map((mount) => {
+    if (mount.dataset_id?.startsWith('ds_')) {
+      if (!datasets) {
+        throw Boom.notFound('dataset not found');
+      }
+      return { sourcePath: datasets.pathOf(mount.dataset_id), destPath: mount.path };
+    }
+    if (mount.dataset_id !== undefined) {
+      const uploaded = storage.getUploadedFile(mount.dataset_id);
+      return { sourcePath: uploaded.path, destPath: mount.path };
+    }
+    const source = realpath(mount.host_path as string);
+    if (!source) {
+      throw Boom.badRequest(`mount source not found: ${mount.host_path}`);
+    }
+    if (!realRoots.some((root) => source === root || source.startsWith(`${root}${path.sep}`))) {
+      throw Boom.badRequest(`host_path is outside the server's mount roots: ${mount.host_path}`, { code: 'mount_not_permitted' });
+    }
+    return { sourcePath: source, destPath: mount.path };
+  });
+}
+
+function realpath(target: string): string | null {
+  try {
+    return fs.realpathSync(target);
+  } catch {
+    return null;
+  }
+}
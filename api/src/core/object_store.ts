@@ -0,0 +1,268 @@
+import crypto from 'node:crypto';
+import fs from 'node:fs';
+import path from 'node:path';
+
+// Where run artifacts are kept once collected, and archived executions once retention has taken
+// them out of the execution store. Keys are `<id>/<file name>`; objects are written once and
+// handed out through signed URLs that expire.
+export interface ObjectStore {
+  readonly kind: 'filesystem' | 's3' | 'gcs';
+  put(key: string, data: Buffer, contentType: string): Promise<void>;
+  // Null for a key that was never written or has been deleted.
+  get(key: string): Promise<Buffer | null>;
+  delete(key: string): Promise<void>;
+  signedUrl(key: string, expiresAt: Date): Promise<string>;
+}
+
+// Signs an API path such as `/v1/files/<id>` into a download URL that expires at `expiresAtIso`.
+export type UrlSigner = (urlPath: string, expiresAtIso: string) => string;
+
+// Objects under `<dir>/artifacts`, each in a directory of its artifact id next to a meta.json, and
+// served by the API itself on /v1/files/<id>.
+export class FilesystemObjectStore implements ObjectStore {
+  public readonly kind = 'filesystem';
+
+  constructor(private readonly dir: string, private readonly sign: UrlSigner) { }
+
+  public async put(key: string, data: Buffer, contentType: string) {
+    const [id, name] = splitKey(key);
+    const destDir = path.join(this.dir, 'artifacts', id);
+    await fs.promises.mkdir(destDir, { recursive: true });
+    await fs.promises.writeFile(path.join(destDir, name), data);
+    const sha256 = crypto.createHash('sha256').update(data).digest('hex');
+    await fs.promises.writeFile(path.join(destDir, 'meta.json'), JSON.stringify({ id, name, contentType, size: data.length, sha256 }));
+  }
+
+  public async get(key: string) {
+    const [id, name] = splitKey(key);
+    return fs.promises.readFile(path.join(this.dir, 'artifacts', id, name)).catch((err: NodeJS.ErrnoException) => {
+      if (err.code === 'ENOENT') {
+        return null;
+      }
+      throw err;
+    });
+  }
+
+  // An id holds a single object, so its whole directory goes.
+  public async delete(key: string) {
+    await fs.promises.rm(path.join(this.dir, 'artifacts', splitKey(key)[0]), { recursive: true, force: true });
+  }
+
+  public async signedUrl(key: string, expiresAt: Date) {
+    return this.sign(`/v1/files/${splitKey(key)[0]}`, expiresAt.toISOString());
+  }
+}
+
+export interface S3Config {
+  bucket: string;
+  region: string;
+  accessKeyId: string;
+  secretAccessKey: string;
+  sessionToken?: string;
+  // S3-compatible services such as MinIO or R2, addressed path-style; AWS itself when unset.
+  endpoint?: string;
+  // Prepended to every key, e.g. `artifacts/`.
+  prefix?: string;
+}
+
+// Amazon S3 and compatible services. Uploads and downloads both go through query-string signed
+// (SigV4) URLs, so no SDK is needed.
+export class S3ObjectStore implements ObjectStore {
+  public readonly kind = 's3';
+
+  constructor(private readonly config: S3Config) { }
+
+  public async put(key: string, data: Buffer, contentType: string) {
+    await upload(this.presign('PUT', key, new Date(Date.now() + UPLOAD_URL_TTL_MS)), data, contentType);
+  }
+
+  public async get(key: string) {
+    return download(this.presign('GET', key, new Date(Date.now() + UPLOAD_URL_TTL_MS)));
+  }
+
+  public async delete(key: string) {
+    await remove(this.presign('DELETE', key, new Date(Date.now() + UPLOAD_URL_TTL_MS)));
+  }
+
+  public async signedUrl(key: string, expiresAt: Date) {
+    return this.presign('GET', key, expiresAt);
+  }
+
+  private presign(method: string, key: string, expiresAt: Date) {
+    const objectKey = `${this.config.prefix ?? ''}${key}`;
+    const url = this.config.endpoint
+      ? new URL(`${this.config.endpoint.replace(/\/+$/, '')}/${encodePath(`${this.config.bucket}/${objectKey}`)}`)
+      : new URL(`https://${this.config.bucket}.s3.${this.config.region}.amazonaws.com/${encodePath(objectKey)}`);
+    const secret = this.config.secretAccessKey;
+    return presignUrl(url, method, expiresAt, {
+      algorithm: 'AWS4-HMAC-SHA256',
+      headerPrefix: 'X-Amz',
+      credential: this.config.accessKeyId,
+      scope: (date) => `${date}/${this.config.region}/s3/aws4_request`,
+      extraParams: this.config.sessionToken ? { 'X-Amz-Security-Token': this.config.sessionToken } : {},
+      sign: (date, stringToSign) => {
+        let signingKey = hmac(`AWS4${secret}`, date);
+        for (const part of [this.config.region, 's3', 'aws4_request']) {
+          signingKey = hmac(signingKey, part);
+        }
+        return hmac(signingKey, stringToSign).toString('hex');
+      }
+    });
+  }
+}
+
+export interface GcsConfig {
+  bucket: string;
+  // From a service account key file.
+  clientEmail: string;
+  privateKey: string;
+  // https://storage.googleapis.com when unset.
+  endpoint?: string;
+  prefix?: string;
+}
+
+// Google Cloud Storage, through V4 signed URLs made with a service account's key; uploads use the
+// XML API with a signed PUT.
+export class GcsObjectStore implements ObjectStore {
+  public readonly kind = 'gcs';
+
+  constructor(private readonly config: GcsConfig) { }
+
+  public async put(key: string, data: Buffer, contentType: string) {
+    await upload(this.presign('PUT', key, new Date(Date.now() + UPLOAD_URL_TTL_MS)), data, contentType);
+  }
+
+  public async get(key: string) {
+    return download(this.presign('GET', key, new Date(Date.now() + UPLOAD_URL_TTL_MS)));
+  }
+
+  public async delete(key: string) {
+    await remove(this.presign('DELETE', key, new Date(Date.now() + UPLOAD_URL_TTL_MS)));
+  }
+
+  public async signedUrl(key: string, expiresAt: Date) {
+    return this.presign('GET', key, expiresAt);
+  }
+
+  private presign(method: string, key: string, expiresAt: Date) {
+    const endpoint = (this.config.endpoint ?? 'https://storage.googleapis.com').replace(/\/+$/, '');
+    const url = new URL(`${endpoint}/${encodePath(`${this.config.bucket}/${this.config.prefix ?? ''}${key}`)}`);
+    return presignUrl(url, method, expiresAt, {
+      algorithm: 'GOOG4-RSA-SHA256',
+      headerPrefix: 'X-Goog',
+      credential: this.config.clientEmail,
+      scope: (date) => `${date}/auto/storage/goog4_request`,
+      extraParams: {},
+      sign: (_date, stringToSign) => crypto.sign('RSA-SHA256', Buffer.from(stringToSign), this.config.privateKey).toString('hex')
+    });
+  }
+}
+
+// Reads the client email and private key of a service account key file.
+export function readGcsCredentials(file: string): Pick<GcsConfig, 'clientEmail' | 'privateKey'> {
+  const key = JSON.parse(fs.readFileSync(file, 'utf8')) as { client_email?: string; private_key?: string };
+  if (!key.client_email || !key.private_key) {
+    throw new Error(`${file} is not a service account key`);
+  }
+  return { clientEmail: key.client_email, privateKey: key.private_key };
+}
+
+// Long enough for the largest artifact to go up or come back down; downloads handed out use the
+// storage's own URL lifetime.
+const UPLOAD_URL_TTL_MS = 15 * 60 * 1000;
+// Signed URLs of both services are valid for a week at most.
+const MAX_URL_TTL_SECONDS = 7 * 24 * 60 * 60;
+
+interface SigningScheme {
+  algorithm: string;
+  headerPrefix: 'X-Amz' | 'X-Goog';
+  credential: string;
+  scope: (date: string) => string;
+  extraParams: Record<string, string>;
+  sign: (date: string, stringToSign: string) => string;
+}
+
+// Query-string signing shared by SigV4 and GCS V4: only the host header is signed and the payload
+// is left unsigned, so the URL can be used by anyone holding it until it expires.
+function presignUrl(url: URL, method: string, expiresAt: Date, scheme: SigningScheme): string {
+  const now = new Date();
+  const timestamp = now.toISOString().replace(/[-:]/g, '').replace(/\.\d{3}/, '');
+  const date = timestamp.slice(0, 8);
+  const scope = scheme.scope(date);
+  const expires = Math.min(MAX_URL_TTL_SECONDS, Math.max(1, Math.ceil((expiresAt.getTime() - now.getTime()) / 1000)));
+  const params: Record<string, string> = {
+    [`${scheme.headerPrefix}-Algorithm`]: scheme.algorithm,
+    [`${scheme.headerPrefix}-Credential`]: `${scheme.credential}/${scope}`,
+    [`${scheme.headerPrefix}-Date`]: timestamp,
+    [`${scheme.headerPrefix}-Expires`]: String(expires),
+    [`${scheme.headerPrefix}-SignedHeaders`]: 'host',
+    ...scheme.extraParams
+  };
+  const query = Object.keys(params)
+    .sort()
+    .map((name) => `${encodeRfc3986(name)}=${encodeRfc3986(params[name])}`)
+    .join('&');
+  const canonicalRequest = [method, url.pathname, query, `host:${url.host}`, '', 'host', 'UNSIGNED-PAYLOAD'].join('\n');
+  const stringToSign = [scheme.algorithm, timestamp, scope, sha256Hex(canonicalRequest)].join('\n');
+  return `${url.origin}${url.pathname}?${query}&${scheme.headerPrefix}-Signature=${scheme.sign(date, stringToSign)}`;
+}
+
+async function upload(url: string, data: Buffer, contentType: string) {
+  const response = await fetch(url, {
+    method: 'PUT',
+    headers: { 'Content-Type': contentType },
+    body: data,
+    signal: AbortSignal.timeout(UPLOAD_URL_TTL_MS)
+  });
+  if (!response.ok) {
+    // Error bodies are short XML documents naming the problem, e.g. SignatureDoesNotMatch.
+    const detail = (await response.text().catch(() => '')).slice(0, 500);
+    throw new Error(`object upload failed with ${response.status}: ${detail}`);
+  }
+}
+
+async function download(url: string): Promise<Buffer | null> {
+  const response = await fetch(url, { signal: AbortSignal.timeout(UPLOAD_URL_TTL_MS) });
+  if (response.status === 404) {
+    return null;
+  }
+  if (!response.ok) {
+    const detail = (await response.text().catch(() => '')).slice(0, 500);
+    throw new Error(`object download failed with ${response.status}: ${detail}`);
+  }
+  return Buffer.from(await response.arrayBuffer());
+}
+
+// Deleting a missing object succeeds on both services.
+async function remove(url: string) {
+  const response = await fetch(url, { method: 'DELETE', signal: AbortSignal.timeout(UPLOAD_URL_TTL_MS) });
+  if (!response.ok && response.status !== 404) {
+    const detail = (await response.text().catch(() => '')).slice(0, 500);
+    throw new Error(`object delete failed with ${response.status}: ${detail}`);
+  }
+}
+
+function splitKey(key: string): [string, string] {
+  const [id, name, ...rest] = key.split('/');
+  if (!id || !name || rest.length > 0 || name === '.' || name === '..') {
+    throw new Error(`invalid object key: ${key}`);
+  }
+  return [id, name];
+}
+
+function encodePath(objectPath: string) {
+  return objectPath.split('/').map(encodeRfc3986).join('/');
+}
+
+// encodeURIComponent leaves !'()* alone, which both services expect escaped.
+function encodeRfc3986(value: string) {
+  return encodeURIComponent(value).replace(/[!'()*]/g, (char) => `%${char.charCodeAt(0).toString(16).toUpperCase()}`);
+}
+
+function hmac(key: string | Buffer, data: string) {
+  return crypto.createHmac('sha256', key).update(data).digest();
+}
+
+function sha256Hex(data: string) {
+  return crypto.createHash('sha256').update(data).digest('hex');
+}
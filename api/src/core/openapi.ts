@@ -0,0 +1,305 @@
+import Boom from '@hapi/boom';
+import fs from 'node:fs';
+import YAML from 'yaml';
+import type { Application, NextFunction, Request, Response } from 'express';
+import type { Language } from './types.js';
+
+// The part of JSON Schema the request bodies of the spec are written in. Other keywords, such as
+// bounds, lengths and patterns, document what the handlers check against the deployment's
+// configuration and are left to them.
+export interface SchemaObject {
+  $ref?: string;
+  allOf?: SchemaObject[];
+  type?: 'object' | 'array' | 'string' | 'integer' | 'number' | 'boolean';
+  nullable?: boolean;
+  enum?: unknown[];
+  properties?: Record<string, SchemaObject>;
+  required?: string[];
+  additionalProperties?: boolean | SchemaObject;
+  items?: SchemaObject;
+  [keyword: string]: unknown;
+}
+
+export interface OperationObject {
+  operationId?: string;
+  requestBody?: { content?: Record<string, { schema?: SchemaObject }> };
+  [field: string]: unknown;
+}
+
+export interface OpenApiDocument {
+  openapi: string;
+  info: Record<string, unknown>;
+  servers?: Array<{ url: string }>;
+  // Operations by path template and method; a path may also carry shared `parameters`.
+  paths: Record<string, Record<string, unknown>>;
+  components?: { schemas?: Record<string, SchemaObject>; [section: string]: unknown };
+  [field: string]: unknown;
+}
+
+// A route as Express has it, e.g. `post` `/v1/executions/:id/restore`.
+export interface RouteDefinition {
+  method: string;
+  path: string;
+}
+
+export type UnknownFieldAction = 'reject' | 'ignore';
+
+export type RequestErrorReason = 'type' | 'enum' | 'required' | 'unknown_field';
+
+// One problem with a request body: `path` is the field's, e.g. `limits.timeout_ms` or
+// `cases[2].expected_stdout`, or null for the body as a whole.
+export interface RequestError {
+  path: string | null;
+  reason: RequestErrorReason;
+  message: string;
+}
+
+export interface ApiSchemaOptions {
+  // The document's one server, where clients reach this one.
+  serverUrl: string;
+  // Languages with a runner, which become the enum of `language`.
+  languages: Language[];
+  // Whether fields the spec doesn't know fail a request; `reject` when unset.
+  unknownFields?: UnknownFieldAction;
+}
+
+const METHODS = ['get', 'put', 'post', 'delete', 'patch'];
+// Enough for a client to fix its request without a batch of broken submissions filling the response.
+const MAX_ERRORS = 50;
+
+const TYPE_NAMES: Record<NonNullable<SchemaObject['type']>, string> = {
+  object: 'an object',
+  array: 'an array',
+  string: 'a string',
+  integer: 'an integer',
+  number: 'a number',
+  boolean: 'a boolean'
+};
+
+export function loadApiSpec(file: string): OpenApiDocument {
+  return YAML.parse(fs.readFileSync(file, 'utf8')) as OpenApiDocument;
+}
+
+// The routes registered on an app, in registration order.
+export function listRoutes(app: Pick<Application, '_router'>): RouteDefinition[] {
+  const routes: RouteDefinition[] = [];
+  for (const layer of app._router?.stack ?? []) {
+    const route = layer.route as { path: unknown; methods: Record<string, boolean> } | undefined;
+    if (!route || typeof route.path !== 'string') {
+      continue;
+    }
+    for (const method of Object.keys(route.methods)) {
+      if (METHODS.includes(method)) {
+        routes.push({ method, path: route.path });
+      }
+    }
+  }
+  return routes;
+}
+
+// `/v1/runs/:id` as the spec writes it, `/v1/runs/{id}`.
+export function pathTemplate(expressPath: string) {
+  return expressPath.replace(/:(\w+)/g, '{$1}');
+}
+
+interface PublishedOperation {
+  method: string;
+  template: string;
+  pattern: RegExp;
+  // The JSON request body's, or null for operations that take none.
+  body: SchemaObject | null;
+}
+
+// The OpenAPI document of the running server: the spec cut down to the routes it registered,
+// which depend on its role and configuration, with its own URL and languages filled in. Request
+// bodies are checked against the same document before they reach a handler, so what a generated
+// client was built from is what the server enforces: fields the spec doesn't name, values of the
+// wrong type and values outside an enum all fail with one 400 listing every problem.
+export class ApiSchema {
+  private published: OpenApiDocument | null = null;
+  private operations: PublishedOperation[] = [];
+  private readonly flattened = new WeakMap<SchemaObject, SchemaObject>();
+
+  constructor(private readonly spec: OpenApiDocument, private readonly options: ApiSchemaOptions) {}
+
+  // Builds the document from the registered routes; returns those the spec lacks, which are
+  // served but neither documented nor checked.
+  public publish(routes: RouteDefinition[]): RouteDefinition[] {
+    const paths: OpenApiDocument['paths'] = {};
+    const undocumented: RouteDefinition[] = [];
+    for (const route of routes) {
+      const template = pathTemplate(route.path);
+      const item = this.spec.paths[template];
+      if (!item?.[route.method]) {
+        undocumented.push(route);
+        continue;
+      }
+      paths[template] ??= Object.fromEntries(Object.entries(item).filter(([key]) => !METHODS.includes(key)));
+      paths[template][route.method] = item[route.method];
+    }
+    const document: OpenApiDocument = structuredClone({ ...this.spec, servers: [{ url: this.options.serverUrl }], paths });
+    const language = document.components?.schemas?.['CreateRun']?.properties?.['language'];
+    if (language?.enum) {
+      language.enum = [...this.options.languages];
+    }
+    this.published = document;
+    this.operations = Object.entries(document.paths)
+      .flatMap(([template, item]) => METHODS.filter((method) => item[method]).map((method) => ({
+        method,
+        template,
+        pattern: templatePattern(template),
+        body: (item[method] as OperationObject).requestBody?.content?.['application/json']?.schema ?? null
+      })))
+      // Literal segments win over parameters, e.g. /admin/images/gc over /admin/images/{language}.
+      .sort((a, b) => parameterCount(a.template) - parameterCount(b.template));
+    return undocumented;
+  }
+
+  public document(): OpenApiDocument {
+    if (!this.published) {
+      throw new Error('the API document is published once the routes are registered');
+    }
+    return this.published;
+  }
+
+  // Problems with a JSON body sent to a route; none for routes the document doesn't describe.
+  public check(method: string, path: string, body: unknown): RequestError[] {
+    const lowered = method.toLowerCase();
+    const operation = this.operations.find((candidate) => candidate.method === lowered && candidate.pattern.test(path));
+    const errors: RequestError[] = [];
+    if (operation?.body) {
+      this.checkValue(operation.body, body, null, errors);
+    }
+    return errors;
+  }
+
+  public middleware() {
+    return (req: Request, _res: Response, next: NextFunction) => {
+      if (!req.is('application/json')) {
+        return next();
+      }
+      const errors = this.check(req.method, req.path, req.body);
+      if (errors.length > 0) {
+        return next(Boom.badRequest(errors.map((error) => error.message).join('; '), { code: 'invalid_request', errors }));
+      }
+      return next();
+    };
+  }
+
+  private checkValue(schema: SchemaObject, value: unknown, at: string | null, errors: RequestError[]) {
+    if (errors.length >= MAX_ERRORS) {
+      return;
+    }
+    const { type, nullable, enum: values, properties, required, additionalProperties, items } = this.flatten(schema);
+    if (value === null && nullable) {
+      return;
+    }
+    if (type && !hasType(value, type)) {
+      errors.push({ path: at, reason: 'type', message: `${describe(at)} must be ${TYPE_NAMES[type]}` });
+      return;
+    }
+    if (values && !values.includes(value)) {
+      errors.push({ path: at, reason: 'enum', message: `${describe(at)} must be one of ${values.join(', ')}` });
+      return;
+    }
+    if (Array.isArray(value)) {
+      if (items) {
+        value.forEach((item, index) => this.checkValue(items, item, `${at ?? ''}[${index}]`, errors));
+      }
+      return;
+    }
+    if (typeof value !== 'object' || value === null) {
+      return;
+    }
+    const fields = value as Record<string, unknown>;
+    for (const name of required ?? []) {
+      if (fields[name] === undefined && errors.length < MAX_ERRORS) {
+        errors.push({ path: field(at, name), reason: 'required', message: `${field(at, name)} is required` });
+      }
+    }
+    for (const [name, fieldValue] of Object.entries(fields)) {
+      const property = properties?.[name];
+      if (property) {
+        this.checkValue(property, fieldValue, field(at, name), errors);
+      } else if (typeof additionalProperties === 'object') {
+        this.checkValue(additionalProperties, fieldValue, field(at, name), errors);
+      } else if (properties && additionalProperties !== true && this.options.unknownFields !== 'ignore' && errors.length < MAX_ERRORS) {
+        // Objects the spec lists the fields of are closed unless it says otherwise.
+        errors.push({ path: field(at, name), reason: 'unknown_field', message: `${field(at, name)} is not a known field` });
+      }
+    }
+  }
+
+  // Resolves references and merges allOf into one schema, so that each branch's fields count as
+  // known to the others.
+  private flatten(schema: SchemaObject): SchemaObject {
+    const cached = this.flattened.get(schema);
+    if (cached) {
+      return cached;
+    }
+    let flat: SchemaObject;
+    if (schema.$ref) {
+      flat = this.flatten(this.resolve(schema.$ref));
+    } else {
+      const { allOf, ...own } = schema;
+      flat = { ...own };
+      for (const branch of (allOf ?? []).map((part) => this.flatten(part))) {
+        flat = {
+          ...branch,
+          ...flat,
+          properties: branch.properties || flat.properties ? { ...branch.properties, ...flat.properties } : undefined,
+          required: [...(branch.required ?? []), ...(flat.required ?? [])],
+          additionalProperties: flat.additionalProperties ?? branch.additionalProperties
+        };
+      }
+    }
+    this.flattened.set(schema, flat);
+    return flat;
+  }
+
+  private resolve(ref: string): SchemaObject {
+    const name = ref.match(/^#\/components\/schemas\/(.+)$/)?.[1];
+    const schema = name ? this.document().components?.schemas?.[name] : undefined;
+    if (!schema) {
+      throw new Error(`unresolvable schema reference ${ref}`);
+    }
+    return schema;
+  }
+}
+
+// Matches request paths against a template, each parameter standing for one segment.
+function templatePattern(template: string) {
+  const literals = template.split(/\{[^}]+\}/).map((part) => part.replace(/[.*+?^$()|[\]\\]/g, '\\$&'));
+  return new RegExp(`^${literals.join('[^/]+')}$`);
+}
+
+function parameterCount(template: string) {
+  return template.split('{').length - 1;
+}
+
+function hasType(value: unknown, type: NonNullable<SchemaObject['type']>) {
+  switch (type) {
+    case 'object':
+      return typeof value === 'object' && value !== null && !Array.isArray(value);
+    case 'array':
+      return Array.isArray(value);
+    case 'integer':
+      return Number.isInteger(value);
+    case 'number':
+      return typeof value === 'number' && Number.isFinite(value);
+    default:
+      return typeof value === type;
+  }
+}
+
+function field(parent: string | null, name: string) {
+  const key = /^[A-Za-z_][A-Za-z0-9_]*$/.test(name) ? name : JSON.stringify(name);
+  if (parent === null) {
+    return key;
+  }
+  return key === name ? `${parent}.${name}` : `${parent}[${key}]`;
+}
+
+function describe(at: string | null) {
+  return at ?? 'request body';
+}
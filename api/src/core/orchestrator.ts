@@ -2,17 +2,235 @@ import fs from 'node:fs';
 import path from 'node:path';
 import crypto from 'node:crypto';
 import Boom from '@hapi/boom';
-import { mergeLimits } from './limits.js';
-import type { RunRequest, RunRecord } from './types.js';
+import { mergeLimits, withKeyMaxima } from './limits.js';
+import type { LimitPolicy } from './limits.js';
+import type { IsolationLevel, LanguageDetection, PolicyViolation, RunArtifact, RunLimits, RunRequest, RunRecord } from './types.js';
 import { ArtifactStorage } from './storage.js';
-import { Logger } from '../util/logger.js';
-import type { SandboxRunner } from './types.js';
+import { Logger, currentLogContext, setLogPhase, withLogContext } from '../util/logger.js';
+import { DEFAULT_ISOLATION_LEVELS, RunnerRegistry, runnerRegistry } from './runners.js';
+import type { RunnerDefinition } from './runners.js';
+import type { FaultKind, MemoryWarning, OutputListener, SandboxResult, SandboxRunner, UsageSample } from './types.js';
+import { PRIORITY_CLASSES } from './queue.js';
+import type { JobQueue, TenantSlot } from './queue.js';
+import { canceledResult } from './run_dir.js';
+import { selectArtifacts } from './artifacts.js';
+import type { ArtifactSelection } from './artifacts.js';
+import { EnvPolicy } from './env_policy.js';
+import { SubmissionPolicy } from './submission_policy.js';
+import { detectLanguage } from './detect.js';
+import { SCHEMA_VERSION, checkRequestVersion } from './schema.js';
+import { AuditTrail } from './audit.js';
+import { validateAllowlist } from './egress_proxy.js';
+import { resolveMounts, validateMounts } from './mounts.js';
+import { validateGpu } from './gpu.js';
+import { reproducibleEnvironment, validateReproducible } from './reproducible.js';
+import { classifyTermination } from './termination.js';
+import { DEFAULT_COST_WEIGHTS, NO_COST, runCost } from './cost.js';
+import type { CostWeights } from './cost.js';
+import { expandTemplate, remapCoverage, remapDiagnostics, remapOutput, validateTemplate } from './template.js';
+import { fingerprint } from './fingerprint.js';
+import type { ResolvedMount } from './mounts.js';
+import type { ExecutionMetrics } from '../metrics/executions.js';
+import type { Span, SpanContext, Tracer } from '../tracing/tracer.js';
+import { METADATA_KEY_PATTERN } from '../store/store.js';
+import type { ExecutionStore, SubmissionRecord } from '../store/store.js';
+import { IDEMPOTENCY_TTL_MS, requestDigest } from './idempotency.js';
+import type { ResultCache } from './result_cache.js';
+import type { DatasetStore } from './datasets.js';
+import type { HookContext, HookRunner } from './hooks.js';
+import type { PolicyScanner } from './policy_scanner.js';
+import type { ResultSigner } from './result_signing.js';
 
 export interface OrchestratorOptions {
   workRoot: string;
   artifactStorage: ArtifactStorage;
   sandboxRunner: SandboxRunner;
   logger: Logger;
+  registry?: RunnerRegistry;
+  // Isolation applied when a request does not ask for one.
+  defaultIsolation?: IsolationLevel;
+  // Defaults and maxima for request limits; the built-in ones when unset.
+  limits?: LimitPolicy;
+  // Bounds how many runs execute at once; runs start immediately when unset.
+  queue?: JobQueue;
+  // Which environment variables requests may set; the default policy when unset.
+  envPolicy?: EnvPolicy;
+  submissionPolicy?: SubmissionPolicy;
+  // Refuses or flags submissions that break the deployment's rules, such as banned imports;
+  // nothing is scanned when unset.
+  policyScanner?: PolicyScanner;
+  // Directories whose contents requests may mount read-only by host_path; host_path mounts are
+  // rejected when unset.
+  mountRoots?: string[];
+  // Named datasets requests may mount by ID; mounts of them are rejected when unset.
+  datasets?: DatasetStore;
+  metrics?: ExecutionMetrics;
+  // Records a trace per run with spans for queueing, sandbox setup, compile, run and artifacts.
+  tracer?: Tracer;
+  // Persists every submission and its outcome so results can be fetched by ID later; runs are
+  // only kept in memory by their callers when unset.
+  store?: ExecutionStore;
+  // Per-key quotas, maxima and tenant concurrency; every key gets the deployment's limits when unset.
+  keyPolicy?: KeyPolicy;
+  // Answers `deterministic` resubmissions from an earlier run; they run like any other when unset.
+  resultCache?: ResultCache;
+  // The deployment's hooks, called before compiling, before running and after completion of every
+  // run that reaches the sandbox; cached answers skip them.
+  hooks?: HookRunner;
+  // Signs every finished record; records go out unsigned when unset.
+  resultSigner?: ResultSigner;
+  // Percentages of memory_mb at which runs get a memory_pressure event and their watchers a
+  // warning; none are sent when unset.
+  memoryWarnings?: number[];
+  // Most usage samples a run's record keeps; longer runs keep every other one each time they
+  // reach it. The sandbox backend's default when unset.
+  maxUsageSamples?: number;
+  // Saves a fingerprint of every submission's sources with it in the store, for finding similar
+  // submissions; none are kept when unset.
+  fingerprints?: boolean;
+  // Rates a run's cost is counted in compute units by; DEFAULT_COST_WEIGHTS when unset.
+  costWeights?: CostWeights;
+}
+
+// Rules applied to every run by its API key, including each submission of a batch or judge
+// request.
+export interface KeyPolicy {
+  // Throws when the key may not start another run, e.g. because its quota is used up.
+  admitRun(apiKey: string): void;
+  // The key's own maxima, replacing limits.max.
+  maxLimits(apiKey: string): Partial<RunLimits> | undefined;
+  // The tenant whose concurrency cap the run counts against in the queue; uncapped when unset.
+  tenantOf(apiKey: string): TenantSlot | undefined;
+  // How the key's runs name their tenant in logs, never the key itself.
+  tenantName?(apiKey: string): string;
+}
+
+export interface CreateRunOptions {
+  onOutput?: OutputListener;
+  // Live stdin for interactive sessions; replaces `request.stdin` when set.
+  input?: NodeJS.ReadableStream;
+  // The live stdin comes from another program rather than a person, as for a judge's interactor,
+  // so the run keeps the limits of a run instead of a session's longer wall-clock budget.
+  piped?: boolean;
+  // Starts without waiting for a queue slot, for a run that works alongside one already holding
+  // a slot, such as an interactor and its submission.
+  unqueued?: boolean;
+  // Called when the run leaves the queue, just before its sandbox starts; not for runs canceled
+  // while queued.
+  onStart?: () => void;
+  // Files written into the run's inputs/ directory by the API itself, keyed by their path under
+  // it; the judge uses them to hand a checker the case data and a pipeline to hand a stage the
+  // artifacts of earlier ones.
+  inputs?: Record<string, string | Buffer>;
+  // Trace context of the request that submitted the run, e.g. parsed from its traceparent header.
+  traceParent?: SpanContext | null;
+  // Faults the request asked to have injected, from its X-Fault-Injection header.
+  faults?: FaultKind[];
+  // Retries with the same key and request get the run this key started instead of a new one.
+  idempotencyKey?: string;
+  // Keeps the run on this server through a drain even while it is queued, for callers that need
+  // more than its stored request to follow it, such as a callback to deliver.
+  keepOnDrain?: boolean;
+  // Set by resumeRun for a submission a draining server handed back: the run keeps its ID,
+  // acceptance time and trail, and does not count against the key's quota again.
+  resumed?: { id: string; created_at: string; events: number };
+}
+
+export interface StartedRun {
+  id: string;
+  done: Promise<RunRecord>;
+  // Set when an earlier submission with the same Idempotency-Key started the run.
+  replayed?: boolean;
+}
+
+// The run an earlier submission with the same Idempotency-Key started; `done` is only known
+// while the run is in flight in this process.
+export interface IdempotentMatch {
+  id: string;
+  done?: Promise<RunRecord>;
+}
+
+// `compiling` only for compiled languages, from leaving the queue until the program starts.
+export type ActiveRunState = 'queued' | 'compiling' | 'running';
+
+// A run that has been accepted but has not produced its record yet.
+export interface ActiveRun {
+  id: string;
+  language: string;
+  apiKey: string;
+  created_at: string;
+  state: ActiveRunState;
+  controller: AbortController;
+  // Callers following the run through watchRun.
+  watchers: Set<RunWatcher>;
+  trail: AuditTrail;
+  // Whether the stored request is all the run needs; interactive and judge runs also depend on
+  // what their caller hands in, so a draining server cannot requeue them, nor runs kept with
+  // keepOnDrain.
+  resumable: boolean;
+  // Set when draining withdrew the run from the queue before it started.
+  requeued: boolean;
+  // What the policy scanner flagged in the submission without refusing it.
+  policyViolations: PolicyViolation[];
+  // Set once the run is registered, before startRun returns.
+  done?: Promise<RunRecord>;
+}
+
+// Follows a run someone else submitted: its state changes, the output it produces and the memory
+// thresholds it passes from then on.
+export interface RunWatcher {
+  onState?: (state: ActiveRunState) => void;
+  onOutput?: OutputListener;
+  onMemory?: (warning: MemoryWarning) => void;
+  // Samples of runs that set usage_interval_ms, as they are taken.
+  onUsage?: (sample: UsageSample) => void;
+}
+
+export interface WatchedRun {
+  // The state when watching began.
+  state: ActiveRunState;
+  done: Promise<RunRecord>;
+  stop(): void;
+}
+
+// Summary of a drain: queued runs handed back to the store and runs canceled at the deadline.
+export interface DrainOutcome {
+  requeued: number;
+  canceled: number;
+}
+
+// How long runs canceled at the drain deadline get to stop and store their records.
+const DRAIN_CANCEL_GRACE_MS = 10000;
+const DRAIN_POLL_MS = 50;
+
+const MAX_TAGS = 16;
+// Tags go into query strings, comma-separated lists among them, so they keep to URL-safe characters.
+const TAG_PATTERN = /^[A-Za-z0-9][A-Za-z0-9._:\/=-]{0,63}$/;
+const MAX_METADATA_KEYS = 32;
+const MAX_METADATA_VALUE_LENGTH = 512;
+const MIN_USAGE_INTERVAL_MS = 100;
+const MAX_USAGE_INTERVAL_MS = 60000;
+
+// Where the compile and run phases fall within a sandbox call that took totalMs: backends report
+// their durations, so whatever precedes them is setup and the run phase ends the call.
+function phaseLayout(startMs: number, totalMs: number, result: SandboxResult) {
+  const endMs = startMs + totalMs;
+  const compile = result.compile ?? null;
+  const compileMs = compile && !compile.cached ? compile.duration_ms : 0;
+  const runMs = Math.min(result.usage.wall_ms, totalMs);
+  const setupEnd = Math.max(startMs, endMs - runMs - compileMs);
+  const compileEnd = Math.min(endMs, setupEnd + compileMs);
+  return { endMs, setupEnd, compileEnd, runStart: Math.max(compileEnd, endMs - runMs) };
+}
+
+// What callers waiting on a run that draining handed back are told; the run's ID stays valid and
+// its result can be fetched once another server has run it.
+function requeuedError(id: string) {
+  return Boom.serverUnavailable('the server is shutting down; the execution will resume on another server', { code: 'requeued', id });
+}
+
+function isRequeued(err: Error) {
+  return Boom.isBoom(err) && (err.data as { code?: string } | null)?.code === 'requeued';
 }
 
 function generateId(length: number): string {
@@ -26,98 +244,925 @@ function generateId(length: number): string {
 }
 
 export class Orchestrator {
+  private readonly registry: RunnerRegistry;
+  private readonly envPolicy: EnvPolicy;
+  private readonly submissionPolicy: SubmissionPolicy;
+  private readonly active = new Map<string, ActiveRun>();
+  // In-flight runs started with an Idempotency-Key, by API key and key; finished ones are found
+  // through the store.
+  private readonly idempotent = new Map<string, { digest: string; started: StartedRun }>();
+  private draining = false;
+
   constructor(private readonly options: OrchestratorOptions) {
+    this.registry = options.registry ?? runnerRegistry;
+    this.envPolicy = options.envPolicy ?? new EnvPolicy();
+    this.submissionPolicy = options.submissionPolicy ?? new SubmissionPolicy();
     fs.mkdirSync(this.options.workRoot, { recursive: true });
     this.options.artifactStorage.ensureBaseDir();
   }
 
-  public async createRun(request: RunRequest, apiKey: string): Promise<RunRecord> {
-    this.validateRequest(request);
-    const limits = mergeLimits(request.limits);
-    const runId = `run_${generateId(12)}`;
+  public async createRun(request: RunRequest, apiKey: string, options: CreateRunOptions = {}): Promise<RunRecord> {
+    return this.startRun(request, apiKey, options).done;
+  }
+
+  // Validates the request and stages its inputs synchronously, so callers that respond before
+  // the run finishes still see request errors, then executes it in the background.
+  public startRun(original: RunRequest, apiKey: string, options: CreateRunOptions = {}): StartedRun {
+    if (this.draining) {
+      throw Boom.serverUnavailable('the server is shutting down', { code: 'draining' });
+    }
+    // Before detection, whose rules may be among what a newer version changed.
+    checkRequestVersion(original);
+    const { request, detection } = this.resolveLanguage(original);
+    const scope = options.idempotencyKey === undefined ? null : `${apiKey}\0${options.idempotencyKey}`;
+    const inFlight = scope ? this.idempotent.get(scope) : undefined;
+    if (inFlight) {
+      // A concurrent retry that got here before the first submission was stored.
+      this.checkSameRequest(inFlight.digest, request);
+      return { ...inFlight.started, replayed: true };
+    }
+    this.validateRequest(request, Boolean(options.input));
+    const policyViolations = this.options.policyScanner?.check(request, this.options.keyPolicy?.tenantName?.(apiKey)) ?? [];
+    const maxima = this.options.keyPolicy?.maxLimits(apiKey);
+    const limits = mergeLimits(request.limits, {
+      interactive: Boolean(options.input) && !options.piped,
+      maxProcesses: this.registry.require(request.language).pidsLimit,
+      maxOpenFiles: this.registry.require(request.language).openFilesLimit,
+      policy: maxima ? withKeyMaxima(this.options.limits, maxima) : this.options.limits,
+      language: request.language
+    });
+    const runId = options.resumed?.id ?? `run_${generateId(12)}`;
     const workdir = path.join(this.options.workRoot, runId);
     fs.mkdirSync(path.join(workdir, 'inputs'), { recursive: true });
     fs.mkdirSync(path.join(workdir, 'outputs'), { recursive: true });
-
-    const stagedFiles = this.stageInputFiles(request.files ?? [], workdir);
-
-    const codeSha256 = crypto.createHash('sha256').update(request.code).digest('hex');
-    const env = this.buildEnvironment(request.env);
-
-    const result = await this.options.sandboxRunner.run({
+    let stagedFiles: Array<{ sourcePath: string; destPath: string }>;
+    let mounts: ResolvedMount[];
+    // Mounted datasets are kept until the run is over, even if they are deleted meanwhile.
+    let releaseDatasets: () => void = () => undefined;
+    try {
+      stagedFiles = this.stageInputFiles(request.files ?? [], workdir);
+      mounts = resolveMounts(request.mounts ?? [], this.options.mountRoots ?? [], this.options.artifactStorage, this.options.datasets);
+      const datasetIds = (request.mounts ?? []).flatMap((mount) => (mount.dataset_id?.startsWith('ds_') ? [mount.dataset_id] : []));
+      releaseDatasets = this.options.datasets?.hold(datasetIds) ?? releaseDatasets;
+      for (const [name, contents] of Object.entries(options.inputs ?? {})) {
+        if (path.posix.normalize(name) !== name || path.posix.isAbsolute(name) || name.startsWith('../') || name === '..') {
+          throw Boom.badRequest(`invalid input name: ${name}`);
+        }
+        fs.mkdirSync(path.dirname(path.join(workdir, 'inputs', name)), { recursive: true });
+        fs.writeFileSync(path.join(workdir, 'inputs', name), contents);
+      }
+      // Last, so requests rejected for anything else do not count against the quota; resumed runs
+      // were counted when first accepted.
+      if (!options.resumed) {
+        this.options.keyPolicy?.admitRun(apiKey);
+      }
+    } catch (err) {
+      releaseDatasets();
+      fs.rm(workdir, { recursive: true, force: true }, () => undefined);
+      throw err;
+    }
+    const cacheKey = this.resultCacheKey(request, limits, options);
+    const cached = cacheKey ? this.options.resultCache?.get(cacheKey) ?? null : null;
+    // Every line logged for the run carries it, wherever the queue picks the run up from; the
+    // submitting request's ID and debug logging carry over.
+    const { requestId, debug } = currentLogContext();
+    const logContext = {
+      requestId,
+      debug,
+      runId,
+      language: request.language,
+      tenant: this.options.keyPolicy?.tenantName?.(apiKey),
+      phase: 'queued'
+    };
+    const active: ActiveRun = {
       id: runId,
       language: request.language,
-      code: request.code,
-      args: request.args ?? [],
-      env,
-      workdir,
-      limits,
-      stagedFiles
+      apiKey,
+      created_at: options.resumed?.created_at ?? new Date().toISOString(),
+      state: 'queued',
+      controller: new AbortController(),
+      trail: new AuditTrail(runId, this.options.store, this.options.logger, options.resumed?.events),
+      resumable: !options.input && !options.inputs && !options.keepOnDrain,
+      requeued: false,
+      policyViolations,
+      watchers: new Set()
+    };
+    if (options.resumed) {
+      active.trail.record('resumed');
+    } else {
+      active.trail.record('submitted', { language: request.language, mode: request.mode ?? 'run', detected: detection !== null });
+    }
+    const span = this.options.tracer?.startSpan('execution', {
+      parent: options.traceParent,
+      kind: 'server',
+      attributes: { 'run.id': runId, 'run.language': request.language, 'run.mode': request.mode ?? 'run' }
     });
-
-    const artifacts = [];
-    let totalArtifactBytes = 0;
-    for (const artifact of result.artifacts) {
-      if (!artifact.path.startsWith(workdir)) {
-        this.options.logger.warn('discarding artifact outside workdir', { artifact: artifact.path, runId });
-        continue;
+    // A cached result skips the queue as well as the sandbox.
+    const replay = (hit: RunRecord): Promise<RunRecord> => {
+      const from = hit.cached_from ?? hit.id;
+      this.setState(active, 'running');
+      active.trail.record('cache_hit', { cached_from: from });
+      fs.rm(workdir, { recursive: true, force: true }, () => undefined);
+      this.options.logger.info('run answered from result cache', { runId, cachedFrom: from, apiKey });
+      span?.setAttribute('run.cached', true);
+      return Promise.resolve({
+        ...hit,
+        id: runId,
+        created_at: active.created_at,
+        queue_wait_ms: 0,
+        detected_language: detection,
+        cached_from: from,
+        retries: [],
+        metadata: request.metadata ?? {},
+        policy_violations: active.policyViolations,
+        cost: NO_COST
+      });
+    };
+    const execute = (waitMs: number) => withLogContext(logContext, () => {
+      if (active.requeued) {
+        return Promise.reject(requeuedError(runId));
       }
-      const relative = path.relative(path.join(workdir, 'outputs'), artifact.path);
-      if (relative.startsWith('..')) {
-        continue;
+      this.setState(active, this.registry.require(request.language).compiled ? 'compiling' : 'running');
+      if (this.options.queue && !options.unqueued) {
+        active.trail.record('dequeued', { queue_wait_ms: waitMs });
       }
-      if (artifacts.length >= limits.max_artifact_files) {
-        break;
+      if (!active.controller.signal.aborted) {
+        options.onStart?.();
+      }
+      this.options.logger.debug('run started', { queueWaitMs: waitMs, isolation: request.isolation ?? this.defaultIsolation(request.language) });
+      this.options.tracer?.startSpan('queue', { parent: span?.context, startMs: Date.now() - waitMs }).end();
+      return this.executeRun(active, request, detection, limits, workdir, stagedFiles, mounts, options, waitMs, span);
+    });
+    if (this.options.queue && !cached && !options.unqueued) {
+      const stats = this.options.queue.stats();
+      active.trail.record('queued', { ahead: stats.depth, running: stats.running, priority: request.priority ?? 'normal' });
+    }
+    withLogContext(logContext, () => this.options.logger.debug('run accepted', { mode: request.mode ?? 'run', limits: JSON.stringify(limits) }));
+    let queued: Promise<RunRecord>;
+    try {
+      queued = cached
+        ? withLogContext(logContext, () => replay(cached))
+        : this.options.queue && !options.unqueued
+          ? this.options.queue.enqueue(execute, active.controller.signal, this.options.keyPolicy?.tenantOf(apiKey), request.priority).done
+          : execute(0);
+    } catch (err) {
+      // The queue turned the run away; its trail ends here.
+      active.trail.record('failed', { error: (err as Error).message });
+      releaseDatasets();
+      fs.rm(workdir, { recursive: true, force: true }, () => undefined);
+      span?.setError((err as Error).message);
+      span?.end();
+      throw err;
+    }
+    this.active.set(runId, active);
+    const store = this.options.store;
+    const submitted = store
+      ? this.persist(
+        runId,
+        store.saveSubmission({
+          id: runId,
+          api_key: apiKey,
+          language: request.language,
+          request,
+          created_at: active.created_at,
+          idempotency_key: options.idempotencyKey,
+          tenant: this.options.keyPolicy?.tenantName?.(apiKey)
+        }).then(() => (this.options.fingerprints ? store.saveFingerprint(runId, fingerprint(request)) : undefined))
+      )
+      : Promise.resolve();
+    // The run stays active until its outcome is stored, so lookups never fall between the two.
+    const done = queued
+      .then(async (run) => {
+        // Signed last, over the record as stored; a cached answer is a record of its own.
+        run.signature = this.options.resultSigner?.sign(run) ?? null;
+        span?.setAttribute('run.status', run.status);
+        active.trail.record('completed', { status: run.status, exit_code: run.exit_code });
+        if (cacheKey && !cached) {
+          this.options.resultCache?.set(cacheKey, run);
+        }
+        if (store) {
+          await submitted;
+          await active.trail.flush();
+          await this.persist(runId, store.save(run));
+        }
+        return run;
+      })
+      .catch(async (err: Error) => {
+        if (isRequeued(err)) {
+          // The submission stays stored, unfinished, for the next server to resume.
+          active.trail.record('requeued');
+          if (store) {
+            await submitted;
+            await active.trail.flush();
+            await this.persist(runId, store.requeueSubmission(runId));
+          }
+          throw err;
+        }
+        span?.setError(err.message);
+        active.trail.record('failed', { error: Boom.isBoom(err) ? err.message : 'internal_error' });
+        if (store) {
+          await submitted;
+          await active.trail.flush();
+          await this.persist(runId, store.saveError(runId, Boom.isBoom(err) ? err.message : 'internal_error'));
+        }
+        throw err;
+      })
+      .finally(() => {
+        span?.end();
+        releaseDatasets();
+        this.active.delete(runId);
+        if (scope) {
+          this.idempotent.delete(scope);
+        }
+      });
+    active.done = done;
+    if (scope) {
+      this.idempotent.set(scope, { digest: requestDigest(request), started: { id: runId, done } });
+    }
+    return { id: runId, done };
+  }
+
+  // Refuses a request startRun would refuse for what it asks for, without staging or running it;
+  // for submissions kept to run later. Quotas and limits are applied once it runs.
+  public checkRequest(original: RunRequest) {
+    checkRequestVersion(original);
+    this.validateRequest(this.resolveLanguage(original).request, false);
+  }
+
+  // Looks up the run an earlier submission with this Idempotency-Key started within
+  // IDEMPOTENCY_TTL_MS. A key reused with a different request is refused rather than replayed.
+  public async findIdempotent(apiKey: string, idempotencyKey: string, original: RunRequest): Promise<IdempotentMatch | null> {
+    // Stored submissions carry the detected language, so compare against the same form.
+    const { request } = this.resolveLanguage(original);
+    const inFlight = this.idempotent.get(`${apiKey}\0${idempotencyKey}`);
+    if (inFlight) {
+      this.checkSameRequest(inFlight.digest, request);
+      return inFlight.started;
+    }
+    const since = new Date(Date.now() - IDEMPOTENCY_TTL_MS).toISOString();
+    const stored = await this.options.store?.findSubmission(apiKey, idempotencyKey, since);
+    if (!stored) {
+      return null;
+    }
+    this.checkSameRequest(requestDigest(stored.request), request);
+    return { id: stored.id };
+  }
+
+  // The record a matched run produced, for callers that answer with the finished run.
+  public async replayRun(match: IdempotentMatch): Promise<RunRecord> {
+    if (match.done) {
+      return match.done;
+    }
+    const run = await this.options.store?.get(match.id);
+    if (run) {
+      return run;
+    }
+    const error = await this.options.store?.getError(match.id);
+    if (error) {
+      throw Boom.conflict(`the original submission failed: ${error}`, { id: match.id });
+    }
+    throw Boom.conflict('the original submission is still running', { id: match.id });
+  }
+
+  // Starts a submission a draining server handed back, as claimed from the store, under its
+  // original ID; its trail picks up where it left off.
+  public async resumeRun(submission: SubmissionRecord): Promise<StartedRun> {
+    const events = (await this.options.store?.listEvents(submission.id))?.length ?? 0;
+    return this.startRun(submission.request, submission.api_key, {
+      idempotencyKey: submission.idempotency_key ?? undefined,
+      resumed: { id: submission.id, created_at: submission.created_at, events }
+    });
+  }
+
+  public get isDraining() {
+    return this.draining;
+  }
+
+  // Stops accepting runs and waits up to timeoutMs for those in flight. Queued runs that need
+  // nothing but their stored request are handed back to the store instead of started, for the
+  // next server to resume; runs still going at the deadline are canceled, which tears down their
+  // sandboxes and stores them as canceled.
+  public async drain(timeoutMs: number): Promise<DrainOutcome> {
+    this.draining = true;
+    const requeue = this.options.store
+      ? [...this.active.values()].filter((active) => active.state === 'queued' && active.resumable)
+      : [];
+    for (const active of requeue) {
+      active.requeued = true;
+      // Queued jobs whose signal aborts are dispatched at once and settle as requeued.
+      active.controller.abort();
+    }
+    await this.untilIdle(Date.now() + timeoutMs);
+    const remaining = [...this.active.keys()];
+    for (const id of remaining) {
+      this.cancelRun(id);
+    }
+    await this.untilIdle(Date.now() + DRAIN_CANCEL_GRACE_MS);
+    return { requeued: requeue.length, canceled: remaining.length };
+  }
+
+  public getActiveRun(id: string) {
+    return this.active.get(id) ?? null;
+  }
+
+  // Null once the run has left this server, finished or not.
+  public watchRun(id: string, watcher: RunWatcher): WatchedRun | null {
+    const active = this.active.get(id);
+    if (!active?.done) {
+      return null;
+    }
+    active.watchers.add(watcher);
+    return { state: active.state, done: active.done, stop: () => active.watchers.delete(watcher) };
+  }
+
+  private setState(active: ActiveRun, state: ActiveRunState) {
+    if (active.state === state) {
+      return;
+    }
+    active.state = state;
+    setLogPhase(state, active.id);
+    for (const watcher of active.watchers) {
+      watcher.onState?.(state);
+    }
+  }
+
+  // Requests cancellation of an in-flight run; its record is reported with status `canceled`.
+  public cancelRun(id: string) {
+    const active = this.active.get(id);
+    if (!active) {
+      return false;
+    }
+    this.options.logger.info('canceling run', { runId: id });
+    active.trail.record('cancel_requested', { state: active.state });
+    active.controller.abort();
+    return true;
+  }
+
+  private async executeRun(
+    active: ActiveRun,
+    request: RunRequest,
+    detection: LanguageDetection | null,
+    limits: RunLimits,
+    workdir: string,
+    stagedFiles: Array<{ sourcePath: string; destPath: string }>,
+    mounts: ResolvedMount[],
+    options: CreateRunOptions,
+    queueWaitMs: number,
+    span: Span | undefined
+  ): Promise<RunRecord> {
+    const runId = active.id;
+    const apiKey = active.apiKey;
+    const sources = request.sources ?? {};
+    const codeSha256 = this.hashSubmission(request.code ?? '', sources);
+    const env = this.buildEnvironment(request);
+    const isolation = request.isolation ?? this.defaultIsolation(request.language);
+    const mode = request.mode ?? 'run';
+    const network = request.network ?? { mode: 'none' };
+    const runner = this.registry.require(request.language);
+    const templated = request.template ? expandTemplate(request.template, request.code ?? '', runner.entryFile) : null;
+
+    let result: SandboxResult;
+    // Runs canceled while queued never reach the sandbox.
+    const canceledWhileQueued = active.controller.signal.aborted;
+    const hooks = this.options.hooks;
+    const hookContext: HookContext = {
+      run_id: runId,
+      language: request.language,
+      tenant: this.options.keyPolicy?.tenantName?.(apiKey) ?? null,
+      request
+    };
+    if (hooks && !canceledWhileQueued) {
+      try {
+        await hooks.beforeCompile(hookContext);
+      } catch (err) {
+        fs.rm(workdir, { recursive: true, force: true }, () => undefined);
+        throw err;
       }
-      if (totalArtifactBytes + artifact.size > limits.max_artifact_bytes) {
-        break;
+      // Without a compile phase the program starts with the sandbox.
+      if (!runner.compiled) {
+        hooks.beforeRun(hookContext);
       }
-      const stored = this.options.artifactStorage.moveArtifact(artifact.path, artifact.name, artifact.contentType);
-      artifacts.push(stored);
-      totalArtifactBytes += artifact.size;
     }
+    const sandboxStarted = Date.now();
+    if (!canceledWhileQueued) {
+      active.trail.record('sandbox_created', { isolation });
+    }
+    try {
+      result = canceledWhileQueued
+        ? canceledResult()
+        : await this.options.sandboxRunner.run({
+          id: runId,
+          language: request.language,
+          mode,
+          code: templated?.source ?? request.code ?? '',
+          sources,
+          stdin: request.stdin ?? '',
+          build: request.build ?? {},
+          lint: request.lint,
+          sql: request.sql,
+          profile: request.profile,
+          coverage: request.coverage,
+          isolation,
+          network,
+          gpu: request.gpu ? { count: request.gpu.count ?? 1, vram_mb: request.gpu.vram_mb } : undefined,
+          version: request.version,
+          args: request.args ?? [],
+          env,
+          workdir,
+          limits,
+          stagedFiles,
+          mounts,
+          onOutput: (stream, chunk) => {
+            options.onOutput?.(stream, chunk);
+            for (const watcher of active.watchers) {
+              watcher.onOutput?.(stream, chunk);
+            }
+          },
+          onRunStart: () => {
+            this.setState(active, 'running');
+            hooks?.beforeRun(hookContext);
+          },
+          memoryWarnings: this.options.memoryWarnings,
+          onMemoryPressure: (warning) => {
+            active.trail.record('memory_pressure', { ...warning });
+            for (const watcher of active.watchers) {
+              watcher.onMemory?.(warning);
+            }
+          },
+          usageIntervalMs: request.usage_interval_ms,
+          maxUsageSamples: this.options.maxUsageSamples,
+          onUsageSample: (sample) => {
+            for (const watcher of active.watchers) {
+              watcher.onUsage?.(sample);
+            }
+          },
+          onOutputLimit: request.on_output_limit,
+          signal: active.controller.signal,
+          input: options.input,
+          faults: options.faults
+        });
+    } catch (err) {
+      fs.rm(workdir, { recursive: true, force: true }, () => undefined);
+      throw err;
+    }
+    const sandboxMs = Date.now() - sandboxStarted;
+    const canceled = active.controller.signal.aborted;
+    if (!canceledWhileQueued) {
+      this.traceSandbox(span, sandboxStarted, sandboxMs, result, isolation);
+      this.auditSandbox(active.trail, sandboxStarted, sandboxMs, result, canceled);
+    }
+    this.options.logger.debug('sandbox finished', {
+      status: result.status,
+      exitCode: result.exitCode,
+      exitSignal: result.exitSignal ?? null,
+      sandboxMs,
+      usage: JSON.stringify(result.usage)
+    });
+    setLogPhase('artifacts');
+    const artifactsSpan = this.options.tracer?.startSpan('artifacts', { parent: span?.context });
+
+    // Whatever a canceled run left in outputs/ may be half written, so it is discarded.
+    const selection: ArtifactSelection = canceled ? { kept: [], skipped: [] } : selectArtifacts(result.artifacts, workdir, limits);
+    if (selection.skipped.length > 0) {
+      this.options.logger.warn('artifacts over limits skipped', { runId, skipped: selection.skipped.length });
+    }
+    const uploads = await Promise.allSettled(
+      selection.kept.map((artifact) =>
+        this.options.artifactStorage.storeArtifact(artifact.path, artifact.name, {
+          contentType: artifact.contentType,
+          inline: request.inline_artifacts
+        })
+      )
+    );
+    // An object store that refuses an upload costs the run that artifact, not its result.
+    const artifacts: RunArtifact[] = [];
+    uploads.forEach((upload, index) => {
+      const artifact = selection.kept[index];
+      if (upload.status === 'fulfilled') {
+        artifacts.push(upload.value);
+        return;
+      }
+      this.options.logger.warn('artifact upload failed', { runId, name: artifact.name, message: (upload.reason as Error).message });
+      selection.skipped.push({ name: artifact.name, size: artifact.size, reason: 'upload_failed' });
+    });
+
+    active.trail.record('artifacts_stored', { kept: artifacts.length, skipped: selection.skipped.length });
+    artifactsSpan?.setAttribute('artifacts.kept', artifacts.length);
+    artifactsSpan?.setAttribute('artifacts.skipped', selection.skipped.length);
+    artifactsSpan?.end();
+
+    // Reported against the expanded entry file; moved back onto the submitted code's lines. What
+    // the program writes to stdout is its output proper and stays as written.
+    const remap = (text: string) => (templated ? remapOutput(text, templated.map) : text);
+    const stdout = result.stdout.toString('utf8');
+    const stderr = remap(result.stderr.toString('utf8'));
+    const compile = result.compile
+      ? { ...result.compile, stdout: remap(result.compile.stdout), stderr: remap(result.compile.stderr) }
+      : null;
+    const droppedBytes = result.droppedBytes ?? { stdout: 0, stderr: 0 };
+    const compileFailed = compile !== null && compile.exit_code !== 0;
+    const diagnostics = templated && result.diagnostics ? remapDiagnostics(result.diagnostics, templated.map) : result.diagnostics;
+    const coverage = templated && result.coverage ? remapCoverage(result.coverage, templated.map) : result.coverage;
+    const status = canceled ? 'canceled' : result.status;
+    const limitExceeded = canceled ? null : result.limitExceeded ?? null;
+    const tests = (result.tests ?? []).map((test) => (test.message === null ? test : { ...test, message: remap(test.message) }));
 
     const runRecord: RunRecord = {
+      schema_version: SCHEMA_VERSION,
       id: runId,
-      status: result.status,
+      status,
       exit_code: result.exitCode ?? 0,
-      stdout: result.stdout.toString('utf8'),
-      stderr: result.stderr.toString('utf8'),
+      // Killing a canceled run looks like a timeout or OOM to the backend; neither applies.
+      limit_exceeded: limitExceeded,
+      timeout: canceled ? null : result.timeout ?? null,
+      termination: classifyTermination(
+        { status, exitCode: result.exitCode ?? 0, limitExceeded, exitSignal: canceled ? null : result.exitSignal ?? null, compile },
+        limits
+      ),
+      stdout,
+      stderr,
+      truncated: droppedBytes.stdout > 0 || droppedBytes.stderr > 0,
+      dropped_bytes: droppedBytes,
+      phases: {
+        compile,
+        // Compile and check mode runs stop after the compile phase.
+        run: compileFailed || mode === 'compile' || mode === 'check'
+          ? null
+          : { exit_code: result.exitCode, stdout, stderr, duration_ms: result.usage.wall_ms }
+      },
       usage: result.usage,
       artifacts,
+      artifacts_skipped: selection.skipped,
+      tests: mode === 'test' ? tests : null,
+      coverage: mode === 'test' && request.coverage ? coverage ?? null : null,
+      diagnostics: request.lint || runner.diagnostics ? diagnostics ?? [] : null,
+      results: runner.queries ? result.results ?? [] : null,
       limits,
-      created_at: new Date().toISOString(),
+      created_at: active.created_at,
+      queue_wait_ms: queueWaitMs,
       language: request.language,
-      code_sha256: codeSha256
+      detected_language: detection,
+      mode,
+      isolation,
+      network,
+      version: request.version ?? null,
+      toolchain: result.toolchain ?? null,
+      code_sha256: codeSha256,
+      cached_from: null,
+      retries: result.retries ?? [],
+      metadata: request.metadata ?? {},
+      annotations: {},
+      policy_violations: active.policyViolations,
+      memory: result.memory ?? null,
+      usage_samples: result.usageSamples ?? null,
+      cost: runCost(result.usage, limits, canceledWhileQueued ? 0 : sandboxMs, this.options.costWeights ?? DEFAULT_COST_WEIGHTS),
+      signature: null
     };
+    if (hooks && hooks.size > 0) {
+      runRecord.annotations = await hooks.afterCompletion(hookContext, runRecord);
+    }
 
-    this.options.logger.info('run completed', { runId, status: runRecord.status, apiKey });
+    this.options.metrics?.recordRun(runRecord, canceledWhileQueued ? null : sandboxMs);
+    setLogPhase('finished');
+    this.options.logger.info('run completed', {
+      runId,
+      status: runRecord.status,
+      limitExceeded: runRecord.limit_exceeded,
+      isolation,
+      apiKey,
+      traceId: span?.context.traceId
+    });
     fs.rm(workdir, { recursive: true, force: true }, () => undefined);
+    active.trail.record('cleanup');
     return runRecord;
   }
 
-  private validateRequest(request: RunRequest) {
+  // Backends report compile and run durations rather than timestamps, so the phase spans are laid
+  // out inside the sandbox span from those durations: whatever time remains before them is setup
+  // (image resolution, dependency layers, container start) and the run phase ends the sandbox span.
+  private traceSandbox(parent: Span | undefined, startMs: number, totalMs: number, result: SandboxResult, isolation: string) {
+    const tracer = this.options.tracer;
+    if (!tracer || !parent) {
+      return;
+    }
+    const { endMs, setupEnd, compileEnd, runStart } = phaseLayout(startMs, totalMs, result);
+    const sandbox = tracer.startSpan('sandbox', { parent: parent.context, startMs, attributes: { 'sandbox.isolation': isolation } });
+    const compile = result.compile ?? null;
+    tracer.startSpan('sandbox.setup', { parent: sandbox.context, startMs }).end(setupEnd);
+    if (compile) {
+      const compileSpan = tracer.startSpan('compile', {
+        parent: sandbox.context,
+        startMs: setupEnd,
+        attributes: { 'compile.cached': Boolean(compile.cached) }
+      });
+      compileSpan.setAttribute('compile.exit_code', compile.exit_code);
+      if (compile.exit_code !== 0) {
+        compileSpan.setError('compilation failed');
+      }
+      compileSpan.end(compileEnd);
+    }
+    if (!compile || compile.exit_code === 0) {
+      const runSpan = tracer.startSpan('run', { parent: sandbox.context, startMs: runStart });
+      runSpan.setAttribute('run.exit_code', result.exitCode);
+      runSpan.setAttribute('run.limit_exceeded', result.limitExceeded);
+      runSpan.end(endMs);
+    }
+    sandbox.setAttribute('sandbox.status', result.status);
+    sandbox.end(endMs);
+  }
+
+  // The phases on the audit trail, timed the way traceSandbox lays out their spans.
+  private auditSandbox(trail: AuditTrail, startMs: number, totalMs: number, result: SandboxResult, canceled: boolean) {
+    const { endMs, setupEnd, compileEnd, runStart } = phaseLayout(startMs, totalMs, result);
+    const compile = result.compile ?? null;
+    if (compile) {
+      trail.record('compile_started', { cached: Boolean(compile.cached) }, new Date(setupEnd));
+      trail.record('compile_finished', { exit_code: compile.exit_code, duration_ms: compile.duration_ms }, new Date(compileEnd));
+    }
+    if (!compile || compile.exit_code === 0) {
+      trail.record('run_started', {}, new Date(runStart));
+      trail.record('run_finished', { exit_code: result.exitCode, status: canceled ? 'canceled' : result.status }, new Date(endMs));
+    }
+    if (result.limitExceeded && !canceled) {
+      trail.record('limit_exceeded', { limit: result.limitExceeded, ...(result.timeout ? { stage: result.timeout.stage } : {}) }, new Date(endMs));
+    }
+  }
+
+  // Only runs the caller marked deterministic, and only those whose outcome depends on nothing but
+  // the request: a live session, mounted host data or network access could all differ next time,
+  // and a run with injected faults is meant to fail rather than be answered from the cache.
+  private resultCacheKey(request: RunRequest, limits: RunLimits, options: CreateRunOptions): string | null {
+    const cache = this.options.resultCache;
+    if (!cache || request.deterministic !== true || options.input || options.faults?.length || (request.mounts ?? []).length > 0 || request.network?.mode === 'allowlist') {
+      return null;
+    }
+    return cache.key({
+      // Tags and metadata label the run without changing what it does.
+      request: { ...request, tags: undefined, metadata: undefined },
+      limits,
+      isolation: request.isolation ?? this.defaultIsolation(request.language),
+      files: (request.files ?? []).map((file) => ({ path: file.path, sha256: this.options.artifactStorage.getUploadedFile(file.id).sha256 })),
+      inputs: options.inputs
+    });
+  }
+
+  private checkSameRequest(digest: string, request: RunRequest) {
+    if (digest !== requestDigest(request)) {
+      throw Boom.badData('Idempotency-Key was already used for a different request');
+    }
+  }
+
+  // Requests without a language get the detected one; the detection goes into the run record.
+  private resolveLanguage(request: RunRequest): { request: RunRequest; detection: LanguageDetection | null } {
+    if (request.language) {
+      return { request, detection: null };
+    }
+    const detection = detectLanguage(request, this.registry);
+    return { request: { ...request, language: detection.language }, detection };
+  }
+
+  private validateRequest(request: RunRequest, interactive: boolean) {
     if (!request.language) {
       throw Boom.badRequest('language is required');
     }
-    if (!['python', 'node', 'ruby', 'php', 'go'].includes(request.language)) {
-      throw Boom.badRequest('unsupported language');
+    const runner = this.registry.require(request.language);
+    if (request.filename !== undefined && typeof request.filename !== 'string') {
+      throw Boom.badRequest('filename must be a string');
     }
-    if (!request.code) {
+    // Interactive sessions on runners with a REPL may start without code.
+    if (!request.code && Object.keys(request.sources ?? {}).length === 0 && !(interactive && runner.repl)) {
       throw Boom.badRequest('code is required');
     }
-    if (Buffer.byteLength(request.code, 'utf8') > 200 * 1024) {
-      throw Boom.badRequest('code exceeds 200 KiB');
+    this.submissionPolicy.validate(request);
+    const unsupportedFiles = runner.unsupportedFiles ?? {};
+    const unsupported = Object.keys(request.sources ?? {}).find((sourcePath) => Object.keys(unsupportedFiles).includes(sourcePath));
+    if (unsupported) {
+      throw Boom.badRequest(`${unsupported}: ${unsupportedFiles[unsupported]} for ${runner.language}`);
+    }
+    if (request.stdin !== undefined && typeof request.stdin !== 'string') {
+      throw Boom.badRequest('stdin must be a string');
+    }
+    if (Buffer.byteLength(request.stdin ?? '', 'utf8') > 512 * 1024) {
+      throw Boom.badRequest('stdin exceeds 512 KiB');
+    }
+    this.envPolicy.validate(request.env);
+    if (request.inline_artifacts !== undefined && typeof request.inline_artifacts !== 'boolean') {
+      throw Boom.badRequest('inline_artifacts must be a boolean');
+    }
+    if (request.on_output_limit !== undefined && !['truncate', 'kill'].includes(request.on_output_limit)) {
+      throw Boom.badRequest('on_output_limit must be truncate or kill');
+    }
+    if (request.deterministic !== undefined && typeof request.deterministic !== 'boolean') {
+      throw Boom.badRequest('deterministic must be a boolean');
+    }
+    if (request.priority !== undefined && !PRIORITY_CLASSES.includes(request.priority)) {
+      throw Boom.badRequest('priority must be interactive, normal or batch');
+    }
+    const tags = request.tags;
+    if (tags !== undefined) {
+      if (!Array.isArray(tags) || tags.length > MAX_TAGS) {
+        throw Boom.badRequest(`tags must be an array of at most ${MAX_TAGS} tags`);
+      }
+      const invalid = tags.find((tag) => typeof tag !== 'string' || !TAG_PATTERN.test(tag));
+      if (invalid !== undefined) {
+        throw Boom.badRequest(`invalid tag: ${String(invalid)}; tags are up to 64 letters, digits and . _ : / = -`);
+      }
+    }
+    this.validateMetadata(request.metadata);
+    const interval = request.usage_interval_ms;
+    if (interval !== undefined && (!Number.isInteger(interval) || interval < MIN_USAGE_INTERVAL_MS || interval > MAX_USAGE_INTERVAL_MS)) {
+      throw Boom.badRequest(`usage_interval_ms must be an integer from ${MIN_USAGE_INTERVAL_MS} to ${MAX_USAGE_INTERVAL_MS}`);
+    }
+    // Versions become image tags, so keep them to tag-safe characters.
+    const version = request.version;
+    if (version !== undefined && (typeof version !== 'string' || !/^[A-Za-z0-9][A-Za-z0-9._-]{0,31}$/.test(version))) {
+      throw Boom.badRequest('invalid version');
+    }
+    if (request.mode !== undefined && !['run', 'test', 'compile', 'check'].includes(request.mode)) {
+      throw Boom.badRequest('mode must be run, test, compile or check');
+    }
+    if (request.mode === 'test') {
+      if (!runner.tests) {
+        throw Boom.badRequest(`test mode not supported for ${request.language}`);
+      }
+      if (interactive) {
+        throw Boom.badRequest('test mode is not available for interactive sessions');
+      }
+    }
+    if (request.coverage !== undefined) {
+      if (typeof request.coverage !== 'boolean') {
+        throw Boom.badRequest('coverage must be a boolean');
+      }
+      if (request.coverage && request.mode !== 'test') {
+        throw Boom.badRequest('coverage is only available in test mode');
+      }
+      if (request.coverage && !runner.coverage) {
+        throw Boom.badRequest(`coverage not supported for ${request.language}`);
+      }
+    }
+    if (request.mode === 'compile' || request.mode === 'check') {
+      const supported = request.mode === 'compile' ? runner.compiled : runner.syntaxCheck;
+      if (!supported) {
+        throw Boom.badRequest(`${request.mode} mode not supported for ${request.language}`);
+      }
+      if (interactive) {
+        throw Boom.badRequest(`${request.mode} mode is not available for interactive sessions`);
+      }
+    }
+    if (request.isolation !== undefined) {
+      if (!['container', 'gvisor', 'microvm', 'wasm'].includes(request.isolation)) {
+        throw Boom.badRequest('isolation must be container, gvisor, microvm or wasm');
+      }
+      if (!(runner.isolation ?? DEFAULT_ISOLATION_LEVELS).includes(request.isolation)) {
+        throw Boom.badRequest(`isolation ${request.isolation} not supported for ${request.language}`);
+      }
+    }
+    this.validateNetwork(request.network);
+    validateGpu(request.gpu);
+    validateMounts(request.mounts);
+    validateTemplate(request);
+    validateReproducible(runner, request);
+    this.validateBuildOptions(request.build);
+    this.validateLintOptions(runner, request.lint);
+    this.validateSqlOptions(runner, request.sql);
+    this.validateProfileOptions(runner, request);
+  }
+
+  private validateMetadata(metadata: RunRequest['metadata']) {
+    if (metadata === undefined) {
+      return;
+    }
+    if (typeof metadata !== 'object' || metadata === null || Array.isArray(metadata) || Object.keys(metadata).length > MAX_METADATA_KEYS) {
+      throw Boom.badRequest(`metadata must be an object of at most ${MAX_METADATA_KEYS} keys`);
+    }
+    for (const [key, value] of Object.entries(metadata)) {
+      if (!METADATA_KEY_PATTERN.test(key)) {
+        throw Boom.badRequest(`invalid metadata key: ${key}; keys are up to 64 letters, digits and underscores, starting with a letter`);
+      }
+      if (typeof value !== 'string' || value.length > MAX_METADATA_VALUE_LENGTH) {
+        throw Boom.badRequest(`metadata.${key} must be a string of at most ${MAX_METADATA_VALUE_LENGTH} characters`);
+      }
     }
   }
 
+  private validateNetwork(network: RunRequest['network']) {
+    if (network === undefined) {
+      return;
+    }
+    if (typeof network !== 'object' || network === null || !['none', 'loopback', 'allowlist'].includes(network.mode)) {
+      throw Boom.badRequest('network.mode must be none, loopback or allowlist');
+    }
+    if (network.mode === 'allowlist') {
+      validateAllowlist(network.allow);
+    } else if (network.allow !== undefined) {
+      throw Boom.badRequest('network.allow requires network.mode allowlist');
+    }
+  }
+
+  private validateLintOptions(runner: RunnerDefinition, lint: RunRequest['lint']) {
+    if (lint === undefined) {
+      return;
+    }
+    if (typeof lint !== 'object' || lint === null || Array.isArray(lint)) {
+      throw Boom.badRequest('lint must be an object');
+    }
+    for (const check of ['vet', 'staticcheck'] as const) {
+      if (lint[check] !== undefined && typeof lint[check] !== 'boolean') {
+        throw Boom.badRequest(`lint.${check} must be a boolean`);
+      }
+    }
+    if (!runner.lint) {
+      throw Boom.badRequest(`lint not supported for ${runner.language}`);
+    }
+  }
+
+  private validateProfileOptions(runner: RunnerDefinition, request: RunRequest) {
+    const { profile } = request;
+    if (profile === undefined) {
+      return;
+    }
+    if (typeof profile !== 'object' || profile === null || Array.isArray(profile)) {
+      throw Boom.badRequest('profile must be an object');
+    }
+    for (const kind of ['cpu', 'heap'] as const) {
+      if (profile[kind] === undefined) {
+        continue;
+      }
+      if (typeof profile[kind] !== 'boolean') {
+        throw Boom.badRequest(`profile.${kind} must be a boolean`);
+      }
+      if (profile[kind] && !runner.profiles?.includes(kind)) {
+        throw Boom.badRequest(`${kind} profiling not supported for ${runner.language}`);
+      }
+    }
+    if ((request.mode ?? 'run') !== 'run') {
+      throw Boom.badRequest('profile is only available in run mode');
+    }
+  }
+
+  private validateSqlOptions(runner: RunnerDefinition, sql: RunRequest['sql']) {
+    if (sql === undefined) {
+      return;
+    }
+    if (typeof sql !== 'object' || sql === null || Array.isArray(sql)) {
+      throw Boom.badRequest('sql must be an object');
+    }
+    if (sql.engine !== undefined && !['sqlite', 'postgres'].includes(sql.engine)) {
+      throw Boom.badRequest('sql.engine must be sqlite or postgres');
+    }
+    if (sql.fixture !== undefined) {
+      if (typeof sql.fixture !== 'string') {
+        throw Boom.badRequest('sql.fixture must be a string');
+      }
+      if (Buffer.byteLength(sql.fixture, 'utf8') > 1024 * 1024) {
+        throw Boom.badRequest('sql.fixture exceeds 1 MiB');
+      }
+    }
+    if (!runner.queries) {
+      throw Boom.badRequest(`sql not supported for ${runner.language}`);
+    }
+  }
+
+  // Build options end up on the compiler command line, so only accept known values.
+  private validateBuildOptions(build: RunRequest['build']) {
+    if (!build) {
+      return;
+    }
+    if (build.compiler !== undefined && !['gcc', 'clang'].includes(build.compiler)) {
+      throw Boom.badRequest('build.compiler must be gcc or clang');
+    }
+    if (build.std !== undefined && !/^(c|gnu|c\+\+|gnu\+\+)\d{2}$/.test(build.std)) {
+      throw Boom.badRequest('invalid build.std');
+    }
+    if (build.optimization !== undefined && !['O0', 'O1', 'O2', 'O3', 'Os'].includes(build.optimization)) {
+      throw Boom.badRequest('invalid build.optimization');
+    }
+    for (const sanitizer of build.sanitizers ?? []) {
+      if (!['address', 'undefined'].includes(sanitizer)) {
+        throw Boom.badRequest(`unsupported sanitizer: ${sanitizer}`);
+      }
+    }
+  }
+
+  // The server default, unless the language cannot run at that level (wasm-only languages).
+  private defaultIsolation(language: string): IsolationLevel {
+    const levels = this.registry.require(language).isolation ?? DEFAULT_ISOLATION_LEVELS;
+    const preferred = this.options.defaultIsolation ?? 'container';
+    return levels.includes(preferred) ? preferred : levels[0];
+  }
+
+  private hashSubmission(code: string, sources: Record<string, string>): string {
+    const hash = crypto.createHash('sha256').update(code);
+    for (const sourcePath of Object.keys(sources).sort()) {
+      hash.update(`\0${sourcePath}\0`).update(sources[sourcePath]);
+    }
+    return hash.digest('hex');
+  }
+
   private stageInputFiles(requestedFiles: Array<{ id: string; path: string }>, workdir: string) {
     const staged: Array<{ sourcePath: string; destPath: string }> = [];
     let totalSize = 0;
     for (const file of requestedFiles) {
-      if (file.path.includes('..') || path.isAbsolute(file.path)) {
-        throw Boom.badRequest(`invalid file path: ${file.path}`);
-      }
       const uploaded = this.options.artifactStorage.getUploadedFile(file.id);
       if (uploaded.size > 10 * 1024 * 1024) {
         throw Boom.badRequest(`file ${uploaded.name} exceeds 10 MiB`);
@@ -131,17 +1176,24 @@ export class Orchestrator {
     return staged;
   }
 
-  private buildEnvironment(env: Record<string, string> | undefined): Record<string, string> {
-    const sanitized: Record<string, string> = { HOME: '/work', TMPDIR: '/work/tmp' };
-    if (!env) {
-      return sanitized;
+  // Waits for active runs to finish, until the deadline.
+  private async untilIdle(deadline: number) {
+    while (this.active.size > 0 && Date.now() < deadline) {
+      await new Promise((resolve) => setTimeout(resolve, DRAIN_POLL_MS));
     }
-    for (const [key, value] of Object.entries(env)) {
-      if (/^LD_/i.test(key)) {
-        continue;
-      }
-      sanitized[key] = value;
+  }
+
+  // Store failures are logged rather than failing the run, whose result the caller still gets.
+  private async persist(runId: string, write: Promise<void>) {
+    try {
+      await write;
+    } catch (err) {
+      this.options.logger.error('execution store write failed', { runId, message: (err as Error).message });
     }
-    return sanitized;
+  }
+
+  // The request's variables were checked against the env policy during validation.
+  private buildEnvironment(request: RunRequest): Record<string, string> {
+    return { ...request.env, ...reproducibleEnvironment(request.reproducible), HOME: '/work', TMPDIR: '/work/tmp' };
   }
 }
@@ -0,0 +1,257 @@
+import type { Comparison } from './judge.js';
+
+// Where and how a case's stdout differs from the expected output, for feedback on wrong answers.
+export interface OutputDiff {
+  // Line by line for exact and trimmed comparison, token by token for float.
+  format: 'unified' | 'tokens';
+  // A unified diff from the expected to the actual output with three lines of context, or one
+  // line per mismatching token; cut off after MAX_DIFF_CHARS.
+  text: string;
+  truncated: boolean;
+  // First difference, 1-based, in the actual output.
+  line: number;
+  column: number;
+  // What each output has from there on, up to MAX_EXCERPT_CHARS (for float, the token), null
+  // for a side that had already ended.
+  expected: string | null;
+  actual: string | null;
+}
+
+const MAX_DIFF_CHARS = 4096;
+const MAX_EXCERPT_CHARS = 64;
+const CONTEXT_LINES = 3;
+// Beyond this many line pairs the part both outputs don't share is shown as replaced outright.
+const MAX_DIFF_CELLS = 1_000_000;
+
+type Edit = { op: ' ' | '-' | '+'; line: string; expected: number; actual: number };
+
+// The output's lines with trailing whitespace dropped from each line and trailing blank lines
+// dropped altogether, as `trimmed` comparison sees them.
+export function trimLines(output: string): string[] {
+  const lines = output
+    .replace(/\r\n/g, '\n')
+    .split('\n')
+    .map((line) => line.trimEnd());
+  while (lines.length > 0 && lines[lines.length - 1] === '') {
+    lines.pop();
+  }
+  return lines;
+}
+
+// Whether a token of the output matches the expected one: numerically within the tolerance,
+// relative for numbers above 1, when both are numbers, and exactly otherwise.
+export function tokenMatches(got: string | undefined, want: string | undefined, tolerance: number): boolean {
+  if (got === undefined || want === undefined) {
+    return got === want;
+  }
+  const expected = Number(want);
+  const actual = Number(got);
+  if (!Number.isFinite(expected) || !Number.isFinite(actual)) {
+    return got === want;
+  }
+  return Math.abs(actual - expected) <= tolerance * Math.max(1, Math.abs(expected));
+}
+
+// The difference between two outputs as the comparison sees it, null when it sees none.
+export function diffOutput(actual: string, expected: string, comparison: Comparison, tolerance: number): OutputDiff | null {
+  return comparison === 'float' ? diffTokens(actual, expected, tolerance) : diffLines(actual, expected, comparison);
+}
+
+function diffLines(actual: string, expected: string, comparison: 'exact' | 'trimmed'): OutputDiff | null {
+  // Lines keep their newline so that exact comparison can tell a missing final one.
+  const split = (output: string) =>
+    comparison === 'exact' ? (output.match(/[^\n]*\n|[^\n]+$/g) ?? []) : trimLines(output).map((line) => `${line}\n`);
+  const want = split(expected);
+  const got = split(actual);
+  let first = 0;
+  while (first < want.length && first < got.length && want[first] === got[first]) {
+    first++;
+  }
+  if (first === want.length && first === got.length) {
+    return null;
+  }
+  const wantLine = want[first];
+  const gotLine = got[first];
+  let column = 0;
+  while (wantLine !== undefined && gotLine !== undefined && wantLine[column] === gotLine[column]) {
+    column++;
+  }
+  const writer = new DiffWriter();
+  writer.add('--- expected');
+  writer.add('+++ actual');
+  for (const hunk of hunks(editScript(want, got))) {
+    const start = hunk[0];
+    const wantCount = hunk.filter((edit) => edit.op !== '+').length;
+    const gotCount = hunk.filter((edit) => edit.op !== '-').length;
+    writer.add(`@@ -${start.expected + (wantCount ? 1 : 0)},${wantCount} +${start.actual + (gotCount ? 1 : 0)},${gotCount} @@`);
+    for (const edit of hunk) {
+      writer.add(`${edit.op}${edit.line.endsWith('\n') ? edit.line.slice(0, -1) : edit.line}`);
+      if (!edit.line.endsWith('\n')) {
+        writer.add('\\ No newline at end of file');
+      }
+    }
+  }
+  return {
+    format: 'unified',
+    ...writer.finish(),
+    line: first + 1,
+    column: column + 1,
+    expected: wantLine === undefined ? null : wantLine.slice(column, column + MAX_EXCERPT_CHARS),
+    actual: gotLine === undefined ? null : gotLine.slice(column, column + MAX_EXCERPT_CHARS)
+  };
+}
+
+function diffTokens(actual: string, expected: string, tolerance: number): OutputDiff | null {
+  const want = expected.split(/\s+/).filter(Boolean);
+  const got = tokens(actual);
+  const writer = new DiffWriter();
+  let first: { line: number; column: number; expected: string | null; actual: string | null } | null = null;
+  for (let index = 0; index < Math.max(want.length, got.length); index++) {
+    const token = got[index];
+    if (tokenMatches(token?.text, want[index], tolerance)) {
+      continue;
+    }
+    const at = token ?? got.end;
+    first = first ?? { line: at.line, column: at.column, expected: want[index] ?? null, actual: token?.text ?? null };
+    const wanted = want[index] === undefined ? 'nothing' : want[index];
+    writer.add(`token ${index + 1} at ${at.line}:${at.column}: expected ${wanted}, got ${token ? token.text : 'nothing'}`);
+    if (writer.full) {
+      break;
+    }
+  }
+  if (!first) {
+    return null;
+  }
+  return { format: 'tokens', ...writer.finish(), ...first };
+}
+
+// The output's whitespace-separated tokens with their 1-based positions, and the position just
+// past the last one.
+function tokens(output: string) {
+  const found: Array<{ text: string; line: number; column: number }> = [];
+  let line = 1;
+  let lineStart = 0;
+  let scanned = 0;
+  const advance = (to: number) => {
+    for (; scanned < to; scanned++) {
+      if (output[scanned] === '\n') {
+        line++;
+        lineStart = scanned + 1;
+      }
+    }
+  };
+  for (const match of output.matchAll(/\S+/g)) {
+    advance(match.index);
+    found.push({ text: match[0], line, column: match.index - lineStart + 1 });
+  }
+  const last = found[found.length - 1];
+  const end = last ? { line: last.line, column: last.column + last.text.length } : { line: 1, column: 1 };
+  return Object.assign(found, { end });
+}
+
+// The shortest edit script turning want into got, from the longest common subsequence of the
+// lines between the prefix and suffix they share.
+function editScript(want: string[], got: string[]): Edit[] {
+  let prefix = 0;
+  while (prefix < want.length && prefix < got.length && want[prefix] === got[prefix]) {
+    prefix++;
+  }
+  let suffix = 0;
+  while (
+    suffix < want.length - prefix &&
+    suffix < got.length - prefix &&
+    want[want.length - 1 - suffix] === got[got.length - 1 - suffix]
+  ) {
+    suffix++;
+  }
+  const a = want.slice(prefix, want.length - suffix);
+  const b = got.slice(prefix, got.length - suffix);
+  const middle: Array<' ' | '-' | '+'> = [];
+  if (a.length * b.length <= MAX_DIFF_CELLS) {
+    // lengths[i * (b.length + 1) + j]: common subsequence of a[i..] and b[j..].
+    const width = b.length + 1;
+    const lengths = new Uint32Array((a.length + 1) * width);
+    for (let i = a.length - 1; i >= 0; i--) {
+      for (let j = b.length - 1; j >= 0; j--) {
+        lengths[i * width + j] =
+          a[i] === b[j] ? lengths[(i + 1) * width + j + 1] + 1 : Math.max(lengths[(i + 1) * width + j], lengths[i * width + j + 1]);
+      }
+    }
+    let i = 0;
+    let j = 0;
+    while (i < a.length || j < b.length) {
+      if (i < a.length && j < b.length && a[i] === b[j]) {
+        middle.push(' ');
+        i++;
+        j++;
+      } else if (j === b.length || (i < a.length && lengths[(i + 1) * width + j] >= lengths[i * width + j + 1])) {
+        middle.push('-');
+        i++;
+      } else {
+        middle.push('+');
+        j++;
+      }
+    }
+  } else {
+    middle.push(...a.map(() => '-' as const), ...b.map(() => '+' as const));
+  }
+  const ops = [...want.slice(0, prefix).map(() => ' ' as const), ...middle, ...want.slice(want.length - suffix).map(() => ' ' as const)];
+  const edits: Edit[] = [];
+  let expectedLine = 0;
+  let actualLine = 0;
+  for (const op of ops) {
+    edits.push({ op, line: op === '+' ? got[actualLine] : want[expectedLine], expected: expectedLine, actual: actualLine });
+    expectedLine += op === '+' ? 0 : 1;
+    actualLine += op === '-' ? 0 : 1;
+  }
+  return edits;
+}
+
+// Groups changes that are at most twice the context apart, each with its context around it.
+function hunks(edits: Edit[]): Edit[][] {
+  const groups: Edit[][] = [];
+  let start = -1;
+  let last = -1;
+  const close = () => groups.push(edits.slice(start, Math.min(edits.length, last + CONTEXT_LINES + 1)));
+  edits.forEach((edit, index) => {
+    if (edit.op === ' ') {
+      return;
+    }
+    if (start >= 0 && index - last - 1 > 2 * CONTEXT_LINES) {
+      close();
+      start = -1;
+    }
+    if (start < 0) {
+      start = Math.max(0, index - CONTEXT_LINES);
+    }
+    last = index;
+  });
+  if (start >= 0) {
+    close();
+  }
+  return groups;
+}
+
+// Collects diff lines up to MAX_DIFF_CHARS.
+class DiffWriter {
+  private readonly lines: string[] = [];
+  private size = 0;
+  public full = false;
+
+  public add(line: string) {
+    if (this.full) {
+      return;
+    }
+    if (this.size + line.length + 1 > MAX_DIFF_CHARS) {
+      this.lines.push(line.slice(0, Math.max(0, MAX_DIFF_CHARS - this.size - 1)));
+      this.full = true;
+      return;
+    }
+    this.lines.push(line);
+    this.size += line.length + 1;
+  }
+
+  public finish() {
+    return { text: this.lines.join('\n'), truncated: this.full };
+  }
+}
@@ -0,0 +1,141 @@
+import Boom from '@hapi/boom';
+import { Logger } from '../util/logger.js';
+import type { Orchestrator } from './orchestrator.js';
+import type { SpanContext } from '../tracing/tracer.js';
+import type { RunRecord, RunRequest, RunStatus } from './types.js';
+import { withoutInlineContent } from '../store/store.js';
+
+// One step of a pipeline; the other fields are those of a run request, so every stage picks its
+// own language, program, arguments and limits.
+export interface PipelineStage extends RunRequest {
+  // Names the stage in `stdin_from`, `artifacts_from` and the result.
+  name: string;
+  // An earlier stage whose stdout becomes this stage's stdin, in place of `stdin`.
+  stdin_from?: string;
+  // Earlier stages whose artifacts are staged under inputs/<stage>/; all of them unless set.
+  artifacts_from?: string[];
+}
+
+export interface PipelineRequest {
+  stages: PipelineStage[];
+}
+
+export interface PipelineStageResult {
+  name: string;
+  run: RunRecord;
+}
+
+export interface PipelineResult {
+  // `succeeded` once every stage did; otherwise the status of the stage that stopped the pipeline.
+  status: RunStatus;
+  failed_stage: string | null;
+  // The stages that ran, in order; those after a failed stage are left out.
+  stages: PipelineStageResult[];
+}
+
+export interface PipelineOptions {
+  orchestrator: Orchestrator;
+  logger: Logger;
+  maxStages?: number;
+  // Receives every run record as it finishes.
+  onRun?: (run: RunRecord) => void;
+}
+
+const STAGE_NAME_PATTERN = /^[A-Za-z0-9_-]{1,64}$/;
+
+// Runs ordered stages that each build on the ones before, e.g. a generator writing test data, the
+// solution reading it and a verifier checking what the solution printed, for workflows the fixed
+// compile-then-run flow of a single run can't express. Stages run one after another as ordinary
+// runs, and the first one that does not succeed stops the pipeline.
+export class Pipeline {
+  private readonly maxStages: number;
+
+  constructor(private readonly options: PipelineOptions) {
+    this.maxStages = options.maxStages ?? 10;
+  }
+
+  // Every stage joins the caller's trace when `traceParent` is given.
+  public async run(request: PipelineRequest, apiKey: string, traceParent?: SpanContext | null): Promise<PipelineResult> {
+    this.validate(request);
+    const consumed = consumedStages(request.stages);
+    const finished = new Map<string, RunRecord>();
+    const stages: PipelineStageResult[] = [];
+    for (const stage of request.stages) {
+      const { name, stdin_from, artifacts_from, ...submission } = stage;
+      const inputs: Record<string, Buffer> = {};
+      for (const from of artifacts_from ?? [...finished.keys()]) {
+        for (const artifact of (finished.get(from) as RunRecord).artifacts) {
+          if (artifact.content === undefined) {
+            throw Boom.entityTooLarge(`artifact ${artifact.name} of stage ${from} is too large to pass to stage ${name}`);
+          }
+          inputs[`${from}/${artifact.name}`] = Buffer.from(artifact.content, 'base64');
+        }
+      }
+      // Artifacts only come back with their contents inline, so those of a stage a later one reads
+      // are asked for that way and dropped again unless the stage wanted them too.
+      const run = await this.options.orchestrator.createRun(
+        {
+          ...submission,
+          stdin: stdin_from === undefined ? submission.stdin : (finished.get(stdin_from) as RunRecord).stdout,
+          inline_artifacts: submission.inline_artifacts || consumed.has(name)
+        },
+        apiKey,
+        { inputs, traceParent }
+      );
+      this.options.onRun?.(run);
+      finished.set(name, run);
+      stages.push({ name, run: submission.inline_artifacts ? run : withoutInlineContent(run) });
+      if (run.status !== 'succeeded') {
+        this.options.logger.info('pipeline stage failed', { runId: run.id, stage: name, status: run.status, apiKey });
+        return { status: run.status, failed_stage: name, stages };
+      }
+    }
+    return { status: 'succeeded', failed_stage: null, stages };
+  }
+
+  private validate(request: PipelineRequest) {
+    if (!Array.isArray(request?.stages) || request.stages.length === 0) {
+      throw Boom.badRequest('stages must be a non-empty array');
+    }
+    if (request.stages.length > this.maxStages) {
+      throw Boom.badRequest(`stages exceeds ${this.maxStages} entries`);
+    }
+    const earlier = new Set<string>();
+    request.stages.forEach((stage, index) => {
+      if (typeof stage !== 'object' || stage === null) {
+        throw Boom.badRequest(`stages[${index}] must be an object`);
+      }
+      if (typeof stage.name !== 'string' || !STAGE_NAME_PATTERN.test(stage.name)) {
+        throw Boom.badRequest(`stages[${index}].name must be 1-64 letters, digits, underscores or hyphens`);
+      }
+      if (earlier.has(stage.name)) {
+        throw Boom.badRequest(`duplicate stage name: ${stage.name}`);
+      }
+      if (stage.stdin_from !== undefined) {
+        if (!earlier.has(stage.stdin_from)) {
+          throw Boom.badRequest(`stages[${index}].stdin_from must name an earlier stage`);
+        }
+        if (stage.stdin !== undefined) {
+          throw Boom.badRequest(`stages[${index}] sets both stdin and stdin_from`);
+        }
+      }
+      if (stage.artifacts_from !== undefined) {
+        if (!Array.isArray(stage.artifacts_from) || stage.artifacts_from.some((from) => !earlier.has(from))) {
+          throw Boom.badRequest(`stages[${index}].artifacts_from must list earlier stages`);
+        }
+      }
+      earlier.add(stage.name);
+    });
+  }
+}
+
+// Stages whose artifacts some later stage receives.
+function consumedStages(stages: PipelineStage[]) {
+  const consumed = new Set<string>();
+  stages.forEach((stage, index) => {
+    for (const from of stage.artifacts_from ?? stages.slice(0, index).map((earlier) => earlier.name)) {
+      consumed.add(from);
+    }
+  });
+  return consumed;
+}
@@ -0,0 +1,302 @@
+import Boom from '@hapi/boom';
+import type { Language, PolicyAction, PolicyViolation, RunRequest } from './types.js';
+
+export type PolicyRuleKind = 'import' | 'call' | 'pattern';
+
+// One thing submissions may not do. `import` rules name modules, which also cover their
+// submodules (`net` covers `net/http`, `os` covers `os.path`); `call` rules name functions,
+// called directly or as methods; `pattern` rules are regular expressions over the source.
+export interface PolicyRule {
+  id: string;
+  kind: PolicyRuleKind;
+  match: string[];
+  // Languages the rule applies to; all of them when unset.
+  languages?: Language[];
+  // Tenants the rule applies to, e.g. the keys of one course; every tenant when unset.
+  tenants?: string[];
+  // `reject` refuses the submission, `flag` runs it and reports the violation with the result.
+  action: PolicyAction;
+  // Shown instead of the default message.
+  message?: string;
+}
+
+type Syntax = 'c' | 'hash' | 'sql';
+
+const SYNTAX: Record<string, Syntax> = {
+  python: 'hash',
+  ruby: 'hash',
+  bash: 'hash',
+  sh: 'hash',
+  sql: 'sql'
+};
+
+// How each language names what it imports; the first group is the module, or for Python's plain
+// `import` statements the comma-separated list of them.
+const IMPORT_PATTERNS: Record<string, RegExp[]> = {
+  python: [
+    /^[ \t]*import[ \t]+([^\n;]+)/gm,
+    /^[ \t]*from[ \t]+([\w.]+)[ \t]+import\b/gm,
+    /\b(?:__import__|import_module)\(\s*['"]([\w.]+)['"]/g
+  ],
+  node: [
+    /\brequire\(\s*['"`]([^'"`]+)['"`]\s*\)/g,
+    /\b(?:import|export)\s+(?:[^'"`;]*?\s+from\s+)?['"]([^'"]+)['"]/g,
+    /\bimport\(\s*['"`]([^'"`]+)['"`]/g
+  ],
+  // Import blocks are split into their paths by GO_BLOCK_PATH.
+  go: [/^[ \t]*import[ \t]+(?:[\w.]+[ \t]+)?"([^"]+)"/gm, /^[ \t]*import[ \t]*\(([^)]*)\)/gm],
+  ruby: [/\brequire(?:_relative)?\s*\(?\s*['"]([^'"]+)['"]/g],
+  php: [/\b(?:require|include)(?:_once)?\s*\(?\s*['"]([^'"]+)['"]/g, /^[ \t]*use[ \t]+\\?([\w\\]+)/gm],
+  rust: [/^[ \t]*(?:pub[ \t]+)?use[ \t]+([\w:]+)/gm, /\bextern[ \t]+crate[ \t]+(\w+)/g],
+  java: [/^[ \t]*import[ \t]+(?:static[ \t]+)?([\w.]+)/gm],
+  c: [/^[ \t]*#[ \t]*include[ \t]*[<"]([^>"]+)[>"]/gm]
+};
+IMPORT_PATTERNS.typescript = IMPORT_PATTERNS.node;
+IMPORT_PATTERNS.kotlin = IMPORT_PATTERNS.java;
+IMPORT_PATTERNS.cpp = IMPORT_PATTERNS.c;
+
+const GO_BLOCK_PATH = /^[ \t]*(?:[\w.]+[ \t]+)?"([^"]+)"/gm;
+
+const KINDS: PolicyRuleKind[] = ['import', 'call', 'pattern'];
+const ACTIONS: PolicyAction[] = ['reject', 'flag'];
+// Enough to show what is wrong without a response the size of the submission.
+const MAX_VIOLATIONS = 100;
+
+// Checks the policy.rules configuration, throwing a message naming the first problem.
+export function parsePolicyRules(value: unknown): PolicyRule[] {
+  if (!Array.isArray(value)) {
+    throw new Error('expected a list of rules');
+  }
+  const ids = new Set<string>();
+  return value.map((entry: Partial<Record<keyof PolicyRule, unknown>>, index) => {
+    const id = typeof entry?.id === 'string' && entry.id ? entry.id : `rule ${index + 1}`;
+    if (ids.has(id)) {
+      throw new Error(`duplicate rule ${id}`);
+    }
+    ids.add(id);
+    if (!KINDS.includes(entry?.kind as PolicyRuleKind)) {
+      throw new Error(`${id}: kind must be one of ${KINDS.join(', ')}`);
+    }
+    const match = typeof entry.match === 'string' ? [entry.match] : entry.match;
+    if (!Array.isArray(match) || match.length === 0 || match.some((item) => typeof item !== 'string' || !item)) {
+      throw new Error(`${id}: match must be a string or a list of strings`);
+    }
+    if (entry.kind === 'pattern') {
+      for (const pattern of match as string[]) {
+        try {
+          new RegExp(pattern);
+        } catch {
+          throw new Error(`${id}: invalid regular expression ${pattern}`);
+        }
+      }
+    }
+    if (entry.action !== undefined && !ACTIONS.includes(entry.action as PolicyAction)) {
+      throw new Error(`${id}: action must be reject or flag`);
+    }
+    for (const list of ['languages', 'tenants'] as const) {
+      const items = entry[list];
+      if (items !== undefined && (!Array.isArray(items) || items.some((item) => typeof item !== 'string'))) {
+        throw new Error(`${id}: ${list} must be a list of strings`);
+      }
+    }
+    return {
+      id,
+      kind: entry.kind as PolicyRuleKind,
+      match: match as string[],
+      languages: entry.languages as Language[] | undefined,
+      tenants: entry.tenants as string[] | undefined,
+      action: (entry.action as PolicyAction | undefined) ?? 'reject',
+      message: typeof entry.message === 'string' ? entry.message : undefined
+    };
+  });
+}
+
+// Scans submissions for what the deployment's rules forbid before anything runs, for classrooms
+// where some APIs are off limits. Imports and calls are found by each language's syntax with
+// comments left out, and calls with string literals left out as well, so mentioning a function
+// is not calling it; this is a lint, not a sandbox, and a determined submission can get around
+// it, which the sandbox still contains.
+export class PolicyScanner {
+  private readonly patterns = new Map<string, RegExp[]>();
+
+  constructor(private readonly rules: PolicyRule[]) {
+    for (const rule of rules) {
+      if (rule.kind === 'pattern') {
+        this.patterns.set(rule.id, rule.match.map((pattern) => new RegExp(pattern, 'gm')));
+      } else if (rule.kind === 'call') {
+        this.patterns.set(rule.id, rule.match.map((name) => new RegExp(`(?<![\\w$])${escapeRegExp(name)}\\s*\\(`, 'g')));
+      }
+    }
+  }
+
+  public get size() {
+    return this.rules.length;
+  }
+
+  // Every violation of the rules that apply to the submission's language and tenant.
+  public scan(request: Pick<RunRequest, 'language' | 'code' | 'template' | 'sources'>, tenant?: string): PolicyViolation[] {
+    const rules = this.rules.filter(
+      (rule) =>
+        (!rule.languages || rule.languages.includes(request.language)) && (!rule.tenants || (tenant !== undefined && rule.tenants.includes(tenant)))
+    );
+    if (rules.length === 0) {
+      return [];
+    }
+    const files: Array<[string, string]> = [];
+    if (typeof request.code === 'string') {
+      files.push(['code', request.code]);
+    }
+    if (typeof request.template?.source === 'string') {
+      files.push(['template', request.template.source]);
+    }
+    files.push(...Object.entries(request.sources ?? {}).filter((entry): entry is [string, string] => typeof entry[1] === 'string'));
+    const violations: PolicyViolation[] = [];
+    for (const [path, text] of files) {
+      const { code, bare } = strip(text, SYNTAX[request.language] ?? 'c');
+      const imports = rules.some((rule) => rule.kind === 'import') ? findImports(code, bare, request.language) : [];
+      for (const rule of rules) {
+        for (const { match, index } of this.matches(rule, text, bare, imports)) {
+          const { line, column } = position(text, index);
+          violations.push({ rule: rule.id, action: rule.action, path, line, column, match, message: rule.message ?? defaultMessage(rule, match) });
+        }
+      }
+    }
+    return violations
+      .sort((a, b) => a.path.localeCompare(b.path) || a.line - b.line || a.column - b.column)
+      .slice(0, MAX_VIOLATIONS);
+  }
+
+  // Throws for submissions that break a `reject` rule, listing every violation found; returns the
+  // flagged ones otherwise.
+  public check(request: Pick<RunRequest, 'language' | 'code' | 'template' | 'sources'>, tenant?: string): PolicyViolation[] {
+    const violations = this.scan(request, tenant);
+    const rejected = violations.filter((violation) => violation.action === 'reject');
+    if (rejected.length > 0) {
+      throw Boom.badRequest(rejected.map((violation) => `${violation.path}:${violation.line}: ${violation.message}`).join('; '), {
+        code: 'policy_violation',
+        violations
+      });
+    }
+    return violations;
+  }
+
+  private *matches(rule: PolicyRule, text: string, bare: string, imports: Array<{ match: string; index: number }>) {
+    if (rule.kind === 'import') {
+      yield* imports.filter(({ match }) => rule.match.some((banned) => coversModule(banned, match)));
+      return;
+    }
+    // Deny-lists apply to the source as written, calls to the code outside comments and strings.
+    const source = rule.kind === 'pattern' ? text : bare;
+    for (const pattern of this.patterns.get(rule.id) ?? []) {
+      for (const found of source.matchAll(pattern)) {
+        if (found[0] === '') {
+          continue;
+        }
+        yield { match: rule.kind === 'call' ? found[0].replace(/\s*\($/, '') : found[0], index: found.index ?? 0 };
+      }
+    }
+  }
+}
+
+// Imports in the code outside comments; `bare` tells statements from text in string literals that
+// merely looks like one.
+function findImports(code: string, bare: string, language: Language): Array<{ match: string; index: number }> {
+  const found: Array<{ match: string; index: number }> = [];
+  for (const pattern of IMPORT_PATTERNS[language] ?? []) {
+    for (const match of code.matchAll(pattern)) {
+      const statement = (match.index ?? 0) + match[0].length - match[0].trimStart().length;
+      if (bare[statement] !== code[statement]) {
+        continue;
+      }
+      const start = (match.index ?? 0) + match[0].indexOf(match[1]);
+      if (language === 'go' && pattern === IMPORT_PATTERNS.go[1]) {
+        for (const path of match[1].matchAll(GO_BLOCK_PATH)) {
+          found.push({ match: path[1], index: start + (path.index ?? 0) + path[0].indexOf(`"${path[1]}"`) + 1 });
+        }
+        continue;
+      }
+      if (language === 'python' && pattern === IMPORT_PATTERNS.python[0]) {
+        // `import a.b as c, d`
+        let offset = 0;
+        for (const part of match[1].split(',')) {
+          const name = part.trim().split(/\s+/)[0];
+          if (name) {
+            found.push({ match: name, index: start + offset + part.indexOf(name) });
+          }
+          offset += part.length + 1;
+        }
+        continue;
+      }
+      found.push({ match: match[1].replace(/^node:/, ''), index: start });
+    }
+  }
+  return found;
+}
+
+// Whether a rule's module covers an import: the module itself or anything below it.
+function coversModule(banned: string, imported: string) {
+  return imported === banned || ['.', '/', '::', '\\'].some((separator) => imported.startsWith(`${banned}${separator}`));
+}
+
+// The source with comments blanked out (`code`), and with string literals blanked out as well
+// (`bare`). Blanking keeps every offset in place, so matches are reported where they were written.
+function strip(text: string, syntax: Syntax): { code: string; bare: string } {
+  const code = text.split('');
+  const bare = text.split('');
+  const blank = (target: string[], from: number, to: number) => {
+    for (let i = from; i < to; i++) {
+      if (target[i] !== '\n') {
+        target[i] = ' ';
+      }
+    }
+  };
+  const lineComment = syntax === 'c' ? '//' : syntax === 'sql' ? '--' : '#';
+  let i = 0;
+  while (i < text.length) {
+    if (text.startsWith(lineComment, i)) {
+      const end = text.indexOf('\n', i);
+      const stop = end === -1 ? text.length : end;
+      blank(code, i, stop);
+      blank(bare, i, stop);
+      i = stop;
+    } else if (syntax !== 'hash' && text.startsWith('/*', i)) {
+      const end = text.indexOf('*/', i + 2);
+      const stop = end === -1 ? text.length : end + 2;
+      blank(code, i, stop);
+      blank(bare, i, stop);
+      i = stop;
+    } else if (text[i] === '"' || text[i] === "'" || (text[i] === '`' && syntax === 'c')) {
+      const quote = text[i];
+      let j = i + 1;
+      while (j < text.length && text[j] !== quote && !(text[j] === '\n' && quote !== '`')) {
+        j += text[j] === '\\' ? 2 : 1;
+      }
+      blank(bare, i + 1, Math.min(j, text.length));
+      i = j + 1;
+    } else {
+      i++;
+    }
+  }
+  return { code: code.join(''), bare: bare.join('') };
+}
+
+function position(text: string, index: number) {
+  const before = text.slice(0, index);
+  const line = before.split('\n').length;
+  return { line, column: index - before.lastIndexOf('\n') };
+}
+
+function defaultMessage(rule: PolicyRule, match: string) {
+  switch (rule.kind) {
+    case 'import':
+      return `import of ${match} is not allowed`;
+    case 'call':
+      return `call to ${match} is not allowed`;
+    default:
+      return `code matches forbidden pattern ${rule.id}`;
+  }
+}
+
+function escapeRegExp(value: string) {
+  return value.replace(/[.*+?^${}()|[\]\\]/g, '\\$&');
+}
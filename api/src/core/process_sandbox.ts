@@ -0,0 +1,338 @@
+import childProcess from 'node:child_process';
+import fs from 'node:fs';
+import path from 'node:path';
+import { once } from 'node:events';
+import Boom from '@hapi/boom';
+import type { RunAsUser, SandboxResult, SandboxRunSpec, SandboxRunner } from './types.js';
+import { Logger } from '../util/logger.js';
+import { runnerRegistry } from './runners.js';
+import type { RunnerRegistry } from './runners.js';
+import {
+  canceledResult,
+  classifyExit,
+  captureOutput,
+  handOverRunDir,
+  memoryReport,
+  prepareRunDir,
+  readUsageReport,
+  totalDropped,
+  watchDiskUsage,
+  watchUsage,
+  watchRunStart
+} from './run_dir.js';
+import type { UsageReading } from './run_dir.js';
+import { listOutputs } from './artifacts.js';
+import { unsupportedVersion } from './versions.js';
+import { compileProcessSeccomp, seccompArch } from './seccomp.js';
+import type { ProcessSeccompConfig, SeccompFilter } from './seccomp.js';
+import { JOB_LAUNCHER, SANDBOX_EXEC, WINDOWS_PYTHON, detectConfinement, jobLimits, sandboxExecProfile } from './host_confinement.js';
+import type { HostConfinement } from './host_confinement.js';
+
+export interface ProcessSandboxOptions {
+  // Directory containing the runners/<language>/entrypoint scripts.
+  runnersDir: string;
+  registry?: RunnerRegistry;
+  // Deny-list loaded in front of every entrypoint; omit to run them unfiltered.
+  seccomp?: ProcessSeccompConfig;
+  // Defaults to seccomp_exec.py in runnersDir.
+  seccompLauncher?: string;
+  // Drops entrypoints to this UID/GID so submissions cannot touch the API's files or signal its
+  // processes. Requires the API to run as root.
+  runAs?: RunAsUser;
+  // Confines entrypoints with the host's own mechanism: `seccomp` above on Linux, sandbox-exec on
+  // macOS, a job object on Windows. Startup fails on hosts that have none rather than running
+  // submissions unconfined.
+  confine?: boolean;
+}
+
+// Kill the entrypoint if it overruns its own wall-clock enforcement, grace period included, by
+// this much.
+const WATCHDOG_GRACE_MS = 5000;
+// USER_HZ, the unit of /proc/<pid>/stat times on every Linux architecture the server runs on.
+const CLOCK_TICKS_PER_SECOND = 100;
+
+// Runs runner entrypoints directly on the host as child processes. Entrypoints still apply
+// their rlimits and timeouts, and the host's confinement (a seccomp deny-list on Linux, a
+// sandbox-exec profile on macOS, a job object and restricted token on Windows) blocks the worst
+// of what a submission could do, but there is no private filesystem or process namespace, so this
+// backend is only meant for local development without a container runtime.
+export class ProcessSandbox implements SandboxRunner {
+  private readonly registry: RunnerRegistry;
+  private readonly seccompArch: SeccompFilter['arch'] | null;
+  private readonly confinement: HostConfinement | null;
+
+  constructor(private readonly options: ProcessSandboxOptions, private readonly logger: Logger) {
+    this.registry = options.registry ?? runnerRegistry;
+    this.seccompArch = options.seccomp ? seccompArch() : null;
+    if (options.runAs && process.getuid?.() !== 0 && process.getuid?.() !== options.runAs.uid) {
+      throw new Error('running submissions as another user requires the API to run as root');
+    }
+    this.confinement = options.confine ? detectConfinement({ runnersDir: options.runnersDir }) : null;
+    if (this.confinement && (!this.confinement.mechanism || (this.confinement.mechanism === 'seccomp' && !this.seccompArch))) {
+      throw new Error(
+        `the process backend cannot confine submissions on ${this.confinement.platform} without ${
+          this.confinement.mechanism ? 'a seccomp deny-list' : this.confinement.missing.join(', ')
+        }; set DISABLE_SANDBOX_SECURITY=1 to run them unconfined`
+      );
+    }
+    this.logger.warn('process sandbox backend enabled; submissions run without isolation', {
+      confinement: this.confinement?.mechanism ?? 'none',
+      unenforced: this.confinement?.missing
+    });
+    if (options.seccomp && !this.seccompArch && !this.confinement) {
+      this.logger.warn('seccomp filtering needs Linux on x86_64 or arm64; entrypoints run unfiltered', {
+        platform: process.platform,
+        arch: process.arch
+      });
+    }
+  }
+
+  public async run(spec: SandboxRunSpec): Promise<SandboxResult> {
+    const runner = this.registry.require(spec.language);
+    if (!runner.entrypoint) {
+      throw Boom.badRequest(`language not supported by the process backend: ${spec.language}`);
+    }
+    if (spec.isolation !== 'container') {
+      throw Boom.badRequest(`isolation ${spec.isolation} requires the docker backend`);
+    }
+    if (spec.network.mode === 'allowlist') {
+      throw Boom.badRequest('network allowlists require the docker backend');
+    }
+    if (spec.gpu) {
+      throw Boom.badRequest('gpu requires the docker backend');
+    }
+    if (spec.mounts.length > 0) {
+      // There is no private filesystem to place /data in.
+      throw Boom.badRequest('mounts require the docker backend');
+    }
+    if (spec.version) {
+      // Entrypoints use whatever toolchain is installed on the host.
+      throw unsupportedVersion(spec.language, spec.version, []);
+    }
+    if (spec.signal?.aborted) {
+      return canceledResult();
+    }
+    const runDir = prepareRunDir(runner, spec);
+    if (this.options.runAs) {
+      handOverRunDir(runDir, this.options.runAs);
+    }
+    const [command, ...commandArgs] = this.launchCommand(spec, runDir, path.join(this.options.runnersDir, runner.entrypoint));
+    this.logger.info('launching process sandbox', { specId: spec.id, command, streaming: Boolean(spec.onOutput) });
+    // The entrypoint leads its own process group so that the compiler and its helpers can be
+    // killed together. The program gets a session of its own from the entrypoint, which signals it
+    // at the wall-clock limit, so its group is killed separately. Windows has no process groups;
+    // there the job object takes everything down with the launcher.
+    const windows = process.platform === 'win32';
+    const child = childProcess.spawn(command, commandArgs, {
+      cwd: runDir,
+      detached: !windows,
+      windowsHide: true,
+      stdio: ['pipe', 'pipe', 'pipe'],
+      uid: this.options.runAs?.uid,
+      gid: this.options.runAs?.gid
+    });
+    const killGroup = () => {
+      if (windows) {
+        killWindowsTree(child, this.confinement?.mechanism === 'job-object');
+        return;
+      }
+      for (const group of [child.pid as number, ...descendantGroups(child.pid as number)]) {
+        try {
+          process.kill(-group, 'SIGKILL');
+        } catch {
+          // The group is already gone.
+        }
+      }
+    };
+    // The spec goes on the first line of stdin; interactive sessions keep streaming input after it.
+    child.stdin.write(`${JSON.stringify({
+      id: spec.id,
+      language: spec.language,
+      mode: spec.mode,
+      build: spec.build,
+      lint: spec.lint ?? null,
+      sql: spec.sql ?? null,
+      profile: spec.profile ?? null,
+      coverage: Boolean(spec.coverage),
+      args: spec.args,
+      env: spec.env,
+      limits: spec.limits,
+      stdin: spec.stdin,
+      interactive: Boolean(spec.input),
+      on_output_limit: spec.onOutputLimit ?? 'truncate',
+      settings: runner.settings ?? {},
+      workdir: runDir
+    })}\n`);
+    if (spec.input) {
+      child.stdin.on('error', () => undefined);
+      spec.input.pipe(child.stdin);
+    } else {
+      child.stdin.end();
+    }
+
+    const output = captureOutput(spec, () => {
+      if (spec.onOutputLimit === 'kill') {
+        killGroup();
+      }
+    });
+    child.stdout.on('data', (chunk: Buffer) => output.push('stdout', chunk));
+    child.stderr.on('data', (chunk: Buffer) => output.push('stderr', chunk));
+    const watchdog = setTimeout(killGroup, spec.limits.timeout_ms + spec.limits.kill_grace_ms + WATCHDOG_GRACE_MS);
+    spec.signal?.addEventListener('abort', killGroup, { once: true });
+    const disk = watchDiskUsage(runDir, spec.limits, killGroup);
+    const memory = watchUsage(spec, windows ? null : async () => treeUsage(child.pid as number));
+    const started = runner.compiled && spec.onRunStart ? watchRunStart(runDir, spec.onRunStart) : null;
+
+    const [code, signal] = (await once(child, 'exit')) as [number | null, NodeJS.Signals | null];
+    clearTimeout(watchdog);
+    disk.stop();
+    memory.stop();
+    started?.stop();
+    spec.signal?.removeEventListener('abort', killGroup);
+    // Background processes the program left behind would otherwise outlive the run.
+    killGroup();
+
+    const report = readUsageReport(runDir, spec.limits, memory.peakMb);
+    const droppedBytes = totalDropped(report, output);
+    const outputLimit = report.limitExceeded ?? (droppedBytes.stdout || droppedBytes.stderr ? 'output' : null);
+    const { status, limitExceeded } = classifyExit(code, signal, disk.exceeded ? 'disk' : outputLimit, spec.onOutputLimit);
+
+    return {
+      status,
+      exitCode: code,
+      limitExceeded,
+      timeout: report.timeout,
+      exitSignal: report.exitSignal,
+      stdout: output.stdout(),
+      stderr: output.stderr(),
+      droppedBytes,
+      compile: report.compile,
+      toolchain: report.toolchain,
+      tests: report.tests,
+      coverage: report.coverage,
+      diagnostics: report.diagnostics,
+      results: report.results,
+      usage: report.usage,
+      memory: memoryReport(report.usage, spec.limits, memory),
+      usageSamples: memory.series,
+      artifacts: listOutputs(runDir)
+    };
+  }
+
+  private launchCommand(spec: SandboxRunSpec, runDir: string, entrypoint: string): string[] {
+    const command = this.entrypointCommand(entrypoint);
+    if (this.confinement?.mechanism === 'sandbox-exec') {
+      return [SANDBOX_EXEC, '-p', sandboxExecProfile(runDir, spec.network), ...command];
+    }
+    if (this.confinement?.mechanism === 'job-object') {
+      const launcher = path.join(this.options.runnersDir, JOB_LAUNCHER);
+      return [WINDOWS_PYTHON, launcher, JSON.stringify(jobLimits(runDir, spec.limits)), ...command];
+    }
+    if (!this.options.seccomp || !this.seccompArch) {
+      return command;
+    }
+    const filter = compileProcessSeccomp(this.options.seccomp, this.seccompArch, spec.language, spec.network);
+    const launcher = this.options.seccompLauncher ?? path.join(this.options.runnersDir, 'seccomp_exec.py');
+    return [...this.entrypointCommand(launcher), JSON.stringify(filter), ...command];
+  }
+
+  // Entrypoints are not all marked executable in the tree, so honour the shebang explicitly.
+  private entrypointCommand(script: string): string[] {
+    const firstLine = fs.readFileSync(script, 'utf8').split('\n', 1)[0];
+    if (!firstLine.startsWith('#!')) {
+      return [script];
+    }
+    const interpreter = firstLine.slice(2).trim().split(/\s+/);
+    if (process.platform === 'win32') {
+      // Neither /usr/bin/env nor /bin exist there; the interpreter is looked up on PATH instead.
+      const name = path.posix.basename(interpreter[0] === '/usr/bin/env' ? interpreter[1] : interpreter[0]);
+      return [name === 'python3' ? WINDOWS_PYTHON : name, script];
+    }
+    return [...interpreter, script];
+  }
+}
+
+// The job object kills everything in it once its launcher is gone; without one, taskkill walks
+// the tree by parent process.
+function killWindowsTree(child: childProcess.ChildProcess, inJob: boolean) {
+  if (inJob) {
+    child.kill('SIGKILL');
+    return;
+  }
+  childProcess.spawnSync('taskkill', ['/pid', String(child.pid), '/t', '/f'], { stdio: 'ignore', windowsHide: true });
+}
+
+// Process groups of everything below pid, found by walking /proc, or by asking ps on hosts
+// without it such as macOS.
+function descendantGroups(pid: number): number[] {
+  const children = new Map<number, Array<{ pid: number; group: number }>>();
+  for (const entry of processTable()) {
+    children.set(entry.parent, [...(children.get(entry.parent) ?? []), { pid: entry.pid, group: entry.group }]);
+  }
+  const groups = new Set<number>();
+  const pending = [pid];
+  while (pending.length > 0) {
+    for (const child of children.get(pending.pop() as number) ?? []) {
+      groups.add(child.group);
+      pending.push(child.pid);
+    }
+  }
+  groups.delete(pid);
+  return [...groups];
+}
+
+// Resident memory and CPU time of pid and everything below it, from /proc; null on hosts without
+// it. CPU time includes the children each process has waited for, which are gone from the table.
+function treeUsage(pid: number): UsageReading | null {
+  if (!fs.existsSync('/proc/self/status')) {
+    return null;
+  }
+  const children = new Map<number, number[]>();
+  for (const entry of processTable()) {
+    children.set(entry.parent, [...(children.get(entry.parent) ?? []), entry.pid]);
+  }
+  let kilobytes = 0;
+  let ticks = 0;
+  const pending = [pid];
+  while (pending.length > 0) {
+    const current = pending.pop() as number;
+    pending.push(...(children.get(current) ?? []));
+    try {
+      const rss = /^VmRSS:\s+(\d+) kB/m.exec(fs.readFileSync(`/proc/${current}/status`, 'utf8'));
+      kilobytes += rss ? Number(rss[1]) : 0;
+      // utime, stime, cutime and cstime, counted from the state after the command name.
+      const stat = fs.readFileSync(`/proc/${current}/stat`, 'utf8');
+      const fields = stat.slice(stat.lastIndexOf(')') + 2).split(' ');
+      ticks += fields.slice(11, 15).reduce((sum, field) => sum + (Number(field) || 0), 0);
+    } catch {
+      // Exited since the table was read.
+    }
+  }
+  return { memoryMb: kilobytes / 1024, cpuMs: (ticks * 1000) / CLOCK_TICKS_PER_SECOND };
+}
+
+function processTable(): Array<{ pid: number; parent: number; group: number }> {
+  let entries: string[];
+  try {
+    entries = fs.readdirSync('/proc').filter((entry) => /^\d+$/.test(entry));
+  } catch {
+    const ps = childProcess.spawnSync('ps', ['-A', '-o', 'pid=,ppid=,pgid='], { encoding: 'utf8' });
+    return (ps.stdout ?? '').split('\n').filter((line) => line.trim()).map((line) => {
+      const [pid, parent, group] = line.trim().split(/\s+/).map(Number);
+      return { pid, parent, group };
+    });
+  }
+  const table: Array<{ pid: number; parent: number; group: number }> = [];
+  for (const entry of entries) {
+    let stat: string;
+    try {
+      stat = fs.readFileSync(`/proc/${entry}/stat`, 'utf8');
+    } catch {
+      continue;
+    }
+    // The command name before them is parenthesised and may itself contain spaces.
+    const [, parent, group] = stat.slice(stat.lastIndexOf(')') + 2).split(' ').map(Number);
+    table.push({ pid: Number(entry), parent, group });
+  }
+  return table;
+}
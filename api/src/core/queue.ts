@@ -0,0 +1,251 @@
+import { tooManyRequests } from './rate_limit.js';
+import type { PriorityClass } from './types.js';
+
+export interface QueueStats {
+  // Jobs waiting for a worker.
+  depth: number;
+  running: number;
+  concurrency: number;
+  max_depth: number;
+  // Mean time recently completed jobs spent waiting for a worker.
+  avg_wait_ms: number;
+  by_priority: Record<PriorityClass, PriorityStats>;
+}
+
+export interface PriorityStats {
+  depth: number;
+  running: number;
+  // Workers kept for this class that no other class may take.
+  reserved: number;
+}
+
+// From most to least urgent.
+export const PRIORITY_CLASSES: PriorityClass[] = ['interactive', 'normal', 'batch'];
+
+// The tenant a job belongs to and how many of its jobs may run at once, so one tenant cannot
+// take every worker however many jobs it submits.
+export interface TenantSlot {
+  id: string;
+  maxRunning: number;
+}
+
+export interface QueuedJob<T> {
+  // Resolves with the job's result once a worker has run it.
+  done: Promise<T>;
+}
+
+// Runs execution jobs through a bounded set of workers. Implementations must reject new jobs
+// synchronously when they cannot accept more, so callers can answer with 429 before doing work.
+export interface JobQueue {
+  // `job` receives how long it waited for a worker. When `signal` aborts while the job is still
+  // waiting it is dispatched straight away so it can settle as canceled. Jobs are `normal`
+  // priority unless told otherwise.
+  enqueue<T>(job: (waitMs: number) => Promise<T>, signal?: AbortSignal, tenant?: TenantSlot, priority?: PriorityClass): QueuedJob<T>;
+  stats(): QueueStats;
+}
+
+export interface InMemoryQueueOptions {
+  concurrency: number;
+  maxDepth: number;
+  // Workers only jobs of that class may use, so e.g. interactive runs always find one free
+  // however much batch work is queued. At most `concurrency` in total; none by default.
+  reservations?: Partial<Record<PriorityClass, number>>;
+  // A waiting job is treated as one class more urgent for every agingMs it has waited, so batch
+  // work still starts under a steady stream of interactive runs. Never aged when 0 or unset.
+  agingMs?: number;
+}
+
+interface PendingJob {
+  enqueuedAt: number;
+  signal?: AbortSignal;
+  tenant?: TenantSlot;
+  priority: PriorityClass;
+  // Runs the job and settles its `done` promise; never rejects.
+  start: (waitMs: number) => Promise<void>;
+}
+
+// Samples kept for avg_wait_ms.
+const WAIT_WINDOW = 100;
+
+// Workers of a queue go to the waiting job of the most urgent class, oldest first, skipping jobs
+// whose tenant is at its cap and those that would take a worker reserved for another class.
+// Running jobs are never interrupted; a more urgent job takes the next free worker.
+export class InMemoryQueue implements JobQueue {
+  private readonly pending: PendingJob[] = [];
+  private readonly waits: number[] = [];
+  private running = 0;
+  private readonly runningByTenant = new Map<string, number>();
+  private readonly runningByPriority: Record<PriorityClass, number> = { interactive: 0, normal: 0, batch: 0 };
+
+  constructor(private readonly options: InMemoryQueueOptions) {
+    if (options.concurrency < 1) {
+      throw new Error('queue concurrency must be at least 1');
+    }
+    const reserved = PRIORITY_CLASSES.reduce((sum, priority) => sum + this.reserved(priority), 0);
+    if (reserved > options.concurrency) {
+      throw new Error('queue reservations exceed its concurrency');
+    }
+  }
+
+  public enqueue<T>(
+    job: (waitMs: number) => Promise<T>,
+    signal?: AbortSignal,
+    tenant?: TenantSlot,
+    priority: PriorityClass = 'normal'
+  ): QueuedJob<T> {
+    const startsNow = this.canStart(tenant, priority);
+    if (!startsNow && this.pending.length >= this.options.maxDepth) {
+      throw tooManyRequests('execution queue is full', this.retryAfterMs(), { depth: this.pending.length });
+    }
+    // A tenant may fill as much of the queue as its share of the workers.
+    if (!startsNow && tenant && this.pendingFor(tenant.id) >= this.tenantDepth(tenant)) {
+      throw tooManyRequests('too many queued executions for this tenant', this.retryAfterMs(), { depth: this.pendingFor(tenant.id) });
+    }
+    const done = new Promise<T>((resolve, reject) => {
+      const entry: PendingJob = {
+        enqueuedAt: Date.now(),
+        signal,
+        tenant,
+        priority,
+        start: (waitMs) => {
+          let result: Promise<T>;
+          try {
+            result = job(waitMs);
+          } catch (err) {
+            result = Promise.reject(err);
+          }
+          return result.then(resolve, reject);
+        }
+      };
+      if (startsNow) {
+        this.dispatch(entry);
+        return;
+      }
+      this.pending.push(entry);
+      signal?.addEventListener(
+        'abort',
+        () => {
+          const index = this.pending.indexOf(entry);
+          if (index !== -1) {
+            this.pending.splice(index, 1);
+            // Canceled jobs skip the line; they settle without doing real work.
+            void entry.start(Date.now() - entry.enqueuedAt);
+          }
+        },
+        { once: true }
+      );
+    });
+    return { done };
+  }
+
+  public stats(): QueueStats {
+    const totalWait = this.waits.reduce((sum, wait) => sum + wait, 0);
+    return {
+      depth: this.pending.length,
+      running: this.running,
+      concurrency: this.options.concurrency,
+      max_depth: this.options.maxDepth,
+      avg_wait_ms: this.waits.length ? Math.round(totalWait / this.waits.length) : 0,
+      by_priority: Object.fromEntries(
+        PRIORITY_CLASSES.map((priority) => [
+          priority,
+          {
+            depth: this.pending.filter((pending) => pending.priority === priority).length,
+            running: this.runningByPriority[priority],
+            reserved: this.reserved(priority)
+          }
+        ])
+      ) as Record<PriorityClass, PriorityStats>
+    };
+  }
+
+  private dispatch(entry: PendingJob) {
+    const waitMs = Date.now() - entry.enqueuedAt;
+    this.waits.push(waitMs);
+    if (this.waits.length > WAIT_WINDOW) {
+      this.waits.shift();
+    }
+    this.running++;
+    this.runningByPriority[entry.priority]++;
+    this.adjustTenant(entry.tenant, 1);
+    void entry.start(waitMs).then(() => {
+      this.running--;
+      this.runningByPriority[entry.priority]--;
+      this.adjustTenant(entry.tenant, -1);
+      // A finished job may free a tenant, a reservation and a worker.
+      for (let next = this.next(); next !== -1; next = this.next()) {
+        this.dispatch(this.pending.splice(next, 1)[0]);
+      }
+    });
+  }
+
+  // Index of the pending job the next free worker goes to, or -1 when none may start.
+  private next() {
+    const now = Date.now();
+    let best = -1;
+    let bestRank = Infinity;
+    this.pending.forEach((pending, index) => {
+      if (!this.canStart(pending.tenant, pending.priority)) {
+        return;
+      }
+      // Pending jobs are in arrival order, so the first of a rank is the oldest.
+      const rank = this.rank(pending, now);
+      if (rank < bestRank) {
+        best = index;
+        bestRank = rank;
+      }
+    });
+    return best;
+  }
+
+  // 0 for interactive, 2 for batch, less for every agingMs the job has waited.
+  private rank(job: PendingJob, now: number) {
+    const agingMs = this.options.agingMs ?? 0;
+    const aged = agingMs > 0 ? Math.floor((now - job.enqueuedAt) / agingMs) : 0;
+    return Math.max(0, PRIORITY_CLASSES.indexOf(job.priority) - aged);
+  }
+
+  // Whether a job may take a worker now: one is free beyond those still reserved for the other
+  // classes, and its tenant is under its cap. Reservations follow a job's own class, not its aged rank.
+  private canStart(tenant: TenantSlot | undefined, priority: PriorityClass) {
+    const heldForOthers = PRIORITY_CLASSES.filter((other) => other !== priority).reduce(
+      (sum, other) => sum + Math.max(0, this.reserved(other) - this.runningByPriority[other]),
+      0
+    );
+    return this.options.concurrency - this.running - heldForOthers > 0 && this.hasRoom(tenant);
+  }
+
+  private reserved(priority: PriorityClass) {
+    return this.options.reservations?.[priority] ?? 0;
+  }
+
+  private hasRoom(tenant: TenantSlot | undefined) {
+    return !tenant || (this.runningByTenant.get(tenant.id) ?? 0) < tenant.maxRunning;
+  }
+
+  private adjustTenant(tenant: TenantSlot | undefined, delta: number) {
+    if (!tenant) {
+      return;
+    }
+    const running = (this.runningByTenant.get(tenant.id) ?? 0) + delta;
+    if (running > 0) {
+      this.runningByTenant.set(tenant.id, running);
+    } else {
+      this.runningByTenant.delete(tenant.id);
+    }
+  }
+
+  private pendingFor(tenantId: string) {
+    return this.pending.filter((pending) => pending.tenant?.id === tenantId).length;
+  }
+
+  private tenantDepth(tenant: TenantSlot) {
+    const share = Math.min(1, tenant.maxRunning / this.options.concurrency);
+    return Math.max(1, Math.floor(this.options.maxDepth * share));
+  }
+
+  // Callers are told to come back after about as long as recent jobs waited, at least a second.
+  private retryAfterMs() {
+    return Math.max(1000, this.stats().avg_wait_ms);
+  }
+}
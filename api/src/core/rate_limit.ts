@@ -5,6 +5,16 @@ interface BucketState {
   lastRefill: number;
 }
 
+// A 429 telling the client when to try again, as a Retry-After header in whole seconds and as
+// `retry_after_ms` in the error data.
+export function tooManyRequests(message: string, retryAfterMs: number, data: Record<string, unknown> = {}): Boom.Boom {
+  const retryMs = Math.max(1, Math.ceil(retryAfterMs));
+  const err = Boom.tooManyRequests(message, { ...data, retry_after_ms: retryMs });
+  err.output.headers['Retry-After'] = String(Math.ceil(retryMs / 1000));
+  return err;
+}
+
+// Submissions per second by bucket key, which is the tenant ID when keys share one.
 export class TokenBucketLimiter {
   private readonly buckets = new Map<string, BucketState>();
 
@@ -22,7 +32,7 @@ export class TokenBucketLimiter {
       state.tokens = newTokens;
       state.lastRefill = now;
       this.buckets.set(key, state);
-      throw Boom.tooManyRequests('rate limit exceeded');
+      throw tooManyRequests('rate limit exceeded', ((1 - newTokens) / rate) * 1000);
     }
     state.tokens = newTokens - 1;
     state.lastRefill = now;
@@ -0,0 +1,156 @@
+import crypto from 'node:crypto';
+import fs from 'node:fs';
+import path from 'node:path';
+import { MAX_LIMITS, mergeLimits } from './limits.js';
+import type { LimitPolicy } from './limits.js';
+import { DEFAULT_ISOLATION_LEVELS, RunnerRegistry, runnerRegistry } from './runners.js';
+import type { RunnerDefinition } from './runners.js';
+import type { IsolationLevel, Language, SandboxRunner } from './types.js';
+import { Logger } from '../util/logger.js';
+
+export interface ReadinessOptions {
+  // The sandbox executions run in, so a probe exercises the same backend and toolchains.
+  sandbox: SandboxRunner;
+  registry?: RunnerRegistry;
+  // Probe work directories are created here and removed once the probe is done.
+  workRoot: string;
+  defaultIsolation?: IsolationLevel;
+  limits?: LimitPolicy;
+  // Runners left out of readiness, e.g. wasm-only languages while no WebAssembly runtime is set.
+  // Every registered runner with a probe program is checked by default.
+  include?: (runner: RunnerDefinition) => boolean;
+}
+
+export interface RunnerReadiness {
+  ready: boolean;
+  checked_at: string;
+  duration_ms: number;
+  // Why the probe failed, null once it passed.
+  error: string | null;
+}
+
+export interface ReadinessReport {
+  ready: boolean;
+  runners: Record<Language, RunnerReadiness>;
+}
+
+// Checks that each runner can actually compile and run its trivial probe program, so a node whose
+// image or compiler is missing reports itself unready instead of failing every submission. Probes
+// go straight to the sandbox, past the queue and the store, and their results are cached between
+// rounds so /readyz stays cheap.
+export class ReadinessProbe {
+  private readonly registry: RunnerRegistry;
+  private readonly results = new Map<Language, RunnerReadiness>();
+  private timer: NodeJS.Timeout | null = null;
+  private probing: Promise<ReadinessReport> | null = null;
+
+  constructor(private readonly options: ReadinessOptions, private readonly logger: Logger) {
+    this.registry = options.registry ?? runnerRegistry;
+  }
+
+  // Probes every intervalMs, starting with one straight away; the node is unready until it ends.
+  public start(intervalMs: number) {
+    void this.probeAll();
+    this.timer = setInterval(() => void this.probeAll(), intervalMs);
+    this.timer.unref();
+  }
+
+  public stop() {
+    if (this.timer) {
+      clearInterval(this.timer);
+      this.timer = null;
+    }
+  }
+
+  // Overlapping calls share the round in progress. Runners are probed one at a time so a round
+  // never takes more than one worker's worth of the host.
+  public probeAll(): Promise<ReadinessReport> {
+    if (!this.probing) {
+      this.probing = (async () => {
+        for (const runner of this.runners()) {
+          this.results.set(runner.language, await this.probe(runner));
+        }
+        return this.report();
+      })().finally(() => {
+        this.probing = null;
+      });
+    }
+    return this.probing;
+  }
+
+  // Ready once every probed runner has passed its latest probe.
+  public report(): ReadinessReport {
+    const runners: Record<Language, RunnerReadiness> = {};
+    let ready = true;
+    for (const runner of this.runners()) {
+      const result = this.results.get(runner.language);
+      if (result) {
+        runners[runner.language] = { ...result };
+      }
+      ready = ready && Boolean(result?.ready);
+    }
+    return { ready, runners };
+  }
+
+  private runners() {
+    const include = this.options.include ?? (() => true);
+    return this.registry.list().filter((runner) => runner.probe !== undefined && include(runner));
+  }
+
+  private async probe(runner: RunnerDefinition): Promise<RunnerReadiness> {
+    const id = `probe_${runner.language}_${crypto.randomBytes(6).toString('hex')}`;
+    const workdir = path.join(this.options.workRoot, id);
+    const started = Date.now();
+    let error: string | null = null;
+    try {
+      fs.mkdirSync(path.join(workdir, 'inputs'), { recursive: true });
+      fs.mkdirSync(path.join(workdir, 'outputs'), { recursive: true });
+      // The longest run the deployment allows, since a cold compiler can take a while.
+      const timeout =
+        this.options.limits?.languages?.[runner.language]?.max?.timeout_ms ?? (this.options.limits?.max ?? MAX_LIMITS).timeout_ms;
+      const limits = mergeLimits(
+        { timeout_ms: timeout },
+        { maxProcesses: runner.pidsLimit, maxOpenFiles: runner.openFilesLimit, policy: this.options.limits, language: runner.language }
+      );
+      const result = await this.options.sandbox.run({
+        id,
+        language: runner.language,
+        mode: 'run',
+        code: runner.probe ?? '',
+        sources: {},
+        stdin: '',
+        build: {},
+        isolation: this.isolation(runner),
+        network: { mode: 'none' },
+        args: [],
+        env: {},
+        workdir,
+        limits,
+        stagedFiles: [],
+        mounts: []
+      });
+      const lines = result.stdout.toString('utf8').trim().split('\n');
+      if (result.status !== 'succeeded') {
+        const detail = (result.compile?.stderr || result.stderr.toString('utf8')).trim().slice(0, 500);
+        error = `probe ${result.status} with exit code ${result.exitCode ?? 'none'}${detail ? `: ${detail}` : ''}`;
+      } else if (lines[lines.length - 1].trim() !== 'ok') {
+        error = `probe printed ${JSON.stringify(lines[lines.length - 1].slice(0, 100))} instead of "ok"`;
+      }
+    } catch (err) {
+      error = (err as Error).message;
+    } finally {
+      fs.rm(workdir, { recursive: true, force: true }, () => undefined);
+    }
+    if (error !== null) {
+      this.logger.warn('runner probe failed', { language: runner.language, message: error });
+    }
+    return { ready: error === null, checked_at: new Date(started).toISOString(), duration_ms: Date.now() - started, error };
+  }
+
+  // Same choice as the orchestrator's for a request that leaves isolation out.
+  private isolation(runner: RunnerDefinition): IsolationLevel {
+    const levels = runner.isolation ?? DEFAULT_ISOLATION_LEVELS;
+    const preferred = this.options.defaultIsolation ?? 'container';
+    return levels.includes(preferred) ? preferred : levels[0];
+  }
+}
@@ -0,0 +1,65 @@
+import Boom from '@hapi/boom';
+import type { RunnerDefinition } from './runners.js';
+import type { ReproducibleOptions, RunRequest } from './types.js';
+
+// What the runner entrypoints read to fix the program's clock and seed its random source. The
+// time is in libfaketime's format: `@` first for a clock that starts there and keeps running.
+export const FAKE_TIME_VARIABLE = 'EXECUTOR_FAKE_TIME';
+export const RANDOM_SEED_VARIABLE = 'EXECUTOR_RANDOM_SEED';
+
+const MAX_SEED = 2 ** 32 - 1;
+
+export function validateReproducible(runner: RunnerDefinition, request: Pick<RunRequest, 'reproducible' | 'isolation'>) {
+  const reproducible = request.reproducible;
+  if (reproducible === undefined) {
+    return;
+  }
+  if (typeof reproducible !== 'object' || reproducible === null || Array.isArray(reproducible)) {
+    throw Boom.badRequest('reproducible must be an object');
+  }
+  const { time, freeze_time: freeze, seed } = reproducible;
+  if (time === undefined && seed === undefined) {
+    throw Boom.badRequest('reproducible needs a time, a seed or both');
+  }
+  if (time !== undefined) {
+    const at = typeof time === 'string' ? Date.parse(time) : NaN;
+    if (!Number.isFinite(at) || at < 0 || new Date(at).getUTCFullYear() > 9999) {
+      throw Boom.badRequest('reproducible.time must be an ISO 8601 time from 1970 on');
+    }
+  }
+  if (freeze !== undefined) {
+    if (typeof freeze !== 'boolean') {
+      throw Boom.badRequest('reproducible.freeze_time must be a boolean');
+    }
+    if (freeze && time === undefined) {
+      throw Boom.badRequest('reproducible.freeze_time requires reproducible.time');
+    }
+  }
+  if (seed !== undefined && (!Number.isInteger(seed) || seed < 0 || seed > MAX_SEED)) {
+    throw Boom.badRequest(`reproducible.seed must be an integer from 0 to ${MAX_SEED}`);
+  }
+  // Wasm modules run in the API's own runtime rather than in a runner entrypoint.
+  if (request.isolation === 'wasm') {
+    throw Boom.badRequest('reproducible is not available with wasm isolation');
+  }
+  const supported = runner.reproducible ?? [];
+  if (time !== undefined && !supported.includes('time')) {
+    throw Boom.badRequest(`a fixed clock is not supported for ${runner.language}`);
+  }
+  if (seed !== undefined && !supported.includes('seed')) {
+    throw Boom.badRequest(`a random seed is not supported for ${runner.language}`);
+  }
+}
+
+// The variables that pass a validated request's options on to the runner.
+export function reproducibleEnvironment(reproducible: ReproducibleOptions | undefined): Record<string, string> {
+  const env: Record<string, string> = {};
+  if (reproducible?.time !== undefined) {
+    const at = new Date(reproducible.time).toISOString().slice(0, 19).replace('T', ' ');
+    env[FAKE_TIME_VARIABLE] = reproducible.freeze_time ? at : `@${at}`;
+  }
+  if (reproducible?.seed !== undefined) {
+    env[RANDOM_SEED_VARIABLE] = String(reproducible.seed);
+  }
+  return env;
+}
@@ -0,0 +1,111 @@
+import crypto from 'node:crypto';
+import type { RunLimits, RunRecord, RunRequest } from './types.js';
+
+export interface ResultCacheOptions {
+  // Results kept; the least recently used is dropped beyond this.
+  maxEntries: number;
+  // A result older than this is run again, e.g. to pick up a rebuilt runner image.
+  ttlMs: number;
+}
+
+export interface ResultCacheStats {
+  entries: number;
+  max_entries: number;
+  hits: number;
+  misses: number;
+}
+
+// Everything that decides what a deterministic run prints: the submission, its input, the
+// toolchain and the limits it ran under. Uploaded files count by content, files the API writes
+// itself (a judge checker's case data, a pipeline stage's earlier artifacts) by their contents.
+export interface ResultKeyParts {
+  request: RunRequest;
+  limits: RunLimits;
+  isolation: string;
+  files: Array<{ path: string; sha256: string }>;
+  inputs?: Record<string, string | Buffer>;
+}
+
+interface CachedResult {
+  run: RunRecord;
+  storedAt: number;
+}
+
+// Results of runs submitted as `deterministic`, so a resubmission of the same program with the
+// same input (a judge re-grading every submission, a student pressing Run twice) is answered from
+// the earlier run without reaching the sandbox. Only the caller can vouch that a program doesn't
+// read the clock or a random source, hence the flag. Kept in memory per server.
+export class ResultCache {
+  private readonly entries = new Map<string, CachedResult>();
+  private hits = 0;
+  private misses = 0;
+
+  constructor(private readonly options: ResultCacheOptions) { }
+
+  public key(parts: ResultKeyParts): string {
+    const { request } = parts;
+    const hash = crypto.createHash('sha256');
+    const sources = request.sources ?? {};
+    hash.update(`${request.language}\0${request.mode ?? 'run'}\0${request.version ?? ''}\0${parts.isolation}\0`);
+    hash.update(`${sha256(request.code ?? '')}\0${sha256(request.stdin ?? '')}\0`);
+    for (const name of Object.keys(sources).sort()) {
+      hash.update(`${name}\0${sha256(sources[name])}\0`);
+    }
+    hash.update(`${JSON.stringify(sortedLimits(parts.limits))}\0`);
+    hash.update(`${JSON.stringify(request.args ?? [])}\0${JSON.stringify(sortedEntries(request.env ?? {}))}\0`);
+    hash.update(`${JSON.stringify(request.build ?? {})}\0${JSON.stringify(request.lint ?? null)}\0${JSON.stringify(request.sql ?? null)}\0`);
+    hash.update(`${JSON.stringify(request.profile ?? null)}\0${Boolean(request.coverage)}\0`);
+    hash.update(`${request.on_output_limit ?? 'truncate'}\0${JSON.stringify(request.gpu ?? null)}\0`);
+    hash.update(`${JSON.stringify(request.template ?? null)}\0${JSON.stringify(request.reproducible ?? null)}\0`);
+    for (const file of [...parts.files].sort((a, b) => a.path.localeCompare(b.path))) {
+      hash.update(`${file.path}\0${file.sha256}\0`);
+    }
+    for (const [name, contents] of Object.entries(parts.inputs ?? {}).sort(([a], [b]) => a.localeCompare(b))) {
+      hash.update(`${name}\0${sha256(contents)}\0`);
+    }
+    return hash.digest('hex');
+  }
+
+  public get(key: string): RunRecord | null {
+    const entry = this.entries.get(key);
+    if (!entry || Date.now() - entry.storedAt > this.options.ttlMs) {
+      this.entries.delete(key);
+      this.misses++;
+      return null;
+    }
+    // Re-inserted so iteration order stays least recently used first.
+    this.entries.delete(key);
+    this.entries.set(key, entry);
+    this.hits++;
+    return entry.run;
+  }
+
+  // Canceled runs say nothing about the program, and artifacts are left to runs of their own since
+  // their download URLs expire.
+  public set(key: string, run: RunRecord) {
+    if (run.status === 'canceled' || run.artifacts.length > 0 || this.options.maxEntries === 0) {
+      return;
+    }
+    this.entries.delete(key);
+    this.entries.set(key, { run, storedAt: Date.now() });
+    while (this.entries.size > this.options.maxEntries) {
+      this.entries.delete(this.entries.keys().next().value as string);
+    }
+  }
+
+  public stats(): ResultCacheStats {
+    return { entries: this.entries.size, max_entries: this.options.maxEntries, hits: this.hits, misses: this.misses };
+  }
+}
+
+function sha256(text: string | Buffer) {
+  return crypto.createHash('sha256').update(text).digest('hex');
+}
+
+function sortedEntries(record: Record<string, string>) {
+  return Object.entries(record).sort(([a], [b]) => a.localeCompare(b));
+}
+
+function sortedLimits(limits: RunLimits) {
+  return Object.fromEntries(Object.entries(limits).sort(([a], [b]) => a.localeCompare(b)));
+}
@@ -0,0 +1,60 @@
+import crypto from 'node:crypto';
+import { canonicalJson } from './idempotency.js';
+import type { ResultSignature } from './types.js';
+
+// A public key as GET /v1/signing-keys lists it.
+export interface SigningKey {
+  algorithm: 'ed25519';
+  // First 16 hex digits of the SHA-256 of the key's DER encoding.
+  key_id: string;
+  // SPKI, PEM encoded.
+  public_key: string;
+}
+
+// Signs results with the deployment's Ed25519 key, given as a PKCS#8 PEM.
+export class ResultSigner {
+  public readonly key: SigningKey;
+  private readonly privateKey: crypto.KeyObject;
+
+  constructor(privateKeyPem: string) {
+    this.privateKey = crypto.createPrivateKey(privateKeyPem);
+    if (this.privateKey.asymmetricKeyType !== 'ed25519') {
+      throw new Error(`result signing key must be an Ed25519 private key, not ${this.privateKey.asymmetricKeyType}`);
+    }
+    const publicKey = crypto.createPublicKey(this.privateKey);
+    this.key = {
+      algorithm: 'ed25519',
+      key_id: keyId(publicKey),
+      public_key: publicKey.export({ type: 'spki', format: 'pem' }).toString()
+    };
+  }
+
+  public sign(result: object): ResultSignature {
+    const value = crypto.sign(null, Buffer.from(signedContent(result)), this.privateKey).toString('base64');
+    return { algorithm: 'ed25519', key_id: this.key.key_id, value };
+  }
+}
+
+// Whether the result carries a valid signature by the key, as a receiver would check it.
+export function verifyResult(result: { signature?: ResultSignature | null }, key: SigningKey): boolean {
+  const signature = result.signature;
+  if (!signature || signature.algorithm !== 'ed25519' || signature.key_id !== key.key_id) {
+    return false;
+  }
+  const publicKey = crypto.createPublicKey(key.public_key);
+  return crypto.verify(null, Buffer.from(signedContent(result)), publicKey, Buffer.from(signature.value, 'base64'));
+}
+
+// Inline artifact contents are left out along with the signature, since stored records drop them
+// and each artifact's sha256 already covers its bytes.
+function signedContent(result: object): string {
+  const { signature: _signature, ...content } = result as Record<string, unknown>;
+  if (Array.isArray(content.artifacts)) {
+    content.artifacts = content.artifacts.map(({ content: _content, ...artifact }: Record<string, unknown>) => artifact);
+  }
+  return canonicalJson(content);
+}
+
+function keyId(publicKey: crypto.KeyObject): string {
+  return crypto.createHash('sha256').update(publicKey.export({ type: 'spki', format: 'der' })).digest('hex').slice(0, 16);
+}
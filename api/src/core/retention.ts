@@ -0,0 +1,214 @@
+import type { ObjectStore } from './object_store.js';
+import type { ResultSigner } from './result_signing.js';
+import type { ArtifactStorage } from './storage.js';
+import type { ExecutionEvent, RunRecord } from './types.js';
+import type { ExecutionStore, SubmissionRecord } from '../store/store.js';
+import { Logger } from '../util/logger.js';
+
+export type RetentionAction = 'archive' | 'delete';
+
+export interface RetentionOptions {
+  // Executions that finished longer ago than this leave the execution store.
+  maxAgeMs: number;
+  // `archive` exports them to the archive store first, from where they can be restored.
+  action: RetentionAction;
+  // Required for `archive`.
+  archive?: ObjectStore;
+  store: ExecutionStore;
+  artifacts: ArtifactStorage;
+  // Signs restored records again when their artifact URLs are renewed.
+  signer?: ResultSigner;
+  // Executions taken per store query.
+  batchSize: number;
+}
+
+// An execution as exported, at `<id>/execution.json` in the archive store.
+export interface ArchivedExecution {
+  format: 1;
+  id: string;
+  archived_at: string;
+  submission: SubmissionRecord | null;
+  record: RunRecord | null;
+  error: string | null;
+  events: ExecutionEvent[];
+  // Artifacts the storage directory held, base64 encoded; those in a bucket stay where they are.
+  artifacts: Array<{ name: string; key: string; content_type: string; data: string }>;
+}
+
+export interface RetentionSweep {
+  archived: number;
+  deleted: number;
+  failed: number;
+}
+
+export interface RetentionStats {
+  sweeps: number;
+  archived: number;
+  deleted: number;
+  restored: number;
+  failed: number;
+  last_sweep_at: string | null;
+}
+
+// Keeps the execution store small: executions past their retention period are archived to object
+// storage, or deleted, with the artifacts kept in the storage directory. An archived execution
+// can be restored on demand, which starts its retention period over.
+export class RetentionSweeper {
+  private timer: NodeJS.Timeout | null = null;
+  private sweeping: Promise<RetentionSweep> | null = null;
+  private readonly totals: RetentionStats = { sweeps: 0, archived: 0, deleted: 0, restored: 0, failed: 0, last_sweep_at: null };
+
+  constructor(private readonly options: RetentionOptions, private readonly logger: Logger) {
+    if (options.action === 'archive' && !options.archive) {
+      throw new Error('retention needs an archive store to archive executions');
+    }
+  }
+
+  public start(intervalMs: number) {
+    void this.sweep();
+    this.timer = setInterval(() => void this.sweep(), intervalMs);
+    this.timer.unref();
+  }
+
+  public stop() {
+    if (this.timer) {
+      clearInterval(this.timer);
+      this.timer = null;
+    }
+  }
+
+  // Overlapping calls share the sweep in progress.
+  public sweep(now = Date.now()): Promise<RetentionSweep> {
+    if (!this.sweeping) {
+      this.sweeping = this.collect(now).finally(() => {
+        this.sweeping = null;
+      });
+    }
+    return this.sweeping;
+  }
+
+  public stats(): RetentionStats {
+    return { ...this.totals };
+  }
+
+  // Whether the archive holds the execution, so that lookups can tell it from an unknown one.
+  public async isArchived(id: string): Promise<boolean> {
+    return Boolean(this.options.archive && (await this.options.archive.get(archiveKey(id))));
+  }
+
+  // Puts an archived execution back into the store with its artifacts and removes it from the
+  // archive. Resolves to false when the archive has no such execution.
+  public async restore(id: string): Promise<boolean> {
+    const { archive, store, artifacts, signer } = this.options;
+    const data = archive ? await archive.get(archiveKey(id)) : null;
+    if (!data) {
+      return false;
+    }
+    const archived = JSON.parse(data.toString('utf8')) as ArchivedExecution;
+    const record = archived.record ? { ...archived.record, artifacts: [...archived.record.artifacts] } : null;
+    for (const artifact of archived.artifacts) {
+      const renewed = await artifacts.restoreArtifact(artifact.key, Buffer.from(artifact.data, 'base64'), artifact.content_type);
+      if (record) {
+        record.artifacts = record.artifacts.map((entry) => (entry.name === artifact.name ? { ...entry, ...renewed } : entry));
+      }
+    }
+    if (record && archived.artifacts.length > 0) {
+      // The old signature covered the old URLs.
+      record.signature = signer?.sign(record) ?? null;
+    }
+    if (archived.submission) {
+      await store.saveSubmission(archived.submission);
+    }
+    for (const event of archived.events) {
+      await store.appendEvent(id, event);
+    }
+    if (record) {
+      await store.save(record);
+    } else if (archived.error !== null) {
+      await store.saveError(id, archived.error);
+    }
+    await archive!.delete(archiveKey(id));
+    this.totals.restored++;
+    this.logger.info('restored archived execution', { id });
+    return true;
+  }
+
+  private async collect(now: number): Promise<RetentionSweep> {
+    const cutoff = new Date(now - this.options.maxAgeMs).toISOString();
+    const result: RetentionSweep = { archived: 0, deleted: 0, failed: 0 };
+    // Batches continue while they come back full; one with a failure ends the sweep, since the
+    // next query would return the same execution again.
+    for (;;) {
+      const ids = await this.options.store.listFinished(cutoff, this.options.batchSize).catch((err: Error) => {
+        this.logger.warn('could not list expired executions', { message: err.message });
+        return [];
+      });
+      const failedBefore = result.failed;
+      for (const id of ids) {
+        try {
+          if (this.options.action === 'archive') {
+            await this.archiveExecution(id, now);
+            result.archived++;
+          } else {
+            await this.deleteExecution(id);
+            result.deleted++;
+          }
+        } catch (err) {
+          result.failed++;
+          this.logger.warn('could not expire execution', { id, message: (err as Error).message });
+        }
+      }
+      if (ids.length < this.options.batchSize || result.failed > failedBefore) {
+        break;
+      }
+    }
+    this.totals.sweeps++;
+    this.totals.archived += result.archived;
+    this.totals.deleted += result.deleted;
+    this.totals.failed += result.failed;
+    this.totals.last_sweep_at = new Date(now).toISOString();
+    if (result.archived + result.deleted + result.failed > 0) {
+      this.logger.info('expired executions', { ...result });
+    }
+    return result;
+  }
+
+  private async archiveExecution(id: string, now: number) {
+    const { store, artifacts } = this.options;
+    const record = await store.get(id);
+    const archived: ArchivedExecution = {
+      format: 1,
+      id,
+      archived_at: new Date(now).toISOString(),
+      submission: await store.getSubmission(id),
+      record,
+      error: await store.getError(id),
+      events: await store.listEvents(id),
+      artifacts: []
+    };
+    for (const artifact of record?.artifacts ?? []) {
+      const key = artifacts.localArtifactKey(artifact);
+      const data = key ? await artifacts.readArtifact(key) : null;
+      if (key && data) {
+        archived.artifacts.push({ name: artifact.name, key, content_type: artifact.content_type, data: data.toString('base64') });
+      }
+    }
+    await this.options.archive!.put(archiveKey(id), Buffer.from(JSON.stringify(archived)), 'application/json');
+    await this.deleteExecution(id, record);
+  }
+
+  private async deleteExecution(id: string, record?: RunRecord | null) {
+    const { store, artifacts } = this.options;
+    for (const artifact of (record === undefined ? await store.get(id) : record)?.artifacts ?? []) {
+      const key = artifacts.localArtifactKey(artifact);
+      if (key) {
+        await artifacts.deleteArtifact(key);
+      }
+    }
+    await store.deleteExecution(id);
+  }
+}
+
+function archiveKey(id: string) {
+  return `${id}/execution.json`;
+}
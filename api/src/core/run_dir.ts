@@ -0,0 +1,509 @@
+import fs from 'node:fs';
+import path from 'node:path';
+import Boom from '@hapi/boom';
+import type {
+  CoverageReport,
+  Diagnostic,
+  QueryResult,
+  LimitKind,
+  MemoryReport,
+  MemoryWarning,
+  OutputLimitAction,
+  OutputStream,
+  PhaseResult,
+  RunAsUser,
+  RunUsage,
+  SandboxResult,
+  SandboxRunSpec,
+  TestCase,
+  TimeoutReport,
+  UsageSample,
+  UsageSeries
+} from './types.js';
+import type { RunnerDefinition } from './runners.js';
+
+// Helpers shared by every SandboxRunner backend: laying out the per-run directory the runner
+// entrypoints expect, and turning what they leave behind into a SandboxResult.
+
+export interface UsageReport {
+  usage: RunUsage;
+  limitExceeded: LimitKind | null;
+  // How the program was stopped once it reached timeout_ms.
+  timeout: TimeoutReport | null;
+  // Name of the signal that ended the program, e.g. SIGSEGV.
+  exitSignal: string | null;
+  compile: PhaseResult | null;
+  toolchain: string | null;
+  // Digest of .build/ taken right after compilation, before submission code ran.
+  buildDigest: string | null;
+  // Test cases reported by a test-mode run.
+  tests: TestCase[] | null;
+  // Line coverage of a test-mode run that asked for it.
+  coverage: CoverageReport | null;
+  // Diagnostics of a run that asked for lint.
+  diagnostics: Diagnostic[] | null;
+  // Statement results of a sql run.
+  results: QueryResult[] | null;
+  // Output the entrypoint discarded past the per-stream caps.
+  droppedBytes: Record<OutputStream, number>;
+}
+
+export function prepareRunDir(runner: RunnerDefinition, spec: SandboxRunSpec) {
+  const runDir = spec.workdir;
+  fs.mkdirSync(runDir, { recursive: true });
+  if (spec.code) {
+    fs.writeFileSync(path.join(runDir, runner.entryFile), spec.code, { encoding: 'utf8' });
+  }
+  writeSources(runDir, spec.sources);
+  stageFiles(runDir, spec.stagedFiles);
+  return runDir;
+}
+
+export function writeSources(runDir: string, sources: SandboxRunSpec['sources']) {
+  for (const [sourcePath, contents] of Object.entries(sources)) {
+    if (!isRelativeInside(sourcePath)) {
+      continue;
+    }
+    const dest = path.join(runDir, sourcePath);
+    refuseSymlinks(runDir, dest);
+    fs.mkdirSync(path.dirname(dest), { recursive: true });
+    fs.writeFileSync(dest, contents, { encoding: 'utf8' });
+  }
+}
+
+export function stageFiles(runDir: string, files: SandboxRunSpec['stagedFiles']) {
+  for (const file of files) {
+    if (!isRelativeInside(file.destPath)) {
+      continue;
+    }
+    const dest = path.join(runDir, 'inputs', file.destPath);
+    refuseSymlinks(runDir, dest);
+    fs.mkdirSync(path.dirname(dest), { recursive: true });
+    fs.copyFileSync(file.sourcePath, dest);
+  }
+}
+
+// Whether a submitted path stays inside the directory it is joined to: relative, and without a
+// `..` segment. Names that merely contain two dots, like `a..b.py`, are fine.
+export function isRelativeInside(relativePath: string) {
+  return !path.isAbsolute(relativePath) && !relativePath.split('/').includes('..');
+}
+
+// Paths are checked when the request is accepted, but a run directory the API did not lay out
+// itself, such as a warm container's, could already hold a link that a write would follow out of
+// it; every existing step from runDir down to dest must be a plain directory or file.
+function refuseSymlinks(runDir: string, dest: string) {
+  let current = runDir;
+  for (const segment of path.relative(runDir, dest).split(path.sep)) {
+    current = path.join(current, segment);
+    const stat = fs.lstatSync(current, { throwIfNoEntry: false });
+    if (!stat) {
+      return;
+    }
+    if (stat.isSymbolicLink()) {
+      throw Boom.badRequest(`invalid source path: ${path.relative(runDir, dest)} goes through a symlink`);
+    }
+  }
+}
+
+// Gives the run directory to the user submissions run as, so the program can write its outputs
+// but nothing the API wrote outside it. Needs CAP_CHOWN, i.e. an executor running as root.
+export function handOverRunDir(runDir: string, user: RunAsUser) {
+  fs.chownSync(runDir, user.uid, user.gid);
+  for (const entry of fs.readdirSync(runDir, { recursive: true, encoding: 'utf8' })) {
+    fs.lchownSync(path.join(runDir, entry), user.uid, user.gid);
+  }
+}
+
+// Reads the usage.json written by the runner entrypoint, falling back to the configured limits
+// when the runner died before it could write one, except for the memory a backend that samples
+// it saw the run reach.
+export function readUsageReport(runDir: string, limits: SandboxRunSpec['limits'], sampledPeakMb: number | null = null): UsageReport {
+  const usagePath = path.join(runDir, 'usage.json');
+  const maxRssMb = sampledPeakMb === null ? limits.memory_mb : Math.round(sampledPeakMb);
+  const report: UsageReport = {
+    usage: { wall_ms: limits.timeout_ms, cpu_ms: limits.cpu_ms, user_cpu_ms: null, system_cpu_ms: null, max_rss_mb: maxRssMb },
+    limitExceeded: null,
+    timeout: null,
+    exitSignal: null,
+    compile: null,
+    toolchain: null,
+    buildDigest: null,
+    tests: null,
+    coverage: null,
+    diagnostics: null,
+    results: null,
+    droppedBytes: { stdout: 0, stderr: 0 }
+  };
+  if (!fs.existsSync(usagePath)) {
+    return report;
+  }
+  const reported = JSON.parse(fs.readFileSync(usagePath, 'utf8')) as RunUsage & {
+    limit_exceeded?: LimitKind | null;
+    timeout?: TimeoutReport | null;
+    signal?: string | null;
+    compile?: PhaseResult | null;
+    toolchain?: string | null;
+    build_digest?: string | null;
+    tests?: TestCase[] | null;
+    coverage?: CoverageReport | null;
+    diagnostics?: Diagnostic[] | null;
+    results?: QueryResult[] | null;
+    dropped_bytes?: Partial<Record<OutputStream, number>>;
+  };
+  const {
+    limit_exceeded: reportedLimit,
+    timeout: reportedTimeout,
+    signal: reportedSignal,
+    compile: reportedCompile,
+    toolchain: reportedToolchain,
+    build_digest: reportedDigest,
+    tests: reportedTests,
+    coverage: reportedCoverage,
+    diagnostics: reportedDiagnostics,
+    results: reportedResults,
+    dropped_bytes: reportedDropped,
+    ...measured
+  } = reported;
+  report.usage = { ...measured, user_cpu_ms: measured.user_cpu_ms ?? null, system_cpu_ms: measured.system_cpu_ms ?? null };
+  report.limitExceeded = reportedLimit ?? null;
+  report.timeout = reportedTimeout ?? null;
+  report.exitSignal = reportedSignal ?? null;
+  report.compile = reportedCompile ?? null;
+  report.toolchain = reportedToolchain ?? null;
+  report.buildDigest = reportedDigest ?? null;
+  report.tests = reportedTests ?? null;
+  report.coverage = reportedCoverage ?? null;
+  report.diagnostics = reportedDiagnostics ?? null;
+  report.results = reportedResults ?? null;
+  report.droppedBytes = { stdout: reportedDropped?.stdout ?? 0, stderr: reportedDropped?.stderr ?? 0 };
+  return report;
+}
+
+export function classifyExit(
+  code: number | null,
+  signal: NodeJS.Signals | null,
+  reportedLimit: LimitKind | null,
+  onOutputLimit: OutputLimitAction = 'truncate'
+): { status: SandboxResult['status']; limitExceeded: LimitKind | null } {
+  if (reportedLimit === 'disk' || (reportedLimit === 'output' && onOutputLimit === 'kill')) {
+    // Killed by watchDiskUsage or for passing an output cap, the same way a timeout is.
+    return { status: 'killed', limitExceeded: reportedLimit };
+  }
+  if (reportedLimit === 'processes' && code !== 0) {
+    // A refused fork is what brought the run down, even when a timeout or signal followed.
+    return { status: 'killed', limitExceeded: reportedLimit };
+  }
+  if (signal === 'SIGKILL' || code === 124 || reportedLimit === 'wall_time') {
+    return { status: 'timeout', limitExceeded: 'wall_time' };
+  }
+  // A program killed at its CPU limit exits with 137 like one the OOM killer took.
+  if (reportedLimit === 'cpu_time') {
+    return { status: 'killed', limitExceeded: reportedLimit };
+  }
+  if (code === 137 || reportedLimit === 'memory') {
+    // The kernel OOM killer stopped the program, or the whole container, once it hit --memory.
+    return { status: 'oom', limitExceeded: 'memory' };
+  }
+  return { status: code === 0 ? 'succeeded' : 'failed', limitExceeded: reportedLimit };
+}
+
+export interface DiskWatch {
+  readonly exceeded: boolean;
+  stop(): void;
+}
+
+// Created in the run directory by the entrypoints once the build is done and the program starts.
+export const RUN_STARTED_MARKER = '.run_started';
+
+const DISK_POLL_MS = 250;
+const RUN_START_POLL_MS = 100;
+const MEMORY_POLL_MS = 250;
+// Samples a run's usage series keeps unless the spec sets maxUsageSamples.
+const DEFAULT_MAX_USAGE_SAMPLES = 1000;
+
+// Calls onStarted once the entrypoint creates RUN_STARTED_MARKER, so callers following a run can
+// tell its compile phase from the program's. Polled, like the disk usage, since the entrypoint
+// has no channel to the API but its output.
+export function watchRunStart(runDir: string, onStarted: () => void): { stop(): void } {
+  let timer: NodeJS.Timeout | undefined;
+  const poll = () => {
+    if (fs.existsSync(path.join(runDir, RUN_STARTED_MARKER))) {
+      onStarted();
+      return;
+    }
+    timer = setTimeout(poll, RUN_START_POLL_MS);
+  };
+  timer = setTimeout(poll, RUN_START_POLL_MS);
+  return {
+    stop() {
+      clearTimeout(timer);
+    }
+  };
+}
+
+// Polls how much the run directory has grown since the sandbox started and calls onExceeded once
+// that passes disk_mb; files staged before the run do not count. Neither backend has a per-run
+// filesystem quota, so this is what keeps a program from filling the host disk. Between polls it
+// can overshoot by whatever gets written in DISK_POLL_MS, and the entrypoints' RLIMIT_FSIZE still
+// bounds each single file.
+export function watchDiskUsage(runDir: string, limits: SandboxRunSpec['limits'], onExceeded: () => void): DiskWatch {
+  const limitBytes = limits.disk_mb * 1024 * 1024;
+  let exceeded = false;
+  let stopped = false;
+  let timer: NodeJS.Timeout | undefined;
+  const baseline = diskUsage(runDir);
+  const poll = async () => {
+    const used = (await diskUsage(runDir)) - (await baseline);
+    if (stopped) {
+      return;
+    }
+    if (used > limitBytes) {
+      exceeded = true;
+      onExceeded();
+      return;
+    }
+    timer = setTimeout(poll, DISK_POLL_MS);
+  };
+  timer = setTimeout(poll, DISK_POLL_MS);
+  return {
+    get exceeded() {
+      return exceeded;
+    },
+    stop() {
+      stopped = true;
+      clearTimeout(timer);
+    }
+  };
+}
+
+// What the sandbox holds and has used, or null while the backend cannot tell, e.g. before its
+// container exists.
+export interface UsageReading {
+  // Megabytes held at the time of the reading.
+  memoryMb: number;
+  // The most held since the sandbox started, where the kernel keeps it.
+  peakMb?: number;
+  // CPU time of every process in the sandbox so far, null when the backend cannot read it.
+  cpuMs: number | null;
+}
+
+export type UsageProbe = () => Promise<UsageReading | null>;
+
+export interface UsageWatch {
+  // Highest memory reading so far, null before the first.
+  readonly peakMb: number | null;
+  readonly warnings: MemoryWarning[];
+  // Null unless the spec asked for samples and there is a probe to take them.
+  readonly series: UsageSeries | null;
+  stop(): void;
+}
+
+// Samples the sandbox through probe: every MEMORY_POLL_MS for its peak memory, calling
+// spec.onMemoryPressure the first time it passes each of spec.memoryWarnings, and every
+// spec.usageIntervalMs, when set, for the series of CPU and memory readings the result carries.
+// Polled, like the disk usage; a spike shorter than MEMORY_POLL_MS can pass unseen unless the
+// probe reads a peak the kernel keeps. Backends without a probe pass null and get a watch that
+// never samples.
+export function watchUsage(spec: SandboxRunSpec, probe: UsageProbe | null): UsageWatch {
+  const limitMb = spec.limits.memory_mb;
+  const pending = [...new Set(spec.memoryWarnings ?? [])].sort((a, b) => a - b);
+  const warnings: MemoryWarning[] = [];
+  const startedMs = Date.now();
+  const maxSamples = Math.max(spec.maxUsageSamples ?? DEFAULT_MAX_USAGE_SAMPLES, 2);
+  const series: UsageSeries | null = probe && spec.usageIntervalMs ? { interval_ms: spec.usageIntervalMs, samples: [] } : null;
+  let previous = { elapsedMs: 0, cpuMs: 0 };
+  let peakMb: number | null = null;
+  let stopped = false;
+  let memoryTimer: NodeJS.Timeout | undefined;
+  let sampleTimer: NodeJS.Timeout | undefined;
+  const read = async () => {
+    const reading = await (probe as UsageProbe)().catch(() => null);
+    if (stopped || reading === null) {
+      return null;
+    }
+    const used = Math.max(reading.memoryMb, reading.peakMb ?? 0);
+    peakMb = Math.max(peakMb ?? 0, used);
+    // A jump past several thresholds at once reports each of them.
+    while (pending.length > 0 && used >= (limitMb * pending[0]) / 100) {
+      const warning = {
+        threshold_pct: pending.shift() as number,
+        used_mb: roundTenth(used),
+        limit_mb: limitMb,
+        elapsed_ms: Date.now() - startedMs
+      };
+      warnings.push(warning);
+      spec.onMemoryPressure?.(warning);
+    }
+    return reading;
+  };
+  const poll = async () => {
+    await read();
+    if (!stopped) {
+      memoryTimer = setTimeout(poll, MEMORY_POLL_MS);
+    }
+  };
+  const sample = async (target: UsageSeries) => {
+    const reading = await read();
+    if (stopped) {
+      return;
+    }
+    if (reading) {
+      const elapsedMs = Date.now() - startedMs;
+      const { cpuMs } = reading;
+      const taken: UsageSample = {
+        elapsed_ms: elapsedMs,
+        memory_mb: roundTenth(reading.memoryMb),
+        cpu_ms: cpuMs === null ? null : Math.round(cpuMs),
+        cpu_pct: cpuMs === null || elapsedMs <= previous.elapsedMs
+          ? null
+          : roundTenth(Math.max(0, (cpuMs - previous.cpuMs) / (elapsedMs - previous.elapsedMs)) * 100)
+      };
+      previous = { elapsedMs, cpuMs: cpuMs ?? 0 };
+      target.samples.push(taken);
+      // Thinned rather than cut off, so that the series still covers the whole run; the latest
+      // reading stays so that the ones after it keep the same spacing.
+      const { samples } = target;
+      if (samples.length > maxSamples) {
+        target.samples = samples.filter((_, index) => index % 2 === (samples.length - 1) % 2);
+        target.interval_ms *= 2;
+      }
+      spec.onUsageSample?.(taken);
+    }
+    sampleTimer = setTimeout(sample, target.interval_ms, target);
+  };
+  if (probe) {
+    memoryTimer = setTimeout(poll, MEMORY_POLL_MS);
+    if (series) {
+      sampleTimer = setTimeout(sample, series.interval_ms, series);
+    }
+  }
+  return {
+    get peakMb() {
+      return peakMb;
+    },
+    warnings,
+    series,
+    stop() {
+      stopped = true;
+      clearTimeout(memoryTimer);
+      clearTimeout(sampleTimer);
+    }
+  };
+}
+
+// How close the finished run came to its memory limit, by the runner's report and the samples.
+export function memoryReport(usage: RunUsage, limits: SandboxRunSpec['limits'], watch: UsageWatch): MemoryReport {
+  const peakMb = roundTenth(Math.max(usage.max_rss_mb, watch.peakMb ?? 0));
+  return {
+    limit_mb: limits.memory_mb,
+    peak_mb: peakMb,
+    peak_pct: limits.memory_mb > 0 ? roundTenth((peakMb / limits.memory_mb) * 100) : 0,
+    sampled: watch.peakMb !== null,
+    warnings: watch.warnings
+  };
+}
+
+function roundTenth(value: number) {
+  return Math.round(value * 10) / 10;
+}
+
+// Allocated bytes below dir, walked asynchronously so a directory with many files does not
+// block the event loop. Entries removed mid-walk are skipped.
+async function diskUsage(dir: string): Promise<number> {
+  const entries = await fs.promises.readdir(dir, { withFileTypes: true }).catch(() => []);
+  let total = 0;
+  for (const entry of entries) {
+    const entryPath = path.join(dir, entry.name);
+    const stat = await fs.promises.lstat(entryPath).catch(() => null);
+    total += stat ? stat.blocks * 512 : 0;
+    if (entry.isDirectory()) {
+      total += await diskUsage(entryPath);
+    }
+  }
+  return total;
+}
+
+// Result for a run canceled before its sandbox started; nothing ran, so nothing was used.
+export function canceledResult(): SandboxResult {
+  return {
+    status: 'canceled',
+    exitCode: null,
+    limitExceeded: null,
+    stdout: Buffer.alloc(0),
+    stderr: Buffer.alloc(0),
+    usage: { wall_ms: 0, cpu_ms: 0, max_rss_mb: 0 },
+    artifacts: []
+  };
+}
+
+// Resolves with null as soon as `signal` aborts. The underlying work keeps running, which suits
+// steps shared between runs such as dependency installs.
+export function unlessAborted<T>(promise: Promise<T>, signal?: AbortSignal): Promise<T | null> {
+  if (!signal) {
+    return promise;
+  }
+  if (signal.aborted) {
+    return Promise.resolve(null);
+  }
+  return new Promise<T | null>((resolve, reject) => {
+    const onAbort = () => resolve(null);
+    signal.addEventListener('abort', onAbort, { once: true });
+    promise.then(
+      (value) => {
+        signal.removeEventListener('abort', onAbort);
+        resolve(value);
+      },
+      (err) => {
+        signal.removeEventListener('abort', onAbort);
+        reject(err);
+      }
+    );
+  });
+}
+
+export interface OutputCapture {
+  push(stream: OutputStream, chunk: Buffer): void;
+  stdout(): Buffer;
+  stderr(): Buffer;
+  // Bytes that arrived past the caps, which entrypoints normally drop before the backend sees them.
+  dropped: Record<OutputStream, number>;
+}
+
+// Keeps at most max_stdout_bytes and max_stderr_bytes of a run's output in memory and forwards the
+// same bytes to the onOutput listener, so a runner that ignores its caps cannot exhaust the API's
+// memory. onOverflow runs once, when the first byte past a cap arrives.
+export function captureOutput(spec: SandboxRunSpec, onOverflow: () => void): OutputCapture {
+  const caps = { stdout: spec.limits.max_stdout_bytes, stderr: spec.limits.max_stderr_bytes };
+  const chunks: Record<OutputStream, Buffer[]> = { stdout: [], stderr: [] };
+  const kept = { stdout: 0, stderr: 0 };
+  const dropped = { stdout: 0, stderr: 0 };
+  return {
+    push(stream, chunk) {
+      const part = chunk.subarray(0, Math.max(0, caps[stream] - kept[stream]));
+      if (part.length < chunk.length) {
+        if (dropped.stdout === 0 && dropped.stderr === 0) {
+          onOverflow();
+        }
+        dropped[stream] += chunk.length - part.length;
+      }
+      if (part.length === 0) {
+        return;
+      }
+      kept[stream] += part.length;
+      chunks[stream].push(part);
+      spec.onOutput?.(stream, part);
+    },
+    stdout: () => Buffer.concat(chunks.stdout),
+    stderr: () => Buffer.concat(chunks.stderr),
+    dropped
+  };
+}
+
+// Adds what the backend dropped to what the entrypoint reported dropping.
+export function totalDropped(report: UsageReport, capture: OutputCapture): Record<OutputStream, number> {
+  return {
+    stdout: report.droppedBytes.stdout + capture.dropped.stdout,
+    stderr: report.droppedBytes.stderr + capture.dropped.stderr
+  };
+}
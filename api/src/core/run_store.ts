@@ -1,13 +1,301 @@
-import type { RunRecord } from './types.js';
+import { similarity } from './fingerprint.js';
+import type { ExecutionEvent, RunRecord } from './types.js';
+import type {
+  ApiKeyRecord,
+  ApiKeyStore,
+  ExecutionCursor,
+  ExecutionFilter,
+  ExecutionStore,
+  ExecutionSummary,
+  ScheduleRecord,
+  ScheduleRunRecord,
+  ScheduleStore,
+  SettingsStore,
+  SimilarExecution,
+  SimilarityQuery,
+  SubmissionRecord,
+  UsageQuery,
+  UsageTotals
+} from '../store/store.js';
+import { withoutInlineContent } from '../store/store.js';
 
-export class RunStore {
+// In-memory execution store, the default; everything is lost when the process exits.
+export class RunStore implements ExecutionStore, ApiKeyStore, SettingsStore, ScheduleStore {
+  private readonly submissions = new Map<string, SubmissionRecord>();
   private readonly runs = new Map<string, RunRecord>();
+  private readonly errors = new Map<string, string>();
+  private readonly apiKeys = new Map<string, ApiKeyRecord>();
+  private readonly settings = new Map<string, string>();
+  private readonly events = new Map<string, ExecutionEvent[]>();
+  private readonly requeued = new Set<string>();
+  private readonly finishedAt = new Map<string, string>();
+  private readonly schedules = new Map<string, ScheduleRecord>();
+  private readonly scheduleRuns = new Map<string, ScheduleRunRecord[]>();
+  private readonly fingerprints = new Map<string, Set<number>>();
 
-  public save(run: RunRecord) {
-    this.runs.set(run.id, run);
+  public async saveSubmission(submission: SubmissionRecord) {
+    this.submissions.set(submission.id, submission);
   }
 
-  public get(id: string) {
+  public async save(run: RunRecord) {
+    this.runs.set(run.id, withoutInlineContent(run));
+    this.finish(run.id);
+  }
+
+  public async get(id: string) {
     return this.runs.get(id) ?? null;
   }
+
+  public async saveError(id: string, message: string) {
+    this.errors.set(id, message);
+    this.finish(id);
+  }
+
+  public async getError(id: string) {
+    return this.errors.get(id) ?? null;
+  }
+
+  public async getSubmission(id: string) {
+    return this.submissions.get(id) ?? null;
+  }
+
+  public async failUnfinished(createdBefore: string, message: string) {
+    let count = 0;
+    for (const submission of this.submissions.values()) {
+      const unfinished = !this.runs.has(submission.id) && !this.errors.has(submission.id) && !this.requeued.has(submission.id);
+      if (submission.created_at < createdBefore && unfinished) {
+        this.errors.set(submission.id, message);
+        this.finish(submission.id);
+        count++;
+      }
+    }
+    return count;
+  }
+
+  public async requeueSubmission(id: string) {
+    if (this.submissions.has(id) && !this.runs.has(id) && !this.errors.has(id)) {
+      this.requeued.add(id);
+    }
+  }
+
+  public async listExecutions(filter: ExecutionFilter, limit: number, after?: ExecutionCursor) {
+    const isAfter = (submission: SubmissionRecord) =>
+      !after || submission.created_at < after.created_at || (submission.created_at === after.created_at && submission.id < after.id);
+    return [...this.submissions.values()]
+      .filter(isAfter)
+      .sort((a, b) => b.created_at.localeCompare(a.created_at) || b.id.localeCompare(a.id))
+      .map((submission) => [this.summarize(submission), submission] as const)
+      .filter(([execution, submission]) => matches(filter, execution, submission))
+      .slice(0, limit)
+      .map(([execution]) => execution);
+  }
+
+  public async saveFingerprint(id: string, hashes: number[]) {
+    this.fingerprints.set(id, new Set(hashes));
+  }
+
+  public async getFingerprint(id: string) {
+    return [...(this.fingerprints.get(id) ?? [])].sort((a, b) => a - b);
+  }
+
+  public async findSimilar(query: SimilarityQuery, limit: number) {
+    const hashes = new Set(query.hashes);
+    const found: SimilarExecution[] = [];
+    for (const [id, stored] of this.fingerprints) {
+      const submission = this.submissions.get(id);
+      if (id === query.exclude_id || !submission) {
+        continue;
+      }
+      const execution = this.summarize(submission);
+      const shared = [...stored].filter((hash) => hashes.has(hash)).length;
+      const score = similarity(shared, hashes.size, stored.size);
+      if (shared > 0 && score >= query.threshold && matches(query.filter, execution, submission)) {
+        found.push({ ...execution, shared, similarity: score });
+      }
+    }
+    return found
+      .sort((a, b) => b.similarity - a.similarity || b.created_at.localeCompare(a.created_at) || b.id.localeCompare(a.id))
+      .slice(0, limit);
+  }
+
+  public async listFinished(finishedBefore: string, limit: number) {
+    return [...this.finishedAt]
+      .filter(([, at]) => at < finishedBefore)
+      .sort(([, a], [, b]) => a.localeCompare(b))
+      .slice(0, limit)
+      .map(([id]) => id);
+  }
+
+  public async deleteExecution(id: string) {
+    for (const entries of [this.submissions, this.runs, this.errors, this.events, this.finishedAt, this.fingerprints]) {
+      entries.delete(id);
+    }
+    this.requeued.delete(id);
+  }
+
+  public async claimRequeued() {
+    const claimed = [...this.requeued].map((id) => this.submissions.get(id) as SubmissionRecord);
+    this.requeued.clear();
+    return claimed.sort((a, b) => a.created_at.localeCompare(b.created_at));
+  }
+
+  public async findSubmission(apiKey: string, idempotencyKey: string, since: string) {
+    let latest: SubmissionRecord | null = null;
+    for (const submission of this.submissions.values()) {
+      if (
+        submission.api_key === apiKey &&
+        submission.idempotency_key === idempotencyKey &&
+        submission.created_at >= since &&
+        (!latest || submission.created_at > latest.created_at)
+      ) {
+        latest = submission;
+      }
+    }
+    return latest;
+  }
+
+  public async countSubmissions(since: string) {
+    const counts: Record<string, number> = {};
+    for (const submission of this.submissions.values()) {
+      if (submission.created_at >= since) {
+        counts[submission.api_key] = (counts[submission.api_key] ?? 0) + 1;
+      }
+    }
+    return counts;
+  }
+
+  public async sumCosts(query: UsageQuery) {
+    const groups = new Map<string, UsageTotals>();
+    for (const submission of this.submissions.values()) {
+      const run = this.runs.get(submission.id);
+      if (!run || submission.created_at < query.since || submission.created_at >= query.until ||
+        (query.api_key !== undefined && submission.api_key !== query.api_key) ||
+        (query.tenant !== undefined && submission.tenant !== query.tenant)) {
+        continue;
+      }
+      const fields = {
+        api_key: submission.api_key,
+        tenant: submission.tenant ?? null,
+        day: submission.created_at.slice(0, 10)
+      };
+      const group: Partial<UsageTotals> = Object.fromEntries(query.group_by.map((dimension) => [dimension, fields[dimension]]));
+      const key = JSON.stringify(query.group_by.map((dimension) => fields[dimension]));
+      const totals = groups.get(key) ?? { ...group, executions: 0, cpu_seconds: 0, memory_gb_seconds: 0, sandbox_seconds: 0, units: 0 };
+      totals.executions += 1;
+      totals.cpu_seconds += run.cost?.cpu_seconds ?? 0;
+      totals.memory_gb_seconds += run.cost?.memory_gb_seconds ?? 0;
+      totals.sandbox_seconds += run.cost?.sandbox_seconds ?? 0;
+      totals.units += run.cost?.units ?? 0;
+      groups.set(key, totals);
+    }
+    if (query.group_by.length === 0) {
+      return [groups.get('[]') ?? { executions: 0, cpu_seconds: 0, memory_gb_seconds: 0, sandbox_seconds: 0, units: 0 }];
+    }
+    const compare = (a: string | null | undefined, b: string | null | undefined) => a === b ? 0 : a == null ? -1 : b == null || a > b ? 1 : -1;
+    return [...groups.values()].sort((a, b) => {
+      for (const dimension of query.group_by) {
+        const order = compare(a[dimension], b[dimension]);
+        if (order !== 0) {
+          return order;
+        }
+      }
+      return 0;
+    });
+  }
+
+  public async appendEvent(id: string, event: ExecutionEvent) {
+    this.events.set(id, [...(this.events.get(id) ?? []), event]);
+  }
+
+  public async listEvents(id: string) {
+    return [...(this.events.get(id) ?? [])].sort((a, b) => a.seq - b.seq);
+  }
+
+  public async listApiKeys() {
+    return [...this.apiKeys.values()];
+  }
+
+  public async saveApiKey(key: ApiKeyRecord) {
+    this.apiKeys.set(key.id, key);
+  }
+
+  public async deleteApiKey(id: string) {
+    return this.apiKeys.delete(id);
+  }
+
+  // Kept serialized, like the persistent backends, so callers never share the stored object.
+  public async getSetting(name: string) {
+    const value = this.settings.get(name);
+    return value === undefined ? null : JSON.parse(value);
+  }
+
+  public async saveSetting(name: string, value: unknown) {
+    this.settings.set(name, JSON.stringify(value));
+  }
+
+  public async listSchedules(apiKey?: string) {
+    return [...this.schedules.values()]
+      .filter((schedule) => apiKey === undefined || schedule.api_key === apiKey)
+      .sort((a, b) => a.created_at.localeCompare(b.created_at))
+      .map((schedule) => structuredClone(schedule));
+  }
+
+  public async getSchedule(id: string) {
+    const schedule = this.schedules.get(id);
+    return schedule ? structuredClone(schedule) : null;
+  }
+
+  public async saveSchedule(schedule: ScheduleRecord) {
+    const stored = this.schedules.get(schedule.id);
+    if (schedule.revision === 1 ? stored !== undefined : stored?.revision !== schedule.revision - 1) {
+      return false;
+    }
+    this.schedules.set(schedule.id, structuredClone(schedule));
+    return true;
+  }
+
+  public async deleteSchedule(id: string) {
+    this.scheduleRuns.delete(id);
+    return this.schedules.delete(id);
+  }
+
+  public async appendScheduleRun(run: ScheduleRunRecord, keep: number) {
+    this.scheduleRuns.set(run.schedule_id, [...(this.scheduleRuns.get(run.schedule_id) ?? []), run].slice(-keep));
+  }
+
+  public async listScheduleRuns(scheduleId: string, limit: number) {
+    return [...(this.scheduleRuns.get(scheduleId) ?? [])].reverse().slice(0, limit);
+  }
+
+  public async close() {
+    // Nothing to release.
+  }
+
+  private finish(id: string) {
+    this.finishedAt.set(id, new Date().toISOString());
+  }
+
+  private summarize(submission: SubmissionRecord): ExecutionSummary {
+    return {
+      id: submission.id,
+      language: submission.language,
+      status: this.runs.get(submission.id)?.status ?? (this.errors.has(submission.id) ? 'error' : this.requeued.has(submission.id) ? 'requeued' : 'pending'),
+      created_at: submission.created_at,
+      finished_at: this.finishedAt.get(submission.id) ?? null,
+      tenant: submission.tenant ?? null,
+      tags: submission.request.tags ?? [],
+      metadata: submission.request.metadata ?? {}
+    };
+  }
+}
+
+function matches(filter: ExecutionFilter, execution: ExecutionSummary, submission: SubmissionRecord) {
+  return (filter.api_key === undefined || submission.api_key === filter.api_key) &&
+    (filter.tenant === undefined || execution.tenant === filter.tenant) &&
+    (filter.language === undefined || execution.language === filter.language) &&
+    (filter.statuses === undefined || filter.statuses.includes(execution.status)) &&
+    (filter.created_after === undefined || execution.created_at >= filter.created_after) &&
+    (filter.created_before === undefined || execution.created_at < filter.created_before) &&
+    (filter.tag === undefined || execution.tags.includes(filter.tag)) &&
+    Object.entries(filter.metadata ?? {}).every(([key, value]) => execution.metadata[key] === value);
 }
@@ -0,0 +1,393 @@
+import Boom from '@hapi/boom';
+import type { IsolationLevel, Language, ProfileKind, ReproducibleKind } from './types.js';
+
+export interface RunnerDefinition {
+  language: Language;
+  image: string;
+  entryFile: string;
+  extensions: string[];
+  // Default max_processes for the language's runs.
+  pidsLimit: number;
+  // Default max_open_files for the language's runs, when it needs more than the deployment's.
+  openFilesLimit?: number;
+  // Entrypoint script under runners/, used by backends that execute on the host instead of in
+  // the image (e.g. the process backend).
+  entrypoint?: string;
+  // Command run inside the runner image to report the toolchain version.
+  versionCommand: string[];
+  // Trivial program whose last line of output is `ok`, which readiness checks compile and run to
+  // prove the toolchain works; runners without one are not probed.
+  probe?: string;
+  // Manifest (e.g. requirements.txt) that triggers a cached dependency install when submitted.
+  dependencyFile?: string;
+  // Files installed along with dependencyFile when submitted (e.g. go.sum), part of its cache key.
+  dependencyLockFiles?: string[];
+  // Whether every install adds to one cache per image, e.g. Go's module cache, which holds each
+  // module version once, instead of getting a layer of its own.
+  sharedDependencies?: boolean;
+  // Whether the install step is skipped, so nothing is downloaded and runs see only what the
+  // cache already holds.
+  offlineDependencies?: boolean;
+  // Build files of tools the runner does not drive, e.g. Gradle's for Java, keyed by name with the
+  // reason; a submission carrying one is refused rather than built as if it were not there.
+  unsupportedFiles?: Record<string, string>;
+  // Whether an interactive session may omit code to get the language's REPL.
+  repl?: boolean;
+  // Whether the entrypoint compiles into .build/ and can reuse a cached build from there.
+  compiled?: boolean;
+  // Whether the entrypoint supports test mode and reports the cases it ran.
+  tests?: boolean;
+  // Whether test mode can measure line coverage of the submission.
+  coverage?: boolean;
+  // Whether the entrypoint supports check mode: a parse or type check of the sources that stops
+  // short of building and running them.
+  syntaxCheck?: boolean;
+  // Whether the entrypoint can run static checks before the build and report their diagnostics.
+  lint?: boolean;
+  // Whether the entrypoint parses its compiler's errors and warnings into diagnostics.
+  diagnostics?: boolean;
+  // Profiles the entrypoint can capture while the program runs.
+  profiles?: ProfileKind[];
+  // What the entrypoint can fix for runs with `reproducible`; statically linked programs such as
+  // Go's read the clock without libc, out of libfaketime's reach.
+  reproducible?: ReproducibleKind[];
+  // Isolation levels runs may request; container, gvisor and microvm when unset. `wasm` runs
+  // go to the WasmSandbox instead of the runner's image.
+  isolation?: IsolationLevel[];
+  // Whether the entrypoint runs statements against a per-run database and reports their results.
+  queries?: boolean;
+  // Runner-specific settings forwarded verbatim to the entrypoint.
+  settings?: Record<string, string>;
+  // Whether container runs get a noexec tmpfs at /tmp, sized by disk_mb, so nothing the program
+  // writes there can be executed.
+  noexecTmp?: boolean;
+  // Environment of the runner's container, which unlike `settings` the entrypoint sees before
+  // the spec arrives, e.g. while a warm container waits for its run.
+  containerEnv?: Record<string, string>;
+}
+
+// Isolation levels of runners that do not list their own.
+export const DEFAULT_ISOLATION_LEVELS: IsolationLevel[] = ['container', 'gvisor', 'microvm'];
+
+// Runners that are switched off stay registered, so they can be switched on again, but look
+// unregistered to everything except all() and isEnabled().
+export class RunnerRegistry {
+  private readonly runners = new Map<Language, RunnerDefinition>();
+  private readonly disabled = new Set<Language>();
+
+  public register(definition: RunnerDefinition) {
+    if (this.runners.has(definition.language)) {
+      throw new Error(`runner already registered: ${definition.language}`);
+    }
+    this.runners.set(definition.language, {
+      ...definition,
+      image: process.env[`RUNNER_IMAGE_${definition.language.toUpperCase()}`] ?? definition.image
+    });
+  }
+
+  // Applies deployment configuration on top of a registered runner's definition, enabled or not.
+  public configure(language: Language, changes: Partial<Omit<RunnerDefinition, 'language'>>) {
+    const definition = this.runners.get(language);
+    if (!definition) {
+      throw Boom.badRequest('unsupported language');
+    }
+    this.runners.set(language, { ...definition, ...changes });
+  }
+
+  public unregister(language: Language) {
+    this.runners.delete(language);
+    this.disabled.delete(language);
+  }
+
+  public setEnabled(language: Language, enabled: boolean) {
+    if (!this.runners.has(language)) {
+      throw Boom.notFound(`no runner for ${language}`);
+    }
+    if (enabled) {
+      this.disabled.delete(language);
+    } else {
+      this.disabled.add(language);
+    }
+  }
+
+  // Whether the language has a runner at all, enabled or not.
+  public has(language: Language) {
+    return this.runners.has(language);
+  }
+
+  public isEnabled(language: Language) {
+    return this.runners.has(language) && !this.disabled.has(language);
+  }
+
+  public get(language: Language) {
+    return this.disabled.has(language) ? null : this.runners.get(language) ?? null;
+  }
+
+  public require(language: Language): RunnerDefinition {
+    const definition = this.get(language);
+    if (!definition) {
+      throw Boom.badRequest('unsupported language');
+    }
+    return definition;
+  }
+
+  public forExtension(extension: string) {
+    const normalized = extension.startsWith('.') ? extension : `.${extension}`;
+    return this.list().find((definition) => definition.extensions.includes(normalized)) ?? null;
+  }
+
+  public list(): RunnerDefinition[] {
+    return this.all().filter((definition) => !this.disabled.has(definition.language));
+  }
+
+  // Every registered runner, the disabled ones included.
+  public all(): RunnerDefinition[] {
+    return [...this.runners.values()];
+  }
+}
+
+// Java and Kotlin projects build with Maven's pom.xml or straight from their sources.
+const GRADLE_FILES = Object.fromEntries(
+  ['build.gradle', 'build.gradle.kts', 'settings.gradle', 'settings.gradle.kts'].map((name) => [name, 'Gradle builds are not supported'])
+);
+
+export function registerBuiltinRunners(registry: RunnerRegistry) {
+  registry.register({
+    language: 'python',
+    image: 'code-executor-runner-python:latest',
+    entryFile: 'main.py',
+    entrypoint: 'python/entrypoint.sh',
+    extensions: ['.py'],
+    pidsLimit: 32,
+    versionCommand: ['python3', '--version'],
+    probe: 'print("ok")',
+    syntaxCheck: true,
+    profiles: ['cpu'],
+    dependencyFile: 'requirements.txt',
+    repl: true,
+    tests: true,
+    coverage: true,
+    settings: { interpreter: process.env.PYTHON_INTERPRETER ?? 'python3' },
+    reproducible: ['time', 'seed']
+  });
+  registry.register({
+    language: 'node',
+    image: 'code-executor-runner-node:latest',
+    entryFile: 'main.js',
+    entrypoint: 'node/entrypoint.sh',
+    extensions: ['.js', '.mjs', '.cjs'],
+    pidsLimit: 32,
+    versionCommand: ['node', '--version'],
+    probe: 'console.log("ok")',
+    syntaxCheck: true,
+    profiles: ['cpu', 'heap'],
+    dependencyFile: 'package.json',
+    repl: true,
+    reproducible: ['time', 'seed']
+  });
+  // TypeScript runs on the Node image: the entrypoint type-checks main.ts and its imports, then
+  // runs the emitted JavaScript. Warm containers load the compiler while they wait.
+  registry.register({
+    language: 'typescript',
+    image: 'code-executor-runner-node:latest',
+    entryFile: 'main.ts',
+    entrypoint: 'node/entrypoint.sh',
+    extensions: ['.ts', '.mts', '.cts'],
+    pidsLimit: 32,
+    versionCommand: ['node', '-p', "`node ${process.version}, typescript ${require('/usr/local/lib/node_modules/typescript').version}`"],
+    probe: 'const status: string = "ok";\nconsole.log(status);',
+    syntaxCheck: true,
+    profiles: ['cpu', 'heap'],
+    dependencyFile: 'package.json',
+    compiled: true,
+    containerEnv: { RUNNER_PRELOAD: 'typescript' },
+    reproducible: ['time', 'seed']
+  });
+  registry.register({
+    language: 'ruby',
+    image: 'code-executor-runner-ruby:latest',
+    entryFile: 'main.rb',
+    entrypoint: 'ruby/entrypoint.sh',
+    extensions: ['.rb'],
+    pidsLimit: 32,
+    versionCommand: ['ruby', '--version'],
+    probe: 'puts "ok"',
+    syntaxCheck: true,
+    reproducible: ['time', 'seed']
+  });
+  registry.register({
+    language: 'php',
+    image: 'code-executor-runner-php:latest',
+    entryFile: 'main.php',
+    entrypoint: 'php/entrypoint.sh',
+    extensions: ['.php'],
+    pidsLimit: 32,
+    versionCommand: ['php', '--version'],
+    probe: '<?php echo "ok\\n";',
+    syntaxCheck: true,
+    reproducible: ['time', 'seed']
+  });
+  registry.register({
+    language: 'go',
+    image: 'code-executor-runner-go:latest',
+    entryFile: 'main.go',
+    entrypoint: 'go/entrypoint.py',
+    extensions: ['.go'],
+    // Go compiler needs more processes for compilation
+    pidsLimit: 256,
+    versionCommand: ['go', 'version'],
+    probe: 'package main\n\nimport "fmt"\n\nfunc main() { fmt.Println("ok") }\n',
+    syntaxCheck: true,
+    profiles: ['cpu', 'heap'],
+    compiled: true,
+    diagnostics: true,
+    tests: true,
+    coverage: true,
+    lint: true,
+    dependencyFile: 'go.mod',
+    dependencyLockFiles: ['go.sum'],
+    sharedDependencies: true
+  });
+  registry.register({
+    language: 'rust',
+    image: 'code-executor-runner-rust:latest',
+    entryFile: 'main.rs',
+    entrypoint: 'rust/entrypoint.py',
+    extensions: ['.rs'],
+    // rustc and cargo spawn a job per codegen unit
+    pidsLimit: 256,
+    versionCommand: ['rustc', '--version'],
+    probe: 'fn main() { println!("ok"); }',
+    syntaxCheck: true,
+    compiled: true,
+    diagnostics: true,
+    reproducible: ['time']
+  });
+  registry.register({
+    language: 'java',
+    image: 'code-executor-runner-java:latest',
+    entryFile: 'Main.java',
+    entrypoint: 'java/entrypoint.py',
+    extensions: ['.java'],
+    // The JVM starts GC, JIT and signal threads before running any user code
+    pidsLimit: 256,
+    // and keeps every jar on the class path open
+    openFilesLimit: 1024,
+    versionCommand: ['java', '-version'],
+    probe: 'public class Main { public static void main(String[] args) { System.out.println("ok"); } }',
+    compiled: true,
+    diagnostics: true,
+    dependencyFile: 'pom.xml',
+    unsupportedFiles: GRADLE_FILES,
+    reproducible: ['time']
+  });
+  registry.register({
+    language: 'kotlin',
+    image: 'code-executor-runner-kotlin:latest',
+    entryFile: 'main.kt',
+    entrypoint: 'kotlin/entrypoint.py',
+    extensions: ['.kt'],
+    // kotlinc and the program each run on a JVM
+    pidsLimit: 256,
+    openFilesLimit: 1024,
+    versionCommand: ['kotlinc', '-version'],
+    probe: 'fun main() { println("ok") }',
+    compiled: true,
+    unsupportedFiles: GRADLE_FILES,
+    reproducible: ['time']
+  });
+  registry.register({
+    language: 'c',
+    image: 'code-executor-runner-cpp:latest',
+    entryFile: 'main.c',
+    entrypoint: 'cpp/entrypoint.py',
+    extensions: ['.c', '.h'],
+    pidsLimit: 64,
+    versionCommand: ['gcc', '--version'],
+    probe: '#include <stdio.h>\nint main(void) { puts("ok"); return 0; }\n',
+    syntaxCheck: true,
+    compiled: true,
+    diagnostics: true,
+    isolation: ['container', 'gvisor', 'microvm', 'wasm'],
+    reproducible: ['time']
+  });
+  registry.register({
+    language: 'cpp',
+    image: 'code-executor-runner-cpp:latest',
+    entryFile: 'main.cpp',
+    entrypoint: 'cpp/entrypoint.py',
+    extensions: ['.cpp', '.cc', '.cxx', '.hpp'],
+    pidsLimit: 64,
+    versionCommand: ['g++', '--version'],
+    probe: '#include <iostream>\nint main() { std::cout << "ok" << std::endl; }\n',
+    syntaxCheck: true,
+    compiled: true,
+    diagnostics: true,
+    isolation: ['container', 'gvisor', 'microvm', 'wasm'],
+    reproducible: ['time']
+  });
+  registry.register({
+    language: 'bash',
+    image: 'code-executor-runner-shell:latest',
+    entryFile: 'main.sh',
+    entrypoint: 'shell/entrypoint.py',
+    extensions: ['.sh', '.bash'],
+    // Every command of a pipeline is a process of its own
+    pidsLimit: 64,
+    versionCommand: ['bash', '--version'],
+    probe: 'echo ok',
+    syntaxCheck: true,
+    noexecTmp: true,
+    settings: { restricted: 'true' },
+    reproducible: ['time']
+  });
+  registry.register({
+    language: 'sh',
+    image: 'code-executor-runner-shell:latest',
+    entryFile: 'main.sh',
+    entrypoint: 'shell/entrypoint.py',
+    // .sh files default to bash, which registers first
+    extensions: ['.sh'],
+    pidsLimit: 64,
+    // The image's sh is busybox ash, which has no --version
+    versionCommand: ['sh', '-c', 'busybox | head -n 1'],
+    probe: 'echo ok',
+    syntaxCheck: true,
+    noexecTmp: true,
+    reproducible: ['time']
+  });
+  registry.register({
+    language: 'sql',
+    image: 'code-executor-runner-sql:latest',
+    entryFile: 'main.sql',
+    entrypoint: 'sql/entrypoint.py',
+    extensions: ['.sql'],
+    // A postgres run starts the server's own processes next to the statements
+    pidsLimit: 64,
+    versionCommand: ['python3', '-c', 'import sqlite3; print("SQLite", sqlite3.sqlite_version)'],
+    probe: "SELECT 'ok' AS status;",
+    queries: true
+  });
+  registry.register({
+    language: 'wasm',
+    // Precompiled modules only run under the WASI runtime, which needs no image.
+    image: '',
+    entryFile: 'main.wasm',
+    extensions: ['.wasm'],
+    pidsLimit: 1,
+    versionCommand: [],
+    // A hand-assembled WASI module whose _start writes `ok\n` to stdout with fd_write.
+    probe: 'AGFzbQEAAAABDAJgBH9/f38Bf2AAAAIjARZ3YXNpX3NuYXBzaG90X3ByZXZpZXcxCGZkX3dyaXRlAAADAgEBBQMBAAEHEwIGbWVtb3J5AgAGX3N0YXJ0AAEKDwENAEEBQQBBAUEUEAAaCwsRAQBBAAsLCAAAAAMAAABvawo=',
+    isolation: ['wasm']
+  });
+}
+
+export function createDefaultRegistry(): RunnerRegistry {
+  const registry = new RunnerRegistry();
+  registerBuiltinRunners(registry);
+  return registry;
+}
+
+// Process-wide registry used when a component is not handed one explicitly. Extensions can
+// call `runnerRegistry.register(...)` at startup to add languages.
+export const runnerRegistry = createDefaultRegistry();
@@ -0,0 +1,147 @@
+import Boom from '@hapi/boom';
+import { MAX_LIMITS } from './limits.js';
+import type { LimitPolicy } from './limits.js';
+import type { RunnerRegistry } from './runners.js';
+import type { Language, RunLimits } from './types.js';
+import type { SettingsStore } from '../store/store.js';
+import { Logger } from '../util/logger.js';
+
+// Name of the setting the overrides are saved under.
+const SETTING = 'runtime';
+
+// What the admin API changed on top of the configuration: languages switched on or off, and
+// limits replacing the configured defaults and maxima.
+export interface RuntimeOverrides {
+  languages: Record<Language, { enabled: boolean }>;
+  limits: { defaults: Partial<RunLimits>; max: Partial<RunLimits> };
+}
+
+// A change to the limits; a null limit goes back to the configured value.
+export interface LimitChange {
+  defaults?: Partial<Record<keyof RunLimits, number | null>>;
+  max?: Partial<Record<keyof RunLimits, number | null>>;
+}
+
+export interface RuntimeSettingsOptions {
+  registry: RunnerRegistry;
+  store: SettingsStore;
+  // The policy runs are limited by, changed in place so everything holding it sees new values.
+  limits: LimitPolicy;
+}
+
+// Switches languages on and off and tunes the deployment's default limits and maxima while the
+// server runs. Changes are saved in the execution store, applied over the configuration at
+// startup and picked up by refresh() on every instance sharing the store.
+export class RuntimeSettings {
+  private readonly configured: { enabled: Map<Language, boolean>; defaults: RunLimits; max: RunLimits };
+  private saved: RuntimeOverrides = emptyOverrides();
+
+  constructor(private readonly options: RuntimeSettingsOptions, private readonly logger: Logger) {
+    this.configured = {
+      enabled: new Map(options.registry.all().map((runner) => [runner.language, options.registry.isEnabled(runner.language)])),
+      defaults: { ...options.limits.defaults },
+      max: { ...options.limits.max }
+    };
+  }
+
+  // Applies the overrides saved in the store, which another instance may have changed.
+  public async refresh() {
+    const saved = (await this.options.store.getSetting(SETTING)) as Partial<RuntimeOverrides> | null;
+    this.saved = {
+      languages: saved?.languages ?? {},
+      limits: { defaults: saved?.limits?.defaults ?? {}, max: saved?.limits?.max ?? {} }
+    };
+    this.apply();
+  }
+
+  public overrides(): RuntimeOverrides {
+    return structuredClone(this.saved);
+  }
+
+  public async setEnabled(language: Language, enabled: boolean) {
+    if (!this.options.registry.has(language)) {
+      throw Boom.notFound(`no runner for ${language}`);
+    }
+    if (typeof enabled !== 'boolean') {
+      throw Boom.badRequest('enabled must be a boolean');
+    }
+    const next = structuredClone(this.saved);
+    if (enabled === this.configured.enabled.get(language)) {
+      delete next.languages[language];
+    } else {
+      next.languages[language] = { enabled };
+    }
+    await this.save(next);
+    this.logger.info(enabled ? 'language enabled' : 'language disabled', { language });
+  }
+
+  // Validates the whole change before any of it takes effect, so a rejected change leaves the
+  // limits as they were.
+  public async updateLimits(change: LimitChange): Promise<LimitPolicy> {
+    if (typeof change !== 'object' || change === null || Array.isArray(change)) {
+      throw Boom.badRequest('limits must be an object');
+    }
+    const next = structuredClone(this.saved);
+    for (const section of Object.keys(change) as Array<keyof LimitChange>) {
+      if (section !== 'defaults' && section !== 'max') {
+        throw Boom.badRequest(`unknown limits section ${section}; expected defaults or max`);
+      }
+      const values = change[section];
+      if (typeof values !== 'object' || values === null || Array.isArray(values)) {
+        throw Boom.badRequest(`${section} must be an object`);
+      }
+      for (const [name, limit] of Object.entries(values) as Array<[keyof RunLimits, number | null]>) {
+        if (!(name in MAX_LIMITS)) {
+          throw Boom.badRequest(`unknown limit ${name}`);
+        }
+        if (limit === null) {
+          delete next.limits[section][name];
+        } else if (typeof limit !== 'number' || !Number.isInteger(limit) || limit <= 0) {
+          throw Boom.badRequest(`${section}.${name} must be a positive integer or null`);
+        } else {
+          next.limits[section][name] = limit;
+        }
+      }
+    }
+    const defaults = { ...this.configured.defaults, ...next.limits.defaults };
+    const max = { ...this.configured.max, ...next.limits.max };
+    for (const name of Object.keys(MAX_LIMITS) as Array<keyof RunLimits>) {
+      if (defaults[name] > max[name]) {
+        throw Boom.badRequest(`defaults.${name} exceeds maximum of ${max[name]}`, {
+          code: 'limit_exceeds_maximum',
+          limit: name,
+          maximum: max[name]
+        });
+      }
+    }
+    await this.save(next);
+    this.logger.info('limits updated', { defaults: JSON.stringify(next.limits.defaults), max: JSON.stringify(next.limits.max) });
+    return this.policy();
+  }
+
+  // The policy in effect, configuration and overrides together.
+  public policy(): LimitPolicy {
+    return this.options.limits;
+  }
+
+  private async save(next: RuntimeOverrides) {
+    await this.options.store.saveSetting(SETTING, next);
+    this.saved = next;
+    this.apply();
+  }
+
+  private apply() {
+    const { registry, limits } = this.options;
+    for (const [language, enabled] of this.configured.enabled) {
+      if (registry.has(language)) {
+        registry.setEnabled(language, this.saved.languages[language]?.enabled ?? enabled);
+      }
+    }
+    limits.defaults = { ...this.configured.defaults, ...this.saved.limits.defaults };
+    limits.max = { ...this.configured.max, ...this.saved.limits.max };
+  }
+}
+
+function emptyOverrides(): RuntimeOverrides {
+  return { languages: {}, limits: { defaults: {}, max: {} } };
+}
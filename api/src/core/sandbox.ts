@@ -1,120 +1,831 @@
 import childProcess from 'node:child_process';
 import fs from 'node:fs';
+import os from 'node:os';
 import path from 'node:path';
 import { once } from 'node:events';
 import crypto from 'node:crypto';
-import type { SandboxResult, SandboxRunSpec, SandboxRunner } from './types.js';
+import Boom from '@hapi/boom';
+import type { ChildProcessWithoutNullStreams } from 'node:child_process';
+import type { IsolationLevel, PhaseResult, RunAsUser, RunLimits, SandboxResult, SandboxRunSpec, SandboxRunner } from './types.js';
 import { Logger } from '../util/logger.js';
-
-const languageImageMap: Record<string, string> = {
-  python: process.env.RUNNER_IMAGE_PYTHON ?? 'code-executor-runner-python:latest',
-  node: process.env.RUNNER_IMAGE_NODE ?? 'code-executor-runner-node:latest',
-  ruby: process.env.RUNNER_IMAGE_RUBY ?? 'code-executor-runner-ruby:latest',
-  php: process.env.RUNNER_IMAGE_PHP ?? 'code-executor-runner-php:latest',
-  go: process.env.RUNNER_IMAGE_GO ?? 'code-executor-runner-go:latest'
-};
+import { runnerRegistry } from './runners.js';
+import type { RunnerDefinition, RunnerRegistry } from './runners.js';
+import {
+  canceledResult,
+  classifyExit,
+  captureOutput,
+  handOverRunDir,
+  memoryReport,
+  prepareRunDir,
+  readUsageReport,
+  totalDropped,
+  unlessAborted,
+  watchDiskUsage,
+  watchUsage,
+  watchRunStart
+} from './run_dir.js';
+import type { UsageProbe } from './run_dir.js';
+import { listOutputs } from './artifacts.js';
+import { directorySize } from './build_cache.js';
+import type { BuildCache } from './build_cache.js';
+import { unsupportedVersion } from './versions.js';
+import { infrastructureFailure } from './infrastructure.js';
+import type { VersionManager } from './versions.js';
+import type { ImageManager } from './images.js';
+import { permits } from './egress_proxy.js';
+import type { EgressProxy } from './egress_proxy.js';
+import { WarmPool } from './warm_pool.js';
+import type { WarmPoolKey, WarmPoolOptions, WarmSandbox } from './warm_pool.js';
+import type { CacheExpiry, ContainerHost, SandboxContainer } from './janitor.js';
+import { GpuPool } from './gpu.js';
+import type { GpuDevice, GpuLease } from './gpu.js';
 
 export interface DockerRunnerOptions {
   workRoot: string;
   seccompProfile: string;
   appArmorProfile?: string;
+  registry?: RunnerRegistry;
+  // Where the Docker daemon sees workRoot, when the API runs in a container of its own.
+  hostWorkRoot?: string;
+  // API-side directory holding dependency installs keyed by manifest hash; disabled when unset.
+  cacheDir?: string;
+  // Where the Docker daemon sees cacheDir.
+  hostCacheDir?: string;
+  // Leaves out the seccomp/AppArmor profiles and no-new-privileges, e.g. on Docker Desktop.
+  disableSecurity?: boolean;
+  // Docker-compatible CLI used to launch containers, e.g. `nerdctl` for containerd or `podman`.
+  cli?: string;
+  // OCI runtimes used for the stronger isolation levels; `container` uses the daemon default.
+  runtimes?: Partial<Record<IsolationLevel, string>>;
+  // Idle containers kept booted per language, isolation level and limits; disabled when unset.
+  warmPool?: WarmPoolOptions;
+  // Reuses compiled outputs across identical submissions; compiled languages always build when unset.
+  buildCache?: BuildCache;
+  // How a cached build reaches its run: `copy` clones it into the run directory; `overlay` has the
+  // daemon mount it read-only at /work/.build under a writable layer of the run's own, which
+  // copies nothing. Warm containers, booted before their run's build was known, always copy.
+  // `copy` unless set.
+  buildLayers?: 'copy' | 'overlay';
+  // Where the Docker daemon sees the build cache's directory.
+  hostBuildCacheDir?: string;
+  // Resolves requested toolchain versions to runner images; requests naming a version are
+  // rejected when unset.
+  versions?: VersionManager;
+  // Pinned images of the versions its catalogue lists, which take precedence over `versions`.
+  images?: ImageManager;
+  // Egress for runs with a network allowlist: the internal network those sandboxes join, the
+  // proxy that is their only way out, and the hosts and CIDRs requests may ask for. Allowlist
+  // runs are rejected when unset.
+  egress?: EgressOptions;
+  // Where the Docker daemon sees API-side directories that hold mount sources, e.g. the storage
+  // directory and the mount roots, keyed by the API-side path. Unlisted paths are passed as is.
+  mountHostPaths?: Record<string, string>;
+  // Runs containers as this UID/GID instead of the image's user, handing it the run directory.
+  runAs?: RunAsUser;
+  // Passed as --userns, e.g. `auto` or `keep-id` under podman. Docker only remaps users when the
+  // daemon has userns-remap enabled; the run directory is then chowned to the unmapped runAs ids.
+  userns?: string;
+  // GPUs runs may ask for; requests for a GPU are rejected when unset.
+  gpus?: GpuDevice[];
+  // OCI runtime that passes GPUs through, `nvidia` unless set.
+  gpuRuntime?: string;
+  // Where the API sees the host's cgroup v2 hierarchy, which containers' memory is sampled from
+  // for memory warnings and the peak of killed runs; /sys/fs/cgroup unless set.
+  cgroupRoot?: string;
+}
+
+export interface EgressOptions {
+  network: string;
+  proxy: EgressProxy;
+  allowlist: string[];
+}
+
+interface DependencyLayer {
+  hostDir: string;
+  phase: PhaseResult | null;
 }
 
-export class DockerSandbox implements SandboxRunner {
-  constructor(private readonly options: DockerRunnerOptions, private readonly logger: Logger) { }
+// A cached build mounted as the lower layer of an overlay, by the paths the daemon sees.
+interface BuildOverlay {
+  lower: string;
+  upper: string;
+  work: string;
+  release(): void;
+}
+
+// A container that has already been started and is blocked reading its spec from stdin.
+interface WarmContainer extends WarmSandbox {
+  child: ChildProcessWithoutNullStreams;
+  name: string;
+  runDir: string;
+}
+
+const DEFAULT_RUNTIMES: Record<IsolationLevel, string | null> = {
+  container: null,
+  gvisor: 'runsc',
+  microvm: 'kata-fc',
+  // Served by the WasmSandbox in front of this one; never started as a container.
+  wasm: null
+};
+
+const DEPENDENCY_INSTALL_TIMEOUT_MS = 120000;
+const CANCEL_RETRY_MS = 250;
+// What `docker run` and `docker exec` exit with when they could not create or start the
+// container, or the command in it.
+const START_FAILURE_CODES = new Set([125, 126, 127]);
+// Set on every run, warm and dependency container, so they can be found after a crash.
+const SANDBOX_LABEL = 'code-executor.sandbox';
+const DEFAULT_CGROUP_ROOT = '/sys/fs/cgroup';
+// Where a container's cgroup sits below the root: under Docker's systemd and cgroupfs drivers,
+// then podman's.
+const CGROUP_LAYOUTS = [
+  (id: string) => `system.slice/docker-${id}.scope`,
+  (id: string) => `docker/${id}`,
+  (id: string) => `machine.slice/libpod-${id}.scope`
+];
+
+export class DockerSandbox implements SandboxRunner, ContainerHost {
+  private readonly registry: RunnerRegistry;
+  private readonly cli: string;
+  private readonly toolchains = new Map<string, Promise<string | null>>();
+  private readonly installs = new Map<string, Promise<DependencyLayer | SandboxResult>>();
+  // Containers this process launched whose client has not exited yet.
+  private readonly live = new Set<string>();
+  public readonly warmPool: WarmPool<WarmContainer>;
+  public readonly gpuPool: GpuPool;
+
+  constructor(private readonly options: DockerRunnerOptions, private readonly logger: Logger) {
+    this.registry = options.registry ?? runnerRegistry;
+    this.cli = options.cli ?? 'docker';
+    this.warmPool = new WarmPool(options.warmPool ?? { size: 0 }, (key) => this.launchWarmContainer(key), logger);
+    this.gpuPool = new GpuPool(options.gpus ?? []);
+  }
 
   public async run(spec: SandboxRunSpec): Promise<SandboxResult> {
-    const image = languageImageMap[spec.language];
-    const runDir = spec.workdir;
-    fs.mkdirSync(runDir, { recursive: true });
-    const codeFile = path.join(runDir, this.entryFileName(spec.language));
-    fs.writeFileSync(codeFile, spec.code, { encoding: 'utf8' });
-    this.stageFiles(runDir, spec.stagedFiles);
-    const dockerArgs = this.buildDockerArgs(image, runDir, spec);
-    this.logger.info('launching sandbox', { specId: spec.id, dockerArgs });
-    const child = childProcess.spawn('docker', dockerArgs, {
-      stdio: ['pipe', 'pipe', 'pipe']
-    });
-    child.stdin.end(JSON.stringify({
+    const runner = this.registry.require(spec.language);
+    if (spec.gpu) {
+      this.checkGpu(spec);
+    }
+    const egress = spec.network.mode === 'allowlist' ? this.egressFor(spec.network.allow ?? []) : null;
+    const mounts = spec.mounts.map((mount) => ({ hostPath: this.mountHostPath(mount.sourcePath), destPath: mount.destPath }));
+    const image = await unlessAborted(this.resolveImage(runner, spec.version), spec.signal);
+    if (!image) {
+      return canceledResult();
+    }
+    let dependencies: DependencyLayer | null = null;
+    if (runner.dependencyFile && spec.sources[runner.dependencyFile] !== undefined && this.options.cacheDir) {
+      const prepared = await unlessAborted(
+        this.prepareDependencies(runner, image, dependencyFiles(runner, spec.sources)),
+        spec.signal
+      );
+      if (!prepared) {
+        return canceledResult();
+      }
+      if ('status' in prepared) {
+        return prepared;
+      }
+      dependencies = prepared;
+    }
+    // Check mode builds nothing worth keeping.
+    const buildCache = runner.compiled && spec.mode !== 'check' ? this.options.buildCache : undefined;
+    const buildKey = buildCache ? await unlessAborted(this.buildCacheKey(buildCache, runner, image, spec), spec.signal) : null;
+    if (spec.signal?.aborted) {
+      return canceledResult();
+    }
+    // Warm containers were started before the dependency layer and mounts were known, so they can
+    // only serve runs without them, and they always run the default toolchain offline.
+    const poolKey: WarmPoolKey | null = dependencies || spec.version || egress || spec.mounts.length > 0 || spec.gpu
+      ? null
+      : { language: runner.language, isolation: spec.isolation, limits: spec.limits };
+    const warm = poolKey ? this.warmPool.lease(poolKey) : null;
+    const runDir = prepareRunDir(runner, warm ? { ...spec, workdir: warm.runDir } : spec);
+    if (warm && fs.existsSync(path.join(spec.workdir, 'inputs'))) {
+      // Inputs the orchestrator wrote into the run's own workdir.
+      fs.cpSync(path.join(spec.workdir, 'inputs'), path.join(runDir, 'inputs'), { recursive: true });
+    }
+    const overlay = Boolean(buildCache && buildKey && this.options.buildLayers === 'overlay' && !warm);
+    let prebuilt = buildCache && buildKey && !overlay ? buildCache.restore(buildKey, path.join(runDir, '.build')) : false;
+    if (this.options.runAs) {
+      handOverRunDir(runDir, this.options.runAs);
+    }
+    // Runs wait here for their GPUs, after everything that doesn't need them is ready.
+    const gpus = spec.gpu ? await this.leaseGpus(spec) : null;
+    if (spec.gpu && !gpus) {
+      return canceledResult();
+    }
+    const grant = egress?.proxy.grant(spec.id, spec.network.allow ?? []);
+    let child: ChildProcessWithoutNullStreams;
+    let containerName: string;
+    let buildOverlay: BuildOverlay | null = null;
+    if (warm) {
+      child = warm.child;
+      containerName = warm.name;
+      this.logger.info('using warm sandbox', { specId: spec.id, isolation: spec.isolation, streaming: Boolean(spec.onOutput) });
+    } else {
+      containerName = `run_${spec.id}_${randomSuffix()}`;
+      buildOverlay = overlay ? this.overlayBuild(buildCache!, buildKey!, runDir) : null;
+      prebuilt = buildOverlay !== null;
+      const dockerArgs = this.buildDockerArgs(
+        runner,
+        image,
+        runDir,
+        containerName,
+        spec.limits,
+        spec.isolation,
+        dependencies,
+        mounts,
+        egress?.network,
+        gpus,
+        buildOverlay
+      );
+      this.logger.info('launching sandbox', { specId: spec.id, cli: this.cli, dockerArgs, streaming: Boolean(spec.onOutput) });
+      child = this.spawnContainer(containerName, dockerArgs);
+    }
+    // The spec goes on the first line of stdin; interactive sessions keep streaming input after it.
+    child.stdin.write(`${JSON.stringify({
       id: spec.id,
+      language: spec.language,
+      mode: spec.mode,
+      build: spec.build,
+      lint: spec.lint ?? null,
+      sql: spec.sql ?? null,
+      profile: spec.profile ?? null,
+      coverage: Boolean(spec.coverage),
       args: spec.args,
-      env: spec.env,
-      limits: spec.limits
-    }));
+      env: grant ? { ...spec.env, ...proxyEnvironment(grant.proxyUrl) } : spec.env,
+      limits: spec.limits,
+      stdin: spec.stdin,
+      interactive: Boolean(spec.input),
+      prebuilt,
+      on_output_limit: spec.onOutputLimit ?? 'truncate',
+      settings: runner.settings ?? {}
+    })}\n`);
+    if (spec.input) {
+      child.stdin.on('error', () => undefined);
+      spec.input.pipe(child.stdin);
+    } else {
+      child.stdin.end();
+    }
 
-    const stdoutChunks: Buffer[] = [];
-    const stderrChunks: Buffer[] = [];
-    child.stdout.on('data', (chunk: Buffer) => {
-      stdoutChunks.push(chunk);
-    });
-    child.stderr.on('data', (chunk: Buffer) => {
-      stderrChunks.push(chunk);
+    // Killing the docker client would leave the container running, so stop it by name. Right
+    // after launch the container may not exist yet; keep trying until the client exits.
+    let exited = false;
+    const cancel = () => {
+      childProcess.execFile(this.cli, ['kill', containerName], (err) => {
+        if (err && !exited) {
+          setTimeout(cancel, CANCEL_RETRY_MS);
+        }
+      });
+    };
+    spec.signal?.addEventListener('abort', cancel, { once: true });
+    const output = captureOutput(spec, () => {
+      if (spec.onOutputLimit === 'kill') {
+        cancel();
+      }
     });
+    child.stdout.on('data', (chunk: Buffer) => output.push('stdout', chunk));
+    child.stderr.on('data', (chunk: Buffer) => output.push('stderr', chunk));
+    const disk = watchDiskUsage(runDir, spec.limits, cancel);
+    const memory = watchUsage(spec, cgroupUsageProbe(cidFile(containerName), this.options.cgroupRoot ?? DEFAULT_CGROUP_ROOT));
+    const started = runner.compiled && spec.onRunStart ? watchRunStart(runDir, spec.onRunStart) : null;
+    let code: number | null;
+    let signal: NodeJS.Signals | null;
+    try {
+      [code, signal] = (await once(child, 'exit')) as [number | null, NodeJS.Signals | null];
+    } finally {
+      disk.stop();
+      memory.stop();
+      fs.rm(cidFile(containerName), { force: true }, () => undefined);
+      buildOverlay?.release();
+      started?.stop();
+      grant?.release();
+      gpus?.release();
+      if (poolKey) {
+        this.warmPool.finished(poolKey);
+      }
+    }
+    exited = true;
+    spec.signal?.removeEventListener('abort', cancel);
 
-    const [code, signal] = (await once(child, 'exit')) as [number | null, NodeJS.Signals | null];
+    // Runners always leave usage.json behind, so without one the program never ran.
+    const startFailed =
+      !spec.signal?.aborted && code !== null && START_FAILURE_CODES.has(code) && !fs.existsSync(path.join(runDir, 'usage.json'));
+    const report = readUsageReport(runDir, spec.limits, memory.peakMb);
+    const droppedBytes = totalDropped(report, output);
+    const outputLimit = report.limitExceeded ?? (droppedBytes.stdout || droppedBytes.stderr ? 'output' : null);
+    const { status, limitExceeded } = classifyExit(code, signal, disk.exceeded ? 'disk' : outputLimit, spec.onOutputLimit);
+    if (buildCache && buildKey && !prebuilt && report.compile?.exit_code === 0 && report.buildDigest) {
+      buildCache.store(buildKey, path.join(runDir, '.build'), report.buildDigest);
+    }
+    if (warm) {
+      // The orchestrator only accepts artifacts from the run's own workdir.
+      if (fs.existsSync(path.join(runDir, 'outputs'))) {
+        fs.cpSync(path.join(runDir, 'outputs'), path.join(spec.workdir, 'outputs'), { recursive: true });
+      }
+      fs.rm(runDir, { recursive: true, force: true }, () => undefined);
+    }
+    if (startFailed) {
+      const reason = output.stderr().toString('utf8').trim();
+      throw infrastructureFailure(`sandbox failed to start: ${reason || `${this.cli} exited with ${code}`}`);
+    }
 
-    const stdout = Buffer.concat(stdoutChunks).slice(0, spec.limits.max_output_bytes);
-    const stderr = Buffer.concat(stderrChunks).slice(0, spec.limits.max_output_bytes);
+    return {
+      status,
+      exitCode: code,
+      limitExceeded,
+      timeout: report.timeout,
+      exitSignal: report.exitSignal,
+      stdout: output.stdout(),
+      stderr: output.stderr(),
+      droppedBytes,
+      compile: report.compile ?? dependencies?.phase ?? null,
+      toolchain: report.toolchain,
+      tests: report.tests,
+      coverage: report.coverage,
+      diagnostics: report.diagnostics,
+      results: report.results,
+      usage: report.usage,
+      memory: memoryReport(report.usage, spec.limits, memory),
+      usageSamples: memory.series,
+      artifacts: listOutputs(spec.workdir)
+    };
+  }
 
-    let status: SandboxResult['status'] = 'succeeded';
-    if (signal === 'SIGKILL') {
-      status = 'timeout';
-    } else if (code === 137) {
-      status = 'oom';
-    } else if (code !== 0) {
-      status = 'failed';
+  private checkGpu(spec: SandboxRunSpec) {
+    const gpu = spec.gpu as NonNullable<SandboxRunSpec['gpu']>;
+    if (spec.isolation !== 'container') {
+      throw Boom.badRequest('gpu requires isolation container');
+    }
+    // A worker's devices were reserved by the coordinator, which knows them from the registration.
+    if (spec.gpuDevices) {
+      return;
+    }
+    if (this.gpuPool.size === 0) {
+      throw Boom.badRequest('no GPUs are available on this server');
     }
+    if (!this.gpuPool.fits(gpu)) {
+      throw Boom.badRequest('gpu request exceeds the GPUs of this server');
+    }
+  }
 
-    const usagePath = path.join(runDir, 'usage.json');
-    let usage = { wall_ms: spec.limits.timeout_ms, cpu_ms: spec.limits.cpu_ms, max_rss_mb: spec.limits.memory_mb };
-    if (fs.existsSync(usagePath)) {
-      usage = JSON.parse(fs.readFileSync(usagePath, 'utf8'));
+  private async leaseGpus(spec: SandboxRunSpec): Promise<GpuLease | null> {
+    const gpu = spec.gpu as NonNullable<SandboxRunSpec['gpu']>;
+    if (spec.gpuDevices) {
+      return { devices: spec.gpuDevices, vram_mb: gpu.vram_mb ?? null, release: () => undefined };
+    }
+    const lease = await this.gpuPool.acquire(gpu, spec.signal);
+    if (lease) {
+      this.logger.info('gpus leased', { specId: spec.id, devices: lease.devices.join(','), vramMb: lease.vram_mb });
     }
+    return lease;
+  }
 
-    const artifacts = this.collectArtifacts(runDir);
+  // Builds depend on the sources, build options and the toolchain inside the image; without a
+  // known toolchain version the run compiles from scratch.
+  private async buildCacheKey(
+    buildCache: BuildCache,
+    runner: RunnerDefinition,
+    image: string,
+    spec: SandboxRunSpec
+  ): Promise<string | null> {
+    const toolchain = await this.probeImage(runner, image);
+    if (!toolchain) {
+      return null;
+    }
+    return buildCache.key({
+      language: runner.language,
+      // Compile mode builds the very program a run does, so either reuses the other's build.
+      mode: spec.mode === 'compile' ? 'run' : spec.mode,
+      image,
+      toolchain,
+      code: spec.code,
+      sources: spec.sources,
+      build: spec.build,
+      // Profiling and coverage are compiled into Go programs.
+      profile: spec.profile,
+      coverage: spec.coverage
+    });
+  }
+
+  private egressFor(allow: string[]): EgressOptions {
+    const egress = this.options.egress;
+    if (!egress) {
+      throw Boom.badRequest('network allowlists are not enabled on this server');
+    }
+    const refused = allow.filter((entry) => !permits(egress.allowlist, entry));
+    if (refused.length > 0) {
+      throw Boom.badRequest(`network.allow entries not permitted by the server: ${refused.join(', ')}`, {
+        code: 'egress_not_permitted',
+        permitted: egress.allowlist
+      });
+    }
+    return egress;
+  }
 
+  // Translates an API-side mount source to the path the daemon sees. --mount takes
+  // comma-separated fields, so a source containing a comma cannot be passed at all.
+  private mountHostPath(sourcePath: string): string {
+    let hostPath = sourcePath;
+    let matched = '';
+    for (const [apiPath, daemonPath] of Object.entries(this.options.mountHostPaths ?? {})) {
+      const prefix = apiPath.replace(/\/+$/, '');
+      if ((sourcePath === prefix || sourcePath.startsWith(`${prefix}/`)) && prefix.length > matched.length) {
+        matched = prefix;
+        hostPath = `${daemonPath.replace(/\/+$/, '')}${sourcePath.slice(prefix.length)}`;
+      }
+    }
+    if (hostPath.includes(',')) {
+      throw Boom.badRequest(`mount source path is not supported: ${sourcePath}`);
+    }
+    return hostPath;
+  }
+
+  private resolveImage(runner: RunnerDefinition, version: string | undefined): Promise<string> {
+    if (!version) {
+      return Promise.resolve(runner.image);
+    }
+    const catalogued = this.options.images?.lookup(runner.language, version);
+    if (catalogued) {
+      return Promise.resolve(catalogued);
+    }
+    if (!this.options.versions) {
+      return Promise.reject(unsupportedVersion(runner.language, version, []));
+    }
+    return this.options.versions.resolve(runner, version);
+  }
+
+  // Leases the cached build and lays out the overlay's writable layer, next to the run directory
+  // rather than in it so the program cannot reach overlayfs's work directory. Null on a miss.
+  private overlayBuild(buildCache: BuildCache, key: string, runDir: string): BuildOverlay | null {
+    const layer = buildCache.lease(key);
+    if (!layer) {
+      return null;
+    }
+    const layerDir = `${runDir}_layer`;
+    fs.mkdirSync(path.join(layerDir, 'upper'), { recursive: true });
+    fs.mkdirSync(path.join(layerDir, 'work'), { recursive: true });
+    // The mount point, so the daemon doesn't create it as root.
+    fs.mkdirSync(path.join(runDir, '.build'), { recursive: true });
+    if (this.options.runAs) {
+      fs.chownSync(path.join(layerDir, 'upper'), this.options.runAs.uid, this.options.runAs.gid);
+      fs.chownSync(path.join(runDir, '.build'), this.options.runAs.uid, this.options.runAs.gid);
+    }
+    const hostSandbox = this.options.hostWorkRoot;
+    const hostLayerDir = hostSandbox ? path.join(hostSandbox, path.basename(layerDir)) : layerDir;
+    const hostCache = this.options.hostBuildCacheDir;
     return {
-      status,
-      exitCode: code,
-      stdout,
-      stderr,
-      usage,
-      artifacts
+      lower: hostCache ? path.join(hostCache, path.basename(layer.dir)) : layer.dir,
+      upper: path.join(hostLayerDir, 'upper'),
+      work: path.join(hostLayerDir, 'work'),
+      release: () => {
+        layer.release();
+        fs.rm(layerDir, { recursive: true, force: true }, () => undefined);
+      }
+    };
+  }
+
+  // Containers are booted with the run directory mounted and wait on stdin, so a run only has to
+  // write its files and send the spec.
+  private launchWarmContainer(key: WarmPoolKey): WarmContainer {
+    const runner = this.registry.require(key.language);
+    const name = `warm_${runner.language}_${randomSuffix()}`;
+    const runDir = path.join(this.options.workRoot, name);
+    fs.mkdirSync(runDir, { recursive: true });
+    const dockerArgs = this.buildDockerArgs(runner, runner.image, runDir, name, key.limits, key.isolation, null, []);
+    const child = this.spawnContainer(name, dockerArgs);
+    return {
+      child,
+      name,
+      runDir,
+      onExit: (listener) => child.once('exit', listener),
+      stop: () => childProcess.execFile(this.cli, ['kill', name], () => undefined),
+      discard: () => {
+        fs.rm(runDir, { recursive: true, force: true }, () => undefined);
+        fs.rm(cidFile(name), { force: true }, () => undefined);
+      }
+    };
+  }
+
+  // Boots idle containers ahead of the first request so its startup latency is hidden too.
+  public prewarm(language: string, limits: RunLimits, isolation: IsolationLevel) {
+    this.registry.require(language);
+    this.warmPool.fill({ language, isolation, limits });
+  }
+
+  // Installs a dependency manifest into a cache directory keyed by its hash so repeat runs reuse
+  // it. Installation happens in a separate container that may reach package registries but never
+  // executes submission code; runs then mount the cached layer read-only at /deps.
+  private prepareDependencies(
+    runner: RunnerDefinition,
+    image: string,
+    files: Record<string, string>
+  ): Promise<DependencyLayer | SandboxResult> {
+    // Versioned images get their own installs; the default image keeps its existing keys.
+    const scope = image === runner.image ? runner.language : `${runner.language}\0${image}`;
+    const hash = crypto.createHash('sha256').update(`${scope}\0${files[runner.dependencyFile as string]}`);
+    for (const name of runner.dependencyLockFiles ?? []) {
+      if (files[name] !== undefined) {
+        hash.update(`\0${name}\0${files[name]}`);
+      }
+    }
+    const key = hash.digest('hex');
+    // A shared cache is one directory per scope, with each manifest's files and completion marker
+    // under manifests/<key> so an install failing never touches what others downloaded.
+    const layer = runner.sharedDependencies
+      ? path.join(runner.language, crypto.createHash('sha256').update(scope).digest('hex'))
+      : path.join(runner.language, key);
+    const manifestDir = runner.sharedDependencies ? `manifests/${key}` : '';
+    const cacheDir = path.join(this.options.cacheDir as string, layer);
+    const hostCache = this.options.hostCacheDir;
+    const hostDir = hostCache ? path.join(hostCache, layer) : cacheDir;
+    const marker = path.join(cacheDir, manifestDir, '.complete');
+    if (fs.existsSync(marker)) {
+      // The marker's mtime is when the layer was last used, which is what the janitor expires by.
+      const now = new Date();
+      fs.utimesSync(marker, now, now);
+      return Promise.resolve({ hostDir, phase: null });
+    }
+    if (runner.offlineDependencies) {
+      // Whatever an operator seeded the cache with is all the run gets.
+      fs.mkdirSync(cacheDir, { recursive: true });
+      return Promise.resolve({ hostDir, phase: null });
+    }
+    const pending = this.installs.get(key);
+    if (pending) {
+      return pending;
+    }
+    const installDir = path.join(cacheDir, manifestDir);
+    const install = this.installDependencies(runner, image, files, installDir, manifestDir, hostDir).finally(() => {
+      this.installs.delete(key);
+    });
+    this.installs.set(key, install);
+    return install;
+  }
+
+  private async installDependencies(
+    runner: RunnerDefinition,
+    image: string,
+    files: Record<string, string>,
+    installDir: string,
+    manifestDir: string,
+    hostDir: string
+  ): Promise<DependencyLayer | SandboxResult> {
+    fs.rmSync(installDir, { recursive: true, force: true });
+    fs.mkdirSync(installDir, { recursive: true });
+    for (const [name, contents] of Object.entries(files)) {
+      fs.writeFileSync(path.join(installDir, name), contents);
+    }
+    const containerName = `deps_${runner.language}_${crypto.randomBytes(6).toString('hex')}`;
+    const args = [
+      'run',
+      '-i',
+      '--rm',
+      '--name',
+      containerName,
+      '--label',
+      `${SANDBOX_LABEL}=deps`,
+      '--read-only',
+      '--tmpfs',
+      '/tmp',
+      '--cap-drop=ALL',
+      '--pids-limit=256',
+      '--memory',
+      '1024m',
+      '--mount',
+      `type=bind,src=${hostDir},dst=/deps`,
+      image,
+      '--'
+    ];
+    this.logger.info('installing dependencies', { language: runner.language, installDir });
+    const started = Date.now();
+    const child = this.spawnContainer(containerName, args);
+    child.stdin.end(JSON.stringify({
+      mode: 'setup',
+      settings: runner.settings ?? {},
+      manifest_dir: path.posix.join('/deps', manifestDir)
+    }));
+    const stdoutChunks: Buffer[] = [];
+    const stderrChunks: Buffer[] = [];
+    child.stdout.on('data', (chunk: Buffer) => stdoutChunks.push(chunk));
+    child.stderr.on('data', (chunk: Buffer) => stderrChunks.push(chunk));
+    const timer = setTimeout(() => {
+      childProcess.execFile(this.cli, ['kill', containerName], () => undefined);
+    }, DEPENDENCY_INSTALL_TIMEOUT_MS);
+    const [code] = (await once(child, 'exit')) as [number | null, NodeJS.Signals | null];
+    clearTimeout(timer);
+
+    const phase: PhaseResult = {
+      exit_code: code,
+      stdout: Buffer.concat(stdoutChunks).toString('utf8'),
+      stderr: Buffer.concat(stderrChunks).toString('utf8'),
+      duration_ms: Date.now() - started
     };
+    if (code !== 0) {
+      this.logger.warn('dependency installation failed', { language: runner.language, code });
+      fs.rmSync(installDir, { recursive: true, force: true });
+      return {
+        status: 'failed',
+        exitCode: code,
+        limitExceeded: null,
+        stdout: Buffer.alloc(0),
+        stderr: Buffer.from(`dependency installation failed:\n${phase.stderr}`),
+        compile: phase,
+        usage: { wall_ms: 0, cpu_ms: 0, max_rss_mb: 0 },
+        artifacts: []
+      };
+    }
+    fs.writeFileSync(path.join(installDir, '.complete'), new Date().toISOString());
+    return { hostDir, phase };
   }
 
-  private buildDockerArgs(image: string, runDir: string, spec: SandboxRunSpec): string[] {
-    const alphabet = '0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ';
-    const bytes = crypto.randomBytes(6);
-    let suffix = '';
-    for (let i = 0; i < 6; i++) {
-      suffix += alphabet[bytes[i] % alphabet.length];
+  // Probes the toolchain version once per image by running the registered version command
+  // inside it; resolves to null when the image or command is unavailable.
+  public probeVersion(language: string): Promise<string | null> {
+    const runner = this.registry.require(language);
+    if (runner.versionCommand.length === 0) {
+      return Promise.resolve(null);
     }
-    const containerName = `run_${spec.id}_${suffix}`;
-    const disableSecurity = process.env.DISABLE_SANDBOX_SECURITY === '1';
-    const hostSandbox = process.env.HOST_SANDBOX_DIR;
+    return this.probeImage(runner, runner.image);
+  }
+
+  // Whether a container of that name, or the work directory of a warm one, belongs to a sandbox
+  // this process is still running.
+  public owns(name: string) {
+    return this.live.has(name);
+  }
+
+  public listContainers(): Promise<SandboxContainer[]> {
+    return new Promise((resolve, reject) => {
+      childProcess.execFile(
+        this.cli,
+        ['ps', '--all', '--filter', `label=${SANDBOX_LABEL}`, '--format', '{{.Names}}\t{{.CreatedAt}}'],
+        { timeout: 30000 },
+        (err, stdout) => {
+          if (err) {
+            reject(err);
+            return;
+          }
+          const containers: SandboxContainer[] = [];
+          for (const line of stdout.toString().split('\n')) {
+            const [name, created] = line.split('\t');
+            const createdAt = created ? parseCreatedAt(created) : NaN;
+            if (name && !Number.isNaN(createdAt)) {
+              containers.push({ name, created_at: createdAt });
+            }
+          }
+          resolve(containers);
+        }
+      );
+    });
+  }
+
+  public removeContainers(names: string[]): Promise<void> {
+    return new Promise((resolve, reject) => {
+      childProcess.execFile(this.cli, ['rm', '--force', ...names], { timeout: 30000 }, (err) => (err ? reject(err) : resolve()));
+    });
+  }
+
+  // Removes dependency layers no run has used since `before` (epoch ms), and installs that never
+  // completed. Layers of runners that only use what an operator seeded are kept.
+  public expireDependencies(before: number): CacheExpiry {
+    const expired = { entries: 0, bytes: 0 };
+    const cacheDir = this.options.cacheDir;
+    if (!cacheDir || !fs.existsSync(cacheDir)) {
+      return expired;
+    }
+    for (const language of fs.readdirSync(cacheDir)) {
+      if (this.registry.get(language)?.offlineDependencies) {
+        continue;
+      }
+      const languageDir = path.join(cacheDir, language);
+      if (!fs.statSync(languageDir).isDirectory()) {
+        continue;
+      }
+      for (const layer of fs.readdirSync(languageDir)) {
+        const layerDir = path.join(languageDir, layer);
+        if (lastUsed(layerDir) >= before) {
+          continue;
+        }
+        expired.bytes += directorySize(layerDir);
+        expired.entries++;
+        fs.rmSync(layerDir, { recursive: true, force: true });
+      }
+    }
+    return expired;
+  }
+
+  private spawnContainer(name: string, args: string[]) {
+    const child = childProcess.spawn(this.cli, args, { stdio: ['pipe', 'pipe', 'pipe'] });
+    this.live.add(name);
+    child.once('exit', () => this.live.delete(name));
+    return child;
+  }
+
+  private probeImage(runner: RunnerDefinition, image: string): Promise<string | null> {
+    const language = runner.language;
+    const cached = this.toolchains.get(image);
+    if (cached) {
+      return cached;
+    }
+    const [command, ...commandArgs] = runner.versionCommand;
+    const probe = new Promise<string | null>((resolve) => {
+      childProcess.execFile(
+        this.cli,
+        ['run', '--rm', '--network=none', '--entrypoint', command, image, ...commandArgs],
+        { timeout: 30000 },
+        (err, stdout, stderr) => {
+          if (err) {
+            this.logger.warn('version probe failed', { language, message: err.message });
+            this.toolchains.delete(image);
+            resolve(null);
+            return;
+          }
+          resolve((stdout || stderr).trim().split('\n')[0] || null);
+        }
+      );
+    });
+    this.toolchains.set(image, probe);
+    return probe;
+  }
+
+  private buildDockerArgs(
+    runner: RunnerDefinition,
+    image: string,
+    runDir: string,
+    containerName: string,
+    limits: RunLimits,
+    isolation: IsolationLevel,
+    dependencies: DependencyLayer | null,
+    mounts: Array<{ hostPath: string; destPath: string }>,
+    network = 'none',
+    gpus: GpuLease | null = null,
+    buildOverlay: BuildOverlay | null = null
+  ): string[] {
+    const disableSecurity = this.options.disableSecurity ?? false;
+    const hostSandbox = this.options.hostWorkRoot;
     const hostRunDir = hostSandbox ? path.join(hostSandbox, path.basename(runDir)) : runDir;
-    // Go compiler needs more processes for compilation
-    const pidsLimit = spec.language === 'go' ? '256' : '32';
     const args: string[] = [
       'run',
       '-i',
       '--rm',
       '--name',
       containerName,
-      '--network=none',
+      '--cidfile',
+      cidFile(containerName),
+      '--label',
+      `${SANDBOX_LABEL}=${containerName.startsWith('warm_') ? 'warm' : 'run'}`,
+      `--network=${network}`,
       '--read-only',
-      `--pids-limit=${pidsLimit}`,
+      `--pids-limit=${limits.max_processes}`,
       '--cpus',
-      (spec.limits.cpu_ms / 1000).toFixed(2),
+      (limits.cpu_ms / 1000).toFixed(2),
       '--memory',
-      `${spec.limits.memory_mb}m`,
+      `${limits.memory_mb}m`,
       '--memory-swap',
-      `${spec.limits.memory_mb}m`,
+      `${limits.memory_mb}m`,
       '--cap-drop=ALL',
       '--mount',
       `type=bind,src=${hostRunDir},dst=/work`
     ];
+    if (this.options.runAs) {
+      args.push('--user', `${this.options.runAs.uid}:${this.options.runAs.gid}`);
+    }
+    if (this.options.userns) {
+      args.push(`--userns=${this.options.userns}`);
+    }
+    if (dependencies) {
+      args.push('--mount', `type=bind,src=${dependencies.hostDir},dst=/deps,readonly`);
+    }
+    if (buildOverlay) {
+      // An anonymous volume of the local driver, which the daemon mounts as overlayfs itself so
+      // the API needs no privileges; --rm removes it. The quotes keep the options' commas in one field.
+      const { lower, upper, work } = buildOverlay;
+      args.push(
+        '--mount',
+        'type=volume,dst=/work/.build,volume-driver=local,volume-opt=type=overlay,volume-opt=device=overlay,' +
+          `"volume-opt=o=lowerdir=${lower},upperdir=${upper},workdir=${work}"`
+      );
+    }
+    for (const mount of mounts) {
+      args.push('--mount', `type=bind,src=${mount.hostPath},dst=${mount.destPath},readonly`);
+    }
+    if (runner.noexecTmp) {
+      args.push('--tmpfs', `/tmp:rw,noexec,nosuid,nodev,size=${limits.disk_mb}m`);
+    }
+    // GPU runs only use isolation container, whose runtime the GPU one replaces.
+    const runtime = gpus ? this.options.gpuRuntime ?? 'nvidia' : this.options.runtimes?.[isolation] ?? DEFAULT_RUNTIMES[isolation];
+    if (runtime) {
+      args.push(`--runtime=${runtime}`);
+    }
+    if (gpus) {
+      args.push('--env', `NVIDIA_VISIBLE_DEVICES=${gpus.devices.join(',')}`, '--env', 'NVIDIA_DRIVER_CAPABILITIES=compute,utility');
+      if (gpus.vram_mb !== null) {
+        // Devices are numbered from 0 inside the container. The driver enforces the cap for
+        // processes of an MPS server; elsewhere it only tells CUDA libraries what they may take.
+        const limit = gpus.devices.map((_, index) => `${index}=${gpus.vram_mb}M`).join(',');
+        args.push('--env', `CUDA_MPS_PINNED_DEVICE_MEM_LIMIT=${limit}`);
+      }
+    }
     if (!disableSecurity) {
       args.push('--security-opt', 'no-new-privileges:true');
       args.push('--security-opt', `seccomp=${this.options.seccompProfile}`);
@@ -122,53 +833,100 @@ export class DockerSandbox implements SandboxRunner {
         args.push('--security-opt', `apparmor=${this.options.appArmorProfile}`);
       }
     }
+    for (const [name, value] of Object.entries(runner.containerEnv ?? {})) {
+      args.push('--env', `${name}=${value}`);
+    }
     args.push(image);
     args.push('--');
     return args;
   }
+}
 
-  private stageFiles(runDir: string, files: SandboxRunSpec['stagedFiles']) {
-    for (const file of files) {
-      if (file.destPath.includes('..') || path.isAbsolute(file.destPath)) {
-        continue;
-      }
-      const dest = path.join(runDir, 'inputs', file.destPath);
-      fs.mkdirSync(path.dirname(dest), { recursive: true });
-      fs.copyFileSync(file.sourcePath, dest);
+// The submitted manifest and whichever of the runner's lock files came with it.
+function dependencyFiles(runner: RunnerDefinition, sources: Record<string, string>): Record<string, string> {
+  const files: Record<string, string> = {};
+  for (const name of [runner.dependencyFile as string, ...(runner.dependencyLockFiles ?? [])]) {
+    if (sources[name] !== undefined) {
+      files[name] = sources[name];
     }
   }
+  return files;
+}
 
-  private collectArtifacts(runDir: string): SandboxResult['artifacts'] {
-    const outputsDir = path.join(runDir, 'outputs');
-    if (!fs.existsSync(outputsDir)) {
-      return [];
-    }
-    const entries = fs.readdirSync(outputsDir, { withFileTypes: true });
-    const artifacts: SandboxResult['artifacts'] = [];
-    for (const entry of entries) {
-      if (entry.isFile()) {
-        const fullPath = path.join(outputsDir, entry.name);
-        const stat = fs.statSync(fullPath);
-        artifacts.push({ path: fullPath, name: entry.name, size: stat.size });
-      }
-    }
-    return artifacts;
+// Proxy settings honoured by curl, pip, npm, Go and most HTTP client libraries.
+function proxyEnvironment(proxyUrl: string): Record<string, string> {
+  return {
+    HTTP_PROXY: proxyUrl,
+    HTTPS_PROXY: proxyUrl,
+    http_proxy: proxyUrl,
+    https_proxy: proxyUrl,
+    NO_PROXY: 'localhost,127.0.0.1',
+    no_proxy: 'localhost,127.0.0.1'
+  };
+}
+
+// When a dependency layer was last used: its newest completion marker, or for an install that
+// never completed the directory itself.
+function lastUsed(layerDir: string): number {
+  const markers = [path.join(layerDir, '.complete')];
+  const manifests = path.join(layerDir, 'manifests');
+  if (fs.existsSync(manifests)) {
+    markers.push(...fs.readdirSync(manifests).map((key) => path.join(manifests, key, '.complete')));
+  }
+  const used = markers.filter((marker) => fs.existsSync(marker)).map((marker) => fs.statSync(marker).mtimeMs);
+  return used.length > 0 ? Math.max(...used) : fs.statSync(layerDir).mtimeMs;
+}
+
+// Docker prints creation times as `2026-01-02 15:04:05 +0000 UTC`, podman with fractional seconds.
+function parseCreatedAt(created: string): number {
+  const match = /^(\d{4}-\d{2}-\d{2}) (\d{2}:\d{2}:\d{2})(\.\d+)? ([+-]\d{2})(\d{2})/.exec(created.trim());
+  if (!match) {
+    return NaN;
   }
+  return Date.parse(`${match[1]}T${match[2]}${(match[3] ?? '').slice(0, 4)}${match[4]}:${match[5]}`);
+}
 
-  private entryFileName(language: SandboxRunSpec['language']): string {
-    switch (language) {
-      case 'python':
-        return 'main.py';
-      case 'node':
-        return 'main.js';
-      case 'ruby':
-        return 'main.rb';
-      case 'php':
-        return 'main.php';
-      case 'go':
-        return 'main.go';
-      default:
-        return 'main.txt';
+// Written by the CLI on the API's side, outside the run directory the program could write to.
+function cidFile(containerName: string): string {
+  return path.join(os.tmpdir(), `${containerName}.cid`);
+}
+
+// Reads a container's memory and CPU time from its cgroup, found through the ID `run --cidfile`
+// wrote once the container was created. memory.peak, on kernels that keep it, also covers what
+// happened between polls; memory.current is what the OOM killer measures against --memory.
+function cgroupUsageProbe(cidPath: string, cgroupRoot: string): UsageProbe {
+  let dir: string | null = null;
+  return async () => {
+    if (!dir) {
+      const id = (await fs.promises.readFile(cidPath, 'utf8').catch(() => '')).trim();
+      const candidates = id ? CGROUP_LAYOUTS.map((layout) => path.join(cgroupRoot, layout(id))) : [];
+      dir = candidates.find((candidate) => fs.existsSync(path.join(candidate, 'memory.current'))) ?? null;
+      if (!dir) {
+        return null;
+      }
     }
+    const cgroup = dir;
+    const [current, peak, cpu] = await Promise.all(
+      ['memory.current', 'memory.peak', 'cpu.stat'].map((file) => fs.promises.readFile(path.join(cgroup, file), 'utf8').catch(() => ''))
+    );
+    if (!current.trim() || !Number.isFinite(Number(current))) {
+      return null;
+    }
+    const usageUsec = /^usage_usec (\d+)$/m.exec(cpu);
+    return {
+      memoryMb: Number(current) / (1024 * 1024),
+      peakMb: peak.trim() && Number.isFinite(Number(peak)) ? Number(peak) / (1024 * 1024) : undefined,
+      cpuMs: usageUsec ? Number(usageUsec[1]) / 1000 : null
+    };
+  };
+}
+
+function randomSuffix(): string {
+  const alphabet = '0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ';
+  const bytes = crypto.randomBytes(6);
+  let suffix = '';
+  for (let i = 0; i < 6; i++) {
+    suffix += alphabet[bytes[i] % alphabet.length];
   }
+  return suffix;
 }
@@ -0,0 +1,373 @@
+import crypto from 'node:crypto';
+import Boom from '@hapi/boom';
+import type { Authenticator } from './auth.js';
+import { parseCron } from './cron.js';
+import type { Orchestrator } from './orchestrator.js';
+import type { RunRecord, RunRequest } from './types.js';
+import type { WebhookDispatcher } from './webhooks.js';
+import type {
+  ExecutionStore,
+  OverlapPolicy,
+  ScheduleNotify,
+  ScheduleNotifyEvent,
+  ScheduleRecord,
+  ScheduleRunOutcome,
+  ScheduleRunRecord,
+  ScheduleStore
+} from '../store/store.js';
+import { withoutInlineContent } from '../store/store.js';
+import { Logger } from '../util/logger.js';
+
+export interface SchedulerOptions {
+  store: ExecutionStore & ScheduleStore;
+  orchestrator: Pick<Orchestrator, 'startRun' | 'checkRequest' | 'getActiveRun'>;
+  // Occurrences of schedules whose API key was revoked fail instead of running.
+  keyPolicy: Pick<Authenticator, 'policy'>;
+  // Posts the schedules' notifications; schedules can't ask for any when unset.
+  webhooks?: WebhookDispatcher;
+  // Schedules one API key may have.
+  maxPerKey: number;
+  // Occurrences kept in each schedule's history.
+  historyLimit: number;
+}
+
+// The fields of a schedule a caller sets; all but `request` can be changed later.
+export interface ScheduleInput {
+  name?: unknown;
+  cron?: unknown;
+  request?: unknown;
+  overlap?: unknown;
+  notify?: unknown;
+  enabled?: unknown;
+}
+
+// An occurrence as the history lists it, with how its execution is going.
+export interface ScheduleRunView extends ScheduleRunRecord {
+  // For started occurrences, `running` and then the execution's status, or null once the store
+  // no longer has it; null for the others.
+  status: string | null;
+}
+
+export interface SchedulerTick {
+  started: number;
+  skipped: number;
+  queued: number;
+  failed: number;
+}
+
+export interface SchedulerStats {
+  ticks: number;
+  occurrences: SchedulerTick;
+  last_tick_at: string | null;
+}
+
+const OVERLAP_POLICIES: OverlapPolicy[] = ['skip', 'queue'];
+const NOTIFY_EVENTS: ScheduleNotifyEvent[] = ['succeeded', 'failed', 'skipped'];
+const MAX_NAME_LENGTH = 100;
+// Saves that lose to a concurrent one are tried again this many times.
+const SAVE_ATTEMPTS = 3;
+
+// Runs stored submissions on cron expressions as the API key that registered them, e.g. a nightly
+// benchmark of a reference solution. Every server on a shared store ticks through the schedules,
+// and each occurrence starts on whichever saves the schedule's next revision first. An occurrence
+// due while the previous one is still running is skipped, or with overlap `queue` waits for it to
+// finish; at most one waits, and one due meanwhile is skipped. Occurrences missed while no server
+// was running aren't made up: the next one is counted from now.
+export class Scheduler {
+  private timer: NodeJS.Timeout | null = null;
+  private ticking: Promise<SchedulerTick> | null = null;
+  private readonly totals: SchedulerStats = {
+    ticks: 0,
+    occurrences: { started: 0, skipped: 0, queued: 0, failed: 0 },
+    last_tick_at: null
+  };
+
+  constructor(private readonly options: SchedulerOptions, private readonly logger: Logger) {}
+
+  public start(intervalMs: number) {
+    void this.tick();
+    this.timer = setInterval(() => void this.tick(), intervalMs);
+    this.timer.unref();
+  }
+
+  public stop() {
+    if (this.timer) {
+      clearInterval(this.timer);
+      this.timer = null;
+    }
+  }
+
+  // Starts, skips or queues the occurrences due by `now`.
+  public tick(now = Date.now()): Promise<SchedulerTick> {
+    if (!this.ticking) {
+      this.ticking = this.runDue(now).finally(() => {
+        this.ticking = null;
+      });
+    }
+    return this.ticking;
+  }
+
+  public stats(): SchedulerStats {
+    return { ...this.totals, occurrences: { ...this.totals.occurrences } };
+  }
+
+  public async create(apiKey: string, input: ScheduleInput): Promise<ScheduleRecord> {
+    const existing = await this.options.store.listSchedules(apiKey);
+    if (existing.length >= this.options.maxPerKey) {
+      throw Boom.badRequest(`an api key can have at most ${this.options.maxPerKey} schedules`, { code: 'too_many_schedules' });
+    }
+    const now = new Date();
+    const schedule = this.apply({
+      id: `sch_${crypto.randomBytes(9).toString('base64url')}`,
+      api_key: apiKey,
+      name: '',
+      cron: '',
+      request: this.parseRequest(input.request),
+      overlap: 'skip',
+      notify: null,
+      enabled: true,
+      created_at: now.toISOString(),
+      next_run_at: now.toISOString(),
+      last_execution_id: null,
+      queued_at: null,
+      revision: 1
+    }, { ...input, name: input.name ?? '', cron: input.cron ?? '' }, now);
+    await this.options.store.saveSchedule(schedule);
+    return schedule;
+  }
+
+  // Changes the fields given. A new cron expression, or enabling the schedule again, counts the
+  // next occurrence from now; disabling it drops a queued one.
+  public async update(apiKey: string, id: string, changes: ScheduleInput): Promise<ScheduleRecord> {
+    if (changes.request !== undefined) {
+      throw Boom.badRequest('request cannot be changed; create another schedule instead');
+    }
+    for (let attempt = 1; ; attempt += 1) {
+      const schedule = await this.get(apiKey, id);
+      const updated = this.apply({ ...schedule, revision: schedule.revision + 1 }, changes, new Date());
+      if (await this.options.store.saveSchedule(updated)) {
+        return updated;
+      }
+      if (attempt === SAVE_ATTEMPTS) {
+        throw Boom.conflict('schedule was changed concurrently; try again');
+      }
+    }
+  }
+
+  public list(apiKey: string): Promise<ScheduleRecord[]> {
+    return this.options.store.listSchedules(apiKey);
+  }
+
+  // Another key's schedules are not found, like its executions.
+  public async get(apiKey: string, id: string): Promise<ScheduleRecord> {
+    const schedule = await this.options.store.getSchedule(id);
+    if (!schedule || schedule.api_key !== apiKey) {
+      throw Boom.notFound('schedule not found');
+    }
+    return schedule;
+  }
+
+  // Takes the history with it; an execution already started runs to the end.
+  public async delete(apiKey: string, id: string) {
+    await this.get(apiKey, id);
+    await this.options.store.deleteSchedule(id);
+  }
+
+  public async history(apiKey: string, id: string, limit: number): Promise<ScheduleRunView[]> {
+    await this.get(apiKey, id);
+    const runs = await this.options.store.listScheduleRuns(id, limit);
+    return Promise.all(runs.map(async (run) => ({
+      ...run,
+      status: run.execution_id ? await this.executionStatus(run.execution_id) : null
+    })));
+  }
+
+  private async runDue(now: number): Promise<SchedulerTick> {
+    const tick: SchedulerTick = { started: 0, skipped: 0, queued: 0, failed: 0 };
+    const schedules = await this.options.store.listSchedules().catch((err: Error) => {
+      this.logger.warn('could not list schedules', { message: err.message });
+      return [];
+    });
+    for (const schedule of schedules) {
+      if (!schedule.enabled) {
+        continue;
+      }
+      try {
+        const outcome = await this.advance(schedule, now);
+        if (outcome) {
+          tick[outcome] += 1;
+          this.totals.occurrences[outcome] += 1;
+        }
+      } catch (err) {
+        this.logger.warn('schedule tick failed', { scheduleId: schedule.id, message: (err as Error).message });
+      }
+    }
+    this.totals.ticks += 1;
+    this.totals.last_tick_at = new Date(now).toISOString();
+    return tick;
+  }
+
+  // Deals with the schedule's due or queued occurrence; null when there is none, or when
+  // another server got to it first.
+  private async advance(schedule: ScheduleRecord, now: number): Promise<ScheduleRunOutcome | null> {
+    const due = Date.parse(schedule.next_run_at) <= now;
+    if (!due && schedule.queued_at === null) {
+      return null;
+    }
+    const previousRunning = schedule.last_execution_id !== null && (await this.executionStatus(schedule.last_execution_id)) === 'running';
+    if (!due && previousRunning) {
+      return null;
+    }
+    const next: ScheduleRecord = {
+      ...schedule,
+      next_run_at: due ? parseCron(schedule.cron).next(new Date(now)).toISOString() : schedule.next_run_at,
+      revision: schedule.revision + 1
+    };
+    const occurrence: ScheduleRunRecord = {
+      schedule_id: schedule.id,
+      scheduled_at: schedule.next_run_at,
+      recorded_at: new Date(now).toISOString(),
+      outcome: 'skipped',
+      execution_id: null,
+      error: null
+    };
+    if (!previousRunning) {
+      // A queued occurrence starts in place of one due at the same time.
+      occurrence.outcome = 'started';
+      occurrence.scheduled_at = schedule.queued_at ?? schedule.next_run_at;
+      next.queued_at = null;
+    } else if (schedule.overlap === 'queue' && schedule.queued_at === null) {
+      occurrence.outcome = 'queued';
+      next.queued_at = schedule.next_run_at;
+    }
+    if (!(await this.options.store.saveSchedule(next))) {
+      return null;
+    }
+    if (occurrence.outcome === 'started') {
+      try {
+        occurrence.execution_id = await this.startOccurrence(next, occurrence);
+      } catch (err) {
+        occurrence.outcome = 'failed';
+        occurrence.error = Boom.isBoom(err) ? err.message : 'internal_error';
+        this.logger.warn('scheduled execution did not start', { scheduleId: schedule.id, message: (err as Error).message });
+      }
+    }
+    await this.options.store.appendScheduleRun(occurrence, this.options.historyLimit);
+    if (occurrence.outcome === 'skipped' || occurrence.outcome === 'failed') {
+      void this.notify(next, occurrence.outcome, occurrence, null);
+    }
+    return occurrence.outcome;
+  }
+
+  private async startOccurrence(schedule: ScheduleRecord, occurrence: ScheduleRunRecord): Promise<string> {
+    if (!this.options.keyPolicy.policy(schedule.api_key)) {
+      throw Boom.forbidden('the api key of the schedule was revoked');
+    }
+    // The notification is sent from this server, so the run stays here when it drains.
+    const started = this.options.orchestrator.startRun(schedule.request, schedule.api_key, { keepOnDrain: schedule.notify !== null });
+    const finished: ScheduleRunRecord = { ...occurrence, execution_id: started.id };
+    void started.done.then(
+      (run) => this.notify(schedule, run.status === 'succeeded' ? 'succeeded' : 'failed', finished, withoutInlineContent(run)),
+      (err: unknown) => this.notify(schedule, 'failed', { ...finished, error: Boom.isBoom(err) ? err.message : 'internal_error' }, null)
+    );
+    await this.recordExecution(schedule, started.id);
+    return started.id;
+  }
+
+  // Remembers the occurrence's execution, which the next occurrence waits for or skips while it runs.
+  private async recordExecution(schedule: ScheduleRecord, executionId: string) {
+    let current: ScheduleRecord | null = schedule;
+    for (let attempt = 1; current && attempt <= SAVE_ATTEMPTS; attempt += 1) {
+      if (await this.options.store.saveSchedule({ ...current, last_execution_id: executionId, revision: current.revision + 1 })) {
+        return;
+      }
+      current = await this.options.store.getSchedule(schedule.id);
+    }
+  }
+
+  private async notify(schedule: ScheduleRecord, event: ScheduleNotifyEvent, occurrence: ScheduleRunRecord, run: RunRecord | null) {
+    if (!this.options.webhooks || !schedule.notify?.on.includes(event)) {
+      return;
+    }
+    await this.options.webhooks.deliver(schedule.notify.url, {
+      type: `schedule.${event}`,
+      id: schedule.id,
+      data: { schedule: { id: schedule.id, name: schedule.name, cron: schedule.cron }, occurrence, run }
+    });
+  }
+
+  // `running` until a record or error is stored, or null for executions the store no longer has.
+  private async executionStatus(id: string): Promise<string | null> {
+    if (this.options.orchestrator.getActiveRun(id)) {
+      return 'running';
+    }
+    const run = await this.options.store.get(id);
+    if (run) {
+      return run.status;
+    }
+    if (await this.options.store.getError(id)) {
+      return 'error';
+    }
+    return (await this.options.store.getSubmission(id)) ? 'running' : null;
+  }
+
+  private parseRequest(value: unknown): RunRequest {
+    if (typeof value !== 'object' || value === null || Array.isArray(value)) {
+      throw Boom.badRequest('request must be an execution request object');
+    }
+    const request = value as RunRequest;
+    this.options.orchestrator.checkRequest(request);
+    return request;
+  }
+
+  private apply(schedule: ScheduleRecord, changes: ScheduleInput, now: Date): ScheduleRecord {
+    const next = { ...schedule };
+    if (changes.name !== undefined) {
+      if (typeof changes.name !== 'string' || !changes.name.trim() || changes.name.length > MAX_NAME_LENGTH) {
+        throw Boom.badRequest(`name must be a non-empty string of at most ${MAX_NAME_LENGTH} characters`);
+      }
+      next.name = changes.name;
+    }
+    if (changes.overlap !== undefined) {
+      if (!OVERLAP_POLICIES.includes(changes.overlap as OverlapPolicy)) {
+        throw Boom.badRequest(`overlap must be one of ${OVERLAP_POLICIES.join(', ')}`);
+      }
+      next.overlap = changes.overlap as OverlapPolicy;
+    }
+    if (changes.notify !== undefined) {
+      next.notify = this.parseNotify(changes.notify);
+    }
+    if (changes.enabled !== undefined) {
+      if (typeof changes.enabled !== 'boolean') {
+        throw Boom.badRequest('enabled must be a boolean');
+      }
+      next.enabled = changes.enabled;
+    }
+    if (next.overlap === 'skip' || !next.enabled) {
+      next.queued_at = null;
+    }
+    if (changes.cron !== undefined || (next.enabled && !schedule.enabled)) {
+      const expression = parseCron(changes.cron ?? schedule.cron);
+      next.cron = expression.source;
+      next.next_run_at = expression.next(now).toISOString();
+    }
+    return next;
+  }
+
+  private parseNotify(value: unknown): ScheduleNotify | null {
+    if (value === null) {
+      return null;
+    }
+    if (!this.options.webhooks) {
+      throw Boom.badRequest('notify requires WEBHOOK_SECRET to be set on the server');
+    }
+    if (typeof value !== 'object' || Array.isArray(value)) {
+      throw Boom.badRequest('notify must be an object with a url');
+    }
+    const { url, on = NOTIFY_EVENTS } = value as { url?: unknown; on?: unknown };
+    if (!Array.isArray(on) || on.length === 0 || !on.every((event) => NOTIFY_EVENTS.includes(event))) {
+      throw Boom.badRequest(`notify.on must list some of ${NOTIFY_EVENTS.join(', ')}`);
+    }
+    return { url: this.options.webhooks.validateUrl(url, 'notify.url'), on: [...new Set(on as ScheduleNotifyEvent[])] };
+  }
+}
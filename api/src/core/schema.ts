@@ -0,0 +1,84 @@
+import Boom from '@hapi/boom';
+import { classifyTermination } from './termination.js';
+import type { RunRecord, RunRequest } from './types.js';
+
+// Version of the JSON encoding of run requests and run records. Fields are only ever added within
+// a version and readers skip the ones they don't know, so consumers keep working as the records
+// grow; renaming or removing a field, or changing what one means, takes a new version.
+export const SCHEMA_VERSION = 1;
+
+// Requests may name the version they were written against, and that version or an earlier one is
+// accepted. A newer request may depend on meanings this server doesn't know, so it is refused
+// rather than half understood. Fields the server doesn't know fail the request body check of the
+// HTTP API (see ApiSchema) unless it runs with UNKNOWN_FIELDS=ignore, which mixed-version fleets
+// behind one address want.
+export function checkRequestVersion(request: RunRequest) {
+  const version = request.schema_version;
+  if (version === undefined) {
+    return;
+  }
+  if (typeof version !== 'number' || !Number.isInteger(version) || version < 1) {
+    throw Boom.badRequest('schema_version must be a positive integer');
+  }
+  if (version > SCHEMA_VERSION) {
+    throw Boom.badRequest(`schema_version ${version} is not supported; this server speaks up to ${SCHEMA_VERSION}`, {
+      code: 'schema_version_unsupported',
+      supported: SCHEMA_VERSION
+    });
+  }
+}
+
+// Reads a run record as a store kept it. Records from before versioning count as version 1 and
+// lack what was added to them over time, which gets the value a run without the feature reports.
+// Fields a newer server wrote are kept as they are, so a rollback doesn't lose them.
+export function decodeRunRecord(value: unknown): RunRecord {
+  if (typeof value !== 'object' || value === null || Array.isArray(value)) {
+    throw new Error('run record must be a JSON object');
+  }
+  const record = value as Partial<RunRecord>;
+  const decoded = {
+    limit_exceeded: null,
+    timeout: null,
+    truncated: false,
+    dropped_bytes: { stdout: 0, stderr: 0 },
+    phases: {
+      compile: null,
+      run: { exit_code: record.exit_code ?? null, stdout: record.stdout ?? '', stderr: record.stderr ?? '', duration_ms: record.usage?.wall_ms ?? 0 }
+    },
+    artifacts_skipped: [],
+    tests: null,
+    coverage: null,
+    diagnostics: null,
+    results: null,
+    queue_wait_ms: 0,
+    detected_language: null,
+    mode: 'run',
+    isolation: 'container',
+    network: { mode: 'none' },
+    version: null,
+    toolchain: null,
+    cached_from: null,
+    retries: [],
+    metadata: {},
+    annotations: {},
+    policy_violations: [],
+    memory: null,
+    usage_samples: null,
+    cost: null,
+    signature: null,
+    ...record,
+    schema_version: typeof record.schema_version === 'number' ? record.schema_version : 1
+  } as RunRecord;
+  // Older records did not keep the signal a program died of, so their crashes read as exit codes.
+  decoded.termination ??= classifyTermination(
+    {
+      status: decoded.status,
+      exitCode: decoded.exit_code ?? null,
+      limitExceeded: decoded.limit_exceeded,
+      exitSignal: null,
+      compile: decoded.phases.compile
+    },
+    decoded.limits
+  );
+  return decoded;
+}
@@ -1,5 +1,130 @@
 import fs from 'node:fs';
+import type { NetworkPolicy } from './types.js';
 
 export function loadSeccompProfile(path: string) {
   return JSON.parse(fs.readFileSync(path, 'utf8')) as Record<string, unknown>;
 }
+
+// The process backend has no container runtime to apply the JSON profile above, so it loads a
+// deny-list seccomp-bpf filter itself (runners/seccomp_exec.py) before exec'ing the entrypoint.
+// Denied syscalls fail with EPERM; the filter is inherited by everything the entrypoint starts.
+export interface ProcessSeccompProfile {
+  deny: string[];
+  // Address families socket(2) refuses. AF_INET and AF_INET6 are added for runs without network.
+  denySocketFamilies: string[];
+}
+
+export interface SeccompOverride {
+  allow?: string[];
+  deny?: string[];
+}
+
+export interface ProcessSeccompConfig extends ProcessSeccompProfile {
+  // Per-language changes to the deny-list, keyed by language id.
+  languages: Record<string, SeccompOverride>;
+}
+
+// What the launcher loads: syscall and address family numbers for the host architecture.
+export interface SeccompFilter {
+  arch: 'x86_64' | 'aarch64';
+  syscalls: number[];
+  socket_families: number[];
+}
+
+export const DEFAULT_PROCESS_SECCOMP: ProcessSeccompConfig = {
+  deny: [
+    'ptrace', 'process_vm_readv', 'process_vm_writev', 'kcmp',
+    'mount', 'umount2', 'pivot_root', 'chroot', 'open_tree', 'move_mount', 'fsopen', 'fsmount',
+    'unshare', 'setns', 'name_to_handle_at', 'open_by_handle_at',
+    'init_module', 'finit_module', 'delete_module', 'kexec_load', 'kexec_file_load',
+    'bpf', 'perf_event_open', 'userfaultfd', 'io_uring_setup', 'io_uring_enter', 'io_uring_register',
+    'keyctl', 'add_key', 'request_key',
+    'reboot', 'swapon', 'swapoff', 'quotactl', 'acct', 'syslog', 'lookup_dcookie', 'personality',
+    'sethostname', 'setdomainname', 'settimeofday', 'clock_settime', 'adjtimex', 'iopl', 'ioperm'
+  ],
+  denySocketFamilies: ['AF_PACKET', 'AF_KEY', 'AF_ALG', 'AF_VSOCK', 'AF_BLUETOOTH', 'AF_XDP', 'AF_TIPC', 'AF_RDS', 'AF_CAN'],
+  languages: {
+    // Sanitizer runtimes (-fsanitize, go test -race) re-exec themselves with ASLR disabled.
+    cpp: { allow: ['personality'] },
+    rust: { allow: ['personality'] },
+    go: { allow: ['personality'] }
+  }
+};
+
+// Only the syscalls a deny-list may name are listed; iopl and ioperm do not exist on arm64.
+const SYSCALLS: Record<SeccompFilter['arch'], Record<string, number>> = {
+  x86_64: {
+    ptrace: 101, mount: 165, umount2: 166, pivot_root: 155, chroot: 161, swapon: 167, swapoff: 168,
+    reboot: 169, sethostname: 170, setdomainname: 171, iopl: 172, ioperm: 173, init_module: 175,
+    finit_module: 313, delete_module: 176, kexec_load: 246, kexec_file_load: 320, quotactl: 179, acct: 163,
+    settimeofday: 164, clock_settime: 227, adjtimex: 159, bpf: 321, perf_event_open: 298, unshare: 272,
+    setns: 308, keyctl: 250, add_key: 248, request_key: 249, userfaultfd: 323, process_vm_readv: 310,
+    process_vm_writev: 311, kcmp: 312, name_to_handle_at: 303, open_by_handle_at: 304, syslog: 103,
+    personality: 135, lookup_dcookie: 212, io_uring_setup: 425, io_uring_enter: 426, io_uring_register: 427,
+    open_tree: 428, move_mount: 429, fsopen: 430, fsmount: 432
+  },
+  aarch64: {
+    ptrace: 117, mount: 40, umount2: 39, pivot_root: 41, chroot: 51, swapon: 224, swapoff: 225, reboot: 142,
+    sethostname: 161, setdomainname: 162, init_module: 105, finit_module: 273, delete_module: 106,
+    kexec_load: 104, kexec_file_load: 294, quotactl: 60, acct: 89, settimeofday: 170, clock_settime: 112,
+    adjtimex: 171, bpf: 280, perf_event_open: 241, unshare: 97, setns: 268, keyctl: 219, add_key: 217,
+    request_key: 218, userfaultfd: 282, process_vm_readv: 270, process_vm_writev: 271, kcmp: 272,
+    name_to_handle_at: 264, open_by_handle_at: 265, syslog: 116, personality: 92, lookup_dcookie: 18,
+    io_uring_setup: 425, io_uring_enter: 426, io_uring_register: 427, open_tree: 428, move_mount: 429,
+    fsopen: 430, fsmount: 432
+  }
+};
+
+const SOCKET_FAMILIES: Record<string, number> = {
+  AF_UNIX: 1, AF_INET: 2, AF_AX25: 3, AF_APPLETALK: 5, AF_X25: 9, AF_INET6: 10, AF_KEY: 15, AF_NETLINK: 16,
+  AF_PACKET: 17, AF_RDS: 21, AF_CAN: 29, AF_TIPC: 30, AF_BLUETOOTH: 31, AF_ALG: 38, AF_VSOCK: 40, AF_XDP: 44
+};
+
+export function seccompArch(): SeccompFilter['arch'] | null {
+  if (process.platform !== 'linux') {
+    return null;
+  }
+  return process.arch === 'x64' ? 'x86_64' : process.arch === 'arm64' ? 'aarch64' : null;
+}
+
+// Reads a JSON profile whose fields replace the defaults, so a file holding only `languages`
+// keeps the default deny-list. Unknown names are rejected here rather than on every run.
+export function loadProcessSeccomp(path?: string): ProcessSeccompConfig {
+  const config = path
+    ? { ...DEFAULT_PROCESS_SECCOMP, ...(JSON.parse(fs.readFileSync(path, 'utf8')) as Partial<ProcessSeccompConfig>) }
+    : DEFAULT_PROCESS_SECCOMP;
+  const overrides = Object.values(config.languages ?? {});
+  const syscalls = [...config.deny, ...overrides.flatMap((override) => [...(override.allow ?? []), ...(override.deny ?? [])])];
+  for (const name of syscalls) {
+    if (!Object.values(SYSCALLS).some((table) => name in table)) {
+      throw new Error(`unknown syscall in seccomp profile: ${name}`);
+    }
+  }
+  for (const family of config.denySocketFamilies) {
+    if (!(family in SOCKET_FAMILIES)) {
+      throw new Error(`unknown socket family in seccomp profile: ${family}`);
+    }
+  }
+  return { ...config, languages: config.languages ?? {} };
+}
+
+export function compileProcessSeccomp(
+  config: ProcessSeccompConfig,
+  arch: SeccompFilter['arch'],
+  language: string,
+  network: NetworkPolicy
+): SeccompFilter {
+  const override = config.languages[language] ?? {};
+  const allowed = new Set(override.allow ?? []);
+  const deny = [...config.deny, ...(override.deny ?? [])].filter((name) => !allowed.has(name));
+  // Loopback runs keep inet sockets: the host has no per-run network namespace to confine them.
+  const families = network.mode === 'none'
+    ? [...config.denySocketFamilies, 'AF_INET', 'AF_INET6']
+    : config.denySocketFamilies;
+  const table = SYSCALLS[arch];
+  return {
+    arch,
+    syscalls: [...new Set(deny.filter((name) => name in table).map((name) => table[name]))],
+    socket_families: [...new Set(families.map((family) => SOCKET_FAMILIES[family]))]
+  };
+}
@@ -2,6 +2,8 @@ import crypto from 'node:crypto';
 import fs from 'node:fs';
 import path from 'node:path';
 import Boom from '@hapi/boom';
+import { FilesystemObjectStore } from './object_store.js';
+import type { ObjectStore } from './object_store.js';
 import type { RunArtifact, UploadedFile } from './types.js';
 
 export interface StorageConfig {
@@ -9,6 +11,12 @@ export interface StorageConfig {
   baseUrl: string;
   signingKey: string;
   urlTtlSeconds: number;
+  // Where artifacts go; baseDir, served on /v1/files, when unset. Uploads always stay in baseDir,
+  // since runs stage them from there.
+  objects?: ObjectStore;
+  // Largest artifact whose contents `inline_artifacts` returns in the record; bigger ones only
+  // come back as URLs. Unlimited when unset.
+  maxInlineBytes?: number;
 }
 
 export interface PresignPayload {
@@ -18,7 +26,11 @@ export interface PresignPayload {
 }
 
 export class ArtifactStorage {
-  constructor(private readonly config: StorageConfig) { }
+  private readonly objects: ObjectStore;
+
+  constructor(private readonly config: StorageConfig) {
+    this.objects = config.objects ?? new FilesystemObjectStore(config.baseDir, (urlPath, expiresAt) => this.signUrl(urlPath, expiresAt));
+  }
 
   public ensureBaseDir() {
     fs.mkdirSync(this.config.baseDir, { recursive: true });
@@ -57,39 +69,53 @@ export class ArtifactStorage {
     return meta;
   }
 
-  public moveArtifact(sourcePath: string, name: string, contentType?: string): RunArtifact {
+  // Uploads a collected artifact to the object store and removes it from the run directory. With
+  // `inline` its contents come back base64-encoded too, unless it is over maxInlineBytes.
+  public async storeArtifact(sourcePath: string, name: string, options: { contentType?: string; inline?: boolean } = {}): Promise<RunArtifact> {
     const artifactId = this.generateFileId();
-    const destDir = path.join(this.config.baseDir, 'artifacts', artifactId);
-    fs.mkdirSync(destDir, { recursive: true });
-    const fileName = path.basename(name);
-    const destPath = path.join(destDir, fileName);
-    const data = fs.readFileSync(sourcePath);
-    fs.writeFileSync(destPath, data);
-    const sha256 = crypto.createHash('sha256').update(data).digest('hex');
-    const size = data.length;
-    const metadata = {
-      id: artifactId,
-      name: fileName,
-      originalName: name,
-      contentType: contentType ?? 'application/octet-stream',
-      size,
-      sha256
-    };
-    fs.writeFileSync(path.join(destDir, 'meta.json'), JSON.stringify(metadata));
-    fs.rmSync(sourcePath, { force: true });
-    const expiresAt = new Date(Date.now() + this.config.urlTtlSeconds * 1000).toISOString();
-    const urlPath = `/v1/files/${artifactId}`;
-    const url = this.signUrl(urlPath, expiresAt);
+    const data = await fs.promises.readFile(sourcePath);
+    const contentType = options.contentType ?? 'application/octet-stream';
+    const key = `${artifactId}/${path.basename(name)}`;
+    await this.objects.put(key, data, contentType);
+    await fs.promises.rm(sourcePath, { force: true });
+    const expiresAt = new Date(Date.now() + this.config.urlTtlSeconds * 1000);
+    const inline = options.inline && data.length <= (this.config.maxInlineBytes ?? Infinity);
     return {
       name,
-      size,
-      sha256,
-      url,
-      expires_at: expiresAt,
-      content_type: metadata.contentType
+      size: data.length,
+      sha256: crypto.createHash('sha256').update(data).digest('hex'),
+      url: await this.objects.signedUrl(key, expiresAt),
+      expires_at: expiresAt.toISOString(),
+      content_type: contentType,
+      ...(inline ? { content: data.toString('base64') } : {})
     };
   }
 
+  // The object key of an artifact kept in baseDir; null for one uploaded to a bucket, which the
+  // bucket's own lifecycle rules keep or expire.
+  public localArtifactKey(artifact: RunArtifact): string | null {
+    if (this.objects.kind !== 'filesystem') {
+      return null;
+    }
+    const match = /\/v1\/files\/([^/]+)$/.exec(new URL(artifact.url).pathname);
+    return match ? `${match[1]}/${path.basename(artifact.name)}` : null;
+  }
+
+  public readArtifact(key: string): Promise<Buffer | null> {
+    return this.objects.get(key);
+  }
+
+  public deleteArtifact(key: string): Promise<void> {
+    return this.objects.delete(key);
+  }
+
+  // Stores an archived artifact under its key again, with a download URL from now on.
+  public async restoreArtifact(key: string, data: Buffer, contentType: string): Promise<Pick<RunArtifact, 'url' | 'expires_at'>> {
+    await this.objects.put(key, data, contentType);
+    const expiresAt = new Date(Date.now() + this.config.urlTtlSeconds * 1000);
+    return { url: await this.objects.signedUrl(key, expiresAt), expires_at: expiresAt.toISOString() };
+  }
+
   public signUrl(urlPath: string, expiresAtIso: string): string {
     const exp = Math.floor(new Date(expiresAtIso).getTime() / 1000);
     const payload: PresignPayload = { path: urlPath, exp, method: 'GET' };
@@ -129,7 +155,6 @@ export class ArtifactStorage {
     }
     const meta = JSON.parse(fs.readFileSync(metaPath, 'utf8')) as {
       name: string;
-      originalName: string;
       contentType: string;
       size: number;
       sha256: string;
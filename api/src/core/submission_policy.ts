@@ -0,0 +1,150 @@
+import Boom from '@hapi/boom';
+import { RUN_STARTED_MARKER } from './run_dir.js';
+import type { RunRequest } from './types.js';
+
+export interface SubmissionPolicyOptions {
+  // Files a request may carry in `sources`.
+  maxFiles?: number;
+  // Combined UTF-8 size of `code`, the template and every source.
+  maxBytes?: number;
+  // Largest single source, `code` included; maxBytes when unset.
+  maxFileBytes?: number;
+  // Whether sources may hold NUL and other control characters a text file would not.
+  allowBinary?: boolean;
+}
+
+export type SourceErrorReason =
+  | 'invalid_path'
+  | 'reserved_name'
+  | 'path_conflict'
+  | 'not_a_string'
+  | 'too_large'
+  | 'binary'
+  | 'invalid_utf8'
+  | 'too_many_files'
+  | 'total_too_large';
+
+// One problem with a submission: `path` is the source's path, `code` for the request's code,
+// `template` for its template's source, `files[<index>]` for an uploaded file, or null for limits of the submission as a whole.
+export interface SourceError {
+  path: string | null;
+  reason: SourceErrorReason;
+  message: string;
+}
+
+// Top-level names the runners and the API use in the run directory.
+const RESERVED_NAMES = ['inputs', 'outputs', 'tmp', 'usage.json', '.build', RUN_STARTED_MARKER];
+
+const DEFAULT_MAX_FILES = 100;
+const DEFAULT_MAX_BYTES = 200 * 1024;
+const MAX_PATH_LENGTH = 255;
+// Control characters other than tab, newline, form feed and carriage return.
+const BINARY_PATTERN = /[\u0000-\u0008\u000B\u000E-\u001F\u007F]/;
+const LONE_SURROGATE_PATTERN = /[\uD800-\uDBFF](?![\uDC00-\uDFFF])|(?<![\uD800-\uDBFF])[\uDC00-\uDFFF]/;
+
+// Checks the files of a submission before anything is written to disk: how many there are and
+// how large, that they are text, and that every path stays inside the run directory without
+// touching the names the runners use. Every problem is collected, so a request with several bad
+// files learns about all of them from one 400 whose `data.errors` lists them per file.
+export class SubmissionPolicy {
+  private readonly maxFiles: number;
+  private readonly maxBytes: number;
+  private readonly maxFileBytes: number;
+
+  constructor(private readonly options: SubmissionPolicyOptions = {}) {
+    this.maxFiles = options.maxFiles ?? DEFAULT_MAX_FILES;
+    this.maxBytes = options.maxBytes ?? DEFAULT_MAX_BYTES;
+    this.maxFileBytes = options.maxFileBytes ?? this.maxBytes;
+  }
+
+  public validate(request: Pick<RunRequest, 'code' | 'template' | 'sources' | 'files'>) {
+    const errors: SourceError[] = [];
+    const sources = request.sources ?? {};
+    if (typeof sources !== 'object' || sources === null || Array.isArray(sources)) {
+      throw Boom.badRequest('sources must be an object of strings');
+    }
+    const paths = Object.keys(sources);
+    if (paths.length > this.maxFiles) {
+      errors.push({ path: null, reason: 'too_many_files', message: `sources exceeds ${this.maxFiles} files` });
+    }
+    let totalBytes = 0;
+    if (request.code !== undefined) {
+      if (typeof request.code !== 'string') {
+        errors.push({ path: 'code', reason: 'not_a_string', message: 'code must be a string' });
+      } else {
+        totalBytes += this.checkContents('code', request.code, errors);
+      }
+    }
+    if (typeof request.template?.source === 'string') {
+      totalBytes += this.checkContents('template', request.template.source, errors);
+    }
+    for (const sourcePath of paths) {
+      const pathError = checkPath(sourcePath) ?? checkReserved(sourcePath);
+      if (pathError) {
+        errors.push({ path: sourcePath, ...pathError });
+        continue;
+      }
+      const conflict = paths.find((other) => other.startsWith(`${sourcePath}/`));
+      if (conflict) {
+        errors.push({ path: sourcePath, reason: 'path_conflict', message: `source ${sourcePath} is also the directory of ${conflict}` });
+        continue;
+      }
+      if (typeof sources[sourcePath] !== 'string') {
+        errors.push({ path: sourcePath, reason: 'not_a_string', message: `source ${sourcePath} must be a string` });
+        continue;
+      }
+      totalBytes += this.checkContents(sourcePath, sources[sourcePath], errors);
+    }
+    if (totalBytes > this.maxBytes) {
+      errors.push({ path: null, reason: 'total_too_large', message: `code exceeds ${formatBytes(this.maxBytes)}` });
+    }
+    (request.files ?? []).forEach((file, index) => {
+      if (typeof file?.path !== 'string' || checkPath(file.path)) {
+        errors.push({ path: `files[${index}]`, reason: 'invalid_path', message: `invalid file path: ${String(file?.path)}` });
+      }
+    });
+    if (errors.length > 0) {
+      throw Boom.badRequest(errors.map((error) => error.message).join('; '), { code: 'invalid_submission', errors });
+    }
+  }
+
+  // Returns the size of the contents, recording what is wrong with them.
+  private checkContents(name: string, contents: string, errors: SourceError[]) {
+    const bytes = Buffer.byteLength(contents, 'utf8');
+    const label = name === 'code' || name === 'template' ? name : `source ${name}`;
+    if (bytes > this.maxFileBytes) {
+      errors.push({ path: name, reason: 'too_large', message: `${label} exceeds ${formatBytes(this.maxFileBytes)}` });
+    }
+    if (LONE_SURROGATE_PATTERN.test(contents)) {
+      errors.push({ path: name, reason: 'invalid_utf8', message: `${label} is not valid UTF-8` });
+    } else if (!this.options.allowBinary && BINARY_PATTERN.test(contents)) {
+      errors.push({ path: name, reason: 'binary', message: `${label} contains binary data` });
+    }
+    return bytes;
+  }
+}
+
+// Relative, normalized and printable, so that the path means the same file wherever it is joined.
+function checkPath(sourcePath: string): Pick<SourceError, 'reason' | 'message'> | null {
+  const segments = sourcePath.split('/');
+  const invalid =
+    sourcePath.length === 0 ||
+    sourcePath.length > MAX_PATH_LENGTH ||
+    sourcePath.startsWith('/') ||
+    sourcePath.includes('\\') ||
+    /[\u0000-\u001F\u007F]/.test(sourcePath) ||
+    segments.some((segment) => segment === '' || segment === '.' || segment === '..');
+  return invalid ? { reason: 'invalid_path', message: `invalid source path: ${sourcePath}` } : null;
+}
+
+// Sources are materialised at the root of /work alongside the entry file, so they must not shadow
+// the directories and files the runners manage themselves.
+function checkReserved(sourcePath: string): Pick<SourceError, 'reason' | 'message'> | null {
+  return RESERVED_NAMES.includes(sourcePath.split('/')[0])
+    ? { reason: 'reserved_name', message: `source path uses reserved name: ${sourcePath}` }
+    : null;
+}
+
+function formatBytes(bytes: number) {
+  return bytes % 1024 === 0 ? `${bytes / 1024} KiB` : `${bytes} bytes`;
+}
@@ -0,0 +1,127 @@
+import Boom from '@hapi/boom';
+import type { CodeTemplate, CoverageFile, CoverageReport, Diagnostic, RunRequest } from './types.js';
+
+export const DEFAULT_PLACEHOLDER = '{{code}}';
+// Stands in for the entry file in output that points at a line of the template.
+export const TEMPLATE_FILE = '<template>';
+
+// Where the code landed in the expanded entry file, for mapping what the toolchain reports back
+// onto the lines the submitter wrote.
+export interface TemplateMap {
+  file: string;
+  // Line of the expanded file holding the first line of code, and how many lines the code has.
+  firstLine: number;
+  lines: number;
+  // Column the code starts at on its first line, and the indent added to each later one.
+  firstColumn: number;
+  indent: number;
+}
+
+interface Position {
+  line: number;
+  column: number | null;
+  origin: 'code' | 'template';
+}
+
+export function validateTemplate(request: Pick<RunRequest, 'template' | 'code'>) {
+  const template = request.template;
+  if (template === undefined) {
+    return;
+  }
+  if (typeof template !== 'object' || template === null || Array.isArray(template)) {
+    throw Boom.badRequest('template must be an object');
+  }
+  if (typeof template.source !== 'string') {
+    throw Boom.badRequest('template.source must be a string');
+  }
+  if (template.placeholder !== undefined && (typeof template.placeholder !== 'string' || template.placeholder.length === 0)) {
+    throw Boom.badRequest('template.placeholder must be a non-empty string');
+  }
+  const placeholder = template.placeholder ?? DEFAULT_PLACEHOLDER;
+  if (template.source.split(placeholder).length !== 2) {
+    throw Boom.badRequest(`template.source must contain ${placeholder} exactly once`);
+  }
+  if (typeof request.code !== 'string' || request.code.length === 0) {
+    throw Boom.badRequest('template requires code');
+  }
+}
+
+// Puts the code where the placeholder is. When the placeholder is indented on a line of its
+// own, every line of the code gets that indent, so a Python function lands inside the class or
+// block around it.
+export function expandTemplate(template: CodeTemplate, code: string, file: string): { source: string; map: TemplateMap } {
+  const placeholder = template.placeholder ?? DEFAULT_PLACEHOLDER;
+  const at = template.source.indexOf(placeholder);
+  const before = template.source.slice(0, at);
+  const prefix = before.slice(before.lastIndexOf('\n') + 1);
+  const indent = /^[ \t]*$/.test(prefix) ? prefix : '';
+  // The template's own line break follows the last line.
+  const lines = code.replace(/\r?\n$/, '').split('\n');
+  const injected = lines.map((line, index) => (index === 0 || line === '' ? line : `${indent}${line}`)).join('\n');
+  return {
+    source: `${before}${injected}${template.source.slice(at + placeholder.length)}`,
+    map: { file, firstLine: before.split('\n').length, lines: lines.length, firstColumn: prefix.length + 1, indent: indent.length }
+  };
+}
+
+// Findings on lines of the code move to the code's own lines, and those elsewhere in the entry
+// file to the lines of the template's source; `origin` says which. Other files are left alone.
+export function remapDiagnostics(diagnostics: Diagnostic[], map: TemplateMap): Diagnostic[] {
+  return diagnostics.map((diagnostic) =>
+    diagnostic.file === map.file && diagnostic.line !== null ? { ...diagnostic, ...locate(map, diagnostic.line, diagnostic.column) } : diagnostic
+  );
+}
+
+// References to the entry file in what the toolchain and the program print, such as `main.go:12:5`,
+// `(Main.java:12)`, Python's `File "main.py", line 12` or PHP's `main.php on line 12` and
+// `main.php(12)`, move to the submitted code's lines in place. Those pointing into the template
+// name TEMPLATE_FILE instead, so its lines are not mistaken for the submitter's.
+export function remapOutput(text: string, map: TemplateMap): string {
+  const escaped = map.file.replace(/[.*+?^${}()|[\]\\]/g, '\\$&');
+  const reference = new RegExp(`(?<![\\w.-])((?:[\\w.-]*/)*)${escaped}(:|", line | on line |\\()(\\d+)(?::(\\d+))?`, 'g');
+  return text.replace(reference, (_, dir: string, separator: string, line: string, column: string | undefined) => {
+    const position = locate(map, Number(line), column === undefined ? null : Number(column));
+    const file = position.origin === 'code' ? `${dir}${map.file}` : TEMPLATE_FILE;
+    return `${file}${separator}${position.line}${position.column === null ? '' : `:${position.column}`}`;
+  });
+}
+
+// Coverage of the entry file counts only the lines of the code, numbered as submitted; the
+// template's lines are not the submitter's to cover.
+export function remapCoverage(report: CoverageReport, map: TemplateMap): CoverageReport {
+  const own = (lines: number[]) =>
+    lines.flatMap((line) => {
+      const position = locate(map, line, null);
+      return position.origin === 'code' ? [position.line] : [];
+    });
+  const files = report.files.map((file) => (file.file === map.file ? coverageFile(file.file, own(file.covered), own(file.missed)) : file));
+  const covered = files.reduce((sum, file) => sum + file.covered_lines, 0);
+  const total = files.reduce((sum, file) => sum + file.total_lines, 0);
+  return { ...report, covered_lines: covered, total_lines: total, percent: percent(covered, total), files };
+}
+
+function locate(map: TemplateMap, line: number, column: number | null): Position {
+  const offset = line - map.firstLine;
+  if (offset < 0) {
+    return { line, column, origin: 'template' };
+  }
+  if (offset >= map.lines) {
+    return { line: line - map.lines + 1, column, origin: 'template' };
+  }
+  if (offset === 0) {
+    return column !== null && column < map.firstColumn
+      ? { line, column, origin: 'template' }
+      : { line: 1, column: column === null ? null : column - map.firstColumn + 1, origin: 'code' };
+  }
+  return { line: offset + 1, column: column === null ? null : Math.max(1, column - map.indent), origin: 'code' };
+}
+
+function coverageFile(file: string, covered: number[], missed: number[]): CoverageFile {
+  const total = covered.length + missed.length;
+  return { file, covered_lines: covered.length, total_lines: total, percent: percent(covered.length, total), covered, missed };
+}
+
+// Two decimals, and 100 for files without a line to cover, as the runners report it.
+function percent(covered: number, total: number) {
+  return total === 0 ? 100 : Math.round((covered * 10000) / total) / 100;
+}
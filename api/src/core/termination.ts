@@ -0,0 +1,106 @@
+import type { LimitKind, PhaseResult, RunLimits, RunStatus, Termination, TerminationVerdict } from './types.js';
+
+export interface Outcome {
+  status: RunStatus;
+  exitCode: number | null;
+  limitExceeded: LimitKind | null;
+  exitSignal: string | null;
+  compile: PhaseResult | null;
+}
+
+const SIGNAL_VERDICTS: Record<string, TerminationVerdict> = {
+  SIGSEGV: 'segmentation_fault',
+  SIGBUS: 'bus_error',
+  SIGFPE: 'floating_point_exception',
+  SIGABRT: 'aborted',
+  SIGILL: 'illegal_instruction',
+  SIGKILL: 'killed'
+};
+
+const LIMIT_VERDICTS: Record<LimitKind, TerminationVerdict> = {
+  wall_time: 'time_limit',
+  cpu_time: 'cpu_limit',
+  memory: 'memory_limit',
+  output: 'output_limit',
+  disk: 'disk_limit',
+  processes: 'process_limit'
+};
+
+const SIGNAL_EXPLANATIONS: Partial<Record<TerminationVerdict, string>> = {
+  segmentation_fault:
+    'The program crashed with a segmentation fault (SIGSEGV): it accessed memory it may not, for example through a null or dangling pointer, an index out of bounds or a stack overflow from deep recursion.',
+  bus_error:
+    'The program crashed with a bus error (SIGBUS): it accessed memory that is misaligned or no longer backed by anything, such as a memory-mapped file that was truncated.',
+  floating_point_exception:
+    'The program crashed with an arithmetic error (SIGFPE), most often an integer division or remainder by zero, or a division that overflows.',
+  aborted:
+    'The program aborted itself (SIGABRT), typically on a failed assertion, an uncaught C++ exception or heap corruption detected by the allocator.',
+  illegal_instruction:
+    'The program crashed on an illegal instruction (SIGILL), which compilers also emit as a trap for undefined behaviour such as a function that returns nothing where it must return a value.'
+};
+
+// Says why a run ended, for callers who would otherwise have to make sense of exit code 139 or
+// status `killed` themselves. A limit that stopped the run wins over the signal it was stopped
+// with, and a crash signal over the exit status the runner derived from it.
+export function classifyTermination(outcome: Outcome, limits: RunLimits): Termination {
+  const verdict = terminationVerdict(outcome);
+  // Signals the sandbox sent to enforce a limit are its doing, not the program's.
+  const enforced = verdict === 'canceled' || Object.values(LIMIT_VERDICTS).includes(verdict);
+  const signal = enforced ? null : outcome.exitSignal;
+  return { verdict, signal, explanation: explain(verdict, outcome, limits) };
+}
+
+function terminationVerdict(outcome: Outcome): TerminationVerdict {
+  if (outcome.status === 'canceled') {
+    return 'canceled';
+  }
+  if (outcome.compile && outcome.compile.exit_code !== 0) {
+    return 'compile_error';
+  }
+  if (outcome.status === 'timeout') {
+    return 'time_limit';
+  }
+  if (outcome.status === 'oom') {
+    return 'memory_limit';
+  }
+  if (outcome.status === 'killed') {
+    return outcome.limitExceeded ? LIMIT_VERDICTS[outcome.limitExceeded] : 'killed';
+  }
+  if (outcome.exitSignal) {
+    return SIGNAL_VERDICTS[outcome.exitSignal] ?? 'signaled';
+  }
+  return outcome.exitCode === 0 || outcome.exitCode === null ? 'exited' : 'exited_nonzero';
+}
+
+function explain(verdict: TerminationVerdict, outcome: Outcome, limits: RunLimits): string {
+  switch (verdict) {
+    case 'exited':
+      return 'The program exited normally.';
+    case 'exited_nonzero':
+      return `The program exited with code ${outcome.exitCode}.`;
+    case 'compile_error':
+      return `The build failed with exit code ${outcome.compile?.exit_code}, so the program did not run.`;
+    case 'time_limit':
+      return `The program was still running at its time limit of ${limits.timeout_ms} ms and was stopped.`;
+    case 'cpu_limit':
+      return `The program used up its ${limits.cpu_ms} ms of CPU time and was killed.`;
+    case 'memory_limit':
+      return `The program ran out of memory: it went over its ${limits.memory_mb} MB and was killed by the kernel's OOM killer.`;
+    case 'output_limit':
+      return 'The program wrote more output than the run may keep and was stopped.';
+    case 'disk_limit':
+      return `The program wrote more than its ${limits.disk_mb} MB of disk space and was stopped.`;
+    case 'process_limit':
+      return `The program tried to run more than ${limits.max_processes} processes or threads at once and failed once a fork was refused.`;
+    case 'killed':
+      return outcome.exitSignal
+        ? `The program was killed with ${outcome.exitSignal} by something other than the run's limits.`
+        : 'The program was killed by the sandbox.';
+    case 'signaled':
+      return `The program was ended by ${outcome.exitSignal}.`;
+    case 'canceled':
+      return 'The run was canceled before it finished.';
+    default:
+      return SIGNAL_EXPLANATIONS[verdict] as string;
+  }
+}
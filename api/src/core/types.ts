@@ -1,21 +1,169 @@
-export type Language = 'python' | 'node' | 'ruby' | 'php' | 'go';
+// Languages are resolved through the runner registry (see runners.ts) so new runners can be
+// added without widening a union here.
+export type Language = string;
 
 export interface RunLimits {
+  // Wall-clock limit; at it the program gets SIGTERM, and kill_grace_ms later SIGKILL.
   timeout_ms: number;
+  // How long a program past timeout_ms has to flush its output and exit before it is killed.
+  kill_grace_ms: number;
   memory_mb: number;
   cpu_ms: number;
   max_output_bytes: number;
+  // Per-stream caps; both follow max_output_bytes unless a request sets them.
+  max_stdout_bytes: number;
+  max_stderr_bytes: number;
   max_artifact_bytes: number;
   max_artifact_files: number;
+  max_artifact_file_bytes: number;
+  // Space the run may add to its working directory, outputs/ and tmp/ included.
+  disk_mb: number;
+  // Processes and threads the run may have at once; forks past it fail, containing fork bombs.
+  max_processes: number;
+  // Descriptors the program may have open at once (RLIMIT_NOFILE).
+  max_open_files: number;
+  // Largest core file a crashing program may leave (RLIMIT_CORE); 0 turns core dumps off. Above
+  // 0, C, C++ and Rust runs that crash keep the core and a stack trace as artifacts.
+  core_dump_mb: number;
 }
 
+// Measured by the runner for the program itself, excluding compilation.
 export interface RunUsage {
   wall_ms: number;
+  // User plus system CPU time.
   cpu_ms: number;
+  // Null when the runner could not tell user and system time apart, e.g. it died before reporting.
+  user_cpu_ms?: number | null;
+  system_cpu_ms?: number | null;
+  // Peak resident set size.
   max_rss_mb: number;
 }
 
-export type RunStatus = 'succeeded' | 'failed' | 'timeout' | 'oom' | 'killed';
+// What a run consumed, for billing and usage reports; zero for runs no sandbox ran, such as
+// cached answers.
+export interface RunCost {
+  cpu_seconds: number;
+  // The memory limit the sandbox held, in GB, times sandbox_seconds.
+  memory_gb_seconds: number;
+  // From creating the sandbox to tearing it down, the build included.
+  sandbox_seconds: number;
+  // The three above weighted by the deployment's rates and added up.
+  units: number;
+}
+
+// Sent when a run's memory first passes one of the deployment's thresholds, before the limit is
+// reached and the program is killed.
+export interface MemoryWarning {
+  threshold_pct: number;
+  used_mb: number;
+  limit_mb: number;
+  // Since the sandbox started.
+  elapsed_ms: number;
+}
+
+// How close a run came to memory_mb, for telling a program that barely missed it from one that
+// ran away.
+export interface MemoryReport {
+  limit_mb: number;
+  // The higher of the runner's peak RSS and what the backend sampled from outside the sandbox,
+  // which a program the OOM killer took never gets to report itself.
+  peak_mb: number;
+  peak_pct: number;
+  // Whether the backend sampled the sandbox while it ran; without samples a killed run's peak is
+  // what its runner reported, or the limit when it reported nothing.
+  sampled: boolean;
+  // Thresholds crossed, in the order they were.
+  warnings: MemoryWarning[];
+}
+
+// A reading of the sandbox taken while the run was in flight.
+export interface UsageSample {
+  // Since the sandbox started.
+  elapsed_ms: number;
+  // Memory the sandbox held at the time of the reading.
+  memory_mb: number;
+  // CPU time of its processes so far, and the share of a core they used since the reading before
+  // (above 100 on several cores); null when the backend cannot read CPU time.
+  cpu_ms: number | null;
+  cpu_pct: number | null;
+}
+
+// The readings of a run that asked for them with usage_interval_ms, oldest first. A long run keeps
+// every other reading each time it reaches the deployment's maximum, so `interval_ms` is the
+// requested interval doubled as often as that happened.
+export interface UsageSeries {
+  interval_ms: number;
+  samples: UsageSample[];
+}
+
+export interface PhaseResult {
+  exit_code: number | null;
+  stdout: string;
+  stderr: string;
+  duration_ms: number;
+  // Set when the compile phase was skipped because the build came from the compilation cache.
+  cached?: boolean;
+}
+
+// Compiled languages report the build separately from the program run; `compile` is null for
+// interpreted languages and `run` is null when the build failed.
+export interface RunPhases {
+  compile: PhaseResult | null;
+  run: PhaseResult | null;
+}
+
+// How a program that reached timeout_ms was stopped: it exited within kill_grace_ms of SIGTERM
+// (`soft`), or its process group was SIGKILLed once the grace period ran out (`hard`).
+export interface TimeoutReport {
+  stage: 'soft' | 'hard';
+  // From SIGTERM until the program exited or was killed.
+  grace_ms: number;
+  // Output kept from each stream until the program ended.
+  stdout_bytes: number;
+  stderr_bytes: number;
+  // Bytes of that output written after SIGTERM.
+  flushed_bytes: number;
+}
+
+export type RunStatus = 'succeeded' | 'failed' | 'timeout' | 'oom' | 'killed' | 'canceled';
+
+// Why a run ended, finer than its status: which limit stopped it, or which crash a signal such as
+// SIGSEGV or SIGFPE points to.
+export type TerminationVerdict =
+  | 'exited'
+  | 'exited_nonzero'
+  | 'compile_error'
+  | 'segmentation_fault'
+  | 'bus_error'
+  | 'floating_point_exception'
+  | 'aborted'
+  | 'illegal_instruction'
+  | 'killed'
+  | 'signaled'
+  | 'time_limit'
+  | 'cpu_limit'
+  | 'memory_limit'
+  | 'output_limit'
+  | 'disk_limit'
+  | 'process_limit'
+  | 'canceled';
+
+export interface Termination {
+  verdict: TerminationVerdict;
+  // Name of the signal that ended the program, e.g. SIGSEGV; null when it exited by itself or the
+  // sandbox stopped it.
+  signal: string | null;
+  // One sentence on what happened, for showing to whoever submitted the code.
+  explanation: string;
+}
+
+// Identifies which execution limit stopped or truncated a run, so callers can tell a limit
+// violation apart from a compile error or an ordinary non-zero exit.
+export type LimitKind = 'wall_time' | 'cpu_time' | 'memory' | 'output' | 'disk' | 'processes';
+
+// How strongly a run is separated from the host: a plain container, a gVisor (runsc) user-space
+// kernel, a Firecracker microVM, or a WebAssembly module under a WASI runtime with no container.
+export type IsolationLevel = 'container' | 'gvisor' | 'microvm' | 'wasm';
 
 export interface RunArtifact {
   name: string;
@@ -24,15 +172,255 @@ export interface RunArtifact {
   url: string;
   expires_at: string;
   content_type: string;
+  // Base64 file contents, present when the request asked for inline artifacts.
+  content?: string;
+}
+
+// An outputs/ file left out of the record because it would break one of the artifact caps, or
+// could not be collected at all.
+export interface SkippedArtifact {
+  name: string;
+  size: number;
+  // upload_failed when the object store refused the file; outside_outputs and not_a_file for paths
+  // a backend listed that are not regular files under outputs/.
+  reason: 'file_too_large' | 'total_too_large' | 'too_many_files' | 'upload_failed' | 'outside_outputs' | 'not_a_file';
+}
+
+// Network access for a run. `none` (the default) and `loopback` keep it offline; `loopback`
+// states that the program talks to servers it starts itself on localhost, which the container
+// backend's private network namespace always permits. `allowlist` lets it reach the listed host
+// names, `*.` domains, addresses and CIDR ranges through the egress proxy.
+export interface NetworkPolicy {
+  mode: 'none' | 'loopback' | 'allowlist';
+  allow?: string[];
+}
+
+// GPUs a run needs: `count` devices, each with `vram_mb` of its memory reserved for the run and
+// capping what the run may use. Without vram_mb the run has the devices to itself.
+export interface GpuRequest {
+  count: number;
+  vram_mb?: number;
+}
+
+// Host user and group submissions run as, instead of whatever user the executor itself runs as.
+export interface RunAsUser {
+  uid: number;
+  gid: number;
+}
+
+// Read-only data exposed to a run at `path` under /data: an uploaded file or dataset (`dataset_id`,
+// an ID from /v1/files or /v1/datasets) or a file or directory beneath one of the server's mount
+// roots (`host_path`), shared between runs instead of copied into each workdir.
+export interface Mount {
+  path: string;
+  dataset_id?: string;
+  host_path?: string;
+  // Mounts are always read-only; false is rejected.
+  read_only?: boolean;
+}
+
+// A test case reported by a test-mode run, in the same shape for every language.
+export interface TestCase {
+  name: string;
+  status: 'passed' | 'failed' | 'skipped';
+  duration_ms: number;
+  // Failure output or skip reason; null for passing tests.
+  message: string | null;
+}
+
+// Line coverage of one source file of a test-mode run. Only lines with code on them count; test
+// files themselves are left out.
+export interface CoverageFile {
+  // Relative to the submission root.
+  file: string;
+  covered_lines: number;
+  total_lines: number;
+  // From 0 to 100, rounded to two decimals.
+  percent: number;
+  // Line numbers that ran at least once, and those that never did.
+  covered: number[];
+  missed: number[];
+}
+
+// Coverage of a test-mode run in the same shape for every language; the tool's own report is
+// among the run's artifacts under `coverage/`.
+export interface CoverageReport {
+  // `go` for a cover profile, `coverage.py` for Python.
+  tool: 'go' | 'coverage.py';
+  covered_lines: number;
+  total_lines: number;
+  percent: number;
+  files: CoverageFile[];
+}
+
+// `run` executes the entry file; `test` runs the submission's tests with the language's test
+// runner (go test, pytest or unittest) instead, on runners that support it. `compile` only
+// builds the submission (compiled languages) and `check` only parses or type-checks it, on
+// runners that support it; neither runs any of its code, and both report in the compile phase.
+export type RunMode = 'run' | 'test' | 'compile' | 'check';
+
+// Compiler options for native runners (C/C++); ignored by other languages.
+export interface BuildOptions {
+  compiler?: 'gcc' | 'clang';
+  std?: string;
+  optimization?: 'O0' | 'O1' | 'O2' | 'O3' | 'Os';
+  sanitizers?: Array<'address' | 'undefined'>;
+}
+
+// Static checks run before the build on runners that support them (Go). go vet runs unless
+// `vet` is false; staticcheck only when asked for and installed in the runner image.
+export interface LintOptions {
+  vet?: boolean;
+  staticcheck?: boolean;
+}
+
+// Profiles captured while the program runs, returned as artifacts under `profiles/`: `cpu` samples
+// where the time goes, `heap` what holds memory when the program exits. Runners list the kinds
+// they support.
+export interface ProfileOptions {
+  cpu?: boolean;
+  heap?: boolean;
+}
+
+export type ProfileKind = keyof ProfileOptions;
+
+// A finding of the static checks `lint` asked for, a file its build constraints leave out
+// (`build`), or a compiler error or warning.
+export interface Diagnostic {
+  source: 'vet' | 'staticcheck' | 'build' | 'compile';
+  // Relative to the submission root.
+  file: string;
+  // Null for findings about a whole file.
+  line: number | null;
+  column: number | null;
+  // Analyzer or check that reported it, e.g. `printf` or `SA4006`; null for the build's own.
+  code: string | null;
+  severity: 'error' | 'warning';
+  message: string;
+  // Set for the entry file of runs with a `template`: whether line and column are those of the
+  // submitted code or of the template's source.
+  origin?: 'code' | 'template';
+}
+
+// A harness the submitted code is put into before it is built, for exercises where the
+// submitter writes one function or class and the template holds the rest: a hidden main, input
+// parsing, checks. The expanded source becomes the entry file.
+export interface CodeTemplate {
+  source: string;
+  // Replaced by `code`; must appear exactly once in `source`. `{{code}}` when unset.
+  placeholder?: string;
+}
+
+// The database a `sql` run executes against, created empty for the run and discarded with it.
+// `fixture` is SQL run before the submission to create the schema and load data.
+export interface SqlOptions {
+  engine?: 'sqlite' | 'postgres';
+  fixture?: string;
+}
+
+// One statement of a `sql` submission, in the order they ran.
+export interface QueryResult {
+  statement: string;
+  // Line of main.sql the statement starts on.
+  line: number;
+  // Null for statements that return no rows.
+  columns: string[] | null;
+  // Values without a JSON type, such as dates and numerics, are given as their text form.
+  rows: unknown[][];
+  // Rows an INSERT, UPDATE or DELETE changed; null when the engine does not say.
+  rows_affected: number | null;
+  // Set when rows past max_output_bytes were left out.
+  truncated: boolean;
+  error: string | null;
+}
+
+// What happens once a stream passes its cap: the program keeps running while the rest of that
+// stream is discarded, or it is killed.
+export type OutputLimitAction = 'truncate' | 'kill';
+
+// How a request that omits `language` was assigned one.
+export interface LanguageDetection {
+  language: Language;
+  // From 0 to 1; file names, shebangs and the wasm magic number are certain, content heuristics
+  // never quite are.
+  confidence: number;
+  source: 'filename' | 'shebang' | 'content';
+}
+
+// What a runner can hold still for runs that ask to be reproducible: the wall clock, through
+// libfaketime, and the language's default random source.
+export type ReproducibleKind = 'time' | 'seed';
+
+// Runs the program against a fixed clock and a seeded random source, so that time-dependent or
+// random outcomes come out the same every time.
+export interface ReproducibleOptions {
+  // ISO 8601 time the program's wall clock starts at and runs on from; the monotonic clock, and
+  // with it sleeps and limits, is left alone.
+  time?: string;
+  // Stops the wall clock at `time` instead.
+  freeze_time?: boolean;
+  seed?: number;
 }
 
+// How urgently a run should start: `interactive` for someone watching it, such as an IDE run or a
+// session, `normal` by default, and `batch` for bulk work such as regrading a whole class.
+export type PriorityClass = 'interactive' | 'normal' | 'batch';
+
 export interface RunRequest {
+  // Version of the encoding the request was written against; see SCHEMA_VERSION.
+  schema_version?: number;
+  // Detected from `filename`, the names of `sources`, a shebang or the code itself when omitted.
   language: Language;
-  code: string;
+  // Name of the entry file as the caller knows it; only used to detect the language.
+  filename?: string;
+  mode?: RunMode;
+  code?: string;
+  // Harness `code` is injected into; diagnostics and coverage still refer to the lines of `code`.
+  template?: CodeTemplate;
+  sources?: Record<string, string>;
+  stdin?: string;
+  build?: BuildOptions;
+  lint?: LintOptions;
+  sql?: SqlOptions;
+  profile?: ProfileOptions;
+  // Measure line coverage of a test-mode run.
+  coverage?: boolean;
+  isolation?: IsolationLevel;
+  network?: NetworkPolicy;
+  // One GPU when `count` is left out; only the container backend has any.
+  gpu?: Partial<GpuRequest>;
+  // Toolchain version, e.g. `1.22` for Go or `3.12` for Python; see /v1/runners.
+  version?: string;
   args?: string[];
   files?: Array<{ id: string; path: string }>;
+  mounts?: Mount[];
   limits?: Partial<RunLimits>;
   env?: Record<string, string>;
+  // Return artifact contents in the record in addition to their download URLs.
+  inline_artifacts?: boolean;
+  on_output_limit?: OutputLimitAction;
+  // Queue priority class; `normal` when unset. Batch submissions always run as `batch`.
+  priority?: PriorityClass;
+  // Vouches that the program's output depends only on the request, so an identical earlier run's
+  // result may be returned instead; programs reading the time or a random source must not set it.
+  deterministic?: boolean;
+  reproducible?: ReproducibleOptions;
+  // Labels of the caller's own, e.g. a course and an assignment, that execution listings can
+  // filter by; they don't affect the run.
+  tags?: string[];
+  // Key/value pairs of the caller's own, e.g. an assignment ID, a student ID or a commit SHA,
+  // kept with the result and filterable in listings; they don't affect the run either.
+  metadata?: Record<string, string>;
+  // Samples the program's CPU and memory this often, from 100 to 60000 ms, into the record's
+  // usage_samples and the execution's stream; not sampled when unset.
+  usage_interval_ms?: number;
+}
+
+// An attempt at a run that failed for reasons of the worker it went to and was retried on another.
+export interface RunRetry {
+  attempt: number;
+  worker: string;
+  error: string;
 }
 
 export interface UploadedFile {
@@ -45,39 +433,215 @@ export interface UploadedFile {
 }
 
 export interface RunRecord {
+  // Version of the encoding the record follows; see SCHEMA_VERSION.
+  schema_version: number;
   id: string;
   status: RunStatus;
   exit_code: number | null;
+  limit_exceeded: LimitKind | null;
+  // Set when the program ran into timeout_ms.
+  timeout: TimeoutReport | null;
+  termination: Termination;
   stdout: string;
   stderr: string;
+  // Set when output past max_stdout_bytes or max_stderr_bytes was discarded; dropped_bytes says
+  // how much of each stream is missing.
+  truncated: boolean;
+  dropped_bytes: Record<OutputStream, number>;
+  phases: RunPhases;
   usage: RunUsage;
   artifacts: RunArtifact[];
+  artifacts_skipped: SkippedArtifact[];
+  // Test cases of a test-mode run, null in run mode.
+  tests: TestCase[] | null;
+  // Line coverage of a test-mode run that asked for it; null otherwise, or when the tests never
+  // got far enough to report any.
+  coverage: CoverageReport | null;
+  // What the requested static checks found, then the compiler's errors and warnings; null without
+  // `lint` for languages whose runner doesn't parse its compiler output.
+  diagnostics: Diagnostic[] | null;
+  // Statement results of a `sql` run, null for other languages.
+  results: QueryResult[] | null;
   limits: RunLimits;
   created_at: string;
+  // Time spent waiting for a free worker before the run started.
+  queue_wait_ms: number;
   language: Language;
+  // How the language was chosen when the request left it out, null when it named one.
+  detected_language: LanguageDetection | null;
+  mode: RunMode;
+  isolation: IsolationLevel;
+  network: NetworkPolicy;
+  // Toolchain version the request asked for, null for the default.
+  version: string | null;
+  toolchain: string | null;
   code_sha256: string;
+  // ID of the run whose result a `deterministic` submission was answered with, null when it ran.
+  cached_from: string | null;
+  // Earlier attempts lost to infrastructure failures, oldest first; empty when the first one stood.
+  retries: RunRetry[];
+  // The request's metadata; empty when it had none.
+  metadata: Record<string, string>;
+  // What the deployment's after-completion hooks added, by hook name.
+  annotations: Record<string, unknown>;
+  // Rules the submission broke that the deployment flags rather than refuses.
+  policy_violations: PolicyViolation[];
+  // Null when no sandbox ran, e.g. for a run canceled while it was queued.
+  memory: MemoryReport | null;
+  // Null unless the request set usage_interval_ms and the backend could sample the sandbox.
+  usage_samples: UsageSeries | null;
+  // Null for runs recorded before costs were.
+  cost: RunCost | null;
+  // The deployment's signature over the rest of the record, null when it signs no results.
+  signature: ResultSignature | null;
+}
+
+// Proof that a run record or judge result came from the deployment as it is, for contest
+// platforms and certification services that act on verdicts they did not see produced.
+export interface ResultSignature {
+  algorithm: 'ed25519';
+  // Which of GET /v1/signing-keys to verify with.
+  key_id: string;
+  // Base64 signature of the result's canonical JSON (RFC 8785: keys sorted, no whitespace) with
+  // `signature` itself and inline artifact contents left out.
+  value: string;
+}
+
+export type PolicyAction = 'reject' | 'flag';
+
+// Where a submission broke one of the deployment's policy rules. `path` names the file as
+// SourceError does: `code`, `template` or a source's path.
+export interface PolicyViolation {
+  rule: string;
+  action: PolicyAction;
+  path: string;
+  line: number;
+  column: number;
+  // The module, function or text that matched.
+  match: string;
+  message: string;
+}
+
+// Steps of an execution's audit trail, roughly in the order they happen.
+export type ExecutionEventType =
+  | 'submitted'
+  | 'queued'
+  | 'dequeued'
+  | 'sandbox_created'
+  | 'compile_started'
+  | 'compile_finished'
+  | 'run_started'
+  | 'run_finished'
+  | 'limit_exceeded'
+  | 'memory_pressure'
+  | 'cancel_requested'
+  | 'artifacts_stored'
+  | 'cleanup'
+  | 'completed'
+  | 'failed'
+  | 'requeued'
+  | 'resumed'
+  | 'cache_hit';
+
+export interface ExecutionEvent {
+  // Position in the execution's trail, from 0.
+  seq: number;
+  type: ExecutionEventType;
+  at: string;
+  // Details of the step, e.g. the exit code of run_finished or which limit limit_exceeded hit.
+  data: Record<string, unknown>;
 }
 
 export interface SandboxResult {
   status: RunStatus;
   exitCode: number | null;
+  limitExceeded?: LimitKind | null;
+  timeout?: TimeoutReport | null;
+  // Name of the signal that ended the program, as its runner reported it.
+  exitSignal?: string | null;
   stdout: Buffer;
   stderr: Buffer;
+  // Output bytes the runner or the backend discarded past the caps.
+  droppedBytes?: Record<OutputStream, number>;
+  compile?: PhaseResult | null;
+  toolchain?: string | null;
+  tests?: TestCase[] | null;
+  coverage?: CoverageReport | null;
+  diagnostics?: Diagnostic[] | null;
+  results?: QueryResult[] | null;
   usage: RunUsage;
+  memory?: MemoryReport | null;
+  usageSamples?: UsageSeries | null;
   artifacts: Array<{ path: string; name: string; size: number; contentType?: string }>;
+  // Attempts a coordinator gave up on before the one that produced this result.
+  retries?: RunRetry[];
 }
 
+export type OutputStream = 'stdout' | 'stderr';
+
+export type OutputListener = (stream: OutputStream, chunk: Buffer) => void;
+
 export interface SandboxRunSpec {
   id: string;
   language: Language;
+  mode: RunMode;
   code: string;
+  sources: Record<string, string>;
+  stdin: string;
+  build: BuildOptions;
+  // Static checks to run before the build; none when unset.
+  lint?: LintOptions;
+  // Database and fixture of a `sql` run.
+  sql?: SqlOptions;
+  // Profiles to write under outputs/profiles/; none when unset.
+  profile?: ProfileOptions;
+  // Whether a test-mode run measures coverage, written under outputs/coverage/.
+  coverage?: boolean;
+  isolation: IsolationLevel;
+  network: NetworkPolicy;
+  gpu?: GpuRequest;
+  // Devices a coordinator already reserved for the run on this worker; the backend picks from
+  // its own GPUs when unset.
+  gpuDevices?: string[];
+  // Requested toolchain version; the backend's default toolchain when unset.
+  version?: string;
   args: string[];
   env: Record<string, string>;
   workdir: string;
   limits: RunLimits;
   stagedFiles: Array<{ sourcePath: string; destPath: string }>;
+  // Files and directories bound read-only into the sandbox, by their API-side paths.
+  mounts: Array<{ sourcePath: string; destPath: string }>;
+  onOutput?: OutputListener;
+  // Called once the build of a compiled language is done and the program starts; backends that
+  // cannot tell never call it.
+  onRunStart?: () => void;
+  // Percentages of memory_mb that onMemoryPressure reports the run passing, each once; backends
+  // that cannot sample the sandbox's memory never call it.
+  memoryWarnings?: number[];
+  onMemoryPressure?: (warning: MemoryWarning) => void;
+  // How often to sample the sandbox's CPU and memory, and the most samples the result keeps;
+  // unsampled when unset. onUsageSample gets every sample as it is taken.
+  usageIntervalMs?: number;
+  maxUsageSamples?: number;
+  onUsageSample?: (sample: UsageSample) => void;
+  onOutputLimit?: OutputLimitAction;
+  // Aborted when the run is canceled; backends must stop the execution promptly.
+  signal?: AbortSignal;
+  // Live standard input for interactive sessions. When set, `stdin` is ignored and the runner
+  // keeps the program's stdin open until this stream ends.
+  input?: NodeJS.ReadableStream;
+  // Faults to inject into the run, on servers with fault injection enabled.
+  faults?: FaultKind[];
 }
 
+// Failures a test deployment can inject into a run. `sandbox_create` fails the run before its
+// sandbox starts; `slow_compile` holds the sandbox back before the build, counted in the compile
+// phase of compiled languages; `worker_crash` kills the run partway through (or as it finishes,
+// when sooner) and fails it as a lost worker would; `output_stall` lets the first chunk of output
+// through and then holds back the rest, and the result.
+export type FaultKind = 'sandbox_create' | 'slow_compile' | 'worker_crash' | 'output_stall';
+
 export interface SandboxRunner {
   run(spec: SandboxRunSpec): Promise<SandboxResult>;
 }
@@ -0,0 +1,95 @@
+import childProcess from 'node:child_process';
+import Boom from '@hapi/boom';
+import { Logger } from '../util/logger.js';
+import type { RunnerDefinition } from './runners.js';
+import { infrastructureFailure } from './infrastructure.js';
+
+export interface VersionManagerOptions {
+  // Docker-compatible CLI used to inspect and pull images.
+  cli?: string;
+  // Pull `<repository>:<version>` from the registry when it is not installed locally.
+  pull?: boolean;
+}
+
+// Tags that name a build of the default toolchain rather than a version.
+const NON_VERSION_TAGS = new Set(['latest', 'dev', '<none>']);
+
+const PULL_TIMEOUT_MS = 5 * 60 * 1000;
+
+// Resolves a requested toolchain version to a runner image. Versioned images share the default
+// image's repository and are tagged with the version, e.g. code-executor-runner-go:1.22 next to
+// code-executor-runner-go:latest; see the ARGs in runners/<language>/Dockerfile.
+export class VersionManager {
+  private readonly cli: string;
+  private readonly resolved = new Map<string, Promise<string>>();
+
+  constructor(private readonly options: VersionManagerOptions, private readonly logger: Logger) {
+    this.cli = options.cli ?? 'docker';
+  }
+
+  public resolve(runner: RunnerDefinition, version?: string): Promise<string> {
+    if (!version) {
+      return Promise.resolve(runner.image);
+    }
+    const image = `${imageRepository(runner.image)}:${version}`;
+    const cached = this.resolved.get(image);
+    if (cached) {
+      return cached;
+    }
+    const resolving = this.locate(runner, version, image);
+    this.resolved.set(image, resolving);
+    // Only successful lookups are remembered so a later install or pull is picked up.
+    resolving.catch(() => this.resolved.delete(image));
+    return resolving;
+  }
+
+  // Versions installed locally, discovered from the tags of the runner's image repository.
+  public async available(runner: RunnerDefinition): Promise<string[]> {
+    const { ok, stdout } = await this.exec(['image', 'ls', '--format', '{{.Tag}}', imageRepository(runner.image)]);
+    if (!ok) {
+      return [];
+    }
+    const tags = stdout.split('\n').map((tag) => tag.trim());
+    return [...new Set(tags.filter((tag) => tag && !NON_VERSION_TAGS.has(tag)))].sort();
+  }
+
+  private async locate(runner: RunnerDefinition, version: string, image: string): Promise<string> {
+    if ((await this.exec(['image', 'inspect', image])).ok) {
+      return image;
+    }
+    if (this.options.pull) {
+      this.logger.info('pulling runner image', { language: runner.language, image });
+      const pulled = await this.exec(['pull', image], PULL_TIMEOUT_MS);
+      if (pulled.ok) {
+        return image;
+      }
+      // A registry too slow to answer says nothing about whether the version exists.
+      if (pulled.timedOut) {
+        throw infrastructureFailure(`timed out pulling ${image}`);
+      }
+      this.logger.warn('runner image pull failed', { language: runner.language, image });
+    }
+    const supported = await this.available(runner);
+    throw unsupportedVersion(runner.language, version, supported);
+  }
+
+  private exec(args: string[], timeout = 30000): Promise<{ ok: boolean; timedOut: boolean; stdout: string }> {
+    return new Promise((resolve) => {
+      childProcess.execFile(this.cli, args, { timeout }, (err, stdout) =>
+        resolve({ ok: !err, timedOut: Boolean(err?.killed), stdout: stdout.toString() })
+      );
+    });
+  }
+}
+
+export function unsupportedVersion(language: string, version: string, supported: string[]) {
+  return Boom.badRequest(`unsupported ${language} version: ${version}`, { code: 'unsupported_version', supported });
+}
+
+// Strips the tag and any digest from an image reference, leaving any registry port alone.
+export function imageRepository(image: string): string {
+  const name = image.split('@')[0];
+  const slash = name.lastIndexOf('/');
+  const colon = name.lastIndexOf(':');
+  return colon > slash ? name.slice(0, colon) : name;
+}
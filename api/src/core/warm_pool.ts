@@ -0,0 +1,199 @@
+import type { IsolationLevel, RunLimits } from './types.js';
+import { Logger } from '../util/logger.js';
+
+export interface WarmPoolOptions {
+  // Idle sandboxes kept per language, isolation level and memory/CPU limits. Disabled when 0.
+  size: number;
+  // Isolation levels that are pooled; by default only gVisor and microVMs, whose startup
+  // dominates short runs.
+  isolation?: IsolationLevel[];
+  // `eager` boots a replacement as soon as a sandbox is leased, `lazy` once the run using it has
+  // finished, so the replacement does not compete with the run for CPU.
+  refill?: 'eager' | 'lazy';
+  // Idle sandboxes older than this are destroyed and replaced so none waits indefinitely on a
+  // stale image or runtime. Kept until leased when unset.
+  maxIdleMs?: number;
+}
+
+export interface WarmPoolKey {
+  language: string;
+  isolation: IsolationLevel;
+  limits: RunLimits;
+}
+
+// A booted sandbox waiting for its run. Sandboxes are handed to a single run and never reused.
+export interface WarmSandbox {
+  onExit(listener: () => void): void;
+  // Stops an idle sandbox; it is discarded once it has exited.
+  stop(): void;
+  // Frees what an idle sandbox held after it exited without being leased.
+  discard(): void;
+}
+
+export interface WarmPoolStats {
+  size: number;
+  refill: 'eager' | 'lazy';
+  max_idle_ms: number | null;
+  isolation: IsolationLevel[];
+  idle: number;
+  hits: number;
+  misses: number;
+  launched: number;
+  recycled: number;
+  pools: Array<{ language: string; isolation: IsolationLevel; memory_mb: number; cpu_ms: number; idle: number }>;
+}
+
+interface Slot<T> {
+  key: WarmPoolKey;
+  idle: Array<{ sandbox: T; timer: NodeJS.Timeout | null }>;
+}
+
+const DEFAULT_ISOLATION: IsolationLevel[] = ['gvisor', 'microvm'];
+
+// Keeps pre-booted sandboxes ready per language, isolation level and limits and leases them to
+// incoming runs. A sandbox that exits while idle is dropped without a replacement, so a runtime
+// that cannot boot does not spin; the next lease or fill tries again.
+export class WarmPool<T extends WarmSandbox> {
+  private readonly slots = new Map<string, Slot<T>>();
+  private hits = 0;
+  private misses = 0;
+  private launched = 0;
+  private recycled = 0;
+  private closed = false;
+
+  constructor(
+    private readonly options: WarmPoolOptions,
+    private readonly launch: (key: WarmPoolKey) => T,
+    private readonly logger: Logger
+  ) {}
+
+  // Whether runs at this isolation level are served from the pool.
+  public pools(isolation: IsolationLevel): boolean {
+    return !this.closed && this.options.size > 0 && (this.options.isolation ?? DEFAULT_ISOLATION).includes(isolation);
+  }
+
+  // Hands out an idle sandbox, or null on a miss; the caller then boots its own.
+  public lease(key: WarmPoolKey): T | null {
+    if (!this.pools(key.isolation)) {
+      return null;
+    }
+    const slot = this.slot(key);
+    const entry = slot.idle.shift();
+    if (entry?.timer) {
+      clearTimeout(entry.timer);
+    }
+    if (entry) {
+      this.hits += 1;
+    } else {
+      this.misses += 1;
+    }
+    if (this.options.refill !== 'lazy') {
+      this.fill(key);
+    }
+    return entry?.sandbox ?? null;
+  }
+
+  // Called once a run that asked for a sandbox has finished, whether or not it got one.
+  public finished(key: WarmPoolKey) {
+    if (this.pools(key.isolation) && this.options.refill === 'lazy') {
+      this.fill(key);
+    }
+  }
+
+  // Tops the pool for this key up to its size, e.g. ahead of the first request.
+  public fill(key: WarmPoolKey) {
+    if (!this.pools(key.isolation)) {
+      return;
+    }
+    const slot = this.slot(key);
+    while (slot.idle.length < this.options.size) {
+      const sandbox = this.launch(key);
+      this.launched += 1;
+      const entry = { sandbox, timer: this.recycleTimer(slot, sandbox) };
+      sandbox.onExit(() => {
+        const index = slot.idle.indexOf(entry);
+        if (index !== -1) {
+          this.logger.warn('warm sandbox exited while idle', { language: key.language, isolation: key.isolation });
+          slot.idle.splice(index, 1);
+          if (entry.timer) {
+            clearTimeout(entry.timer);
+          }
+          sandbox.discard();
+        }
+      });
+      slot.idle.push(entry);
+    }
+  }
+
+  // Stops every idle sandbox and pools no more, for a server shutting down. Resolves once they
+  // have all exited.
+  public async close() {
+    this.closed = true;
+    const exited: Array<Promise<void>> = [];
+    for (const slot of this.slots.values()) {
+      for (const entry of slot.idle.splice(0)) {
+        if (entry.timer) {
+          clearTimeout(entry.timer);
+        }
+        exited.push(new Promise((resolve) => entry.sandbox.onExit(() => {
+          entry.sandbox.discard();
+          resolve();
+        })));
+        entry.sandbox.stop();
+      }
+    }
+    await Promise.all(exited);
+  }
+
+  public stats(): WarmPoolStats {
+    const slots = [...this.slots.values()];
+    return {
+      size: this.options.size,
+      refill: this.options.refill ?? 'eager',
+      max_idle_ms: this.options.maxIdleMs ?? null,
+      isolation: this.options.isolation ?? DEFAULT_ISOLATION,
+      idle: slots.reduce((total, slot) => total + slot.idle.length, 0),
+      hits: this.hits,
+      misses: this.misses,
+      launched: this.launched,
+      recycled: this.recycled,
+      pools: slots.map((slot) => ({
+        language: slot.key.language,
+        isolation: slot.key.isolation,
+        memory_mb: slot.key.limits.memory_mb,
+        cpu_ms: slot.key.limits.cpu_ms,
+        idle: slot.idle.length
+      }))
+    };
+  }
+
+  private slot(key: WarmPoolKey): Slot<T> {
+    // Only the limits the container is started with matter; the rest travel with the spec.
+    const id = [key.language, key.isolation, key.limits.memory_mb, key.limits.cpu_ms, key.limits.max_processes].join(':');
+    let slot = this.slots.get(id);
+    if (!slot) {
+      slot = { key, idle: [] };
+      this.slots.set(id, slot);
+    }
+    return slot;
+  }
+
+  private recycleTimer(slot: Slot<T>, sandbox: T): NodeJS.Timeout | null {
+    if (!this.options.maxIdleMs) {
+      return null;
+    }
+    const timer = setTimeout(() => {
+      const index = slot.idle.findIndex((entry) => entry.sandbox === sandbox);
+      if (index === -1) {
+        return;
+      }
+      slot.idle.splice(index, 1);
+      this.recycled += 1;
+      sandbox.onExit(() => sandbox.discard());
+      sandbox.stop();
+      this.fill(slot.key);
+    }, this.options.maxIdleMs);
+    timer.unref();
+    return timer;
+  }
+}
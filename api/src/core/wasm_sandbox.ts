@@ -0,0 +1,159 @@
+import childProcess from 'node:child_process';
+import { once } from 'node:events';
+import Boom from '@hapi/boom';
+import type { RunAsUser, SandboxResult, SandboxRunSpec, SandboxRunner } from './types.js';
+import { Logger } from '../util/logger.js';
+import { runnerRegistry } from './runners.js';
+import type { RunnerRegistry } from './runners.js';
+import {
+  canceledResult,
+  captureOutput,
+  classifyExit,
+  handOverRunDir,
+  memoryReport,
+  prepareRunDir,
+  readUsageReport,
+  totalDropped,
+  watchDiskUsage,
+  watchUsage
+} from './run_dir.js';
+import { listOutputs } from './artifacts.js';
+import { unsupportedVersion } from './versions.js';
+
+export interface WasmSandboxOptions {
+  // The wasirun binary built from runners/wasm; isolation `wasm` is refused when unset.
+  runtime?: string;
+  // wasi-sdk installation that compiles C and C++ submissions; only precompiled modules run without it.
+  wasiSdk?: string;
+  // Function calls a module may make before it is stopped; unmetered when unset.
+  fuel?: number;
+  // Where wazero keeps compiled machine code between runs of the same module.
+  cacheDir?: string;
+  registry?: RunnerRegistry;
+  runAs?: RunAsUser;
+  // Runs every other isolation level.
+  next: SandboxRunner;
+}
+
+// Kill the runtime if it overruns its own wall-clock enforcement by this much.
+const WATCHDOG_GRACE_MS = 5000;
+
+// Runs submissions with isolation `wasm` as WebAssembly modules under the wasirun helper, a WASI
+// runtime built on wazero, and hands every other run to the configured backend. The module is
+// confined by the runtime rather than the kernel: it has no syscalls, only WASI calls against
+// its run directory's inputs/, outputs/ and tmp/, and no network at all. That needs neither a
+// container runtime nor Linux, but it only fits submissions that compile to WebAssembly.
+export class WasmSandbox implements SandboxRunner {
+  private readonly registry: RunnerRegistry;
+
+  constructor(private readonly options: WasmSandboxOptions, private readonly logger: Logger) {
+    this.registry = options.registry ?? runnerRegistry;
+  }
+
+  public async run(spec: SandboxRunSpec): Promise<SandboxResult> {
+    if (spec.isolation !== 'wasm') {
+      return this.options.next.run(spec);
+    }
+    const runtime = this.options.runtime;
+    if (!runtime) {
+      throw Boom.badRequest('isolation wasm is not enabled on this server');
+    }
+    if (spec.network.mode !== 'none') {
+      throw Boom.badRequest('isolation wasm has no network access');
+    }
+    if (spec.mounts.length > 0) {
+      throw Boom.badRequest('mounts are not available with isolation wasm');
+    }
+    if (spec.gpu) {
+      throw Boom.badRequest('gpu is not available with isolation wasm');
+    }
+    if (spec.mode !== 'run') {
+      throw Boom.badRequest(`${spec.mode} mode is not available with isolation wasm`);
+    }
+    if (spec.profile?.cpu || spec.profile?.heap) {
+      throw Boom.badRequest('profiling is not available with isolation wasm');
+    }
+    if (spec.version) {
+      throw unsupportedVersion(spec.language, spec.version, []);
+    }
+    if (spec.signal?.aborted) {
+      return canceledResult();
+    }
+    const runner = this.registry.require(spec.language);
+    const runDir = prepareRunDir(runner, spec);
+    if (this.options.runAs) {
+      handOverRunDir(runDir, this.options.runAs);
+    }
+    this.logger.info('launching wasm sandbox', { specId: spec.id, language: spec.language, streaming: Boolean(spec.onOutput) });
+    const child = childProcess.spawn(runtime, [], {
+      cwd: runDir,
+      stdio: ['pipe', 'pipe', 'pipe'],
+      uid: this.options.runAs?.uid,
+      gid: this.options.runAs?.gid
+    });
+    const kill = () => child.kill('SIGKILL');
+    // Same spec line as the entrypoints; interactive sessions keep streaming input after it.
+    child.stdin.write(`${JSON.stringify({
+      id: spec.id,
+      language: spec.language,
+      build: spec.build,
+      args: spec.args,
+      env: spec.env,
+      limits: spec.limits,
+      stdin: spec.stdin,
+      interactive: Boolean(spec.input),
+      on_output_limit: spec.onOutputLimit ?? 'truncate',
+      settings: {
+        ...(this.options.wasiSdk ? { wasi_sdk: this.options.wasiSdk } : {}),
+        ...(this.options.fuel ? { fuel: String(this.options.fuel) } : {}),
+        ...(this.options.cacheDir ? { cache_dir: this.options.cacheDir } : {})
+      },
+      workdir: runDir
+    })}\n`);
+    if (spec.input) {
+      child.stdin.on('error', () => undefined);
+      spec.input.pipe(child.stdin);
+    } else {
+      child.stdin.end();
+    }
+
+    const output = captureOutput(spec, () => {
+      if (spec.onOutputLimit === 'kill') {
+        kill();
+      }
+    });
+    child.stdout.on('data', (chunk: Buffer) => output.push('stdout', chunk));
+    child.stderr.on('data', (chunk: Buffer) => output.push('stderr', chunk));
+    const watchdog = setTimeout(kill, spec.limits.timeout_ms + WATCHDOG_GRACE_MS);
+    spec.signal?.addEventListener('abort', kill, { once: true });
+    const disk = watchDiskUsage(runDir, spec.limits, kill);
+    // The runtime caps the module's linear memory itself and reports its peak; nothing is sampled.
+    const memory = watchUsage(spec, null);
+
+    const [code, signal] = (await once(child, 'exit')) as [number | null, NodeJS.Signals | null];
+    clearTimeout(watchdog);
+    disk.stop();
+    spec.signal?.removeEventListener('abort', kill);
+
+    const report = readUsageReport(runDir, spec.limits);
+    const droppedBytes = totalDropped(report, output);
+    const outputLimit = report.limitExceeded ?? (droppedBytes.stdout || droppedBytes.stderr ? 'output' : null);
+    const { status, limitExceeded } = classifyExit(code, signal, disk.exceeded ? 'disk' : outputLimit, spec.onOutputLimit);
+
+    return {
+      status,
+      exitCode: code,
+      limitExceeded,
+      timeout: report.timeout,
+      exitSignal: report.exitSignal,
+      stdout: output.stdout(),
+      stderr: output.stderr(),
+      droppedBytes,
+      compile: report.compile,
+      toolchain: report.toolchain,
+      usage: report.usage,
+      memory: memoryReport(report.usage, spec.limits, memory),
+      artifacts: listOutputs(runDir)
+    };
+  }
+}
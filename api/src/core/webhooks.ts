@@ -0,0 +1,105 @@
+import crypto from 'node:crypto';
+import Boom from '@hapi/boom';
+import { permits } from './egress_proxy.js';
+import { Logger } from '../util/logger.js';
+
+export interface WebhookOptions {
+  // Shared secret the HMAC signature of each delivery is computed with.
+  secret: string;
+  // When set, callback URLs must point at one of these hosts or `*.` wildcard domains.
+  allowedHosts?: string[];
+  maxAttempts?: number;
+  // Delay before the first retry; doubled on each further attempt up to maxBackoffMs.
+  initialBackoffMs?: number;
+  maxBackoffMs?: number;
+  timeoutMs?: number;
+}
+
+export interface WebhookEvent {
+  type: string;
+  id: string;
+  data: unknown;
+}
+
+const MAX_URL_LENGTH = 2048;
+
+// Signs `<timestamp>.<body>` so receivers can verify the sender and reject replays.
+export function signPayload(secret: string, timestamp: number, body: string): string {
+  return crypto.createHmac('sha256', secret).update(`${timestamp}.${body}`).digest('hex');
+}
+
+// Posts execution results to caller-supplied callback URLs. Deliveries that fail with a network
+// error, a timeout, 408, 429 or a 5xx response are retried with exponential backoff; any other
+// response ends the delivery.
+export class WebhookDispatcher {
+  constructor(private readonly options: WebhookOptions, private readonly logger: Logger) {}
+
+  // `field` names the URL in errors.
+  public validateUrl(value: unknown, field = 'callback_url'): string {
+    if (typeof value !== 'string' || value.length > MAX_URL_LENGTH || !URL.canParse(value)) {
+      throw Boom.badRequest(`${field} must be a URL of at most ${MAX_URL_LENGTH} characters`);
+    }
+    const url = new URL(value);
+    if (url.protocol !== 'http:' && url.protocol !== 'https:') {
+      throw Boom.badRequest(`${field} must use http or https`);
+    }
+    if (url.username || url.password) {
+      throw Boom.badRequest(`${field} must not contain credentials`);
+    }
+    const allowed = this.options.allowedHosts;
+    if (allowed && !permits(allowed, url.hostname)) {
+      throw Boom.badRequest(`callback host not allowed: ${url.hostname}`, { code: 'callback_not_permitted' });
+    }
+    return url.toString();
+  }
+
+  // Resolves once the event was accepted or the attempts ran out; never rejects.
+  public async deliver(url: string, event: WebhookEvent): Promise<boolean> {
+    const body = JSON.stringify({ type: event.type, id: event.id, data: event.data });
+    const deliveryId = crypto.randomUUID();
+    const maxAttempts = this.options.maxAttempts ?? 5;
+    let backoffMs = this.options.initialBackoffMs ?? 1000;
+    for (let attempt = 1; attempt <= maxAttempts; attempt += 1) {
+      const outcome = await this.attempt(url, event, deliveryId, body);
+      if (outcome === 'delivered') {
+        return true;
+      }
+      if (outcome === 'rejected' || attempt === maxAttempts) {
+        break;
+      }
+      await new Promise((resolve) => setTimeout(resolve, backoffMs));
+      backoffMs = Math.min(backoffMs * 2, this.options.maxBackoffMs ?? 60_000);
+    }
+    this.logger.warn('webhook delivery failed', { id: event.id, deliveryId });
+    return false;
+  }
+
+  private async attempt(url: string, event: WebhookEvent, deliveryId: string, body: string) {
+    const timestamp = Math.floor(Date.now() / 1000);
+    try {
+      const response = await fetch(url, {
+        method: 'POST',
+        headers: {
+          'Content-Type': 'application/json',
+          'User-Agent': 'code-executor-webhooks',
+          'X-Webhook-Event': event.type,
+          'X-Webhook-Delivery': deliveryId,
+          'X-Webhook-Timestamp': String(timestamp),
+          'X-Webhook-Signature': `sha256=${signPayload(this.options.secret, timestamp, body)}`
+        },
+        body,
+        redirect: 'manual',
+        signal: AbortSignal.timeout(this.options.timeoutMs ?? 10_000)
+      });
+      await response.body?.cancel();
+      if (response.ok) {
+        return 'delivered';
+      }
+      this.logger.warn('webhook delivery rejected', { id: event.id, deliveryId, status: response.status });
+      return response.status === 408 || response.status === 429 || response.status >= 500 ? 'retry' : 'rejected';
+    } catch (err) {
+      this.logger.warn('webhook delivery errored', { id: event.id, deliveryId, message: (err as Error).message });
+      return 'retry';
+    }
+  }
+}
@@ -0,0 +1,179 @@
+import fs from 'node:fs';
+import path from 'node:path';
+import { PassThrough } from 'node:stream';
+import Boom from '@hapi/boom';
+import { selectArtifacts } from './artifacts.js';
+import { isRelativeInside } from './run_dir.js';
+import type { CoordinatorMessage, JobFile, RemoteResult, RemoteSpec, WorkerLink, WorkerMessage } from './coordinator.js';
+import { RunnerRegistry, runnerRegistry } from './runners.js';
+import type { MemoryWarning, SandboxRunner, UsageSample } from './types.js';
+import { Logger, enterLogContext, withLogContext } from '../util/logger.js';
+import type { GpuDevice } from './gpu.js';
+import { isInfrastructureFailure } from './infrastructure.js';
+
+export type AgentLink = WorkerLink<CoordinatorMessage, WorkerMessage>;
+
+export interface WorkerAgentOptions {
+  // Stable across restarts, e.g. the host name, so a reconnect replaces the old connection.
+  id: string;
+  sandbox: SandboxRunner;
+  // The languages advertised to the coordinator are this registry's.
+  registry?: RunnerRegistry;
+  // Runs taken at once.
+  capacity: number;
+  // Advertised so the coordinator can reserve them for runs that ask for GPUs.
+  gpus?: GpuDevice[];
+  // Run directories of jobs are created here, named after the run.
+  workRoot: string;
+  heartbeatMs: number;
+}
+
+interface RunningJob {
+  controller: AbortController;
+  input?: PassThrough;
+}
+
+// The worker side of distributed mode: registers with the coordinator, runs the jobs it is sent
+// in the local sandbox and reports their output and results back. Jobs in flight when the
+// connection drops are stopped, since the coordinator hands them to another worker.
+export class WorkerAgent {
+  private readonly registry: RunnerRegistry;
+  private readonly jobs = new Map<string, RunningJob>();
+  private link: AgentLink | null = null;
+  private heartbeat: NodeJS.Timeout | null = null;
+
+  constructor(private readonly options: WorkerAgentOptions, private readonly logger: Logger) {
+    this.registry = options.registry ?? runnerRegistry;
+  }
+
+  public attach(link: AgentLink) {
+    this.link = link;
+    link.onMessage((message) => this.receive(link, message));
+    link.onClose((reason) => {
+      if (this.link !== link) {
+        return;
+      }
+      this.link = null;
+      if (this.heartbeat) {
+        clearInterval(this.heartbeat);
+        this.heartbeat = null;
+      }
+      if (this.jobs.size > 0) {
+        this.logger.warn('coordinator connection lost; stopping jobs', { reason, jobs: this.jobs.size });
+      }
+      for (const job of this.jobs.values()) {
+        job.controller.abort();
+      }
+    });
+    link.send({
+      register: {
+        worker_id: this.options.id,
+        languages: this.registry.list().map((runner) => runner.language),
+        capacity: this.options.capacity,
+        gpus: this.options.gpus ?? []
+      }
+    });
+    this.heartbeat = setInterval(() => link.send({ heartbeat: { running: this.jobs.size } }), this.options.heartbeatMs);
+    this.heartbeat.unref();
+  }
+
+  public get connected() {
+    return this.link !== null;
+  }
+
+  // Whether the run directory or container of this name belongs to a job in flight here.
+  public owns(name: string) {
+    return [...this.jobs.keys()].some((id) => name === id || name.startsWith(`${id}_`));
+  }
+
+  private receive(link: AgentLink, message: CoordinatorMessage) {
+    if (message.job) {
+      void this.runJob(link, message.job);
+    } else if (message.cancel) {
+      this.jobs.get(message.cancel.job_id)?.controller.abort();
+    } else if (message.stdin) {
+      const input = this.jobs.get(message.stdin.job_id)?.input;
+      if (!input || input.writableEnded) {
+        return;
+      }
+      if (message.stdin.data?.length) {
+        input.write(message.stdin.data);
+      }
+      if (message.stdin.close) {
+        input.end();
+      }
+    }
+  }
+
+  // Logged in the context the run has on the coordinator, so the lines of both line up.
+  private runJob(link: AgentLink, job: NonNullable<CoordinatorMessage['job']>) {
+    const context = { requestId: job.request_id || undefined, debug: job.debug, runId: job.job_id, phase: 'running' };
+    return withLogContext(context, () => this.executeJob(link, job));
+  }
+
+  private async executeJob(link: AgentLink, job: NonNullable<CoordinatorMessage['job']>) {
+    const id = job.job_id;
+    const running: RunningJob = { controller: new AbortController(), input: job.interactive ? new PassThrough() : undefined };
+    this.jobs.set(id, running);
+    const workdir = path.join(this.options.workRoot, id);
+    // Replies once the job is done, unless the connection it came on has gone since.
+    const reply = (message: WorkerMessage) => {
+      if (this.link === link) {
+        link.send(message);
+      }
+    };
+    try {
+      const remote = JSON.parse(job.spec_json) as RemoteSpec;
+      enterLogContext({ language: remote.language });
+      fs.mkdirSync(path.join(workdir, 'inputs'), { recursive: true });
+      fs.mkdirSync(path.join(workdir, 'outputs'), { recursive: true });
+      // Empty lists are left out of decoded gRPC messages. A file the run directory cannot hold fails
+      // the job rather than running it without an input the local backend would have provided.
+      for (const file of job.files ?? []) {
+        if (!isRelativeInside(file.path)) {
+          throw Boom.badRequest(`job file ${file.path} is outside the run directory`);
+        }
+        const dest = path.join(workdir, file.path);
+        fs.mkdirSync(path.dirname(dest), { recursive: true });
+        fs.writeFileSync(dest, file.data ?? Buffer.alloc(0));
+      }
+      const spec = {
+        ...remote,
+        workdir,
+        stagedFiles: [],
+        signal: running.controller.signal,
+        input: running.input,
+        onOutput: (stream: 'stdout' | 'stderr', data: Buffer) => reply({ output: { job_id: id, stream, data } }),
+        onRunStart: () => reply({ started: { job_id: id } }),
+        onMemoryPressure: (warning: MemoryWarning) => reply({ memory: { job_id: id, ...warning } }),
+        onUsageSample: (sample: UsageSample) => reply({ usage: { job_id: id, ...sample } })
+      };
+      const result = await this.options.sandbox.run(spec);
+      const { stdout, stderr, artifacts: outputs, ...rest } = result;
+      // Only what the coordinator will keep is sent; the rest goes as its name and size.
+      const selection = selectArtifacts(outputs, workdir, spec.limits);
+      const artifacts: JobFile[] = [
+        ...selection.kept.map((file) => ({ path: file.name, data: fs.readFileSync(file.path), content_type: file.contentType, size: file.size })),
+        ...selection.skipped.map((file) => ({ path: file.name, size: file.size, omitted: true }))
+      ].sort((a, b) => a.path.localeCompare(b.path));
+      const encoded: RemoteResult = { ...rest, stdout: stdout.toString('base64'), stderr: stderr.toString('base64') };
+      reply({ result: { job_id: id, result_json: JSON.stringify(encoded), artifacts } });
+    } catch (err) {
+      const error = err as Error;
+      if (!Boom.isBoom(error)) {
+        this.logger.error('job failed', { runId: id, message: error.message });
+      }
+      reply({
+        failure: {
+          job_id: id,
+          error: error.message,
+          status_code: Boom.isBoom(error) ? error.output.statusCode : 0,
+          infrastructure: isInfrastructureFailure(error)
+        }
+      });
+    } finally {
+      this.jobs.delete(id);
+      fs.rm(workdir, { recursive: true, force: true }, () => undefined);
+    }
+  }
+}
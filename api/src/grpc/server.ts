@@ -0,0 +1,344 @@
+import grpc from '@grpc/grpc-js';
+import protoLoader from '@grpc/proto-loader';
+import Boom from '@hapi/boom';
+import { PassThrough } from 'node:stream';
+import type { Authenticator } from '../core/auth.js';
+import type { BatchResult, BatchRunner } from '../core/batch.js';
+import type { Orchestrator } from '../core/orchestrator.js';
+import type { OutputStream, RunRecord, RunRequest } from '../core/types.js';
+import { Logger, enterLogContext, requestLogContext } from '../util/logger.js';
+import { parseIdempotencyKey } from '../core/idempotency.js';
+import { parseFaultHeader } from '../core/faults.js';
+import { parseTraceparent } from '../tracing/tracer.js';
+
+export interface GrpcServerDeps {
+  protoPath: string;
+  orchestrator: Orchestrator;
+  batches: BatchRunner;
+  authenticator: Authenticator;
+  logger: Logger;
+  // Whether x-log-level: debug metadata turns on debug logging for a call and its runs.
+  requestDebug?: boolean;
+  // Whether x-fault-injection metadata is honored; calls carrying it are refused otherwise.
+  faultInjection?: boolean;
+}
+
+// Decoded ExecuteRequest; proto3 leaves unset fields out because `defaults` is disabled.
+interface ExecuteMessage {
+  language?: string;
+  filename?: string;
+  mode?: RunRequest['mode'];
+  code?: string;
+  sources?: Record<string, string>;
+  stdin?: string;
+  build?: RunRequest['build'];
+  lint?: RunRequest['lint'];
+  sql?: RunRequest['sql'];
+  profile?: RunRequest['profile'];
+  isolation?: RunRequest['isolation'];
+  network?: RunRequest['network'];
+  version?: string;
+  args?: string[];
+  files?: Array<{ id: string; path: string }>;
+  mounts?: RunRequest['mounts'];
+  limits?: RunRequest['limits'];
+  env?: Record<string, string>;
+  inline_artifacts?: boolean;
+  on_output_limit?: RunRequest['on_output_limit'];
+  idempotency_key?: string;
+  priority?: RunRequest['priority'];
+  deterministic?: boolean;
+  coverage?: boolean;
+  gpu?: { count?: number; vram_mb?: number };
+  template?: { source?: string; placeholder?: string };
+  reproducible?: { time?: string; freeze_time?: boolean; seed?: number };
+  tags?: string[];
+  metadata?: Record<string, string>;
+  usage_interval_ms?: number;
+}
+
+interface ExecuteBatchMessage {
+  submissions?: Array<{ tag?: string; request?: ExecuteMessage }>;
+  concurrency?: number;
+}
+
+interface ClientMessage {
+  start?: ExecuteMessage;
+  stdin?: Buffer;
+  close_stdin?: boolean;
+}
+
+const BOOM_TO_GRPC: Record<number, grpc.status> = {
+  400: grpc.status.INVALID_ARGUMENT,
+  401: grpc.status.UNAUTHENTICATED,
+  403: grpc.status.PERMISSION_DENIED,
+  404: grpc.status.NOT_FOUND,
+  409: grpc.status.FAILED_PRECONDITION,
+  422: grpc.status.INVALID_ARGUMENT,
+  429: grpc.status.RESOURCE_EXHAUSTED,
+  503: grpc.status.UNAVAILABLE
+};
+
+export function createGrpcServer(deps: GrpcServerDeps): grpc.Server {
+  const definition = protoLoader.loadSync(deps.protoPath, {
+    keepCase: true,
+    longs: Number,
+    enums: String,
+    defaults: false,
+    oneofs: true
+  });
+  const proto = grpc.loadPackageDefinition(definition) as unknown as {
+    codeexecutor: { v1: { Executor: grpc.ServiceClientConstructor } };
+  };
+  const server = new grpc.Server();
+  server.addService(proto.codeexecutor.v1.Executor.service, {
+    Execute: (call: grpc.ServerUnaryCall<ExecuteMessage, unknown>, callback: grpc.sendUnaryData<unknown>) => {
+      const apiKey = authorize(call.metadata, deps, callback);
+      if (!apiKey) {
+        return;
+      }
+      execute(call, apiKey, deps)
+        .then((run) => callback(null, toRunMessage(run)))
+        .catch((err: Error) => callback(toServiceError(err, deps.logger)));
+    },
+    StreamOutput: (call: grpc.ServerDuplexStream<ClientMessage, unknown>) => streamOutput(call, deps),
+    ExecuteBatch: (call: grpc.ServerUnaryCall<ExecuteBatchMessage, unknown>, callback: grpc.sendUnaryData<unknown>) => {
+      const apiKey = authorize(call.metadata, deps, callback);
+      if (!apiKey) {
+        return;
+      }
+      const request = {
+        submissions: (call.request.submissions ?? []).map((submission) => ({
+          ...toRunRequest(submission.request ?? {}),
+          tag: submission.tag ?? ''
+        })),
+        concurrency: call.request.concurrency || undefined
+      };
+      deps.batches
+        .run(request, apiKey, traceParentOf(call.metadata))
+        .then((result) => callback(null, toBatchMessage(result)))
+        .catch((err: Error) => callback(toServiceError(err, deps.logger)));
+    },
+    Cancel: (call: grpc.ServerUnaryCall<{ id?: string }, { canceled: boolean }>, callback: grpc.sendUnaryData<{ canceled: boolean }>) => {
+      const apiKey = authorize(call.metadata, deps, callback, false);
+      if (!apiKey) {
+        return;
+      }
+      const active = deps.orchestrator.getActiveRun(call.request.id ?? '');
+      if (!active || active.apiKey !== apiKey) {
+        callback(null, { canceled: false });
+        return;
+      }
+      callback(null, { canceled: deps.orchestrator.cancelRun(active.id) });
+    }
+  });
+  return server;
+}
+
+// Like POST /v1/runs: an idempotency key, from the request or `idempotency-key` metadata, makes
+// retries answer with the original run.
+async function execute(call: grpc.ServerUnaryCall<ExecuteMessage, unknown>, apiKey: string, deps: GrpcServerDeps) {
+  const request = toRunRequest(call.request);
+  const header = call.metadata.get('idempotency-key')[0];
+  const idempotencyKey = parseIdempotencyKey(
+    header === undefined ? undefined : header.toString(),
+    call.request.idempotency_key || undefined
+  );
+  const match = idempotencyKey ? await deps.orchestrator.findIdempotent(apiKey, idempotencyKey, request) : null;
+  if (match) {
+    return deps.orchestrator.replayRun(match);
+  }
+  const faults = faultsOf(call.metadata, deps);
+  return deps.orchestrator.createRun(request, apiKey, { traceParent: traceParentOf(call.metadata), idempotencyKey, faults });
+}
+
+// Starts the run on the `start` message and relays later `stdin` messages to the live process,
+// streaming its output back. A client that goes away mid-run cancels the execution.
+function streamOutput(call: grpc.ServerDuplexStream<ClientMessage, unknown>, deps: GrpcServerDeps) {
+  const fail = (err: Error) => call.emit('error', toServiceError(err, deps.logger));
+  const apiKey = authorize(call.metadata, deps, (err) => call.emit('error', err));
+  if (!apiKey) {
+    return;
+  }
+  const input = new PassThrough();
+  let runId: string | null = null;
+  let closed = false;
+
+  const launch = (start: ExecuteMessage) => {
+    const request = toRunRequest(start);
+    try {
+      const started = deps.orchestrator.startRun(request, apiKey, {
+        input,
+        onOutput: (stream: OutputStream, chunk: Buffer) => call.write({ output: { stream, data: chunk } }),
+        traceParent: traceParentOf(call.metadata),
+        faults: faultsOf(call.metadata, deps)
+      });
+      runId = started.id;
+      input.write(request.stdin ?? '');
+      call.write({ id: started.id });
+      started.done
+        .then((run) => {
+          call.write({ result: toRunMessage(run) });
+          call.end();
+        })
+        .catch(fail);
+    } catch (err) {
+      closed = true;
+      fail(err as Error);
+    }
+  };
+
+  call.on('data', (message: ClientMessage) => {
+    if (closed) {
+      return;
+    }
+    if (!runId) {
+      if (!message.start) {
+        closed = true;
+        fail(Boom.badRequest('first message must be start'));
+        return;
+      }
+      launch(message.start);
+    } else if (message.start) {
+      closed = true;
+      fail(Boom.badRequest('start may only be sent once'));
+      deps.orchestrator.cancelRun(runId);
+    } else if (message.stdin && !input.writableEnded) {
+      input.write(message.stdin);
+    } else if (message.close_stdin) {
+      input.end();
+    }
+  });
+  call.on('end', () => input.end());
+  call.on('cancelled', () => {
+    closed = true;
+    input.end();
+    if (runId) {
+      deps.orchestrator.cancelRun(runId);
+    }
+  });
+}
+
+function authorize(
+  metadata: grpc.Metadata,
+  deps: GrpcServerDeps,
+  fail: (err: grpc.ServiceError) => void,
+  rateLimited = true
+): string | null {
+  try {
+    const apiKey = deps.authenticator.authenticate(metadataValue(metadata, 'authorization'));
+    // Authorizing is the first thing every handler does, so the rest of the call carries it.
+    enterLogContext(requestLogContext(metadataValue(metadata, 'x-request-id'), metadataValue(metadata, 'x-log-level'), Boolean(deps.requestDebug)));
+    if (rateLimited) {
+      deps.authenticator.throttle(apiKey);
+    }
+    return apiKey;
+  } catch (err) {
+    fail(toServiceError(err as Error, deps.logger));
+    return null;
+  }
+}
+
+function traceParentOf(metadata: grpc.Metadata) {
+  return parseTraceparent(metadataValue(metadata, 'traceparent'));
+}
+
+function faultsOf(metadata: grpc.Metadata, deps: GrpcServerDeps) {
+  return parseFaultHeader(metadataValue(metadata, 'x-fault-injection'), deps.faultInjection ?? false);
+}
+
+function metadataValue(metadata: grpc.Metadata, name: string): string | undefined {
+  const value = metadata.get(name)[0];
+  return typeof value === 'string' ? value : value?.toString('utf8');
+}
+
+function toServiceError(err: Error, logger: Logger): grpc.ServiceError {
+  if (!Boom.isBoom(err)) {
+    logger.error('unhandled grpc error', { message: err.message });
+  }
+  const code = Boom.isBoom(err) ? BOOM_TO_GRPC[err.output.statusCode] ?? grpc.status.INTERNAL : grpc.status.INTERNAL;
+  const metadata = new grpc.Metadata();
+  const retryAfter = Boom.isBoom(err) ? err.output.headers['Retry-After'] : undefined;
+  if (retryAfter !== undefined) {
+    metadata.set('retry-after', String(retryAfter));
+  }
+  return Object.assign(new Error(err.message), {
+    code,
+    details: Boom.isBoom(err) ? err.message : 'internal_error',
+    metadata
+  });
+}
+
+// Records go out as they are except for query rows and annotations, whose values become
+// google.protobuf.Value.
+function toRunMessage(run: RunRecord) {
+  const annotations = Object.fromEntries(Object.entries(run.annotations ?? {}).map(([name, value]) => [name, toValue(value)]));
+  if (!run.results) {
+    return { ...run, annotations };
+  }
+  const results = run.results.map((result) => ({
+    ...result,
+    columns: result.columns ?? [],
+    rows: result.rows.map((row) => ({ values: row.map(toValue) })),
+    rows_affected: result.rows_affected ?? undefined,
+    error: result.error ?? ''
+  }));
+  return { ...run, results, annotations };
+}
+
+function toBatchMessage(batch: BatchResult) {
+  const results = Object.fromEntries(
+    Object.entries(batch.results).map(([tag, item]) => [tag, item.run ? { ...item, run: toRunMessage(item.run) } : item])
+  );
+  return { ...batch, results };
+}
+
+function toValue(value: unknown) {
+  if (value === null || value === undefined) {
+    return { null_value: 'NULL_VALUE' };
+  }
+  if (typeof value === 'number') {
+    return { number_value: value };
+  }
+  if (typeof value === 'boolean') {
+    return { bool_value: value };
+  }
+  return { string_value: typeof value === 'string' ? value : JSON.stringify(value) };
+}
+
+function toRunRequest(message: ExecuteMessage): RunRequest {
+  return {
+    language: message.language ?? '',
+    filename: message.filename || undefined,
+    mode: message.mode || undefined,
+    code: message.code || undefined,
+    sources: message.sources,
+    stdin: message.stdin,
+    build: message.build,
+    lint: message.lint ? { vet: message.lint.vet, staticcheck: message.lint.staticcheck } : undefined,
+    sql: message.sql ? { engine: message.sql.engine || undefined, fixture: message.sql.fixture || undefined } : undefined,
+    profile: message.profile ? { cpu: message.profile.cpu || undefined, heap: message.profile.heap || undefined } : undefined,
+    isolation: message.isolation || undefined,
+    network: message.network?.mode ? message.network : undefined,
+    version: message.version || undefined,
+    args: message.args,
+    files: message.files,
+    // Leaves out the virtual field proto-loader adds to name the oneof member that was set.
+    mounts: message.mounts?.map((mount) => ({ path: mount.path, dataset_id: mount.dataset_id, host_path: mount.host_path })),
+    limits: message.limits,
+    env: message.env,
+    inline_artifacts: message.inline_artifacts,
+    on_output_limit: message.on_output_limit || undefined,
+    priority: message.priority || undefined,
+    deterministic: message.deterministic || undefined,
+    coverage: message.coverage || undefined,
+    gpu: message.gpu ? { count: message.gpu.count || undefined, vram_mb: message.gpu.vram_mb || undefined } : undefined,
+    template: message.template ? { source: message.template.source ?? '', placeholder: message.template.placeholder || undefined } : undefined,
+    reproducible: message.reproducible
+      ? { time: message.reproducible.time || undefined, freeze_time: message.reproducible.freeze_time || undefined, seed: message.reproducible.seed }
+      : undefined,
+    tags: message.tags?.length ? message.tags : undefined,
+    metadata: message.metadata && Object.keys(message.metadata).length > 0 ? message.metadata : undefined,
+    usage_interval_ms: message.usage_interval_ms || undefined
+  };
+}
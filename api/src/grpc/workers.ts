@@ -0,0 +1,141 @@
+import crypto from 'node:crypto';
+import type { Duplex } from 'node:stream';
+import grpc from '@grpc/grpc-js';
+import protoLoader from '@grpc/proto-loader';
+import type { Coordinator, CoordinatorMessage, WorkerLink, WorkerMessage } from '../core/coordinator.js';
+import type { WorkerAgent } from '../core/worker_agent.js';
+import { Logger } from '../util/logger.js';
+
+// Jobs and results carry input files and artifacts, well past gRPC's 4 MiB default.
+const MAX_MESSAGE_BYTES = 64 * 1024 * 1024;
+const CHANNEL_OPTIONS = {
+  'grpc.max_receive_message_length': MAX_MESSAGE_BYTES,
+  'grpc.max_send_message_length': MAX_MESSAGE_BYTES
+};
+
+type WorkersProto = { codeexecutor: { v1: { Workers: grpc.ServiceClientConstructor } } };
+
+function loadWorkersProto(protoPath: string) {
+  const definition = protoLoader.loadSync(protoPath, {
+    keepCase: true,
+    longs: Number,
+    enums: String,
+    defaults: false,
+    oneofs: true
+  });
+  return (grpc.loadPackageDefinition(definition) as unknown as WorkersProto).codeexecutor.v1.Workers;
+}
+
+// Adapts a Connect stream, from either end, to the link the coordinator and the agent speak.
+function streamLink<In, Out>(stream: Duplex): WorkerLink<In, Out> {
+  let closed = false;
+  const closeListeners: Array<(reason: string) => void> = [];
+  const closeWith = (reason: string) => {
+    if (closed) {
+      return;
+    }
+    closed = true;
+    for (const listener of closeListeners) {
+      listener(reason);
+    }
+  };
+  stream.on('end', () => closeWith('stream ended'));
+  stream.on('error', (err: Error) => closeWith(err.message));
+  stream.on('cancelled', () => closeWith('stream cancelled'));
+  stream.on('close', () => closeWith('stream closed'));
+  return {
+    send: (message) => {
+      if (!closed) {
+        stream.write(message);
+      }
+    },
+    onMessage: (listener) => {
+      stream.on('data', (message: In) => listener(message));
+    },
+    onClose: (listener) => {
+      closeListeners.push(listener);
+    },
+    close: () => {
+      if (closed) {
+        return;
+      }
+      closeWith('closed');
+      stream.end();
+    }
+  };
+}
+
+export interface WorkerServerDeps {
+  protoPath: string;
+  coordinator: Coordinator;
+  // Shared secret workers present as `authorization: Bearer <token>`.
+  token: string;
+  logger: Logger;
+}
+
+// Serves Workers.Connect for workers to pull jobs over. Meant for a private network; the token
+// keeps stray clients from registering as workers.
+export function createWorkerServer(deps: WorkerServerDeps): grpc.Server {
+  const server = new grpc.Server(CHANNEL_OPTIONS);
+  const expected = Buffer.from(`Bearer ${deps.token}`);
+  server.addService(loadWorkersProto(deps.protoPath).service, {
+    Connect: (call: grpc.ServerDuplexStream<WorkerMessage, CoordinatorMessage>) => {
+      const header = call.metadata.get('authorization')[0];
+      const presented = Buffer.from(typeof header === 'string' ? header : header?.toString('utf8') ?? '');
+      if (presented.length !== expected.length || !crypto.timingSafeEqual(presented, expected)) {
+        deps.logger.warn('worker connection refused', { peer: call.getPeer() });
+        call.emit('error', Object.assign(new Error('invalid worker token'), { code: grpc.status.UNAUTHENTICATED, details: 'invalid worker token' }));
+        return;
+      }
+      deps.coordinator.connect(streamLink<WorkerMessage, CoordinatorMessage>(call));
+    }
+  });
+  return server;
+}
+
+export interface WorkerConnectionOptions {
+  protoPath: string;
+  // host:port of the coordinator's worker endpoint.
+  address: string;
+  token: string;
+  agent: WorkerAgent;
+  // Delay before reconnecting after the connection drops.
+  retryMs: number;
+  logger: Logger;
+}
+
+// Keeps the agent connected to the coordinator, reconnecting whenever the stream ends.
+export function connectWorker(options: WorkerConnectionOptions) {
+  const Workers = loadWorkersProto(options.protoPath);
+  const client = new Workers(options.address, grpc.credentials.createInsecure(), CHANNEL_OPTIONS);
+  let stopped = false;
+  let current: WorkerLink<CoordinatorMessage, WorkerMessage> | null = null;
+  const open = () => {
+    if (stopped) {
+      return;
+    }
+    const metadata = new grpc.Metadata();
+    metadata.set('authorization', `Bearer ${options.token}`);
+    const stream = (client as unknown as {
+      Connect(metadata: grpc.Metadata): grpc.ClientDuplexStream<WorkerMessage, CoordinatorMessage>;
+    }).Connect(metadata);
+    const link = streamLink<CoordinatorMessage, WorkerMessage>(stream);
+    current = link;
+    link.onClose((reason) => {
+      current = null;
+      if (!stopped) {
+        options.logger.warn('coordinator connection closed; reconnecting', { reason, retryMs: options.retryMs });
+        setTimeout(open, options.retryMs);
+      }
+    });
+    options.agent.attach(link);
+  };
+  open();
+  return {
+    close: () => {
+      stopped = true;
+      current?.close();
+      client.close();
+    }
+  };
+}
@@ -8,66 +8,647 @@ import Boom from '@hapi/boom';
 import path from 'node:path';
 import fs from 'node:fs';
 import { fileURLToPath } from 'node:url';
-import { Logger } from './util/logger.js';
+import { Logger, logContextMiddleware, setLogLevel } from './util/logger.js';
 import { ArtifactStorage } from './core/storage.js';
-import { Authenticator } from './core/auth.js';
+import { DatasetStore } from './core/datasets.js';
+import { FilesystemObjectStore, GcsObjectStore, S3ObjectStore, readGcsCredentials } from './core/object_store.js';
+import type { ObjectStore } from './core/object_store.js';
+import { Authenticator, policyOf } from './core/auth.js';
 import { TokenBucketLimiter } from './core/rate_limit.js';
-import { RunStore } from './core/run_store.js';
+import { createStore } from './store/index.js';
 import { Orchestrator } from './core/orchestrator.js';
 import { DockerSandbox } from './core/sandbox.js';
+import { ProcessSandbox } from './core/process_sandbox.js';
+import { WasmSandbox } from './core/wasm_sandbox.js';
+import { FaultInjector } from './core/faults.js';
+import { loadProcessSeccomp } from './core/seccomp.js';
+import { InMemoryQueue } from './core/queue.js';
+import { BuildCache } from './core/build_cache.js';
+import { ResultCache } from './core/result_cache.js';
+import { VersionManager } from './core/versions.js';
+import { ImageManager } from './core/images.js';
+import { RuntimeSettings } from './core/runtime_settings.js';
+import { Judge } from './core/judge.js';
+import { Benchmark } from './core/benchmark.js';
+import { Comparer } from './core/compare.js';
+import { Fuzzer } from './core/fuzz.js';
+import type { CostWeights } from './core/cost.js';
+import { Pipeline } from './core/pipeline.js';
+import { BatchRunner } from './core/batch.js';
+import { BundleExporter } from './core/bundle.js';
+import { EnvPolicy } from './core/env_policy.js';
+import { SubmissionPolicy } from './core/submission_policy.js';
+import { EgressProxy } from './core/egress_proxy.js';
+import { WebhookDispatcher } from './core/webhooks.js';
+import { ApiSchema, listRoutes, loadApiSpec } from './core/openapi.js';
 import { registerHealthRoutes } from './routes/health.js';
 import { registerFileRoutes } from './routes/files.js';
+import { registerDatasetRoutes } from './routes/datasets.js';
 import { registerRunRoutes } from './routes/runs.js';
+import { registerExecutionRoutes } from './routes/executions.js';
+import { registerSessionRoutes } from './routes/sessions.js';
+import { registerRunnerRoutes } from './routes/runners.js';
+import { registerQueueRoutes } from './routes/queue.js';
+import { registerWorkerRoutes } from './routes/workers.js';
+import { registerBuildCacheRoutes } from './routes/build_cache.js';
+import { registerWarmPoolRoutes } from './routes/warm_pool.js';
+import { registerJudgeRoutes } from './routes/judge.js';
+import { registerBenchmarkRoutes } from './routes/benchmarks.js';
+import { registerComparisonRoutes } from './routes/comparisons.js';
+import { registerFuzzRoutes } from './routes/fuzz.js';
+import { registerPipelineRoutes } from './routes/pipelines.js';
+import { registerBatchRoutes } from './routes/batches.js';
+import { registerMetricsRoutes } from './routes/metrics.js';
+import { registerApiKeyRoutes } from './routes/api_keys.js';
+import { registerUsageRoutes } from './routes/usage.js';
+import { registerImageRoutes } from './routes/images.js';
+import { registerSettingsRoutes } from './routes/settings.js';
+import { registerSigningRoutes } from './routes/signing.js';
+import { registerOpenApiRoutes } from './routes/openapi.js';
+import { registerScheduleRoutes } from './routes/schedules.js';
+import { MetricsRegistry } from './metrics/registry.js';
+import { ExecutionMetrics } from './metrics/executions.js';
+import { CommandHook, HookRunner } from './core/hooks.js';
+import { ResultSigner } from './core/result_signing.js';
+import { PolicyScanner } from './core/policy_scanner.js';
+import { Janitor } from './core/janitor.js';
+import { RetentionSweeper } from './core/retention.js';
+import { Scheduler } from './core/scheduler.js';
+import type { ExpiringCache } from './core/janitor.js';
+import { ReadinessProbe } from './core/readiness.js';
+import { OtlpHttpExporter, Tracer } from './tracing/tracer.js';
+import { createGrpcServer } from './grpc/server.js';
+import { connectWorker, createWorkerServer } from './grpc/workers.js';
+import { Coordinator } from './core/coordinator.js';
+import { WorkerAgent } from './core/worker_agent.js';
+import grpc from '@grpc/grpc-js';
+import { DEFAULT_ISOLATION_LEVELS, runnerRegistry } from './core/runners.js';
+import { mergeLimits } from './core/limits.js';
+import { formatConfig, loadConfig } from './config/index.js';
 
 const logger = new Logger({ service: 'code-executor-api' });
 
-function parseApiKeys(): Record<string, { label: string; rateLimitRps: number; burst: number }> {
-  const tokensEnv = process.env.API_KEYS ?? 'dev_123:default:5:10';
-  const entries = tokensEnv.split(',').filter(Boolean);
-  const result: Record<string, { label: string; rateLimitRps: number; burst: number }> = {};
-  for (const entry of entries) {
-    const [token, label = 'default', rps = '5', burst = '10'] = entry.split(':');
-    result[token] = { label, rateLimitRps: Number(rps), burst: Number(burst) };
+// Settings come from the file named by --config or CONFIG_FILE, overridden by environment
+// variables; --print-config shows the result and exits without starting the server.
+const configFlag = process.argv.indexOf('--config');
+const config = loadConfig({ file: configFlag === -1 ? process.env.CONFIG_FILE : process.argv[configFlag + 1] });
+if (process.argv.includes('--print-config')) {
+  process.stdout.write(formatConfig(config));
+  process.exit(0);
+}
+setLogLevel(config.logging.level);
+// Languages left out of languages.enabled are switched off rather than dropped, so the admin API
+// can switch them on without a restart.
+for (const runner of runnerRegistry.list()) {
+  if (config.languages.enabled && !config.languages.enabled.includes(runner.language)) {
+    runnerRegistry.setEnabled(runner.language, false);
   }
-  return result;
+}
+if (runnerRegistry.has('go')) {
+  runnerRegistry.configure('go', {
+    settings: config.languages.go.proxy ? { proxy: config.languages.go.proxy } : undefined,
+    offlineDependencies: config.languages.go.offline
+  });
+}
+if (runnerRegistry.has('bash')) {
+  runnerRegistry.configure('bash', { settings: { restricted: String(config.languages.shell.restricted) } });
 }
 
-const apiKeys = parseApiKeys();
-const authenticator = new Authenticator({ tokens: apiKeys });
-const limiter = new TokenBucketLimiter(5, 10);
-const runStore = new RunStore();
+// cluster.role splits the server across machines: a coordinator runs nothing itself and hands
+// runs to its workers, a worker only runs what its coordinator sends.
+const role = config.cluster.role;
+const mountRoots = config.sandbox.mount_roots;
+const runAs = config.sandbox.run_as;
+// store.url selects where executions are persisted: `sqlite:<path>`, a postgres:// URL, or
+// memory when unset. Executions an earlier process left unfinished are failed on startup, and
+// those a draining server requeued are resumed once the orchestrator is up.
+const runStore = createStore(config.store.url, { metadataIndexes: config.store.metadata_indexes });
+const startedAt = new Date().toISOString();
+// Workers may share the coordinator's store for API keys but never touch its executions.
+const recovered = role === 'worker' ? Promise.resolve() : runStore
+  .failUnfinished(startedAt, 'interrupted by a server restart')
+  .then((count) => {
+    if (count > 0) {
+      logger.warn('marked interrupted executions as failed', { count });
+    }
+  });
+recovered.catch((err: Error) => logger.error('execution store unavailable', { message: err.message }));
+// Configured keys plus those issued through /admin/api-keys, which live in the store; issued
+// keys and quota usage are reloaded every API_KEY_REFRESH_MS so instances sharing a store agree.
+const API_KEY_REFRESH_MS = 30000;
+const authenticator = new Authenticator({
+  tokens: Object.fromEntries(config.server.api_keys.map((key) => [key.token, policyOf(key)])),
+  limiter: new TokenBucketLimiter(5, 10),
+  maxConcurrent: config.queue.tenant_concurrency,
+  store: runStore
+});
+const refreshKeys = () =>
+  authenticator.refresh().catch((err: Error) => logger.error('api key refresh failed', { message: err.message }));
+void refreshKeys();
+setInterval(refreshKeys, API_KEY_REFRESH_MS).unref();
+// Languages switched on or off and limits changed through /admin live in the store too, over the
+// configuration, and are reloaded as often as the keys so every instance applies them.
+const runtimeSettings = new RuntimeSettings(
+  { registry: runnerRegistry, store: runStore, limits: config.limits },
+  logger.child({ component: 'runtime-settings' })
+);
+const refreshSettings = () =>
+  runtimeSettings.refresh().catch((err: Error) => logger.error('runtime settings refresh failed', { message: err.message }));
+void refreshSettings();
+setInterval(refreshSettings, API_KEY_REFRESH_MS).unref();
+const storageDir = config.storage.dir;
+// storage.backend picks where artifacts are uploaded; loadConfig has checked that the chosen
+// backend's settings are present. Without one they stay in the storage directory.
+const { s3, gcs } = config.storage;
+const bucketStore = (prefix: string | undefined): ObjectStore | undefined => config.storage.backend === 's3'
+  ? new S3ObjectStore({
+    bucket: config.storage.bucket as string,
+    prefix,
+    region: s3.region as string,
+    endpoint: s3.endpoint,
+    accessKeyId: s3.access_key_id as string,
+    secretAccessKey: s3.secret_access_key as string,
+    sessionToken: s3.session_token
+  })
+  : config.storage.backend === 'gcs'
+    ? new GcsObjectStore({
+      bucket: config.storage.bucket as string,
+      prefix,
+      endpoint: gcs.endpoint,
+      ...readGcsCredentials(gcs.credentials_file as string)
+    })
+    : undefined;
+const objects = bucketStore(config.storage.prefix);
 const storage = new ArtifactStorage({
-  baseDir: process.env.STORAGE_DIR ?? path.join(process.cwd(), 'data'),
-  baseUrl: process.env.PUBLIC_BASE_URL ?? 'http://localhost:8080',
-  signingKey: process.env.SIGNING_KEY ?? 'changeme-signing-key',
-  urlTtlSeconds: 600
+  baseDir: storageDir,
+  baseUrl: config.server.public_base_url,
+  signingKey: config.server.signing_key,
+  urlTtlSeconds: config.storage.url_ttl_seconds,
+  objects,
+  maxInlineBytes: config.storage.max_inline_bytes
 });
+// Inside the storage directory, so runs mount dataset trees through the same host path mapping
+// as uploaded files.
+const datasets = new DatasetStore({
+  baseDir: path.join(storageDir, 'datasets'),
+  maxArchiveBytes: config.datasets.max_archive_bytes,
+  maxBytes: config.datasets.max_bytes,
+  maxFiles: config.datasets.max_files
+});
+
+const buildCache = config.cache.build_dir
+  ? new BuildCache(
+    {
+      dir: config.cache.build_dir,
+      maxBytes: config.cache.build_max_mb * 1024 * 1024
+    },
+    logger.child({ component: 'build-cache' })
+  )
+  : undefined;
 
-const sandbox = new DockerSandbox(
+// Requests marked deterministic are answered from an identical earlier run while it is cached.
+const resultCache = config.cache.results_max_entries > 0
+  ? new ResultCache({ maxEntries: config.cache.results_max_entries, ttlMs: config.cache.results_ttl_ms })
+  : undefined;
+
+// sandbox.backend selects how runs are executed: `docker` (default) launches an ephemeral
+// container per run, `process` runs entrypoints on the host for development only.
+const sandboxBackend = config.sandbox.backend;
+const versions = sandboxBackend === 'docker'
+  ? new VersionManager(
+    { cli: config.sandbox.cli, pull: config.sandbox.pull_versions },
+    logger.child({ component: 'versions' })
+  )
+  : undefined;
+// Runner images are pulled at startup, in the background, and runs start from them pinned by
+// digest; /admin/images points languages at new ones. Images added there are kept next to the
+// datasets in the storage directory.
+const images = sandboxBackend === 'docker' && role !== 'coordinator'
+  ? new ImageManager(
+    {
+      cli: config.sandbox.cli,
+      registry: runnerRegistry,
+      catalog: config.sandbox.images.catalog,
+      pull: config.sandbox.images.pull,
+      gc: config.sandbox.images.gc,
+      stateFile: path.join(storageDir, 'images.json')
+    },
+    logger.child({ component: 'images' })
+  )
+  : undefined;
+void images?.prepare();
+// Runs with a network allowlist join sandbox.egress.network, an internal Docker network on
+// which the API's egress proxy is the only reachable host.
+const egress = config.sandbox.egress;
+const egressProxy = sandboxBackend === 'docker' && egress.network
+  ? new EgressProxy(
+    {
+      port: egress.proxy_port,
+      advertisedHost: egress.proxy_host
+    },
+    logger.child({ component: 'egress-proxy' })
+  )
+  : undefined;
+if (egressProxy) {
+  void egressProxy.listen().then((boundPort) => logger.info('egress proxy listening', { port: boundPort.toString() }));
+}
+const dockerSandbox = sandboxBackend === 'docker' && role !== 'coordinator'
+  ? new DockerSandbox(
+    {
+      workRoot: config.sandbox.work_root,
+      hostWorkRoot: config.sandbox.host_work_root,
+      seccompProfile: config.sandbox.seccomp_profile,
+      appArmorProfile: config.sandbox.apparmor_profile,
+      disableSecurity: config.sandbox.disable_security,
+      registry: runnerRegistry,
+      cacheDir: config.cache.dependency_dir,
+      hostCacheDir: config.cache.host_dependency_dir,
+      cli: config.sandbox.cli,
+      runtimes: {
+        gvisor: config.sandbox.gvisor_runtime,
+        microvm: config.sandbox.microvm_runtime
+      },
+      gpus: config.sandbox.gpus,
+      gpuRuntime: config.sandbox.gpu_runtime,
+      cgroupRoot: config.sandbox.cgroup_root,
+      warmPool: {
+        size: config.sandbox.warm_pool.size,
+        isolation: config.sandbox.warm_pool.isolation,
+        refill: config.sandbox.warm_pool.refill,
+        maxIdleMs: config.sandbox.warm_pool.max_idle_ms
+      },
+      buildCache,
+      buildLayers: config.cache.build_layers,
+      hostBuildCacheDir: config.cache.host_build_dir,
+      versions,
+      images,
+      egress: egressProxy && egress.network
+        ? {
+          network: egress.network,
+          proxy: egressProxy,
+          allowlist: egress.allowlist
+        }
+        : undefined,
+      runAs,
+      userns: config.sandbox.userns,
+      // Uploaded datasets are mounted straight from the storage directory.
+      mountHostPaths: {
+        ...mountRoots,
+        ...(config.storage.host_dir ? { [storageDir]: config.storage.host_dir } : {})
+      }
+    },
+    logger.child({ component: 'sandbox' })
+  )
+  : null;
+// Languages listed here get their pools filled at startup for runs with the default limits.
+if (dockerSandbox) {
+  for (const language of config.sandbox.warm_pool.languages) {
+    for (const isolation of dockerSandbox.warmPool.stats().isolation) {
+      const runner = runnerRegistry.require(language);
+      const limits = mergeLimits(undefined, { maxProcesses: runner.pidsLimit, maxOpenFiles: runner.openFilesLimit, policy: config.limits, language });
+      dockerSandbox.prewarm(language, limits, isolation);
+    }
+  }
+}
+const backend = dockerSandbox ?? new ProcessSandbox(
   {
-    workRoot: process.env.SANDBOX_WORKDIR ?? '/sandbox',
-    seccompProfile: process.env.SECCOMP_PROFILE ?? '/seccomp/default.json',
-    appArmorProfile: process.env.APPARMOR_PROFILE
+    runnersDir: config.sandbox.runners_dir,
+    registry: runnerRegistry,
+    // sandbox.process_seccomp_profile replaces parts of the built-in deny-list and per-language overrides.
+    seccomp: config.sandbox.disable_security ? undefined : loadProcessSeccomp(config.sandbox.process_seccomp_profile),
+    runAs,
+    confine: !config.sandbox.disable_security
   },
   logger.child({ component: 'sandbox' })
 );
+// Runs with isolation wasm execute under sandbox.wasm.runtime on the API host, whichever
+// backend runs the rest; they are refused while it is unset.
+const wasmSandbox = new WasmSandbox(
+  {
+    runtime: config.sandbox.wasm.runtime,
+    wasiSdk: config.sandbox.wasm.wasi_sdk,
+    fuel: config.sandbox.wasm.fuel,
+    cacheDir: config.sandbox.wasm.cache_dir,
+    registry: runnerRegistry,
+    runAs,
+    next: backend
+  },
+  logger.child({ component: 'wasm-sandbox' })
+);
+// Test deployments can have faults injected into runs, on a worker as on a single server, so that
+// integrators can exercise their retry and timeout handling; a coordinator passes requested faults
+// on to its workers.
+const sandbox = config.faults.enabled
+  ? new FaultInjector(
+    { rate: config.faults.rate, kinds: config.faults.kinds, delayMs: config.faults.delay_ms, next: wasmSandbox },
+    logger.child({ component: 'faults' })
+  )
+  : wasmSandbox;
+
+// A coordinator's runs go to its workers; the queue still bounds how many it has out at once.
+const coordinator = role === 'coordinator'
+  ? new Coordinator(
+    {
+      workerTimeoutMs: config.cluster.worker_timeout_ms,
+      dispatchTimeoutMs: config.cluster.dispatch_timeout_ms,
+      maxAttempts: config.cluster.max_attempts
+    },
+    logger.child({ component: 'coordinator' })
+  )
+  : undefined;
+coordinator?.start();
+const agent = role === 'worker'
+  ? new WorkerAgent(
+    {
+      id: config.cluster.worker_id,
+      sandbox,
+      registry: runnerRegistry,
+      capacity: config.cluster.capacity ?? config.queue.concurrency,
+      gpus: config.sandbox.gpus,
+      workRoot: config.sandbox.work_root,
+      heartbeatMs: config.cluster.heartbeat_ms
+    },
+    logger.child({ component: 'worker' })
+  )
+  : undefined;
+
+const queue = new InMemoryQueue({
+  concurrency: config.queue.concurrency,
+  maxDepth: config.queue.max_depth,
+  reservations: config.queue.reservations,
+  agingMs: config.queue.aging_ms
+});
+
+// The janitor removes what crashed executions leave behind. A work directory or container is live
+// while its run is active here or the Docker backend still runs it, so one API server should own
+// each work root and Docker host.
+const caches: ExpiringCache[] = [];
+if (buildCache) {
+  caches.push({ name: 'build', expire: (before) => buildCache.expire(before) });
+}
+if (dockerSandbox) {
+  caches.push({ name: 'dependencies', expire: (before) => dockerSandbox.expireDependencies(before) });
+}
+const janitor = config.janitor.interval_ms > 0
+  ? new Janitor(
+    {
+      ttlMs: config.janitor.ttl_ms,
+      cacheTtlMs: config.janitor.cache_ttl_ms,
+      workRoots: [config.sandbox.work_root],
+      isLive: (name) => Boolean(dockerSandbox?.owns(name) || agent?.owns(name)) || orchestrator.getActiveRun(/^run_[^_]+/.exec(name)?.[0] ?? '') !== null,
+      containers: dockerSandbox,
+      caches
+    },
+    logger.child({ component: 'janitor' })
+  )
+  : undefined;
+
+// Prometheus metrics are only collected and served on /metrics when server.metrics_enabled is set.
+const metrics = config.server.metrics_enabled
+  ? new ExecutionMetrics(new MetricsRegistry(), { queue, buildCache, warmPool: dockerSandbox?.warmPool, janitor, gpuPool: dockerSandbox?.gpuPool })
+  : undefined;
+
+// Traces are exported over OTLP/HTTP when a collector is configured through the standard
+// OpenTelemetry variables.
+const otlpTracesUrl = config.tracing.traces_endpoint
+  ?? (config.tracing.endpoint ? `${config.tracing.endpoint.replace(/\/+$/, '')}/v1/traces` : undefined);
+const tracer = otlpTracesUrl
+  ? new Tracer(
+    new OtlpHttpExporter(
+      { url: otlpTracesUrl, serviceName: config.tracing.service_name },
+      logger.child({ component: 'tracing' })
+    )
+  )
+  : undefined;
+
+// Executions may name a callback_url for their result only when deliveries can be signed.
+const webhooks = config.webhooks.secret
+  ? new WebhookDispatcher(
+    {
+      secret: config.webhooks.secret,
+      allowedHosts: config.webhooks.allowed_hosts,
+      maxAttempts: config.webhooks.max_attempts,
+      timeoutMs: config.webhooks.timeout_ms
+    },
+    logger.child({ component: 'webhooks' })
+  )
+  : undefined;
+
+// Programs the deployment runs before compiling, before running and after completion of each run.
+const hookCommands = Object.entries(config.hooks.commands);
+const hooks = hookCommands.length > 0
+  ? new HookRunner(
+    hookCommands.map(([name, hook]) => new CommandHook({ name, ...hook, timeoutMs: config.hooks.timeout_ms })),
+    { timeoutMs: config.hooks.timeout_ms, failOpen: config.hooks.fail_open },
+    logger.child({ component: 'hooks' })
+  )
+  : undefined;
+
+// Signs run records and judge results so that whoever receives them can check they came from here.
+const resultSigner = config.result_signing.private_key_file
+  ? new ResultSigner(fs.readFileSync(config.result_signing.private_key_file, 'utf8'))
+  : undefined;
+
+const costWeights: CostWeights = {
+  cpu_second: config.cost.cpu_second_units,
+  gb_second: config.cost.gb_second_units,
+  sandbox_second: config.cost.sandbox_second_units
+};
 
 const orchestrator = new Orchestrator({
-  workRoot: process.env.SANDBOX_WORKDIR ?? '/sandbox',
+  workRoot: config.sandbox.work_root,
+  artifactStorage: storage,
+  sandboxRunner: coordinator ?? sandbox,
+  logger: logger.child({ component: 'orchestrator' }),
+  registry: runnerRegistry,
+  defaultIsolation: config.sandbox.default_isolation,
+  limits: config.limits,
+  queue,
+  envPolicy: new EnvPolicy({
+    allow: config.env_policy.allowlist,
+    denyPrefixes: config.env_policy.deny_prefixes,
+    maxBytes: config.env_policy.max_bytes
+  }),
+  submissionPolicy: new SubmissionPolicy({
+    maxFiles: config.submission.max_files,
+    maxBytes: config.submission.max_bytes,
+    maxFileBytes: config.submission.max_file_bytes,
+    allowBinary: config.submission.allow_binary
+  }),
+  policyScanner: config.submission.rules.length > 0 ? new PolicyScanner(config.submission.rules) : undefined,
+  mountRoots: Object.keys(mountRoots),
+  datasets,
+  metrics,
+  tracer,
+  store: runStore,
+  keyPolicy: authenticator,
+  resultCache,
+  hooks,
+  resultSigner,
+  memoryWarnings: config.sandbox.memory_warnings,
+  maxUsageSamples: config.sandbox.max_usage_samples,
+  fingerprints: config.store.fingerprints,
+  costWeights
+});
+janitor?.start(config.janitor.interval_ms);
+
+// Executions past retention.days are archived next to the artifacts, under `archive/` in the
+// bucket or in the storage directory, from where POST /v1/executions/:id/restore brings them back.
+const retention = config.retention.days > 0 && role !== 'worker'
+  ? new RetentionSweeper(
+    {
+      maxAgeMs: config.retention.days * 24 * 3600000,
+      action: config.retention.action,
+      archive: bucketStore(`${config.storage.prefix ?? ''}archive/`)
+        ?? new FilesystemObjectStore(path.join(storageDir, 'archive'), (urlPath, expiresAt) => storage.signUrl(urlPath, expiresAt)),
+      store: runStore,
+      artifacts: storage,
+      signer: resultSigner,
+      batchSize: config.retention.batch_size
+    },
+    logger.child({ component: 'retention' })
+  )
+  : undefined;
+retention?.start(config.retention.interval_ms);
+
+// Every server that accepts runs ticks through the schedules; each occurrence starts on one.
+const scheduler = config.schedules.interval_ms > 0 && role !== 'worker'
+  ? new Scheduler(
+    {
+      store: runStore,
+      orchestrator,
+      keyPolicy: authenticator,
+      webhooks,
+      maxPerKey: config.schedules.max_per_key,
+      historyLimit: config.schedules.history
+    },
+    logger.child({ component: 'scheduler' })
+  )
+  : undefined;
+scheduler?.start(config.schedules.interval_ms);
+
+// /readyz waits for every runner to compile and run its probe program through the same sandbox
+// as executions. Wasm-only languages are left out while no WebAssembly runtime is configured,
+// since every run of theirs is refused anyway. A coordinator probes through its workers, so it
+// is ready once some worker runs each language.
+const readiness = config.server.readiness_probe_interval_ms > 0
+  ? new ReadinessProbe(
+    {
+      sandbox: coordinator ?? sandbox,
+      registry: runnerRegistry,
+      workRoot: config.sandbox.work_root,
+      defaultIsolation: config.sandbox.default_isolation,
+      limits: config.limits,
+      include: (runner) => Boolean(config.sandbox.wasm.runtime) || !(runner.isolation ?? DEFAULT_ISOLATION_LEVELS).every((level) => level === 'wasm')
+    },
+    logger.child({ component: 'readiness' })
+  )
+  : undefined;
+readiness?.start(config.server.readiness_probe_interval_ms);
+// Claimed after failUnfinished has run, which would otherwise fail them as interrupted.
+void recovered
+  .then(() => (role === 'worker' ? [] : runStore.claimRequeued()))
+  .then(async (submissions) => {
+    if (submissions.length > 0) {
+      logger.info('resuming requeued executions', { count: submissions.length });
+    }
+    for (const submission of submissions) {
+      try {
+        const started = await orchestrator.resumeRun(submission);
+        started.done.catch(() => undefined);
+      } catch (err) {
+        // E.g. the language is no longer enabled; the execution ends like any refused one.
+        await runStore.saveError(submission.id, Boom.isBoom(err) ? err.message : 'internal_error');
+      }
+    }
+  })
+  .catch((err: Error) => logger.error('resuming requeued executions failed', { message: err.message }));
+
+const judge = new Judge({
+  orchestrator,
+  logger: logger.child({ component: 'judge' }),
+  registry: runnerRegistry,
+  concurrency: config.judge.concurrency,
+  maxCases: config.judge.max_cases,
+  signer: resultSigner
+});
+
+const benchmark = new Benchmark({
+  orchestrator,
+  logger: logger.child({ component: 'benchmark' }),
+  registry: runnerRegistry,
+  maxIterations: config.benchmark.max_iterations
+});
+
+const comparer = new Comparer({
+  orchestrator,
+  logger: logger.child({ component: 'compare' }),
+  registry: runnerRegistry,
+  maxRuns: config.compare.max_runs
+});
+
+const fuzzer = new Fuzzer({
+  orchestrator,
+  logger: logger.child({ component: 'fuzz' }),
+  registry: runnerRegistry,
+  maxRuns: config.fuzz.max_runs,
+  maxBudgetMs: config.fuzz.max_budget_ms,
+  concurrency: config.fuzz.concurrency
+});
+
+const pipeline = new Pipeline({
+  orchestrator,
+  logger: logger.child({ component: 'pipeline' }),
+  maxStages: config.pipeline.max_stages
+});
+
+// Exported bundles describe this server's sandbox so a replay elsewhere can tell what differs.
+const bundles = new BundleExporter({
+  store: runStore,
   artifactStorage: storage,
-  sandboxRunner: sandbox,
-  logger: logger.child({ component: 'orchestrator' })
+  registry: runnerRegistry,
+  sandbox: {
+    backend: sandboxBackend,
+    default_isolation: config.sandbox.default_isolation ?? 'container',
+    seccomp_profile: config.sandbox.disable_security
+      ? null
+      : sandboxBackend === 'docker' ? config.sandbox.seccomp_profile ?? null : config.sandbox.process_seccomp_profile ?? 'built-in',
+    apparmor_profile: config.sandbox.disable_security ? null : config.sandbox.apparmor_profile ?? null,
+    disable_security: config.sandbox.disable_security,
+    runtimes: {
+      gvisor: config.sandbox.gvisor_runtime ?? null,
+      microvm: config.sandbox.microvm_runtime ?? null,
+      wasm: config.sandbox.wasm.runtime ?? null
+    },
+    userns: config.sandbox.userns ?? null,
+    run_as: runAs ?? null
+  }
+});
+
+const batches = new BatchRunner({
+  orchestrator,
+  logger: logger.child({ component: 'batch' }),
+  concurrency: config.batch.concurrency,
+  maxSubmissions: config.batch.max_submissions
+});
+
+const apiSchema = new ApiSchema(loadApiSpec(config.server.openapi_spec_path), {
+  serverUrl: config.server.public_base_url,
+  languages: runnerRegistry.all().map((definition) => definition.language),
+  unknownFields: config.server.unknown_fields
 });
 
 const app = express();
+// First, so every line logged while handling a request carries its ID.
+app.use(logContextMiddleware({ allowDebug: config.logging.request_debug, logger: logger.child({ component: 'http' }) }));
 // Serve admin UI without Helmet so inline scripts work
 const __dirname = path.dirname(fileURLToPath(import.meta.url));
 
 // Determine admin UI directory with multiple fallback strategies
 let adminDir: string;
-if (process.env.ADMIN_UI_PATH) {
-  // Use explicit environment variable if set
-  adminDir = process.env.ADMIN_UI_PATH;
+if (config.server.admin_ui_path) {
+  // Use the configured path if set
+  adminDir = config.server.admin_ui_path;
 } else {
   // Try to intelligently find the admin UI directory
   // Check if we're in a Docker container (where workdir is /app)
@@ -91,10 +672,13 @@ app.use(cors({
   origin: true, // Allow all origins in development
   credentials: true,
   methods: ['GET', 'POST', 'PUT', 'DELETE', 'OPTIONS'],
-  allowedHeaders: ['Content-Type', 'Authorization']
+  allowedHeaders: ['Content-Type', 'Authorization', 'X-Request-Id', 'X-Log-Level'],
+  exposedHeaders: ['X-Request-Id']
 }));
 
 app.use(compression());
+// A batch carries many submissions, so it gets a larger body limit than single requests.
+app.use('/v1/batches', bodyParser.json({ limit: config.batch.max_body }));
 app.use(bodyParser.json({ limit: '1mb' }));
 
 // Static file serving and routes WITHOUT Helmet (to allow inline scripts in admin UI)
@@ -104,152 +688,8 @@ app.get('/', (_req, res) => {
   res.sendFile(path.join(adminDir, 'index.html'));
 });
 
-// Serve OpenAPI spec (no auth required for spec discovery)
-// This endpoint is used by Open-WebUI to discover available API endpoints and their schemas
-// Since we don't have a YAML parser installed, we return a pre-converted JSON version
-app.get('/openapi.json', (_req, res) => {
-  // Hardcoded OpenAPI spec in JSON format (converted from spec.yaml)
-  // Update the server URL to match the actual deployment
-  const baseUrl = process.env.PUBLIC_BASE_URL ?? 'http://localhost:8080';
-
-  const spec = {
-    openapi: '3.1.0',
-    info: {
-      title: 'Code Executor API',
-      version: '0.1.0',
-      description: 'Execute code in sandboxed environments'
-    },
-    servers: [
-      { url: baseUrl }
-    ],
-    paths: {
-      '/v1/health': {
-        get: {
-          operationId: 'health_check',
-          summary: 'Liveness and readiness probe',
-          tags: ['System'],
-          responses: {
-            '200': {
-              description: 'OK',
-              content: {
-                'application/json': {
-                  schema: {
-                    type: 'object',
-                    properties: {
-                      status: {
-                        type: 'string',
-                        example: 'ok'
-                      }
-                    }
-                  }
-                }
-              }
-            }
-          }
-        }
-      },
-      '/v1/runs': {
-        post: {
-          operationId: 'execute_code',
-          summary: 'Execute code in a sandbox',
-          description: 'Run code in an isolated environment with resource limits',
-          tags: ['Code Execution'],
-          security: [{ bearerAuth: [] }],
-          requestBody: {
-            required: true,
-            content: {
-              'application/json': {
-                schema: {
-                  type: 'object',
-                  required: ['language', 'code'],
-                  properties: {
-                    language: {
-                      type: 'string',
-                      enum: ['python', 'node', 'ruby', 'php'],
-                      description: 'Programming language to execute'
-                    },
-                    code: {
-                      type: 'string',
-                      maxLength: 204800,
-                      description: 'Code to execute'
-                    }
-                  }
-                }
-              }
-            }
-          },
-          responses: {
-            '200': {
-              description: 'Run completed successfully',
-              content: {
-                'application/json': {
-                  schema: {
-                    type: 'object',
-                    properties: {
-                      id: {
-                        type: 'string',
-                        description: 'Unique run identifier'
-                      },
-                      status: {
-                        type: 'string',
-                        enum: ['succeeded', 'failed', 'timeout', 'oom', 'killed'],
-                        description: 'Execution status'
-                      },
-                      stdout: {
-                        type: 'string',
-                        description: 'Standard output from the code'
-                      },
-                      stderr: {
-                        type: 'string',
-                        description: 'Standard error output'
-                      },
-                      exit_code: {
-                        type: 'integer',
-                        nullable: true,
-                        description: 'Process exit code'
-                      }
-                    }
-                  }
-                }
-              }
-            },
-            '400': {
-              description: 'Bad Request'
-            },
-            '401': {
-              description: 'Unauthorized'
-            },
-            '429': {
-              description: 'Rate Limited'
-            }
-          }
-        }
-      }
-    },
-    components: {
-      securitySchemes: {
-        bearerAuth: {
-          type: 'http',
-          scheme: 'bearer',
-          bearerFormat: 'token',
-          description: 'Bearer token authentication'
-        }
-      }
-    },
-    tags: [
-      {
-        name: 'Code Execution',
-        description: 'Execute code in sandboxed environments'
-      },
-      {
-        name: 'System',
-        description: 'System health and status'
-      }
-    ]
-  };
-
-  res.json(spec);
-});
+// Public, for spec discovery; the document is published once every route is registered below.
+registerOpenApiRoutes(app, { schema: apiSchema });
 
 // Add dummy /models endpoints for compatibility with OpenAI clients
 // Open-WebUI sometimes checks these endpoints when detecting API type
@@ -268,12 +708,80 @@ app.get('/v1/models', (_req, res) => {
   });
 });
 
-registerHealthRoutes(app);
+registerHealthRoutes(app, { isDraining: () => orchestrator.isDraining, readiness });
+// Public, so that verifying a result doesn't take an API key.
+registerSigningRoutes(app, { signer: resultSigner });
+if (metrics) {
+  // Scraped without a bearer token like the health check; keep the port off public networks.
+  registerMetricsRoutes(app, { registry: metrics.registry });
+}
 // Apply Helmet and auth only to API routes, not to static assets
 app.use('/v1', helmet());  // Security headers for API routes only
 app.use('/v1', authenticator.middleware());
-registerFileRoutes(app, { storage });
-registerRunRoutes(app, { orchestrator, runStore, limiter, tokenLimits: apiKeys });
+// Checks JSON bodies against the published document, after authentication so that callers
+// without a key learn nothing but that.
+app.use(apiSchema.middleware());
+// Workers serve only the health, readiness and metrics routes above.
+if (role !== 'worker') {
+  registerFileRoutes(app, { storage });
+  registerDatasetRoutes(app, { datasets });
+  registerRunRoutes(app, { orchestrator, runStore, authenticator, bundles, faultInjection: config.faults.enabled });
+  registerExecutionRoutes(app, {
+    orchestrator,
+    runStore,
+    authenticator,
+    webhooks,
+    retention,
+    adminToken: config.server.admin_token,
+    faultInjection: config.faults.enabled,
+    fingerprints: config.store.fingerprints
+  });
+  registerJudgeRoutes(app, { judge, authenticator });
+  registerBenchmarkRoutes(app, { benchmark, authenticator });
+  registerComparisonRoutes(app, { comparer, authenticator });
+  registerFuzzRoutes(app, { fuzzer, authenticator });
+  registerPipelineRoutes(app, { pipeline, authenticator });
+  registerBatchRoutes(app, { batches, authenticator });
+  registerApiKeyRoutes(app, { store: runStore, authenticator, adminToken: config.server.admin_token });
+  registerUsageRoutes(app, { runStore, authenticator, weights: costWeights, adminToken: config.server.admin_token });
+  if (scheduler) {
+    registerScheduleRoutes(app, { scheduler, authenticator, historyLimit: config.schedules.history });
+  }
+  if (images) {
+    registerImageRoutes(app, { images, adminToken: config.server.admin_token });
+  }
+  registerSettingsRoutes(app, {
+    registry: runnerRegistry,
+    settings: runtimeSettings,
+    probeVersion: dockerSandbox ? (language) => dockerSandbox.probeVersion(language) : undefined,
+    versions,
+    images,
+    adminToken: config.server.admin_token
+  });
+  registerQueueRoutes(app, { queue });
+  if (coordinator) {
+    registerWorkerRoutes(app, { coordinator });
+  }
+  if (buildCache) {
+    registerBuildCacheRoutes(app, { buildCache });
+  }
+  if (dockerSandbox) {
+    registerWarmPoolRoutes(app, { warmPool: dockerSandbox.warmPool });
+  }
+  registerRunnerRoutes(app, {
+    registry: runnerRegistry,
+    probeVersion: dockerSandbox ? (language) => dockerSandbox.probeVersion(language) : undefined,
+    versions,
+    images
+  });
+}
+
+// The admin UI and the compatibility stubs for OpenAI clients are not part of the API.
+const unlisted = ['/', '/models', '/v1/models'];
+const undocumented = apiSchema.publish(listRoutes(app).filter((route) => !unlisted.includes(route.path)));
+if (undocumented.length > 0) {
+  logger.warn('routes missing from the OpenAPI spec', { routes: undocumented.map((route) => `${route.method.toUpperCase()} ${route.path}`).join(', ') });
+}
 
 app.use((err: Boom.Boom | Error, _req: express.Request, res: express.Response, _next: express.NextFunction) => {
   if (!Boom.isBoom(err)) {
@@ -282,12 +790,101 @@ app.use((err: Boom.Boom | Error, _req: express.Request, res: express.Response, _
     return;
   }
   const boom = err as Boom.Boom;
+  // Carries Retry-After on rate-limit and queue rejections.
+  res.set(boom.output.headers);
   res.status(boom.output.statusCode).json({ error: boom.message, data: boom.data });
 });
 
-const port = Number(process.env.PORT ?? 8080);
-app.listen(port, () => {
+const port = config.server.port;
+const server = app.listen(port, () => {
   logger.info('api listening', { port: port.toString() });
 });
+if (role !== 'worker') {
+  registerSessionRoutes(server, { orchestrator, authenticator });
+}
+
+// The gRPC API is optional and only served when server.grpc_port is set.
+let grpcServer: grpc.Server | undefined;
+if (config.server.grpc_port) {
+  grpcServer = createGrpcServer({
+    protoPath: config.server.grpc_proto_path,
+    orchestrator,
+    batches,
+    authenticator,
+    logger: logger.child({ component: 'grpc' }),
+    requestDebug: config.logging.request_debug,
+    faultInjection: config.faults.enabled
+  });
+  grpcServer.bindAsync(`0.0.0.0:${config.server.grpc_port}`, grpc.ServerCredentials.createInsecure(), (err, boundPort) => {
+    if (err) {
+      logger.error('grpc server failed to start', { message: err.message });
+      return;
+    }
+    logger.info('grpc listening', { port: boundPort.toString() });
+  });
+}
+
+// Workers connect to the coordinator on cluster.port; the coordinator holds no other state for them.
+let workerServer: grpc.Server | undefined;
+if (coordinator) {
+  workerServer = createWorkerServer({
+    protoPath: config.server.grpc_proto_path,
+    coordinator,
+    token: config.cluster.token as string,
+    logger: logger.child({ component: 'workers' })
+  });
+  workerServer.bindAsync(`0.0.0.0:${config.cluster.port}`, grpc.ServerCredentials.createInsecure(), (err, boundPort) => {
+    if (err) {
+      logger.error('worker server failed to start', { message: err.message });
+      return;
+    }
+    logger.info('listening for workers', { port: boundPort.toString() });
+  });
+}
+const workerConnection = agent
+  ? connectWorker({
+    protoPath: config.server.grpc_proto_path,
+    address: config.cluster.coordinator as string,
+    token: config.cluster.token as string,
+    agent,
+    retryMs: config.cluster.reconnect_ms,
+    logger: logger.child({ component: 'worker' })
+  })
+  : undefined;
+
+// SIGTERM or SIGINT drains the server: no new connections or submissions, queued executions
+// handed back to the store, and in-flight ones given server.drain_timeout_ms to finish before
+// they are canceled. The process exits once everything is stored.
+let shuttingDown = false;
+const shutdown = async (signal: string) => {
+  if (shuttingDown) {
+    return;
+  }
+  shuttingDown = true;
+  logger.info('draining', { signal, timeoutMs: config.server.drain_timeout_ms });
+  server.close();
+  server.closeIdleConnections();
+  grpcServer?.tryShutdown(() => undefined);
+  janitor?.stop();
+  retention?.stop();
+  scheduler?.stop();
+  readiness?.stop();
+  try {
+    const outcome = await orchestrator.drain(config.server.drain_timeout_ms);
+    logger.info('drained', { ...outcome });
+    // Runs still out on workers were canceled by the drain; a worker's own are requeued by its coordinator.
+    workerConnection?.close();
+    coordinator?.stop();
+    workerServer?.tryShutdown(() => undefined);
+    egressProxy?.close();
+    await dockerSandbox?.warmPool.close();
+    await runStore.close();
+  } catch (err) {
+    logger.error('drain failed', { message: (err as Error).message });
+  }
+  process.exit(0);
+};
+process.once('SIGTERM', () => void shutdown('SIGTERM'));
+process.once('SIGINT', () => void shutdown('SIGINT'));
 
 export default app;
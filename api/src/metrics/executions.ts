@@ -0,0 +1,108 @@
+import type { BuildCache } from '../core/build_cache.js';
+import type { GpuPool } from '../core/gpu.js';
+import type { Janitor } from '../core/janitor.js';
+import type { JobQueue } from '../core/queue.js';
+import type { WarmPool, WarmSandbox } from '../core/warm_pool.js';
+import type { RunRecord } from '../core/types.js';
+import { MetricsRegistry } from './registry.js';
+import type { Counter, Histogram } from './registry.js';
+
+export interface ExecutionMetricsOptions {
+  queue?: JobQueue;
+  buildCache?: BuildCache;
+  warmPool?: WarmPool<WarmSandbox>;
+  janitor?: Janitor;
+  gpuPool?: GpuPool;
+}
+
+// The service's execution metrics. Durations are exported in seconds, as Prometheus expects.
+export class ExecutionMetrics {
+  private readonly executions: Counter;
+  private readonly compileDuration: Histogram;
+  private readonly runDuration: Histogram;
+  private readonly queueWait: Histogram;
+  private readonly sandboxStartup: Histogram;
+
+  constructor(public readonly registry: MetricsRegistry, options: ExecutionMetricsOptions = {}) {
+    this.executions = registry.counter('code_executor_executions_total', 'Finished runs by language and status.');
+    this.compileDuration = registry.histogram('code_executor_compile_duration_seconds', 'Time spent compiling, excluding cached builds.');
+    this.runDuration = registry.histogram('code_executor_run_duration_seconds', 'Wall-clock time of the program run phase.');
+    this.queueWait = registry.histogram('code_executor_queue_wait_seconds', 'Time runs waited for a free worker.');
+    this.sandboxStartup = registry.histogram(
+      'code_executor_sandbox_startup_seconds',
+      'Time a run spent in the sandbox outside its compile and run phases, mostly container or process start-up.'
+    );
+    const queue = options.queue;
+    if (queue) {
+      registry.collect('code_executor_queue_depth', 'Runs waiting for a worker.', 'gauge', () => [{ value: queue.stats().depth }]);
+      registry.collect('code_executor_queue_running', 'Runs currently executing.', 'gauge', () => [{ value: queue.stats().running }]);
+    }
+    const buildCache = options.buildCache;
+    if (buildCache) {
+      registry.collect('code_executor_build_cache_lookups_total', 'Build cache lookups by result.', 'counter', () => {
+        const stats = buildCache.stats();
+        return [
+          { labels: { result: 'hit' }, value: stats.hits },
+          { labels: { result: 'miss' }, value: stats.misses }
+        ];
+      });
+    }
+    const warmPool = options.warmPool;
+    if (warmPool) {
+      registry.collect('code_executor_warm_pool_leases_total', 'Warm sandbox requests by result.', 'counter', () => {
+        const stats = warmPool.stats();
+        return [
+          { labels: { result: 'hit' }, value: stats.hits },
+          { labels: { result: 'miss' }, value: stats.misses }
+        ];
+      });
+      registry.collect('code_executor_warm_pool_idle', 'Booted sandboxes waiting for a run.', 'gauge', () => [{ value: warmPool.stats().idle }]);
+    }
+    const gpuPool = options.gpuPool;
+    if (gpuPool && gpuPool.size > 0) {
+      registry.collect('code_executor_gpu_free_vram_bytes', 'GPU memory not reserved by a run, by device.', 'gauge', () =>
+        gpuPool.stats().map((device) => ({ labels: { device: device.id }, value: device.free_vram_mb * 1024 * 1024 }))
+      );
+      registry.collect('code_executor_gpu_runs', 'Runs holding each GPU.', 'gauge', () =>
+        gpuPool.stats().map((device) => ({ labels: { device: device.id }, value: device.runs }))
+      );
+    }
+    const janitor = options.janitor;
+    if (janitor) {
+      registry.collect('code_executor_janitor_removed_total', 'Orphaned sandbox state removed by the janitor, by kind.', 'counter', () => {
+        const { removed } = janitor.stats();
+        return [
+          { labels: { kind: 'workdir' }, value: removed.workdirs },
+          { labels: { kind: 'container' }, value: removed.containers },
+          { labels: { kind: 'cache_entry' }, value: removed.cache_entries }
+        ];
+      });
+      registry.collect('code_executor_janitor_reclaimed_bytes_total', 'Disk space the janitor reclaimed, by kind.', 'counter', () => {
+        const { reclaimed_bytes: reclaimed } = janitor.stats();
+        return [
+          { labels: { kind: 'workdir' }, value: reclaimed.workdirs },
+          { labels: { kind: 'cache' }, value: reclaimed.cache }
+        ];
+      });
+    }
+  }
+
+  // `sandboxMs` is how long the backend took to return, null for runs that never reached it.
+  public recordRun(run: RunRecord, sandboxMs: number | null) {
+    const language = run.language;
+    this.executions.inc({ language, status: run.status });
+    this.queueWait.observe({ language }, run.queue_wait_ms / 1000);
+    const compile = run.phases.compile;
+    const compileMs = compile && !compile.cached ? compile.duration_ms : 0;
+    if (compile && !compile.cached) {
+      this.compileDuration.observe({ language }, compileMs / 1000);
+    }
+    if (run.phases.run) {
+      this.runDuration.observe({ language }, run.phases.run.duration_ms / 1000);
+    }
+    if (sandboxMs !== null) {
+      const startupMs = Math.max(0, sandboxMs - compileMs - (run.phases.run?.duration_ms ?? 0));
+      this.sandboxStartup.observe({ language, isolation: run.isolation }, startupMs / 1000);
+    }
+  }
+}
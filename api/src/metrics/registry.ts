@@ -0,0 +1,133 @@
+// Minimal Prometheus instruments rendered in the text exposition format, enough for the
+// service's own metrics without pulling in a client library.
+
+export type Labels = Record<string, string>;
+
+interface Metric {
+  render(): string[];
+}
+
+// Default histogram buckets in seconds, from 5 ms up to the longest interactive sessions.
+export const DURATION_BUCKETS = [0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300];
+
+const NAME_PATTERN = /^[a-zA-Z_:][a-zA-Z0-9_:]*$/;
+
+export class Counter implements Metric {
+  private readonly values = new Map<string, { labels: Labels; value: number }>();
+
+  constructor(private readonly name: string, private readonly help: string) {}
+
+  public inc(labels: Labels = {}, value = 1) {
+    const key = labelKey(labels);
+    const entry = this.values.get(key) ?? { labels, value: 0 };
+    entry.value += value;
+    this.values.set(key, entry);
+  }
+
+  public render(): string[] {
+    return [
+      ...header(this.name, this.help, 'counter'),
+      ...[...this.values.values()].map((entry) => `${this.name}${formatLabels(entry.labels)} ${entry.value}`)
+    ];
+  }
+}
+
+export class Histogram implements Metric {
+  private readonly series = new Map<string, { labels: Labels; counts: number[]; sum: number; count: number }>();
+
+  constructor(private readonly name: string, private readonly help: string, private readonly buckets = DURATION_BUCKETS) {}
+
+  public observe(labels: Labels, value: number) {
+    const key = labelKey(labels);
+    const entry = this.series.get(key) ?? { labels, counts: this.buckets.map(() => 0), sum: 0, count: 0 };
+    this.buckets.forEach((bound, index) => {
+      if (value <= bound) {
+        entry.counts[index]++;
+      }
+    });
+    entry.sum += value;
+    entry.count++;
+    this.series.set(key, entry);
+  }
+
+  public render(): string[] {
+    const lines = header(this.name, this.help, 'histogram');
+    for (const entry of this.series.values()) {
+      this.buckets.forEach((bound, index) => {
+        lines.push(`${this.name}_bucket${formatLabels({ ...entry.labels, le: String(bound) })} ${entry.counts[index]}`);
+      });
+      lines.push(`${this.name}_bucket${formatLabels({ ...entry.labels, le: '+Inf' })} ${entry.count}`);
+      lines.push(`${this.name}_sum${formatLabels(entry.labels)} ${entry.sum}`);
+      lines.push(`${this.name}_count${formatLabels(entry.labels)} ${entry.count}`);
+    }
+    return lines;
+  }
+}
+
+// A value read from another component when the registry is scraped, e.g. the queue depth.
+export class CollectedMetric implements Metric {
+  constructor(
+    private readonly name: string,
+    private readonly help: string,
+    private readonly type: 'counter' | 'gauge',
+    private readonly collect: () => Array<{ labels?: Labels; value: number }>
+  ) {}
+
+  public render(): string[] {
+    return [
+      ...header(this.name, this.help, this.type),
+      ...this.collect().map((sample) => `${this.name}${formatLabels(sample.labels ?? {})} ${sample.value}`)
+    ];
+  }
+}
+
+export class MetricsRegistry {
+  private readonly metrics = new Map<string, Metric>();
+
+  public counter(name: string, help: string): Counter {
+    return this.register(name, new Counter(name, help));
+  }
+
+  public histogram(name: string, help: string, buckets?: number[]): Histogram {
+    return this.register(name, new Histogram(name, help, buckets));
+  }
+
+  public collect(
+    name: string,
+    help: string,
+    type: 'counter' | 'gauge',
+    collect: () => Array<{ labels?: Labels; value: number }>
+  ): CollectedMetric {
+    return this.register(name, new CollectedMetric(name, help, type, collect));
+  }
+
+  public render(): string {
+    return `${[...this.metrics.values()].flatMap((metric) => metric.render()).join('\n')}\n`;
+  }
+
+  private register<T extends Metric>(name: string, metric: T): T {
+    if (!NAME_PATTERN.test(name)) {
+      throw new Error(`invalid metric name: ${name}`);
+    }
+    if (this.metrics.has(name)) {
+      throw new Error(`metric already registered: ${name}`);
+    }
+    this.metrics.set(name, metric);
+    return metric;
+  }
+}
+
+function header(name: string, help: string, type: string): string[] {
+  return [`# HELP ${name} ${help.replace(/\\/g, '\\\\').replace(/\n/g, '\\n')}`, `# TYPE ${name} ${type}`];
+}
+
+function labelKey(labels: Labels): string {
+  return JSON.stringify(Object.keys(labels).sort().map((name) => [name, labels[name]]));
+}
+
+function formatLabels(labels: Labels): string {
+  const pairs = Object.entries(labels).map(
+    ([name, value]) => `${name}="${value.replace(/\\/g, '\\\\').replace(/"/g, '\\"').replace(/\n/g, '\\n')}"`
+  );
+  return pairs.length ? `{${pairs.join(',')}}` : '';
+}
@@ -0,0 +1,15 @@
+import crypto from 'node:crypto';
+import Boom from '@hapi/boom';
+import type { Request } from 'express';
+
+// Checks the bearer token of an /admin request against the configured admin token, in constant
+// time.
+export function adminGuard(adminToken: string) {
+  const expected = Buffer.from(`Bearer ${adminToken}`);
+  return (req: Request) => {
+    const presented = Buffer.from(req.headers['authorization'] ?? '');
+    if (presented.length !== expected.length || !crypto.timingSafeEqual(presented, expected)) {
+      throw Boom.unauthorized('invalid admin token');
+    }
+  };
+}
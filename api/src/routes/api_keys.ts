@@ -0,0 +1,113 @@
+import crypto from 'node:crypto';
+import Boom from '@hapi/boom';
+import type { Router } from 'express';
+import type { Authenticator } from '../core/auth.js';
+import { hashToken } from '../core/auth.js';
+import { adminGuard } from './admin.js';
+import type { ApiKeyRecord, ApiKeyStore } from '../store/store.js';
+
+export interface ApiKeyRouteDeps {
+  store: ApiKeyStore;
+  authenticator: Authenticator;
+  // Bearer token for /admin; the admin routes are not served when unset.
+  adminToken?: string;
+}
+
+interface CreateKeyBody {
+  label?: unknown;
+  rate_limit_rps?: unknown;
+  burst?: unknown;
+  monthly_executions?: unknown;
+  max_timeout_ms?: unknown;
+  max_memory_mb?: unknown;
+  tenant?: unknown;
+  max_concurrent?: unknown;
+}
+
+// Issues and revokes stored API keys under /admin, outside the /v1 key check, and lets any key
+// read its own usage at /v1/usage. A new key's token is only ever returned by the create call.
+export function registerApiKeyRoutes(router: Router, deps: ApiKeyRouteDeps) {
+  router.get('/v1/usage', (req, res, next) => {
+    try {
+      const apiKey = (req as typeof req & { apiKey?: string }).apiKey;
+      if (!apiKey) {
+        throw Boom.unauthorized('missing api key');
+      }
+      res.json(deps.authenticator.usageOf(apiKey));
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  const adminToken = deps.adminToken;
+  if (!adminToken) {
+    return;
+  }
+  const requireAdmin = adminGuard(adminToken);
+
+  router.get('/admin/api-keys', async (req, res, next) => {
+    try {
+      requireAdmin(req);
+      const keys = await deps.store.listApiKeys();
+      res.json({ keys: keys.map(({ token_sha256: _hash, ...key }) => key) });
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  router.post('/admin/api-keys', async (req, res, next) => {
+    try {
+      requireAdmin(req);
+      const body = (req.body ?? {}) as CreateKeyBody;
+      if (body.label !== undefined && (typeof body.label !== 'string' || !body.label)) {
+        throw Boom.badRequest('label must be a non-empty string');
+      }
+      if (body.tenant !== undefined && (typeof body.tenant !== 'string' || !body.tenant)) {
+        throw Boom.badRequest('tenant must be a non-empty string');
+      }
+      const token = `cx_${crypto.randomBytes(24).toString('base64url')}`;
+      const key: ApiKeyRecord = {
+        id: `key_${crypto.randomBytes(8).toString('hex')}`,
+        token_sha256: hashToken(token),
+        label: (body.label as string | undefined) ?? 'default',
+        rate_limit_rps: positive('rate_limit_rps', body.rate_limit_rps, false) ?? 5,
+        burst: positive('burst', body.burst) ?? 10,
+        monthly_executions: positive('monthly_executions', body.monthly_executions) ?? null,
+        max_timeout_ms: positive('max_timeout_ms', body.max_timeout_ms) ?? null,
+        max_memory_mb: positive('max_memory_mb', body.max_memory_mb) ?? null,
+        tenant: (body.tenant as string | undefined) ?? null,
+        max_concurrent: positive('max_concurrent', body.max_concurrent) ?? null,
+        created_at: new Date().toISOString()
+      };
+      await deps.store.saveApiKey(key);
+      await deps.authenticator.refresh();
+      const { token_sha256: _hash, ...created } = key;
+      res.status(201).json({ ...created, token });
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  router.delete('/admin/api-keys/:id', async (req, res, next) => {
+    try {
+      requireAdmin(req);
+      if (!(await deps.store.deleteApiKey(req.params.id))) {
+        throw Boom.notFound('api key not found');
+      }
+      await deps.authenticator.refresh();
+      res.status(204).end();
+    } catch (err) {
+      next(err);
+    }
+  });
+}
+
+function positive(name: string, value: unknown, integer = true): number | undefined {
+  if (value === undefined || value === null) {
+    return undefined;
+  }
+  if (typeof value !== 'number' || value <= 0 || (integer && !Number.isInteger(value))) {
+    throw Boom.badRequest(`${name} must be a positive ${integer ? 'integer' : 'number'}`);
+  }
+  return value;
+}
@@ -0,0 +1,25 @@
+import Boom from '@hapi/boom';
+import type { Router } from 'express';
+import type { Authenticator } from '../core/auth.js';
+import type { BatchRequest, BatchRunner } from '../core/batch.js';
+import { parseTraceparent } from '../tracing/tracer.js';
+
+export interface BatchRouteDeps {
+  batches: BatchRunner;
+  authenticator: Authenticator;
+}
+
+export function registerBatchRoutes(router: Router, deps: BatchRouteDeps) {
+  router.post('/v1/batches', async (req, res, next) => {
+    try {
+      const apiKey = (req as typeof req & { apiKey?: string }).apiKey;
+      if (!apiKey) {
+        throw Boom.unauthorized('missing api key');
+      }
+      deps.authenticator.throttle(apiKey);
+      res.json(await deps.batches.run(req.body as BatchRequest, apiKey, parseTraceparent(req.headers['traceparent'])));
+    } catch (err) {
+      next(err);
+    }
+  });
+}
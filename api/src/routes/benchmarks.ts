@@ -0,0 +1,25 @@
+import Boom from '@hapi/boom';
+import type { Router } from 'express';
+import type { Authenticator } from '../core/auth.js';
+import type { Benchmark, BenchmarkRequest } from '../core/benchmark.js';
+import { parseTraceparent } from '../tracing/tracer.js';
+
+export interface BenchmarkRouteDeps {
+  benchmark: Benchmark;
+  authenticator: Authenticator;
+}
+
+export function registerBenchmarkRoutes(router: Router, deps: BenchmarkRouteDeps) {
+  router.post('/v1/benchmarks', async (req, res, next) => {
+    try {
+      const apiKey = (req as typeof req & { apiKey?: string }).apiKey;
+      if (!apiKey) {
+        throw Boom.unauthorized('missing api key');
+      }
+      deps.authenticator.throttle(apiKey);
+      res.json(await deps.benchmark.benchmark(req.body as BenchmarkRequest, apiKey, parseTraceparent(req.headers['traceparent'])));
+    } catch (err) {
+      next(err);
+    }
+  });
+}
@@ -0,0 +1,8 @@
+import type { Router } from 'express';
+import type { BuildCache } from '../core/build_cache.js';
+
+export function registerBuildCacheRoutes(router: Router, deps: { buildCache: BuildCache }) {
+  router.get('/v1/build-cache', (_req, res) => {
+    res.json(deps.buildCache.stats());
+  });
+}
@@ -0,0 +1,25 @@
+import Boom from '@hapi/boom';
+import type { Router } from 'express';
+import type { Authenticator } from '../core/auth.js';
+import type { Comparer, ComparisonRequest } from '../core/compare.js';
+import { parseTraceparent } from '../tracing/tracer.js';
+
+export interface ComparisonRouteDeps {
+  comparer: Comparer;
+  authenticator: Authenticator;
+}
+
+export function registerComparisonRoutes(router: Router, deps: ComparisonRouteDeps) {
+  router.post('/v1/comparisons', async (req, res, next) => {
+    try {
+      const apiKey = (req as typeof req & { apiKey?: string }).apiKey;
+      if (!apiKey) {
+        throw Boom.unauthorized('missing api key');
+      }
+      deps.authenticator.throttle(apiKey);
+      res.json(await deps.comparer.compare(req.body as ComparisonRequest, apiKey, parseTraceparent(req.headers['traceparent'])));
+    } catch (err) {
+      next(err);
+    }
+  });
+}
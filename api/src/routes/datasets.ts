@@ -0,0 +1,63 @@
+import fs from 'node:fs';
+import Boom from '@hapi/boom';
+import type { Router } from 'express';
+import multer from 'multer';
+import type { DatasetStore } from '../core/datasets.js';
+
+export interface DatasetRouteDeps {
+  datasets: DatasetStore;
+}
+
+// Uploads named datasets once, as a multipart `file` archive with a `name` field, for runs to
+// mount by ID instead of carrying their fixtures in every submission.
+export function registerDatasetRoutes(router: Router, deps: DatasetRouteDeps) {
+  const upload = multer({ dest: deps.datasets.uploadDir, limits: { fileSize: deps.datasets.maxArchiveBytes, files: 1 } }).single('file');
+
+  router.post('/v1/datasets', (req, res, next) => {
+    upload(req, res, async (uploadErr: unknown) => {
+      try {
+        if (uploadErr instanceof multer.MulterError) {
+          throw uploadErr.code === 'LIMIT_FILE_SIZE'
+            ? Boom.entityTooLarge(`dataset archive exceeds ${deps.datasets.maxArchiveBytes} bytes`)
+            : Boom.badRequest(uploadErr.message);
+        }
+        if (uploadErr) {
+          throw uploadErr;
+        }
+        if (!req.file) {
+          throw Boom.badRequest('file is required');
+        }
+        const { dataset, created } = await deps.datasets.create(req.file.path, req.body?.name);
+        res.status(created ? 201 : 200).json(dataset);
+      } catch (err) {
+        next(err);
+      } finally {
+        if (req.file) {
+          fs.rm(req.file.path, { force: true }, () => undefined);
+        }
+      }
+    });
+  });
+
+  router.get('/v1/datasets', (_req, res) => {
+    res.json({ datasets: deps.datasets.list() });
+  });
+
+  router.get('/v1/datasets/:id', (req, res, next) => {
+    try {
+      res.json(deps.datasets.get(req.params.id));
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  // Runs already holding the dataset keep it until they finish.
+  router.delete('/v1/datasets/:id', (req, res, next) => {
+    try {
+      deps.datasets.delete(req.params.id);
+      res.status(204).end();
+    } catch (err) {
+      next(err);
+    }
+  });
+}
@@ -0,0 +1,429 @@
+import Boom from '@hapi/boom';
+import type { Request, Response, Router } from 'express';
+import type { Authenticator } from '../core/auth.js';
+import type { Orchestrator, StartedRun } from '../core/orchestrator.js';
+import type { ExecutionCursor, ExecutionFilter, ExecutionStore, ExecutionSummary } from '../store/store.js';
+import type { RetentionSweeper } from '../core/retention.js';
+import type { OutputStream, RunRequest } from '../core/types.js';
+import type { WebhookDispatcher } from '../core/webhooks.js';
+import { METADATA_KEY_PATTERN, withoutInlineContent } from '../store/store.js';
+import { parseIdempotencyKey } from '../core/idempotency.js';
+import { parseFaultHeader } from '../core/faults.js';
+import { parseTraceparent } from '../tracing/tracer.js';
+import { adminGuard } from './admin.js';
+
+export interface ExecutionRouteDeps {
+  orchestrator: Orchestrator;
+  runStore: ExecutionStore;
+  authenticator: Authenticator;
+  // Delivers results to submissions' callback_url; callbacks are refused when unset.
+  webhooks?: WebhookDispatcher;
+  // Archives executions past their retention period; nothing is archived when unset.
+  retention?: RetentionSweeper;
+  // Bearer token for /admin/executions, which lists every key's executions; not served when unset.
+  adminToken?: string;
+  // Whether X-Fault-Injection headers are honored; requests carrying one are refused otherwise.
+  faultInjection?: boolean;
+  // Whether the orchestrator saves submissions' fingerprints; /v1/executions/:id/similar is refused otherwise.
+  fingerprints?: boolean;
+}
+
+const DEFAULT_PAGE_SIZE = 50;
+const MAX_PAGE_SIZE = 200;
+const DEFAULT_SIMILARITY_THRESHOLD = 0.5;
+// What `status` filters on: how executions end, or `unfinished` for those still queued or running.
+const LISTED_STATUSES = ['succeeded', 'failed', 'timeout', 'oom', 'killed', 'canceled', 'error', 'unfinished'];
+
+// Asynchronous counterpart to /v1/runs: submissions return immediately with an id that can be
+// polled for the result, canceled while the run is still in flight, or have the result posted to
+// a callback URL once it finishes.
+export function registerExecutionRoutes(router: Router, deps: ExecutionRouteDeps) {
+  router.post('/v1/executions', async (req, res, next) => {
+    try {
+      const apiKey = (req as typeof req & { apiKey?: string }).apiKey;
+      if (!apiKey) {
+        throw Boom.unauthorized('missing api key');
+      }
+      const {
+        callback_url: callbackUrl,
+        idempotency_key: idempotencyField,
+        ...request
+      } = req.body as RunRequest & { callback_url?: unknown; idempotency_key?: unknown };
+      if (callbackUrl !== undefined && !deps.webhooks) {
+        throw Boom.badRequest('callback_url is not enabled on this server');
+      }
+      const callback = callbackUrl === undefined ? null : deps.webhooks!.validateUrl(callbackUrl);
+      const idempotencyKey = parseIdempotencyKey(req.headers['idempotency-key'], idempotencyField);
+      const faults = parseFaultHeader(req.headers['x-fault-injection'], deps.faultInjection ?? false);
+      deps.authenticator.throttle(apiKey);
+      // A retry answers with where the original execution stands; its callback is not repeated.
+      const match = idempotencyKey ? await deps.orchestrator.findIdempotent(apiKey, idempotencyKey, request) : null;
+      if (match) {
+        // Submissions stored without a state yet are running on another instance.
+        const existing = (await describeExecution(deps, match.id)) ?? { id: match.id, status: 'running' };
+        const finished = existing.status !== 'queued' && existing.status !== 'running';
+        res.setHeader('Idempotent-Replayed', 'true');
+        res.status(finished ? 200 : 202).location(`/v1/executions/${match.id}`).json(existing);
+        return;
+      }
+      const started = deps.orchestrator.startRun(request, apiKey, {
+        traceParent: parseTraceparent(req.headers['traceparent']),
+        idempotencyKey,
+        faults,
+        // The callback URL is not stored, so another server could not deliver it.
+        keepOnDrain: Boolean(callback)
+      });
+      if (started.replayed) {
+        res.setHeader('Idempotent-Replayed', 'true');
+      }
+      // The orchestrator stores the outcome, including errors; only a callback awaits it.
+      if (callback && !started.replayed) {
+        void notifyWhenFinished(deps.webhooks!, callback, started, request.metadata ?? {});
+      } else {
+        started.done.catch(() => undefined);
+      }
+      const active = deps.orchestrator.getActiveRun(started.id);
+      res.status(202).location(`/v1/executions/${started.id}`).json({
+        id: started.id,
+        status: active?.state ?? 'running',
+        language: active?.language ?? request.language,
+        created_at: active?.created_at ?? new Date().toISOString()
+      });
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  // The caller's executions, asynchronous and not, newest first, narrowed by the query's filters.
+  // `next_cursor` fetches the page after this one with the same filters and is null on the last.
+  router.get('/v1/executions', async (req, res, next) => {
+    try {
+      const apiKey = (req as typeof req & { apiKey?: string }).apiKey;
+      if (!apiKey) {
+        throw Boom.unauthorized('missing api key');
+      }
+      if (req.query['tenant'] !== undefined) {
+        throw Boom.badRequest('tenant can only be filtered on through /admin/executions');
+      }
+      res.json(await listPage(deps, req, { ...parseFilter(req), api_key: apiKey }));
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  // Every key's executions, for support and dashboards across tenants; also filters by `tenant`.
+  const adminToken = deps.adminToken;
+  if (adminToken) {
+    const requireAdmin = adminGuard(adminToken);
+    router.get('/admin/executions', async (req, res, next) => {
+      try {
+        requireAdmin(req);
+        const tenant = req.query['tenant'];
+        if (tenant !== undefined && typeof tenant !== 'string') {
+          throw Boom.badRequest('tenant must be given once');
+        }
+        res.json(await listPage(deps, req, { ...parseFilter(req), tenant }));
+      } catch (err) {
+        next(err);
+      }
+    });
+  }
+
+  router.get('/v1/executions/:id', async (req, res, next) => {
+    try {
+      const execution = await describeExecution(deps, req.params.id);
+      if (!execution) {
+        if (await deps.retention?.isArchived(req.params.id)) {
+          throw Boom.notFound('execution is archived', { code: 'archived', restore: `/v1/executions/${req.params.id}/restore` });
+        }
+        throw Boom.notFound('execution not found');
+      }
+      res.json(execution);
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  // Brings an archived execution back into the store, for GET /v1/executions/:id and
+  // /v1/runs/:id to find again until its retention period has passed once more. One that was
+  // never archived, or already restored, is returned as it is.
+  router.post('/v1/executions/:id/restore', async (req, res, next) => {
+    try {
+      if (!deps.retention) {
+        throw Boom.badRequest('retention is not enabled on this server');
+      }
+      await deps.retention.restore(req.params.id);
+      const execution = await describeExecution(deps, req.params.id);
+      if (!execution) {
+        throw Boom.notFound('execution not found');
+      }
+      res.json(execution);
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  // The audit trail, for runs submitted through /v1/runs as well; it grows while the execution is
+  // in flight, so a stuck one shows the last step it reached.
+  router.get('/v1/executions/:id/events', async (req, res, next) => {
+    try {
+      const events = await deps.runStore.listEvents(req.params.id);
+      if (events.length === 0) {
+        throw Boom.notFound('execution not found');
+      }
+      res.json({ id: req.params.id, events });
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  // The caller's other submissions whose sources resemble this execution's, most similar first: a
+  // building block for plagiarism checks and for spotting resubmissions of the same code. Matches
+  // are of the same language unless `language` says otherwise, at least `threshold` similar
+  // (shared fingerprint hashes over those of either, 0.5 unless set), and narrowed by the same
+  // filters as the listing; `created_before` keeps to submissions made before a deadline.
+  router.get('/v1/executions/:id/similar', async (req, res, next) => {
+    try {
+      const apiKey = (req as typeof req & { apiKey?: string }).apiKey;
+      if (!apiKey) {
+        throw Boom.unauthorized('missing api key');
+      }
+      if (!deps.fingerprints) {
+        throw Boom.badRequest('fingerprints are not enabled on this server');
+      }
+      const submission = await deps.runStore.getSubmission(req.params.id);
+      if (!submission || submission.api_key !== apiKey) {
+        throw Boom.notFound('execution not found');
+      }
+      const threshold = parseThreshold(req.query['threshold']);
+      const limit = parsePageSize(req.query['limit']);
+      const filter = parseFilter(req);
+      // Submissions too short to fingerprint, or made before fingerprints were kept, have none.
+      const hashes = await deps.runStore.getFingerprint(submission.id);
+      const matches = hashes.length === 0 ? [] : await deps.runStore.findSimilar({
+        hashes,
+        threshold,
+        exclude_id: submission.id,
+        filter: { ...filter, language: filter.language ?? submission.language, api_key: apiKey }
+      }, limit);
+      res.json({
+        id: submission.id,
+        fingerprint_size: hashes.length,
+        threshold,
+        matches: matches.map((match) => listedExecution(deps, match))
+      });
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  // Server-sent events following an execution, for progress displays that would otherwise poll:
+  // `status` with its state when the stream opens and at every change (queued, compiling,
+  // running), `stdout`/`stderr` with the output produced from then on, `memory` when the run
+  // passes one of the deployment's memory thresholds, `usage` with each sample of a run that set
+  // usage_interval_ms and a final `result` or `error`, as a streamed /v1/runs ends. A finished
+  // execution gets its final event at once.
+  router.get('/v1/executions/:id/stream', async (req, res, next) => {
+    try {
+      const send = eventSender(res);
+      const watched = deps.orchestrator.watchRun(req.params.id, {
+        onState: (status) => send('status', { status }),
+        onOutput: (stream: OutputStream, chunk: Buffer) => send(stream, { data: chunk.toString('utf8') }),
+        onMemory: (warning) => send('memory', warning),
+        onUsage: (sample) => send('usage', sample)
+      });
+      if (!watched) {
+        const run = await deps.runStore.get(req.params.id);
+        const error = run ? null : await deps.runStore.getError(req.params.id);
+        if (!run && !error) {
+          throw Boom.notFound('execution not found');
+        }
+        if (run) {
+          send('result', run);
+        } else {
+          send('error', { error });
+        }
+        res.end();
+        return;
+      }
+      res.on('close', watched.stop);
+      send('status', { status: watched.state });
+      try {
+        send('result', withoutInlineContent(await watched.done));
+      } catch (err) {
+        send('error', { error: Boom.isBoom(err) ? err.message : 'internal_error' });
+      }
+      watched.stop();
+      res.end();
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  router.delete('/v1/executions/:id', async (req, res, next) => {
+    try {
+      const apiKey = (req as typeof req & { apiKey?: string }).apiKey;
+      const active = deps.orchestrator.getActiveRun(req.params.id);
+      if (!active || active.apiKey !== apiKey) {
+        if (await deps.runStore.get(req.params.id)) {
+          throw Boom.conflict('execution already finished');
+        }
+        throw Boom.notFound('execution not found');
+      }
+      deps.orchestrator.cancelRun(active.id);
+      res.status(202).json({ id: active.id, status: 'canceling' });
+    } catch (err) {
+      next(err);
+    }
+  });
+}
+
+// The run record once finished, the run's state while in flight, or the error that ended it.
+async function describeExecution(deps: ExecutionRouteDeps, id: string) {
+  const run = await deps.runStore.get(id);
+  if (run) {
+    return run;
+  }
+  const active = deps.orchestrator.getActiveRun(id);
+  if (active) {
+    return { id: active.id, status: active.state, language: active.language, created_at: active.created_at };
+  }
+  const error = await deps.runStore.getError(id);
+  if (error) {
+    return { id, status: 'error', error };
+  }
+  return null;
+}
+
+// Stored states as GET /v1/executions/:id reports them; a pending execution not running here is
+// running on another instance.
+function listedExecution<T extends ExecutionSummary>(deps: ExecutionRouteDeps, execution: T) {
+  const active = deps.orchestrator.getActiveRun(execution.id);
+  const status = execution.status === 'pending'
+    ? (active?.state ?? 'running')
+    : execution.status === 'requeued' ? 'queued' : execution.status;
+  return { ...execution, status };
+}
+
+async function listPage(deps: ExecutionRouteDeps, req: Request, filter: ExecutionFilter) {
+  const limit = parsePageSize(req.query['limit']);
+  const after = parseCursor(req.query['cursor']);
+  // One more than asked for tells whether there is a next page.
+  const page = await deps.runStore.listExecutions(filter, limit + 1, after);
+  const executions = page.slice(0, limit).map((execution) => listedExecution(deps, execution));
+  const last = page.length > limit ? page[limit - 1] : null;
+  return { executions, next_cursor: last ? encodeCursor(last) : null };
+}
+
+// `language`, `tag`, `status` (a comma-separated list of LISTED_STATUSES) and the ISO 8601 times
+// `created_after` (inclusive) and `created_before`.
+function parseFilter(req: Request): ExecutionFilter {
+  const single = (name: string) => {
+    const value = req.query[name];
+    if (value !== undefined && (typeof value !== 'string' || value === '')) {
+      throw Boom.badRequest(`${name} must be given once and not be empty`);
+    }
+    return value;
+  };
+  const time = (name: string) => {
+    const value = single(name);
+    if (value !== undefined && !Number.isFinite(Date.parse(value))) {
+      throw Boom.badRequest(`${name} must be an ISO 8601 time`);
+    }
+    return value === undefined ? undefined : new Date(value).toISOString();
+  };
+  const status = single('status');
+  const statuses = status?.split(',').flatMap((value) => {
+    if (!LISTED_STATUSES.includes(value)) {
+      throw Boom.badRequest(`status must be a comma-separated list of ${LISTED_STATUSES.join(', ')}`);
+    }
+    // Unfinished executions are stored as pending, or requeued while handed back.
+    return value === 'unfinished' ? ['pending', 'requeued'] : [value];
+  });
+  // `metadata.<key>=<value>`, any number of keys.
+  const metadata: Record<string, string> = {};
+  for (const name of Object.keys(req.query).filter((name) => name.startsWith('metadata.'))) {
+    const key = name.slice('metadata.'.length);
+    if (!METADATA_KEY_PATTERN.test(key)) {
+      throw Boom.badRequest(`invalid metadata key: ${key}`);
+    }
+    metadata[key] = single(name)!;
+  }
+  return {
+    language: single('language'),
+    tag: single('tag'),
+    statuses,
+    created_after: time('created_after'),
+    created_before: time('created_before'),
+    metadata: Object.keys(metadata).length > 0 ? metadata : undefined
+  };
+}
+
+function parsePageSize(value: unknown): number {
+  if (value === undefined) {
+    return DEFAULT_PAGE_SIZE;
+  }
+  const limit = typeof value === 'string' && /^\d+$/.test(value) ? Number(value) : NaN;
+  if (!(limit >= 1 && limit <= MAX_PAGE_SIZE)) {
+    throw Boom.badRequest(`limit must be an integer from 1 to ${MAX_PAGE_SIZE}`);
+  }
+  return limit;
+}
+
+function parseThreshold(value: unknown): number {
+  if (value === undefined) {
+    return DEFAULT_SIMILARITY_THRESHOLD;
+  }
+  const threshold = typeof value === 'string' && value.trim() !== '' ? Number(value) : NaN;
+  if (!(threshold >= 0 && threshold <= 1)) {
+    throw Boom.badRequest('threshold must be a number from 0 to 1');
+  }
+  return threshold;
+}
+
+// Cursors are opaque to clients: the last listed execution's creation time and id.
+function encodeCursor(execution: ExecutionCursor): string {
+  return Buffer.from(JSON.stringify([execution.created_at, execution.id])).toString('base64url');
+}
+
+function parseCursor(value: unknown): ExecutionCursor | undefined {
+  if (value === undefined) {
+    return undefined;
+  }
+  try {
+    const [createdAt, id] = JSON.parse(Buffer.from(String(value), 'base64url').toString('utf8')) as unknown[];
+    if (typeof createdAt === 'string' && typeof id === 'string' && Number.isFinite(Date.parse(createdAt))) {
+      return { created_at: createdAt, id };
+    }
+  } catch {
+    // Reported below.
+  }
+  throw Boom.badRequest('cursor must be a next_cursor from an earlier page');
+}
+
+// Writes server-sent events, sending the headers with the first one so earlier errors still go out
+// as regular JSON responses.
+function eventSender(res: Response) {
+  return (event: string, data: unknown) => {
+    if (!res.headersSent) {
+      res.status(200);
+      res.setHeader('Content-Type', 'text/event-stream');
+      res.setHeader('Cache-Control', 'no-cache');
+      res.setHeader('Connection', 'keep-alive');
+      res.flushHeaders();
+    }
+    res.write(`event: ${event}\ndata: ${JSON.stringify(data)}\n\n`);
+  };
+}
+
+// Posts the finished run, or the error that ended it, in the same shape GET /v1/executions/:id
+// returns; errors also carry the request's metadata so that receivers can tell what they are about.
+async function notifyWhenFinished(webhooks: WebhookDispatcher, url: string, started: StartedRun, metadata: Record<string, string>) {
+  try {
+    const run = await started.done;
+    await webhooks.deliver(url, { type: 'execution.completed', id: run.id, data: withoutInlineContent(run) });
+  } catch (err) {
+    const error = Boom.isBoom(err) ? err.message : 'internal_error';
+    await webhooks.deliver(url, { type: 'execution.failed', id: started.id, data: { id: started.id, status: 'error', error, metadata } });
+  }
+}
@@ -0,0 +1,25 @@
+import Boom from '@hapi/boom';
+import type { Router } from 'express';
+import type { Authenticator } from '../core/auth.js';
+import type { Fuzzer, FuzzRequest } from '../core/fuzz.js';
+import { parseTraceparent } from '../tracing/tracer.js';
+
+export interface FuzzRouteDeps {
+  fuzzer: Fuzzer;
+  authenticator: Authenticator;
+}
+
+export function registerFuzzRoutes(router: Router, deps: FuzzRouteDeps) {
+  router.post('/v1/fuzz', async (req, res, next) => {
+    try {
+      const apiKey = (req as typeof req & { apiKey?: string }).apiKey;
+      if (!apiKey) {
+        throw Boom.unauthorized('missing api key');
+      }
+      deps.authenticator.throttle(apiKey);
+      res.json(await deps.fuzzer.fuzz(req.body as FuzzRequest, apiKey, parseTraceparent(req.headers['traceparent'])));
+    } catch (err) {
+      next(err);
+    }
+  });
+}
@@ -1,7 +1,36 @@
 import type { Router } from 'express';
+import type { ReadinessProbe } from '../core/readiness.js';
+
+export interface HealthRouteDeps {
+  isDraining?: () => boolean;
+  // Runner probes behind /readyz; without one the node is ready whenever it isn't draining.
+  readiness?: ReadinessProbe;
+}
+
+// A draining server reports 503 so load balancers stop sending it work. /healthz only says the
+// process is up, for liveness checks that restart it; /readyz also needs every runner's probe to
+// have passed, so traffic isn't routed to a node missing a compiler.
+export function registerHealthRoutes(router: Router, deps: HealthRouteDeps = {}) {
+  const isDraining = deps.isDraining ?? (() => false);
 
-export function registerHealthRoutes(router: Router) {
   router.get('/v1/health', (_req, res) => {
+    if (isDraining()) {
+      res.status(503).json({ status: 'draining' });
+      return;
+    }
+    res.json({ status: 'ok' });
+  });
+
+  router.get('/healthz', (_req, res) => {
     res.json({ status: 'ok' });
   });
+
+  router.get('/readyz', (_req, res) => {
+    const report = deps.readiness?.report() ?? { ready: true, runners: {} };
+    if (isDraining()) {
+      res.status(503).json({ status: 'draining', runners: report.runners });
+      return;
+    }
+    res.status(report.ready ? 200 : 503).json({ status: report.ready ? 'ready' : 'not_ready', runners: report.runners });
+  });
 }
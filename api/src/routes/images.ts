@@ -0,0 +1,74 @@
+import Boom from '@hapi/boom';
+import type { Request, Router } from 'express';
+import type { ImageManager } from '../core/images.js';
+import { adminGuard } from './admin.js';
+
+export interface ImageRouteDeps {
+  images: ImageManager;
+  // Bearer token for /admin; the routes are not served when unset.
+  adminToken?: string;
+}
+
+// Lists the runner images under /admin and points a language, or one of its versions, at a new
+// image, which is pulled and pinned before the call returns.
+export function registerImageRoutes(router: Router, deps: ImageRouteDeps) {
+  const adminToken = deps.adminToken;
+  if (!adminToken) {
+    return;
+  }
+  const requireAdmin = adminGuard(adminToken);
+
+  router.get('/admin/images', (req, res, next) => {
+    try {
+      requireAdmin(req);
+      res.json({ images: deps.images.list() });
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  const update = async (req: Request, version: string | null) => {
+    requireAdmin(req);
+    const image = (req.body ?? {}).image as unknown;
+    if (typeof image !== 'string' || !image) {
+      throw Boom.badRequest('image must be a non-empty string');
+    }
+    return deps.images.set(req.params.language, version, image);
+  };
+
+  router.put('/admin/images/:language', async (req, res, next) => {
+    try {
+      res.json(await update(req, null));
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  router.put('/admin/images/:language/:version', async (req, res, next) => {
+    try {
+      res.json(await update(req, req.params.version));
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  router.delete('/admin/images/:language/:version', async (req, res, next) => {
+    try {
+      requireAdmin(req);
+      await deps.images.remove(req.params.language, req.params.version);
+      res.status(204).end();
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  // Removes replaced images straight away instead of at the next update or restart.
+  router.post('/admin/images/gc', async (req, res, next) => {
+    try {
+      requireAdmin(req);
+      res.json(await deps.images.collect());
+    } catch (err) {
+      next(err);
+    }
+  });
+}
@@ -0,0 +1,25 @@
+import Boom from '@hapi/boom';
+import type { Router } from 'express';
+import type { Authenticator } from '../core/auth.js';
+import type { Judge, JudgeRequest } from '../core/judge.js';
+import { parseTraceparent } from '../tracing/tracer.js';
+
+export interface JudgeRouteDeps {
+  judge: Judge;
+  authenticator: Authenticator;
+}
+
+export function registerJudgeRoutes(router: Router, deps: JudgeRouteDeps) {
+  router.post('/v1/judge', async (req, res, next) => {
+    try {
+      const apiKey = (req as typeof req & { apiKey?: string }).apiKey;
+      if (!apiKey) {
+        throw Boom.unauthorized('missing api key');
+      }
+      deps.authenticator.throttle(apiKey);
+      res.json(await deps.judge.judge(req.body as JudgeRequest, apiKey, parseTraceparent(req.headers['traceparent'])));
+    } catch (err) {
+      next(err);
+    }
+  });
+}
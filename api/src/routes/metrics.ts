@@ -0,0 +1,8 @@
+import type { Router } from 'express';
+import type { MetricsRegistry } from '../metrics/registry.js';
+
+export function registerMetricsRoutes(router: Router, deps: { registry: MetricsRegistry }) {
+  router.get('/metrics', (_req, res) => {
+    res.type('text/plain; version=0.0.4').send(deps.registry.render());
+  });
+}
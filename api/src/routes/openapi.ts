@@ -0,0 +1,13 @@
+import type { Router } from 'express';
+import type { ApiSchema } from '../core/openapi.js';
+
+export interface OpenApiRouteDeps {
+  schema: ApiSchema;
+}
+
+// The OpenAPI document of this server, for client generators and tool discovery (Open-WebUI).
+export function registerOpenApiRoutes(router: Router, deps: OpenApiRouteDeps) {
+  router.get('/openapi.json', (_req, res) => {
+    res.json(deps.schema.document());
+  });
+}
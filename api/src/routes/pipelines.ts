@@ -0,0 +1,25 @@
+import Boom from '@hapi/boom';
+import type { Router } from 'express';
+import type { Authenticator } from '../core/auth.js';
+import type { Pipeline, PipelineRequest } from '../core/pipeline.js';
+import { parseTraceparent } from '../tracing/tracer.js';
+
+export interface PipelineRouteDeps {
+  pipeline: Pipeline;
+  authenticator: Authenticator;
+}
+
+export function registerPipelineRoutes(router: Router, deps: PipelineRouteDeps) {
+  router.post('/v1/pipelines', async (req, res, next) => {
+    try {
+      const apiKey = (req as typeof req & { apiKey?: string }).apiKey;
+      if (!apiKey) {
+        throw Boom.unauthorized('missing api key');
+      }
+      deps.authenticator.throttle(apiKey);
+      res.json(await deps.pipeline.run(req.body as PipelineRequest, apiKey, parseTraceparent(req.headers['traceparent'])));
+    } catch (err) {
+      next(err);
+    }
+  });
+}
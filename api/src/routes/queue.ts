@@ -0,0 +1,8 @@
+import type { Router } from 'express';
+import type { JobQueue } from '../core/queue.js';
+
+export function registerQueueRoutes(router: Router, deps: { queue: JobQueue }) {
+  router.get('/v1/queue', (_req, res) => {
+    res.json(deps.queue.stats());
+  });
+}
@@ -0,0 +1,37 @@
+import type { Router } from 'express';
+import type { RunnerDefinition, RunnerRegistry } from '../core/runners.js';
+import type { VersionManager } from '../core/versions.js';
+import type { ImageManager } from '../core/images.js';
+
+export interface RunnerRouteDeps {
+  registry: RunnerRegistry;
+  probeVersion?: (language: string) => Promise<string | null>;
+  versions?: VersionManager;
+  images?: ImageManager;
+}
+
+export function registerRunnerRoutes(router: Router, deps: RunnerRouteDeps) {
+  router.get('/v1/runners', async (_req, res, next) => {
+    try {
+      const runners = await Promise.all(deps.registry.list().map((runner) => describeRunner(runner, deps)));
+      res.json({ runners });
+    } catch (err) {
+      next(err);
+    }
+  });
+}
+
+// A runner as /v1/runners lists it, with its toolchain version and the others installed.
+export async function describeRunner(runner: RunnerDefinition, deps: Omit<RunnerRouteDeps, 'registry'>) {
+  return {
+    language: runner.language,
+    extensions: runner.extensions,
+    entry_file: runner.entryFile,
+    // What `reproducible` can fix for the language.
+    reproducible: runner.reproducible ?? [],
+    version: deps.probeVersion ? await deps.probeVersion(runner.language) : null,
+    versions: [
+      ...new Set([...(deps.versions ? await deps.versions.available(runner) : []), ...(deps.images?.versions(runner.language) ?? [])])
+    ].sort()
+  };
+}
@@ -1,15 +1,21 @@
 import Boom from '@hapi/boom';
-import type { Router } from 'express';
-import type { Orchestrator } from '../core/orchestrator.js';
-import type { RunStore } from '../core/run_store.js';
-import type { TokenBucketLimiter } from '../core/rate_limit.js';
-import type { RunRequest } from '../core/types.js';
+import type { Response, Router } from 'express';
+import type { Authenticator } from '../core/auth.js';
+import type { BundleExporter } from '../core/bundle.js';
+import type { CreateRunOptions, Orchestrator } from '../core/orchestrator.js';
+import { parseIdempotencyKey } from '../core/idempotency.js';
+import { parseFaultHeader } from '../core/faults.js';
+import type { ExecutionStore } from '../store/store.js';
+import type { OutputStream, RunRequest } from '../core/types.js';
+import { parseTraceparent } from '../tracing/tracer.js';
 
 export interface RunRouteDeps {
   orchestrator: Orchestrator;
-  runStore: RunStore;
-  limiter: TokenBucketLimiter;
-  tokenLimits: Record<string, { rateLimitRps: number; burst: number; label?: string }>;
+  runStore: ExecutionStore;
+  authenticator: Authenticator;
+  bundles: BundleExporter;
+  // Whether X-Fault-Injection headers are honored; requests carrying one are refused otherwise.
+  faultInjection?: boolean;
 }
 
 export function registerRunRoutes(router: Router, deps: RunRouteDeps) {
@@ -19,19 +25,31 @@ export function registerRunRoutes(router: Router, deps: RunRouteDeps) {
       if (!apiKey) {
         throw Boom.unauthorized('missing api key');
       }
-      const tokenConfig = deps.tokenLimits[apiKey];
-      deps.limiter.check(apiKey, tokenConfig?.rateLimitRps, tokenConfig?.burst);
-      const run = await deps.orchestrator.createRun(req.body as RunRequest, apiKey);
-      deps.runStore.save(run);
-      res.json(run);
+      const { idempotency_key: idempotencyField, ...request } = req.body as RunRequest & { idempotency_key?: unknown };
+      const idempotencyKey = parseIdempotencyKey(req.headers['idempotency-key'], idempotencyField);
+      deps.authenticator.throttle(apiKey);
+      // Retries get the original run's record, as JSON even when streaming was asked for.
+      const match = idempotencyKey ? await deps.orchestrator.findIdempotent(apiKey, idempotencyKey, request) : null;
+      if (match) {
+        res.setHeader('Idempotent-Replayed', 'true');
+        res.json(await deps.orchestrator.replayRun(match));
+        return;
+      }
+      const traceParent = parseTraceparent(req.headers['traceparent']);
+      const faults = parseFaultHeader(req.headers['x-fault-injection'], deps.faultInjection ?? false);
+      if (req.query['stream'] === 'true') {
+        await streamRun(request, apiKey, { traceParent, idempotencyKey, faults }, deps, res);
+        return;
+      }
+      res.json(await deps.orchestrator.createRun(request, apiKey, { traceParent, idempotencyKey, faults }));
     } catch (err) {
       next(err);
     }
   });
 
-  router.get('/v1/runs/:id', (req, res, next) => {
+  router.get('/v1/runs/:id', async (req, res, next) => {
     try {
-      const run = deps.runStore.get(req.params.id);
+      const run = await deps.runStore.get(req.params.id);
       if (!run) {
         throw Boom.notFound('run not found');
       }
@@ -40,4 +58,55 @@ export function registerRunRoutes(router: Router, deps: RunRouteDeps) {
       next(err);
     }
   });
+
+  // A tarball for `codexec replay`, for runs and asynchronous executions alike.
+  router.get('/v1/runs/:id/bundle', async (req, res, next) => {
+    try {
+      const apiKey = (req as typeof req & { apiKey?: string }).apiKey;
+      if (!apiKey) {
+        throw Boom.unauthorized('missing api key');
+      }
+      const bundle = await deps.bundles.export(req.params.id, apiKey);
+      res.setHeader('Content-Type', 'application/gzip');
+      res.setHeader('Content-Disposition', `attachment; filename="${req.params.id}.tar.gz"`);
+      res.send(bundle);
+    } catch (err) {
+      next(err);
+    }
+  });
+}
+
+// Streams output as server-sent events: `stdout`/`stderr` events carry chunks as they are
+// produced and a final `result` event carries the run record. Headers are only sent once the
+// first event is ready so validation failures still surface as regular JSON errors.
+async function streamRun(
+  request: RunRequest,
+  apiKey: string,
+  options: Pick<CreateRunOptions, 'traceParent' | 'idempotencyKey' | 'faults'>,
+  deps: RunRouteDeps,
+  res: Response
+) {
+  const send = (event: string, data: unknown) => {
+    if (!res.headersSent) {
+      res.status(200);
+      res.setHeader('Content-Type', 'text/event-stream');
+      res.setHeader('Cache-Control', 'no-cache');
+      res.setHeader('Connection', 'keep-alive');
+      res.flushHeaders();
+    }
+    res.write(`event: ${event}\ndata: ${JSON.stringify(data)}\n\n`);
+  };
+  try {
+    const run = await deps.orchestrator.createRun(request, apiKey, {
+      onOutput: (stream: OutputStream, chunk: Buffer) => send(stream, { data: chunk.toString('utf8') }),
+      ...options
+    });
+    send('result', run);
+  } catch (err) {
+    if (!res.headersSent) {
+      throw err;
+    }
+    send('error', { error: Boom.isBoom(err) ? err.message : 'internal_error' });
+  }
+  res.end();
 }
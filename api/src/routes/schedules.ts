@@ -0,0 +1,97 @@
+import Boom from '@hapi/boom';
+import type { Request, Router } from 'express';
+import type { Authenticator } from '../core/auth.js';
+import type { Scheduler, ScheduleInput } from '../core/scheduler.js';
+import type { ScheduleRecord } from '../store/store.js';
+
+export interface ScheduleRouteDeps {
+  scheduler: Scheduler;
+  authenticator: Authenticator;
+  // The most history entries one request can list.
+  historyLimit: number;
+}
+
+const DEFAULT_HISTORY_PAGE = 20;
+
+// Registers submissions to run on a cron expression and lists what each occurrence did. A key
+// only sees its own schedules, and they run as that key, against its quota and limits.
+export function registerScheduleRoutes(router: Router, deps: ScheduleRouteDeps) {
+  router.post('/v1/schedules', async (req, res, next) => {
+    try {
+      const apiKey = requireKey(req);
+      deps.authenticator.throttle(apiKey);
+      const schedule = await deps.scheduler.create(apiKey, (req.body ?? {}) as ScheduleInput);
+      res.status(201).json(view(schedule));
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  router.get('/v1/schedules', async (req, res, next) => {
+    try {
+      const schedules = await deps.scheduler.list(requireKey(req));
+      res.json({ schedules: schedules.map(view) });
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  router.get('/v1/schedules/:id', async (req, res, next) => {
+    try {
+      res.json(view(await deps.scheduler.get(requireKey(req), req.params.id)));
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  router.patch('/v1/schedules/:id', async (req, res, next) => {
+    try {
+      const schedule = await deps.scheduler.update(requireKey(req), req.params.id, (req.body ?? {}) as ScheduleInput);
+      res.json(view(schedule));
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  router.delete('/v1/schedules/:id', async (req, res, next) => {
+    try {
+      await deps.scheduler.delete(requireKey(req), req.params.id);
+      res.status(204).end();
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  router.get('/v1/schedules/:id/runs', async (req, res, next) => {
+    try {
+      const limit = parseLimit(req.query['limit'], deps.historyLimit);
+      res.json({ runs: await deps.scheduler.history(requireKey(req), req.params.id, limit) });
+    } catch (err) {
+      next(err);
+    }
+  });
+}
+
+function requireKey(req: Request): string {
+  const apiKey = (req as Request & { apiKey?: string }).apiKey;
+  if (!apiKey) {
+    throw Boom.unauthorized('missing api key');
+  }
+  return apiKey;
+}
+
+function parseLimit(value: unknown, max: number): number {
+  if (value === undefined) {
+    return Math.min(DEFAULT_HISTORY_PAGE, max);
+  }
+  const limit = typeof value === 'string' && /^\d+$/.test(value) ? Number(value) : NaN;
+  if (!(limit >= 1 && limit <= max)) {
+    throw Boom.badRequest(`limit must be an integer from 1 to ${max}`);
+  }
+  return limit;
+}
+
+// The token a schedule runs as is never returned.
+function view({ api_key: _apiKey, ...schedule }: ScheduleRecord) {
+  return schedule;
+}
@@ -0,0 +1,123 @@
+import Boom from '@hapi/boom';
+import type { IncomingMessage, Server } from 'node:http';
+import type { Duplex } from 'node:stream';
+import { PassThrough } from 'node:stream';
+import { WebSocketServer } from 'ws';
+import type { RawData, WebSocket } from 'ws';
+import type { Authenticator } from '../core/auth.js';
+import type { Orchestrator } from '../core/orchestrator.js';
+import type { OutputStream, RunRequest } from '../core/types.js';
+import { parseTraceparent } from '../tracing/tracer.js';
+import type { SpanContext } from '../tracing/tracer.js';
+
+export interface SessionRouteDeps {
+  orchestrator: Orchestrator;
+  authenticator: Authenticator;
+}
+
+type ClientFrame =
+  | { type: 'start'; run: RunRequest }
+  | { type: 'stdin'; data: string }
+  | { type: 'close_stdin' }
+  | { type: 'cancel' };
+
+// Interactive sessions over a websocket at /v1/sessions. The client sends a `start` frame with a
+// run request, then `stdin` frames that are relayed to the live process; the server answers with
+// `started`, `stdout`/`stderr` frames as output is produced and a final `result` frame.
+// Browsers cannot set headers on websockets, so the token may also be passed as `access_token`.
+export function registerSessionRoutes(server: Server, deps: SessionRouteDeps) {
+  const wss = new WebSocketServer({ noServer: true, maxPayload: 1024 * 1024 });
+  server.on('upgrade', (req: IncomingMessage, socket: Duplex, head: Buffer) => {
+    const url = new URL(req.url ?? '/', 'http://localhost');
+    if (url.pathname !== '/v1/sessions') {
+      socket.destroy();
+      return;
+    }
+    let apiKey: string;
+    try {
+      const token = url.searchParams.get('access_token');
+      apiKey = deps.authenticator.authenticate(req.headers['authorization'] ?? (token ? `Bearer ${token}` : undefined));
+      deps.authenticator.throttle(apiKey);
+    } catch (err) {
+      const boom = Boom.isBoom(err) ? err : Boom.internal();
+      const headers = Object.entries(boom.output.headers).map(([name, value]) => `${name}: ${value}\r\n`).join('');
+      socket.end(`HTTP/1.1 ${boom.output.statusCode} ${boom.output.payload.error}\r\n${headers}Connection: close\r\n\r\n`);
+      return;
+    }
+    const traceParent = parseTraceparent(req.headers['traceparent']);
+    wss.handleUpgrade(req, socket, head, (ws) => runSession(ws, apiKey, traceParent, deps));
+  });
+}
+
+function runSession(ws: WebSocket, apiKey: string, traceParent: SpanContext | null, deps: SessionRouteDeps) {
+  const input = new PassThrough();
+  let runId: string | null = null;
+  let finished = false;
+  const send = (frame: Record<string, unknown>) => {
+    if (ws.readyState === ws.OPEN) {
+      ws.send(JSON.stringify(frame));
+    }
+  };
+  const fail = (message: string, code = 1008) => {
+    send({ type: 'error', error: message });
+    ws.close(code);
+  };
+
+  ws.on('message', (raw: RawData) => {
+    let frame: ClientFrame;
+    try {
+      frame = JSON.parse(raw.toString()) as ClientFrame;
+    } catch {
+      fail('invalid frame');
+      return;
+    }
+    if (!runId) {
+      if (frame.type !== 'start') {
+        fail('first frame must be start');
+        return;
+      }
+      try {
+        // Someone is at the other end of a session, so it jumps ahead of queued bulk work.
+        const started = deps.orchestrator.startRun({ ...frame.run, priority: frame.run.priority ?? 'interactive' }, apiKey, {
+          input,
+          onOutput: (stream: OutputStream, chunk: Buffer) => send({ type: stream, data: chunk.toString('utf8') }),
+          traceParent
+        });
+        runId = started.id;
+        send({ type: 'started', id: started.id });
+        started.done
+          .then((run) => {
+            finished = true;
+            send({ type: 'result', run });
+            ws.close(1000);
+          })
+          .catch((err: Error) => {
+            finished = true;
+            fail(Boom.isBoom(err) ? err.message : 'internal_error', 1011);
+          });
+      } catch (err) {
+        fail(Boom.isBoom(err) ? err.message : 'internal_error');
+      }
+      return;
+    }
+    if (frame.type === 'stdin' && typeof frame.data === 'string') {
+      if (!input.writableEnded) {
+        input.write(frame.data);
+      }
+    } else if (frame.type === 'close_stdin') {
+      input.end();
+    } else if (frame.type === 'cancel') {
+      deps.orchestrator.cancelRun(runId);
+    } else {
+      fail('unexpected frame');
+    }
+  });
+
+  // A client that disconnects ends the session rather than leaving the process waiting on stdin.
+  ws.on('close', () => {
+    input.end();
+    if (runId && !finished) {
+      deps.orchestrator.cancelRun(runId);
+    }
+  });
+}
@@ -0,0 +1,78 @@
+import Boom from '@hapi/boom';
+import type { Router } from 'express';
+import type { RunnerRegistry } from '../core/runners.js';
+import type { RuntimeSettings } from '../core/runtime_settings.js';
+import { adminGuard } from './admin.js';
+import { describeRunner } from './runners.js';
+import type { RunnerRouteDeps } from './runners.js';
+
+export interface SettingsRouteDeps extends Omit<RunnerRouteDeps, 'registry'> {
+  registry: RunnerRegistry;
+  settings: RuntimeSettings;
+  // Bearer token for /admin; the routes are not served when unset.
+  adminToken?: string;
+}
+
+// Lists every registered runner under /admin, the disabled ones included, switches languages on
+// and off and tunes the default limits and maxima, all without a restart.
+export function registerSettingsRoutes(router: Router, deps: SettingsRouteDeps) {
+  const adminToken = deps.adminToken;
+  if (!adminToken) {
+    return;
+  }
+  const requireAdmin = adminGuard(adminToken);
+  // Disabled runners are not probed for their version, which needs them to run.
+  const describe = async (language: string) => {
+    const runner = deps.registry.all().find((definition) => definition.language === language);
+    if (!runner) {
+      throw Boom.notFound(`no runner for ${language}`);
+    }
+    const enabled = deps.registry.isEnabled(language);
+    return { ...(await describeRunner(runner, enabled ? deps : { ...deps, probeVersion: undefined })), enabled, image: runner.image };
+  };
+
+  router.get('/admin/runners', async (req, res, next) => {
+    try {
+      requireAdmin(req);
+      res.json({ runners: await Promise.all(deps.registry.all().map((runner) => describe(runner.language))) });
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  // Runs already accepted for a language that is switched off fail once they reach the sandbox.
+  router.patch('/admin/runners/:language', async (req, res, next) => {
+    try {
+      requireAdmin(req);
+      await deps.settings.setEnabled(req.params.language, (req.body ?? {}).enabled);
+      res.json(await describe(req.params.language));
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  router.get('/admin/limits', (req, res, next) => {
+    try {
+      requireAdmin(req);
+      res.json(limitsOf(deps.settings));
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  router.patch('/admin/limits', async (req, res, next) => {
+    try {
+      requireAdmin(req);
+      await deps.settings.updateLimits(req.body ?? {});
+      res.json(limitsOf(deps.settings));
+    } catch (err) {
+      next(err);
+    }
+  });
+}
+
+// The limits in effect, and which of them the admin API changed.
+function limitsOf(settings: RuntimeSettings) {
+  const { defaults, max, languages } = settings.policy();
+  return { defaults, max, languages: languages ?? {}, overrides: settings.overrides().limits };
+}
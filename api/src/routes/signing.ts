@@ -0,0 +1,14 @@
+import type { Router } from 'express';
+import type { ResultSigner } from '../core/result_signing.js';
+
+export interface SigningRouteDeps {
+  // Unset when the deployment signs no results, which lists no keys.
+  signer?: ResultSigner;
+}
+
+// The public keys results are signed with, by key_id, so that receivers can verify them.
+export function registerSigningRoutes(router: Router, deps: SigningRouteDeps) {
+  router.get('/v1/signing-keys', (_req, res) => {
+    res.json({ keys: deps.signer ? [deps.signer.key] : [] });
+  });
+}
@@ -0,0 +1,108 @@
+import Boom from '@hapi/boom';
+import type { Request, Router } from 'express';
+import type { Authenticator, KeyDescription } from '../core/auth.js';
+import { round, type CostWeights } from '../core/cost.js';
+import type { ExecutionStore, UsageDimension, UsageQuery, UsageTotals } from '../store/store.js';
+import { COST_FIELDS } from '../store/store.js';
+import { adminGuard } from './admin.js';
+
+export interface UsageRouteDeps {
+  runStore: ExecutionStore;
+  authenticator: Authenticator;
+  weights: CostWeights;
+  // Bearer token for /admin/usage/report, which is not served when unset.
+  adminToken?: string;
+}
+
+// `key` in group_by; reports name keys by their description rather than their token.
+const GROUPS: Record<string, UsageDimension> = { key: 'api_key', tenant: 'tenant', day: 'day' };
+
+interface UsageGroup extends Omit<UsageTotals, 'api_key'> {
+  key?: KeyDescription;
+}
+
+// Cost reports over executions created in a time range, for billing: a key's own at
+// /v1/usage/report, by day, and every key's at /admin/usage/report, by key, tenant and day.
+export function registerUsageRoutes(router: Router, deps: UsageRouteDeps) {
+  router.get('/v1/usage/report', async (req, res, next) => {
+    try {
+      const apiKey = (req as typeof req & { apiKey?: string }).apiKey;
+      if (!apiKey) {
+        throw Boom.unauthorized('missing api key');
+      }
+      const query = parseQuery(req, ['day']);
+      res.json(await report(deps, { ...query, api_key: apiKey }));
+    } catch (err) {
+      next(err);
+    }
+  });
+
+  const adminToken = deps.adminToken;
+  if (!adminToken) {
+    return;
+  }
+  const requireAdmin = adminGuard(adminToken);
+  router.get('/admin/usage/report', async (req, res, next) => {
+    try {
+      requireAdmin(req);
+      const tenant = req.query['tenant'];
+      if (tenant !== undefined && (typeof tenant !== 'string' || tenant === '')) {
+        throw Boom.badRequest('tenant must be given once and not be empty');
+      }
+      res.json(await report(deps, { ...parseQuery(req, Object.keys(GROUPS)), tenant }));
+    } catch (err) {
+      next(err);
+    }
+  });
+}
+
+async function report(deps: UsageRouteDeps, query: UsageQuery) {
+  const totals = await deps.runStore.sumCosts(query);
+  const groups = totals.map(({ api_key: apiKey, ...group }): UsageGroup => {
+    const rounded = { ...group, ...Object.fromEntries(COST_FIELDS.map((field) => [field, round(group[field])])) };
+    return apiKey === undefined ? rounded : { key: deps.authenticator.describeKey(apiKey), ...rounded };
+  });
+  const sum = (field: (typeof COST_FIELDS)[number]) => round(totals.reduce((total, group) => total + group[field], 0));
+  return {
+    from: query.since,
+    to: query.until,
+    group_by: query.group_by.map((dimension) => (dimension === 'api_key' ? 'key' : dimension)),
+    weights: deps.weights,
+    totals: {
+      executions: totals.reduce((total, group) => total + group.executions, 0),
+      ...Object.fromEntries(COST_FIELDS.map((field) => [field, sum(field)]))
+    },
+    groups
+  };
+}
+
+// `from` defaults to the start of the current calendar month (UTC) and `to` to now; `group_by`
+// to `day`.
+function parseQuery(req: Request, allowed: string[]): UsageQuery {
+  const single = (name: string) => {
+    const value = req.query[name];
+    if (value !== undefined && (typeof value !== 'string' || value === '')) {
+      throw Boom.badRequest(`${name} must be given once and not be empty`);
+    }
+    return value;
+  };
+  const time = (name: string, fallback: Date) => {
+    const value = single(name);
+    if (value !== undefined && !Number.isFinite(Date.parse(value))) {
+      throw Boom.badRequest(`${name} must be an ISO 8601 time`);
+    }
+    return (value === undefined ? fallback : new Date(value)).toISOString();
+  };
+  const now = new Date();
+  const since = time('from', new Date(Date.UTC(now.getUTCFullYear(), now.getUTCMonth(), 1)));
+  const until = time('to', now);
+  if (since >= until) {
+    throw Boom.badRequest('from must be before to');
+  }
+  const names = single('group_by')?.split(',') ?? ['day'];
+  const invalid = names.find((name) => name !== 'none' && !allowed.includes(name));
+  if (invalid !== undefined || (names.includes('none') && names.length > 1)) {
+    throw Boom.badRequest(`group_by must be none or a comma-separated list of ${allowed.join(', ')}`);
+  }
+  return { since, until, group_by: [...new Set(names.filter((name) => name !== 'none').map((name) => GROUPS[name]))] };
+}
@@ -0,0 +1,8 @@
+import type { Router } from 'express';
+import type { WarmPool, WarmSandbox } from '../core/warm_pool.js';
+
+export function registerWarmPoolRoutes(router: Router, deps: { warmPool: WarmPool<WarmSandbox> }) {
+  router.get('/v1/warm-pool', (_req, res) => {
+    res.json(deps.warmPool.stats());
+  });
+}
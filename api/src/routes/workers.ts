@@ -0,0 +1,8 @@
+import type { Router } from 'express';
+import type { Coordinator } from '../core/coordinator.js';
+
+export function registerWorkerRoutes(router: Router, deps: { coordinator: Coordinator }) {
+  router.get('/v1/workers', (_req, res) => {
+    res.json(deps.coordinator.stats());
+  });
+}
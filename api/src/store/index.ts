@@ -0,0 +1,26 @@
+import { RunStore } from '../core/run_store.js';
+import { PostgresStore } from './postgres.js';
+import { SqliteStore } from './sqlite.js';
+import type { ApiKeyStore, ExecutionStore, ScheduleStore, SettingsStore } from './store.js';
+
+export interface StoreOptions {
+  // Metadata keys to index in the SQLite and PostgreSQL backends.
+  metadataIndexes?: string[];
+}
+
+export type { ApiKeyRecord, ApiKeyStore, ExecutionStore, ScheduleStore, SettingsStore, SubmissionRecord } from './store.js';
+
+// Picks the backend from a store URL: `sqlite:<path>` (e.g. `sqlite:/data/executions.db`),
+// `postgres://…`, or nothing for the in-memory store.
+export function createStore(url: string | undefined, options: StoreOptions = {}): ExecutionStore & ApiKeyStore & SettingsStore & ScheduleStore {
+  if (!url) {
+    return new RunStore();
+  }
+  if (url.startsWith('sqlite:')) {
+    return new SqliteStore(url.slice('sqlite:'.length).replace(/^\/\/(?=\/)/, ''), options);
+  }
+  if (url.startsWith('postgres://') || url.startsWith('postgresql://')) {
+    return new PostgresStore({ connectionString: url, ...options });
+  }
+  throw new Error(`unsupported STORE_URL: ${url.split(':')[0]}`);
+}
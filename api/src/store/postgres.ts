@@ -0,0 +1,527 @@
+import pg from 'pg';
+import { decodeRunRecord } from '../core/schema.js';
+import type { ExecutionEvent, RunArtifact, RunRecord } from '../core/types.js';
+import type {
+  ApiKeyRecord,
+  ApiKeyStore,
+  ExecutionCursor,
+  ExecutionFilter,
+  ExecutionStore,
+  ExecutionSummary,
+  ScheduleRecord,
+  ScheduleRunRecord,
+  ScheduleStore,
+  SettingsStore,
+  SimilarExecution,
+  SimilarityQuery,
+  SubmissionRecord,
+  UsageQuery,
+  UsageTotals
+} from './store.js';
+import { COST_FIELDS, METADATA_KEY_PATTERN, withoutInlineContent } from './store.js';
+
+// Same layout as the SQLite schema, with native JSON and timestamp columns.
+const SCHEMA = `
+CREATE TABLE IF NOT EXISTS executions (
+  id TEXT PRIMARY KEY,
+  api_key TEXT NOT NULL,
+  language TEXT NOT NULL,
+  status TEXT NOT NULL,
+  request JSONB NOT NULL,
+  record JSONB,
+  error TEXT,
+  created_at TIMESTAMPTZ NOT NULL,
+  finished_at TIMESTAMPTZ,
+  idempotency_key TEXT
+);
+-- Tables created before idempotency keys, tenants, tags or metadata lack their columns.
+ALTER TABLE executions ADD COLUMN IF NOT EXISTS idempotency_key TEXT;
+ALTER TABLE executions ADD COLUMN IF NOT EXISTS tenant TEXT;
+ALTER TABLE executions ADD COLUMN IF NOT EXISTS tags JSONB NOT NULL DEFAULT '[]';
+ALTER TABLE executions ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS executions_idempotency_key ON executions (api_key, idempotency_key);
+CREATE INDEX IF NOT EXISTS executions_tenant_created_at ON executions (tenant, created_at);
+CREATE INDEX IF NOT EXISTS executions_status_created_at ON executions (status, created_at);
+CREATE INDEX IF NOT EXISTS executions_created_at_api_key ON executions (created_at, api_key);
+CREATE INDEX IF NOT EXISTS executions_finished_at ON executions (finished_at);
+CREATE INDEX IF NOT EXISTS executions_api_key_created_at ON executions (api_key, created_at);
+CREATE TABLE IF NOT EXISTS artifacts (
+  run_id TEXT NOT NULL REFERENCES executions (id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  size BIGINT NOT NULL,
+  sha256 TEXT NOT NULL,
+  url TEXT NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL,
+  content_type TEXT NOT NULL,
+  PRIMARY KEY (run_id, name)
+);
+CREATE TABLE IF NOT EXISTS execution_events (
+  execution_id TEXT NOT NULL,
+  seq INTEGER NOT NULL,
+  type TEXT NOT NULL,
+  at TIMESTAMPTZ NOT NULL,
+  data JSONB NOT NULL,
+  PRIMARY KEY (execution_id, seq)
+);
+CREATE TABLE IF NOT EXISTS fingerprints (
+  execution_id TEXT NOT NULL REFERENCES executions (id) ON DELETE CASCADE,
+  hash BIGINT NOT NULL,
+  PRIMARY KEY (execution_id, hash)
+);
+CREATE INDEX IF NOT EXISTS fingerprints_hash ON fingerprints (hash);
+CREATE TABLE IF NOT EXISTS api_keys (
+  id TEXT PRIMARY KEY,
+  token_sha256 TEXT NOT NULL UNIQUE,
+  label TEXT NOT NULL,
+  rate_limit_rps DOUBLE PRECISION NOT NULL,
+  burst INTEGER NOT NULL,
+  monthly_executions INTEGER,
+  max_timeout_ms INTEGER,
+  max_memory_mb INTEGER,
+  tenant TEXT,
+  max_concurrent INTEGER,
+  created_at TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS settings (
+  name TEXT PRIMARY KEY,
+  value JSONB NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS schedules (
+  id TEXT PRIMARY KEY,
+  api_key TEXT NOT NULL,
+  revision INTEGER NOT NULL,
+  record JSONB NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS schedules_api_key_created_at ON schedules (api_key, created_at);
+CREATE TABLE IF NOT EXISTS schedule_runs (
+  seq BIGSERIAL PRIMARY KEY,
+  schedule_id TEXT NOT NULL REFERENCES schedules (id) ON DELETE CASCADE,
+  record JSONB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS schedule_runs_schedule_id_seq ON schedule_runs (schedule_id, seq);
+`;
+
+export interface PostgresStoreOptions {
+  // postgres:// connection URL.
+  connectionString: string;
+  maxConnections?: number;
+  // Metadata keys listings often filter by, each given an index.
+  metadataIndexes?: string[];
+}
+
+// Execution store in PostgreSQL, for deployments that run several API instances or keep results
+// in a managed database. The schema is created on first use.
+export class PostgresStore implements ExecutionStore, ApiKeyStore, SettingsStore, ScheduleStore {
+  private readonly pool: pg.Pool;
+  private readonly ready: Promise<void>;
+
+  constructor(options: PostgresStoreOptions) {
+    this.pool = new pg.Pool({ connectionString: options.connectionString, max: options.maxConnections ?? 10 });
+    const indexes = (options.metadataIndexes ?? []).map((key) =>
+      `CREATE INDEX IF NOT EXISTS executions_metadata_${key}_created_at ON executions ((${metadataValue(key)}), created_at);`);
+    this.ready = this.pool.query([SCHEMA, ...indexes].join('\n')).then(() => undefined);
+    // Surfaced by the first query that awaits it.
+    this.ready.catch(() => undefined);
+  }
+
+  public async saveSubmission(submission: SubmissionRecord) {
+    await this.query(
+      `INSERT INTO executions (id, api_key, language, status, request, created_at, idempotency_key, tenant, tags, metadata)
+       VALUES ($1, $2, $3, 'pending', $4, $5, $6, $7, $8, $9)
+       ON CONFLICT (id) DO NOTHING`,
+      [
+        submission.id,
+        submission.api_key,
+        submission.language,
+        JSON.stringify(submission.request),
+        submission.created_at,
+        submission.idempotency_key ?? null,
+        submission.tenant ?? null,
+        JSON.stringify(submission.request.tags ?? []),
+        JSON.stringify(submission.request.metadata ?? {})
+      ]
+    );
+  }
+
+  public async save(run: RunRecord) {
+    const { artifacts, ...record } = withoutInlineContent(run);
+    await this.ready;
+    const client = await this.pool.connect();
+    try {
+      await client.query('BEGIN');
+      await client.query(
+        `INSERT INTO executions (id, api_key, language, status, request, record, created_at, finished_at)
+         VALUES ($1, '', $2, $3, 'null', $4, $5, now())
+         ON CONFLICT (id) DO UPDATE SET status = excluded.status, record = excluded.record, finished_at = excluded.finished_at`,
+        [run.id, run.language, run.status, JSON.stringify(record), run.created_at]
+      );
+      await client.query('DELETE FROM artifacts WHERE run_id = $1', [run.id]);
+      for (const artifact of artifacts) {
+        await client.query(
+          'INSERT INTO artifacts (run_id, name, size, sha256, url, expires_at, content_type) VALUES ($1, $2, $3, $4, $5, $6, $7)',
+          [run.id, artifact.name, artifact.size, artifact.sha256, artifact.url, artifact.expires_at, artifact.content_type]
+        );
+      }
+      await client.query('COMMIT');
+    } catch (err) {
+      await client.query('ROLLBACK');
+      throw err;
+    } finally {
+      client.release();
+    }
+  }
+
+  public async saveError(id: string, message: string) {
+    await this.query(
+      `INSERT INTO executions (id, api_key, language, status, request, error, created_at, finished_at)
+       VALUES ($1, '', '', 'error', 'null', $2, now(), now())
+       ON CONFLICT (id) DO UPDATE SET status = 'error', error = excluded.error, finished_at = excluded.finished_at`,
+      [id, message]
+    );
+  }
+
+  public async get(id: string): Promise<RunRecord | null> {
+    const { rows } = await this.query('SELECT record FROM executions WHERE id = $1 AND record IS NOT NULL', [id]);
+    if (rows.length === 0) {
+      return null;
+    }
+    const artifacts = await this.query(
+      `SELECT name, size::float8 AS size, sha256, url,
+              to_char(expires_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS expires_at, content_type
+       FROM artifacts WHERE run_id = $1 ORDER BY name`,
+      [id]
+    );
+    return { ...decodeRunRecord(rows[0].record), artifacts: artifacts.rows as RunArtifact[] };
+  }
+
+  public async getError(id: string): Promise<string | null> {
+    const { rows } = await this.query("SELECT error FROM executions WHERE id = $1 AND status = 'error'", [id]);
+    return (rows[0]?.error as string | undefined) ?? null;
+  }
+
+  public async getSubmission(id: string): Promise<SubmissionRecord | null> {
+    const { rows } = await this.query(
+      `SELECT id, api_key, language, request, idempotency_key,
+              to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS created_at
+       FROM executions WHERE id = $1 AND api_key <> ''`,
+      [id]
+    );
+    return (rows[0] as SubmissionRecord | undefined) ?? null;
+  }
+
+  public async failUnfinished(createdBefore: string, message: string): Promise<number> {
+    const result = await this.query(
+      "UPDATE executions SET status = 'error', error = $1, finished_at = now() WHERE status = 'pending' AND created_at < $2",
+      [message, createdBefore]
+    );
+    return result.rowCount ?? 0;
+  }
+
+  public async requeueSubmission(id: string) {
+    await this.query("UPDATE executions SET status = 'requeued' WHERE id = $1 AND status = 'pending'", [id]);
+  }
+
+  // A single UPDATE, so servers starting together never claim the same submission.
+  public async claimRequeued(): Promise<SubmissionRecord[]> {
+    const { rows } = await this.query(
+      `UPDATE executions SET status = 'pending' WHERE status = 'requeued'
+       RETURNING id, api_key, language, request, idempotency_key,
+                 to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS created_at`,
+      []
+    );
+    return (rows as SubmissionRecord[]).sort((a, b) => a.created_at.localeCompare(b.created_at));
+  }
+
+  public async findSubmission(apiKey: string, idempotencyKey: string, since: string): Promise<SubmissionRecord | null> {
+    const { rows } = await this.query(
+      `SELECT id, api_key, language, request, idempotency_key,
+              to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS created_at
+       FROM executions WHERE api_key = $1 AND idempotency_key = $2 AND created_at >= $3
+       ORDER BY created_at DESC LIMIT 1`,
+      [apiKey, idempotencyKey, since]
+    );
+    return (rows[0] as SubmissionRecord | undefined) ?? null;
+  }
+
+  public async countSubmissions(since: string) {
+    const { rows } = await this.query(
+      "SELECT api_key, COUNT(*)::int AS count FROM executions WHERE created_at >= $1 AND api_key <> '' GROUP BY api_key",
+      [since]
+    );
+    return Object.fromEntries(rows.map((row) => [row.api_key as string, row.count as number]));
+  }
+
+  public async sumCosts(query: UsageQuery) {
+    const values: string[] = [query.since, query.until];
+    let where = "record IS NOT NULL AND api_key <> '' AND created_at >= $1::timestamptz AND created_at < $2::timestamptz";
+    if (query.api_key !== undefined) {
+      values.push(query.api_key);
+      where += ` AND api_key = $${values.length}`;
+    }
+    if (query.tenant !== undefined) {
+      values.push(query.tenant);
+      where += ` AND tenant = $${values.length}`;
+    }
+    const columns = query.group_by.map((dimension) =>
+      dimension === 'day' ? `to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day` : dimension);
+    const positions = query.group_by.map((_, index) => String(index + 1));
+    const cost = (field: string) => `COALESCE(SUM((record->'cost'->>'${field}')::float8), 0) AS ${field}`;
+    const { rows } = await this.query(
+      `SELECT ${[...columns, 'COUNT(*)::int AS executions', ...COST_FIELDS.map(cost)].join(', ')}
+       FROM executions WHERE ${where}
+       ${positions.length > 0 ? `GROUP BY ${positions.join(', ')} ORDER BY ${positions.map((position) => `${position} NULLS FIRST`).join(', ')}` : ''}`,
+      values
+    );
+    return rows as UsageTotals[];
+  }
+
+  public async appendEvent(id: string, event: ExecutionEvent) {
+    await this.query(
+      'INSERT INTO execution_events (execution_id, seq, type, at, data) VALUES ($1, $2, $3, $4, $5)',
+      [id, event.seq, event.type, event.at, JSON.stringify(event.data)]
+    );
+  }
+
+  public async listEvents(id: string) {
+    const { rows } = await this.query(
+      `SELECT seq, type, to_char(at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS at, data
+       FROM execution_events WHERE execution_id = $1 ORDER BY seq`,
+      [id]
+    );
+    return rows as ExecutionEvent[];
+  }
+
+  public async listExecutions(filter: ExecutionFilter, limit: number, after?: ExecutionCursor) {
+    const values: unknown[] = [];
+    const conditions = filterConditions(filter, values);
+    if (after) {
+      values.push(after.created_at, after.id);
+      conditions.push(`(created_at, id) < ($${values.length - 1}::timestamptz, $${values.length})`);
+    }
+    values.push(limit);
+    const { rows } = await this.query(
+      `SELECT id, language, status,
+              to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS created_at,
+              to_char(finished_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS finished_at,
+              tenant, tags, metadata
+       FROM executions
+       ${conditions.length > 0 ? `WHERE ${conditions.join(' AND ')}` : ''}
+       ORDER BY created_at DESC, id DESC LIMIT $${values.length}`,
+      values
+    );
+    return rows as ExecutionSummary[];
+  }
+
+  public async saveFingerprint(id: string, hashes: number[]) {
+    await this.query(
+      `WITH removed AS (DELETE FROM fingerprints WHERE execution_id = $1 AND hash <> ALL($2::bigint[]))
+       INSERT INTO fingerprints (execution_id, hash) SELECT DISTINCT $1, unnest($2::bigint[])
+       ON CONFLICT DO NOTHING`,
+      [id, hashes]
+    );
+  }
+
+  public async getFingerprint(id: string) {
+    const { rows } = await this.query('SELECT hash FROM fingerprints WHERE execution_id = $1 ORDER BY hash', [id]);
+    // BIGINT comes back as a string.
+    return rows.map((row) => Number(row.hash));
+  }
+
+  // Candidates are the executions sharing a hash with the query, found through the hash index.
+  public async findSimilar(query: SimilarityQuery, limit: number) {
+    const hashes = [...new Set(query.hashes)];
+    const values: unknown[] = [hashes, query.exclude_id ?? '', query.threshold];
+    const conditions = filterConditions(query.filter, values);
+    values.push(limit);
+    const { rows } = await this.query(
+      `WITH matched AS (
+         SELECT execution_id, COUNT(*) AS shared FROM fingerprints
+         WHERE hash = ANY($1::bigint[]) AND execution_id <> $2
+         GROUP BY execution_id
+       ), scored AS (
+         SELECT execution_id, shared,
+                shared::float8 / (cardinality($1::bigint[]) + (SELECT COUNT(*) FROM fingerprints f WHERE f.execution_id = matched.execution_id) - shared) AS similarity
+         FROM matched
+       )
+       SELECT id, language, status,
+              to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS created_at,
+              to_char(finished_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS finished_at,
+              tenant, tags, metadata, shared, similarity
+       FROM scored JOIN executions ON executions.id = scored.execution_id
+       WHERE similarity >= $3 ${conditions.map((condition) => `AND ${condition}`).join(' ')}
+       ORDER BY similarity DESC, executions.created_at DESC, id DESC LIMIT $${values.length}`,
+      values
+    );
+    return rows.map((row): SimilarExecution => ({ ...row, shared: Number(row.shared), similarity: Number(row.similarity) }));
+  }
+
+  public async listFinished(finishedBefore: string, limit: number) {
+    const { rows } = await this.query(
+      `SELECT id FROM executions WHERE finished_at < $1 AND status NOT IN ('pending', 'requeued')
+       ORDER BY finished_at LIMIT $2`,
+      [finishedBefore, limit]
+    );
+    return rows.map((row) => row.id as string);
+  }
+
+  // Artifacts and the fingerprint go with the row through their foreign keys.
+  public async deleteExecution(id: string) {
+    await this.query(
+      `WITH events AS (DELETE FROM execution_events WHERE execution_id = $1)
+       DELETE FROM executions WHERE id = $1`,
+      [id]
+    );
+  }
+
+  public async listApiKeys() {
+    const { rows } = await this.query(
+      `SELECT id, token_sha256, label, rate_limit_rps, burst, monthly_executions, max_timeout_ms, max_memory_mb, tenant, max_concurrent,
+              to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.MS"Z"') AS created_at
+       FROM api_keys ORDER BY created_at`,
+      []
+    );
+    return rows as ApiKeyRecord[];
+  }
+
+  public async saveApiKey(key: ApiKeyRecord) {
+    await this.query(
+      `INSERT INTO api_keys (id, token_sha256, label, rate_limit_rps, burst, monthly_executions, max_timeout_ms, max_memory_mb, tenant, max_concurrent, created_at)
+       VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+       ON CONFLICT (id) DO UPDATE SET label = excluded.label, rate_limit_rps = excluded.rate_limit_rps, burst = excluded.burst,
+         monthly_executions = excluded.monthly_executions, max_timeout_ms = excluded.max_timeout_ms, max_memory_mb = excluded.max_memory_mb,
+         tenant = excluded.tenant, max_concurrent = excluded.max_concurrent`,
+      [
+        key.id,
+        key.token_sha256,
+        key.label,
+        key.rate_limit_rps,
+        key.burst,
+        key.monthly_executions,
+        key.max_timeout_ms,
+        key.max_memory_mb,
+        key.tenant,
+        key.max_concurrent,
+        key.created_at
+      ]
+    );
+  }
+
+  public async deleteApiKey(id: string) {
+    const result = await this.query('DELETE FROM api_keys WHERE id = $1', [id]);
+    return (result.rowCount ?? 0) > 0;
+  }
+
+  public async getSetting(name: string) {
+    const { rows } = await this.query('SELECT value FROM settings WHERE name = $1', [name]);
+    return rows.length > 0 ? (rows[0] as { value: unknown }).value : null;
+  }
+
+  public async saveSetting(name: string, value: unknown) {
+    await this.query(
+      `INSERT INTO settings (name, value, updated_at) VALUES ($1, $2, now())
+       ON CONFLICT (name) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+      [name, JSON.stringify(value)]
+    );
+  }
+
+  public async listSchedules(apiKey?: string) {
+    const { rows } = await this.query('SELECT record FROM schedules WHERE $1::text IS NULL OR api_key = $1 ORDER BY created_at', [apiKey ?? null]);
+    return rows.map((row) => row.record as ScheduleRecord);
+  }
+
+  public async getSchedule(id: string) {
+    const { rows } = await this.query('SELECT record FROM schedules WHERE id = $1', [id]);
+    return rows.length > 0 ? (rows[0].record as ScheduleRecord) : null;
+  }
+
+  public async saveSchedule(schedule: ScheduleRecord) {
+    const record = JSON.stringify(schedule);
+    const result = schedule.revision === 1
+      ? await this.query(
+        'INSERT INTO schedules (id, api_key, revision, record, created_at) VALUES ($1, $2, 1, $3, $4) ON CONFLICT (id) DO NOTHING',
+        [schedule.id, schedule.api_key, record, schedule.created_at]
+      )
+      : await this.query('UPDATE schedules SET revision = $1, record = $2 WHERE id = $3 AND revision = $4', [
+        schedule.revision,
+        record,
+        schedule.id,
+        schedule.revision - 1
+      ]);
+    return (result.rowCount ?? 0) > 0;
+  }
+
+  // The history goes with the row through its foreign key.
+  public async deleteSchedule(id: string) {
+    const result = await this.query('DELETE FROM schedules WHERE id = $1', [id]);
+    return (result.rowCount ?? 0) > 0;
+  }
+
+  // The DELETE runs on the snapshot from before the INSERT, so it keeps one fewer of the older rows.
+  public async appendScheduleRun(run: ScheduleRunRecord, keep: number) {
+    await this.query(
+      `WITH added AS (INSERT INTO schedule_runs (schedule_id, record) VALUES ($1, $2))
+       DELETE FROM schedule_runs WHERE schedule_id = $1 AND seq NOT IN
+         (SELECT seq FROM schedule_runs WHERE schedule_id = $1 ORDER BY seq DESC LIMIT $3)`,
+      [run.schedule_id, JSON.stringify(run), keep - 1]
+    );
+  }
+
+  public async listScheduleRuns(scheduleId: string, limit: number) {
+    const { rows } = await this.query('SELECT record FROM schedule_runs WHERE schedule_id = $1 ORDER BY seq DESC LIMIT $2', [scheduleId, limit]);
+    return rows.map((row) => row.record as ScheduleRunRecord);
+  }
+
+  public async close() {
+    await this.pool.end();
+  }
+
+  private async query(text: string, values: unknown[]) {
+    await this.ready;
+    return this.pool.query(text, values);
+  }
+}
+
+// Conditions on executions' columns for every field of the filter that is set, each taking the
+// next parameter after those already in `values`.
+function filterConditions(filter: ExecutionFilter, values: unknown[]) {
+  const conditions: string[] = [];
+  const where = (condition: (param: string) => string, value: unknown) => {
+    values.push(value);
+    conditions.push(condition(`$${values.length}`));
+  };
+  if (filter.api_key !== undefined) {
+    where((param) => `api_key = ${param}`, filter.api_key);
+  }
+  if (filter.tenant !== undefined) {
+    where((param) => `tenant = ${param}`, filter.tenant);
+  }
+  if (filter.language !== undefined) {
+    where((param) => `language = ${param}`, filter.language);
+  }
+  if (filter.statuses !== undefined) {
+    where((param) => `status = ANY(${param}::text[])`, filter.statuses);
+  }
+  if (filter.created_after !== undefined) {
+    where((param) => `created_at >= ${param}::timestamptz`, filter.created_after);
+  }
+  if (filter.created_before !== undefined) {
+    where((param) => `created_at < ${param}::timestamptz`, filter.created_before);
+  }
+  if (filter.tag !== undefined) {
+    where((param) => `tags @> jsonb_build_array(${param}::text)`, filter.tag);
+  }
+  for (const [key, value] of Object.entries(filter.metadata ?? {})) {
+    where((param) => `${metadataValue(key)} = ${param}`, value);
+  }
+  return conditions;
+}
+
+// A metadata key's value, spelled the same in indexes and in queries so the planner matches them up.
+function metadataValue(key: string) {
+  if (!METADATA_KEY_PATTERN.test(key)) {
+    throw new Error(`invalid metadata key: ${key}`);
+  }
+  return `metadata->>'${key}'`;
+}
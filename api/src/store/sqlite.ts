@@ -0,0 +1,523 @@
+import fs from 'node:fs';
+import path from 'node:path';
+import { DatabaseSync } from 'node:sqlite';
+import { decodeRunRecord } from '../core/schema.js';
+import type { ExecutionEvent, RunArtifact, RunRecord } from '../core/types.js';
+import type {
+  ApiKeyRecord,
+  ApiKeyStore,
+  ExecutionCursor,
+  ExecutionFilter,
+  ExecutionStore,
+  ExecutionSummary,
+  ScheduleRecord,
+  ScheduleRunRecord,
+  ScheduleStore,
+  SettingsStore,
+  SimilarExecution,
+  SimilarityQuery,
+  SubmissionRecord,
+  UsageQuery,
+  UsageTotals
+} from './store.js';
+import { COST_FIELDS, METADATA_KEY_PATTERN, withoutInlineContent } from './store.js';
+
+// `status` is `pending` until the execution finishes, then the run's status or `error`; submissions
+// handed back by a draining server wait as `requeued`. The run
+// record is kept without its artifacts, which live in their own table.
+const SCHEMA = `
+CREATE TABLE IF NOT EXISTS executions (
+  id TEXT PRIMARY KEY,
+  api_key TEXT NOT NULL,
+  language TEXT NOT NULL,
+  status TEXT NOT NULL,
+  request TEXT NOT NULL,
+  record TEXT,
+  error TEXT,
+  created_at TEXT NOT NULL,
+  finished_at TEXT,
+  idempotency_key TEXT,
+  tenant TEXT,
+  tags TEXT NOT NULL DEFAULT '[]',
+  metadata TEXT NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS executions_status_created_at ON executions (status, created_at);
+CREATE INDEX IF NOT EXISTS executions_created_at_api_key ON executions (created_at, api_key);
+CREATE INDEX IF NOT EXISTS executions_finished_at ON executions (finished_at);
+CREATE INDEX IF NOT EXISTS executions_api_key_created_at ON executions (api_key, created_at);
+CREATE TABLE IF NOT EXISTS artifacts (
+  run_id TEXT NOT NULL REFERENCES executions (id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  size INTEGER NOT NULL,
+  sha256 TEXT NOT NULL,
+  url TEXT NOT NULL,
+  expires_at TEXT NOT NULL,
+  content_type TEXT NOT NULL,
+  PRIMARY KEY (run_id, name)
+);
+-- Append-only audit trail; events may be written before their execution's row.
+CREATE TABLE IF NOT EXISTS execution_events (
+  execution_id TEXT NOT NULL,
+  seq INTEGER NOT NULL,
+  type TEXT NOT NULL,
+  at TEXT NOT NULL,
+  data TEXT NOT NULL,
+  PRIMARY KEY (execution_id, seq)
+);
+-- Winnowed fingerprints of submissions' sources, one row per hash, looked up by hash.
+CREATE TABLE IF NOT EXISTS fingerprints (
+  execution_id TEXT NOT NULL REFERENCES executions (id) ON DELETE CASCADE,
+  hash INTEGER NOT NULL,
+  PRIMARY KEY (execution_id, hash)
+);
+CREATE INDEX IF NOT EXISTS fingerprints_hash ON fingerprints (hash);
+CREATE TABLE IF NOT EXISTS api_keys (
+  id TEXT PRIMARY KEY,
+  token_sha256 TEXT NOT NULL UNIQUE,
+  label TEXT NOT NULL,
+  rate_limit_rps REAL NOT NULL,
+  burst INTEGER NOT NULL,
+  monthly_executions INTEGER,
+  max_timeout_ms INTEGER,
+  max_memory_mb INTEGER,
+  tenant TEXT,
+  max_concurrent INTEGER,
+  created_at TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS settings (
+  name TEXT PRIMARY KEY,
+  value TEXT NOT NULL,
+  updated_at TEXT NOT NULL
+);
+-- The schedule as JSON, with what it is looked up and compared by in columns of their own.
+CREATE TABLE IF NOT EXISTS schedules (
+  id TEXT PRIMARY KEY,
+  api_key TEXT NOT NULL,
+  revision INTEGER NOT NULL,
+  record TEXT NOT NULL,
+  created_at TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS schedules_api_key_created_at ON schedules (api_key, created_at);
+CREATE TABLE IF NOT EXISTS schedule_runs (
+  seq INTEGER PRIMARY KEY AUTOINCREMENT,
+  schedule_id TEXT NOT NULL REFERENCES schedules (id) ON DELETE CASCADE,
+  record TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS schedule_runs_schedule_id_seq ON schedule_runs (schedule_id, seq);
+`;
+
+export interface SqliteStoreOptions {
+  // Metadata keys listings often filter by, each given an index.
+  metadataIndexes?: string[];
+}
+
+// Execution store in a single SQLite file, using Node's built-in driver. Statements run
+// synchronously, which is fine for the small rows written once per execution.
+export class SqliteStore implements ExecutionStore, ApiKeyStore, SettingsStore, ScheduleStore {
+  private readonly db: DatabaseSync;
+
+  constructor(file: string, options: SqliteStoreOptions = {}) {
+    fs.mkdirSync(path.dirname(file), { recursive: true });
+    this.db = new DatabaseSync(file);
+    this.db.exec('PRAGMA journal_mode = WAL; PRAGMA foreign_keys = ON;');
+    this.db.exec(SCHEMA);
+    // Databases created before idempotency keys, tenants, tags or metadata lack their columns.
+    const columns = this.db.prepare('PRAGMA table_info(executions)').all() as Array<{ name: string }>;
+    const added = [['idempotency_key', 'TEXT'], ['tenant', 'TEXT'], ['tags', "TEXT NOT NULL DEFAULT '[]'"], ['metadata', "TEXT NOT NULL DEFAULT '{}'"]];
+    for (const [name, definition] of added) {
+      if (!columns.some((column) => column.name === name)) {
+        this.db.exec(`ALTER TABLE executions ADD COLUMN ${name} ${definition}`);
+      }
+    }
+    this.db.exec('CREATE INDEX IF NOT EXISTS executions_idempotency_key ON executions (api_key, idempotency_key)');
+    this.db.exec('CREATE INDEX IF NOT EXISTS executions_tenant_created_at ON executions (tenant, created_at)');
+    for (const key of options.metadataIndexes ?? []) {
+      this.db.exec(`CREATE INDEX IF NOT EXISTS executions_metadata_${key}_created_at ON executions (${metadataValue(key)}, created_at)`);
+    }
+  }
+
+  public async saveSubmission(submission: SubmissionRecord) {
+    this.db
+      .prepare(
+        `INSERT INTO executions (id, api_key, language, status, request, created_at, idempotency_key, tenant, tags, metadata)
+         VALUES (?, ?, ?, 'pending', ?, ?, ?, ?, ?, ?)
+         ON CONFLICT (id) DO NOTHING`
+      )
+      .run(
+        submission.id,
+        submission.api_key,
+        submission.language,
+        JSON.stringify(submission.request),
+        submission.created_at,
+        submission.idempotency_key ?? null,
+        submission.tenant ?? null,
+        JSON.stringify(submission.request.tags ?? []),
+        JSON.stringify(submission.request.metadata ?? {})
+      );
+  }
+
+  public async save(run: RunRecord) {
+    const { artifacts, ...record } = withoutInlineContent(run);
+    this.transaction(() => {
+      this.db
+        .prepare(
+          `INSERT INTO executions (id, api_key, language, status, request, record, created_at, finished_at)
+           VALUES (?, '', ?, ?, 'null', ?, ?, ?)
+           ON CONFLICT (id) DO UPDATE SET status = excluded.status, record = excluded.record, finished_at = excluded.finished_at`
+        )
+        .run(run.id, run.language, run.status, JSON.stringify(record), run.created_at, new Date().toISOString());
+      this.db.prepare('DELETE FROM artifacts WHERE run_id = ?').run(run.id);
+      const insert = this.db.prepare(
+        'INSERT INTO artifacts (run_id, name, size, sha256, url, expires_at, content_type) VALUES (?, ?, ?, ?, ?, ?, ?)'
+      );
+      for (const artifact of artifacts) {
+        insert.run(run.id, artifact.name, artifact.size, artifact.sha256, artifact.url, artifact.expires_at, artifact.content_type);
+      }
+    });
+  }
+
+  public async saveError(id: string, message: string) {
+    this.db
+      .prepare(
+        `INSERT INTO executions (id, api_key, language, status, request, error, created_at, finished_at)
+         VALUES (?, '', '', 'error', 'null', ?, ?, ?)
+         ON CONFLICT (id) DO UPDATE SET status = 'error', error = excluded.error, finished_at = excluded.finished_at`
+      )
+      .run(id, message, new Date().toISOString(), new Date().toISOString());
+  }
+
+  public async get(id: string): Promise<RunRecord | null> {
+    const row = this.db.prepare('SELECT record FROM executions WHERE id = ? AND record IS NOT NULL').get(id) as
+      | { record: string }
+      | undefined;
+    if (!row) {
+      return null;
+    }
+    const artifacts = this.db
+      .prepare('SELECT name, size, sha256, url, expires_at, content_type FROM artifacts WHERE run_id = ? ORDER BY name')
+      .all(id) as unknown as RunArtifact[];
+    return { ...decodeRunRecord(JSON.parse(row.record)), artifacts };
+  }
+
+  public async getError(id: string): Promise<string | null> {
+    const row = this.db.prepare("SELECT error FROM executions WHERE id = ? AND status = 'error'").get(id) as
+      | { error: string }
+      | undefined;
+    return row?.error ?? null;
+  }
+
+  public async getSubmission(id: string): Promise<SubmissionRecord | null> {
+    const row = this.db
+      .prepare("SELECT id, api_key, language, request, created_at, idempotency_key FROM executions WHERE id = ? AND api_key != ''")
+      .get(id) as (Omit<SubmissionRecord, 'request'> & { request: string }) | undefined;
+    return row ? { ...row, request: JSON.parse(row.request) } : null;
+  }
+
+  public async failUnfinished(createdBefore: string, message: string): Promise<number> {
+    const result = this.db
+      .prepare("UPDATE executions SET status = 'error', error = ?, finished_at = ? WHERE status = 'pending' AND created_at < ?")
+      .run(message, new Date().toISOString(), createdBefore);
+    return Number(result.changes);
+  }
+
+  public async requeueSubmission(id: string) {
+    this.db.prepare("UPDATE executions SET status = 'requeued' WHERE id = ? AND status = 'pending'").run(id);
+  }
+
+  public async claimRequeued(): Promise<SubmissionRecord[]> {
+    let rows: Array<Omit<SubmissionRecord, 'request'> & { request: string }> = [];
+    this.transaction(() => {
+      rows = this.db
+        .prepare("SELECT id, api_key, language, request, created_at, idempotency_key FROM executions WHERE status = 'requeued' ORDER BY created_at")
+        .all() as typeof rows;
+      this.db.prepare("UPDATE executions SET status = 'pending' WHERE status = 'requeued'").run();
+    });
+    return rows.map((row) => ({ ...row, request: JSON.parse(row.request) }));
+  }
+
+  public async findSubmission(apiKey: string, idempotencyKey: string, since: string): Promise<SubmissionRecord | null> {
+    const row = this.db
+      .prepare(
+        `SELECT id, api_key, language, request, created_at, idempotency_key FROM executions
+         WHERE api_key = ? AND idempotency_key = ? AND created_at >= ? ORDER BY created_at DESC LIMIT 1`
+      )
+      .get(apiKey, idempotencyKey, since) as (Omit<SubmissionRecord, 'request'> & { request: string }) | undefined;
+    return row ? { ...row, request: JSON.parse(row.request) } : null;
+  }
+
+  public async countSubmissions(since: string) {
+    // Rows written by save() alone have no key and belong to nobody's quota.
+    const rows = this.db
+      .prepare("SELECT api_key, COUNT(*) AS count FROM executions WHERE created_at >= ? AND api_key != '' GROUP BY api_key")
+      .all(since) as Array<{ api_key: string; count: number }>;
+    return Object.fromEntries(rows.map((row) => [row.api_key, Number(row.count)]));
+  }
+
+  public async sumCosts(query: UsageQuery) {
+    const values: string[] = [query.since, query.until];
+    let where = "record IS NOT NULL AND api_key != '' AND created_at >= ? AND created_at < ?";
+    if (query.api_key !== undefined) {
+      where += ' AND api_key = ?';
+      values.push(query.api_key);
+    }
+    if (query.tenant !== undefined) {
+      where += ' AND tenant = ?';
+      values.push(query.tenant);
+    }
+    const columns = query.group_by.map((dimension) => (dimension === 'day' ? 'substr(created_at, 1, 10) AS day' : dimension));
+    const positions = query.group_by.map((_, index) => String(index + 1));
+    const cost = (field: string) => `TOTAL(json_extract(record, '$.cost.${field}')) AS ${field}`;
+    const rows = this.db
+      .prepare(
+        `SELECT ${[...columns, 'COUNT(*) AS executions', ...COST_FIELDS.map(cost)].join(', ')}
+         FROM executions WHERE ${where}
+         ${positions.length > 0 ? `GROUP BY ${positions.join(', ')} ORDER BY ${positions.map((position) => `${position} NULLS FIRST`).join(', ')}` : ''}`
+      )
+      .all(...values) as unknown as UsageTotals[];
+    return rows.map((row) => ({ ...row, executions: Number(row.executions) }));
+  }
+
+  public async appendEvent(id: string, event: ExecutionEvent) {
+    this.db
+      .prepare('INSERT INTO execution_events (execution_id, seq, type, at, data) VALUES (?, ?, ?, ?, ?)')
+      .run(id, event.seq, event.type, event.at, JSON.stringify(event.data));
+  }
+
+  public async listEvents(id: string) {
+    const rows = this.db
+      .prepare('SELECT seq, type, at, data FROM execution_events WHERE execution_id = ? ORDER BY seq')
+      .all(id) as Array<Omit<ExecutionEvent, 'data'> & { data: string }>;
+    return rows.map((row) => ({ seq: Number(row.seq), type: row.type, at: row.at, data: JSON.parse(row.data) }));
+  }
+
+  public async listExecutions(filter: ExecutionFilter, limit: number, after?: ExecutionCursor) {
+    const { conditions, values } = filterConditions(filter);
+    if (after) {
+      conditions.push('(created_at < ? OR (created_at = ? AND id < ?))');
+      values.push(after.created_at, after.created_at, after.id);
+    }
+    const rows = this.db
+      .prepare(
+        `SELECT id, language, status, created_at, finished_at, tenant, tags, metadata FROM executions
+         ${conditions.length > 0 ? `WHERE ${conditions.join(' AND ')}` : ''}
+         ORDER BY created_at DESC, id DESC LIMIT ?`
+      )
+      .all(...values, limit) as Array<Omit<ExecutionSummary, 'tags' | 'metadata'> & { tags: string; metadata: string }>;
+    return rows.map(summaryOf);
+  }
+
+  public async saveFingerprint(id: string, hashes: number[]) {
+    this.transaction(() => {
+      this.db.prepare('DELETE FROM fingerprints WHERE execution_id = ?').run(id);
+      const insert = this.db.prepare('INSERT OR IGNORE INTO fingerprints (execution_id, hash) VALUES (?, ?)');
+      for (const hash of hashes) {
+        insert.run(id, hash);
+      }
+    });
+  }
+
+  public async getFingerprint(id: string) {
+    const rows = this.db.prepare('SELECT hash FROM fingerprints WHERE execution_id = ? ORDER BY hash').all(id) as Array<{ hash: number }>;
+    return rows.map((row) => Number(row.hash));
+  }
+
+  // Candidates are the executions sharing a hash with the query, found through the hash index.
+  public async findSimilar(query: SimilarityQuery, limit: number) {
+    const hashes = [...new Set(query.hashes)];
+    const { conditions, values } = filterConditions(query.filter);
+    const rows = this.db
+      .prepare(
+        `WITH matched AS (
+           SELECT execution_id, COUNT(*) AS shared FROM fingerprints
+           WHERE hash IN (SELECT value FROM json_each(?)) AND execution_id != ?
+           GROUP BY execution_id
+         ), scored AS (
+           SELECT execution_id, shared,
+                  shared * 1.0 / (? + (SELECT COUNT(*) FROM fingerprints f WHERE f.execution_id = matched.execution_id) - shared) AS similarity
+           FROM matched
+         )
+         SELECT id, language, status, created_at, finished_at, tenant, tags, metadata, shared, similarity
+         FROM scored JOIN executions ON executions.id = scored.execution_id
+         WHERE similarity >= ? ${conditions.map((condition) => `AND ${condition}`).join(' ')}
+         ORDER BY similarity DESC, created_at DESC, id DESC LIMIT ?`
+      )
+      .all(JSON.stringify(hashes), query.exclude_id ?? '', hashes.length, query.threshold, ...values, limit) as Array<
+        Omit<ExecutionSummary, 'tags' | 'metadata'> & { tags: string; metadata: string; shared: number; similarity: number }
+      >;
+    return rows.map((row): SimilarExecution => ({ ...summaryOf(row), shared: Number(row.shared), similarity: Number(row.similarity) }));
+  }
+
+  public async listFinished(finishedBefore: string, limit: number) {
+    const rows = this.db
+      .prepare(
+        `SELECT id FROM executions WHERE finished_at < ? AND status NOT IN ('pending', 'requeued')
+         ORDER BY finished_at LIMIT ?`
+      )
+      .all(finishedBefore, limit) as Array<{ id: string }>;
+    return rows.map((row) => row.id);
+  }
+
+  // Artifacts and the fingerprint go with the row; events have no foreign key, since they may come first.
+  public async deleteExecution(id: string) {
+    this.transaction(() => {
+      this.db.prepare('DELETE FROM execution_events WHERE execution_id = ?').run(id);
+      this.db.prepare('DELETE FROM executions WHERE id = ?').run(id);
+    });
+  }
+
+  public async listApiKeys() {
+    return this.db.prepare('SELECT * FROM api_keys ORDER BY created_at').all() as unknown as ApiKeyRecord[];
+  }
+
+  public async saveApiKey(key: ApiKeyRecord) {
+    this.db
+      .prepare(
+        `INSERT INTO api_keys (id, token_sha256, label, rate_limit_rps, burst, monthly_executions, max_timeout_ms, max_memory_mb, tenant, max_concurrent, created_at)
+         VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+         ON CONFLICT (id) DO UPDATE SET label = excluded.label, rate_limit_rps = excluded.rate_limit_rps, burst = excluded.burst,
+           monthly_executions = excluded.monthly_executions, max_timeout_ms = excluded.max_timeout_ms, max_memory_mb = excluded.max_memory_mb,
+           tenant = excluded.tenant, max_concurrent = excluded.max_concurrent`
+      )
+      .run(
+        key.id,
+        key.token_sha256,
+        key.label,
+        key.rate_limit_rps,
+        key.burst,
+        key.monthly_executions,
+        key.max_timeout_ms,
+        key.max_memory_mb,
+        key.tenant,
+        key.max_concurrent,
+        key.created_at
+      );
+  }
+
+  public async deleteApiKey(id: string) {
+    return Number(this.db.prepare('DELETE FROM api_keys WHERE id = ?').run(id).changes) > 0;
+  }
+
+  public async getSetting(name: string) {
+    const row = this.db.prepare('SELECT value FROM settings WHERE name = ?').get(name) as { value: string } | undefined;
+    return row ? JSON.parse(row.value) : null;
+  }
+
+  public async saveSetting(name: string, value: unknown) {
+    this.db
+      .prepare(
+        `INSERT INTO settings (name, value, updated_at) VALUES (?, ?, ?)
+         ON CONFLICT (name) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`
+      )
+      .run(name, JSON.stringify(value), new Date().toISOString());
+  }
+
+  public async listSchedules(apiKey?: string) {
+    const rows = this.db
+      .prepare('SELECT record FROM schedules WHERE ? IS NULL OR api_key = ? ORDER BY created_at')
+      .all(apiKey ?? null, apiKey ?? null) as Array<{ record: string }>;
+    return rows.map((row) => JSON.parse(row.record) as ScheduleRecord);
+  }
+
+  public async getSchedule(id: string) {
+    const row = this.db.prepare('SELECT record FROM schedules WHERE id = ?').get(id) as { record: string } | undefined;
+    return row ? (JSON.parse(row.record) as ScheduleRecord) : null;
+  }
+
+  public async saveSchedule(schedule: ScheduleRecord) {
+    const record = JSON.stringify(schedule);
+    const result = schedule.revision === 1
+      ? this.db
+        .prepare('INSERT INTO schedules (id, api_key, revision, record, created_at) VALUES (?, ?, 1, ?, ?) ON CONFLICT (id) DO NOTHING')
+        .run(schedule.id, schedule.api_key, record, schedule.created_at)
+      : this.db
+        .prepare('UPDATE schedules SET revision = ?, record = ? WHERE id = ? AND revision = ?')
+        .run(schedule.revision, record, schedule.id, schedule.revision - 1);
+    return Number(result.changes) > 0;
+  }
+
+  // The history goes with the row.
+  public async deleteSchedule(id: string) {
+    return Number(this.db.prepare('DELETE FROM schedules WHERE id = ?').run(id).changes) > 0;
+  }
+
+  public async appendScheduleRun(run: ScheduleRunRecord, keep: number) {
+    this.transaction(() => {
+      this.db.prepare('INSERT INTO schedule_runs (schedule_id, record) VALUES (?, ?)').run(run.schedule_id, JSON.stringify(run));
+      this.db
+        .prepare(
+          `DELETE FROM schedule_runs WHERE schedule_id = ? AND seq NOT IN
+             (SELECT seq FROM schedule_runs WHERE schedule_id = ? ORDER BY seq DESC LIMIT ?)`
+        )
+        .run(run.schedule_id, run.schedule_id, keep);
+    });
+  }
+
+  public async listScheduleRuns(scheduleId: string, limit: number) {
+    const rows = this.db
+      .prepare('SELECT record FROM schedule_runs WHERE schedule_id = ? ORDER BY seq DESC LIMIT ?')
+      .all(scheduleId, limit) as Array<{ record: string }>;
+    return rows.map((row) => JSON.parse(row.record) as ScheduleRunRecord);
+  }
+
+  public async close() {
+    this.db.close();
+  }
+
+  private transaction(work: () => void) {
+    this.db.exec('BEGIN');
+    try {
+      work();
+      this.db.exec('COMMIT');
+    } catch (err) {
+      this.db.exec('ROLLBACK');
+      throw err;
+    }
+  }
+}
+
+// A metadata key's value, spelled the same in indexes and in queries so SQLite matches them up.
+function metadataValue(key: string) {
+  if (!METADATA_KEY_PATTERN.test(key)) {
+    throw new Error(`invalid metadata key: ${key}`);
+  }
+  return `json_extract(metadata, '$.${key}')`;
+}
+
+// Conditions on executions' columns for every field of the filter that is set, with their parameters.
+function filterConditions(filter: ExecutionFilter) {
+  const conditions: string[] = [];
+  const values: string[] = [];
+  const where = (condition: string, ...params: string[]) => {
+    conditions.push(condition);
+    values.push(...params);
+  };
+  if (filter.api_key !== undefined) {
+    where('api_key = ?', filter.api_key);
+  }
+  if (filter.tenant !== undefined) {
+    where('tenant = ?', filter.tenant);
+  }
+  if (filter.language !== undefined) {
+    where('language = ?', filter.language);
+  }
+  if (filter.statuses !== undefined) {
+    where(`status IN (${filter.statuses.map(() => '?').join(', ')})`, ...filter.statuses);
+  }
+  if (filter.created_after !== undefined) {
+    where('created_at >= ?', filter.created_after);
+  }
+  if (filter.created_before !== undefined) {
+    where('created_at < ?', filter.created_before);
+  }
+  if (filter.tag !== undefined) {
+    where('EXISTS (SELECT 1 FROM json_each(executions.tags) WHERE value = ?)', filter.tag);
+  }
+  for (const [key, value] of Object.entries(filter.metadata ?? {})) {
+    where(`${metadataValue(key)} = ?`, value);
+  }
+  return { conditions, values };
+}
+
+function summaryOf<T extends { tags: string; metadata: string }>(row: T) {
+  return { ...row, tags: JSON.parse(row.tags) as string[], metadata: JSON.parse(row.metadata) as Record<string, string> };
+}
@@ -0,0 +1,251 @@
+import type { ExecutionEvent, RunRecord, RunRequest } from '../core/types.js';
+
+// A submission as accepted, before it has a result.
+export interface SubmissionRecord {
+  id: string;
+  api_key: string;
+  language: string;
+  request: RunRequest;
+  created_at: string;
+  // Idempotency-Key the submission came with, scoped to its API key.
+  idempotency_key?: string;
+  // Tenant of the key at the time, as named in logs; listings filter on it.
+  tenant?: string;
+}
+
+// An execution as listed, without its request or result.
+export interface ExecutionSummary {
+  id: string;
+  language: string;
+  // `pending` until it finishes and `requeued` while handed back, then the run's status or `error`.
+  status: string;
+  created_at: string;
+  finished_at: string | null;
+  tenant: string | null;
+  tags: string[];
+  metadata: Record<string, string>;
+}
+
+// Narrows a listing; executions match every field that is set.
+export interface ExecutionFilter {
+  api_key?: string;
+  tenant?: string;
+  language?: string;
+  // Any of these summary statuses.
+  statuses?: string[];
+  // Created at or after `created_after` and before `created_before`.
+  created_after?: string;
+  created_before?: string;
+  // One of the request's tags.
+  tag?: string;
+  // Each of these keys with exactly this value in the request's metadata.
+  metadata?: Record<string, string>;
+}
+
+export type UsageDimension = 'api_key' | 'tenant' | 'day';
+
+export interface UsageQuery {
+  // Executions created at or after `since` and before `until`.
+  since: string;
+  until: string;
+  api_key?: string;
+  tenant?: string;
+  group_by: UsageDimension[];
+}
+
+// What a group of executions cost together. Each field of the query's group_by is set.
+export interface UsageTotals {
+  api_key?: string;
+  tenant?: string | null;
+  // UTC date of creation, YYYY-MM-DD.
+  day?: string;
+  // Those with a run record; executions that errored or haven't finished cost nothing yet.
+  executions: number;
+  cpu_seconds: number;
+  memory_gb_seconds: number;
+  sandbox_seconds: number;
+  units: number;
+}
+
+// The fields of a run's cost that usage reports add up.
+export const COST_FIELDS = ['cpu_seconds', 'memory_gb_seconds', 'sandbox_seconds', 'units'] as const;
+
+// Where a page of a listing starts: after the execution of that id, created at that time.
+export interface ExecutionCursor {
+  created_at: string;
+  id: string;
+}
+
+// Which stored fingerprints to compare with `hashes`; see findSimilar.
+export interface SimilarityQuery {
+  hashes: number[];
+  // Least similarity a match has, from 0 to 1.
+  threshold: number;
+  // Left out of the matches, e.g. the execution `hashes` are of.
+  exclude_id?: string;
+  filter: ExecutionFilter;
+}
+
+// An execution whose fingerprint resembles the one queried for.
+export interface SimilarExecution extends ExecutionSummary {
+  // Hashes the two fingerprints have in common, and those over the hashes of either.
+  shared: number;
+  similarity: number;
+}
+
+// Where executions are kept so their results stay retrievable by ID, across restarts for the
+// persistent backends. Submissions are recorded when accepted and completed with either their run
+// record or the error that ended them.
+export interface ExecutionStore {
+  saveSubmission(submission: SubmissionRecord): Promise<void>;
+  save(run: RunRecord): Promise<void>;
+  // Records why an execution ended without producing a run record.
+  saveError(id: string, message: string): Promise<void>;
+  get(id: string): Promise<RunRecord | null>;
+  getError(id: string): Promise<string | null>;
+  // The submission as accepted, request included; null for unknown IDs and rows written by
+  // save() or saveError() alone.
+  getSubmission(id: string): Promise<SubmissionRecord | null>;
+  // Ends submissions accepted before `createdBefore` that never finished, e.g. because the server
+  // restarted mid-run, with `message` as their error. Resolves to how many there were.
+  failUnfinished(createdBefore: string, message: string): Promise<number>;
+  // Hands back a submission that never started, e.g. when this server drains on shutdown, for
+  // the next server to resume; failUnfinished leaves it alone.
+  requeueSubmission(id: string): Promise<void>;
+  // Takes the requeued submissions, oldest first. Each goes to one caller only and is unfinished
+  // again from then on.
+  claimRequeued(): Promise<SubmissionRecord[]>;
+  // The latest submission by `apiKey` with that Idempotency-Key accepted since `since`.
+  findSubmission(apiKey: string, idempotencyKey: string, since: string): Promise<SubmissionRecord | null>;
+  // Submissions accepted since `since`, by API key; what monthly quotas are measured against.
+  countSubmissions(since: string): Promise<Record<string, number>>;
+  // The cost of the finished executions the query selects, one entry per group, ordered by the
+  // grouped fields (nulls first); a single entry when grouped by nothing.
+  sumCosts(query: UsageQuery): Promise<UsageTotals[]>;
+  // Adds a step to the execution's audit trail; events are never changed once written.
+  appendEvent(id: string, event: ExecutionEvent): Promise<void>;
+  // The audit trail by seq; empty for unknown IDs.
+  listEvents(id: string): Promise<ExecutionEvent[]>;
+  // A page of the submissions that match `filter`, newest first, starting after `after` when given.
+  listExecutions(filter: ExecutionFilter, limit: number, after?: ExecutionCursor): Promise<ExecutionSummary[]>;
+  // Up to `limit` executions that finished before `finishedBefore`, oldest first; what retention
+  // archives or deletes. Saving an execution again counts as finishing it then.
+  listFinished(finishedBefore: string, limit: number): Promise<string[]>;
+  // Keeps the winnowed fingerprint of an execution's sources next to it; saving another replaces it.
+  saveFingerprint(id: string, hashes: number[]): Promise<void>;
+  // Empty for executions without one.
+  getFingerprint(id: string): Promise<number[]>;
+  // Up to `limit` executions that match the query's filter and whose fingerprint is at least its
+  // threshold similar to `hashes`, most similar first, then newest first.
+  findSimilar(query: SimilarityQuery, limit: number): Promise<SimilarExecution[]>;
+  // Removes the execution with its artifacts, fingerprint and audit trail.
+  deleteExecution(id: string): Promise<void>;
+  close(): Promise<void>;
+}
+
+// An API key issued through the admin API. Only the token's SHA-256 is kept; the token itself
+// is returned once, when the key is created.
+export interface ApiKeyRecord {
+  id: string;
+  token_sha256: string;
+  label: string;
+  rate_limit_rps: number;
+  burst: number;
+  // Executions per calendar month (UTC); unlimited when null.
+  monthly_executions: number | null;
+  // Replace the server's limits.max for this key's runs when set.
+  max_timeout_ms: number | null;
+  max_memory_mb: number | null;
+  // Keys of one tenant share its rate limit and concurrency cap.
+  tenant: string | null;
+  max_concurrent: number | null;
+  created_at: string;
+}
+
+// Issued API keys, kept next to the executions by every store backend.
+export interface ApiKeyStore {
+  listApiKeys(): Promise<ApiKeyRecord[]>;
+  saveApiKey(key: ApiKeyRecord): Promise<void>;
+  // Resolves to whether a key with that id existed.
+  deleteApiKey(id: string): Promise<boolean>;
+}
+
+// Settings changed at runtime through the admin API, as JSON values by name, kept by every store
+// backend so they outlive a restart and reach every instance sharing the store.
+export interface SettingsStore {
+  // Null for a setting that was never saved.
+  getSetting(name: string): Promise<unknown>;
+  saveSetting(name: string, value: unknown): Promise<void>;
+}
+
+export type OverlapPolicy = 'skip' | 'queue';
+
+export type ScheduleNotifyEvent = 'succeeded' | 'failed' | 'skipped';
+
+// Where a schedule reports its occurrences, as signed webhook deliveries.
+export interface ScheduleNotify {
+  url: string;
+  on: ScheduleNotifyEvent[];
+}
+
+// A submission that runs on a cron expression as the API key that registered it.
+export interface ScheduleRecord {
+  id: string;
+  api_key: string;
+  name: string;
+  cron: string;
+  request: RunRequest;
+  // What happens to an occurrence that comes due while the previous one is still running.
+  overlap: OverlapPolicy;
+  notify: ScheduleNotify | null;
+  enabled: boolean;
+  created_at: string;
+  // When the next occurrence is due; recomputed from the time a schedule is enabled again.
+  next_run_at: string;
+  // The execution of the latest occurrence that started.
+  last_execution_id: string | null;
+  // When the occurrence waiting for the previous one to finish came due, with overlap `queue`.
+  queued_at: string | null;
+  // Counts the saves of the schedule: the first save is revision 1, each later one adds 1.
+  revision: number;
+}
+
+export type ScheduleRunOutcome = 'started' | 'skipped' | 'queued' | 'failed';
+
+// One occurrence of a schedule: started as `execution_id`, skipped or queued behind the previous
+// one, or failed to start with `error`.
+export interface ScheduleRunRecord {
+  schedule_id: string;
+  scheduled_at: string;
+  recorded_at: string;
+  outcome: ScheduleRunOutcome;
+  execution_id: string | null;
+  error: string | null;
+}
+
+// Schedules and their history, kept next to the executions by every store backend. Servers
+// sharing a store all run the schedules, so saves compare revisions and only one of them gets to
+// start an occurrence.
+export interface ScheduleStore {
+  // Every key's schedules when `apiKey` is left out, oldest first.
+  listSchedules(apiKey?: string): Promise<ScheduleRecord[]>;
+  getSchedule(id: string): Promise<ScheduleRecord | null>;
+  // Stores revision 1 as a new schedule and later revisions over the one before; resolves to
+  // false, without saving, when the stored schedule is not at the revision before, e.g. because
+  // another server saved it first.
+  saveSchedule(schedule: ScheduleRecord): Promise<boolean>;
+  // Takes the schedule's history with it; resolves to whether the schedule existed.
+  deleteSchedule(id: string): Promise<boolean>;
+  // Adds an occurrence and drops all but the latest `keep` of the schedule's.
+  appendScheduleRun(run: ScheduleRunRecord, keep: number): Promise<void>;
+  // The latest occurrences, newest first.
+  listScheduleRuns(scheduleId: string, limit: number): Promise<ScheduleRunRecord[]>;
+}
+
+// Metadata keys are spliced into JSON paths and index names, so they keep to identifier characters.
+export const METADATA_KEY_PATTERN = /^[A-Za-z][A-Za-z0-9_]{0,63}$/;
+
+// Inline artifact contents are returned once with the run and never persisted.
+export function withoutInlineContent(run: RunRecord): RunRecord {
+  return { ...run, artifacts: run.artifacts.map(({ content: _content, ...artifact }) => artifact) };
+}
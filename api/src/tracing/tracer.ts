@@ -0,0 +1,203 @@
+import crypto from 'node:crypto';
+import { Logger } from '../util/logger.js';
+
+// Lightweight OpenTelemetry-compatible tracing: W3C trace context propagation and OTLP/HTTP JSON
+// export, enough to follow a submission through the pipeline without the full SDK.
+
+export interface SpanContext {
+  traceId: string;
+  spanId: string;
+  sampled: boolean;
+}
+
+export type AttributeValue = string | number | boolean;
+
+export interface SpanData {
+  name: string;
+  kind: 'server' | 'internal';
+  traceId: string;
+  spanId: string;
+  parentSpanId: string | null;
+  startMs: number;
+  endMs: number;
+  attributes: Record<string, AttributeValue>;
+  error: string | null;
+}
+
+export interface SpanExporter {
+  export(spans: SpanData[]): void;
+}
+
+export interface StartSpanOptions {
+  parent?: SpanContext | null;
+  kind?: SpanData['kind'];
+  // Defaults to now; used to place spans for work whose start was only recorded as a timestamp.
+  startMs?: number;
+  attributes?: Record<string, AttributeValue>;
+}
+
+const TRACEPARENT_PATTERN = /^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$/;
+
+// Parses a W3C `traceparent` header; null when it is missing or malformed.
+export function parseTraceparent(header: string | string[] | undefined): SpanContext | null {
+  const value = Array.isArray(header) ? header[0] : header;
+  const match = TRACEPARENT_PATTERN.exec(value?.trim().toLowerCase() ?? '');
+  if (!match || /^0+$/.test(match[1]) || /^0+$/.test(match[2])) {
+    return null;
+  }
+  return { traceId: match[1], spanId: match[2], sampled: (parseInt(match[3], 16) & 1) === 1 };
+}
+
+export function formatTraceparent(context: SpanContext): string {
+  return `00-${context.traceId}-${context.spanId}-${context.sampled ? '01' : '00'}`;
+}
+
+export class Span {
+  public readonly context: SpanContext;
+  private readonly attributes: Record<string, AttributeValue>;
+  private error: string | null = null;
+  private ended = false;
+
+  constructor(
+    private readonly tracer: Tracer,
+    private readonly name: string,
+    private readonly options: StartSpanOptions
+  ) {
+    this.context = {
+      traceId: options.parent?.traceId ?? crypto.randomBytes(16).toString('hex'),
+      spanId: crypto.randomBytes(8).toString('hex'),
+      sampled: options.parent?.sampled ?? true
+    };
+    this.attributes = { ...options.attributes };
+  }
+
+  public setAttribute(key: string, value: AttributeValue | null | undefined) {
+    if (value !== null && value !== undefined) {
+      this.attributes[key] = value;
+    }
+  }
+
+  public setError(message: string) {
+    this.error = message;
+  }
+
+  public end(endMs = Date.now()) {
+    if (this.ended) {
+      return;
+    }
+    this.ended = true;
+    if (this.context.sampled) {
+      this.tracer.record({
+        name: this.name,
+        kind: this.options.kind ?? 'internal',
+        traceId: this.context.traceId,
+        spanId: this.context.spanId,
+        parentSpanId: this.options.parent?.spanId ?? null,
+        startMs: this.options.startMs ?? endMs,
+        endMs,
+        attributes: this.attributes,
+        error: this.error
+      });
+    }
+  }
+}
+
+export class Tracer {
+  constructor(private readonly exporter: SpanExporter) {}
+
+  public startSpan(name: string, options: StartSpanOptions = {}): Span {
+    return new Span(this, name, { ...options, startMs: options.startMs ?? Date.now() });
+  }
+
+  public record(span: SpanData) {
+    this.exporter.export([span]);
+  }
+}
+
+export interface OtlpExporterOptions {
+  // Full URL of the collector's OTLP/HTTP traces endpoint, e.g. http://collector:4318/v1/traces.
+  url: string;
+  serviceName: string;
+  // Spans are sent in batches at this interval or once this many are buffered.
+  flushIntervalMs?: number;
+  maxBatchSize?: number;
+}
+
+// Buffers finished spans and posts them to an OpenTelemetry collector as OTLP JSON. Export
+// failures are logged and the batch dropped; tracing never holds up runs.
+export class OtlpHttpExporter implements SpanExporter {
+  private buffer: SpanData[] = [];
+  private readonly timer: NodeJS.Timeout;
+
+  constructor(private readonly options: OtlpExporterOptions, private readonly logger: Logger) {
+    this.timer = setInterval(() => void this.flush(), options.flushIntervalMs ?? 5000);
+    this.timer.unref();
+  }
+
+  public export(spans: SpanData[]) {
+    this.buffer.push(...spans);
+    if (this.buffer.length >= (this.options.maxBatchSize ?? 512)) {
+      void this.flush();
+    }
+  }
+
+  public async flush() {
+    if (this.buffer.length === 0) {
+      return;
+    }
+    const spans = this.buffer;
+    this.buffer = [];
+    try {
+      const response = await fetch(this.options.url, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(toOtlp(spans, this.options.serviceName))
+      });
+      if (!response.ok) {
+        this.logger.warn('trace export rejected', { status: response.status, spans: spans.length });
+      }
+    } catch (err) {
+      this.logger.warn('trace export failed', { message: (err as Error).message, spans: spans.length });
+    }
+  }
+}
+
+export function toOtlp(spans: SpanData[], serviceName: string) {
+  return {
+    resourceSpans: [
+      {
+        resource: { attributes: toAttributes({ 'service.name': serviceName }) },
+        scopeSpans: [
+          {
+            scope: { name: 'code-executor' },
+            spans: spans.map((span) => ({
+              traceId: span.traceId,
+              spanId: span.spanId,
+              parentSpanId: span.parentSpanId ?? undefined,
+              name: span.name,
+              // SPAN_KIND_INTERNAL and SPAN_KIND_SERVER.
+              kind: span.kind === 'server' ? 2 : 1,
+              startTimeUnixNano: `${span.startMs}000000`,
+              endTimeUnixNano: `${span.endMs}000000`,
+              attributes: toAttributes(span.attributes),
+              // STATUS_CODE_ERROR or STATUS_CODE_UNSET.
+              status: span.error === null ? { code: 0 } : { code: 2, message: span.error }
+            }))
+          }
+        ]
+      }
+    ]
+  };
+}
+
+function toAttributes(attributes: Record<string, AttributeValue>) {
+  return Object.entries(attributes).map(([key, value]) => {
+    if (typeof value === 'boolean') {
+      return { key, value: { boolValue: value } };
+    }
+    if (typeof value === 'number') {
+      return { key, value: Number.isInteger(value) ? { intValue: String(value) } : { doubleValue: value } };
+    }
+    return { key, value: { stringValue: value } };
+  });
+}
@@ -1,4 +1,83 @@
+import { AsyncLocalStorage, AsyncResource } from 'node:async_hooks';
 import crypto from 'node:crypto';
+import type { NextFunction, Request, Response } from 'express';
+
+export type LogLevel = 'debug' | 'info' | 'warn' | 'error';
+
+export const LOG_LEVELS: LogLevel[] = ['debug', 'info', 'warn', 'error'];
+
+// What every line logged on behalf of a request or run carries, whichever component logs it.
+export interface LogContext {
+  requestId?: string;
+  runId?: string;
+  language?: string;
+  tenant?: string;
+  // Where the run is: queued, compiling, running, artifacts or finished.
+  phase?: string;
+  // Logs debug lines for this request or run whatever the level, to trace one submission.
+  debug?: boolean;
+}
+
+const contexts = new AsyncLocalStorage<LogContext>();
+let minimumLevel: LogLevel = 'info';
+
+// Lines below the level are dropped unless their request or run asked for debug logging.
+export function setLogLevel(level: LogLevel) {
+  minimumLevel = level;
+}
+
+// Runs fn with the context added to the current one; it follows fn's callbacks and promises.
+export function withLogContext<T>(context: LogContext, fn: () => T): T {
+  return contexts.run({ ...contexts.getStore(), ...context }, fn);
+}
+
+// Adds to the context for the rest of the current call and what it starts, for handlers that
+// cannot wrap their body, such as gRPC ones once the caller is known.
+export function enterLogContext(context: LogContext) {
+  contexts.enterWith({ ...contexts.getStore(), ...context });
+}
+
+export function currentLogContext(): LogContext {
+  return { ...contexts.getStore() };
+}
+
+// Moves the current run on to another phase; only the run's own context when runId is given,
+// for callbacks that may fire from elsewhere.
+export function setLogPhase(phase: string, runId?: string) {
+  const context = contexts.getStore();
+  if (context && (runId === undefined || context.runId === runId)) {
+    context.phase = phase;
+  }
+}
+
+// The context of a request from its X-Request-Id and X-Log-Level headers, or the gRPC metadata
+// of the same names. Request IDs callers send are kept so their logs and ours line up; any
+// other request gets a new one. Debug logging is only honoured when allowDebug is set.
+export function requestLogContext(requestId: string | undefined, level: string | undefined, allowDebug: boolean): LogContext {
+  return {
+    requestId: requestId && /^[\w.:-]{1,128}$/.test(requestId) ? requestId : `req_${crypto.randomBytes(8).toString('hex')}`,
+    debug: allowDebug && level?.trim().toLowerCase() === 'debug'
+  };
+}
+
+// Runs the rest of every request in its log context and echoes its request ID back.
+export function logContextMiddleware(options: { allowDebug: boolean; logger: Logger }) {
+  return (req: Request, res: Response, next: NextFunction) => {
+    const context = requestLogContext(req.get('x-request-id'), req.get('x-log-level'), options.allowDebug);
+    res.set('X-Request-Id', context.requestId);
+    const started = Date.now();
+    withLogContext(context, () => {
+      // Bound, because the response emits finish from outside the request's context.
+      res.on(
+        'finish',
+        AsyncResource.bind(() =>
+          options.logger.debug('request handled', { method: req.method, path: req.path, status: res.statusCode, durationMs: Date.now() - started })
+        )
+      );
+      next();
+    });
+  };
+}
 
 export class Logger {
   constructor(private readonly context: Record<string, string> = {}) {}
@@ -7,6 +86,10 @@ export class Logger {
     return new Logger({ ...this.context, ...extra });
   }
 
+  public debug(message: string, meta: Record<string, unknown> = {}) {
+    this.log('debug', message, meta);
+  }
+
   public info(message: string, meta: Record<string, unknown> = {}) {
     this.log('info', message, meta);
   }
@@ -19,12 +102,17 @@ export class Logger {
     this.log('error', message, meta);
   }
 
-  private log(level: string, message: string, meta: Record<string, unknown>) {
+  private log(level: LogLevel, message: string, meta: Record<string, unknown>) {
+    const { debug, ...scope } = contexts.getStore() ?? {};
+    if (LOG_LEVELS.indexOf(level) < LOG_LEVELS.indexOf(debug ? 'debug' : minimumLevel)) {
+      return;
+    }
     const payload = {
       level,
       message,
       time: new Date().toISOString(),
       ...this.context,
+      ...scope,
       ...meta
     };
     process.stdout.write(`${JSON.stringify(payload)}\n`);
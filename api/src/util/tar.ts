@@ -0,0 +1,208 @@
+import fs from 'node:fs';
+import zlib from 'node:zlib';
+
+export interface TarEntry {
+  name: string;
+  data: Buffer;
+  // Permission bits; 0o644 when unset.
+  mode?: number;
+}
+
+// A regular file of a tar archive on disk: where its contents start and how long they are.
+export interface TarFileEntry {
+  name: string;
+  mode: number;
+  offset: number;
+  size: number;
+}
+
+const BLOCK = 512;
+
+// Writes regular files as a gzipped ustar archive, which `tar -xzf` and every common tool read.
+// Names longer than 100 bytes are split into the ustar prefix field at a slash.
+export function packTarGz(entries: TarEntry[], mtime = new Date()): Buffer {
+  const blocks: Buffer[] = [];
+  for (const entry of entries) {
+    blocks.push(header(entry, Math.floor(mtime.getTime() / 1000)), entry.data);
+    const padding = (BLOCK - (entry.data.length % BLOCK)) % BLOCK;
+    if (padding > 0) {
+      blocks.push(Buffer.alloc(padding));
+    }
+  }
+  // Two zero blocks mark the end of the archive.
+  blocks.push(Buffer.alloc(BLOCK * 2));
+  return zlib.gzipSync(Buffer.concat(blocks));
+}
+
+// Reads the regular files of a gzipped (or plain) tar archive; directories, links and other
+// entry types are skipped.
+export function unpackTarGz(archive: Buffer): TarEntry[] {
+  const data = archive[0] === 0x1f && archive[1] === 0x8b ? zlib.gunzipSync(archive) : archive;
+  const entries: TarEntry[] = [];
+  let offset = 0;
+  while (offset + BLOCK <= data.length) {
+    const block = data.subarray(offset, offset + BLOCK);
+    if (block.every((byte) => byte === 0)) {
+      break;
+    }
+    if (checksum(block) !== readOctal(block, 148, 8)) {
+      throw new Error('corrupt tar archive: header checksum mismatch');
+    }
+    const size = readOctal(block, 124, 12);
+    const type = String.fromCharCode(block[156]);
+    const prefix = readString(block, 345, 155);
+    const name = readString(block, 0, 100);
+    const start = offset + BLOCK;
+    if (start + size > data.length) {
+      throw new Error('corrupt tar archive: truncated entry');
+    }
+    if (type === '0' || type === '\0') {
+      entries.push({
+        name: prefix ? `${prefix}/${name}` : name,
+        data: Buffer.from(data.subarray(start, start + size)),
+        mode: readOctal(block, 100, 8)
+      });
+    }
+    offset = start + Math.ceil(size / BLOCK) * BLOCK;
+  }
+  return entries;
+}
+
+// Lists the regular files of an uncompressed tar archive on disk without reading their
+// contents, so archives larger than memory can be extracted one entry at a time. GNU long names
+// and pax paths are honoured. Links and special files are refused rather than skipped, so that
+// what is extracted never silently lacks a file the archive meant to hold.
+export function listTarFile(file: string): TarFileEntry[] {
+  const fd = fs.openSync(file, 'r');
+  try {
+    const length = fs.fstatSync(fd).size;
+    const block = Buffer.alloc(BLOCK);
+    const entries: TarFileEntry[] = [];
+    // Set by a GNU long-name or pax header for the entry that follows it.
+    let nextName: string | null = null;
+    let offset = 0;
+    while (offset + BLOCK <= length) {
+      fs.readSync(fd, block, 0, BLOCK, offset);
+      if (block.every((byte) => byte === 0)) {
+        break;
+      }
+      if (checksum(block) !== readOctal(block, 148, 8)) {
+        throw new Error('corrupt tar archive: header checksum mismatch');
+      }
+      const size = readSize(block);
+      const type = String.fromCharCode(block[156]);
+      const start = offset + BLOCK;
+      if (start + size > length) {
+        throw new Error('corrupt tar archive: truncated entry');
+      }
+      // GNU archives keep other fields where ustar has the prefix.
+      const prefix = block.toString('ascii', 257, 263) === 'ustar\0' ? readString(block, 345, 155) : '';
+      const name = nextName ?? (prefix ? `${prefix}/${readString(block, 0, 100)}` : readString(block, 0, 100));
+      if (type === 'L' || type === 'x') {
+        const data = Buffer.alloc(size);
+        fs.readSync(fd, data, 0, size, start);
+        nextName = type === 'L' ? data.toString('utf8').replace(/\0+$/, '') : paxPath(data) ?? nextName;
+      } else {
+        nextName = null;
+        if (type === '0' || type === '\0' || type === '7') {
+          entries.push({ name, mode: readOctal(block, 100, 8), offset: start, size });
+        } else if (type === '1' || type === '2') {
+          throw new Error(`${name} is a link; only regular files and directories are supported`);
+        } else if (type !== '5' && type !== 'g' && type !== 'K') {
+          throw new Error(`${name} is not a regular file or directory`);
+        }
+      }
+      offset = start + Math.ceil(size / BLOCK) * BLOCK;
+    }
+    return entries;
+  } finally {
+    fs.closeSync(fd);
+  }
+}
+
+// pax records are `<length> <key>=<value>\n`; only the path matters here.
+function paxPath(data: Buffer): string | null {
+  let offset = 0;
+  let found: string | null = null;
+  while (offset < data.length) {
+    const space = data.indexOf(0x20, offset);
+    const length = parseInt(data.subarray(offset, space).toString('ascii'), 10);
+    if (space === -1 || !(length > 0)) {
+      break;
+    }
+    const record = data.subarray(space + 1, offset + length - 1).toString('utf8');
+    if (record.startsWith('path=')) {
+      found = record.slice('path='.length);
+    }
+    offset += length;
+  }
+  return found;
+}
+
+// Sizes past 8 GiB are stored base-256, flagged by the high bit of the field.
+function readSize(block: Buffer): number {
+  if ((block[124] & 0x80) === 0) {
+    return readOctal(block, 124, 12);
+  }
+  let size = block[124] & 0x7f;
+  for (let i = 125; i < 136; i++) {
+    size = size * 256 + block[i];
+  }
+  return size;
+}
+
+function header(entry: TarEntry, mtime: number): Buffer {
+  const block = Buffer.alloc(BLOCK);
+  const [prefix, name] = splitName(entry.name);
+  block.write(name, 0, 100, 'utf8');
+  writeOctal(block, entry.mode ?? 0o644, 100, 8);
+  writeOctal(block, 0, 108, 8);
+  writeOctal(block, 0, 116, 8);
+  writeOctal(block, entry.data.length, 124, 12);
+  writeOctal(block, mtime, 136, 12);
+  block.write('0', 156, 1, 'ascii');
+  block.write('ustar\0', 257, 6, 'ascii');
+  block.write('00', 263, 2, 'ascii');
+  block.write(prefix, 345, 155, 'utf8');
+  // The checksum is computed with its own field set to spaces.
+  block.fill(' ', 148, 156);
+  writeOctal(block, checksum(block), 148, 7);
+  return block;
+}
+
+function splitName(name: string): [string, string] {
+  if (Buffer.byteLength(name) <= 100) {
+    return ['', name];
+  }
+  for (let slash = name.indexOf('/'); slash !== -1; slash = name.indexOf('/', slash + 1)) {
+    const prefix = name.slice(0, slash);
+    const rest = name.slice(slash + 1);
+    if (Buffer.byteLength(prefix) <= 155 && Buffer.byteLength(rest) <= 100) {
+      return [prefix, rest];
+    }
+  }
+  throw new Error(`path too long for a tar archive: ${name}`);
+}
+
+function checksum(block: Buffer): number {
+  let sum = 0;
+  for (let i = 0; i < BLOCK; i++) {
+    sum += i >= 148 && i < 156 ? 0x20 : block[i];
+  }
+  return sum;
+}
+
+function writeOctal(block: Buffer, value: number, offset: number, length: number) {
+  block.write(`${value.toString(8).padStart(length - 1, '0')}\0`, offset, length, 'ascii');
+}
+
+function readOctal(block: Buffer, offset: number, length: number): number {
+  const text = readString(block, offset, length).trim();
+  return text ? parseInt(text, 8) : 0;
+}
+
+function readString(block: Buffer, offset: number, length: number): string {
+  const field = block.subarray(offset, offset + length);
+  const end = field.indexOf(0);
+  return field.subarray(0, end === -1 ? length : end).toString('utf8');
+}
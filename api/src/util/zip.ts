@@ -0,0 +1,160 @@
+import fs from 'node:fs';
+import stream from 'node:stream';
+import type { Readable } from 'node:stream';
+import zlib from 'node:zlib';
+
+// A regular file of a zip archive on disk, as its central directory describes it.
+export interface ZipFileEntry {
+  name: string;
+  mode: number;
+  size: number;
+  compressedSize: number;
+  method: number;
+  headerOffset: number;
+}
+
+const END_OF_CENTRAL_DIRECTORY = 0x06054b50;
+const ZIP64_LOCATOR = 0x07064b50;
+const ZIP64_END_OF_CENTRAL_DIRECTORY = 0x06064b50;
+const CENTRAL_FILE_HEADER = 0x02014b50;
+const LOCAL_FILE_HEADER = 0x04034b50;
+const ZIP64_EXTRA = 0x0001;
+const STORED = 0;
+const DEFLATED = 8;
+// The end record is 22 bytes followed by a comment of at most 64 KiB.
+const MAX_END_SEARCH = 22 + 0xffff;
+const UNIX = 3;
+const S_IFMT = 0o170000;
+const S_IFREG = 0o100000;
+const S_IFDIR = 0o040000;
+const S_IFLNK = 0o120000;
+
+// Lists the regular files of a zip archive from its central directory, zip64 included, without
+// reading their contents. Links, encrypted entries and compression methods other than stored
+// and deflate are refused rather than skipped.
+export function listZipFile(file: string): ZipFileEntry[] {
+  const fd = fs.openSync(file, 'r');
+  try {
+    const length = fs.fstatSync(fd).size;
+    const tailLength = Math.min(length, MAX_END_SEARCH);
+    const tail = read(fd, length - tailLength, tailLength);
+    let end = -1;
+    for (let i = tail.length - 22; i >= 0; i--) {
+      if (tail.readUInt32LE(i) === END_OF_CENTRAL_DIRECTORY) {
+        end = i;
+        break;
+      }
+    }
+    if (end === -1) {
+      throw new Error('corrupt zip archive: end of central directory not found');
+    }
+    let count = tail.readUInt16LE(end + 10);
+    let directorySize = tail.readUInt32LE(end + 12);
+    let directoryOffset = tail.readUInt32LE(end + 16);
+    if (end >= 20 && tail.readUInt32LE(end - 20) === ZIP64_LOCATOR) {
+      const record = read(fd, Number(tail.readBigUInt64LE(end - 12)), 56);
+      if (record.readUInt32LE(0) !== ZIP64_END_OF_CENTRAL_DIRECTORY) {
+        throw new Error('corrupt zip archive: zip64 end of central directory not found');
+      }
+      count = Number(record.readBigUInt64LE(32));
+      directorySize = Number(record.readBigUInt64LE(40));
+      directoryOffset = Number(record.readBigUInt64LE(48));
+    }
+    if (directoryOffset + directorySize > length) {
+      throw new Error('corrupt zip archive: central directory out of range');
+    }
+    const directory = read(fd, directoryOffset, directorySize);
+    const entries: ZipFileEntry[] = [];
+    let offset = 0;
+    for (let index = 0; index < count; index++) {
+      if (offset + 46 > directory.length || directory.readUInt32LE(offset) !== CENTRAL_FILE_HEADER) {
+        throw new Error('corrupt zip archive: bad central directory entry');
+      }
+      const madeBy = directory.readUInt16LE(offset + 4) >> 8;
+      const flags = directory.readUInt16LE(offset + 8);
+      const method = directory.readUInt16LE(offset + 10);
+      const nameLength = directory.readUInt16LE(offset + 28);
+      const extraLength = directory.readUInt16LE(offset + 30);
+      const commentLength = directory.readUInt16LE(offset + 32);
+      const attributes = directory.readUInt32LE(offset + 38);
+      const name = directory.toString('utf8', offset + 46, offset + 46 + nameLength);
+      const sizes = zip64Sizes(
+        directory.subarray(offset + 46 + nameLength, offset + 46 + nameLength + extraLength),
+        directory.readUInt32LE(offset + 24),
+        directory.readUInt32LE(offset + 20),
+        directory.readUInt32LE(offset + 42)
+      );
+      offset += 46 + nameLength + extraLength + commentLength;
+      const type = madeBy === UNIX ? (attributes >>> 16) & S_IFMT : 0;
+      if (name.endsWith('/') || type === S_IFDIR) {
+        continue;
+      }
+      if (type === S_IFLNK) {
+        throw new Error(`${name} is a link; only regular files and directories are supported`);
+      }
+      if (type !== 0 && type !== S_IFREG) {
+        throw new Error(`${name} is not a regular file or directory`);
+      }
+      if (flags & 0x1) {
+        throw new Error(`${name} is encrypted`);
+      }
+      if (method !== STORED && method !== DEFLATED) {
+        throw new Error(`${name} uses unsupported compression method ${method}`);
+      }
+      const permissions = madeBy === UNIX ? (attributes >>> 16) & 0o777 : 0;
+      entries.push({ name, mode: permissions || 0o644, method, ...sizes });
+    }
+    return entries;
+  } finally {
+    fs.closeSync(fd);
+  }
+}
+
+// Streams the uncompressed contents of an entry.
+export function openZipEntry(file: string, entry: ZipFileEntry): Readable {
+  const fd = fs.openSync(file, 'r');
+  let header: Buffer;
+  try {
+    header = read(fd, entry.headerOffset, 30);
+  } finally {
+    fs.closeSync(fd);
+  }
+  if (header.readUInt32LE(0) !== LOCAL_FILE_HEADER) {
+    throw new Error(`corrupt zip archive: bad local header for ${entry.name}`);
+  }
+  const start = entry.headerOffset + 30 + header.readUInt16LE(26) + header.readUInt16LE(28);
+  if (entry.compressedSize === 0) {
+    return stream.Readable.from([]);
+  }
+  const raw = fs.createReadStream(file, { start, end: start + entry.compressedSize - 1 });
+  return entry.method === DEFLATED ? stream.pipeline(raw, zlib.createInflateRaw(), () => undefined) : raw;
+}
+
+// Fields the 32-bit header marks as 0xFFFFFFFF are in the zip64 extra field, in this order.
+function zip64Sizes(extra: Buffer, size: number, compressedSize: number, headerOffset: number) {
+  const sizes = { size, compressedSize, headerOffset };
+  for (let offset = 0; offset + 4 <= extra.length; ) {
+    const id = extra.readUInt16LE(offset);
+    const length = extra.readUInt16LE(offset + 2);
+    if (id === ZIP64_EXTRA) {
+      let field = offset + 4;
+      for (const key of ['size', 'compressedSize', 'headerOffset'] as const) {
+        if (sizes[key] === 0xffffffff && field + 8 <= offset + 4 + length) {
+          sizes[key] = Number(extra.readBigUInt64LE(field));
+          field += 8;
+        }
+      }
+    }
+    offset += 4 + length;
+  }
+  return sizes;
+}
+
+function read(fd: number, position: number, length: number): Buffer {
+  const buffer = Buffer.alloc(length);
+  const bytes = fs.readSync(fd, buffer, 0, length, position);
+  if (bytes < length) {
+    throw new Error('corrupt zip archive: truncated');
+  }
+  return buffer;
+}
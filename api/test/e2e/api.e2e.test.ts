@@ -7,20 +7,35 @@ import bodyParser from 'body-parser';
 import { registerHealthRoutes } from '../../src/routes/health.js';
 import { registerFileRoutes } from '../../src/routes/files.js';
 import { registerRunRoutes } from '../../src/routes/runs.js';
+import { registerExecutionRoutes } from '../../src/routes/executions.js';
 import { ArtifactStorage } from '../../src/core/storage.js';
 import { Authenticator } from '../../src/core/auth.js';
 import { TokenBucketLimiter } from '../../src/core/rate_limit.js';
 import { RunStore } from '../../src/core/run_store.js';
 import { Orchestrator } from '../../src/core/orchestrator.js';
+import { BundleExporter, readBundle } from '../../src/core/bundle.js';
+import { runnerRegistry } from '../../src/core/runners.js';
 import { Logger } from '../../src/util/logger.js';
 import type { SandboxRunner, SandboxRunSpec, SandboxResult } from '../../src/core/types.js';
 
 class MockSandbox implements SandboxRunner {
   async run(spec: SandboxRunSpec): Promise<SandboxResult> {
+    if (spec.code.includes('wait_for_cancel')) {
+      await new Promise((resolve) => spec.signal?.addEventListener('abort', resolve, { once: true }));
+      return {
+        status: 'oom',
+        exitCode: 137,
+        stdout: Buffer.from(''),
+        stderr: Buffer.from(''),
+        usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 },
+        artifacts: []
+      };
+    }
     if (spec.code.includes('while True')) {
       return {
         status: 'timeout',
         exitCode: null,
+        limitExceeded: 'wall_time',
         stdout: Buffer.from(''),
         stderr: Buffer.from('timeout'),
         usage: { wall_ms: spec.limits.timeout_ms, cpu_ms: spec.limits.cpu_ms, max_rss_mb: spec.limits.memory_mb },
@@ -31,6 +46,7 @@ class MockSandbox implements SandboxRunner {
       return {
         status: 'oom',
         exitCode: 137,
+        limitExceeded: 'memory',
         stdout: Buffer.from(''),
         stderr: Buffer.from('oom'),
         usage: { wall_ms: spec.limits.timeout_ms, cpu_ms: spec.limits.cpu_ms, max_rss_mb: spec.limits.memory_mb },
@@ -51,6 +67,7 @@ class MockSandbox implements SandboxRunner {
     fs.mkdirSync(outputDir, { recursive: true });
     const artifactPath = path.join(outputDir, 'report.txt');
     fs.writeFileSync(artifactPath, 'ok');
+    spec.onOutput?.('stdout', Buffer.from('hello'));
     return {
       status: 'succeeded',
       exitCode: 0,
@@ -75,21 +92,40 @@ describe('Code Executor API', () => {
       signingKey: 'signing',
       urlTtlSeconds: 600
     });
+    const runStore = new RunStore();
     const orchestrator = new Orchestrator({
       workRoot: path.join(tmp, 'sandbox'),
       artifactStorage: storage,
       sandboxRunner: new MockSandbox(),
-      logger: new Logger({ test: 'e2e' })
+      logger: new Logger({ test: 'e2e' }),
+      store: runStore
+    });
+    const authenticator = new Authenticator({
+      tokens: { [token]: { label: 'dev', rateLimitRps: 5, burst: 5 } },
+      limiter: new TokenBucketLimiter(5, 5)
     });
-    const limiter = new TokenBucketLimiter(5, 5);
-    const runStore = new RunStore();
-    const authenticator = new Authenticator({ tokens: { [token]: { label: 'dev', rateLimitRps: 5, burst: 5 } } });
     app = express();
     app.use(bodyParser.json({ limit: '1mb' }));
     registerHealthRoutes(app);
     app.use(authenticator.middleware());
     registerFileRoutes(app, { storage });
-    registerRunRoutes(app, { orchestrator, runStore, limiter, tokenLimits: { [token]: { label: 'dev', rateLimitRps: 5, burst: 5 } } });
+    const bundles = new BundleExporter({
+      store: runStore,
+      artifactStorage: storage,
+      registry: runnerRegistry,
+      sandbox: {
+        backend: 'process',
+        default_isolation: 'container',
+        seccomp_profile: null,
+        apparmor_profile: null,
+        disable_security: true,
+        runtimes: { gvisor: null, microvm: null },
+        userns: null,
+        run_as: null
+      }
+    });
+    registerRunRoutes(app, { orchestrator, runStore, authenticator, bundles });
+    registerExecutionRoutes(app, { orchestrator, runStore, authenticator });
     app.use((err: any, _req: express.Request, res: express.Response, _next: express.NextFunction) => {
       if (err.isBoom) {
         res.status(err.output.statusCode).json({ error: err.message });
@@ -105,6 +141,13 @@ describe('Code Executor API', () => {
     expect(res.body.status).toBe('ok');
   });
 
+  it('serves liveness and readiness probes without a key', async () => {
+    expect((await request(app).get('/healthz')).body).toEqual({ status: 'ok' });
+    const ready = await request(app).get('/readyz');
+    expect(ready.status).toBe(200);
+    expect(ready.body).toEqual({ status: 'ready', runners: {} });
+  });
+
   it('creates successful run', async () => {
     const res = await request(app)
       .post('/v1/runs')
@@ -112,6 +155,89 @@ describe('Code Executor API', () => {
       .send({ language: 'python', code: 'print("hi")' });
     expect(res.status).toBe(200);
     expect(res.body.status).toBe('succeeded');
+    expect(res.body.limit_exceeded).toBeNull();
+  });
+
+  it('streams run output as server-sent events', async () => {
+    const res = await request(app)
+      .post('/v1/runs?stream=true')
+      .set('Authorization', `Bearer ${token}`)
+      .send({ language: 'python', code: 'print("hi")' });
+    expect(res.status).toBe(200);
+    expect(res.headers['content-type']).toContain('text/event-stream');
+    expect(res.text).toContain('event: stdout\ndata: {"data":"hello"}');
+    expect(res.text).toContain('event: result');
+  });
+
+  it('exports a replay bundle of a run', async () => {
+    const run = await request(app)
+      .post('/v1/runs')
+      .set('Authorization', `Bearer ${token}`)
+      .send({ language: 'python', code: 'print("hi")', stdin: 'input', env: { MODE: 'debug' } });
+    const res = await request(app)
+      .get(`/v1/runs/${run.body.id}/bundle`)
+      .set('Authorization', `Bearer ${token}`)
+      .buffer(true)
+      .parse((response, callback) => {
+        const chunks: Buffer[] = [];
+        response.on('data', (chunk: Buffer) => chunks.push(chunk));
+        response.on('end', () => callback(null, Buffer.concat(chunks)));
+      });
+    expect(res.status).toBe(200);
+    expect(res.headers['content-type']).toContain('application/gzip');
+    const bundle = readBundle(res.body as Buffer);
+    expect(bundle.code).toBe('print("hi")');
+    expect(bundle.stdin).toBe('input');
+    expect(bundle.stdout).toBe('hello');
+    expect(bundle.manifest.request.env).toEqual({ MODE: 'debug' });
+    const missing = await request(app).get('/v1/runs/run_missing/bundle').set('Authorization', `Bearer ${token}`);
+    expect(missing.status).toBe(404);
+  });
+
+  it('runs executions asynchronously', async () => {
+    const submit = await request(app)
+      .post('/v1/executions')
+      .set('Authorization', `Bearer ${token}`)
+      .send({ language: 'python', code: 'print("hi")' });
+    expect(submit.status).toBe(202);
+    expect(submit.headers['location']).toBe(`/v1/executions/${submit.body.id}`);
+    let res = await request(app).get(`/v1/executions/${submit.body.id}`).set('Authorization', `Bearer ${token}`);
+    for (let i = 0; i < 20 && res.body.status === 'running'; i++) {
+      await new Promise((resolve) => setTimeout(resolve, 10));
+      res = await request(app).get(`/v1/executions/${submit.body.id}`).set('Authorization', `Bearer ${token}`);
+    }
+    expect(res.status).toBe(200);
+    expect(res.body.status).toBe('succeeded');
+    expect(res.body.stdout).toBe('hello');
+  });
+
+  it('refuses callbacks when webhooks are not configured', async () => {
+    const res = await request(app)
+      .post('/v1/executions')
+      .set('Authorization', `Bearer ${token}`)
+      .send({ language: 'python', code: 'print("hi")', callback_url: 'https://grader.example.com/done' });
+    expect(res.status).toBe(400);
+    expect(res.body.error).toBe('callback_url is not enabled on this server');
+  });
+
+  it('cancels in-flight executions', async () => {
+    const submit = await request(app)
+      .post('/v1/executions')
+      .set('Authorization', `Bearer ${token}`)
+      .send({ language: 'python', code: 'wait_for_cancel()' });
+    const running = await request(app).get(`/v1/executions/${submit.body.id}`).set('Authorization', `Bearer ${token}`);
+    expect(running.body.status).toBe('running');
+    const cancel = await request(app).delete(`/v1/executions/${submit.body.id}`).set('Authorization', `Bearer ${token}`);
+    expect(cancel.status).toBe(202);
+    let res = running;
+    for (let i = 0; i < 20 && res.body.status === 'running'; i++) {
+      await new Promise((resolve) => setTimeout(resolve, 10));
+      res = await request(app).get(`/v1/executions/${submit.body.id}`).set('Authorization', `Bearer ${token}`);
+    }
+    expect(res.body.status).toBe('canceled');
+    expect(res.body.limit_exceeded).toBeNull();
+    const again = await request(app).delete(`/v1/executions/${submit.body.id}`).set('Authorization', `Bearer ${token}`);
+    expect(again.status).toBe(409);
   });
 
   it('handles timeout run', async () => {
@@ -120,6 +246,7 @@ describe('Code Executor API', () => {
       .set('Authorization', `Bearer ${token}`)
       .send({ language: 'python', code: 'while True: pass' });
     expect(res.body.status).toBe('timeout');
+    expect(res.body.limit_exceeded).toBe('wall_time');
   });
 
   it('handles oom run', async () => {
@@ -128,6 +255,7 @@ describe('Code Executor API', () => {
       .set('Authorization', `Bearer ${token}`)
       .send({ language: 'python', code: 'memory_bomb()' });
     expect(res.body.status).toBe('oom');
+    expect(res.body.limit_exceeded).toBe('memory');
   });
 
   it('returns artifact URL', async () => {
@@ -0,0 +1,137 @@
+import grpc from '@grpc/grpc-js';
+import protoLoader from '@grpc/proto-loader';
+import path from 'node:path';
+import fs from 'node:fs';
+import os from 'node:os';
+import { createGrpcServer } from '../../src/grpc/server.js';
+import { ArtifactStorage } from '../../src/core/storage.js';
+import { Authenticator } from '../../src/core/auth.js';
+import { BatchRunner } from '../../src/core/batch.js';
+import { TokenBucketLimiter } from '../../src/core/rate_limit.js';
+import { Orchestrator } from '../../src/core/orchestrator.js';
+import { Logger } from '../../src/util/logger.js';
+import type { SandboxRunner, SandboxRunSpec, SandboxResult } from '../../src/core/types.js';
+
+const protoPath = path.join(process.cwd(), 'proto', 'executor.proto');
+
+class EchoSandbox implements SandboxRunner {
+  async run(spec: SandboxRunSpec): Promise<SandboxResult> {
+    const chunks: Buffer[] = [];
+    if (spec.input) {
+      for await (const chunk of spec.input) {
+        chunks.push(Buffer.from(chunk));
+        spec.onOutput?.('stdout', Buffer.from(chunk));
+      }
+    } else {
+      chunks.push(Buffer.from(spec.stdin));
+    }
+    return {
+      status: 'succeeded',
+      exitCode: 0,
+      stdout: Buffer.concat(chunks),
+      stderr: Buffer.alloc(0),
+      usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 },
+      artifacts: []
+    };
+  }
+}
+
+describe('gRPC API', () => {
+  const token = 'dev_123';
+  let server: grpc.Server;
+  let client: grpc.Client & Record<string, any>;
+
+  beforeAll(async () => {
+    const tmp = fs.mkdtempSync(path.join(os.tmpdir(), 'code-grpc-'));
+    const tokens = { [token]: { label: 'dev', rateLimitRps: 50, burst: 50 } };
+    const orchestrator = new Orchestrator({
+      workRoot: path.join(tmp, 'sandbox'),
+      artifactStorage: new ArtifactStorage({
+        baseDir: path.join(tmp, 'storage'),
+        baseUrl: 'http://localhost:8080',
+        signingKey: 'signing',
+        urlTtlSeconds: 600
+      }),
+      sandboxRunner: new EchoSandbox(),
+      logger: new Logger({ test: 'grpc' })
+    });
+    server = createGrpcServer({
+      protoPath,
+      orchestrator,
+      batches: new BatchRunner({ orchestrator, logger: new Logger({ test: 'grpc' }) }),
+      authenticator: new Authenticator({ tokens, limiter: new TokenBucketLimiter(50, 50) }),
+      logger: new Logger({ test: 'grpc' })
+    });
+    const port = await new Promise<number>((resolve, reject) => {
+      server.bindAsync('127.0.0.1:0', grpc.ServerCredentials.createInsecure(), (err, bound) => (err ? reject(err) : resolve(bound)));
+    });
+    const definition = protoLoader.loadSync(protoPath, { keepCase: true, longs: Number, defaults: false, oneofs: true });
+    const proto = grpc.loadPackageDefinition(definition) as any;
+    client = new proto.codeexecutor.v1.Executor(`127.0.0.1:${port}`, grpc.credentials.createInsecure());
+  });
+
+  afterAll(() => {
+    client.close();
+    server.forceShutdown();
+  });
+
+  const metadata = () => {
+    const md = new grpc.Metadata();
+    md.set('authorization', `Bearer ${token}`);
+    return md;
+  };
+
+  it('executes a run', async () => {
+    const run = await new Promise<any>((resolve, reject) => {
+      client.Execute({ language: 'python', code: 'print(input())', stdin: 'hi' }, metadata(), (err: Error | null, res: any) =>
+        err ? reject(err) : resolve(res)
+      );
+    });
+    expect(run.status).toBe('succeeded');
+    expect(run.stdout).toBe('hi');
+  });
+
+  it('executes a batch keyed by tag', async () => {
+    const result = await new Promise<any>((resolve, reject) => {
+      client.ExecuteBatch(
+        {
+          submissions: [
+            { tag: 'alice', request: { language: 'python', code: 'print(input())', stdin: 'a' } },
+            { tag: 'bob', request: { language: 'cobol', code: 'DISPLAY' } }
+          ]
+        },
+        metadata(),
+        (err: Error | null, res: any) => (err ? reject(err) : resolve(res))
+      );
+    });
+    expect(result).toMatchObject({ total: 2, succeeded: 1, errors: 1 });
+    expect(result.results.alice.run.stdout).toBe('a');
+    expect(result.results.bob.error).toBe('unsupported language');
+  });
+
+  it('rejects calls without a token', async () => {
+    const err = await new Promise<grpc.ServiceError>((resolve) => {
+      client.Execute({ language: 'python', code: 'print(1)' }, new grpc.Metadata(), (e: grpc.ServiceError) => resolve(e));
+    });
+    expect(err.code).toBe(grpc.status.UNAUTHENTICATED);
+  });
+
+  it('streams stdin and output', async () => {
+    const call = client.StreamOutput(metadata());
+    const messages: any[] = [];
+    const finished = new Promise<void>((resolve, reject) => {
+      call.on('data', (message: any) => messages.push(message));
+      call.on('end', resolve);
+      call.on('error', reject);
+    });
+    call.write({ start: { language: 'python', code: 'print(input())' } });
+    call.write({ stdin: Buffer.from('from ') });
+    call.write({ stdin: Buffer.from('stream') });
+    call.end();
+    await finished;
+    expect(messages[0].id).toMatch(/^run_/);
+    const output = messages.filter((m) => m.output).map((m) => m.output.data.toString());
+    expect(output.join('')).toBe('from stream');
+    expect(messages[messages.length - 1].result.status).toBe('succeeded');
+  });
+});
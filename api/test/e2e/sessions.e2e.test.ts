@@ -0,0 +1,110 @@
+import express from 'express';
+import path from 'node:path';
+import fs from 'node:fs';
+import os from 'node:os';
+import type { AddressInfo } from 'node:net';
+import type { Server } from 'node:http';
+import WebSocket from 'ws';
+import { registerSessionRoutes } from '../../src/routes/sessions.js';
+import { ArtifactStorage } from '../../src/core/storage.js';
+import { Authenticator } from '../../src/core/auth.js';
+import { TokenBucketLimiter } from '../../src/core/rate_limit.js';
+import { Orchestrator } from '../../src/core/orchestrator.js';
+import { Logger } from '../../src/util/logger.js';
+import type { SandboxRunner, SandboxRunSpec, SandboxResult } from '../../src/core/types.js';
+
+// Upper-cases each line of input as it arrives, like an interactive program would.
+class EchoSandbox implements SandboxRunner {
+  async run(spec: SandboxRunSpec): Promise<SandboxResult> {
+    const chunks: Buffer[] = [];
+    for await (const chunk of spec.input ?? []) {
+      const reply = Buffer.from(chunk.toString().toUpperCase());
+      chunks.push(reply);
+      spec.onOutput?.('stdout', reply);
+    }
+    return {
+      status: spec.signal?.aborted ? 'killed' : 'succeeded',
+      exitCode: 0,
+      stdout: Buffer.concat(chunks),
+      stderr: Buffer.alloc(0),
+      usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 },
+      artifacts: []
+    };
+  }
+}
+
+describe('interactive sessions', () => {
+  const token = 'dev_123';
+  let server: Server;
+  let baseUrl: string;
+
+  beforeAll(async () => {
+    const tmp = fs.mkdtempSync(path.join(os.tmpdir(), 'code-session-'));
+    const tokens = { [token]: { label: 'dev', rateLimitRps: 50, burst: 50 } };
+    const orchestrator = new Orchestrator({
+      workRoot: path.join(tmp, 'sandbox'),
+      artifactStorage: new ArtifactStorage({
+        baseDir: path.join(tmp, 'storage'),
+        baseUrl: 'http://localhost:8080',
+        signingKey: 'signing',
+        urlTtlSeconds: 600
+      }),
+      sandboxRunner: new EchoSandbox(),
+      logger: new Logger({ test: 'sessions' })
+    });
+    server = express().listen(0);
+    registerSessionRoutes(server, {
+      orchestrator,
+      authenticator: new Authenticator({ tokens, limiter: new TokenBucketLimiter(50, 50) })
+    });
+    baseUrl = `ws://127.0.0.1:${(server.address() as AddressInfo).port}/v1/sessions`;
+  });
+
+  afterAll(() => {
+    server.close();
+  });
+
+  const collect = (ws: WebSocket) => {
+    const frames: any[] = [];
+    const closed = new Promise<void>((resolve) => ws.on('close', () => resolve()));
+    ws.on('message', (raw) => frames.push(JSON.parse(raw.toString())));
+    return { frames, closed };
+  };
+
+  it('relays stdin and stdout while the program runs', async () => {
+    const ws = new WebSocket(`${baseUrl}?access_token=${token}`);
+    const { frames, closed } = collect(ws);
+    await new Promise((resolve) => ws.on('open', resolve));
+    ws.send(JSON.stringify({ type: 'start', run: { language: 'python' } }));
+    ws.send(JSON.stringify({ type: 'stdin', data: 'hello\n' }));
+    await new Promise((resolve) => setTimeout(resolve, 50));
+    expect(frames.find((frame) => frame.type === 'stdout')?.data).toBe('HELLO\n');
+    ws.send(JSON.stringify({ type: 'close_stdin' }));
+    await closed;
+    expect(frames[0].type).toBe('started');
+    const result = frames[frames.length - 1];
+    expect(result.type).toBe('result');
+    expect(result.run.status).toBe('succeeded');
+    expect(result.run.limits.timeout_ms).toBe(60000);
+  });
+
+  it('cancels the run when asked', async () => {
+    const ws = new WebSocket(baseUrl, { headers: { Authorization: `Bearer ${token}` } });
+    const { frames, closed } = collect(ws);
+    await new Promise((resolve) => ws.on('open', resolve));
+    ws.send(JSON.stringify({ type: 'start', run: { language: 'python', code: 'input()' } }));
+    ws.send(JSON.stringify({ type: 'cancel' }));
+    ws.send(JSON.stringify({ type: 'close_stdin' }));
+    await closed;
+    expect(frames[frames.length - 1].run.status).toBe('canceled');
+  });
+
+  it('rejects unauthenticated upgrades', async () => {
+    const ws = new WebSocket(baseUrl);
+    const status = await new Promise<number | undefined>((resolve) => {
+      ws.on('unexpected-response', (_req, res) => resolve(res.statusCode));
+      ws.on('error', () => resolve(undefined));
+    });
+    expect(status).toBe(401);
+  });
+});
@@ -0,0 +1,64 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { DEFAULT_LIMITS } from '../../src/core/limits.js';
+import { listOutputs, selectArtifacts } from '../../src/core/artifacts.js';
+
+describe('artifacts', () => {
+  let workdir: string;
+
+  const write = (name: string, bytes: number) => {
+    const fullPath = path.join(workdir, 'outputs', name);
+    fs.mkdirSync(path.dirname(fullPath), { recursive: true });
+    fs.writeFileSync(fullPath, Buffer.alloc(bytes, 1));
+  };
+
+  beforeEach(() => {
+    workdir = fs.mkdtempSync(path.join(os.tmpdir(), 'artifacts-'));
+  });
+
+  afterEach(() => {
+    fs.rmSync(workdir, { recursive: true, force: true });
+  });
+
+  it('lists nested files and ignores symlinks', () => {
+    write('test.txt', 3);
+    write('plots/a.png', 4);
+    fs.symlinkSync('/etc/passwd', path.join(workdir, 'outputs', 'passwd'));
+    expect(listOutputs(workdir).map((file) => [file.name, file.size])).toEqual([
+      ['plots/a.png', 4],
+      ['test.txt', 3]
+    ]);
+  });
+
+  it('applies per-file, total and count caps', () => {
+    write('a.bin', 10);
+    write('b.bin', 50);
+    write('c.bin', 30);
+    write('d.bin', 30);
+    write('e.bin', 1);
+    const limits = { ...DEFAULT_LIMITS, max_artifact_file_bytes: 40, max_artifact_bytes: 45, max_artifact_files: 2 };
+    const selection = selectArtifacts(listOutputs(workdir), workdir, limits);
+    expect(selection.kept.map((file) => file.name)).toEqual(['a.bin', 'c.bin']);
+    expect(selection.skipped).toEqual([
+      { name: 'b.bin', size: 50, reason: 'file_too_large' },
+      { name: 'd.bin', size: 30, reason: 'too_many_files' },
+      { name: 'e.bin', size: 1, reason: 'too_many_files' }
+    ]);
+  });
+
+  it('never keeps files outside outputs/', () => {
+    fs.writeFileSync(path.join(workdir, 'secret'), 'x');
+    const selection = selectArtifacts([{ path: path.join(workdir, 'secret'), name: 'secret', size: 1 }], workdir, DEFAULT_LIMITS);
+    expect(selection.kept).toEqual([]);
+    expect(selection.skipped).toEqual([{ name: 'secret', size: 1, reason: 'outside_outputs' }]);
+  });
+
+  it('keeps outputs whose names start with two dots', () => {
+    write('..notes.txt', 5);
+    write('..plots/a.png', 4);
+    const selection = selectArtifacts(listOutputs(workdir), workdir, DEFAULT_LIMITS);
+    expect(selection.kept.map((file) => file.name)).toEqual(['..notes.txt', '..plots/a.png']);
+    expect(selection.skipped).toEqual([]);
+  });
+});
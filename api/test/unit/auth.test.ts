@@ -0,0 +1,83 @@
+import { Authenticator, hashToken } from '../../src/core/auth.js';
+import { RunStore } from '../../src/core/run_store.js';
+
+describe('Authenticator', () => {
+  const issued = {
+    id: 'key_1',
+    token_sha256: hashToken('cx_issued'),
+    label: 'free',
+    rate_limit_rps: 1,
+    burst: 1,
+    monthly_executions: 2,
+    max_timeout_ms: 2000,
+    max_memory_mb: null,
+    tenant: null,
+    max_concurrent: null,
+    created_at: '2026-01-01T00:00:00.000Z'
+  };
+
+  it('accepts configured keys and issued keys once refreshed', async () => {
+    const store = new RunStore();
+    const auth = new Authenticator({ tokens: { dev: { label: 'dev', rateLimitRps: 5, burst: 5 } }, store });
+    expect(auth.authenticate('Bearer dev')).toBe('dev');
+    await store.saveApiKey(issued);
+    expect(() => auth.authenticate('Bearer cx_issued')).toThrow('invalid token');
+    await auth.refresh();
+    expect(auth.authenticate('Bearer cx_issued')).toBe('cx_issued');
+    expect(auth.maxLimits('cx_issued')).toEqual({ timeout_ms: 2000 });
+    // Reports name keys without their tokens.
+    expect(auth.describeKey('cx_issued')).toEqual({ fingerprint: issued.token_sha256.slice(0, 16), id: 'key_1', label: 'free' });
+    expect(auth.describeKey('dev')).toMatchObject({ id: null, label: 'dev' });
+    await store.deleteApiKey('key_1');
+    await auth.refresh();
+    expect(() => auth.authenticate('Bearer cx_issued')).toThrow('invalid token');
+    expect(auth.describeKey('cx_issued')).toEqual({ fingerprint: issued.token_sha256.slice(0, 16), id: null, label: null });
+  });
+
+  it('refuses runs past the monthly quota, counting what the store already has', async () => {
+    const store = new RunStore();
+    await store.saveApiKey(issued);
+    await store.saveSubmission({
+      id: 'run_1',
+      api_key: 'cx_issued',
+      language: 'python',
+      request: { language: 'python', code: 'print(1)' },
+      created_at: new Date().toISOString()
+    });
+    const auth = new Authenticator({ tokens: {}, store });
+    await auth.refresh();
+    auth.admitRun('cx_issued');
+    expect(() => auth.admitRun('cx_issued')).toThrow('monthly execution quota exceeded');
+    expect(auth.usageOf('cx_issued')).toMatchObject({ label: 'free', monthly_executions: 2, used: 2 });
+  });
+
+  it('applies each key\'s rate limit', async () => {
+    const auth = new Authenticator({ tokens: { slow: { label: 'slow', rateLimitRps: 0.001, burst: 1 } } });
+    auth.throttle('slow');
+    expect(() => auth.throttle('slow')).toThrow('rate limit exceeded');
+  });
+
+  it('shares rate limits and concurrency caps between keys of one tenant', () => {
+    const auth = new Authenticator({
+      tokens: {
+        a: { label: 'a', rateLimitRps: 0.001, burst: 1, tenant: 'acme' },
+        b: { label: 'b', rateLimitRps: 0.001, burst: 1, tenant: 'acme', maxConcurrent: 3 },
+        c: { label: 'c', rateLimitRps: 0.001, burst: 1 }
+      },
+      maxConcurrent: 2
+    });
+    auth.throttle('a');
+    let rejection: any;
+    try {
+      auth.throttle('b');
+    } catch (err) {
+      rejection = err;
+    }
+    expect(rejection.message).toBe('rate limit exceeded');
+    expect(Number(rejection.output.headers['Retry-After'])).toBeGreaterThan(900);
+    auth.throttle('c');
+    expect(auth.tenantOf('a')).toEqual({ id: 'acme', maxRunning: 2 });
+    expect(auth.tenantOf('b')).toEqual({ id: 'acme', maxRunning: 3 });
+    expect(auth.tenantOf('c')).toEqual({ id: 'c', maxRunning: 2 });
+  });
+});
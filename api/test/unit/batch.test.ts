@@ -0,0 +1,109 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { BatchRunner } from '../../src/core/batch.js';
+import { Orchestrator } from '../../src/core/orchestrator.js';
+import { ArtifactStorage } from '../../src/core/storage.js';
+import { Logger } from '../../src/util/logger.js';
+import type { RunRequest, SandboxResult, SandboxRunner, SandboxRunSpec } from '../../src/core/types.js';
+
+// Echoes stdin after a short delay while tracking how many runs are in the sandbox at once.
+class CountingSandbox implements SandboxRunner {
+  public running = 0;
+  public peak = 0;
+
+  async run(spec: SandboxRunSpec): Promise<SandboxResult> {
+    this.running += 1;
+    this.peak = Math.max(this.peak, this.running);
+    await new Promise((resolve) => setTimeout(resolve, 5));
+    this.running -= 1;
+    return {
+      status: spec.stdin === 'fail' ? 'failed' : 'succeeded',
+      exitCode: spec.stdin === 'fail' ? 1 : 0,
+      stdout: Buffer.from(spec.stdin),
+      stderr: Buffer.alloc(0),
+      usage: { wall_ms: 5, cpu_ms: 1, max_rss_mb: 1 },
+      artifacts: []
+    };
+  }
+}
+
+describe('BatchRunner', () => {
+  let tmpDir: string;
+  let sandbox: CountingSandbox;
+  let batches: BatchRunner;
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'batch-'));
+    sandbox = new CountingSandbox();
+    const orchestrator = new Orchestrator({
+      workRoot: path.join(tmpDir, 'sandbox'),
+      artifactStorage: new ArtifactStorage({
+        baseDir: path.join(tmpDir, 'storage'),
+        baseUrl: 'http://localhost:8080',
+        signingKey: 'test-key',
+        urlTtlSeconds: 600
+      }),
+      sandboxRunner: sandbox,
+      logger: new Logger({ test: 'batch' })
+    });
+    batches = new BatchRunner({ orchestrator, logger: new Logger({ test: 'batch' }), concurrency: 3, maxSubmissions: 10 });
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('runs submissions with bounded concurrency and keys results by tag', async () => {
+    const submissions = Array.from({ length: 8 }, (_, index) => ({
+      tag: `student-${index}`,
+      language: 'python',
+      code: 'print(input())',
+      stdin: index === 2 ? 'fail' : String(index)
+    }));
+    submissions.push({ tag: 'bad', language: 'cobol', code: 'DISPLAY', stdin: '' });
+    const result = await batches.run({ submissions }, 'dev');
+    expect(sandbox.peak).toBe(3);
+    expect(result).toMatchObject({ total: 9, succeeded: 7, errors: 1 });
+    expect(result.results['student-5'].run?.stdout).toBe('5');
+    expect(result.results['student-2'].run?.status).toBe('failed');
+    expect(result.results.bad).toEqual({ tag: 'bad', run: null, error: 'unsupported language' });
+
+    await batches.run({ submissions: submissions.slice(0, 4), concurrency: 1 }, 'dev');
+    expect(sandbox.peak).toBe(3);
+  });
+
+  it('queues every submission as batch work', async () => {
+    const priorities: Array<string | undefined> = [];
+    const runner = new BatchRunner({
+      orchestrator: {
+        createRun: async (request: RunRequest) => {
+          priorities.push(request.priority);
+          return { status: 'succeeded' };
+        }
+      } as unknown as Orchestrator,
+      logger: new Logger({ test: 'batch' }),
+      concurrency: 2,
+      maxSubmissions: 10
+    });
+    await runner.run(
+      {
+        submissions: [
+          { tag: 'a', language: 'python', code: 'print(1)' },
+          { tag: 'b', language: 'python', code: 'print(1)', priority: 'interactive' }
+        ]
+      },
+      'dev'
+    );
+    expect(priorities).toEqual(['batch', 'batch']);
+  });
+
+  it('validates the batch before running anything', async () => {
+    const submission = { tag: 'a', language: 'python', code: 'print(1)' };
+    await expect(batches.run({ submissions: [] }, 'dev')).rejects.toThrow('submissions is required');
+    await expect(batches.run({ submissions: new Array(11).fill(submission) }, 'dev')).rejects.toThrow('submissions exceeds 10');
+    await expect(batches.run({ submissions: [submission, submission] }, 'dev')).rejects.toThrow('duplicate tag: a');
+    await expect(batches.run({ submissions: [{ ...submission, tag: '' }] }, 'dev')).rejects.toThrow('submissions[0].tag');
+    await expect(batches.run({ submissions: [submission], concurrency: 0 }, 'dev')).rejects.toThrow('concurrency must be');
+  });
+});
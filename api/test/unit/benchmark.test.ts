@@ -0,0 +1,105 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { Benchmark, summarize } from '../../src/core/benchmark.js';
+import { ResultCache } from '../../src/core/result_cache.js';
+import { Logger } from '../../src/util/logger.js';
+import type { RunRecord } from '../../src/core/types.js';
+import { ScriptedSandbox, scriptedOrchestrator } from './scripted_sandbox.js';
+import type { Script } from './scripted_sandbox.js';
+
+// Each run takes 10 ms longer than the one before, starting at 10. The stdin `crash` fails the
+// third run.
+const script: Script = (spec, count) => {
+  const failed = spec.stdin === 'crash' && count === 3;
+  return {
+    status: failed ? 'failed' : 'succeeded',
+    exitCode: failed ? 1 : 0,
+    stdout: Buffer.from('done'),
+    usage: { wall_ms: count * 10, cpu_ms: count * 5, max_rss_mb: 8 }
+  };
+};
+
+describe('Benchmark', () => {
+  let tmpDir: string;
+  let sandbox: ScriptedSandbox;
+  let benchmark: Benchmark;
+  let runs: RunRecord[];
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'benchmark-'));
+    sandbox = new ScriptedSandbox(script);
+    runs = [];
+    const orchestrator = scriptedOrchestrator(tmpDir, sandbox, { resultCache: new ResultCache({ maxEntries: 100, ttlMs: 60000 }) });
+    benchmark = new Benchmark({
+      orchestrator,
+      logger: new Logger({ test: 'benchmark' }),
+      maxIterations: 20,
+      onRun: (run) => runs.push(run)
+    });
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('times the runs after the warmup and summarizes them', async () => {
+    const result = await benchmark.benchmark({ language: 'go', code: 'package main', iterations: 4, warmup: 2 }, 'dev');
+    expect(result).toMatchObject({ status: 'succeeded', failed_run_id: null, iterations: 4, warmup: 2 });
+    expect(result.compile).toMatchObject({ exit_code: 0 });
+    expect(result.runs.map((run) => [run.warmup, run.wall_ms])).toEqual([
+      [true, 10],
+      [true, 20],
+      [false, 30],
+      [false, 40],
+      [false, 50],
+      [false, 60]
+    ]);
+    expect(result.wall_ms).toEqual({ mean: 45, median: 45, p95: 60, min: 30, max: 60, stddev: 11.18 });
+    expect(result.cpu_ms).toMatchObject({ mean: 22.5, min: 15, max: 30 });
+    expect(result.max_rss_mb).toMatchObject({ mean: 8, stddev: 0 });
+    expect(result.runs.map((run) => run.run_id)).toEqual(runs.map((run) => run.id));
+    // Every run reaches the sandbox, even though the result cache would answer repeats.
+    expect(sandbox.specs).toHaveLength(6);
+    expect(sandbox.specs.every((spec) => spec.mode === 'run')).toBe(true);
+  });
+
+  it('detects the language once and defaults to ten timed runs after one warmup', async () => {
+    const result = await benchmark.benchmark({ code: '#!/usr/bin/env python3\nprint(1)' }, 'dev');
+    expect(result).toMatchObject({ status: 'succeeded', iterations: 10, warmup: 1, compile: null });
+    expect(result.runs).toHaveLength(11);
+    expect(new Set(sandbox.specs.map((spec) => spec.language))).toEqual(new Set(['python']));
+  });
+
+  it('stops at the first run that does not succeed', async () => {
+    const crashed = await benchmark.benchmark({ language: 'python', code: 'x', stdin: 'crash', iterations: 5 }, 'dev');
+    expect(crashed).toMatchObject({ status: 'failed', failed_run_id: runs[2].id });
+    expect(crashed.runs).toHaveLength(2);
+    expect(crashed.wall_ms).toEqual({ mean: 20, median: 20, p95: 20, min: 20, max: 20, stddev: 0 });
+
+    const broken = await benchmark.benchmark({ language: 'go', code: 'syntax error', iterations: 5, warmup: 0 }, 'dev');
+    expect(broken).toMatchObject({ status: 'failed', runs: [], wall_ms: null, cpu_ms: null, max_rss_mb: null });
+    expect(broken.compile).toMatchObject({ exit_code: 1 });
+  });
+
+  it('validates iterations and warmup', async () => {
+    await expect(benchmark.benchmark({ language: 'python', code: 'x', iterations: 0 }, 'dev')).rejects.toThrow(
+      'iterations must be a positive integer'
+    );
+    await expect(benchmark.benchmark({ language: 'python', code: 'x', warmup: 1.5 }, 'dev')).rejects.toThrow(
+      'warmup must be a non-negative integer'
+    );
+    await expect(benchmark.benchmark({ language: 'python', code: 'x', iterations: 15, warmup: 6 }, 'dev')).rejects.toThrow(
+      'iterations and warmup exceed 20 runs'
+    );
+    await expect(benchmark.benchmark({ language: 'cobol', code: 'x' }, 'dev')).rejects.toThrow();
+    expect(sandbox.specs).toHaveLength(0);
+  });
+
+  it('summarizes samples with a nearest-rank p95', () => {
+    expect(summarize([])).toBeNull();
+    expect(summarize([3, 1, 2])).toEqual({ mean: 2, median: 2, p95: 3, min: 1, max: 3, stddev: 0.82 });
+    const hundred = Array.from({ length: 100 }, (_, index) => 100 - index);
+    expect(summarize(hundred)).toMatchObject({ median: 50.5, p95: 95, min: 1, max: 100 });
+  });
+});
@@ -0,0 +1,94 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { BuildCache, buildDigest } from '../../src/core/build_cache.js';
+import { Logger } from '../../src/util/logger.js';
+
+describe('BuildCache', () => {
+  let tmpDir: string;
+  const logger = new Logger({ test: 'build-cache' });
+  const parts = { language: 'go', mode: 'run', image: 'runner-go', toolchain: 'go1.22', code: 'package main', sources: {}, build: {} };
+
+  const makeBuild = (name: string, bytes: number) => {
+    const dir = path.join(tmpDir, name);
+    fs.mkdirSync(dir, { recursive: true });
+    fs.writeFileSync(path.join(dir, 'main'), Buffer.alloc(bytes, 1));
+    return dir;
+  };
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'build-cache-'));
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('keys on sources, build options, toolchain and mode', () => {
+    const cache = new BuildCache({ dir: path.join(tmpDir, 'cache'), maxBytes: 1024 }, logger);
+    const key = cache.key(parts);
+    expect(cache.key({ ...parts })).toBe(key);
+    expect(cache.key({ ...parts, toolchain: 'go1.23' })).not.toBe(key);
+    expect(cache.key({ ...parts, build: { optimization: 'O0' } })).not.toBe(key);
+    expect(cache.key({ ...parts, sources: { 'util.go': 'package main' } })).not.toBe(key);
+    expect(cache.key({ ...parts, mode: 'test' })).not.toBe(key);
+    expect(cache.key({ ...parts, profile: { cpu: true } })).not.toBe(key);
+    expect(cache.key({ ...parts, coverage: true })).not.toBe(key);
+    expect(cache.key({ ...parts, profile: undefined })).toBe(key);
+  });
+
+  it('restores stored builds and counts hits and misses', () => {
+    const cache = new BuildCache({ dir: path.join(tmpDir, 'cache'), maxBytes: 1024 }, logger);
+    const key = cache.key(parts);
+    const dest = path.join(tmpDir, 'run', '.build');
+    expect(cache.restore(key, dest)).toBe(false);
+    const build = makeBuild('build', 10);
+    cache.store(key, build, buildDigest(build));
+    expect(cache.restore(key, dest)).toBe(true);
+    expect(fs.readdirSync(dest)).toEqual(['main']);
+    expect(cache.stats()).toMatchObject({ entries: 1, bytes: 10, hits: 1, misses: 1 });
+  });
+
+  it('refuses builds that no longer match the runner digest', () => {
+    const cache = new BuildCache({ dir: path.join(tmpDir, 'cache'), maxBytes: 1024 }, logger);
+    const build = makeBuild('build', 10);
+    const digest = buildDigest(build);
+    fs.writeFileSync(path.join(build, 'main'), 'tampered');
+    cache.store(cache.key(parts), build, digest);
+    expect(cache.stats().entries).toBe(0);
+  });
+
+  it('evicts the least recently used builds beyond maxBytes', () => {
+    const cache = new BuildCache({ dir: path.join(tmpDir, 'cache'), maxBytes: 100 }, logger);
+    const first = cache.key({ ...parts, code: 'a' });
+    const second = cache.key({ ...parts, code: 'b' });
+    const buildA = makeBuild('a', 60);
+    const buildB = makeBuild('b', 60);
+    cache.store(first, buildA, buildDigest(buildA));
+    cache.store(second, buildB, buildDigest(buildB));
+    expect(cache.stats()).toMatchObject({ entries: 1, bytes: 60, evictions: 1 });
+    expect(cache.restore(first, path.join(tmpDir, 'out'))).toBe(false);
+    expect(cache.restore(second, path.join(tmpDir, 'out'))).toBe(true);
+  });
+
+  it('keeps leased builds in place until they are released', () => {
+    const cache = new BuildCache({ dir: path.join(tmpDir, 'cache'), maxBytes: 100 }, logger);
+    const first = cache.key({ ...parts, code: 'a' });
+    const second = cache.key({ ...parts, code: 'b' });
+    expect(cache.lease(first)).toBeNull();
+    const buildA = makeBuild('a', 60);
+    cache.store(first, buildA, buildDigest(buildA));
+    const layer = cache.lease(first)!;
+    expect(fs.readdirSync(layer.dir).sort()).toEqual(['.complete', 'main']);
+    // Room for the second build can only come from the second build itself.
+    const buildB = makeBuild('b', 60);
+    cache.store(second, buildB, buildDigest(buildB));
+    expect(cache.stats()).toMatchObject({ entries: 1, evictions: 1 });
+    expect(cache.expire(Date.now() + 1)).toEqual({ entries: 0, bytes: 0 });
+    expect(fs.existsSync(path.join(layer.dir, 'main'))).toBe(true);
+    layer.release();
+    layer.release();
+    expect(cache.expire(Date.now() + 1)).toEqual({ entries: 1, bytes: 60 });
+    expect(cache.stats()).toMatchObject({ entries: 0, hits: 1, misses: 1 });
+  });
+});
@@ -0,0 +1,109 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import zlib from 'node:zlib';
+import { describe, expect, it } from '@jest/globals';
+import { BundleExporter, readBundle } from '../../src/core/bundle.js';
+import type { SandboxDescription } from '../../src/core/bundle.js';
+import { RunStore } from '../../src/core/run_store.js';
+import { runnerRegistry } from '../../src/core/runners.js';
+import { ArtifactStorage } from '../../src/core/storage.js';
+import type { RunRecord } from '../../src/core/types.js';
+import { packTarGz, unpackTarGz } from '../../src/util/tar.js';
+
+const sandbox: SandboxDescription = {
+  backend: 'docker',
+  default_isolation: 'container',
+  seccomp_profile: '/seccomp/default.json',
+  apparmor_profile: null,
+  disable_security: false,
+  runtimes: { gvisor: 'runsc', microvm: null },
+  userns: null,
+  run_as: null
+};
+
+function setup() {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'bundle-'));
+  const storage = new ArtifactStorage({ baseDir: dir, baseUrl: 'http://localhost', signingKey: 'k', urlTtlSeconds: 60 });
+  const store = new RunStore();
+  return { dir, storage, store, exporter: new BundleExporter({ store, artifactStorage: storage, registry: runnerRegistry, sandbox }) };
+}
+
+describe('tar', () => {
+  it('round-trips files, long paths included', () => {
+    const long = `${'nested/'.repeat(20)}file.txt`;
+    const entries = unpackTarGz(packTarGz([
+      { name: 'a.txt', data: Buffer.from('hello') },
+      { name: long, data: Buffer.alloc(1000, 1), mode: 0o755 }
+    ]));
+    expect(entries.map((entry) => entry.name)).toEqual(['a.txt', long]);
+    expect(entries[0].data.toString()).toBe('hello');
+    expect(entries[1].data.length).toBe(1000);
+    expect(entries[1].mode).toBe(0o755);
+  });
+});
+
+describe('BundleExporter', () => {
+  it('exports the submission, its inputs and the original result', async () => {
+    const { dir, storage, store, exporter } = setup();
+    const upload = path.join(dir, 'data.csv');
+    fs.writeFileSync(upload, 'a,b\n1,2\n');
+    const file = storage.storeUploadedFile(upload, 'data.csv', 'text/csv');
+    await store.saveSubmission({
+      id: 'run_1',
+      api_key: 'dev',
+      language: 'go',
+      created_at: '2026-01-01T00:00:00.000Z',
+      request: {
+        language: 'go',
+        version: '1.22',
+        code: 'package main',
+        sources: { 'util/util.go': 'package util' },
+        stdin: '42\n',
+        env: { DEBUG: '1' },
+        files: [{ id: file.id, path: 'data.csv' }, { id: 'file_gone', path: 'gone.txt' }]
+      }
+    });
+    await store.save({
+      id: 'run_1',
+      status: 'failed',
+      exit_code: 2,
+      limit_exceeded: null,
+      stdout: 'partial',
+      stderr: 'panic: boom',
+      toolchain: 'go1.22.5',
+      limits: { timeout_ms: 5000 },
+      artifacts: []
+    } as unknown as RunRecord);
+
+    const bundle = readBundle(await exporter.export('run_1', 'dev'));
+    expect(bundle.code).toBe('package main');
+    expect(bundle.sources).toEqual({ 'util/util.go': 'package util' });
+    expect(bundle.stdin).toBe('42\n');
+    expect(bundle.inputs['data.csv'].toString()).toBe('a,b\n1,2\n');
+    expect(bundle.stderr).toBe('panic: boom');
+    expect(bundle.manifest).toMatchObject({
+      entry_file: 'main.go',
+      request: { env: { DEBUG: '1' }, version: '1.22' },
+      toolchain: { version: '1.22', reported: 'go1.22.5', image: 'code-executor-runner-go:1.22' },
+      sandbox,
+      result: { status: 'failed', exit_code: 2, error: null },
+      missing_files: ['gone.txt']
+    });
+    expect(bundle.manifest.request).not.toHaveProperty('code');
+  });
+
+  it('only exports submissions of the requesting key', async () => {
+    const { store, exporter } = setup();
+    await store.saveSubmission({ id: 'run_2', api_key: 'dev', language: 'python', created_at: '2026-01-01T00:00:00.000Z', request: { language: 'python', code: 'x' } });
+    await expect(exporter.export('run_2', 'someone-else')).rejects.toThrow('execution not found');
+    const pending = readBundle(await exporter.export('run_2', 'dev'));
+    expect(pending.manifest.result.status).toBe('pending');
+  });
+
+  it('rejects archives with entries outside the bundle', () => {
+    const archive = packTarGz([{ name: 'bundle.json', data: Buffer.from('{"format":1}') }, { name: '../escape', data: Buffer.from('x') }]);
+    expect(() => readBundle(archive)).toThrow('invalid bundle entry: ../escape');
+    expect(() => readBundle(zlib.gzipSync(Buffer.alloc(1024)))).toThrow('bundle.json is missing');
+  });
+});
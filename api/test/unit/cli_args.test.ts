@@ -0,0 +1,63 @@
+import { parseDuration, parseReplayArgs, parseRunArgs } from '../../src/cli/args.js';
+
+describe('parseRunArgs', () => {
+  it('parses durations with and without units', () => {
+    expect(parseDuration('250')).toBe(250);
+    expect(parseDuration('500ms')).toBe(500);
+    expect(parseDuration('1.5s')).toBe(1500);
+    expect(parseDuration('1m')).toBe(60000);
+    expect(() => parseDuration('5x')).toThrow('invalid duration: 5x');
+  });
+
+  it('maps flags onto a run and passes everything after -- to the program', () => {
+    const options = parseRunArgs(
+      ['--lang', 'go', 'main.go', 'util.go', '--stdin', 'input.txt', '--timeout', '5s', '--env', 'A=1=2', '--json', '--', '--flag', 'x'],
+      {}
+    );
+    expect(options).toMatchObject({
+      files: ['main.go', 'util.go'],
+      language: 'go',
+      stdin: 'input.txt',
+      limits: { timeout_ms: 5000 },
+      env: { A: '1=2' },
+      args: ['--flag', 'x'],
+      json: true,
+      watch: false
+    });
+    expect(options.lint).toBeUndefined();
+    expect(parseRunArgs(['main.go', '--timeout', '2s', '--kill-grace', '250ms'], {}).limits).toEqual({
+      timeout_ms: 2000,
+      kill_grace_ms: 250
+    });
+    expect(parseRunArgs(['main.go', '--lint'], {}).lint).toEqual({ staticcheck: false });
+    expect(parseRunArgs(['main.go', '--staticcheck'], {}).lint).toEqual({ staticcheck: true });
+    expect(parseRunArgs(['main_test.go', '--mode', 'test', '--coverage'], {}).coverage).toBe(true);
+    expect(parseRunArgs(['main.sql', '--engine', 'postgres', '--fixture', 'schema.sql'], {})).toMatchObject({
+      sqlEngine: 'postgres',
+      fixture: 'schema.sql'
+    });
+  });
+
+  it('rejects bad input', () => {
+    expect(() => parseRunArgs([], {})).toThrow('an entry file is required');
+    expect(() => parseRunArgs(['main.py', '--backend', 'vm'], {})).toThrow('--backend must be docker or process');
+    expect(() => parseRunArgs(['main.py', '--env', 'NOVALUE'], {})).toThrow('--env expects KEY=VALUE');
+    expect(() => parseRunArgs(['main.sql', '--engine', 'mysql'], {})).toThrow('--engine must be sqlite or postgres');
+    expect(() => parseRunArgs(['main.go', '--coverage'], {})).toThrow('--coverage requires --mode test');
+    expect(parseRunArgs(['main.py'], { CONFIG_FILE: 'codexec.yaml' })).toMatchObject({ backend: undefined, config: 'codexec.yaml' });
+  });
+});
+
+describe('parseReplayArgs', () => {
+  it('takes one bundle and the sandbox flags', () => {
+    expect(parseReplayArgs(['bundle.tar.gz', '--backend', 'process', '--json'], { CONFIG_FILE: 'codexec.yaml' })).toEqual({
+      bundle: 'bundle.tar.gz',
+      backend: 'process',
+      json: true,
+      keep: false,
+      config: 'codexec.yaml'
+    });
+    expect(() => parseReplayArgs([], {})).toThrow('exactly one bundle is required');
+    expect(() => parseReplayArgs(['a.tar.gz', '--backend', 'vm'], {})).toThrow('--backend must be docker or process');
+  });
+});
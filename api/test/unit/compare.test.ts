@@ -0,0 +1,110 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { Comparer } from '../../src/core/compare.js';
+import { Logger } from '../../src/util/logger.js';
+import { ScriptedSandbox, scriptedOrchestrator } from './scripted_sandbox.js';
+import type { Script } from './scripted_sandbox.js';
+
+// Prints the stdin doubled, or tripled for code containing `off-by-one` when the stdin is 3. Code
+// containing `slow` takes 30 ms of wall time and 16 MB, other code 10 ms and 8 MB, plus 1 ms for
+// every run before; `crash` fails on stdin 2.
+const script: Script = (spec, count) => {
+  const input = Number(spec.stdin || '0');
+  const failed = spec.code.includes('crash') && input === 2;
+  const factor = spec.code.includes('off-by-one') && input === 3 ? 3 : 2;
+  const slow = spec.code.includes('slow');
+  return {
+    status: failed ? 'failed' : 'succeeded',
+    exitCode: failed ? 1 : 0,
+    stdout: Buffer.from(failed ? '' : `${input * factor}\n`),
+    usage: { wall_ms: (slow ? 30 : 10) + count, cpu_ms: slow ? 20 : 5, max_rss_mb: slow ? 16 : 8 }
+  };
+};
+
+describe('Comparer', () => {
+  let tmpDir: string;
+  let sandbox: ScriptedSandbox;
+  let comparer: Comparer;
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'compare-'));
+    sandbox = new ScriptedSandbox(script);
+    comparer = new Comparer({ orchestrator: scriptedOrchestrator(tmpDir, sandbox), logger: new Logger({ test: 'compare' }), maxRuns: 12 });
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('reports how much time and memory the candidate saves on the same cases', async () => {
+    const result = await comparer.compare({
+      baseline: { language: 'python', code: 'slow' },
+      candidate: { language: 'python', code: 'fast' },
+      cases: [{ stdin: '1', expected_stdout: '2' }, { stdin: '4' }],
+      limits: { timeout_ms: 2000 },
+      iterations: 2
+    }, 'dev');
+    expect(result).toMatchObject({ outcome: 'same', total: 2, iterations: 2, regressions: [], fixes: [], output_differences: 0, timed_cases: 2 });
+    // Runs alternate between the sides, case by case.
+    expect(sandbox.specs.map((spec) => `${spec.code}:${spec.stdin}`)).toEqual([
+      'slow:1', 'fast:1', 'slow:4', 'fast:4', 'slow:1', 'fast:1', 'slow:4', 'fast:4'
+    ]);
+    expect(sandbox.specs.every((spec) => spec.limits.timeout_ms === 2000 && spec.mode === 'run')).toBe(true);
+    // Baseline totals are 31 + 33 and 35 + 37 ms, the candidate's 12 + 14 and 16 + 18.
+    expect(result.baseline.wall_ms).toMatchObject({ median: 68, min: 64, max: 72 });
+    expect(result.deltas?.wall_ms).toEqual({ baseline: 68, candidate: 30, delta: -38, change_pct: -55.88, within_noise: false });
+    expect(result.deltas?.max_rss_mb).toEqual({ baseline: 16, candidate: 8, delta: -8, change_pct: -50, within_noise: false });
+    expect(result.cases[0].baseline).toMatchObject({ verdict: 'AC', status: 'succeeded', wall_ms: 33, max_rss_mb: 16 });
+    expect(result.cases[1].candidate).toMatchObject({ verdict: 'AC', wall_ms: 16 });
+  });
+
+  it('lists regressions, fixes and output differences', async () => {
+    const result = await comparer.compare({
+      baseline: { language: 'python', code: 'crash' },
+      candidate: { language: 'python', code: 'off-by-one' },
+      cases: [{ stdin: '1', expected_stdout: '2' }, { stdin: '2', expected_stdout: '4' }, { stdin: '3', expected_stdout: '6' }]
+    }, 'dev');
+    expect(result).toMatchObject({ outcome: 'different', regressions: [2], fixes: [1], output_differences: 2, timed_cases: 1 });
+    expect(result.cases.map((testCase) => [testCase.baseline.verdict, testCase.candidate.verdict, testCase.outputs_match])).toEqual([
+      ['AC', 'AC', true],
+      ['RE', 'AC', false],
+      ['AC', 'WA', false]
+    ]);
+    expect(result.cases[2].diff).toMatchObject({ line: 1, column: 1, expected: '6\n', actual: '9\n' });
+    expect(result.deltas?.wall_ms.within_noise).toBeNull();
+  });
+
+  it('stops running a side that does not compile', async () => {
+    const result = await comparer.compare({
+      baseline: { language: 'go', code: 'package main' },
+      candidate: { language: 'go', code: 'syntax error' },
+      cases: [{ stdin: '1' }, { stdin: '2' }, { stdin: '3' }]
+    }, 'dev');
+    expect(sandbox.specs.map((spec) => spec.code)).toEqual(['package main', 'syntax error', 'package main', 'package main']);
+    expect(result.candidate.compile).toMatchObject({ exit_code: 1 });
+    expect(result.cases.map((testCase) => testCase.candidate.verdict)).toEqual(['CE', 'CE', 'CE']);
+    expect(result.cases[1].candidate.run_id).toBeNull();
+    expect(result).toMatchObject({ regressions: [0, 1, 2], timed_cases: 0, deltas: null });
+    expect(result.candidate.wall_ms).toBeNull();
+  });
+
+  it('checks both sides before running either', async () => {
+    await expect(comparer.compare({
+      baseline: { language: 'python', code: 'x' },
+      candidate: { language: 'cobol', code: 'x' }
+    }, 'dev')).rejects.toThrow();
+    await expect(comparer.compare({
+      baseline: { language: 'python', code: 'x' },
+      candidate: { language: 'python', code: 'x' },
+      cases: [{}, {}, {}, {}],
+      iterations: 2
+    }, 'dev')).rejects.toThrow('cases and iterations exceed 12 runs for both sides together');
+    await expect(comparer.compare({ baseline: { language: 'python', code: 'x' } } as never, 'dev')).rejects.toThrow('candidate must be a submission');
+    await expect(comparer.compare({
+      baseline: { language: 'python', code: 'x', stdin: '1' } as never,
+      candidate: { language: 'python', code: 'x' }
+    }, 'dev')).rejects.toThrow('baseline.stdin cannot be set');
+    expect(sandbox.specs).toHaveLength(0);
+  });
+});
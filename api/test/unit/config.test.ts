@@ -0,0 +1,166 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { formatConfig, loadConfig } from '../../src/config/index.js';
+import { DEFAULT_LIMITS, MAX_LIMITS } from '../../src/core/limits.js';
+
+describe('loadConfig', () => {
+  let tmpDir: string;
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'config-'));
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  function write(name: string, contents: string) {
+    const file = path.join(tmpDir, name);
+    fs.writeFileSync(file, contents);
+    return file;
+  }
+
+  it('uses the built-in defaults when nothing is configured', () => {
+    const config = loadConfig({ env: {} });
+    expect(config.server.port).toBe(8080);
+    expect(config.sandbox.backend).toBe('docker');
+    expect(config.server.api_keys).toEqual([{ token: 'dev_123', label: 'default', rate_limit_rps: 5, burst: 10 }]);
+    expect(config.limits).toEqual({ defaults: DEFAULT_LIMITS, max: MAX_LIMITS, languages: {} });
+    expect(config.languages.enabled).toBeUndefined();
+    expect(config.languages.go).toEqual({ offline: false });
+    expect(config.languages.shell).toEqual({ restricted: true });
+    expect(config.logging).toEqual({ level: 'info', request_debug: true });
+  });
+
+  it('reads YAML and TOML files and lets the environment override them', () => {
+    const yaml = write('config.yaml', [
+      'server:',
+      '  port: 9000',
+      'languages:',
+      '  enabled: [python, go]',
+      'limits:',
+      '  defaults:',
+      '    timeout_ms: 2000',
+      'sandbox:',
+      '  backend: process',
+      '  warm_pool:',
+      '    size: 2'
+    ].join('\n'));
+    const config = loadConfig({ file: yaml, env: { PORT: '7000', SANDBOX_WARM_POOL_LANGUAGES: 'go', GO_MODULES_OFFLINE: 'true' } });
+    expect(config.server.port).toBe(7000);
+    expect(config.languages.enabled).toEqual(['python', 'go']);
+    expect(config.languages.go).toEqual({ offline: true });
+    expect(config.limits.defaults).toEqual({ ...DEFAULT_LIMITS, timeout_ms: 2000 });
+    expect(config.sandbox).toMatchObject({ backend: 'process', warm_pool: { size: 2, languages: ['go'], refill: 'eager' } });
+
+    const toml = write('config.toml', '[sandbox.egress]\nproxy_port = 3200\nallowlist = ["pypi.org"]\n');
+    expect(loadConfig({ file: toml, env: {} }).sandbox.egress).toMatchObject({ proxy_port: 3200, allowlist: ['pypi.org'] });
+  });
+
+  it('parses the structured environment variables', () => {
+    const config = loadConfig({
+      env: {
+        API_KEYS: 'a:team:2:4,b',
+        MOUNT_ROOTS: '/datasets,/models=/srv/models',
+        SANDBOX_RUN_AS: '1000',
+        METRICS_ENABLED: '1',
+        WASM_RUNTIME: '/usr/local/bin/wasirun',
+        WASM_FUEL: '100000',
+        SANDBOX_GPUS: '0:24576,GPU-1f2e:16384',
+        SANDBOX_IMAGES: 'go@1.22=registry.local:5000/runner-go:1.22,python=runner-python:3.12',
+        COST_SANDBOX_SECOND_UNITS: '0.25'
+      }
+    });
+    expect(config.server.api_keys).toEqual([
+      { token: 'a', label: 'team', rate_limit_rps: 2, burst: 4 },
+      { token: 'b', label: 'default', rate_limit_rps: 5, burst: 10 }
+    ]);
+    expect(config.sandbox.mount_roots).toEqual({ '/datasets': '/datasets', '/models': '/srv/models' });
+    expect(config.sandbox.run_as).toEqual({ uid: 1000, gid: 1000 });
+    expect(config.server.metrics_enabled).toBe(true);
+    expect(config.sandbox.wasm).toMatchObject({ runtime: '/usr/local/bin/wasirun', fuel: 100000 });
+    expect(config.sandbox.gpus).toEqual([
+      { id: '0', vram_mb: 24576 },
+      { id: 'GPU-1f2e', vram_mb: 16384 }
+    ]);
+    expect(config.sandbox.images.catalog).toEqual({ 'go@1.22': 'registry.local:5000/runner-go:1.22', python: 'runner-python:3.12' });
+    expect(config.cost).toEqual({ cpu_second_units: 1, gb_second_units: 1, sandbox_second_units: 0.25 });
+  });
+
+  it('reports every invalid or unknown setting at once', () => {
+    const file = write('config.json', JSON.stringify({
+      server: { port: 'eighty', prot: 1 },
+      limits: { defaults: { timeout_ms: 60000 } },
+      languages: { enabled: ['cobol'] }
+    }));
+    let message = '';
+    try {
+      loadConfig({ file, env: { QUEUE_CONCURRENCY: 'many', SANDBOX_BACKEND: 'vm', LOG_LEVEL: 'verbose', COST_GB_SECOND_UNITS: '-1' } });
+    } catch (err) {
+      message = (err as Error).message;
+    }
+    expect(message).toContain(`server.port in ${file}: expected a non-negative integer`);
+    expect(message).toContain(`server.prot in ${file}: unknown setting`);
+    expect(message).toContain('QUEUE_CONCURRENCY: expected a non-negative integer');
+    expect(message).toContain('SANDBOX_BACKEND: expected one of docker, process');
+    expect(message).toContain('LOG_LEVEL: expected one of debug, info, warn, error');
+    expect(message).toContain('COST_GB_SECOND_UNITS: expected a non-negative number');
+    expect(message).toContain('unknown language: cobol');
+    expect(message).toContain('limits.defaults.timeout_ms exceeds limits.max.timeout_ms');
+  });
+
+  it('reads per-language limits and checks them against the deployment\'s', () => {
+    const limits = (languages: unknown) => write('config.json', JSON.stringify({ limits: { languages } }));
+    const config = loadConfig({ file: limits({ java: { defaults: { memory_mb: 512 }, max: { memory_mb: 1024 } } }), env: {} });
+    expect(config.limits.languages).toEqual({ java: { defaults: { memory_mb: 512 }, max: { memory_mb: 1024 } } });
+    expect(() => loadConfig({ file: limits({ java: { defaults: { memory_mb: 2048 } } }), env: {} })).toThrow(
+      'limits.languages.java: defaults.memory_mb exceeds max.memory_mb'
+    );
+    expect(() => loadConfig({ file: limits({ java: { max: { heap_mb: 1 } } }), env: {} })).toThrow('java.max: unknown limit heap_mb');
+    expect(() => loadConfig({ file: limits({ cobol: { max: { memory_mb: 1 } } }), env: {} })).toThrow('unknown language: cobol');
+  });
+
+  it('requires the settings of the chosen artifact store', () => {
+    expect(loadConfig({ env: {} }).storage).toMatchObject({ backend: 'filesystem', url_ttl_seconds: 600 });
+    expect(() => loadConfig({ env: { ARTIFACT_STORE: 's3', ARTIFACT_BUCKET: 'runs', AWS_REGION: 'eu-west-1' } })).toThrow(
+      'storage.s3.access_key_id is required with storage.backend s3'
+    );
+    expect(() => loadConfig({ env: { ARTIFACT_STORE: 'gcs' } })).toThrow('storage.gcs.credentials_file is required with storage.backend gcs');
+    const s3 = loadConfig({
+      env: { ARTIFACT_STORE: 's3', ARTIFACT_BUCKET: 'runs', AWS_REGION: 'eu-west-1', AWS_ACCESS_KEY_ID: 'AKID', AWS_SECRET_ACCESS_KEY: 'shh' }
+    });
+    expect(s3.storage.s3).toEqual({ region: 'eu-west-1', access_key_id: 'AKID', secret_access_key: 'shh' });
+  });
+
+  it('requires a token and, for workers, the coordinator in distributed mode', () => {
+    expect(loadConfig({ env: {} }).cluster).toMatchObject({ role: 'standalone', heartbeat_ms: 5000, max_attempts: 3 });
+    expect(() => loadConfig({ env: { CLUSTER_ROLE: 'coordinator' } })).toThrow('cluster.token is required with cluster.role coordinator');
+    expect(() => loadConfig({ env: { CLUSTER_ROLE: 'worker', CLUSTER_TOKEN: 'shh' } })).toThrow('cluster.coordinator is required with cluster.role worker');
+    const worker = loadConfig({ env: { CLUSTER_ROLE: 'worker', CLUSTER_TOKEN: 'shh', CLUSTER_COORDINATOR: 'coordinator:7070', CLUSTER_WORKER_ID: 'w1' } });
+    expect(worker.cluster).toMatchObject({ role: 'worker', coordinator: 'coordinator:7070', worker_id: 'w1' });
+    expect(JSON.parse(formatConfig(worker)).cluster.token).toBe('<redacted>');
+  });
+
+  it('injects faults at random only with fault injection enabled', () => {
+    expect(loadConfig({ env: {} }).faults).toEqual({
+      enabled: false,
+      rate: 0,
+      kinds: ['sandbox_create', 'slow_compile', 'worker_crash', 'output_stall'],
+      delay_ms: 5000
+    });
+    expect(() => loadConfig({ env: { FAULTS_RATE: '0.5' } })).toThrow('faults.rate requires faults.enabled');
+    expect(() => loadConfig({ env: { FAULTS_ENABLED: 'true', FAULTS_RATE: '2' } })).toThrow('faults.rate must be a share of runs from 0 to 1');
+    expect(() => loadConfig({ env: { FAULTS_KINDS: 'sandbox_create,power_cut' } })).toThrow();
+    const chaos = loadConfig({ env: { FAULTS_ENABLED: 'true', FAULTS_RATE: '0.1', FAULTS_KINDS: 'worker_crash' } });
+    expect(chaos.faults).toMatchObject({ enabled: true, rate: 0.1, kinds: ['worker_crash'] });
+  });
+
+  it('hides secrets when printing the configuration', () => {
+    const printed = JSON.parse(formatConfig(loadConfig({ env: { SIGNING_KEY: 'hunter2', WEBHOOK_SECRET: 's3cret' } })));
+    expect(printed.server.signing_key).toBe('<redacted>');
+    expect(printed.server.api_keys[0]).toEqual({ token: '<redacted>', label: 'default', rate_limit_rps: 5, burst: 10 });
+    expect(printed.webhooks.secret).toBe('<redacted>');
+    expect(printed.store.url).toBeUndefined();
+  });
+});
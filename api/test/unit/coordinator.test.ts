@@ -0,0 +1,333 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import Boom from '@hapi/boom';
+import { Coordinator } from '../../src/core/coordinator.js';
+import type { CoordinatorMessage, WorkerLink, WorkerMessage } from '../../src/core/coordinator.js';
+import { WorkerAgent } from '../../src/core/worker_agent.js';
+import { DEFAULT_LIMITS } from '../../src/core/limits.js';
+import { infrastructureFailure } from '../../src/core/infrastructure.js';
+import type { GpuDevice } from '../../src/core/gpu.js';
+import { RunnerRegistry } from '../../src/core/runners.js';
+import { Logger } from '../../src/util/logger.js';
+import type { SandboxResult, SandboxRunSpec, SandboxRunner } from '../../src/core/types.js';
+
+// Two ends of an in-process connection; messages arrive asynchronously, as over a stream.
+function linkPair() {
+  type End<In, Out> = WorkerLink<In, Out> & { listeners: Array<(message: In) => void> };
+  const closeListeners: Array<(reason: string) => void> = [];
+  let closed = false;
+  const close = () => {
+    if (!closed) {
+      closed = true;
+      closeListeners.forEach((listener) => listener('closed'));
+    }
+  };
+  const end = <In, Out>(peer: () => End<Out, In>): End<In, Out> => {
+    const self: End<In, Out> = {
+      listeners: [],
+      send: (message) => {
+        if (!closed) {
+          setImmediate(() => !closed && peer().listeners.forEach((listener) => listener(message)));
+        }
+      },
+      onMessage: (listener) => self.listeners.push(listener),
+      onClose: (listener) => closeListeners.push(listener),
+      close
+    };
+    return self;
+  };
+  const coordinatorEnd: End<WorkerMessage, CoordinatorMessage> = end(() => workerEnd);
+  const workerEnd: End<CoordinatorMessage, WorkerMessage> = end(() => coordinatorEnd);
+  return { coordinatorEnd, workerEnd };
+}
+
+const result = (stdout: string, status: SandboxResult['status'] = 'succeeded'): SandboxResult => ({
+  status,
+  exitCode: status === 'succeeded' ? 0 : null,
+  limitExceeded: null,
+  stdout: Buffer.from(stdout),
+  stderr: Buffer.alloc(0),
+  usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 },
+  artifacts: []
+});
+
+describe('Coordinator', () => {
+  let tmpDir: string;
+  let coordinator: Coordinator;
+  let ran: Array<{ worker: string; spec: SandboxRunSpec }>;
+  const logger = new Logger({ test: 'coordinator' });
+
+  const registry = (...languages: string[]) => {
+    const runners = new RunnerRegistry();
+    for (const language of languages) {
+      runners.register({ language, image: `runner-${language}`, entryFile: 'main', extensions: [], pidsLimit: 32, versionCommand: [] });
+    }
+    return runners;
+  };
+
+  const attachWorker = (id: string, languages: string[], capacity: number, sandbox?: SandboxRunner, gpus?: GpuDevice[]) => {
+    const { coordinatorEnd, workerEnd } = linkPair();
+    const agent = new WorkerAgent(
+      {
+        id,
+        registry: registry(...languages),
+        capacity,
+        gpus,
+        workRoot: fs.mkdtempSync(path.join(tmpDir, `${id}-`)),
+        heartbeatMs: 20,
+        sandbox: sandbox ?? {
+          async run(spec) {
+            ran.push({ worker: id, spec });
+            return result(`${id} ran ${spec.id}`);
+          }
+        }
+      },
+      logger
+    );
+    coordinator.connect(coordinatorEnd);
+    agent.attach(workerEnd);
+    return { agent, link: coordinatorEnd };
+  };
+
+  const spec = (id: string, language = 'python', overrides: Partial<SandboxRunSpec> = {}): SandboxRunSpec => {
+    const workdir = path.join(tmpDir, 'coordinator', id);
+    fs.mkdirSync(path.join(workdir, 'inputs'), { recursive: true });
+    fs.mkdirSync(path.join(workdir, 'outputs'), { recursive: true });
+    return {
+      id,
+      language,
+      mode: 'run',
+      code: 'print(1)',
+      sources: {},
+      stdin: '',
+      build: {},
+      isolation: 'container',
+      network: { mode: 'none' },
+      args: [],
+      env: {},
+      workdir,
+      limits: { ...DEFAULT_LIMITS },
+      stagedFiles: [],
+      mounts: [],
+      ...overrides
+    } as SandboxRunSpec;
+  };
+
+  const until = async (check: () => boolean) => {
+    for (let i = 0; i < 200 && !check(); i++) {
+      await new Promise((resolve) => setTimeout(resolve, 5));
+    }
+  };
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'coordinator-'));
+    ran = [];
+    coordinator = new Coordinator({ workerTimeoutMs: 60000, dispatchTimeoutMs: 2000, maxAttempts: 2 }, logger);
+    coordinator.start();
+  });
+
+  afterEach(() => {
+    coordinator.stop();
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('sends each run to the least loaded worker that runs its language', async () => {
+    attachWorker('small', ['python'], 1);
+    attachWorker('big', ['python', 'ruby'], 4);
+    await until(() => coordinator.stats().workers.length === 2);
+    expect(coordinator.stats().workers.map((worker) => [worker.id, worker.languages, worker.capacity])).toEqual([
+      ['small', ['python'], 1],
+      ['big', ['python', 'ruby'], 4]
+    ]);
+    const results = await Promise.all([
+      coordinator.run(spec('run_a')),
+      coordinator.run(spec('run_b')),
+      coordinator.run(spec('run_c', 'ruby'))
+    ]);
+    expect(results.map((entry) => entry.stdout.toString())).toEqual(['small ran run_a', 'big ran run_b', 'big ran run_c']);
+    expect(ran.find((entry) => entry.spec.id === 'run_a')?.spec).toMatchObject({ language: 'python', code: 'print(1)', limits: DEFAULT_LIMITS });
+  });
+
+  it('sends runs asking for GPUs to workers with free ones, reserving the devices', async () => {
+    const releases: Array<() => void> = [];
+    attachWorker('cpu', ['python'], 4);
+    attachWorker(
+      'gpu',
+      ['python'],
+      4,
+      {
+        run: (spec) =>
+          new Promise((resolve) => {
+            ran.push({ worker: 'gpu', spec });
+            releases.push(() => resolve(result(`gpu ran ${spec.id}`)));
+          })
+      },
+      [{ id: '0', vram_mb: 16000 }]
+    );
+    await until(() => coordinator.stats().workers.length === 2);
+    const whole = coordinator.run(spec('run_whole', 'python', { gpu: { count: 1 } }));
+    const shared = coordinator.run(spec('run_shared', 'python', { gpu: { count: 1, vram_mb: 8000 } }));
+    // Waiting for the GPU doesn't hold up runs that need none.
+    expect((await coordinator.run(spec('run_cpu'))).stdout.toString()).toBe('cpu ran run_cpu');
+    await until(() => ran.length === 2);
+    expect(ran.map((entry) => [entry.worker, entry.spec.id, entry.spec.gpuDevices])).toEqual([
+      ['gpu', 'run_whole', ['0']],
+      ['cpu', 'run_cpu', undefined]
+    ]);
+    expect(coordinator.stats()).toMatchObject({ waiting: 1 });
+    expect(coordinator.stats().workers[1].gpus).toEqual([{ id: '0', vram_mb: 16000, free_vram_mb: 0, runs: 1 }]);
+    releases[0]();
+    await whole;
+    await until(() => ran.length === 3);
+    expect(ran[2].spec).toMatchObject({ id: 'run_shared', gpuDevices: ['0'], gpu: { vram_mb: 8000 } });
+    expect(coordinator.stats().workers[1].gpus[0]).toMatchObject({ free_vram_mb: 8000, runs: 1 });
+    releases[1]();
+    await shared;
+  });
+
+  it('ships input files, relays output and brings artifacts back under the run\'s limits', async () => {
+    attachWorker('w1', ['python'], 1, {
+      async run(spec) {
+        expect(fs.readFileSync(path.join(spec.workdir, 'inputs', 'data.csv'), 'utf8')).toBe('a,b\n');
+        expect(fs.readFileSync(path.join(spec.workdir, 'inputs', 'upload.txt'), 'utf8')).toBe('uploaded');
+        expect(fs.readFileSync(path.join(spec.workdir, 'inputs', '..data.txt'), 'utf8')).toBe('dotted');
+        spec.onOutput?.('stdout', Buffer.from('partial'));
+        fs.writeFileSync(path.join(spec.workdir, 'outputs', 'plot.png'), 'png');
+        fs.writeFileSync(path.join(spec.workdir, 'outputs', 'huge.bin'), Buffer.alloc(64));
+        return { ...result('done'), artifacts: [
+          { path: path.join(spec.workdir, 'outputs', 'huge.bin'), name: 'huge.bin', size: 64 },
+          { path: path.join(spec.workdir, 'outputs', 'plot.png'), name: 'plot.png', size: 3, contentType: 'image/png' }
+        ] };
+      }
+    });
+    const run = spec('run_files', 'python', { limits: { ...DEFAULT_LIMITS, max_artifact_file_bytes: 32 } });
+    fs.writeFileSync(path.join(run.workdir, 'inputs', 'data.csv'), 'a,b\n');
+    fs.writeFileSync(path.join(run.workdir, 'inputs', '..data.txt'), 'dotted');
+    const upload = path.join(tmpDir, 'upload.txt');
+    fs.writeFileSync(upload, 'uploaded');
+    run.stagedFiles = [{ sourcePath: upload, destPath: 'upload.txt' }];
+    const output: string[] = [];
+    run.onOutput = (stream, data) => output.push(`${stream}:${data.toString()}`);
+    const outcome = await coordinator.run(run);
+    expect(output).toEqual(['stdout:partial']);
+    expect(outcome.stdout.toString()).toBe('done');
+    expect(outcome.artifacts.map((file) => [file.name, file.size, file.contentType])).toEqual([
+      ['huge.bin', 64, undefined],
+      ['plot.png', 3, 'image/png']
+    ]);
+    expect(fs.readFileSync(path.join(run.workdir, 'outputs', 'plot.png'), 'utf8')).toBe('png');
+    // Left out by the worker, but still as large as it was so the orchestrator skips it too.
+    expect(fs.statSync(path.join(run.workdir, 'outputs', 'huge.bin')).size).toBe(64);
+  });
+
+  it('fails jobs with a file outside the run directory instead of running them without it', async () => {
+    const { coordinatorEnd, workerEnd } = linkPair();
+    const failures: Array<WorkerMessage['failure']> = [];
+    coordinatorEnd.onMessage((message) => message.failure && failures.push(message.failure));
+    new WorkerAgent({ id: 'w1', registry: registry('python'), capacity: 1, workRoot: tmpDir, heartbeatMs: 1000, sandbox: {
+      async run(spec) {
+        ran.push({ worker: 'w1', spec });
+        return result('ran');
+      }
+    } }, logger).attach(workerEnd);
+    const { workdir, ...remote } = spec('run_escape');
+    coordinatorEnd.send({ job: { job_id: 'run_escape', attempt: 1, spec_json: JSON.stringify(remote), files: [{ path: '../escape.txt', data: Buffer.from('x') }] } });
+    await until(() => failures.length > 0);
+    expect(failures).toEqual([{ job_id: 'run_escape', error: 'job file ../escape.txt is outside the run directory', status_code: 400, infrastructure: false }]);
+    expect(ran).toEqual([]);
+    expect(fs.existsSync(path.join(tmpDir, 'escape.txt'))).toBe(false);
+    coordinatorEnd.close();
+  });
+
+  it('re-dispatches the runs of a worker that disconnects', async () => {
+    let release!: () => void;
+    const stuck = new Promise<void>((resolve) => {
+      release = resolve;
+    });
+    const doomed = attachWorker('doomed', ['python'], 1, {
+      async run(spec) {
+        ran.push({ worker: 'doomed', spec });
+        await stuck;
+        return result('too late');
+      }
+    });
+    const pending = coordinator.run(spec('run_lost'));
+    await until(() => ran.length === 1);
+    attachWorker('spare', ['python'], 1);
+    await until(() => coordinator.stats().workers.length === 2);
+    doomed.link.close();
+    const outcome = await pending;
+    expect(outcome.stdout.toString()).toBe('spare ran run_lost');
+    expect(coordinator.stats()).toMatchObject({ redispatched: 1, waiting: 0 });
+    expect(doomed.agent.connected).toBe(false);
+    release();
+  });
+
+  it('presumes a silent worker dead and fails runs once their attempts are used up', async () => {
+    coordinator.stop();
+    coordinator = new Coordinator({ workerTimeoutMs: 100, dispatchTimeoutMs: 2000, maxAttempts: 1 }, logger);
+    coordinator.start();
+    const { coordinatorEnd, workerEnd } = linkPair();
+    coordinator.connect(coordinatorEnd);
+    workerEnd.send({ register: { worker_id: 'silent', languages: ['python'], capacity: 1 } });
+    await until(() => coordinator.stats().workers.length === 1);
+    const outcome = coordinator.run(spec('run_silent')).catch((err: Error) => err);
+    // The monitor's timer doesn't hold the process open, so the test waits with one of its own.
+    await until(() => coordinator.stats().workers.length === 0);
+    expect(await outcome).toMatchObject({ message: 'worker silent was lost: heartbeat timed out' });
+  });
+
+  it('runs a job again on another worker when its sandbox fails to start, but not when the request is refused', async () => {
+    const broken: SandboxRunner = {
+      async run(spec) {
+        ran.push({ worker: 'broken', spec });
+        if (spec.isolation === 'microvm') {
+          throw Boom.badRequest('isolation microvm is not available');
+        }
+        throw infrastructureFailure('sandbox failed to start: no space left on device');
+      }
+    };
+    attachWorker('broken', ['python'], 4, broken);
+    attachWorker('healthy', ['python'], 1);
+    await until(() => coordinator.stats().workers.length === 2);
+    // The broken worker is the less loaded one until the healthy one is busy.
+    const outcome = await coordinator.run(spec('run_retried'));
+    expect(outcome.stdout.toString()).toBe('healthy ran run_retried');
+    expect(outcome.retries).toEqual([{ attempt: 1, worker: 'broken', error: 'sandbox failed to start: no space left on device' }]);
+    expect(coordinator.stats().redispatched).toBe(1);
+    const refused = await coordinator.run(spec('run_refused', 'python', { isolation: 'microvm' })).catch((err: Error) => err);
+    expect(refused).toMatchObject({ message: 'isolation microvm is not available', output: { statusCode: 400 } });
+    expect(ran.filter((entry) => entry.spec.id === 'run_refused').map((entry) => entry.worker)).toEqual(['broken']);
+  });
+
+  it('fails runs no worker takes within the dispatch timeout', async () => {
+    coordinator.stop();
+    coordinator = new Coordinator({ workerTimeoutMs: 60000, dispatchTimeoutMs: 50, maxAttempts: 2 }, logger);
+    attachWorker('w1', ['ruby'], 1);
+    const err = await coordinator.run(spec('run_orphan', 'python')).catch((error: Error & { data?: unknown }) => error);
+    expect(err).toMatchObject({ message: 'no worker available for python', data: { code: 'no_worker' } });
+  });
+
+  it('cancels runs waiting for a worker and those a worker is running', async () => {
+    attachWorker('w1', ['python'], 1, {
+      run: (spec) =>
+        new Promise((resolve) => {
+          ran.push({ worker: 'w1', spec });
+          spec.signal?.addEventListener('abort', () => resolve(result('', 'canceled')));
+        })
+    });
+    await until(() => coordinator.stats().workers.length === 1);
+    const running = new AbortController();
+    const waiting = new AbortController();
+    const first = coordinator.run(spec('run_1', 'python', { signal: running.signal }));
+    const second = coordinator.run(spec('run_2', 'python', { signal: waiting.signal }));
+    await until(() => ran.length === 1);
+    expect(coordinator.stats().waiting).toBe(1);
+    waiting.abort();
+    expect((await second).status).toBe('canceled');
+    running.abort();
+    expect((await first).status).toBe('canceled');
+    expect(ran.map((entry) => entry.spec.id)).toEqual(['run_1']);
+  });
+});
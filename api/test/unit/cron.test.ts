@@ -0,0 +1,33 @@
+import { parseCron } from '../../src/core/cron.js';
+
+describe('parseCron', () => {
+  const next = (source: string, after: string) => parseCron(source).next(new Date(after)).toISOString();
+
+  it('finds the next matching minute in UTC', () => {
+    expect(next('0 3 * * *', '2026-03-10T02:59:30.000Z')).toBe('2026-03-10T03:00:00.000Z');
+    expect(next('0 3 * * *', '2026-03-10T03:00:00.000Z')).toBe('2026-03-11T03:00:00.000Z');
+    expect(next('*/15 9-17 * * MON-FRI', '2026-03-13T17:50:00.000Z')).toBe('2026-03-16T09:00:00.000Z');
+    expect(next('5/20 * * * *', '2026-03-10T10:46:00.000Z')).toBe('2026-03-10T11:05:00.000Z');
+    expect(next('0 0 1 jan,jul *', '2026-03-10T00:00:00.000Z')).toBe('2026-07-01T00:00:00.000Z');
+    expect(next('@weekly', '2026-03-10T00:00:00.000Z')).toBe('2026-03-15T00:00:00.000Z');
+    expect(next('0 12 * * 7', '2026-03-10T00:00:00.000Z')).toBe('2026-03-15T12:00:00.000Z');
+  });
+
+  it('matches either day field once both are restricted', () => {
+    // The 13th, or any Friday.
+    expect(next('0 0 13 * 5', '2026-03-01T00:00:00.000Z')).toBe('2026-03-06T00:00:00.000Z');
+    expect(next('0 0 13 * 5', '2026-03-07T00:00:00.000Z')).toBe('2026-03-13T00:00:00.000Z');
+    expect(next('0 0 13 * ?', '2026-03-07T00:00:00.000Z')).toBe('2026-03-13T00:00:00.000Z');
+    expect(next('0 0 29 2 *', '2026-03-01T00:00:00.000Z')).toBe('2028-02-29T00:00:00.000Z');
+  });
+
+  it('refuses malformed and impossible expressions', () => {
+    expect(() => parseCron('0 3 * *')).toThrow('cron must have 5 fields');
+    expect(() => parseCron('60 * * * *')).toThrow('cron minute must be from 0 to 59, got 60');
+    expect(() => parseCron('0 ? * * *')).toThrow('cron hour field is invalid: ?');
+    expect(() => parseCron('*/0 * * * *')).toThrow('cron minute field is invalid: */0');
+    expect(() => parseCron('0 0 * FOO *')).toThrow('cron month must be from 1 to 12, got FOO');
+    expect(() => parseCron('0 0 30 2 *')).toThrow('never matches');
+    expect(() => parseCron(42)).toThrow('cron must be a cron expression');
+  });
+});
@@ -0,0 +1,157 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import zlib from 'node:zlib';
+import { DatasetStore } from '../../src/core/datasets.js';
+import { packTarGz } from '../../src/util/tar.js';
+
+interface ZipEntry {
+  name: string;
+  data: Buffer;
+  // Unix file type and permission bits.
+  mode?: number;
+}
+
+// Deflated entries made on Unix, enough for the reader; CRCs are left zero since it does not check them.
+function zip(entries: ZipEntry[]): Buffer {
+  const locals: Buffer[] = [];
+  const central: Buffer[] = [];
+  let offset = 0;
+  for (const entry of entries) {
+    const name = Buffer.from(entry.name);
+    const data = zlib.deflateRawSync(entry.data);
+    const local = Buffer.alloc(30);
+    local.writeUInt32LE(0x04034b50, 0);
+    local.writeUInt16LE(20, 4);
+    local.writeUInt16LE(8, 8);
+    local.writeUInt32LE(data.length, 18);
+    local.writeUInt32LE(entry.data.length, 22);
+    local.writeUInt16LE(name.length, 26);
+    const header = Buffer.alloc(46);
+    header.writeUInt32LE(0x02014b50, 0);
+    header.writeUInt16LE((3 << 8) | 20, 4);
+    header.writeUInt16LE(20, 6);
+    header.writeUInt16LE(8, 10);
+    header.writeUInt32LE(data.length, 20);
+    header.writeUInt32LE(entry.data.length, 24);
+    header.writeUInt16LE(name.length, 28);
+    header.writeUInt32LE(((entry.mode ?? 0o100644) << 16) >>> 0, 38);
+    header.writeUInt32LE(offset, 42);
+    locals.push(local, name, data);
+    central.push(header, name);
+    offset += local.length + name.length + data.length;
+  }
+  const directory = Buffer.concat(central);
+  const end = Buffer.alloc(22);
+  end.writeUInt32LE(0x06054b50, 0);
+  end.writeUInt16LE(entries.length, 8);
+  end.writeUInt16LE(entries.length, 10);
+  end.writeUInt32LE(directory.length, 12);
+  end.writeUInt32LE(offset, 16);
+  return Buffer.concat([...locals, directory, end]);
+}
+
+describe('DatasetStore', () => {
+  let tmpDir: string;
+  let datasets: DatasetStore;
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'datasets-'));
+    datasets = new DatasetStore({ baseDir: path.join(tmpDir, 'datasets'), maxBytes: 1024 * 1024, maxFiles: 10 });
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  function archive(name: string, contents: Buffer) {
+    const file = path.join(tmpDir, name);
+    fs.writeFileSync(file, contents);
+    return file;
+  }
+
+  const fixtures = [
+    { name: 'cases/1.in', data: Buffer.from('1 2\n') },
+    { name: 'cases/1.out', data: Buffer.from('3\n') },
+    { name: 'check.sh', data: Buffer.from('#!/bin/sh\n'), mode: 0o755 }
+  ];
+
+  it('extracts tar and zip archives into read-only trees addressed by their contents', async () => {
+    const fromTar = await datasets.create(archive('a.tar.gz', packTarGz(fixtures)), 'course-101');
+    const fromZip = await datasets.create(
+      archive('a.zip', zip(fixtures.map((entry) => ({ ...entry, name: `./${entry.name}`, mode: 0o100000 | (entry.mode ?? 0o644) })))),
+      'course-101-zip'
+    );
+    expect(fromTar).toMatchObject({ created: true, dataset: { name: 'course-101', format: 'tar', files: 3, size: 16 } });
+    expect(fromZip.dataset).toMatchObject({ format: 'zip', digest: fromTar.dataset.digest });
+    const tree = datasets.pathOf(fromTar.dataset.id);
+    expect(datasets.pathOf(fromZip.dataset.id)).toBe(tree);
+    expect(fs.readFileSync(path.join(tree, 'cases', '1.in'), 'utf8')).toBe('1 2\n');
+    expect(fs.statSync(path.join(tree, 'cases', '1.out')).mode & 0o777).toBe(0o444);
+    expect(fs.statSync(path.join(tree, 'check.sh')).mode & 0o777).toBe(0o555);
+    expect(new DatasetStore({ baseDir: path.join(tmpDir, 'datasets') }).list().map((dataset) => dataset.name)).toEqual([
+      'course-101',
+      'course-101-zip'
+    ]);
+  });
+
+  it('returns the existing dataset for the same upload and refuses new contents under its name', async () => {
+    const first = await datasets.create(archive('a.tar.gz', packTarGz(fixtures)), 'course-101');
+    const again = await datasets.create(archive('b.tar', zlib.gunzipSync(packTarGz(fixtures))), 'course-101');
+    expect(again).toEqual({ dataset: first.dataset, created: false });
+    await expect(datasets.create(archive('c.tar.gz', packTarGz(fixtures.slice(1))), 'course-101')).rejects.toMatchObject({
+      message: 'dataset course-101 already exists with different contents',
+      output: { statusCode: 409 }
+    });
+  });
+
+  it('shares unchanged files between versions of a dataset', async () => {
+    const v1 = await datasets.create(archive('v1.tar.gz', packTarGz(fixtures)), 'v1');
+    const v2 = await datasets.create(
+      archive('v2.tar.gz', packTarGz([fixtures[0], { name: 'cases/1.out', data: Buffer.from('4\n') }])),
+      'v2'
+    );
+    const inode = (id: string, name: string) => fs.statSync(path.join(datasets.pathOf(id), name)).ino;
+    expect(inode(v1.dataset.id, 'cases/1.in')).toBe(inode(v2.dataset.id, 'cases/1.in'));
+    expect(inode(v1.dataset.id, 'cases/1.out')).not.toBe(inode(v2.dataset.id, 'cases/1.out'));
+  });
+
+  it('refuses archives that are unsafe, too large or not archives at all', async () => {
+    const refused = async (name: string, contents: Buffer) => {
+      try {
+        await datasets.create(archive(name, contents), 'bad');
+      } catch (err) {
+        return (err as Error).message;
+      }
+      return null;
+    };
+    expect(await refused('a.tar.gz', packTarGz([{ name: '../escape.txt', data: Buffer.from('x') }]))).toBe(
+      'invalid dataset archive: unsafe path "../escape.txt"'
+    );
+    expect(await refused('b.zip', zip([{ name: 'link', data: Buffer.from('/etc/passwd'), mode: 0o120777 }]))).toBe(
+      'invalid dataset archive: link is a link; only regular files and directories are supported'
+    );
+    expect(await refused('c.tar.gz', packTarGz([{ name: 'a', data: Buffer.from('x') }, { name: 'a/b', data: Buffer.from('y') }]))).toBe(
+      'invalid dataset archive: a is both a file and a directory'
+    );
+    expect(await refused('d.zip', zip([{ name: 'zeros', data: Buffer.alloc(2 * 1024 * 1024) }]))).toBe(
+      'dataset archive expands beyond the maximum dataset size'
+    );
+    expect(await refused('e.tar.gz', packTarGz(Array.from({ length: 11 }, (_, index) => ({ name: `${index}`, data: Buffer.from('x') }))))).toBe(
+      'dataset archive exceeds 10 files'
+    );
+    expect(await refused('f.txt', Buffer.from('just text'))).toBe('dataset archive must be a zip, tar or gzipped tar file');
+    expect(datasets.list()).toEqual([]);
+  });
+
+  it('keeps a deleted dataset\'s tree until the runs mounting it release it', async () => {
+    const { dataset } = await datasets.create(archive('a.tar.gz', packTarGz(fixtures)), 'course-101');
+    const tree = datasets.pathOf(dataset.id);
+    const release = datasets.hold([dataset.id]);
+    datasets.delete(dataset.id);
+    expect(() => datasets.get(dataset.id)).toThrow('dataset not found');
+    expect(fs.existsSync(path.join(tree, 'cases', '1.in'))).toBe(true);
+    release();
+    expect(fs.existsSync(tree)).toBe(false);
+  });
+});
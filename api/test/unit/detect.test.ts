@@ -0,0 +1,47 @@
+import { detectLanguage } from '../../src/core/detect.js';
+
+describe('detectLanguage', () => {
+  it('trusts the file name, then the sources, then a shebang', () => {
+    expect(detectLanguage({ filename: 'solution.rs', code: 'print(1)' })).toEqual({ language: 'rust', confidence: 1, source: 'filename' });
+    expect(detectLanguage({ sources: { 'main.go': 'package main', 'util.go': 'package main' } })).toMatchObject({ language: 'go', source: 'filename' });
+    expect(detectLanguage({ sources: { 'a.py': '', 'b.py': '', 'notes.txt': '' } })).toMatchObject({ language: 'python' });
+    expect(detectLanguage({ code: '#!/usr/bin/env python3\nprint(1)' })).toEqual({ language: 'python', confidence: 1, source: 'shebang' });
+    expect(detectLanguage({ filename: 'run.sh', code: '#!/bin/sh\necho hi' })).toMatchObject({ language: 'sh', source: 'shebang' });
+    expect(detectLanguage({ code: '#!/usr/bin/env -S deno run\nconst x = 1;' })).toMatchObject({ language: 'typescript' });
+  });
+
+  it('recognizes languages from their code', () => {
+    const cases: Array<[string, string]> = [
+      ['python', 'def add(a, b):\n    return a + b\n\nprint(add(1, 2))\n'],
+      ['go', 'package main\n\nimport "fmt"\n\nfunc main() {\n\tfmt.Println("hi")\n}\n'],
+      ['rust', 'fn main() {\n    println!("hi");\n}\n'],
+      ['java', 'public class Main {\n  public static void main(String[] args) {\n    System.out.println("hi");\n  }\n}\n'],
+      ['kotlin', 'fun main() {\n    println("hi")\n}\n'],
+      ['c', '#include <stdio.h>\n\nint main(void) {\n  printf("hi\\n");\n  return 0;\n}\n'],
+      ['cpp', '#include <iostream>\n\nint main() {\n  std::cout << "hi";\n}\n'],
+      ['node', 'const fs = require("fs");\nconsole.log(fs.readdirSync("."));\n'],
+      ['typescript', 'const greeting: string = "hi";\nconsole.log(greeting);\n'],
+      ['ruby', '[1, 2].each do |n|\n  puts n\nend\n'],
+      ['php', '<?php\necho "hi";\n'],
+      ['sql', 'CREATE TABLE t (id INTEGER);\nSELECT * FROM t;\n'],
+      ['bash', 'names=(a b)\nfor n in "${names[@]}"; do\n  echo "$n"\ndone\n'],
+      ['wasm', 'AGFzbQEAAAA=']
+    ];
+    for (const [language, code] of cases) {
+      const detection = detectLanguage({ code });
+      expect(detection.language).toBe(language);
+      expect(detection.confidence).toBeGreaterThanOrEqual(0.6);
+    }
+  });
+
+  it('refuses to guess between languages that fit equally well', () => {
+    expect(() => detectLanguage({ filename: 'run.sh', code: 'echo hi' })).toThrow('language is ambiguous between bash, sh');
+    try {
+      detectLanguage({ filename: 'run.sh', code: 'echo hi' });
+    } catch (err) {
+      expect((err as { data: unknown }).data).toMatchObject({ code: 'language_ambiguous', candidates: [{ language: 'bash' }, { language: 'sh' }] });
+    }
+    expect(() => detectLanguage({ code: 'hello world' })).toThrow('language is required and could not be detected');
+    expect(() => detectLanguage({ code: 'print(1)' })).toThrow('could not be detected');
+  });
+});
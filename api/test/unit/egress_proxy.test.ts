@@ -0,0 +1,96 @@
+import http from 'node:http';
+import net from 'node:net';
+import { EgressProxy, permits, validateAllowlist } from '../../src/core/egress_proxy.js';
+import { Logger } from '../../src/util/logger.js';
+
+describe('EgressProxy', () => {
+  let upstream: http.Server;
+  let upstreamPort: number;
+  let proxy: EgressProxy;
+  let proxyPort: number;
+
+  beforeAll(async () => {
+    upstream = http.createServer((_req, res) => res.end('fixture'));
+    await new Promise<void>((resolve) => upstream.listen(0, '127.0.0.1', resolve));
+    upstreamPort = (upstream.address() as net.AddressInfo).port;
+    proxy = new EgressProxy({ port: 0, host: '127.0.0.1', advertisedHost: '127.0.0.1' }, new Logger({ test: 'egress' }));
+    proxyPort = await proxy.listen();
+  });
+
+  afterAll(() => {
+    proxy.close();
+    upstream.close();
+  });
+
+  // Sends a plain HTTP request for the fixture through the proxy URL of a grant.
+  const fetchThrough = (proxyUrl: string | null) => {
+    const url = new URL(proxyUrl ?? `http://127.0.0.1:${proxyPort}`);
+    const headers: Record<string, string> = {};
+    if (proxyUrl) {
+      headers['proxy-authorization'] = `Basic ${Buffer.from(`${url.username}:${url.password}`).toString('base64')}`;
+    }
+    return new Promise<{ status: number; body: string }>((resolve, reject) => {
+      const req = http.request(
+        { host: url.hostname, port: url.port, path: `http://127.0.0.1:${upstreamPort}/`, headers, agent: false },
+        (res) => {
+          let body = '';
+          res.on('data', (chunk) => (body += chunk));
+          res.on('end', () => resolve({ status: res.statusCode ?? 0, body }));
+        }
+      );
+      req.on('error', reject);
+      req.end();
+    });
+  };
+
+  it('forwards requests to allowed destinations', async () => {
+    const grant = proxy.grant('run_a', ['127.0.0.0/8']);
+    expect(await fetchThrough(grant.proxyUrl)).toEqual({ status: 200, body: 'fixture' });
+    grant.release();
+    expect((await fetchThrough(grant.proxyUrl)).status).toBe(403);
+  });
+
+  it('refuses destinations outside the allowlist and requests without credentials', async () => {
+    const grant = proxy.grant('run_b', ['10.0.0.0/8', 'example.com']);
+    expect((await fetchThrough(grant.proxyUrl)).status).toBe(403);
+    expect((await fetchThrough(null)).status).toBe(403);
+    grant.release();
+  });
+
+  it('tunnels CONNECT requests', async () => {
+    const grant = proxy.grant('run_c', ['127.0.0.1']);
+    const url = new URL(grant.proxyUrl);
+    const socket = await new Promise<net.Socket>((resolve, reject) => {
+      const req = http.request({
+        host: url.hostname,
+        port: url.port,
+        method: 'CONNECT',
+        agent: false,
+        path: `127.0.0.1:${upstreamPort}`,
+        headers: { 'proxy-authorization': `Basic ${Buffer.from(`${url.username}:${url.password}`).toString('base64')}` }
+      });
+      req.on('connect', (res, tunnel) => (res.statusCode === 200 ? resolve(tunnel) : reject(new Error(`${res.statusCode}`))));
+      req.on('error', reject);
+      req.end();
+    });
+    const response = await new Promise<string>((resolve) => {
+      let data = '';
+      socket.on('data', (chunk) => (data += chunk));
+      socket.on('end', () => resolve(data));
+      socket.write('GET / HTTP/1.1\r\nHost: fixture\r\nConnection: close\r\n\r\n');
+    });
+    expect(response).toContain('fixture');
+    grant.release();
+  });
+
+  it('validates allowlist entries against the operator list', () => {
+    expect(validateAllowlist(['pypi.org', '*.example.com', '10.0.0.0/8', '::1'])).toHaveLength(4);
+    expect(() => validateAllowlist([])).toThrow('at least one');
+    expect(() => validateAllowlist(['10.0.0.0/40'])).toThrow('invalid network.allow entry');
+    expect(() => validateAllowlist(['http://pypi.org'])).toThrow('invalid network.allow entry');
+    expect(permits(['*.example.com', '10.0.0.0/8'], 'api.example.com')).toBe(true);
+    expect(permits(['*.example.com', '10.0.0.0/8'], '10.0.0.0/8')).toBe(true);
+    expect(permits(['*.example.com', '10.0.0.0/8'], '10.1.0.0/16')).toBe(false);
+    expect(permits(['pypi.org'], 'evil.org')).toBe(false);
+  });
+});
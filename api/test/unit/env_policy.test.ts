@@ -0,0 +1,35 @@
+import { EnvPolicy } from '../../src/core/env_policy.js';
+
+describe('EnvPolicy', () => {
+  it('accepts ordinary configuration', () => {
+    const policy = new EnvPolicy();
+    expect(policy.validate(undefined)).toEqual({});
+    expect(policy.validate({ APP_MODE: 'test', LEVEL: '3' })).toEqual({ APP_MODE: 'test', LEVEL: '3' });
+  });
+
+  it('refuses loader variables and names the sandbox sets', () => {
+    const policy = new EnvPolicy();
+    expect(() => policy.validate({ LD_PRELOAD: '/tmp/x.so' })).toThrow('env variable not allowed: LD_PRELOAD');
+    expect(() => policy.validate({ ld_library_path: '/tmp' })).toThrow('not allowed');
+    expect(() => policy.validate({ DYLD_INSERT_LIBRARIES: 'x' })).toThrow('not allowed');
+    expect(() => policy.validate({ PATH: '/tmp' })).toThrow('env variable not allowed: PATH');
+    expect(() => policy.validate({ HOME: '/' })).toThrow('not allowed');
+  });
+
+  it('applies configured deny prefixes and allowlists', () => {
+    const policy = new EnvPolicy({ allow: ['APP_*', 'DEBUG'], denyPrefixes: ['APP_SECRET'] });
+    expect(policy.validate({ APP_MODE: 'x', DEBUG: '1' })).toEqual({ APP_MODE: 'x', DEBUG: '1' });
+    expect(() => policy.validate({ OTHER: 'x' })).toThrow('env variable not allowed: OTHER');
+    expect(() => policy.validate({ APP_SECRET_KEY: 'x' })).toThrow('not allowed');
+  });
+
+  it('validates names, values and size', () => {
+    const policy = new EnvPolicy({ maxBytes: 16, maxVars: 2 });
+    expect(() => policy.validate({ 'BAD-NAME': 'x' })).toThrow('invalid env variable name');
+    expect(() => policy.validate({ A: 1 as never })).toThrow('must be a string');
+    expect(() => policy.validate({ A: 'a\0b' })).toThrow('without NUL bytes');
+    expect(() => policy.validate({ A: '1', B: '2', C: '3' })).toThrow('env exceeds 2 variables');
+    expect(() => policy.validate({ NAME: 'x'.repeat(13) })).toThrow('env exceeds 16 bytes');
+    expect(() => policy.validate(['A=1'])).toThrow('env must be an object of strings');
+  });
+});
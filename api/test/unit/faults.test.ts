@@ -0,0 +1,126 @@
+import { FaultInjector, parseFaultHeader } from '../../src/core/faults.js';
+import { DEFAULT_LIMITS } from '../../src/core/limits.js';
+import { Logger } from '../../src/util/logger.js';
+import type { FaultKind, SandboxRunner, SandboxRunSpec, SandboxResult } from '../../src/core/types.js';
+
+// Writes `first`, then `second` 20 ms later, and finishes after 40 ms, or as soon as it is
+// canceled; Go runs report a 10 ms build.
+class SlowSandbox implements SandboxRunner {
+  public readonly specs: SandboxRunSpec[] = [];
+
+  async run(spec: SandboxRunSpec): Promise<SandboxResult> {
+    this.specs.push(spec);
+    spec.onOutput?.('stdout', Buffer.from('first\n'));
+    const canceled = await new Promise<boolean>((resolve) => {
+      const second = setTimeout(() => spec.onOutput?.('stdout', Buffer.from('second\n')), 20);
+      const done = setTimeout(() => resolve(false), 40);
+      spec.signal?.addEventListener('abort', () => {
+        clearTimeout(second);
+        clearTimeout(done);
+        resolve(true);
+      });
+    });
+    return {
+      status: canceled ? 'canceled' : 'succeeded',
+      exitCode: canceled ? null : 0,
+      limitExceeded: null,
+      stdout: Buffer.from(canceled ? 'first\n' : 'first\nsecond\n'),
+      stderr: Buffer.alloc(0),
+      usage: { wall_ms: 40, cpu_ms: 1, max_rss_mb: 8 },
+      artifacts: [],
+      compile: spec.language === 'go' ? { exit_code: 0, stdout: '', stderr: '', duration_ms: 10 } : null
+    };
+  }
+}
+
+function spec(overrides: Partial<SandboxRunSpec> = {}): SandboxRunSpec {
+  return {
+    id: 'run_1',
+    language: 'python',
+    mode: 'run',
+    code: 'print(1)',
+    sources: {},
+    stdin: '',
+    build: {},
+    isolation: 'container',
+    network: { mode: 'none' },
+    args: [],
+    env: {},
+    workdir: '/tmp/run_1',
+    limits: DEFAULT_LIMITS,
+    stagedFiles: [],
+    mounts: [],
+    ...overrides
+  };
+}
+
+describe('FaultInjector', () => {
+  let sandbox: SlowSandbox;
+  const injector = (options: { rate?: number; kinds?: FaultKind[]; random?: () => number } = {}) =>
+    new FaultInjector({ rate: 0, kinds: [], delayMs: 100, next: sandbox, ...options }, new Logger({ test: 'faults' }));
+
+  beforeEach(() => {
+    sandbox = new SlowSandbox();
+  });
+
+  it('runs requests without faults as they are', async () => {
+    const result = await injector().run(spec());
+    expect(result.status).toBe('succeeded');
+    expect(sandbox.specs).toHaveLength(1);
+  });
+
+  it('fails the run as an infrastructure failure before the sandbox starts', async () => {
+    await expect(injector().run(spec({ faults: ['sandbox_create'] }))).rejects.toThrow('sandbox failed to start: injected fault');
+    expect(sandbox.specs).toHaveLength(0);
+  });
+
+  it('counts a slow compile in the compile phase', async () => {
+    const started = Date.now();
+    const result = await injector().run(spec({ language: 'go', faults: ['slow_compile'] }));
+    expect(Date.now() - started).toBeGreaterThan(130);
+    expect(result.compile!.duration_ms).toBeGreaterThan(105);
+    expect(result.status).toBe('succeeded');
+  });
+
+  it('kills a run partway through and fails it as a lost worker would', async () => {
+    const output: string[] = [];
+    const crashing = new FaultInjector({ rate: 0, kinds: [], delayMs: 10, next: sandbox }, new Logger({ test: 'faults' }));
+    await expect(crashing.run(spec({ faults: ['worker_crash'], onOutput: (_, chunk) => output.push(chunk.toString()) })))
+      .rejects.toThrow('worker crashed mid-run: injected fault');
+    expect(output).toEqual(['first\n']);
+    expect(sandbox.specs[0].signal?.aborted).toBe(true);
+
+    // A run the caller cancels is canceled rather than crashed.
+    const controller = new AbortController();
+    const canceled = injector().run(spec({ faults: ['worker_crash'], signal: controller.signal }));
+    controller.abort();
+    expect((await canceled).status).toBe('canceled');
+  });
+
+  it('holds back output after the first chunk, and the result with it', async () => {
+    const output: Array<[string, number]> = [];
+    const started = Date.now();
+    const result = await injector().run(spec({ faults: ['output_stall'], onOutput: (_, chunk) => output.push([chunk.toString(), Date.now() - started]) }));
+    expect(output.map(([chunk]) => chunk)).toEqual(['first\n', 'second\n']);
+    expect(output[1][1]).toBeGreaterThan(95);
+    expect(Date.now() - started).toBeGreaterThan(95);
+    expect(result.stdout.toString()).toBe('first\nsecond\n');
+  });
+
+  it('injects one of the configured faults into the given share of runs', async () => {
+    const draws = [0.05, 0.9, 0.5];
+    const random = injector({ rate: 0.1, kinds: ['slow_compile', 'sandbox_create'], random: () => draws.shift() ?? 0.99 });
+    await expect(random.run(spec())).rejects.toThrow('injected fault');
+    // 0.5 is above the rate.
+    expect((await random.run(spec())).status).toBe('succeeded');
+  });
+});
+
+describe('parseFaultHeader', () => {
+  it('reads fault kinds separated by commas only where fault injection is enabled', () => {
+    expect(parseFaultHeader(undefined, false)).toBeUndefined();
+    expect(parseFaultHeader('worker_crash, output_stall,worker_crash', true)).toEqual(['worker_crash', 'output_stall']);
+    expect(() => parseFaultHeader('worker_crash', false)).toThrow('fault injection is not enabled on this server');
+    expect(() => parseFaultHeader('power_cut', true)).toThrow('unknown fault: power_cut');
+  });
+});
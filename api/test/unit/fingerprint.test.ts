@@ -0,0 +1,84 @@
+import { MAX_FINGERPRINT_HASHES, fingerprint, similarity } from '../../src/core/fingerprint.js';
+
+const SOLUTION = `
+# Sums the numbers on each line.
+import sys
+
+def total(line):
+    values = [int(word) for word in line.split()]
+    return sum(values) // len(values)
+
+for line in sys.stdin:
+    print(total(line), "average")
+`;
+
+const RENAMED = `
+import sys
+def mean(row):  # renamed everything
+    xs = [int(w) for w in row.split()]
+    return sum(xs) // len(xs)
+for row in sys.stdin:
+    print(mean(row), 'mean')
+`;
+
+const OTHER = `
+import sys
+data = sys.stdin.read().split()
+while data:
+    if data.pop() == "stop":
+        break
+else:
+    raise SystemExit(2)
+`;
+
+function shared(a: number[], b: number[]) {
+  const other = new Set(b);
+  return a.filter((hash) => other.has(hash)).length;
+}
+
+describe('fingerprint', () => {
+  it('ignores names, literals, comments and layout', () => {
+    const original = fingerprint({ language: 'python', code: SOLUTION });
+    expect(original.length).toBeGreaterThan(0);
+    expect(fingerprint({ language: 'python', code: RENAMED })).toEqual(original);
+    // Sorted and distinct.
+    expect([...original].sort((a, b) => a - b)).toEqual(original);
+    expect(new Set(original).size).toBe(original.length);
+  });
+
+  it('tells unrelated submissions apart', () => {
+    const a = fingerprint({ language: 'python', code: SOLUTION });
+    const b = fingerprint({ language: 'python', code: OTHER });
+    expect(similarity(shared(a, b), a.length, b.length)).toBeLessThan(0.2);
+    expect(similarity(a.length, a.length, a.length)).toBe(1);
+    expect(similarity(0, 0, 0)).toBe(0);
+  });
+
+  it('covers every source file but not the template', () => {
+    const code = fingerprint({ language: 'python', code: SOLUTION });
+    const split = fingerprint({ language: 'python', code: '', sources: { 'main.py': SOLUTION } });
+    expect(split).toEqual(code);
+    const extended = fingerprint({ language: 'python', code: SOLUTION, sources: { 'util.py': OTHER } });
+    expect(shared(code, extended)).toBe(code.length);
+    expect(extended.length).toBeGreaterThan(code.length);
+  });
+
+  it('uses the language\'s comment syntax', () => {
+    const go = 'func main() { x := 1 // a comment\n\tfmt.Println(x) /* another */ }';
+    expect(fingerprint({ language: 'go', code: go })).toEqual(fingerprint({ language: 'go', code: 'func main() { y := 2\n fmt.Println(y) }' }));
+    // `//` is integer division in Python, not a comment.
+    expect(fingerprint({ language: 'python', code: 'a = b // c + d * e - f' })).not.toEqual(fingerprint({ language: 'python', code: 'a = b' }));
+  });
+
+  it('has no hashes for tiny submissions and caps large ones', () => {
+    expect(fingerprint({ language: 'python', code: 'print(1)' })).toEqual([]);
+    // Tokens in a fixed pseudo-random order, so that nearly every k-gram is a different one.
+    const symbols = ['if', 'for', 'while', 'return', '+', '-', '*', '/', '(', ')', '[', ']', ':', ',', '=', 'x', '1'];
+    let state = 1;
+    const large = Array.from({ length: 20000 }, () => {
+      state = (state * 1103515245 + 12345) % 2147483648;
+      return symbols[state % symbols.length];
+    }).join(' ');
+    expect(fingerprint({ language: 'python', code: large }).length).toBe(MAX_FINGERPRINT_HASHES);
+  });
+});
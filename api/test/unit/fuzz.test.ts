@@ -0,0 +1,101 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { Fuzzer } from '../../src/core/fuzz.js';
+import { Logger } from '../../src/util/logger.js';
+import { ScriptedSandbox, scriptedOrchestrator } from './scripted_sandbox.js';
+import type { Script } from './scripted_sandbox.js';
+
+// Reads whitespace-separated integers and prints their sum, like a judge's solution. Input that
+// isn't a list of integers raises a ValueError naming the offending token, a negative number
+// exits with status 3, and more than five numbers take so long that the run times out.
+const script: Script = (spec) => {
+  const tokens = (spec.stdin ?? '').split(/\s+/).filter(Boolean);
+  const invalid = tokens.find((token) => !/^-?\d+$/.test(token));
+  if (invalid !== undefined) {
+    const traceback = `Traceback (most recent call last):\nValueError: invalid literal for int() with base 10: '${invalid}'\n`;
+    return { status: 'failed', exitCode: 1, stderr: Buffer.from(traceback) };
+  }
+  if (tokens.some((token) => token.startsWith('-') && token !== '-0')) {
+    return { status: 'failed', exitCode: 3, stderr: Buffer.from('negative input\n') };
+  }
+  if (tokens.length > 5) {
+    return { status: 'timeout', exitCode: null, limitExceeded: 'wall_time' };
+  }
+  return { stdout: Buffer.from(`${tokens.reduce((sum, token) => sum + BigInt(token), 0n)}\n`) };
+};
+
+describe('Fuzzer', () => {
+  let tmpDir: string;
+  let sandbox: ScriptedSandbox;
+  let fuzzer: Fuzzer;
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'fuzz-'));
+    sandbox = new ScriptedSandbox(script);
+    const orchestrator = scriptedOrchestrator(tmpDir, sandbox);
+    fuzzer = new Fuzzer({ orchestrator, logger: new Logger({ test: 'fuzz' }), maxRuns: 300, maxBudgetMs: 60000, concurrency: 4 });
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('finds each kind of failure once and counts the inputs that cause it', async () => {
+    const result = await fuzzer.fuzz({ language: 'python', code: 'print(sum(map(int, input().split())))', corpus: ['1 2', '40 2'], seed: 7 }, 'dev');
+    expect(result).toMatchObject({ stopped: 'max_runs', runs: 300, seed: 7, compile: null });
+    // The seeds run first, as they are.
+    expect(sandbox.specs.slice(0, 2).map((spec) => spec.stdin)).toEqual(['1 2', '40 2']);
+    expect(sandbox.specs.every((spec) => spec.mode === 'run')).toBe(true);
+    expect(new Set(sandbox.specs.map((spec) => spec.stdin)).size).toBe(300);
+    expect(result.corpus_size).toBeGreaterThan(2);
+
+    const kinds = result.findings.map((finding) => [finding.verdict, finding.exit_code]);
+    expect(new Set(kinds.map(String)).size).toBe(kinds.length);
+    // Every invalid token is the same ValueError.
+    const valueErrors = result.findings.filter((finding) => finding.stderr_tail.startsWith('ValueError'));
+    expect(valueErrors).toHaveLength(1);
+    expect(valueErrors[0]).toMatchObject({ verdict: 'RE', status: 'failed', exit_code: 1, seed: false });
+    expect(valueErrors[0].count).toBeGreaterThan(1);
+    expect(result.findings.find((finding) => finding.exit_code === 3)).toMatchObject({ verdict: 'RE', stderr_tail: 'negative input' });
+    for (const finding of result.findings) {
+      const run = sandbox.specs.find((spec) => spec.stdin === finding.input);
+      expect(run).toBeDefined();
+    }
+  });
+
+  it('repeats a fuzz given the same seed', async () => {
+    const first = await fuzzer.fuzz({ language: 'python', code: 'x', corpus: ['3 4'], seed: 42, max_runs: 40 }, 'dev');
+    const inputs = sandbox.specs.map((spec) => spec.stdin);
+    sandbox.specs.length = 0;
+    const second = await fuzzer.fuzz({ language: 'python', code: 'x', corpus: ['3 4'], seed: 42, max_runs: 40 }, 'dev');
+    expect(sandbox.specs.map((spec) => spec.stdin)).toEqual(inputs);
+    expect(second.findings.map((finding) => finding.input)).toEqual(first.findings.map((finding) => finding.input));
+  });
+
+  it('reports failing seeds and stops on a submission that does not compile', async () => {
+    const seeded = await fuzzer.fuzz({ language: 'python', code: 'x', corpus: ['abc'], max_runs: 1 }, 'dev');
+    expect(seeded.findings).toMatchObject([{ input: 'abc', seed: true, stderr_tail: "ValueError: invalid literal for int() with base 10: 'abc'" }]);
+
+    sandbox.specs.length = 0;
+    const broken = await fuzzer.fuzz({ language: 'go', code: 'syntax error', corpus: ['1', '2'] }, 'dev');
+    expect(broken).toMatchObject({ stopped: 'compile_error', runs: 1, findings: [] });
+    expect(broken.compile).toMatchObject({ exit_code: 1 });
+    expect(sandbox.specs).toHaveLength(1);
+  });
+
+  it('stops once the budget is spent', async () => {
+    const result = await fuzzer.fuzz({ language: 'python', code: 'x', budget_ms: 1 }, 'dev');
+    expect(result.stopped).toBe('budget');
+    expect(result.runs).toBeLessThan(300);
+  });
+
+  it('validates the request before running anything', async () => {
+    await expect(fuzzer.fuzz({ language: 'python', code: 'x', stdin: '1' } as never, 'dev')).rejects.toThrow('stdin cannot be set');
+    await expect(fuzzer.fuzz({ language: 'python', code: 'x', corpus: [] }, 'dev')).rejects.toThrow('corpus must be a non-empty array of strings');
+    await expect(fuzzer.fuzz({ language: 'python', code: 'x', max_runs: 301 }, 'dev')).rejects.toThrow('max_runs must be an integer from 1 to 300');
+    await expect(fuzzer.fuzz({ language: 'python', code: 'x', budget_ms: 0 }, 'dev')).rejects.toThrow('budget_ms must be an integer from 1 to 60000');
+    await expect(fuzzer.fuzz({ language: 'cobol', code: 'x' }, 'dev')).rejects.toThrow();
+    expect(sandbox.specs).toHaveLength(0);
+  });
+});
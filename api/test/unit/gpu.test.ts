@@ -0,0 +1,71 @@
+import { GpuPool, parseGpuDevices, validateGpu } from '../../src/core/gpu.js';
+
+describe('GpuPool', () => {
+  const devices = [
+    { id: '0', vram_mb: 16000 },
+    { id: '1', vram_mb: 24000 }
+  ];
+
+  it('shares devices between runs whose reservations fit and picks the fullest device first', () => {
+    const pool = new GpuPool(devices);
+    const first = pool.tryAcquire({ count: 1, vram_mb: 10000 });
+    expect(first?.devices).toEqual(['0']);
+    expect(pool.tryAcquire({ count: 1, vram_mb: 6000 })?.devices).toEqual(['0']);
+    expect(pool.tryAcquire({ count: 1, vram_mb: 6000 })?.devices).toEqual(['1']);
+    expect(pool.stats().map((device) => [device.id, device.free_vram_mb, device.runs])).toEqual([
+      ['0', 0, 2],
+      ['1', 18000, 1]
+    ]);
+  });
+
+  it('gives runs without vram_mb whole devices', () => {
+    const pool = new GpuPool(devices);
+    const shared = pool.tryAcquire({ count: 1, vram_mb: 1000 });
+    expect(pool.tryAcquire({ count: 2 })).toBeNull();
+    shared?.release();
+    shared?.release();
+    const whole = pool.tryAcquire({ count: 2 });
+    expect(whole).toMatchObject({ devices: ['0', '1'], vram_mb: null });
+    expect(pool.tryAcquire({ count: 1, vram_mb: 1 })).toBeNull();
+  });
+
+  it('serves waiting runs oldest first as devices are released, and drops canceled ones', async () => {
+    const pool = new GpuPool([devices[0]]);
+    const holder = pool.tryAcquire({ count: 1 });
+    const controller = new AbortController();
+    const canceled = pool.acquire({ count: 1 }, controller.signal);
+    const whole = pool.acquire({ count: 1 });
+    const small = pool.acquire({ count: 1, vram_mb: 1000 });
+    controller.abort();
+    expect(await canceled).toBeNull();
+    holder?.release();
+    const lease = await whole;
+    expect(lease?.devices).toEqual(['0']);
+    lease?.release();
+    expect((await small)?.vram_mb).toBe(1000);
+  });
+
+  it('tells requests that could never be served from those that must wait', () => {
+    const pool = new GpuPool(devices);
+    expect(pool.fits({ count: 2, vram_mb: 16000 })).toBe(true);
+    expect(pool.fits({ count: 2, vram_mb: 20000 })).toBe(false);
+    expect(pool.fits({ count: 3 })).toBe(false);
+  });
+});
+
+describe('validateGpu', () => {
+  it('checks the count and memory of a request', () => {
+    expect(() => validateGpu({ count: 1, vram_mb: 4096 })).not.toThrow();
+    expect(() => validateGpu({ count: 0 })).toThrow('gpu.count must be an integer from 1 to 8');
+    expect(() => validateGpu({ vram_mb: 1.5 })).toThrow('gpu.vram_mb must be a positive integer');
+    expect(() => validateGpu([] as never)).toThrow('gpu must be an object');
+  });
+
+  it('parses id:vram_mb device lists', () => {
+    expect(parseGpuDevices('0:24576,GPU-1f2e:16384')).toEqual([
+      { id: '0', vram_mb: 24576 },
+      { id: 'GPU-1f2e', vram_mb: 16384 }
+    ]);
+    expect(() => parseGpuDevices('0')).toThrow('expected id:vram_mb, got 0');
+  });
+});
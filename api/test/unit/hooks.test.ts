@@ -0,0 +1,51 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { CommandHook, HookRunner } from '../../src/core/hooks.js';
+import type { HookContext } from '../../src/core/hooks.js';
+import type { RunRecord } from '../../src/core/types.js';
+import { Logger } from '../../src/util/logger.js';
+
+describe('hooks', () => {
+  let tmpDir: string;
+  const logger = new Logger({ test: 'hooks' });
+  const context: HookContext = { run_id: 'run_1', language: 'python', tenant: 'acme', request: { language: 'python', code: 'print(1)' } };
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'hooks-'));
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  const script = (name: string, body: string) => {
+    const file = path.join(tmpDir, name);
+    fs.writeFileSync(file, `#!/bin/sh\n${body}\n`, { mode: 0o755 });
+    return file;
+  };
+
+  it('passes the run to command hooks and reads their replies', async () => {
+    const seen = path.join(tmpDir, 'seen.json');
+    const fingerprint = script('fingerprint', `cat > ${seen}; echo '{"annotation": {"fingerprint": "abc"}}'`);
+    const hook = new CommandHook({ name: 'fingerprint', command: [fingerprint], events: ['after_completion'] });
+    expect(hook.beforeCompile).toBeUndefined();
+    const run = { id: 'run_1', status: 'succeeded' } as RunRecord;
+    await expect(hook.afterCompletion?.(context, run)).resolves.toEqual({ fingerprint: 'abc' });
+    expect(JSON.parse(fs.readFileSync(seen, 'utf8'))).toMatchObject({ event: 'after_completion', run_id: 'run_1', tenant: 'acme', result: { status: 'succeeded' } });
+
+    const gate = new CommandHook({ name: 'gate', command: [script('gate', `cat > /dev/null; echo '{"reject": "quota used up"}'`)] });
+    await expect(gate.beforeCompile?.(context)).rejects.toMatchObject({ message: 'quota used up', data: { code: 'rejected_by_hook' } });
+  });
+
+  it('refuses runs whose before_compile hook fails unless failing open', async () => {
+    const crash = new CommandHook({ name: 'crash', command: [script('crash', 'exit 3')], events: ['before_compile'] });
+    await expect(new HookRunner([crash], {}, logger).beforeCompile(context)).rejects.toMatchObject({
+      message: 'hook crash failed',
+      data: { code: 'hook_failed' }
+    });
+    await expect(new HookRunner([crash], { failOpen: true }, logger).beforeCompile(context)).resolves.toBeUndefined();
+    const slow = { name: 'slow', beforeCompile: () => new Promise<void>(() => undefined) };
+    await expect(new HookRunner([slow], { timeoutMs: 20 }, logger).beforeCompile(context)).rejects.toMatchObject({ data: { hook: 'slow' } });
+  });
+});
@@ -0,0 +1,63 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { detectConfinement, jobLimits, sandboxExecProfile } from '../../src/core/host_confinement.js';
+import { DEFAULT_LIMITS } from '../../src/core/limits.js';
+
+describe('detectConfinement', () => {
+  const runnersDir = '/opt/runners';
+
+  it('picks each platform\'s mechanism and reports what it leaves unenforced', () => {
+    const exists = () => true;
+    const runs = () => true;
+    expect(detectConfinement({ runnersDir, platform: 'darwin', exists, runs })).toEqual({
+      platform: 'darwin',
+      mechanism: 'sandbox-exec',
+      missing: ['memory limits']
+    });
+    expect(detectConfinement({ runnersDir, platform: 'win32', exists, runs })).toEqual({
+      platform: 'win32',
+      mechanism: 'job-object',
+      missing: ['network isolation']
+    });
+  });
+
+  it('reports hosts without a usable mechanism instead of picking none silently', () => {
+    expect(detectConfinement({ runnersDir, platform: 'darwin', exists: () => false })).toMatchObject({
+      mechanism: null,
+      missing: ['/usr/bin/sandbox-exec']
+    });
+    expect(detectConfinement({ runnersDir, platform: 'win32', exists: () => true, runs: () => false })).toMatchObject({
+      mechanism: null,
+      missing: ['Python to run job_exec.py']
+    });
+    expect(detectConfinement({ runnersDir, platform: 'freebsd' })).toMatchObject({ mechanism: null });
+  });
+});
+
+describe('sandboxExecProfile', () => {
+  it('confines writes to the run directory and opens only localhost for loopback runs', () => {
+    const runDir = fs.mkdtempSync(path.join(os.tmpdir(), 'confinement-'));
+    try {
+      const offline = sandboxExecProfile(runDir, { mode: 'none' });
+      expect(offline).toContain('(deny file-write*)');
+      expect(offline).toContain(`(subpath ${JSON.stringify(fs.realpathSync(runDir))})`);
+      expect(offline).toContain('(deny network*)');
+      expect(offline).not.toContain('localhost');
+      expect(sandboxExecProfile(runDir, { mode: 'loopback' })).toContain('(remote ip "localhost:*")');
+    } finally {
+      fs.rmSync(runDir, { recursive: true, force: true });
+    }
+  });
+});
+
+describe('jobLimits', () => {
+  it('hands the job object the run\'s memory, process and CPU limits', () => {
+    expect(jobLimits('C:\\runs\\run_1', DEFAULT_LIMITS)).toEqual({
+      workdir: 'C:\\runs\\run_1',
+      memory_mb: DEFAULT_LIMITS.memory_mb,
+      max_processes: DEFAULT_LIMITS.max_processes,
+      cpu_ms: DEFAULT_LIMITS.cpu_ms
+    });
+  });
+});
@@ -0,0 +1,100 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { ImageManager } from '../../src/core/images.js';
+import { RunnerRegistry } from '../../src/core/runners.js';
+import { Logger } from '../../src/util/logger.js';
+
+describe('ImageManager', () => {
+  let tmpDir: string;
+  let cli: string;
+  let registry: RunnerRegistry;
+  const logger = new Logger({ test: 'images' });
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'images-'));
+    cli = path.join(tmpDir, 'docker');
+    // Fake CLI whose host holds the images named by files under host/; pulling copies one over
+    // from registry/, and `image rm` is logged.
+    fs.mkdirSync(path.join(tmpDir, 'host'));
+    fs.mkdirSync(path.join(tmpDir, 'registry'));
+    fs.writeFileSync(
+      cli,
+      [
+        '#!/bin/sh',
+        `dir=${tmpDir}`,
+        'name() { printf %s "$1" | tr "/:@" "___"; }',
+        'case "$1 $2" in',
+        '  "image inspect") [ -f "$dir/host/$(name "$5")" ] && cat "$dir/host/$(name "$5")";;',
+        '  "pull "*) [ -f "$dir/registry/$(name "$2")" ] && cp "$dir/registry/$(name "$2")" "$dir/host/$(name "$2")";;',
+        '  "image rm") echo "$3" >> "$dir/removed";;',
+        '  *) exit 1;;',
+        'esac'
+      ].join('\n'),
+      { mode: 0o755 }
+    );
+    registry = new RunnerRegistry();
+    registry.register({ language: 'go', image: 'runner-go:latest', entryFile: 'main.go', extensions: ['.go'], pidsLimit: 64, versionCommand: [] });
+    registry.register({ language: 'zig', image: 'runner-zig:dev', entryFile: 'main.zig', extensions: ['.zig'], pidsLimit: 64, versionCommand: [] });
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  const image = (where: 'host' | 'registry', reference: string, id: string, digest?: string) => {
+    const repository = reference.slice(0, reference.lastIndexOf(':'));
+    fs.writeFileSync(path.join(tmpDir, where, reference.replace(/[/:@]/g, '_')), `sha256:${id} ${digest ? `${repository}@sha256:${digest}` : ''}\n`);
+  };
+  const removed = () => (fs.existsSync(path.join(tmpDir, 'removed')) ? fs.readFileSync(path.join(tmpDir, 'removed'), 'utf8').trim().split('\n') : []);
+
+  it('pulls missing images at startup and pins them by digest', async () => {
+    image('registry', 'runner-go:latest', 'aaa', '111');
+    image('registry', 'runner-go:1.22', 'bbb', '222');
+    // Built on the host, so there is no registry digest to pin to.
+    image('host', 'runner-zig:dev', 'ccc');
+    const images = new ImageManager({ cli, registry, catalog: { 'go@1.22': 'runner-go:1.22' } }, logger);
+    expect(images.list().map((entry) => entry.status)).toEqual(['pending', 'pending', 'pending']);
+    await images.prepare();
+    expect(images.list()).toMatchObject([
+      { language: 'go', version: null, image: 'runner-go:latest', pinned: 'runner-go@sha256:111', image_id: 'sha256:aaa', source: 'runner', status: 'ready' },
+      { language: 'go', version: '1.22', pinned: 'runner-go@sha256:222', source: 'config', status: 'ready' },
+      { language: 'zig', version: null, pinned: 'runner-zig:dev', status: 'ready' }
+    ]);
+    expect(registry.require('go').image).toBe('runner-go@sha256:111');
+    expect(images.lookup('go', '1.22')).toBe('runner-go@sha256:222');
+    expect(images.lookup('go', '1.21')).toBeNull();
+    expect(images.versions('go')).toEqual(['1.22']);
+  });
+
+  it('leaves images it cannot get unpinned and reports why', async () => {
+    const images = new ImageManager({ cli, registry, pull: false }, logger);
+    await images.prepare();
+    expect(images.list()[0]).toMatchObject({ status: 'failed', pinned: null, error: 'image runner-go:latest is not available' });
+    expect(registry.require('go').image).toBe('runner-go:latest');
+  });
+
+  it('switches to an updated image only once it is pinned and removes the one it replaced', async () => {
+    image('host', 'runner-go:latest', 'aaa', '111');
+    image('host', 'runner-zig:dev', 'ccc');
+    const stateFile = path.join(tmpDir, 'state', 'images.json');
+    const images = new ImageManager({ cli, registry, stateFile }, logger);
+    await images.prepare();
+    await expect(images.set('go', null, 'runner-go:1.23')).rejects.toMatchObject({ data: { code: 'image_unavailable' } });
+    expect(registry.require('go').image).toBe('runner-go@sha256:111');
+    image('registry', 'runner-go:1.23', 'ddd', '333');
+    await expect(images.set('go', null, 'runner-go:1.23')).resolves.toMatchObject({ pinned: 'runner-go@sha256:333', source: 'admin' });
+    expect(registry.require('go').image).toBe('runner-go@sha256:333');
+    expect(removed()).toEqual(['runner-go@sha256:111']);
+    // The update outlives a restart.
+    const restarted = new ImageManager({ cli, registry: freshRegistry(), stateFile }, logger);
+    expect(restarted.list()[0]).toMatchObject({ image: 'runner-go:1.23', source: 'admin' });
+    await expect(images.remove('go', '1.21')).rejects.toMatchObject({ message: 'image not found' });
+  });
+
+  function freshRegistry() {
+    const fresh = new RunnerRegistry();
+    fresh.register({ language: 'go', image: 'runner-go:latest', entryFile: 'main.go', extensions: ['.go'], pidsLimit: 64, versionCommand: [] });
+    return fresh;
+  }
+});
@@ -0,0 +1,168 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { BuildCache, buildDigest } from '../../src/core/build_cache.js';
+import { Janitor } from '../../src/core/janitor.js';
+import type { ContainerHost, SandboxContainer } from '../../src/core/janitor.js';
+import { DockerSandbox } from '../../src/core/sandbox.js';
+import { Logger } from '../../src/util/logger.js';
+
+describe('Janitor', () => {
+  let tmpDir: string;
+  let workRoot: string;
+  const logger = new Logger({ test: 'janitor' });
+  const HOUR = 3600000;
+
+  // A work directory last modified `ageMs` ago, holding `bytes` bytes.
+  const workdir = (name: string, ageMs: number, bytes = 10) => {
+    const dir = path.join(workRoot, name);
+    fs.mkdirSync(path.join(dir, 'outputs'), { recursive: true });
+    fs.writeFileSync(path.join(dir, 'outputs', 'out.bin'), Buffer.alloc(bytes));
+    const at = new Date(Date.now() - ageMs);
+    fs.utimesSync(dir, at, at);
+    return dir;
+  };
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'janitor-'));
+    workRoot = path.join(tmpDir, 'work');
+    fs.mkdirSync(workRoot);
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('removes old work directories and containers no live execution owns', async () => {
+    const orphan = workdir('run_orphan000001', 2 * HOUR, 100);
+    const live = workdir('run_live00000001', 2 * HOUR);
+    const recent = workdir('run_recent000001', 60000);
+    const warm = workdir('warm_python_abc123', 2 * HOUR, 50);
+    const other = workdir('operator-notes', 2 * HOUR);
+    const removed: string[][] = [];
+    const containers: ContainerHost = {
+      listContainers: async (): Promise<SandboxContainer[]> => [
+        { name: 'run_orphan000001_a1b2c3', created_at: Date.now() - 2 * HOUR },
+        { name: 'run_live00000001_d4e5f6', created_at: Date.now() - 2 * HOUR },
+        { name: 'deps_node_0f0f0f0f0f0f', created_at: Date.now() - 60000 }
+      ],
+      removeContainers: async (names) => {
+        removed.push(names);
+      }
+    };
+    const janitor = new Janitor(
+      { ttlMs: HOUR, cacheTtlMs: HOUR, workRoots: [workRoot], isLive: (name) => name.startsWith('run_live'), containers },
+      logger
+    );
+    expect(await janitor.sweep()).toEqual({ workdirs: 2, containers: 1, cache_entries: 0, reclaimed_bytes: 150 });
+    expect([orphan, warm].some((dir) => fs.existsSync(dir))).toBe(false);
+    expect([live, recent, other].every((dir) => fs.existsSync(dir))).toBe(true);
+    expect(removed).toEqual([['run_orphan000001_a1b2c3']]);
+    expect(janitor.stats()).toMatchObject({
+      sweeps: 1,
+      removed: { workdirs: 2, containers: 1, cache_entries: 0 },
+      reclaimed_bytes: { workdirs: 150, cache: 0 }
+    });
+  });
+
+  it('keeps sweeping when the container host is unavailable', async () => {
+    workdir('run_orphan000001', 2 * HOUR);
+    const janitor = new Janitor(
+      {
+        ttlMs: HOUR,
+        cacheTtlMs: HOUR,
+        workRoots: [workRoot, path.join(tmpDir, 'missing')],
+        isLive: () => false,
+        containers: {
+          listContainers: async () => {
+            throw new Error('Cannot connect to the Docker daemon');
+          },
+          removeContainers: async () => undefined
+        }
+      },
+      logger
+    );
+    expect(await janitor.sweep()).toMatchObject({ workdirs: 1, containers: 0 });
+  });
+
+  it('expires build cache entries nothing has used for the cache TTL', async () => {
+    const dir = path.join(tmpDir, 'cache');
+    const parts = { language: 'go', mode: 'run', image: 'runner-go', toolchain: 'go1.22', sources: {}, build: {} };
+    const build = path.join(tmpDir, 'build');
+    fs.mkdirSync(build);
+    fs.writeFileSync(path.join(build, 'main'), Buffer.alloc(64, 1));
+    const first = new BuildCache({ dir, maxBytes: 1024 * 1024 }, logger);
+    const stale = first.key({ ...parts, code: 'package stale' });
+    const used = first.key({ ...parts, code: 'package used' });
+    first.store(stale, build, buildDigest(build));
+    first.store(used, build, buildDigest(build));
+    // Both were stored two days ago; `used` has been restored since.
+    const twoDaysAgo = new Date(Date.now() - 48 * HOUR);
+    for (const key of [stale, used]) {
+      fs.utimesSync(path.join(dir, key, '.complete'), twoDaysAgo, twoDaysAgo);
+    }
+    const cache = new BuildCache({ dir, maxBytes: 1024 * 1024 }, logger);
+    expect(cache.restore(used, path.join(tmpDir, 'restored'))).toBe(true);
+    const janitor = new Janitor(
+      {
+        ttlMs: HOUR,
+        cacheTtlMs: 24 * HOUR,
+        workRoots: [],
+        isLive: () => false,
+        caches: [{ name: 'build', expire: (before) => cache.expire(before) }]
+      },
+      logger
+    );
+    // Entries are the same size, completion marker included.
+    const entryBytes = cache.stats().bytes / 2;
+    expect(await janitor.sweep()).toEqual({ workdirs: 0, containers: 0, cache_entries: 1, reclaimed_bytes: entryBytes });
+    expect(fs.existsSync(path.join(dir, stale))).toBe(false);
+    expect(cache.stats()).toMatchObject({ entries: 1, bytes: entryBytes });
+    expect(janitor.stats().reclaimed_bytes.cache).toBe(entryBytes);
+  });
+
+  it('lists labelled containers through the Docker CLI', async () => {
+    const cli = path.join(tmpDir, 'docker');
+    fs.writeFileSync(
+      cli,
+      [
+        '#!/bin/sh',
+        'case "$1" in',
+        '  ps) printf "run_abc_1\\t2026-01-02 15:04:05 +0000 UTC\\nwarm_go_2\\t2026-01-02 16:04:05.123456 +0100 CET\\n";;',
+        `  rm) echo "$@" > ${path.join(tmpDir, 'removed')};;`,
+        'esac'
+      ].join('\n'),
+      { mode: 0o755 }
+    );
+    const docker = new DockerSandbox({ workRoot, seccompProfile: '/seccomp/default.json', cli }, logger);
+    expect(await docker.listContainers()).toEqual([
+      { name: 'run_abc_1', created_at: Date.parse('2026-01-02T15:04:05Z') },
+      { name: 'warm_go_2', created_at: Date.parse('2026-01-02T15:04:05.123Z') }
+    ]);
+    await docker.removeContainers(['run_abc_1']);
+    expect(fs.readFileSync(path.join(tmpDir, 'removed'), 'utf8').trim()).toBe('rm --force run_abc_1');
+  });
+
+  it('expires dependency layers by when runs last used them', () => {
+    const cacheDir = path.join(tmpDir, 'deps');
+    const layer = (name: string, ageMs: number, complete: boolean) => {
+      const dir = path.join(cacheDir, 'python', name);
+      fs.mkdirSync(dir, { recursive: true });
+      fs.writeFileSync(path.join(dir, 'site.py'), Buffer.alloc(32));
+      const at = new Date(Date.now() - ageMs);
+      if (complete) {
+        fs.writeFileSync(path.join(dir, '.complete'), '');
+        fs.utimesSync(path.join(dir, '.complete'), at, at);
+      }
+      fs.utimesSync(dir, at, at);
+      return dir;
+    };
+    const stale = layer('stale', 48 * HOUR, true);
+    const fresh = layer('fresh', HOUR, true);
+    const abandoned = layer('abandoned', 48 * HOUR, false);
+    const docker = new DockerSandbox({ workRoot, seccompProfile: '/seccomp/default.json', cacheDir }, logger);
+    expect(docker.expireDependencies(Date.now() - 24 * HOUR)).toEqual({ entries: 2, bytes: 64 });
+    expect(fs.existsSync(stale) || fs.existsSync(abandoned)).toBe(false);
+    expect(fs.existsSync(fresh)).toBe(true);
+  });
+});
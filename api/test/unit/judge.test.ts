@@ -0,0 +1,299 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { Judge, outputMatches } from '../../src/core/judge.js';
+import { ResultCache } from '../../src/core/result_cache.js';
+import { Logger } from '../../src/util/logger.js';
+import type { RunRecord, SandboxRunSpec, SandboxResult } from '../../src/core/types.js';
+import { ScriptedSandbox, scriptedOrchestrator } from './scripted_sandbox.js';
+import type { Script } from './scripted_sandbox.js';
+
+// Echoes stdin back as stdout. A `crash` or `slow` stdin produces the other outcomes a judged run
+// can have. The code `permutation checker` plays a checker accepting any ordering of the answer's
+// tokens; `broken checker` crashes. Piped runs play an interactive problem: the `guess interactor`
+// asks for the answer and accepts only it back, `broken interactor` crashes, and submissions echo
+// (`echo`), reverse (`reverse`), hang up without answering (`hang up`) or never stop (`stubborn`).
+const script: Script = (spec) => {
+  if (spec.input) {
+    return interactive(spec, spec.input);
+  }
+  const stdout = Buffer.from(spec.stdin);
+  if (spec.code.endsWith('checker')) {
+    const read = (name: string) =>
+      fs.readFileSync(path.join(spec.workdir, 'inputs', name), 'utf8').split(/\s+/).sort().join(' ');
+    const accepted = read('output.txt') === read('answer.txt');
+    if (spec.code === 'broken checker') {
+      return { status: 'failed', exitCode: 3, stdout: Buffer.from('checker crashed') };
+    }
+    return accepted
+      ? { status: 'succeeded', exitCode: 0, stdout: Buffer.from('ok') }
+      : { status: 'failed', exitCode: 1, stdout: Buffer.from('not a permutation') };
+  }
+  if (spec.stdin === 'crash') {
+    return { status: 'failed', exitCode: 2, stdout };
+  }
+  if (spec.stdin === 'slow') {
+    return { status: 'timeout', exitCode: 124, limitExceeded: 'wall_time', stdout };
+  }
+  return { stdout };
+};
+
+async function interactive(spec: SandboxRunSpec, input: NodeJS.ReadableStream): Promise<Partial<SandboxResult>> {
+  let stdout = '';
+  const write = (text: string) => {
+    stdout += text;
+    spec.onOutput?.('stdout', Buffer.from(text));
+  };
+  const exit = (status: SandboxResult['status'], exitCode: number | null, stderr = '') => ({
+    status,
+    exitCode,
+    stdout: Buffer.from(stdout),
+    stderr: Buffer.from(stderr)
+  });
+  // Resolves with the next chunk, or null once stdin is closed or the run canceled.
+  const read = () =>
+    new Promise<string | null>((resolve) => {
+      const done = (value: string | null) => {
+        input.off('data', onData);
+        input.off('end', onEnd);
+        spec.signal?.removeEventListener('abort', onEnd);
+        resolve(value);
+      };
+      const onData = (data: Buffer) => done(data.toString());
+      const onEnd = () => done(null);
+      input.on('data', onData);
+      input.on('end', onEnd);
+      spec.signal?.addEventListener('abort', onEnd);
+    });
+  if (spec.code === 'broken interactor') {
+    return exit('failed', 3, 'interactor crashed');
+  }
+  if (spec.code === 'guess interactor') {
+    const answer = fs.readFileSync(path.join(spec.workdir, 'inputs', 'answer.txt'), 'utf8');
+    write(answer);
+    const reply = await read();
+    return reply === answer ? exit('succeeded', 0) : exit('failed', 1, `expected ${answer}, got ${reply}`);
+  }
+  if (spec.code === 'hang up') {
+    return exit('succeeded', 0);
+  }
+  if (spec.code === 'stubborn') {
+    // Ignores stdin, even once it is closed, until canceled.
+    await new Promise((resolve) => spec.signal?.addEventListener('abort', resolve));
+    return exit('canceled', null);
+  }
+  const question = await read();
+  if (question === null) {
+    return exit(spec.signal?.aborted ? 'canceled' : 'succeeded', spec.signal?.aborted ? null : 0);
+  }
+  write(spec.code === 'reverse' ? [...question].reverse().join('') : question);
+  return exit('succeeded', 0);
+}
+
+describe('Judge', () => {
+  let tmpDir: string;
+  let sandbox: ScriptedSandbox;
+  let judge: Judge;
+  let runs: RunRecord[];
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'judge-'));
+    sandbox = new ScriptedSandbox(script);
+    runs = [];
+    const orchestrator = scriptedOrchestrator(tmpDir, sandbox);
+    judge = new Judge({ orchestrator, logger: new Logger({ test: 'judge' }), concurrency: 2, onRun: (run) => runs.push(run) });
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('gives each case a verdict', async () => {
+    const result = await judge.judge(
+      {
+        language: 'python',
+        code: 'print(input())',
+        cases: [
+          { stdin: '3\n', expected_stdout: '3' },
+          { stdin: '4\n', expected_stdout: '5' },
+          { stdin: 'crash', expected_stdout: '' },
+          { stdin: 'slow', expected_stdout: '' }
+        ]
+      },
+      'dev'
+    );
+    expect(result.cases.map((c) => c.verdict)).toEqual(['AC', 'WA', 'RE', 'TLE']);
+    expect(result.verdict).toBe('WA');
+    expect(result.cases[1].diff).toMatchObject({ format: 'unified', line: 1, column: 1, expected: '5\n', actual: '4\n' });
+    expect(result.cases.filter((c) => c.diff).map((c) => c.index)).toEqual([1]);
+    expect(result.passed).toBe(1);
+    expect(result.total).toBe(4);
+    expect(result.compile).toBeNull();
+    expect(runs.map((run) => run.id).sort()).toEqual(result.cases.map((c) => c.run_id).sort());
+  });
+
+  it('stops after a compile error', async () => {
+    const result = await judge.judge(
+      {
+        language: 'go',
+        code: 'package main syntax error',
+        cases: [{ stdin: '1', expected_stdout: '1' }, { stdin: '2', expected_stdout: '2' }]
+      },
+      'dev'
+    );
+    expect(sandbox.specs).toHaveLength(1);
+    expect(result.verdict).toBe('CE');
+    expect(result.cases.map((c) => c.verdict)).toEqual(['CE', 'CE']);
+    expect(result.cases[1].run_id).toBeNull();
+    expect(result.compile?.exit_code).toBe(1);
+  });
+
+  it('runs every case of a compiled submission that builds', async () => {
+    const result = await judge.judge(
+      {
+        language: 'go',
+        code: 'package main',
+        cases: [1, 2, 3].map((n) => ({ stdin: `${n}`, expected_stdout: `${n}` }))
+      },
+      'dev'
+    );
+    expect(result.verdict).toBe('AC');
+    expect(result.passed).toBe(3);
+    expect(sandbox.specs.map((spec) => spec.stdin).sort()).toEqual(['1', '2', '3']);
+  });
+
+  it('starts no more cases after a failure when asked to fail fast, keeping results in case order', async () => {
+    const compiled = await judge.judge(
+      { language: 'go', code: 'package main', fail_fast: true, cases: [1, 2, 3].map((n) => ({ stdin: `${n}`, expected_stdout: '2' })) },
+      'dev'
+    );
+    expect(compiled.cases.map((c) => [c.index, c.verdict, c.run_id === null])).toEqual([
+      [0, 'WA', false],
+      [1, 'SK', true],
+      [2, 'SK', true]
+    ]);
+    expect(sandbox.specs).toHaveLength(1);
+    expect(compiled.verdict).toBe('WA');
+    const cases = ['1', 'crash', '3', '4', '5', '6'].map((stdin) => ({ stdin, expected_stdout: stdin }));
+    const interpreted = await judge.judge({ language: 'python', code: 'print(input())', fail_fast: true, cases }, 'dev');
+    expect(interpreted.cases.map((c) => c.index)).toEqual([0, 1, 2, 3, 4, 5]);
+    expect(interpreted.cases.slice(0, 2).map((c) => c.verdict)).toEqual(['AC', 'RE']);
+    expect(interpreted.cases[5].verdict).toBe('SK');
+    expect(interpreted.verdict).toBe('RE');
+  });
+
+  it('grades cases with a checker program', async () => {
+    const checker = { language: 'python', code: 'permutation checker' };
+    const result = await judge.judge(
+      {
+        language: 'python',
+        code: 'print(input())',
+        checker,
+        cases: [
+          { stdin: '3 1 2', expected_stdout: '1 2 3' },
+          { stdin: '1 2 2', expected_stdout: '1 2 3' },
+          { stdin: 'crash', expected_stdout: '1 2 3' }
+        ]
+      },
+      'dev'
+    );
+    expect(result.cases.map((c) => c.verdict)).toEqual(['AC', 'WA', 'RE']);
+    expect(result.cases[1].checker_message).toBe('not a permutation');
+    expect(result.cases[2].checker_run_id).toBeNull();
+    const checkerSpec = sandbox.specs.find((spec) => spec.code === checker.code);
+    expect(checkerSpec?.args).toEqual(['inputs/input.txt', 'inputs/output.txt', 'inputs/answer.txt']);
+    expect(runs).toHaveLength(5);
+
+    const broken = await judge.judge(
+      {
+        language: 'python',
+        code: 'print(input())',
+        checker: { ...checker, code: 'broken checker' },
+        cases: [{ stdin: '1', expected_stdout: '1' }]
+      },
+      'dev'
+    );
+    expect(broken.verdict).toBe('JF');
+    expect(broken.cases[0].checker_message).toBe('checker crashed');
+  });
+
+  it('re-grades deterministic submissions from the result cache', async () => {
+    const cachedJudge = new Judge({
+      orchestrator: scriptedOrchestrator(tmpDir, sandbox, { resultCache: new ResultCache({ maxEntries: 100, ttlMs: 60000 }) }),
+      logger: new Logger({ test: 'judge' })
+    });
+    const request = {
+      language: 'python',
+      code: 'print(input())',
+      deterministic: true,
+      checker: { language: 'python', code: 'permutation checker', deterministic: true },
+      cases: [
+        { stdin: '3 1 2', expected_stdout: '1 2 3' },
+        { stdin: '1 2 2', expected_stdout: '1 2 3' }
+      ]
+    };
+    const first = await cachedJudge.judge(request, 'dev');
+    expect(sandbox.specs).toHaveLength(4);
+    const again = await cachedJudge.judge(request, 'dev');
+    expect(sandbox.specs).toHaveLength(4);
+    expect(again.cases.map((c) => [c.verdict, c.checker_message])).toEqual(first.cases.map((c) => [c.verdict, c.checker_message]));
+    expect(again.cases[0].run_id).not.toBe(first.cases[0].run_id);
+  });
+
+  it('judges interactive problems by piping the submission and an interactor together', async () => {
+    const interactor = { language: 'python', code: 'guess interactor' };
+    const cases = [{ stdin: 'range 1 10', expected_stdout: '42' }];
+    const accepted = await judge.judge({ language: 'python', code: 'echo', interactor, cases }, 'dev');
+    expect(accepted.cases[0]).toMatchObject({ verdict: 'AC', fault: null, stdout: '42', interactor_message: null });
+    const interactorSpec = sandbox.specs.find((spec) => spec.code === interactor.code);
+    expect(interactorSpec?.args).toEqual(['inputs/input.txt', 'inputs/answer.txt']);
+    expect(runs.map((run) => run.id).sort()).toEqual([accepted.cases[0].run_id, accepted.cases[0].interactor_run_id].sort());
+
+    const wrong = await judge.judge({ language: 'python', code: 'reverse', interactor, cases }, 'dev');
+    expect(wrong.cases[0]).toMatchObject({ verdict: 'WA', fault: 'submission', interactor_message: 'expected 42, got 24' });
+
+    const hungUp = await judge.judge({ language: 'python', code: 'hang up', interactor, cases }, 'dev');
+    expect(hungUp.cases[0]).toMatchObject({ verdict: 'WA', fault: 'submission' });
+  });
+
+  it('blames a crashing interactor and cancels the submission it leaves behind', async () => {
+    const result = await judge.judge(
+      {
+        language: 'python',
+        code: 'stubborn',
+        limits: { kill_grace_ms: 20 },
+        interactor: { language: 'python', code: 'broken interactor', limits: { kill_grace_ms: 20 } },
+        cases: [{ stdin: '', expected_stdout: '42' }]
+      },
+      'dev'
+    );
+    expect(result.cases[0]).toMatchObject({ verdict: 'JF', fault: 'interactor', status: 'canceled', interactor_message: 'interactor crashed' });
+  });
+
+  it('validates cases', async () => {
+    await expect(judge.judge({ language: 'python', code: 'print(1)', cases: [] }, 'dev')).rejects.toThrow('cases is required');
+    await expect(
+      judge.judge({ language: 'python', code: 'print(1)', fail_fast: 'yes' as never, cases: [{ expected_stdout: '1' }] }, 'dev')
+    ).rejects.toThrow('fail_fast must be a boolean');
+    await expect(
+      judge.judge({ language: 'python', code: 'print(1)', cases: [{ expected_stdout: '1', comparison: 'fuzzy' as never }] }, 'dev')
+    ).rejects.toThrow('comparison must be exact, trimmed or float');
+    const program = { language: 'python', code: 'interact' };
+    await expect(
+      judge.judge({ language: 'python', code: 'echo', interactor: { code: 'x' } as never, cases: [{ expected_stdout: '1' }] }, 'dev')
+    ).rejects.toThrow('interactor.language is required');
+    await expect(
+      judge.judge({ language: 'python', code: 'echo', checker: program, interactor: program, cases: [{ expected_stdout: '1' }] }, 'dev')
+    ).rejects.toThrow('checker and interactor are mutually exclusive');
+  });
+
+  it('compares output exactly, trimmed or with a float tolerance', () => {
+    expect(outputMatches('1 2\n', '1 2', 'exact')).toBe(false);
+    expect(outputMatches('1 2  \r\n\n', '1 2', 'trimmed')).toBe(true);
+    expect(outputMatches(' 1 2\n', '1 2', 'trimmed')).toBe(false);
+    expect(outputMatches('0.33334 yes', '0.333333 yes', 'float', 1e-6)).toBe(false);
+    expect(outputMatches('0.33334 yes', '0.333333 yes', 'float', 1e-5)).toBe(true);
+    expect(outputMatches('1000000.5', '1000000', 'float', 1e-6)).toBe(true);
+    expect(outputMatches('1 2', '1 2 3', 'float')).toBe(false);
+  });
+});
@@ -1,4 +1,4 @@
-import { mergeLimits, DEFAULT_LIMITS } from '../../src/core/limits.js';
+import { mergeLimits, withKeyMaxima, DEFAULT_LIMITS, MAX_LIMITS, SESSION_DEFAULT_TIMEOUT_MS } from '../../src/core/limits.js';
 
 describe('mergeLimits', () => {
   it('merges defaults', () => {
@@ -8,4 +8,73 @@ describe('mergeLimits', () => {
   it('caps values', () => {
     expect(() => mergeLimits({ timeout_ms: 20001 })).toThrow('timeout_ms exceeds maximum');
   });
+
+  it('gives programs past the wall-clock limit a bounded grace period', () => {
+    expect(mergeLimits(undefined).kill_grace_ms).toBe(1000);
+    expect(mergeLimits({ kill_grace_ms: 0 }).kill_grace_ms).toBe(0);
+    expect(() => mergeLimits({ kill_grace_ms: 5001 })).toThrow('kill_grace_ms exceeds maximum');
+  });
+
+  it('caps each stream at max_output_bytes unless set separately', () => {
+    expect(mergeLimits({ max_output_bytes: 100 })).toMatchObject({ max_stdout_bytes: 100, max_stderr_bytes: 100 });
+    expect(mergeLimits({ max_output_bytes: 100, max_stderr_bytes: 10 })).toMatchObject({ max_stdout_bytes: 100, max_stderr_bytes: 10 });
+    expect(() => mergeLimits({ max_stdout_bytes: 2 * 1024 * 1024 + 1 })).toThrow('max_stdout_bytes exceeds maximum');
+  });
+
+  it('defaults max_processes to the runner\'s own limit', () => {
+    expect(mergeLimits(undefined, { maxProcesses: 256 }).max_processes).toBe(256);
+    expect(mergeLimits({ max_processes: 4 }, { maxProcesses: 256 }).max_processes).toBe(4);
+    expect(() => mergeLimits({ max_processes: 513 })).toThrow('max_processes exceeds maximum');
+  });
+
+  it('bounds open files and core dumps, with core dumps off unless asked for', () => {
+    expect(mergeLimits(undefined)).toMatchObject({ max_open_files: 256, core_dump_mb: 0 });
+    expect(mergeLimits(undefined, { maxOpenFiles: 1024 }).max_open_files).toBe(1024);
+    expect(mergeLimits({ max_open_files: 16, core_dump_mb: 2 }, { maxOpenFiles: 1024 })).toMatchObject({ max_open_files: 16, core_dump_mb: 2 });
+    expect(() => mergeLimits({ max_open_files: 4097 })).toThrow('max_open_files exceeds maximum');
+    expect(() => mergeLimits({ core_dump_mb: 11, max_artifact_file_bytes: MAX_LIMITS.max_artifact_file_bytes })).toThrow('core_dump_mb exceeds maximum of 10');
+  });
+
+  it('keeps core dumps within the size of one artifact', () => {
+    // A core over the default 2 MiB per file would be dropped as file_too_large.
+    expect(() => mergeLimits({ core_dump_mb: 3 })).toThrow('core_dump_mb exceeds maximum of 2, the max_artifact_file_bytes of the run');
+    expect(mergeLimits({ core_dump_mb: 8, max_artifact_file_bytes: 8 * 1024 * 1024 }).core_dump_mb).toBe(8);
+    expect(() => mergeLimits({ core_dump_mb: 1, max_artifact_file_bytes: 1024 * 1024 - 1 })).toThrow('core_dump_mb exceeds maximum of 0');
+  });
+
+  it('applies a configured policy instead of the built-in limits', () => {
+    const policy = { defaults: { ...DEFAULT_LIMITS, memory_mb: 128 }, max: { ...MAX_LIMITS, memory_mb: 192 } };
+    expect(mergeLimits(undefined, { policy }).memory_mb).toBe(128);
+    expect(() => mergeLimits({ memory_mb: 256 }, { policy })).toThrow('memory_mb exceeds maximum');
+  });
+
+  it('replaces the maxima with a key\'s own and lowers defaults to fit', () => {
+    const policy = withKeyMaxima(undefined, { timeout_ms: 2000, memory_mb: 2048 });
+    expect(mergeLimits(undefined, { policy })).toMatchObject({ timeout_ms: 2000, memory_mb: DEFAULT_LIMITS.memory_mb });
+    expect(mergeLimits({ memory_mb: 2048 }, { policy }).memory_mb).toBe(2048);
+    expect(() => mergeLimits({ timeout_ms: 2001 }, { policy })).toThrow('timeout_ms exceeds maximum');
+  });
+
+  it('applies a language\'s own defaults and maxima and rejects what exceeds them', () => {
+    const policy = {
+      defaults: DEFAULT_LIMITS,
+      max: MAX_LIMITS,
+      languages: { java: { defaults: { memory_mb: 1024, max_processes: 64 }, max: { memory_mb: 2048 } }, python: { max: { cpu_ms: 2000 } } }
+    };
+    expect(mergeLimits(undefined, { policy, language: 'java', maxProcesses: 256 })).toMatchObject({ memory_mb: 1024, max_processes: 64 });
+    expect(mergeLimits({ memory_mb: 2048 }, { policy, language: 'java' }).memory_mb).toBe(2048);
+    expect(mergeLimits(undefined, { policy, language: 'go' }).memory_mb).toBe(DEFAULT_LIMITS.memory_mb);
+    expect(() => mergeLimits({ cpu_ms: 3000 }, { policy, language: 'python' })).toThrow('cpu_ms exceeds maximum of 2000 for python');
+    expect(() => mergeLimits({ memory_mb: 2048 }, { policy, language: 'go' })).toThrow(`memory_mb exceeds maximum of ${MAX_LIMITS.memory_mb}`);
+    // A key's maxima still win over the language's.
+    const tier = withKeyMaxima(policy, { memory_mb: 512 });
+    expect(mergeLimits(undefined, { policy: tier, language: 'java' }).memory_mb).toBe(512);
+    expect(() => mergeLimits({ memory_mb: 1024 }, { policy: tier, language: 'java' })).toThrow('memory_mb exceeds maximum of 512 for java');
+  });
+
+  it('allows longer wall time for interactive sessions', () => {
+    expect(mergeLimits(undefined, { interactive: true }).timeout_ms).toBe(SESSION_DEFAULT_TIMEOUT_MS);
+    expect(mergeLimits({ timeout_ms: 120000 }, { interactive: true }).timeout_ms).toBe(120000);
+    expect(() => mergeLimits({ timeout_ms: 300001 }, { interactive: true })).toThrow('timeout_ms exceeds maximum');
+  });
 });
@@ -0,0 +1,54 @@
+import { Logger, requestLogContext, setLogLevel, setLogPhase, withLogContext } from '../../src/util/logger.js';
+
+describe('Logger', () => {
+  const write = process.stdout.write;
+  let lines: Array<Record<string, unknown>>;
+
+  beforeEach(() => {
+    lines = [];
+    process.stdout.write = ((chunk: string) => {
+      lines.push(JSON.parse(chunk) as Record<string, unknown>);
+      return true;
+    }) as typeof process.stdout.write;
+  });
+
+  afterEach(() => {
+    process.stdout.write = write;
+    setLogLevel('info');
+  });
+
+  it('tags every line with the context of the run it was logged for', async () => {
+    const logger = new Logger({ component: 'sandbox' });
+    await withLogContext({ requestId: 'req_1', tenant: 'acme' }, () =>
+      withLogContext({ runId: 'run_1', language: 'python', phase: 'queued' }, async () => {
+        await new Promise((resolve) => setTimeout(resolve, 1));
+        setLogPhase('running');
+        logger.info('launching sandbox', { specId: 'run_1' });
+        // Only the run's own context moves on.
+        setLogPhase('finished', 'run_2');
+        logger.info('still running');
+      })
+    );
+    logger.info('outside');
+    expect(lines[0]).toMatchObject({ message: 'launching sandbox', component: 'sandbox', requestId: 'req_1', tenant: 'acme', runId: 'run_1', language: 'python', phase: 'running' });
+    expect(lines[1].phase).toBe('running');
+    expect(lines[2].runId).toBeUndefined();
+  });
+
+  it('logs debug lines only at debug level or for requests that ask for them', () => {
+    const logger = new Logger();
+    logger.debug('hidden');
+    withLogContext({ debug: true }, () => logger.debug('traced'));
+    setLogLevel('warn');
+    logger.info('dropped');
+    logger.warn('kept');
+    expect(lines.map((line) => line.message)).toEqual(['traced', 'kept']);
+    expect(lines[0].debug).toBeUndefined();
+  });
+
+  it('keeps request IDs callers send and only honours debug when allowed', () => {
+    expect(requestLogContext('trace-42', 'DEBUG', true)).toEqual({ requestId: 'trace-42', debug: true });
+    expect(requestLogContext('trace-42', 'debug', false).debug).toBe(false);
+    expect(requestLogContext('bad id\n', undefined, true).requestId).toMatch(/^req_[0-9a-f]{16}$/);
+  });
+});
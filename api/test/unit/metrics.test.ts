@@ -0,0 +1,88 @@
+import { ExecutionMetrics } from '../../src/metrics/executions.js';
+import { MetricsRegistry } from '../../src/metrics/registry.js';
+import type { RunRecord } from '../../src/core/types.js';
+
+function record(overrides: Partial<RunRecord>): RunRecord {
+  return {
+    language: 'go',
+    status: 'succeeded',
+    isolation: 'container',
+    queue_wait_ms: 20,
+    phases: {
+      compile: { exit_code: 0, stdout: '', stderr: '', duration_ms: 1500 },
+      run: { exit_code: 0, stdout: '', stderr: '', duration_ms: 300 }
+    },
+    ...overrides
+  } as RunRecord;
+}
+
+describe('MetricsRegistry', () => {
+  it('renders counters and histograms in the text exposition format', () => {
+    const registry = new MetricsRegistry();
+    const counter = registry.counter('jobs_total', 'Jobs.');
+    const histogram = registry.histogram('job_seconds', 'Job time.', [0.1, 1]);
+    counter.inc({ kind: 'a"b' });
+    counter.inc({ kind: 'a"b' }, 2);
+    histogram.observe({}, 0.5);
+    histogram.observe({}, 2);
+    expect(registry.render()).toBe(
+      [
+        '# HELP jobs_total Jobs.',
+        '# TYPE jobs_total counter',
+        'jobs_total{kind="a\\"b"} 3',
+        '# HELP job_seconds Job time.',
+        '# TYPE job_seconds histogram',
+        'job_seconds_bucket{le="0.1"} 0',
+        'job_seconds_bucket{le="1"} 1',
+        'job_seconds_bucket{le="+Inf"} 2',
+        'job_seconds_sum 2.5',
+        'job_seconds_count 2',
+        ''
+      ].join('\n')
+    );
+    expect(() => registry.counter('jobs_total', 'again')).toThrow('already registered');
+    expect(() => registry.counter('bad-name', 'x')).toThrow('invalid metric name');
+  });
+});
+
+describe('ExecutionMetrics', () => {
+  it('records executions, phase durations and sandbox start-up', () => {
+    const metrics = new ExecutionMetrics(new MetricsRegistry());
+    metrics.recordRun(record({}), 2000);
+    metrics.recordRun(record({ language: 'python', status: 'timeout', phases: { compile: null, run: null } }), null);
+    const text = metrics.registry.render();
+    expect(text).toContain('code_executor_executions_total{language="go",status="succeeded"} 1');
+    expect(text).toContain('code_executor_executions_total{language="python",status="timeout"} 1');
+    expect(text).toContain('code_executor_compile_duration_seconds_sum{language="go"} 1.5');
+    expect(text).toContain('code_executor_run_duration_seconds_sum{language="go"} 0.3');
+    expect(text).toContain('code_executor_queue_wait_seconds_count{language="python"} 1');
+    expect(text).toContain('code_executor_sandbox_startup_seconds_sum{language="go",isolation="container"} 0.2');
+    expect(text).not.toContain('code_executor_sandbox_startup_seconds_count{language="python"');
+  });
+
+  it('reads queue and build cache figures when scraped', () => {
+    const queue = { stats: () => ({ depth: 3, running: 2, concurrency: 4, max_depth: 10, avg_wait_ms: 0 }), enqueue: () => ({ done: Promise.resolve() }) };
+    const buildCache = { stats: () => ({ hits: 7, misses: 3 }) };
+    const metrics = new ExecutionMetrics(new MetricsRegistry(), { queue: queue as never, buildCache: buildCache as never });
+    const text = metrics.registry.render();
+    expect(text).toContain('code_executor_queue_depth 3');
+    expect(text).toContain('code_executor_queue_running 2');
+    expect(text).toContain('code_executor_build_cache_lookups_total{result="hit"} 7');
+    expect(text).toContain('code_executor_build_cache_lookups_total{result="miss"} 3');
+  });
+
+  it('reports what the janitor removed and reclaimed', () => {
+    const janitor = {
+      stats: () => ({
+        sweeps: 2,
+        removed: { workdirs: 4, containers: 1, cache_entries: 3 },
+        reclaimed_bytes: { workdirs: 2048, cache: 512 },
+        last_sweep_at: null
+      })
+    };
+    const text = new ExecutionMetrics(new MetricsRegistry(), { janitor: janitor as never }).registry.render();
+    expect(text).toContain('code_executor_janitor_removed_total{kind="workdir"} 4');
+    expect(text).toContain('code_executor_janitor_removed_total{kind="container"} 1');
+    expect(text).toContain('code_executor_janitor_reclaimed_bytes_total{kind="cache"} 512');
+  });
+});
@@ -0,0 +1,91 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { resolveMounts, validateMounts } from '../../src/core/mounts.js';
+import { ArtifactStorage } from '../../src/core/storage.js';
+import { DatasetStore } from '../../src/core/datasets.js';
+import { packTarGz } from '../../src/util/tar.js';
+
+describe('mounts', () => {
+  let tmpDir: string;
+  let storage: ArtifactStorage;
+  let root: string;
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'mounts-'));
+    storage = new ArtifactStorage({
+      baseDir: path.join(tmpDir, 'storage'),
+      baseUrl: 'http://localhost:8080',
+      signingKey: 'test-key',
+      urlTtlSeconds: 600
+    });
+    root = path.join(tmpDir, 'datasets');
+    fs.mkdirSync(path.join(root, 'mnist'), { recursive: true });
+    fs.writeFileSync(path.join(tmpDir, 'secret.txt'), 'secret');
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('validates mount paths and sources', () => {
+    expect(validateMounts(undefined)).toEqual([]);
+    expect(() => validateMounts([{ path: '/work/data', host_path: root }])).toThrow('under /data');
+    expect(() => validateMounts([{ path: '/data/../etc', host_path: root }])).toThrow('under /data');
+    expect(() => validateMounts([{ path: '/data', host_path: root }])).toThrow('under /data');
+    expect(() => validateMounts([{ path: '/data/a' }])).toThrow('exactly one of dataset_id or host_path');
+    expect(() => validateMounts([{ path: '/data/a', host_path: 'relative' }])).toThrow('must be an absolute path');
+    expect(() => validateMounts([{ path: '/data/a', dataset_id: '../x' }])).toThrow('dataset_id is invalid');
+    expect(() => validateMounts([{ path: '/data/a', host_path: root, read_only: false }])).toThrow('always read-only');
+    expect(() =>
+      validateMounts([
+        { path: '/data/a', host_path: root },
+        { path: '/data/a/b', host_path: root }
+      ])
+    ).toThrow('overlaps /data/a');
+  });
+
+  it('resolves host paths inside the mount roots and uploaded datasets', () => {
+    const tempPath = path.join(tmpDir, 'upload.csv');
+    fs.writeFileSync(tempPath, 'a,b\n1,2\n');
+    const uploaded = storage.storeUploadedFile(tempPath, 'train.csv', 'text/csv');
+    const resolved = resolveMounts(
+      [
+        { path: '/data/mnist', host_path: path.join(root, 'mnist') },
+        { path: '/data/train.csv', dataset_id: uploaded.id }
+      ],
+      [root],
+      storage
+    );
+    expect(resolved).toEqual([
+      { sourcePath: fs.realpathSync(path.join(root, 'mnist')), destPath: '/data/mnist' },
+      { sourcePath: uploaded.path, destPath: '/data/train.csv' }
+    ]);
+  });
+
+  it('resolves datasets to their extracted trees', async () => {
+    const datasets = new DatasetStore({ baseDir: path.join(tmpDir, 'storage', 'datasets') });
+    const archive = path.join(tmpDir, 'fixtures.tar.gz');
+    fs.writeFileSync(archive, packTarGz([{ name: 'cases/1.in', data: Buffer.from('1 2\n') }]));
+    const { dataset } = await datasets.create(archive, 'fixtures');
+    const [resolved] = resolveMounts([{ path: '/data/fixtures', dataset_id: dataset.id }], [], storage, datasets);
+    expect(resolved).toEqual({ sourcePath: datasets.pathOf(dataset.id), destPath: '/data/fixtures' });
+    expect(fs.readFileSync(path.join(resolved.sourcePath, 'cases', '1.in'), 'utf8')).toBe('1 2\n');
+    expect(() => resolveMounts([{ path: '/data/fixtures', dataset_id: 'ds_0123abcd' }], [], storage, datasets)).toThrow('dataset not found');
+    expect(() => resolveMounts([{ path: '/data/fixtures', dataset_id: dataset.id }], [], storage)).toThrow('dataset not found');
+  });
+
+  it('refuses host paths outside the mount roots, including through symlinks', () => {
+    fs.symlinkSync(path.join(tmpDir, 'secret.txt'), path.join(root, 'link.txt'));
+    expect(() => resolveMounts([{ path: '/data/s', host_path: path.join(tmpDir, 'secret.txt') }], [root], storage)).toThrow(
+      'outside the server'
+    );
+    expect(() => resolveMounts([{ path: '/data/s', host_path: path.join(root, 'link.txt') }], [root], storage)).toThrow(
+      'outside the server'
+    );
+    expect(() => resolveMounts([{ path: '/data/s', host_path: path.join(root, 'mnist') }], [], storage)).toThrow('outside the server');
+    expect(() => resolveMounts([{ path: '/data/s', host_path: path.join(root, 'missing') }], [root], storage)).toThrow(
+      'mount source not found'
+    );
+  });
+});
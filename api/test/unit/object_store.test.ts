@@ -0,0 +1,150 @@
+import crypto from 'node:crypto';
+import fs from 'node:fs';
+import http from 'node:http';
+import os from 'node:os';
+import path from 'node:path';
+import type { AddressInfo } from 'node:net';
+import { GcsObjectStore, S3ObjectStore } from '../../src/core/object_store.js';
+import { ArtifactStorage } from '../../src/core/storage.js';
+
+describe('object stores', () => {
+  let server: http.Server;
+  let endpoint: string;
+  let statuses: number[];
+  let received: Array<{ method?: string; url: URL; headers: http.IncomingHttpHeaders; body: string }>;
+
+  beforeEach(async () => {
+    received = [];
+    statuses = [];
+    server = http.createServer((req, res) => {
+      let body = '';
+      req.on('data', (chunk) => (body += chunk));
+      req.on('end', () => {
+        received.push({ method: req.method, url: new URL(req.url ?? '/', endpoint), headers: req.headers, body });
+        res.statusCode = statuses.shift() ?? 200;
+        res.end(res.statusCode === 200 ? '' : '<Error><Code>AccessDenied</Code></Error>');
+      });
+    });
+    await new Promise<void>((resolve) => server.listen(0, '127.0.0.1', resolve));
+    endpoint = `http://127.0.0.1:${(server.address() as AddressInfo).port}`;
+  });
+
+  afterEach(async () => {
+    await new Promise((resolve) => server.close(resolve));
+  });
+
+  const s3 = (overrides: Partial<ConstructorParameters<typeof S3ObjectStore>[0]> = {}) =>
+    new S3ObjectStore({ bucket: 'runs', region: 'eu-west-1', accessKeyId: 'AKIDEXAMPLE', secretAccessKey: 'secret', ...overrides });
+
+  it('presigns S3 downloads for the bucket host', async () => {
+    const url = new URL(await s3({ sessionToken: 'tok/en' }).signedUrl('file_1/plot 1.png', new Date(Date.now() + 600_000)));
+    expect(url.host).toBe('runs.s3.eu-west-1.amazonaws.com');
+    expect(url.pathname).toBe('/file_1/plot%201.png');
+    expect(url.searchParams.get('X-Amz-Algorithm')).toBe('AWS4-HMAC-SHA256');
+    expect(url.searchParams.get('X-Amz-Credential')).toMatch(/^AKIDEXAMPLE\/\d{8}\/eu-west-1\/s3\/aws4_request$/);
+    expect(Number(url.searchParams.get('X-Amz-Expires'))).toBeGreaterThanOrEqual(599);
+    expect(url.searchParams.get('X-Amz-SignedHeaders')).toBe('host');
+    expect(url.searchParams.get('X-Amz-Security-Token')).toBe('tok/en');
+    expect(url.searchParams.get('X-Amz-Signature')).toMatch(/^[0-9a-f]{64}$/);
+  });
+
+  it('uploads to S3-compatible endpoints path-style', async () => {
+    await s3({ endpoint, prefix: 'artifacts/' }).put('file_1/out.txt', Buffer.from('hello'), 'text/plain');
+    expect(received).toHaveLength(1);
+    expect(received[0].method).toBe('PUT');
+    expect(received[0].url.pathname).toBe('/runs/artifacts/file_1/out.txt');
+    expect(received[0].url.searchParams.get('X-Amz-Signature')).toMatch(/^[0-9a-f]{64}$/);
+    expect(received[0].headers['content-type']).toBe('text/plain');
+    expect(received[0].body).toBe('hello');
+  });
+
+  it('reports refused uploads', async () => {
+    statuses = [403];
+    await expect(s3({ endpoint }).put('file_1/out.txt', Buffer.from('x'), 'text/plain')).rejects.toThrow(
+      'object upload failed with 403: <Error><Code>AccessDenied</Code></Error>'
+    );
+  });
+
+  it('reads and deletes objects, with a missing one read as null', async () => {
+    const store = s3({ endpoint, prefix: 'archive/' });
+    statuses = [200, 404, 204, 403];
+    expect(await store.get('run_1/execution.json')).toEqual(Buffer.alloc(0));
+    expect(await store.get('run_2/execution.json')).toBeNull();
+    await store.delete('run_1/execution.json');
+    await expect(store.delete('run_1/execution.json')).rejects.toThrow('object delete failed with 403');
+    expect(received.map(({ method, url }) => [method, url.pathname])).toEqual([
+      ['GET', '/runs/archive/run_1/execution.json'],
+      ['GET', '/runs/archive/run_2/execution.json'],
+      ['DELETE', '/runs/archive/run_1/execution.json'],
+      ['DELETE', '/runs/archive/run_1/execution.json']
+    ]);
+  });
+
+  it('signs GCS URLs with the service account key', async () => {
+    const { privateKey, publicKey } = crypto.generateKeyPairSync('rsa', { modulusLength: 2048 });
+    const store = new GcsObjectStore({
+      bucket: 'runs',
+      clientEmail: 'executor@project.iam.gserviceaccount.com',
+      privateKey: privateKey.export({ type: 'pkcs8', format: 'pem' }).toString(),
+      endpoint
+    });
+    await store.put('file_1/out.txt', Buffer.from('hello'), 'text/plain');
+    const url = received[0].url;
+    expect(url.pathname).toBe('/runs/file_1/out.txt');
+    expect(url.searchParams.get('X-Goog-Credential')).toMatch(/^executor@project\.iam\.gserviceaccount\.com\/\d{8}\/auto\/storage\/goog4_request$/);
+    // Rebuilt as GCS does when it checks the signature.
+    const query = url.search.slice(1).split('&').filter((pair) => !pair.startsWith('X-Goog-Signature=')).join('&');
+    const canonical = ['PUT', url.pathname, query, `host:${url.host}`, '', 'host', 'UNSIGNED-PAYLOAD'].join('\n');
+    const credential = url.searchParams.get('X-Goog-Credential') as string;
+    const stringToSign = [
+      'GOOG4-RSA-SHA256',
+      url.searchParams.get('X-Goog-Date'),
+      credential.slice(credential.indexOf('/') + 1),
+      crypto.createHash('sha256').update(canonical).digest('hex')
+    ].join('\n');
+    const signature = Buffer.from(url.searchParams.get('X-Goog-Signature') as string, 'hex');
+    expect(crypto.verify('RSA-SHA256', Buffer.from(stringToSign), publicKey, signature)).toBe(true);
+  });
+});
+
+describe('ArtifactStorage', () => {
+  let tmpDir: string;
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'storage-'));
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  const storage = (maxInlineBytes?: number) =>
+    new ArtifactStorage({ baseDir: tmpDir, baseUrl: 'http://localhost:8080', signingKey: 'test-key', urlTtlSeconds: 600, maxInlineBytes });
+
+  const output = (name: string, contents: string) => {
+    const file = path.join(tmpDir, name);
+    fs.writeFileSync(file, contents);
+    return file;
+  };
+
+  it('keeps artifacts in the storage directory behind signed /v1/files URLs by default', async () => {
+    const artifacts = storage();
+    const artifact = await artifacts.storeArtifact(output('report.txt', 'done'), 'reports/report.txt', { contentType: 'text/plain' });
+    expect(artifact).toMatchObject({ name: 'reports/report.txt', size: 4, content_type: 'text/plain' });
+    expect(fs.existsSync(path.join(tmpDir, 'report.txt'))).toBe(false);
+    const url = new URL(artifact.url);
+    artifacts.verifySignedRequest(url.pathname, url.searchParams.get('payload') as string, url.searchParams.get('sig') as string);
+    const resolved = artifacts.resolveArtifact(url.pathname.split('/').pop() as string);
+    expect(fs.readFileSync(resolved.path, 'utf8')).toBe('done');
+    expect(resolved.metadata.contentType).toBe('text/plain');
+  });
+
+  it('inlines only artifacts up to maxInlineBytes', async () => {
+    const artifacts = storage(4);
+    const small = await artifacts.storeArtifact(output('a.txt', 'tiny'), 'a.txt', { inline: true });
+    const large = await artifacts.storeArtifact(output('b.txt', 'larger'), 'b.txt', { inline: true });
+    expect(small.content).toBe(Buffer.from('tiny').toString('base64'));
+    expect(large.content).toBeUndefined();
+    expect(large.url).toContain('/v1/files/');
+  });
+});
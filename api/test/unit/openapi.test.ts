@@ -0,0 +1,110 @@
+import path from 'node:path';
+import { ApiSchema, listRoutes, loadApiSpec } from '../../src/core/openapi.js';
+
+const spec = loadApiSpec(path.join(process.cwd(), 'openapi', 'spec.yaml'));
+
+function published(unknownFields: 'reject' | 'ignore' = 'reject') {
+  const schema = new ApiSchema(spec, { serverUrl: 'https://exec.example.com', languages: ['python', 'go'], unknownFields });
+  schema.publish([
+    { method: 'post', path: '/v1/runs' },
+    { method: 'post', path: '/v1/judge' },
+    { method: 'post', path: '/v1/batches' },
+    { method: 'put', path: '/admin/images/:language' },
+    { method: 'post', path: '/admin/images/gc' }
+  ]);
+  return schema;
+}
+
+describe('listRoutes', () => {
+  it('lists the routes of the app in registration order', () => {
+    const app = {
+      _router: {
+        stack: [
+          { name: 'jsonParser' },
+          { route: { path: '/v1/runs', methods: { post: true } } },
+          { route: { path: '/v1/runs/:id', methods: { get: true, _all: true } } }
+        ]
+      }
+    };
+    expect(listRoutes(app)).toEqual([
+      { method: 'post', path: '/v1/runs' },
+      { method: 'get', path: '/v1/runs/:id' }
+    ]);
+  });
+});
+
+describe('ApiSchema', () => {
+  it('documents the registered routes with the server and languages filled in', () => {
+    const schema = new ApiSchema(spec, { serverUrl: 'https://exec.example.com', languages: ['python', 'go'] });
+    const undocumented = schema.publish([
+      { method: 'post', path: '/v1/runs' },
+      { method: 'get', path: '/v1/executions/:id' },
+      { method: 'get', path: '/v1/unlisted' }
+    ]);
+    const document = schema.document();
+    expect(undocumented).toEqual([{ method: 'get', path: '/v1/unlisted' }]);
+    expect(Object.keys(document.paths)).toEqual(['/v1/runs', '/v1/executions/{id}']);
+    expect(Object.keys(document.paths['/v1/executions/{id}'])).toEqual(['get']);
+    expect(document.servers).toEqual([{ url: 'https://exec.example.com' }]);
+    expect(document.components?.schemas?.['CreateRun'].properties?.['language'].enum).toEqual(['python', 'go']);
+    // The spec itself is left alone for the next publish.
+    expect(spec.paths['/v1/workers']).toBeDefined();
+  });
+
+  it('accepts requests that follow the spec', () => {
+    const schema = published();
+    expect(schema.check('POST', '/v1/runs', {
+      language: 'python',
+      code: 'print(1)',
+      idempotency_key: 'k1',
+      sources: { 'util/helpers.py': 'x = 1' },
+      limits: { timeout_ms: 2000 },
+      network: { mode: 'allowlist', allow: ['pypi.org'] }
+    })).toEqual([]);
+    expect(schema.check('POST', '/v1/judge', { code: 'print(input())', cases: [{ stdin: '1', expected_stdout: '1' }], checker: { language: 'python', code: 'x' } })).toEqual([]);
+  });
+
+  it('lists every field that does not fit', () => {
+    const errors = published().check('POST', '/v1/runs', {
+      language: 'cobol',
+      code: 42,
+      limits: { timeout_ms: 1.5, memroy_mb: 256 },
+      mounts: [{ path: '/data/x', read_only: false }, { dataset_id: 'ds_1' }],
+      sources: { 'a.py': 1 },
+      colour: 'blue'
+    });
+    expect(errors).toEqual([
+      { path: 'language', reason: 'enum', message: 'language must be one of python, go' },
+      { path: 'code', reason: 'type', message: 'code must be a string' },
+      { path: 'limits.timeout_ms', reason: 'type', message: 'limits.timeout_ms must be an integer' },
+      { path: 'limits.memroy_mb', reason: 'unknown_field', message: 'limits.memroy_mb is not a known field' },
+      { path: 'mounts[0].read_only', reason: 'enum', message: 'mounts[0].read_only must be one of true' },
+      { path: 'mounts[1].path', reason: 'required', message: 'mounts[1].path is required' },
+      { path: 'sources["a.py"]', reason: 'type', message: 'sources["a.py"] must be a string' },
+      { path: 'colour', reason: 'unknown_field', message: 'colour is not a known field' }
+    ]);
+  });
+
+  it('knows the fields of every allOf branch', () => {
+    const schema = published();
+    expect(schema.check('POST', '/v1/batches', { submissions: [{ tag: 'a', language: 'go', code: 'x' }], concurrency: 2 })).toEqual([]);
+    expect(schema.check('POST', '/v1/batches', { submissions: [{ language: 'go', cases: [] }] })).toEqual([
+      { path: 'submissions[0].tag', reason: 'required', message: 'submissions[0].tag is required' },
+      { path: 'submissions[0].cases', reason: 'unknown_field', message: 'submissions[0].cases is not a known field' }
+    ]);
+  });
+
+  it('leaves unknown fields alone when told to', () => {
+    expect(published('ignore').check('POST', '/v1/runs', { language: 'python', colour: 'blue', limits: { memroy_mb: 1 } })).toEqual([]);
+    expect(published('ignore').check('POST', '/v1/runs', { language: 'ruby' })).toHaveLength(1);
+  });
+
+  it('matches literal path segments before parameters', () => {
+    const schema = published();
+    expect(schema.check('PUT', '/admin/images/python', { image: 'python:3.12' })).toEqual([]);
+    expect(schema.check('PUT', '/admin/images/python', { image: 3 })[0].message).toBe('image must be a string');
+    expect(schema.check('POST', '/admin/images/gc', { image: 3 })).toEqual([]);
+    expect(schema.check('POST', '/v1/runs', [])[0].message).toBe('request body must be an object');
+    expect(schema.check('GET', '/v1/runs', { anything: true })).toEqual([]);
+  });
+});
@@ -1,10 +1,23 @@
+import crypto from 'node:crypto';
 import fs from 'node:fs';
 import os from 'node:os';
 import path from 'node:path';
+import { PassThrough } from 'node:stream';
+import Boom from '@hapi/boom';
 import { Orchestrator } from '../../src/core/orchestrator.js';
+import type { OrchestratorOptions } from '../../src/core/orchestrator.js';
 import { ArtifactStorage } from '../../src/core/storage.js';
+import { RunStore } from '../../src/core/run_store.js';
+import { InMemoryQueue } from '../../src/core/queue.js';
+import { canceledResult } from '../../src/core/run_dir.js';
+import { fingerprint } from '../../src/core/fingerprint.js';
+import { ResultCache } from '../../src/core/result_cache.js';
+import { HookRunner } from '../../src/core/hooks.js';
+import { PolicyScanner } from '../../src/core/policy_scanner.js';
+import { ResultSigner, verifyResult } from '../../src/core/result_signing.js';
+import { withoutInlineContent } from '../../src/store/store.js';
 import { Logger } from '../../src/util/logger.js';
-import type { SandboxRunner, SandboxRunSpec, SandboxResult } from '../../src/core/types.js';
+import type { CoverageReport, RunRequest, SandboxRunner, SandboxRunSpec, SandboxResult } from '../../src/core/types.js';
 
 class MockSandbox implements SandboxRunner {
   constructor(private readonly resultFactory: (spec: SandboxRunSpec) => SandboxResult) {}
@@ -15,17 +28,30 @@ class MockSandbox implements SandboxRunner {
 
 describe('Orchestrator', () => {
   let tmpDir: string;
+  let storage: ArtifactStorage;
+  let sandbox: SandboxRunner;
   let orchestrator: Orchestrator;
+  let lastSpec: SandboxRunSpec | undefined;
+
+  // An orchestrator over the test's work root, storage and sandbox, with `overrides` in their place.
+  const orchestratorWith = (overrides: Partial<OrchestratorOptions>) => new Orchestrator({
+    workRoot: path.join(tmpDir, 'sandbox'),
+    artifactStorage: storage,
+    sandboxRunner: sandbox,
+    logger: new Logger({ test: 'orchestrator' }),
+    ...overrides
+  });
 
   beforeEach(() => {
     tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'orch-'));
-    const storage = new ArtifactStorage({
+    storage = new ArtifactStorage({
       baseDir: path.join(tmpDir, 'storage'),
       baseUrl: 'http://localhost:8080',
       signingKey: 'test-key',
       urlTtlSeconds: 600
     });
-    const sandbox = new MockSandbox((spec) => {
+    sandbox = new MockSandbox((spec) => {
+      lastSpec = spec;
       const outPath = path.join(spec.workdir, 'outputs', 'result.txt');
       fs.writeFileSync(outPath, 'artifact');
       return {
@@ -39,12 +65,7 @@ describe('Orchestrator', () => {
         ]
       };
     });
-    orchestrator = new Orchestrator({
-      workRoot: path.join(tmpDir, 'sandbox'),
-      artifactStorage: storage,
-      sandboxRunner: sandbox,
-      logger: new Logger({ test: 'orchestrator' })
-    });
+    orchestrator = orchestratorWith({});
   });
 
   it('creates runs and stores artifacts', async () => {
@@ -52,5 +73,875 @@ describe('Orchestrator', () => {
     expect(run.status).toBe('succeeded');
     expect(run.artifacts).toHaveLength(1);
     expect(run.artifacts[0].name).toBe('result.txt');
+    expect(run.phases.compile).toBeNull();
+    expect(run.phases.run).toEqual({ exit_code: 0, stdout: 'hello', stderr: '', duration_ms: 10 });
+    expect(run.timeout).toBeNull();
+    expect(run.schema_version).toBe(1);
+  });
+
+  it('passes multi-file sources to the sandbox', async () => {
+    await orchestrator.createRun(
+      {
+        language: 'go',
+        sources: {
+          'main.go': 'package main\nimport "submission/util"\nfunc main() { util.Hello() }',
+          'util/util.go': 'package util\nfunc Hello() {}'
+        }
+      },
+      'dev'
+    );
+    expect(Object.keys(lastSpec?.sources ?? {})).toEqual(['main.go', 'util/util.go']);
+  });
+
+  it('rejects source paths that escape the workdir', async () => {
+    await expect(
+      orchestrator.createRun({ language: 'python', sources: { '../evil.py': 'print(1)' } }, 'dev')
+    ).rejects.toThrow('invalid source path');
+    await expect(
+      orchestrator.createRun({ language: 'python', sources: { 'outputs/x.py': 'print(1)' } }, 'dev')
+    ).rejects.toThrow('reserved name');
+    await expect(
+      orchestrator.createRun({ language: 'go', sources: { '.build/main': 'binary' } }, 'dev')
+    ).rejects.toThrow('reserved name');
+  });
+
+  it('refuses requests written against a newer schema version', async () => {
+    await expect(
+      orchestrator.createRun({ language: 'python', code: 'print(1)', schema_version: 2 }, 'dev')
+    ).rejects.toThrow('schema_version 2 is not supported');
+    await orchestrator.createRun({ language: 'python', code: 'print(1)', schema_version: 1, future_field: true } as RunRequest, 'dev');
+  });
+
+  it('passes env through the env policy', async () => {
+    await orchestrator.createRun({ language: 'python', code: 'print(1)', env: { APP_MODE: 'test' } }, 'dev');
+    expect(lastSpec?.env).toEqual({ APP_MODE: 'test', HOME: '/work', TMPDIR: '/work/tmp' });
+    await expect(
+      orchestrator.createRun({ language: 'python', code: 'print(1)', env: { LD_PRELOAD: '/tmp/x.so' } }, 'dev')
+    ).rejects.toThrow('env variable not allowed: LD_PRELOAD');
+  });
+
+  it('hands a fixed clock and random seed to the runner', async () => {
+    await orchestrator.createRun(
+      { language: 'python', code: 'print(1)', env: { APP_MODE: 'test' }, reproducible: { time: '2024-02-29T12:00:00+01:00', seed: 7 } },
+      'dev'
+    );
+    expect(lastSpec?.env).toMatchObject({ APP_MODE: 'test', EXECUTOR_FAKE_TIME: '@2024-02-29 11:00:00', EXECUTOR_RANDOM_SEED: '7' });
+    await expect(
+      orchestrator.createRun({ language: 'python', code: 'print(1)', env: { EXECUTOR_RANDOM_SEED: '7' } }, 'dev')
+    ).rejects.toThrow('env variable not allowed: EXECUTOR_RANDOM_SEED');
+    await expect(
+      orchestrator.createRun({ language: 'go', code: 'package main', reproducible: { time: '2024-01-01T00:00:00Z' } }, 'dev')
+    ).rejects.toThrow('a fixed clock is not supported for go');
+  });
+
+  it('validates the network policy', async () => {
+    const run = await orchestrator.createRun({ language: 'python', code: 'print(1)' }, 'dev');
+    expect(run.network).toEqual({ mode: 'none' });
+    await orchestrator.createRun({ language: 'python', code: 'print(1)', network: { mode: 'allowlist', allow: ['pypi.org'] } }, 'dev');
+    expect(lastSpec?.network).toEqual({ mode: 'allowlist', allow: ['pypi.org'] });
+    await expect(
+      orchestrator.createRun({ language: 'python', code: 'print(1)', network: { mode: 'open' as never } }, 'dev')
+    ).rejects.toThrow('network.mode must be none, loopback or allowlist');
+    await expect(
+      orchestrator.createRun({ language: 'python', code: 'print(1)', network: { mode: 'none', allow: ['pypi.org'] } }, 'dev')
+    ).rejects.toThrow('network.allow requires network.mode allowlist');
+  });
+
+  it('resolves mounts before the run starts', async () => {
+    await orchestrator.createRun({ language: 'python', code: 'print(1)' }, 'dev');
+    expect(lastSpec?.mounts).toEqual([]);
+    await expect(
+      orchestrator.createRun({ language: 'python', code: 'print(1)', mounts: [{ path: '/data/x', host_path: tmpDir }] }, 'dev')
+    ).rejects.toThrow('outside the server');
+    await expect(
+      orchestrator.createRun({ language: 'python', code: 'print(1)', mounts: [{ path: '/tmp/x', host_path: tmpDir }] }, 'dev')
+    ).rejects.toThrow('under /data');
+  });
+
+  it('forwards stdin to the sandbox', async () => {
+    await orchestrator.createRun({ language: 'python', code: 'print(input())', stdin: '42\n' }, 'dev');
+    expect(lastSpec?.stdin).toBe('42\n');
+  });
+
+  it('validates C/C++ build options', async () => {
+    await orchestrator.createRun(
+      { language: 'cpp', code: 'int main() {}', build: { std: 'c++20', optimization: 'O0', sanitizers: ['address'] } },
+      'dev'
+    );
+    expect(lastSpec?.build).toEqual({ std: 'c++20', optimization: 'O0', sanitizers: ['address'] });
+    await expect(
+      orchestrator.createRun({ language: 'cpp', code: 'int main() {}', build: { std: 'c++20; rm -rf /' } }, 'dev')
+    ).rejects.toThrow('invalid build.std');
+  });
+
+  it('detects the language when the request leaves it out', async () => {
+    const run = await orchestrator.createRun({ filename: 'hello.rb', code: 'puts 1' } as RunRequest, 'dev');
+    expect(lastSpec?.language).toBe('ruby');
+    expect(run.language).toBe('ruby');
+    expect(run.detected_language).toEqual({ language: 'ruby', confidence: 1, source: 'filename' });
+    const named = await orchestrator.createRun({ language: 'python', code: 'print(1)' }, 'dev');
+    expect(named.detected_language).toBeNull();
+    await expect(orchestrator.createRun({ code: 'echo hi', filename: 'a.sh' } as RunRequest, 'dev')).rejects.toThrow('language is ambiguous');
+  });
+
+  it('selects the isolation level per request', async () => {
+    const run = await orchestrator.createRun({ language: 'python', code: 'print(1)', isolation: 'gvisor' }, 'dev');
+    expect(lastSpec?.isolation).toBe('gvisor');
+    expect(run.isolation).toBe('gvisor');
+    await orchestrator.createRun({ language: 'python', code: 'print(1)' }, 'dev');
+    expect(lastSpec?.isolation).toBe('container');
+    await expect(
+      orchestrator.createRun({ language: 'python', code: 'print(1)', isolation: 'vm' as never }, 'dev')
+    ).rejects.toThrow('isolation must be container, gvisor, microvm or wasm');
+  });
+
+  it('runs wasm-only languages at isolation wasm and C at either', async () => {
+    await orchestrator.createRun({ language: 'wasm', code: 'AGFzbQEAAAA=' }, 'dev');
+    expect(lastSpec?.isolation).toBe('wasm');
+    await orchestrator.createRun({ language: 'c', code: 'int main() {}', isolation: 'wasm' }, 'dev');
+    expect(lastSpec?.isolation).toBe('wasm');
+    await expect(
+      orchestrator.createRun({ language: 'python', code: 'print(1)', isolation: 'wasm' }, 'dev')
+    ).rejects.toThrow('isolation wasm not supported for python');
+    await expect(
+      orchestrator.createRun({ language: 'wasm', code: 'AGFzbQEAAAA=', isolation: 'container' }, 'dev')
+    ).rejects.toThrow('isolation container not supported for wasm');
+  });
+
+  it('runs tests on runners that support test mode', async () => {
+    const run = await orchestrator.createRun({ language: 'go', mode: 'test', sources: { 'main_test.go': 'package main' } }, 'dev');
+    expect(lastSpec?.mode).toBe('test');
+    expect(run.mode).toBe('test');
+    expect(run.tests).toEqual([]);
+    expect((await orchestrator.createRun({ language: 'python', code: 'print(1)' }, 'dev')).tests).toBeNull();
+    await expect(orchestrator.createRun({ language: 'ruby', code: 'puts 1', mode: 'test' }, 'dev')).rejects.toThrow(
+      'test mode not supported for ruby'
+    );
+    await expect(
+      orchestrator.createRun({ language: 'python', code: 'print(1)', mode: 'bench' as never }, 'dev')
+    ).rejects.toThrow('mode must be run, test, compile or check');
+  });
+
+  it('only builds or checks submissions in compile and check modes', async () => {
+    const compiled = await orchestrator.createRun({ language: 'go', code: 'package main', mode: 'compile' }, 'dev');
+    expect(lastSpec?.mode).toBe('compile');
+    expect(compiled.mode).toBe('compile');
+    expect(compiled.phases.run).toBeNull();
+    const checked = await orchestrator.createRun({ language: 'python', code: 'print(1)', mode: 'check' }, 'dev');
+    expect(checked.phases.run).toBeNull();
+    await expect(orchestrator.createRun({ language: 'python', code: 'print(1)', mode: 'compile' }, 'dev')).rejects.toThrow(
+      'compile mode not supported for python'
+    );
+    await expect(orchestrator.createRun({ language: 'java', code: 'class Main {}', mode: 'check' }, 'dev')).rejects.toThrow(
+      'check mode not supported for java'
+    );
+    await expect(
+      orchestrator.createRun({ language: 'java', code: 'class Main {}', sources: { 'build.gradle': 'plugins { id \'java\' }' } }, 'dev')
+    ).rejects.toThrow('build.gradle: Gradle builds are not supported for java');
+    expect(() =>
+      orchestrator.startRun({ language: 'python', code: 'print(1)', mode: 'check' }, 'dev', { input: new PassThrough() })
+    ).toThrow('check mode is not available for interactive sessions');
+  });
+
+  it('queues runs under their priority class', async () => {
+    const priorities: Array<string | undefined> = [];
+    const queue = new InMemoryQueue({ concurrency: 1, maxDepth: 10 });
+    const prioritized = orchestratorWith({
+      sandboxRunner: new MockSandbox(() => ({ status: 'succeeded', exitCode: 0, stdout: Buffer.alloc(0), stderr: Buffer.alloc(0), usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 }, artifacts: [] })),
+      queue: {
+        enqueue: (job, signal, tenant, priority) => {
+          priorities.push(priority);
+          return queue.enqueue(job, signal, tenant, priority);
+        },
+        stats: () => queue.stats()
+      }
+    });
+    await prioritized.createRun({ language: 'python', code: 'print(1)', priority: 'interactive' }, 'dev');
+    await prioritized.createRun({ language: 'python', code: 'print(1)' }, 'dev');
+    expect(priorities).toEqual(['interactive', undefined]);
+    await expect(
+      prioritized.createRun({ language: 'python', code: 'print(1)', priority: 'urgent' as never }, 'dev')
+    ).rejects.toThrow('priority must be interactive, normal or batch');
+  });
+
+  it('says why a run ended', async () => {
+    const crashing = orchestratorWith({
+      sandboxRunner: new MockSandbox(() => ({
+        status: 'failed',
+        exitCode: 139,
+        exitSignal: 'SIGSEGV',
+        stdout: Buffer.alloc(0),
+        stderr: Buffer.alloc(0),
+        usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 },
+        artifacts: []
+      })),
+    });
+    const run = await crashing.createRun({ language: 'c', code: 'int main() { return *(int *)0; }' }, 'dev');
+    expect(run.termination).toMatchObject({ verdict: 'segmentation_fault', signal: 'SIGSEGV' });
+    expect((await orchestrator.createRun({ language: 'python', code: 'print(1)' }, 'dev')).termination.verdict).toBe('exited');
+  });
+
+  it('runs static checks on runners that support lint', async () => {
+    const run = await orchestrator.createRun({ language: 'go', code: 'package main', lint: { staticcheck: true } }, 'dev');
+    expect(lastSpec?.lint).toEqual({ staticcheck: true });
+    expect(run.diagnostics).toEqual([]);
+    await expect(orchestrator.createRun({ language: 'python', code: 'print(1)', lint: {} }, 'dev')).rejects.toThrow(
+      'lint not supported for python'
+    );
+    await expect(
+      orchestrator.createRun({ language: 'go', code: 'package main', lint: { vet: 'yes' as never } }, 'dev')
+    ).rejects.toThrow('lint.vet must be a boolean');
+  });
+
+  it('reports the coverage of test-mode runs that ask for it', async () => {
+    const coverage: CoverageReport = {
+      tool: 'go',
+      covered_lines: 1,
+      total_lines: 2,
+      percent: 50,
+      files: [{ file: 'main.go', covered_lines: 1, total_lines: 2, percent: 50, covered: [4], missed: [8] }]
+    };
+    const measured = orchestratorWith({
+      sandboxRunner: new MockSandbox((spec) => {
+        lastSpec = spec;
+        return {
+          status: 'succeeded',
+          exitCode: 0,
+          stdout: Buffer.alloc(0),
+          stderr: Buffer.alloc(0),
+          usage: { wall_ms: 10, cpu_ms: 5, max_rss_mb: 2 },
+          artifacts: [],
+          tests: [],
+          coverage: spec.coverage ? coverage : null
+        };
+      }),
+    });
+    const run = await measured.createRun({ language: 'go', mode: 'test', code: 'package main', coverage: true }, 'dev');
+    expect(lastSpec?.coverage).toBe(true);
+    expect(run.coverage).toEqual(coverage);
+    expect((await measured.createRun({ language: 'go', mode: 'test', code: 'package main' }, 'dev')).coverage).toBeNull();
+    await expect(orchestrator.createRun({ language: 'go', code: 'package main', coverage: true }, 'dev')).rejects.toThrow(
+      'coverage is only available in test mode'
+    );
+    await expect(
+      orchestrator.createRun({ language: 'go', mode: 'test', code: 'package main', coverage: 'yes' as never }, 'dev')
+    ).rejects.toThrow('coverage must be a boolean');
+  });
+
+  it('asks runners for the profiles they support in run mode', async () => {
+    await orchestrator.createRun({ language: 'go', code: 'package main', profile: { cpu: true, heap: true } }, 'dev');
+    expect(lastSpec?.profile).toEqual({ cpu: true, heap: true });
+    await orchestrator.createRun({ language: 'python', code: 'print(1)', profile: { cpu: true, heap: false } }, 'dev');
+    expect(lastSpec?.profile).toEqual({ cpu: true, heap: false });
+    await expect(orchestrator.createRun({ language: 'python', code: 'print(1)', profile: { heap: true } }, 'dev')).rejects.toThrow(
+      'heap profiling not supported for python'
+    );
+    await expect(orchestrator.createRun({ language: 'ruby', code: 'puts 1', profile: { cpu: true } }, 'dev')).rejects.toThrow(
+      'cpu profiling not supported for ruby'
+    );
+    await expect(
+      orchestrator.createRun({ language: 'go', code: 'package main', profile: { cpu: 'yes' as never } }, 'dev')
+    ).rejects.toThrow('profile.cpu must be a boolean');
+    await expect(
+      orchestrator.createRun({ language: 'go', code: 'package main', mode: 'test', profile: { cpu: true } }, 'dev')
+    ).rejects.toThrow('profile is only available in run mode');
+  });
+
+  it('reports compiler diagnostics without lint on runners that parse them', async () => {
+    expect((await orchestrator.createRun({ language: 'go', code: 'package main' }, 'dev')).diagnostics).toEqual([]);
+    expect((await orchestrator.createRun({ language: 'c', code: 'int main() {}' }, 'dev')).diagnostics).toEqual([]);
+    expect(lastSpec?.lint).toBeUndefined();
+    expect((await orchestrator.createRun({ language: 'python', code: 'print(1)' }, 'dev')).diagnostics).toBeNull();
+  });
+
+  it('builds templated code and reports diagnostics and errors against the submitted lines', async () => {
+    const templated = orchestratorWith({
+      sandboxRunner: new MockSandbox((spec) => {
+        lastSpec = spec;
+        return {
+          status: 'failed',
+          exitCode: 1,
+          stdout: Buffer.alloc(0),
+          stderr: Buffer.from('./main.go:4:2: undefined: y\n'),
+          compile: { exit_code: 1, duration_ms: 5, stdout: '', stderr: './main.go:4:2: undefined: y\n' },
+          usage: { wall_ms: 10, cpu_ms: 5, max_rss_mb: 2 },
+          artifacts: [],
+          diagnostics: [{ source: 'compile', file: 'main.go', line: 4, column: 2, code: null, severity: 'error', message: 'undefined: y' }]
+        };
+      }),
+    });
+    const run = await templated.createRun(
+      { language: 'go', code: 'func add(x int) int {\n\treturn y\n}', template: { source: 'package main\n\n{{code}}\n\nfunc main() { println(add(1)) }\n' } },
+      'dev'
+    );
+    expect(lastSpec?.code).toBe('package main\n\nfunc add(x int) int {\n\treturn y\n}\n\nfunc main() { println(add(1)) }\n');
+    expect(run.diagnostics).toEqual([
+      { source: 'compile', file: 'main.go', line: 2, column: 2, code: null, severity: 'error', message: 'undefined: y', origin: 'code' }
+    ]);
+    expect(run.stderr).toBe('./main.go:2:2: undefined: y\n');
+    expect(run.phases.compile?.stderr).toBe('./main.go:2:2: undefined: y\n');
+    await expect(orchestrator.createRun({ language: 'go', code: 'x', template: { source: 'package main' } }, 'dev')).rejects.toThrow(
+      'template.source must contain {{code}} exactly once'
+    );
+  });
+
+  it('passes database options to the sql runner', async () => {
+    const fixture = 'CREATE TABLE t (a INT);';
+    const run = await orchestrator.createRun({ language: 'sql', code: 'SELECT * FROM t;', sql: { engine: 'postgres', fixture } }, 'dev');
+    expect(lastSpec?.sql).toEqual({ engine: 'postgres', fixture });
+    expect(run.results).toEqual([]);
+    expect((await orchestrator.createRun({ language: 'python', code: 'print(1)' }, 'dev')).results).toBeNull();
+    await expect(orchestrator.createRun({ language: 'python', code: 'print(1)', sql: {} }, 'dev')).rejects.toThrow(
+      'sql not supported for python'
+    );
+    await expect(
+      orchestrator.createRun({ language: 'sql', code: 'SELECT 1;', sql: { engine: 'mysql' as never } }, 'dev')
+    ).rejects.toThrow('sql.engine must be sqlite or postgres');
+  });
+
+  it('reports canceled runs without their partial artifacts', async () => {
+    const started = orchestrator.startRun({ language: 'python', code: 'print(1)' }, 'dev');
+    expect(orchestrator.cancelRun(started.id)).toBe(true);
+    const run = await started.done;
+    expect(run.status).toBe('canceled');
+    expect(run.limit_exceeded).toBeNull();
+    expect(run.artifacts).toEqual([]);
+    expect(orchestrator.getActiveRun(started.id)).toBeNull();
+  });
+
+  it('tells watchers of a run its state changes and output', async () => {
+    let release: () => void = () => undefined;
+    const released = new Promise<void>((resolve) => (release = resolve));
+    const watched = orchestratorWith({
+      queue: new InMemoryQueue({ concurrency: 1, maxDepth: 10 }),
+      sandboxRunner: {
+        async run(spec) {
+          if (spec.code === 'block') {
+            await released;
+          }
+          spec.onOutput?.('stderr', Buffer.from('building'));
+          spec.onRunStart?.();
+          spec.onOutput?.('stdout', Buffer.from('hi'));
+          return { status: 'succeeded', exitCode: 0, stdout: Buffer.from('hi'), stderr: Buffer.alloc(0), usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 }, artifacts: [] };
+        }
+      },
+    });
+    const blocker = watched.startRun({ language: 'python', code: 'block' }, 'dev');
+    const started = watched.startRun({ language: 'go', code: 'package main' }, 'dev');
+    const events: string[] = [];
+    const watch = watched.watchRun(started.id, {
+      onState: (state) => events.push(state),
+      onOutput: (stream, chunk) => events.push(`${stream}:${chunk.toString()}`)
+    });
+    expect(watch?.state).toBe('queued');
+    release();
+    expect((await watch?.done)?.id).toBe(started.id);
+    expect(events).toEqual(['compiling', 'stderr:building', 'running', 'stdout:hi']);
+    await blocker.done;
+    expect(watched.watchRun(started.id, {})).toBeNull();
+  });
+
+  it('records each step of a run on its audit trail', async () => {
+    const store = new RunStore();
+    const audited = orchestratorWith({
+      sandboxRunner: new MockSandbox(() => ({
+        status: 'timeout',
+        exitCode: 124,
+        limitExceeded: 'wall_time',
+        compile: { exit_code: 0, stdout: '', stderr: '', duration_ms: 30 },
+        stdout: Buffer.alloc(0),
+        stderr: Buffer.alloc(0),
+        usage: { wall_ms: 1000, cpu_ms: 990, max_rss_mb: 2 },
+        artifacts: []
+      })),
+      store,
+    });
+    const run = await audited.createRun({ language: 'go', code: 'package main\nfunc main() { for {} }' }, 'dev');
+    const events = await store.listEvents(run.id);
+    expect(events.map((event) => event.type)).toEqual([
+      'submitted',
+      'sandbox_created',
+      'compile_started',
+      'compile_finished',
+      'run_started',
+      'run_finished',
+      'limit_exceeded',
+      'artifacts_stored',
+      'cleanup',
+      'completed'
+    ]);
+    expect(events.map((event) => event.seq)).toEqual([0, 1, 2, 3, 4, 5, 6, 7, 8, 9]);
+    expect(events[6].data).toEqual({ limit: 'wall_time' });
+    expect(events[9].data).toEqual({ status: 'timeout', exit_code: 124 });
+    expect(Date.parse(events[4].at)).toBeGreaterThanOrEqual(Date.parse(events[3].at));
+  });
+
+  it('passes memory warnings on to watchers and the audit trail', async () => {
+    const store = new RunStore();
+    let release: () => void = () => undefined;
+    const released = new Promise<void>((resolve) => (release = resolve));
+    const warned = orchestratorWith({
+      sandboxRunner: {
+        async run(spec) {
+          await released;
+          const warning = { threshold_pct: spec.memoryWarnings![0], used_mb: 210, limit_mb: spec.limits.memory_mb, elapsed_ms: 400 };
+          spec.onMemoryPressure?.(warning);
+          return {
+            status: 'oom',
+            exitCode: 137,
+            limitExceeded: 'memory',
+            stdout: Buffer.alloc(0),
+            stderr: Buffer.alloc(0),
+            usage: { wall_ms: 500, cpu_ms: 450, max_rss_mb: 256 },
+            memory: { limit_mb: 256, peak_mb: 256, peak_pct: 100, sampled: true, warnings: [warning] },
+            artifacts: []
+          };
+        }
+      },
+      store,
+      memoryWarnings: [80],
+    });
+    const started = warned.startRun({ language: 'python', code: 'x = [0] * 10**9', limits: { memory_mb: 256 } }, 'dev');
+    const warnings: unknown[] = [];
+    warned.watchRun(started.id, { onMemory: (warning) => warnings.push(warning) });
+    release();
+    const run = await started.done;
+    expect(warnings).toEqual([{ threshold_pct: 80, used_mb: 210, limit_mb: 256, elapsed_ms: 400 }]);
+    expect(run.memory).toMatchObject({ peak_pct: 100, warnings });
+    const events = await store.listEvents(run.id);
+    expect(events.find((event) => event.type === 'memory_pressure')?.data).toEqual(warnings[0]);
+  });
+
+  it('passes usage samples on to watchers and keeps the series in the record', async () => {
+    let release: () => void = () => undefined;
+    const released = new Promise<void>((resolve) => (release = resolve));
+    const specs: SandboxRunSpec[] = [];
+    const sampled = orchestratorWith({
+      sandboxRunner: {
+        async run(spec) {
+          specs.push(spec);
+          await released;
+          const sample = { elapsed_ms: 200, memory_mb: 40, cpu_ms: 150, cpu_pct: 75 };
+          spec.onUsageSample?.(sample);
+          return {
+            status: 'succeeded',
+            exitCode: 0,
+            stdout: Buffer.alloc(0),
+            stderr: Buffer.alloc(0),
+            usage: { wall_ms: 300, cpu_ms: 200, max_rss_mb: 40 },
+            usageSamples: spec.usageIntervalMs ? { interval_ms: spec.usageIntervalMs, samples: [sample] } : null,
+            artifacts: []
+          };
+        }
+      },
+      maxUsageSamples: 50,
+    });
+    const started = sampled.startRun({ language: 'python', code: 'print(1)', usage_interval_ms: 200 }, 'dev');
+    const samples: unknown[] = [];
+    sampled.watchRun(started.id, { onUsage: (sample) => samples.push(sample) });
+    release();
+    const run = await started.done;
+    expect(specs[0]).toMatchObject({ usageIntervalMs: 200, maxUsageSamples: 50 });
+    expect(samples).toEqual([{ elapsed_ms: 200, memory_mb: 40, cpu_ms: 150, cpu_pct: 75 }]);
+    expect(run.usage_samples).toEqual({ interval_ms: 200, samples });
+    expect((await sampled.createRun({ language: 'python', code: 'print(1)' }, 'dev')).usage_samples).toBeNull();
+
+    for (const interval of [50, 60001, 1.5]) {
+      await expect(sampled.createRun({ language: 'python', code: 'print(1)', usage_interval_ms: interval }, 'dev'))
+        .rejects.toThrow('usage_interval_ms must be an integer from 100 to 60000');
+    }
+  });
+
+  it('lists artifacts the object store refused as skipped', async () => {
+    const refusing = orchestratorWith({
+      artifactStorage: new ArtifactStorage({
+        baseDir: path.join(tmpDir, 'storage'),
+        baseUrl: 'http://localhost:8080',
+        signingKey: 'test-key',
+        urlTtlSeconds: 600,
+        objects: {
+          kind: 's3',
+          put: async () => {
+            throw new Error('object upload failed with 403');
+          },
+          signedUrl: async () => 'unused'
+        }
+      })
+    });
+    const run = await refusing.createRun({ language: 'python', code: 'print("hi")' }, 'dev');
+    expect(run.status).toBe('succeeded');
+    expect(run.artifacts).toEqual([]);
+    expect(run.artifacts_skipped).toEqual([{ name: 'result.txt', size: 8, reason: 'upload_failed' }]);
+  });
+
+  it('reports how a run past its wall-clock limit was stopped', async () => {
+    const timeout = { stage: 'hard' as const, grace_ms: 250, stdout_bytes: 5, stderr_bytes: 0, flushed_bytes: 0 };
+    const timingOut = orchestratorWith({
+      sandboxRunner: new MockSandbox(() => ({
+        status: 'timeout',
+        exitCode: 124,
+        limitExceeded: 'wall_time',
+        timeout,
+        stdout: Buffer.from('hello'),
+        stderr: Buffer.alloc(0),
+        usage: { wall_ms: 1250, cpu_ms: 1200, max_rss_mb: 2 },
+        artifacts: []
+      })),
+    });
+    const run = await timingOut.createRun({ language: 'python', code: 'while True: pass', limits: { timeout_ms: 1000, kill_grace_ms: 250 } }, 'dev');
+    expect(run.status).toBe('timeout');
+    expect(run.timeout).toEqual(timeout);
+    expect(run.limits).toMatchObject({ timeout_ms: 1000, kill_grace_ms: 250 });
+  });
+
+  it('stores each run and its outcome in the execution store', async () => {
+    const store = new RunStore();
+    const failing = { run: async () => Promise.reject(new Error('daemon unavailable')) };
+    const options = { store };
+    const succeeding = new MockSandbox(() => ({
+      status: 'succeeded',
+      exitCode: 0,
+      stdout: Buffer.from('ok'),
+      stderr: Buffer.alloc(0),
+      usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 },
+      artifacts: []
+    }));
+    const request = { language: 'python', code: 'print(1)' };
+    const run = await orchestratorWith({ ...options, sandboxRunner: succeeding }).createRun(request, 'dev');
+    expect((await store.get(run.id))?.stdout).toBe('ok');
+
+    const started = orchestratorWith({ ...options, sandboxRunner: failing }).startRun(request, 'dev');
+    await expect(started.done).rejects.toThrow('daemon unavailable');
+    expect(await store.getError(started.id)).toBe('internal_error');
+  });
+
+  it('applies the key policy to every run', async () => {
+    const admitted: string[] = [];
+    const keyPolicy = {
+      admitRun: (apiKey: string) => {
+        if (apiKey === 'over-quota') {
+          throw new Error('monthly execution quota exceeded');
+        }
+        admitted.push(apiKey);
+      },
+      maxLimits: (apiKey: string) => (apiKey === 'pro' ? { memory_mb: 2048 } : undefined),
+      tenantOf: () => undefined
+    };
+    const tiered = orchestratorWith({
+      sandboxRunner: new MockSandbox(() => ({
+        status: 'succeeded',
+        exitCode: 0,
+        stdout: Buffer.alloc(0),
+        stderr: Buffer.alloc(0),
+        usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 },
+        artifacts: []
+      })),
+      keyPolicy
+    });
+    const request = { language: 'python', code: 'print(1)', limits: { memory_mb: 2048 } };
+    expect((await tiered.createRun(request, 'pro')).limits.memory_mb).toBe(2048);
+    await expect(tiered.createRun(request, 'dev')).rejects.toThrow('memory_mb exceeds maximum');
+    await expect(tiered.createRun({ language: 'python', code: 'print(1)' }, 'over-quota')).rejects.toThrow('quota exceeded');
+    expect(admitted).toEqual(['pro']);
+  });
+
+  it('records the tenant, tags and metadata of submissions for listings', async () => {
+    const store = new RunStore();
+    const tagged = orchestratorWith({
+      sandboxRunner: new MockSandbox(() => ({
+        status: 'succeeded',
+        exitCode: 0,
+        stdout: Buffer.alloc(0),
+        stderr: Buffer.alloc(0),
+        usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 },
+        artifacts: []
+      })),
+      store,
+      keyPolicy: { admitRun: () => undefined, maxLimits: () => undefined, tenantOf: () => undefined, tenantName: () => 'acme' }
+    });
+    const run = await tagged.createRun({ language: 'python', code: 'print(1)', tags: ['course:cs101', 'hw1'] }, 'dev');
+    expect(await store.listExecutions({ tag: 'hw1' }, 10)).toMatchObject([{ id: run.id, tenant: 'acme', tags: ['course:cs101', 'hw1'] }]);
+    await expect(tagged.createRun({ language: 'python', code: 'x', tags: ['a,b'] }, 'dev')).rejects.toThrow('invalid tag: a,b');
+    await expect(tagged.createRun({ language: 'python', code: 'x', tags: 'hw1' as never }, 'dev')).rejects.toThrow('tags must be an array of at most 16 tags');
+
+    const labeled = await tagged.createRun({ language: 'python', code: 'print(1)', metadata: { assignment_id: 'hw3', commit_sha: 'f00d' } }, 'dev');
+    expect(labeled.metadata).toEqual({ assignment_id: 'hw3', commit_sha: 'f00d' });
+    expect((await store.get(labeled.id))?.metadata).toEqual({ assignment_id: 'hw3', commit_sha: 'f00d' });
+    expect(await store.listExecutions({ metadata: { assignment_id: 'hw3' } }, 10)).toMatchObject([{ id: labeled.id, metadata: { commit_sha: 'f00d' } }]);
+    expect(run.metadata).toEqual({});
+    await expect(tagged.createRun({ language: 'python', code: 'x', metadata: { 'student-id': '1' } }, 'dev')).rejects.toThrow('invalid metadata key: student-id');
+    await expect(tagged.createRun({ language: 'python', code: 'x', metadata: { attempt: 2 as never } }, 'dev')).rejects.toThrow('metadata.attempt must be a string');
+    await expect(tagged.createRun({ language: 'python', code: 'x', metadata: { sha: 'x'.repeat(513) } }, 'dev')).rejects.toThrow('of at most 512 characters');
+  });
+
+  it('keeps a fingerprint of each submission for finding similar ones', async () => {
+    const store = new RunStore();
+    const fingerprinting = orchestratorWith({
+      sandboxRunner: new MockSandbox(() => ({
+        status: 'succeeded',
+        exitCode: 0,
+        stdout: Buffer.alloc(0),
+        stderr: Buffer.alloc(0),
+        usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 },
+        artifacts: []
+      })),
+      store,
+      fingerprints: true
+    });
+    const code = 'def solve(xs):\n    return sorted(xs)[len(xs) // 2]\nprint(solve([3, 1, 2]))\n';
+    const original = await fingerprinting.createRun({ language: 'python', code }, 'dev');
+    const copied = await fingerprinting.createRun({ language: 'python', code: code.replaceAll('xs', 'values').replace('solve', 'median') }, 'dev');
+    const hashes = await store.getFingerprint(original.id);
+    expect(hashes).toEqual(fingerprint({ language: 'python', code }));
+    const [match] = await store.findSimilar({ hashes, threshold: 0.9, exclude_id: original.id, filter: { api_key: 'dev' } }, 10);
+    expect(match).toMatchObject({ id: copied.id, similarity: 1 });
+  });
+
+  it('replays submissions that reuse an idempotency key', async () => {
+    const store = new RunStore();
+    const options = { store };
+    let runs = 0;
+    const counting = new MockSandbox(() => ({
+      status: 'succeeded',
+      exitCode: 0,
+      stdout: Buffer.from(String(++runs)),
+      stderr: Buffer.alloc(0),
+      usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 },
+      artifacts: []
+    }));
+    const idempotent = orchestratorWith({ ...options, sandboxRunner: counting });
+    const request = { language: 'python', code: 'import random; print(random.random())', env: { A: '1', B: '2' } };
+    const first = idempotent.startRun(request, 'dev', { idempotencyKey: 'order-1' });
+    // Concurrent retries share the in-flight run, whatever the key order of their body.
+    const retry = idempotent.startRun({ env: { B: '2', A: '1' }, code: request.code, language: 'python' }, 'dev', { idempotencyKey: 'order-1' });
+    expect(retry).toMatchObject({ id: first.id, replayed: true });
+    await first.done;
+
+    const match = await idempotent.findIdempotent('dev', 'order-1', request);
+    expect(match?.id).toBe(first.id);
+    expect((await idempotent.replayRun(match!)).stdout).toBe('1');
+    expect(await idempotent.findIdempotent('other-key', 'order-1', request)).toBeNull();
+    await expect(idempotent.findIdempotent('dev', 'order-1', { ...request, code: 'print(2)' })).rejects.toThrow(
+      'Idempotency-Key was already used for a different request'
+    );
+    expect(runs).toBe(1);
+  });
+
+  it('answers deterministic resubmissions from the result cache', async () => {
+    const store = new RunStore();
+    let runs = 0;
+    const cache = new ResultCache({ maxEntries: 10, ttlMs: 60000 });
+    const cached = orchestratorWith({
+      sandboxRunner: new MockSandbox((spec) => ({
+        status: 'succeeded',
+        exitCode: 0,
+        stdout: Buffer.from(`${++runs}:${spec.stdin}`),
+        stderr: Buffer.alloc(0),
+        usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 },
+        artifacts: []
+      })),
+      queue: new InMemoryQueue({ concurrency: 1, maxDepth: 5 }),
+      store,
+      resultCache: cache
+    });
+    const request: RunRequest = { language: 'python', code: 'print(input())', stdin: '3', deterministic: true };
+    const first = await cached.createRun(request, 'dev');
+    expect(first).toMatchObject({ stdout: '1:3', cached_from: null });
+    const second = await cached.createRun({ ...request }, 'dev');
+    expect(second.id).not.toBe(first.id);
+    expect(second).toMatchObject({ stdout: '1:3', cached_from: first.id, queue_wait_ms: 0 });
+    // Only the run that reached a sandbox costs anything.
+    expect(first.cost).toMatchObject({ cpu_seconds: 0.001 });
+    expect(first.cost!.memory_gb_seconds).toBe(Math.round((first.limits.memory_mb / 1024) * first.cost!.sandbox_seconds * 1e6) / 1e6);
+    // By default a CPU-second and a GB-second are a unit each.
+    expect(first.cost!.units).toBeGreaterThan(first.cost!.memory_gb_seconds);
+    expect(second.cost).toEqual({ cpu_seconds: 0, memory_gb_seconds: 0, sandbox_seconds: 0, units: 0 });
+    expect((await store.listEvents(second.id)).map((event) => event.type)).toEqual(['submitted', 'cache_hit', 'completed']);
+    expect((await store.get(second.id))?.cached_from).toBe(first.id);
+    // Metadata labels the run without changing what it does, so it doesn't miss the cache.
+    const labeled = await cached.createRun({ ...request, metadata: { student_id: 's2' } }, 'dev');
+    expect(labeled).toMatchObject({ stdout: '1:3', cached_from: first.id, metadata: { student_id: 's2' } });
+    // Other input, other limits or no flag run again.
+    expect((await cached.createRun({ ...request, stdin: '4' }, 'dev')).stdout).toBe('2:4');
+    expect((await cached.createRun({ ...request, limits: { timeout_ms: 2000 } }, 'dev')).stdout).toBe('3:3');
+    expect((await cached.createRun({ ...request, deterministic: undefined }, 'dev')).stdout).toBe('4:3');
+    expect(runs).toBe(4);
+    expect(cache.stats()).toMatchObject({ entries: 3, hits: 2, misses: 3 });
+    await expect(cached.createRun({ ...request, deterministic: 'yes' as unknown as boolean }, 'dev')).rejects.toThrow('deterministic must be a boolean');
+  });
+
+  it('drains by finishing running runs and requeuing queued ones for the next server', async () => {
+    const store = new RunStore();
+    let release: () => void = () => undefined;
+    const released = new Promise<void>((resolve) => (release = resolve));
+    const options = {
+      sandboxRunner: new MockSandbox(() => ({
+        status: 'succeeded',
+        exitCode: 0,
+        stdout: Buffer.from('ok'),
+        stderr: Buffer.alloc(0),
+        usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 },
+        artifacts: []
+      })),
+      store
+    };
+    const draining = orchestratorWith({
+      ...options,
+      queue: new InMemoryQueue({ concurrency: 1, maxDepth: 10 }),
+      sandboxRunner: { run: async (spec) => (await released, options.sandboxRunner.run(spec)) }
+    });
+    const running = draining.startRun({ language: 'python', code: 'print(1)' }, 'dev');
+    const queued = draining.startRun({ language: 'python', code: 'print(2)' }, 'dev');
+    // Needs the files the judge hands in, so it cannot wait in the store.
+    const judged = draining.startRun({ language: 'python', code: 'print(3)' }, 'dev', { inputs: { 'case.txt': '1' } });
+    const drained = draining.drain(5000);
+    await expect(queued.done).rejects.toMatchObject({ data: { code: 'requeued', id: queued.id } });
+    expect(() => draining.startRun({ language: 'python', code: 'print(4)' }, 'dev')).toThrow('the server is shutting down');
+    expect(draining.isDraining).toBe(true);
+    release();
+    expect((await running.done).status).toBe('succeeded');
+    expect((await judged.done).status).toBe('succeeded');
+    expect(await drained).toEqual({ requeued: 1, canceled: 0 });
+
+    expect(await store.failUnfinished(new Date(Date.now() + 1000).toISOString(), 'interrupted')).toBe(0);
+    const claimed = await store.claimRequeued();
+    expect(claimed.map((submission) => submission.id)).toEqual([queued.id]);
+    expect(await store.claimRequeued()).toEqual([]);
+    const resumed = await orchestratorWith(options).resumeRun(claimed[0]);
+    expect(resumed.id).toBe(queued.id);
+    expect((await resumed.done).created_at).toBe(claimed[0].created_at);
+    const events = await store.listEvents(queued.id);
+    expect(events.map((event) => event.type)).toEqual([
+      'submitted',
+      'queued',
+      'requeued',
+      'resumed',
+      'sandbox_created',
+      'run_started',
+      'run_finished',
+      'artifacts_stored',
+      'cleanup',
+      'completed'
+    ]);
+    expect(events.map((event) => event.seq)).toEqual(events.map((_event, index) => index));
+  });
+
+  it('cancels runs still going when the drain times out', async () => {
+    const stuck = orchestratorWith({
+      sandboxRunner: {
+        run: (spec) => new Promise((resolve) => spec.signal?.addEventListener('abort', () => resolve(canceledResult())))
+      },
+    });
+    const started = stuck.startRun({ language: 'python', code: 'while True: pass' }, 'dev');
+    expect(await stuck.drain(50)).toEqual({ requeued: 0, canceled: 1 });
+    expect((await started.done).status).toBe('canceled');
+  });
+
+  it('calls hooks around runs and keeps what they add', async () => {
+    const events: string[] = [];
+    const hooked = orchestratorWith({
+      sandboxRunner: new MockSandbox(() => {
+        events.push('sandbox');
+        return {
+          status: 'succeeded',
+          exitCode: 0,
+          stdout: Buffer.from('42'),
+          stderr: Buffer.alloc(0),
+          usage: { wall_ms: 1, cpu_ms: 7, max_rss_mb: 1 },
+          artifacts: []
+        };
+      }),
+      hooks: new HookRunner(
+        [
+          {
+            name: 'policy',
+            beforeCompile: (context) => {
+              events.push(`before_compile ${context.language}`);
+              if (context.request.code?.includes('os.system')) {
+                throw Boom.forbidden('shelling out is not allowed');
+              }
+            },
+            beforeRun: () => {
+              events.push('before_run');
+            }
+          },
+          { name: 'billing', afterCompletion: (_context, run) => ({ cpu_ms: run.usage.cpu_ms }) },
+          {
+            name: 'broken',
+            afterCompletion: () => {
+              throw new Error('enrichment service down');
+            }
+          }
+        ],
+        {},
+        new Logger({ test: 'hooks' })
+      )
+    });
+    const run = await hooked.createRun({ language: 'python', code: 'print(42)' }, 'dev');
+    // The run does not wait for before_run hooks.
+    expect(events[0]).toBe('before_compile python');
+    expect([...events].sort()).toEqual(['before_compile python', 'before_run', 'sandbox']);
+    expect(run.annotations).toEqual({ billing: { cpu_ms: 7 } });
+    await expect(hooked.createRun({ language: 'python', code: 'import os; os.system("ls")' }, 'dev')).rejects.toThrow('shelling out is not allowed');
+    expect(events.filter((event) => event === 'sandbox')).toHaveLength(1);
+  });
+
+  it('refuses submissions the policy scanner rejects and reports what it flags', async () => {
+    const scanned = orchestratorWith({
+      sandboxRunner: new MockSandbox(() => ({
+        status: 'succeeded',
+        exitCode: 0,
+        stdout: Buffer.alloc(0),
+        stderr: Buffer.alloc(0),
+        usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 },
+        artifacts: []
+      })),
+      policyScanner: new PolicyScanner([
+        { id: 'no-subprocess', kind: 'import', match: ['subprocess'], action: 'reject' },
+        { id: 'no-eval', kind: 'call', match: ['eval'], action: 'flag' }
+      ])
+    });
+    expect(() => scanned.startRun({ language: 'python', code: 'import subprocess' }, 'dev')).toThrow('code:1: import of subprocess is not allowed');
+    const run = await scanned.createRun({ language: 'python', code: 'print(eval("1 + 1"))' }, 'dev');
+    expect(run.status).toBe('succeeded');
+    expect(run.policy_violations).toMatchObject([{ rule: 'no-eval', action: 'flag', line: 1, column: 7 }]);
+  });
+
+  it('signs finished records, cached answers included', async () => {
+    let withArtifact = false;
+    const signer = new ResultSigner(
+      crypto.generateKeyPairSync('ed25519').privateKey.export({ type: 'pkcs8', format: 'pem' }).toString()
+    );
+    const signing = orchestratorWith({
+      sandboxRunner: new MockSandbox((spec) => {
+        const outPath = path.join(spec.workdir, 'outputs', 'result.txt');
+        if (withArtifact) {
+          fs.writeFileSync(outPath, 'artifact');
+        }
+        return {
+          status: 'succeeded',
+          exitCode: 0,
+          stdout: Buffer.from('42\n'),
+          stderr: Buffer.alloc(0),
+          usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 },
+          artifacts: withArtifact ? [{ path: outPath, name: 'result.txt', size: 8, contentType: 'text/plain' }] : []
+        };
+      }),
+      resultCache: new ResultCache({ maxEntries: 10, ttlMs: 60000 }),
+      resultSigner: signer
+    });
+    const first = await signing.createRun({ language: 'python', code: 'print(42)', deterministic: true }, 'dev');
+    expect(first.signature?.key_id).toBe(signer.key.key_id);
+    expect(verifyResult(JSON.parse(JSON.stringify(first)), signer.key)).toBe(true);
+    const cached = await signing.createRun({ language: 'python', code: 'print(42)', deterministic: true }, 'dev');
+    expect(cached.cached_from).toBe(first.id);
+    expect(verifyResult(cached, signer.key)).toBe(true);
+    expect(verifyResult({ ...cached, stdout: '41\n' }, signer.key)).toBe(false);
+    // What the store keeps, without inline contents, verifies too.
+    withArtifact = true;
+    const inline = await signing.createRun({ language: 'python', code: 'print(42)', inline_artifacts: true }, 'dev');
+    expect(inline.artifacts[0].content).toBe(Buffer.from('artifact').toString('base64'));
+    expect(verifyResult({ ...inline, artifacts: [] }, signer.key)).toBe(false);
+    expect(verifyResult(withoutInlineContent(inline), signer.key)).toBe(true);
   });
 });
@@ -0,0 +1,42 @@
+import { diffOutput } from '../../src/core/output_diff.js';
+
+describe('diffOutput', () => {
+  it('diffs lines as the comparison sees them and points at the first difference', () => {
+    const expected = Array.from({ length: 12 }, (_, index) => `${index + 1}`).join('\n');
+    const actual = expected.replace('3\n', '').replace('12', '12  \nextra');
+    expect(diffOutput(actual, expected, 'trimmed', 0)).toEqual({
+      format: 'unified',
+      text: '--- expected\n+++ actual\n@@ -1,6 +1,5 @@\n 1\n 2\n-3\n 4\n 5\n 6\n@@ -10,3 +9,4 @@\n 10\n 11\n 12\n+extra',
+      truncated: false,
+      line: 3,
+      column: 1,
+      expected: '3\n',
+      actual: '4\n'
+    });
+    expect(diffOutput('1 2  \r\n\n', '1 2', 'trimmed', 0)).toBeNull();
+    expect(diffOutput('answer: 41\n', 'answer: 42', 'exact', 0)).toMatchObject({
+      line: 1,
+      column: 10,
+      expected: '2',
+      actual: '1\n',
+      text: '--- expected\n+++ actual\n@@ -1,1 +1,1 @@\n-answer: 42\n\\ No newline at end of file\n+answer: 41'
+    });
+    expect(diffOutput('', 'yes', 'exact', 0)).toMatchObject({ line: 1, column: 1, expected: 'yes', actual: null });
+  });
+
+  it('lists mismatching tokens for float comparison and caps what it returns', () => {
+    expect(diffOutput('0.5 yes\n  0.3334', '0.5 yes 0.333333 4', 'float', 1e-6)).toEqual({
+      format: 'tokens',
+      text: 'token 3 at 2:3: expected 0.333333, got 0.3334\ntoken 4 at 2:9: expected 4, got nothing',
+      truncated: false,
+      line: 2,
+      column: 3,
+      expected: '0.333333',
+      actual: '0.3334'
+    });
+    const long = diffOutput('x\n'.repeat(10_000), 'y\n'.repeat(10_000), 'exact', 0);
+    expect(long?.truncated).toBe(true);
+    expect(long?.text.length).toBeLessThanOrEqual(4096);
+    expect(diffOutput('1 '.repeat(5000), '2 '.repeat(5000), 'float', 0)?.truncated).toBe(true);
+  });
+});
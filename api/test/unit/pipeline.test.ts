@@ -0,0 +1,148 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { Pipeline } from '../../src/core/pipeline.js';
+import { Orchestrator } from '../../src/core/orchestrator.js';
+import { ArtifactStorage } from '../../src/core/storage.js';
+import { Logger } from '../../src/util/logger.js';
+import type { SandboxRunner, SandboxRunSpec, SandboxResult } from '../../src/core/types.js';
+
+// `generate` writes outputs/data.txt and prints a count, `solve` prints the sum of the numbers in
+// inputs/generate/data.txt, `verify` fails unless its stdin is `6`, and `list` prints the files
+// under inputs/.
+class StageSandbox implements SandboxRunner {
+  public readonly specs: SandboxRunSpec[] = [];
+
+  async run(spec: SandboxRunSpec): Promise<SandboxResult> {
+    this.specs.push(spec);
+    const inputs = path.join(spec.workdir, 'inputs');
+    const artifacts: SandboxResult['artifacts'] = [];
+    let stdout = '';
+    let failed = false;
+    if (spec.code === 'generate') {
+      const data = path.join(spec.workdir, 'outputs', 'data.txt');
+      fs.writeFileSync(data, '1 2 3');
+      artifacts.push({ path: data, name: 'data.txt', size: 5, contentType: 'text/plain' });
+      stdout = '3';
+    } else if (spec.code === 'solve') {
+      const numbers = fs.readFileSync(path.join(inputs, 'generate', 'data.txt'), 'utf8').split(' ').map(Number);
+      stdout = String(numbers.reduce((sum, value) => sum + value, 0));
+    } else if (spec.code === 'verify') {
+      failed = spec.stdin !== '6';
+    } else if (spec.code === 'list') {
+      stdout = fs.readdirSync(inputs, { recursive: true }).map(String).sort().join(',');
+    }
+    return {
+      status: failed ? 'failed' : 'succeeded',
+      exitCode: failed ? 1 : 0,
+      limitExceeded: null,
+      stdout: Buffer.from(stdout),
+      stderr: Buffer.alloc(0),
+      usage: { wall_ms: 1, cpu_ms: 1, max_rss_mb: 1 },
+      artifacts
+    };
+  }
+}
+
+describe('Pipeline', () => {
+  let tmpDir: string;
+  let sandbox: StageSandbox;
+  let pipeline: Pipeline;
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'pipeline-'));
+    sandbox = new StageSandbox();
+    const orchestrator = new Orchestrator({
+      workRoot: path.join(tmpDir, 'sandbox'),
+      artifactStorage: new ArtifactStorage({
+        baseDir: path.join(tmpDir, 'storage'),
+        baseUrl: 'http://localhost:8080',
+        signingKey: 'test-key',
+        urlTtlSeconds: 600
+      }),
+      sandboxRunner: sandbox,
+      logger: new Logger({ test: 'pipeline' })
+    });
+    pipeline = new Pipeline({ orchestrator, logger: new Logger({ test: 'pipeline' }), maxStages: 4 });
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('passes artifacts and stdout from earlier stages to later ones', async () => {
+    const result = await pipeline.run(
+      {
+        stages: [
+          { name: 'generate', language: 'python', code: 'generate' },
+          { name: 'solve', language: 'python', code: 'solve', limits: { timeout_ms: 2000 } },
+          { name: 'verify', language: 'python', code: 'verify', stdin_from: 'solve', artifacts_from: [] }
+        ]
+      },
+      'dev'
+    );
+    expect(result).toMatchObject({ status: 'succeeded', failed_stage: null });
+    expect(result.stages.map((stage) => [stage.name, stage.run.status, stage.run.stdout])).toEqual([
+      ['generate', 'succeeded', '3'],
+      ['solve', 'succeeded', '6'],
+      ['verify', 'succeeded', '']
+    ]);
+    // Fetched inline to be handed on, but not returned that way since the stage didn't ask.
+    expect(result.stages[0].run.artifacts.map((artifact) => [artifact.name, artifact.content])).toEqual([['data.txt', undefined]]);
+    expect(sandbox.specs.map((spec) => spec.limits.timeout_ms)[1]).toBe(2000);
+    expect(sandbox.specs[2].stdin).toBe('6');
+  });
+
+  it('stages each earlier stage\'s artifacts under its name unless told which to take', async () => {
+    const result = await pipeline.run(
+      {
+        stages: [
+          { name: 'generate', language: 'python', code: 'generate', inline_artifacts: true },
+          { name: 'list', language: 'python', code: 'list' },
+          { name: 'only', language: 'python', code: 'list', artifacts_from: ['list'] }
+        ]
+      },
+      'dev'
+    );
+    expect(result.stages[0].run.artifacts[0].content).toBe(Buffer.from('1 2 3').toString('base64'));
+    expect(result.stages[1].run.stdout).toBe('generate,generate/data.txt');
+    expect(result.stages[2].run.stdout).toBe('');
+  });
+
+  it('stops at the first stage that does not succeed', async () => {
+    const result = await pipeline.run(
+      {
+        stages: [
+          { name: 'verify', language: 'python', code: 'verify', stdin: '5' },
+          { name: 'generate', language: 'python', code: 'generate' }
+        ]
+      },
+      'dev'
+    );
+    expect(result).toMatchObject({ status: 'failed', failed_stage: 'verify' });
+    expect(result.stages.map((stage) => stage.name)).toEqual(['verify']);
+    expect(sandbox.specs).toHaveLength(1);
+  });
+
+  it('validates the stages before running any', async () => {
+    const stage = { language: 'python', code: 'generate' };
+    await expect(pipeline.run({ stages: [] }, 'dev')).rejects.toThrow('stages must be a non-empty array');
+    await expect(pipeline.run({ stages: Array.from({ length: 5 }, (_, index) => ({ ...stage, name: `s${index}` })) }, 'dev')).rejects.toThrow(
+      'stages exceeds 4 entries'
+    );
+    await expect(pipeline.run({ stages: [{ ...stage, name: 'a b' }] }, 'dev')).rejects.toThrow(
+      'stages[0].name must be 1-64 letters, digits, underscores or hyphens'
+    );
+    await expect(pipeline.run({ stages: [{ ...stage, name: 'a' }, { ...stage, name: 'a' }] }, 'dev')).rejects.toThrow('duplicate stage name: a');
+    await expect(pipeline.run({ stages: [{ ...stage, name: 'a', stdin_from: 'b' }, { ...stage, name: 'b' }] }, 'dev')).rejects.toThrow(
+      'stages[0].stdin_from must name an earlier stage'
+    );
+    await expect(pipeline.run({ stages: [{ ...stage, name: 'a' }, { ...stage, name: 'b', stdin_from: 'a', stdin: 'x' }] }, 'dev')).rejects.toThrow(
+      'stages[1] sets both stdin and stdin_from'
+    );
+    await expect(pipeline.run({ stages: [{ ...stage, name: 'a', artifacts_from: ['a'] }] }, 'dev')).rejects.toThrow(
+      'stages[0].artifacts_from must list earlier stages'
+    );
+    expect(sandbox.specs).toHaveLength(0);
+  });
+});
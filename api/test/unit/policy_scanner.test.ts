@@ -0,0 +1,61 @@
+import { PolicyScanner, parsePolicyRules } from '../../src/core/policy_scanner.js';
+
+describe('PolicyScanner', () => {
+  const scanner = new PolicyScanner(
+    parsePolicyRules([
+      { id: 'no-exec', kind: 'import', match: ['os/exec', 'net', 'subprocess', 'child_process'] },
+      { id: 'no-fork', kind: 'call', match: ['fork', 'system', 'execve'], languages: ['c', 'cpp'] },
+      { id: 'no-eval', kind: 'pattern', match: '\\beval\\s*\\(', action: 'flag', message: 'eval is discouraged' },
+      { id: 'course-101', kind: 'import', match: 'numpy', tenants: ['cs101'] }
+    ])
+  );
+
+  it('finds banned imports in each language and leaves comments and strings alone', () => {
+    const go = 'package main\n\nimport (\n\t"fmt"\n\t// "os/exec"\n\th "net/http"\n)\n\nimport "os/exec"\n\nfunc main() { fmt.Println("import \\"net\\"") }\n';
+    expect(scanner.scan({ language: 'go', code: go }).map(({ match, line, column }) => [match, line, column])).toEqual([
+      ['net/http', 6, 5],
+      ['os/exec', 9, 9]
+    ]);
+    const python = 'import os, subprocess as sp\n# import subprocess\ntext = "from subprocess import run"\nfrom subprocess import run\n';
+    expect(scanner.scan({ language: 'python', code: python }).map(({ match, line }) => [match, line])).toEqual([
+      ['subprocess', 1],
+      ['subprocess', 4]
+    ]);
+    const node = "const { spawn } = require('node:child_process');\nimport('child_process/x');\n";
+    expect(scanner.scan({ language: 'node', code: '', sources: { 'main.js': node } })).toMatchObject([
+      { path: 'main.js', line: 1, match: 'child_process' },
+      { path: 'main.js', line: 2, match: 'child_process/x' }
+    ]);
+    // numpy is only off limits for one course.
+    expect(scanner.scan({ language: 'python', code: 'import numpy' })).toEqual([]);
+    expect(scanner.scan({ language: 'python', code: 'import numpy' }, 'cs101')).toHaveLength(1);
+  });
+
+  it('rejects forbidden calls with every violation and flags the rest', () => {
+    const c = '#include <unistd.h>\nint main() {\n  /* fork() is off limits */\n  puts("fork()");\n  if (fork() == 0) system ("ls");\n  return eval(1);\n}\n';
+    let data: unknown;
+    try {
+      scanner.check({ language: 'c', code: c });
+    } catch (err) {
+      data = (err as { data: unknown }).data;
+    }
+    expect(data).toEqual({
+      code: 'policy_violation',
+      violations: [
+        { rule: 'no-fork', action: 'reject', path: 'code', line: 5, column: 7, match: 'fork', message: 'call to fork is not allowed' },
+        { rule: 'no-fork', action: 'reject', path: 'code', line: 5, column: 20, match: 'system', message: 'call to system is not allowed' },
+        { rule: 'no-eval', action: 'flag', path: 'code', line: 6, column: 10, match: 'eval(', message: 'eval is discouraged' }
+      ]
+    });
+    expect(scanner.check({ language: 'python', code: 'print(eval("1"))' })).toMatchObject([{ rule: 'no-eval', action: 'flag', line: 1, column: 7 }]);
+  });
+
+  it('checks rules when the configuration is loaded', () => {
+    expect(() => parsePolicyRules([{ id: 'x', kind: 'syscall', match: 'fork' }])).toThrow('x: kind must be one of import, call, pattern');
+    expect(() => parsePolicyRules([{ id: 'x', kind: 'pattern', match: '(' }])).toThrow('x: invalid regular expression (');
+    expect(() => parsePolicyRules([{ kind: 'call', match: [] }])).toThrow('rule 1: match must be a string or a list of strings');
+    expect(parsePolicyRules([{ id: 'x', kind: 'call', match: 'fork' }])).toEqual([
+      { id: 'x', kind: 'call', match: ['fork'], languages: undefined, tenants: undefined, action: 'reject', message: undefined }
+    ]);
+  });
+});
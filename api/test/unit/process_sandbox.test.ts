@@ -0,0 +1,290 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { ProcessSandbox } from '../../src/core/process_sandbox.js';
+import { RunnerRegistry } from '../../src/core/runners.js';
+import { writeSources } from '../../src/core/run_dir.js';
+import { DEFAULT_PROCESS_SECCOMP } from '../../src/core/seccomp.js';
+import { Logger } from '../../src/util/logger.js';
+import type { MemoryWarning, SandboxRunSpec, UsageSample } from '../../src/core/types.js';
+
+// Killed orphans may linger as zombies until init reaps them, which still counts as stopped.
+function isRunning(pid: number) {
+  try {
+    process.kill(pid, 0);
+  } catch {
+    return false;
+  }
+  const stat = `/proc/${pid}/stat`;
+  return !fs.existsSync(stat) || !/^\d+ \(.*\) Z/.test(fs.readFileSync(stat, 'utf8'));
+}
+
+// SIGKILL takes effect asynchronously, so a process may linger for a moment after the run returned.
+async function stopsRunning(pid: number) {
+  const deadline = Date.now() + 2000;
+  while (isRunning(pid) && Date.now() < deadline) {
+    await new Promise((resolve) => setTimeout(resolve, 20));
+  }
+  return !isRunning(pid);
+}
+
+describe('ProcessSandbox', () => {
+  let tmpDir: string;
+  let sandbox: ProcessSandbox;
+  let registry: RunnerRegistry;
+
+  const spec = (overrides: Partial<SandboxRunSpec> = {}): SandboxRunSpec => ({
+    id: 'run_test',
+    language: 'shell',
+    mode: 'run',
+    code: 'echo hi',
+    sources: {},
+    stdin: '',
+    build: {},
+    isolation: 'container',
+    network: { mode: 'none' },
+    args: [],
+    env: {},
+    workdir: path.join(tmpDir, 'work'),
+    limits: {
+      timeout_ms: 5000,
+      kill_grace_ms: 1000,
+      memory_mb: 128,
+      cpu_ms: 5000,
+      max_output_bytes: 1024,
+      max_stdout_bytes: 1024,
+      max_stderr_bytes: 1024,
+      max_artifact_bytes: 1024,
+      max_artifact_files: 5,
+      max_artifact_file_bytes: 1024,
+      disk_mb: 1,
+      max_processes: 8,
+      max_open_files: 64,
+      core_dump_mb: 0
+    },
+    stagedFiles: [],
+    mounts: [],
+    ...overrides
+  });
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'proc-'));
+    const runnersDir = path.join(tmpDir, 'runners');
+    fs.mkdirSync(path.join(runnersDir, 'shell'), { recursive: true });
+    // Minimal entrypoint honouring the runner contract: run main.sh, write usage.json and outputs/.
+    fs.writeFileSync(
+      path.join(runnersDir, 'shell', 'entrypoint.sh'),
+      [
+        '#!/bin/sh',
+        'cat > /dev/null',
+        'mkdir -p outputs',
+        'sh main.sh > outputs/out.txt',
+        'status=$?',
+        'cat outputs/out.txt',
+        'echo \'{"wall_ms":1,"cpu_ms":3,"user_cpu_ms":2,"system_cpu_ms":1,"max_rss_mb":1,"limit_exceeded":null}\' > usage.json',
+        'exit $status'
+      ].join('\n')
+    );
+    registry = new RunnerRegistry();
+    registry.register({
+      language: 'shell',
+      image: 'unused',
+      entryFile: 'main.sh',
+      entrypoint: 'shell/entrypoint.sh',
+      extensions: ['.sh'],
+      pidsLimit: 8,
+      versionCommand: ['sh', '--version']
+    });
+    sandbox = new ProcessSandbox({ runnersDir, registry }, new Logger({ test: 'process-sandbox' }));
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('runs the entrypoint in the run directory and collects results', async () => {
+    const chunks: string[] = [];
+    const result = await sandbox.run(spec({ onOutput: (_stream, chunk) => chunks.push(chunk.toString()) }));
+    expect(result.status).toBe('succeeded');
+    expect(result.stdout.toString()).toBe('hi\n');
+    expect(chunks.join('')).toBe('hi\n');
+    expect(result.usage).toEqual({ wall_ms: 1, cpu_ms: 3, user_cpu_ms: 2, system_cpu_ms: 1, max_rss_mb: 1 });
+    expect(result.artifacts.map((artifact) => artifact.name)).toEqual(['out.txt']);
+  });
+
+  it('samples the memory of the process tree and warns at its thresholds', async () => {
+    const warnings: MemoryWarning[] = [];
+    // Half of memory_mb, held for a second; the entrypoint stub itself reports 1 MB.
+    const result = await sandbox.run(spec({
+      code: 'python3 -c "import time; block = b\'x\' * (64 * 1024 * 1024); time.sleep(1)"',
+      memoryWarnings: [90, 25],
+      onMemoryPressure: (warning) => warnings.push(warning)
+    }));
+    expect(result.status).toBe('succeeded');
+    expect(warnings.map((warning) => warning.threshold_pct)).toEqual([25]);
+    expect(warnings[0].used_mb).toBeGreaterThan(32);
+    expect(result.memory).toMatchObject({ limit_mb: 128, sampled: true, warnings });
+    expect(result.memory!.peak_mb).toBeGreaterThanOrEqual(64);
+    expect(result.usage.max_rss_mb).toBe(1);
+  });
+
+  it('samples CPU and memory at the requested interval, thinning long series', async () => {
+    const live: UsageSample[] = [];
+    // Busy for a second, holding 16 MB.
+    const result = await sandbox.run(spec({
+      code: 'python3 -c "import time; block = b\'x\' * (16 * 1024 * 1024); end = time.time() + 1\nwhile time.time() < end: pass"',
+      usageIntervalMs: 100,
+      maxUsageSamples: 4,
+      onUsageSample: (sample) => live.push(sample)
+    }));
+    expect(result.status).toBe('succeeded');
+    expect(live.length).toBeGreaterThan(5);
+    const series = result.usageSamples!;
+    // Thinned at least twice: 100 ms became 400 ms or more.
+    expect(series.interval_ms).toBeGreaterThanOrEqual(400);
+    expect(series.samples.length).toBeLessThan(5);
+    expect(series.samples[series.samples.length - 1]).toEqual(live[live.length - 1]);
+    const busy = live.slice(2);
+    expect(busy.every((sample) => sample.memory_mb >= 16 && sample.cpu_ms !== null)).toBe(true);
+    expect(Math.max(...busy.map((sample) => sample.cpu_pct ?? 0))).toBeGreaterThan(50);
+    expect(live[live.length - 1].cpu_ms!).toBeGreaterThan(live[0].cpu_ms!);
+
+    expect((await sandbox.run(spec())).usageSamples).toBeNull();
+  });
+
+  it('reports when the program of a compiled language starts', async () => {
+    const starts: number[] = [];
+    const interpreted = await sandbox.run(spec({ code: 'touch .run_started; sleep 0.3', onRunStart: () => starts.push(Date.now()) }));
+    expect(interpreted.status).toBe('succeeded');
+    expect(starts).toHaveLength(0);
+    const compiledRegistry = new RunnerRegistry();
+    compiledRegistry.register({ ...registry.require('shell'), compiled: true });
+    const compiledSandbox = new ProcessSandbox({ runnersDir: path.join(tmpDir, 'runners'), registry: compiledRegistry }, new Logger({ test: 'process-sandbox' }));
+    const compiled = await compiledSandbox.run(spec({ code: 'sleep 0.2; touch .run_started; sleep 0.3', onRunStart: () => starts.push(Date.now()) }));
+    expect(compiled.status).toBe('succeeded');
+    expect(starts).toHaveLength(1);
+  });
+
+  it('refuses to write sources through a symlink in the run directory', async () => {
+    const outside = path.join(tmpDir, 'outside');
+    fs.mkdirSync(outside);
+    fs.mkdirSync(path.join(tmpDir, 'work'), { recursive: true });
+    fs.symlinkSync(outside, path.join(tmpDir, 'work', 'pkg'));
+    await expect(sandbox.run(spec({ sources: { 'pkg/evil.sh': 'echo pwned' } }))).rejects.toThrow('pkg/evil.sh goes through a symlink');
+    expect(fs.readdirSync(outside)).toEqual([]);
+  });
+
+  it('writes sources named with two dots but none that climb out of the run directory', () => {
+    const runDir = path.join(tmpDir, 'run');
+    fs.mkdirSync(runDir);
+    writeSources(runDir, { 'a..b.py': 'x', 'notes/..hidden': 'y', '../escape.py': 'z', 'pkg/../../escape.py': 'z', '/abs.py': 'z' });
+    expect(fs.readFileSync(path.join(runDir, 'a..b.py'), 'utf8')).toBe('x');
+    expect(fs.readFileSync(path.join(runDir, 'notes', '..hidden'), 'utf8')).toBe('y');
+    expect(fs.readdirSync(runDir).sort()).toEqual(['a..b.py', 'notes']);
+    expect(fs.existsSync(path.join(tmpDir, 'escape.py'))).toBe(false);
+  });
+
+  it('maps the timeout exit code', async () => {
+    const result = await sandbox.run(spec({ code: 'exit 124' }));
+    expect(result.status).toBe('timeout');
+    expect(result.limitExceeded).toBe('wall_time');
+  });
+
+  it('kills the whole process group on cancellation', async () => {
+    const controller = new AbortController();
+    const pending = sandbox.run(spec({ code: 'sleep 30 & echo $! > bg.pid; sleep 30', signal: controller.signal }));
+    const pidFile = path.join(tmpDir, 'work', 'bg.pid');
+    while (!fs.existsSync(pidFile) || !fs.readFileSync(pidFile, 'utf8').trim()) {
+      await new Promise((resolve) => setTimeout(resolve, 20));
+    }
+    controller.abort();
+    await pending;
+    expect(await stopsRunning(Number(fs.readFileSync(pidFile, 'utf8')))).toBe(true);
+  });
+
+  it('kills programs in a session of their own on cancellation', async () => {
+    // Runners start the program with setsid so they can signal it apart from themselves.
+    const controller = new AbortController();
+    const pending = sandbox.run(spec({ code: 'setsid sh -c \'echo $$ > bg.pid; exec sleep 30\'', signal: controller.signal }));
+    const pidFile = path.join(tmpDir, 'work', 'bg.pid');
+    while (!fs.existsSync(pidFile) || !fs.readFileSync(pidFile, 'utf8').trim()) {
+      await new Promise((resolve) => setTimeout(resolve, 20));
+    }
+    controller.abort();
+    await pending;
+    expect(await stopsRunning(Number(fs.readFileSync(pidFile, 'utf8')))).toBe(true);
+  });
+
+  it('does not start runs that were canceled beforehand', async () => {
+    const controller = new AbortController();
+    controller.abort();
+    const result = await sandbox.run(spec({ signal: controller.signal }));
+    expect(result.status).toBe('canceled');
+    expect(fs.existsSync(path.join(tmpDir, 'work'))).toBe(false);
+  });
+
+  it('loads the seccomp deny-list in front of the entrypoint', async () => {
+    const filtered = new ProcessSandbox(
+      {
+        runnersDir: path.join(tmpDir, 'runners'),
+        registry,
+        seccomp: DEFAULT_PROCESS_SECCOMP,
+        seccompLauncher: path.join(process.cwd(), '..', 'runners', 'seccomp_exec.py')
+      },
+      new Logger({ test: 'process-sandbox' })
+    );
+    const code = 'python3 -c "import socket; socket.socket()" 2>&1';
+    const offline = await filtered.run(spec({ code }));
+    expect(offline.status).toBe('failed');
+    expect(offline.stdout.toString()).toContain('Operation not permitted');
+    const loopback = await filtered.run(spec({ code, network: { mode: 'loopback' } }));
+    expect(loopback.status).toBe('succeeded');
+  });
+
+  it('refuses to start confined without the host\'s mechanism', () => {
+    expect(() => new ProcessSandbox({ runnersDir: path.join(tmpDir, 'runners'), registry, confine: true }, new Logger({ test: 'process-sandbox' }))).toThrow(
+      'set DISABLE_SANDBOX_SECURITY=1 to run them unconfined'
+    );
+    expect(
+      () =>
+        new ProcessSandbox(
+          { runnersDir: path.join(tmpDir, 'runners'), registry, seccomp: DEFAULT_PROCESS_SECCOMP, confine: true },
+          new Logger({ test: 'process-sandbox' })
+        )
+    ).not.toThrow();
+  });
+
+  // Switching users needs root; unprivileged test runs skip this case.
+  (process.getuid?.() === 0 ? it : it.skip)('runs entrypoints as the configured user', async () => {
+    fs.chmodSync(tmpDir, 0o755);
+    const unprivileged = new ProcessSandbox(
+      { runnersDir: path.join(tmpDir, 'runners'), registry, runAs: { uid: 65534, gid: 65534 } },
+      new Logger({ test: 'process-sandbox' })
+    );
+    const result = await unprivileged.run(spec({ code: 'id -u; id -g' }));
+    expect(result.stdout.toString()).toBe('65534\n65534\n');
+    expect(fs.statSync(path.join(tmpDir, 'work', 'outputs', 'out.txt')).uid).toBe(65534);
+  });
+
+  it('kills runs that write more than disk_mb', async () => {
+    const result = await sandbox.run(spec({ code: 'head -c 4194304 /dev/zero > big.bin; sleep 30' }));
+    expect(result.status).toBe('killed');
+    expect(result.limitExceeded).toBe('disk');
+  });
+
+  it('keeps at most the per-stream caps of output and counts the rest', async () => {
+    const result = await sandbox.run(spec({ code: 'head -c 3000 /dev/zero | tr "\\0" a' }));
+    expect(result.status).toBe('succeeded');
+    expect(result.limitExceeded).toBe('output');
+    expect(result.stdout.length).toBe(1024);
+    expect(result.droppedBytes).toEqual({ stdout: 1976, stderr: 0 });
+    const killed = await sandbox.run(spec({ code: 'head -c 3000 /dev/zero', onOutputLimit: 'kill' }));
+    expect(killed.status).toBe('killed');
+  });
+
+  it('reports non-zero exits as failed', async () => {
+    const result = await sandbox.run(spec({ code: 'exit 3' }));
+    expect(result.status).toBe('failed');
+    expect(result.exitCode).toBe(3);
+  });
+});
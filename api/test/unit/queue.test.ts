@@ -0,0 +1,161 @@
+import { InMemoryQueue } from '../../src/core/queue.js';
+
+function deferred() {
+  let resolve!: () => void;
+  const promise = new Promise<void>((r) => {
+    resolve = r;
+  });
+  return { promise, resolve };
+}
+
+describe('InMemoryQueue', () => {
+  it('runs at most `concurrency` jobs at once', async () => {
+    const queue = new InMemoryQueue({ concurrency: 1, maxDepth: 5 });
+    const first = deferred();
+    const order: string[] = [];
+    const a = queue.enqueue(async () => {
+      order.push('a');
+      await first.promise;
+    });
+    const b = queue.enqueue(async () => {
+      order.push('b');
+    });
+    expect(queue.stats()).toMatchObject({ depth: 1, running: 1 });
+    expect(order).toEqual(['a']);
+    first.resolve();
+    await Promise.all([a.done, b.done]);
+    expect(order).toEqual(['a', 'b']);
+    expect(queue.stats()).toMatchObject({ depth: 0, running: 0 });
+  });
+
+  it('rejects jobs once the queue is full', () => {
+    const queue = new InMemoryQueue({ concurrency: 1, maxDepth: 1 });
+    const blocker = deferred();
+    queue.enqueue(() => blocker.promise);
+    queue.enqueue(async () => undefined);
+    expect(() => queue.enqueue(async () => undefined)).toThrow('execution queue is full');
+    blocker.resolve();
+  });
+
+  it('dispatches aborted jobs without waiting for a worker', async () => {
+    const queue = new InMemoryQueue({ concurrency: 1, maxDepth: 5 });
+    const blocker = deferred();
+    queue.enqueue(() => blocker.promise);
+    const controller = new AbortController();
+    const canceled = queue.enqueue(async () => controller.signal.aborted, controller.signal);
+    controller.abort();
+    await expect(canceled.done).resolves.toBe(true);
+    expect(queue.stats().depth).toBe(0);
+    blocker.resolve();
+  });
+
+  it('caps how many of one tenant\'s jobs run at once and lets other tenants through', async () => {
+    const queue = new InMemoryQueue({ concurrency: 2, maxDepth: 4 });
+    const noisy = { id: 'noisy', maxRunning: 1 };
+    const blocker = deferred();
+    const order: string[] = [];
+    const first = queue.enqueue(async () => {
+      order.push('noisy-1');
+      await blocker.promise;
+    }, undefined, noisy);
+    const second = queue.enqueue(async () => {
+      order.push('noisy-2');
+    }, undefined, noisy);
+    const other = queue.enqueue(async () => {
+      order.push('quiet');
+    }, undefined, { id: 'quiet', maxRunning: 1 });
+    await other.done;
+    expect(order).toEqual(['noisy-1', 'quiet']);
+    // Half the workers, so half the queue.
+    queue.enqueue(async () => undefined, undefined, noisy);
+    expect(() => queue.enqueue(async () => undefined, undefined, noisy)).toThrow('too many queued executions for this tenant');
+    blocker.resolve();
+    await Promise.all([first.done, second.done]);
+    expect(order).toEqual(['noisy-1', 'quiet', 'noisy-2']);
+  });
+
+  it('starts waiting jobs most urgent class first and oldest first within a class', async () => {
+    const queue = new InMemoryQueue({ concurrency: 1, maxDepth: 10 });
+    const blocker = deferred();
+    const order: string[] = [];
+    const job = (name: string) => async () => {
+      order.push(name);
+    };
+    const running = queue.enqueue(() => blocker.promise);
+    const jobs = [
+      queue.enqueue(job('regrade-1'), undefined, undefined, 'batch'),
+      queue.enqueue(job('api'), undefined, undefined),
+      queue.enqueue(job('regrade-2'), undefined, undefined, 'batch'),
+      queue.enqueue(job('ide-1'), undefined, undefined, 'interactive'),
+      queue.enqueue(job('ide-2'), undefined, undefined, 'interactive')
+    ];
+    expect(queue.stats().by_priority).toEqual({
+      interactive: { depth: 2, running: 0, reserved: 0 },
+      normal: { depth: 1, running: 1, reserved: 0 },
+      batch: { depth: 2, running: 0, reserved: 0 }
+    });
+    blocker.resolve();
+    await Promise.all([running.done, ...jobs.map((queued) => queued.done)]);
+    expect(order).toEqual(['ide-1', 'ide-2', 'api', 'regrade-1', 'regrade-2']);
+  });
+
+  it('ages waiting jobs so batch work is not starved', async () => {
+    const queue = new InMemoryQueue({ concurrency: 1, maxDepth: 10, agingMs: 30 });
+    const blocker = deferred();
+    const order: string[] = [];
+    const running = queue.enqueue(() => blocker.promise);
+    const regrade = queue.enqueue(async () => {
+      order.push('regrade');
+    }, undefined, undefined, 'batch');
+    // Two aging periods make the batch job as urgent as any interactive one, and it is older.
+    await new Promise((resolve) => setTimeout(resolve, 70));
+    const ide = queue.enqueue(async () => {
+      order.push('ide');
+    }, undefined, undefined, 'interactive');
+    blocker.resolve();
+    await Promise.all([running.done, regrade.done, ide.done]);
+    expect(order).toEqual(['regrade', 'ide']);
+  });
+
+  it('keeps reserved workers for their class', async () => {
+    const queue = new InMemoryQueue({ concurrency: 2, maxDepth: 10, reservations: { interactive: 1 } });
+    const blocker = deferred();
+    const order: string[] = [];
+    const first = queue.enqueue(async () => {
+      order.push('regrade-1');
+      await blocker.promise;
+    }, undefined, undefined, 'batch');
+    const second = queue.enqueue(async () => {
+      order.push('regrade-2');
+    }, undefined, undefined, 'batch');
+    // The second worker is held for interactive runs, however long the batch waits.
+    expect(order).toEqual(['regrade-1']);
+    const ide = queue.enqueue(async () => {
+      order.push('ide');
+    }, undefined, undefined, 'interactive');
+    await ide.done;
+    expect(order).toEqual(['regrade-1', 'ide']);
+    expect(queue.stats().by_priority.batch).toEqual({ depth: 1, running: 1, reserved: 0 });
+    blocker.resolve();
+    await Promise.all([first.done, second.done]);
+    expect(order).toEqual(['regrade-1', 'ide', 'regrade-2']);
+    expect(() => new InMemoryQueue({ concurrency: 2, maxDepth: 1, reservations: { interactive: 2, batch: 1 } })).toThrow(
+      'queue reservations exceed its concurrency'
+    );
+  });
+
+  it('tells rejected callers when to retry', () => {
+    const queue = new InMemoryQueue({ concurrency: 1, maxDepth: 0 });
+    const blocker = deferred();
+    queue.enqueue(() => blocker.promise);
+    let rejection: any;
+    try {
+      queue.enqueue(async () => undefined);
+    } catch (err) {
+      rejection = err;
+    }
+    expect(rejection.output.headers['Retry-After']).toBe('1');
+    expect(rejection.data).toMatchObject({ retry_after_ms: 1000 });
+    blocker.resolve();
+  });
+});
@@ -0,0 +1,109 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { ReadinessProbe } from '../../src/core/readiness.js';
+import { RunnerRegistry, createDefaultRegistry } from '../../src/core/runners.js';
+import { Logger } from '../../src/util/logger.js';
+import type { SandboxResult, SandboxRunSpec, SandboxRunner } from '../../src/core/types.js';
+
+describe('ReadinessProbe', () => {
+  let tmpDir: string;
+  let specs: SandboxRunSpec[];
+  let broken: Set<string>;
+  const logger = new Logger({ test: 'readiness' });
+
+  // Echoes the probe's expected output unless its language is broken, like a missing compiler.
+  const sandbox: SandboxRunner = {
+    async run(spec) {
+      specs.push(spec);
+      expect(fs.existsSync(path.join(spec.workdir, 'outputs'))).toBe(true);
+      const ok = !broken.has(spec.language);
+      return {
+        status: ok ? 'succeeded' : 'failed',
+        exitCode: ok ? 0 : 127,
+        stdout: Buffer.from(ok ? 'status\nok\n' : ''),
+        stderr: Buffer.from(ok ? '' : 'javac: not found\n'),
+        usage: { wall_ms: 1, cpu_ms: 1, memory_peak_mb: 1 },
+        artifacts: []
+      } as SandboxResult;
+    }
+  };
+
+  const registry = () => {
+    const runners = new RunnerRegistry();
+    runners.register({ language: 'python', image: 'runner-python', entryFile: 'main.py', extensions: ['.py'], pidsLimit: 32, versionCommand: [], probe: 'print("ok")' });
+    runners.register({ language: 'java', image: 'runner-java', entryFile: 'Main.java', extensions: ['.java'], pidsLimit: 256, versionCommand: [], probe: 'class Main {}' });
+    runners.register({ language: 'wasm', image: '', entryFile: 'main.wasm', extensions: ['.wasm'], pidsLimit: 1, versionCommand: [], isolation: ['wasm'], probe: 'AGFzbQEAAAA=' });
+    runners.register({ language: 'lua', image: 'runner-lua', entryFile: 'main.lua', extensions: ['.lua'], pidsLimit: 32, versionCommand: [] });
+    return runners;
+  };
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'readiness-'));
+    specs = [];
+    broken = new Set();
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('is ready once every runner with a probe compiled and ran it', async () => {
+    const probe = new ReadinessProbe({ sandbox, registry: registry(), workRoot: tmpDir, defaultIsolation: 'gvisor' }, logger);
+    expect(probe.report()).toEqual({ ready: false, runners: {} });
+    const report = await probe.probeAll();
+    expect(report.ready).toBe(true);
+    expect(Object.keys(report.runners)).toEqual(['python', 'java', 'wasm']);
+    expect(report.runners.python).toMatchObject({ ready: true, error: null });
+    expect(specs.map((spec) => [spec.language, spec.isolation, spec.limits.max_processes])).toEqual([
+      ['python', 'gvisor', 32],
+      ['java', 'gvisor', 256],
+      ['wasm', 'wasm', 1]
+    ]);
+    expect(specs[0]).toMatchObject({ mode: 'run', code: 'print("ok")', network: { mode: 'none' }, limits: { timeout_ms: 10000 } });
+    expect(specs[0].id).toMatch(/^probe_python_[0-9a-f]{12}$/);
+    // Probe work directories are removed once the probe is done.
+    await new Promise((resolve) => setTimeout(resolve, 20));
+    expect(fs.readdirSync(tmpDir)).toEqual([]);
+  });
+
+  it('reports the runner whose toolchain is missing until a later probe passes', async () => {
+    broken.add('java');
+    const probe = new ReadinessProbe(
+      { sandbox, registry: registry(), workRoot: tmpDir, include: (runner) => runner.language !== 'wasm' },
+      logger
+    );
+    const report = await probe.probeAll();
+    expect(report.ready).toBe(false);
+    expect(report.runners.java).toMatchObject({ ready: false, error: 'probe failed with exit code 127: javac: not found' });
+    expect(report.runners.python.ready).toBe(true);
+    expect(report.runners.wasm).toBeUndefined();
+    broken.clear();
+    expect((await probe.probeAll()).ready).toBe(true);
+  });
+
+  it('fails probes that print something other than ok or throw', async () => {
+    const probe = new ReadinessProbe(
+      {
+        sandbox: {
+          run: async (spec) => {
+            if (spec.language === 'java') {
+              throw new Error('docker: image not found');
+            }
+            return { status: 'succeeded', exitCode: 0, stdout: Buffer.from('hello\n'), stderr: Buffer.alloc(0), usage: { wall_ms: 1, cpu_ms: 1, memory_peak_mb: 1 }, artifacts: [] } as SandboxResult;
+          }
+        },
+        registry: registry(),
+        workRoot: tmpDir
+      },
+      logger
+    );
+    const report = await probe.probeAll();
+    expect(report.runners.python.error).toBe('probe printed "hello" instead of "ok"');
+    expect(report.runners.java.error).toBe('docker: image not found');
+  });
+
+  it('has a probe program for every builtin runner', () => {
+    expect(createDefaultRegistry().list().filter((runner) => !runner.probe)).toEqual([]);
+  });
+});
@@ -0,0 +1,32 @@
+import { reproducibleEnvironment, validateReproducible } from '../../src/core/reproducible.js';
+import { RunnerRegistry, registerBuiltinRunners } from '../../src/core/runners.js';
+
+describe('reproducible runs', () => {
+  const registry = new RunnerRegistry();
+  registerBuiltinRunners(registry);
+
+  it('passes the clock in libfaketime format and the seed as it is', () => {
+    expect(reproducibleEnvironment({ time: '2024-06-01T08:30:00Z', seed: 0 })).toEqual({
+      EXECUTOR_FAKE_TIME: '@2024-06-01 08:30:00',
+      EXECUTOR_RANDOM_SEED: '0'
+    });
+    expect(reproducibleEnvironment({ time: '2024-06-01T08:30:00.750-02:00', freeze_time: true })).toEqual({
+      EXECUTOR_FAKE_TIME: '2024-06-01 10:30:00'
+    });
+    expect(reproducibleEnvironment(undefined)).toEqual({});
+  });
+
+  it('accepts only what the language can hold still', () => {
+    const python = registry.require('python');
+    validateReproducible(python, { reproducible: { time: '2024-01-01', freeze_time: true, seed: 4294967295 } });
+    expect(() => validateReproducible(python, { reproducible: {} })).toThrow('reproducible needs a time, a seed or both');
+    expect(() => validateReproducible(python, { reproducible: { time: 'yesterday' } })).toThrow('reproducible.time must be an ISO 8601 time');
+    expect(() => validateReproducible(python, { reproducible: { seed: 1.5 } })).toThrow('reproducible.seed must be an integer');
+    expect(() => validateReproducible(python, { reproducible: { seed: 1, freeze_time: true } })).toThrow('freeze_time requires reproducible.time');
+    expect(() => validateReproducible(registry.require('java'), { reproducible: { seed: 1 } })).toThrow('a random seed is not supported for java');
+    validateReproducible(registry.require('java'), { reproducible: { time: '2024-01-01T00:00:00Z' } });
+    expect(() => validateReproducible(registry.require('c'), { reproducible: { time: '2024-01-01' }, isolation: 'wasm' })).toThrow(
+      'not available with wasm isolation'
+    );
+  });
+});
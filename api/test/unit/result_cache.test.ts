@@ -0,0 +1,44 @@
+import { ResultCache } from '../../src/core/result_cache.js';
+import { DEFAULT_LIMITS } from '../../src/core/limits.js';
+import type { RunRecord, RunRequest } from '../../src/core/types.js';
+
+function run(id: string, overrides: Partial<RunRecord> = {}): RunRecord {
+  return { id, status: 'succeeded', stdout: id, artifacts: [], cached_from: null, ...overrides } as RunRecord;
+}
+
+describe('ResultCache', () => {
+  const request: RunRequest = { language: 'python', code: 'print(1)', stdin: '', env: { A: '1', B: '2' } };
+  const key = (cache: ResultCache, overrides: Partial<RunRequest> = {}, files: Array<{ path: string; sha256: string }> = []) =>
+    cache.key({ request: { ...request, ...overrides }, limits: DEFAULT_LIMITS, isolation: 'container', files });
+
+  it('keys runs by everything that decides their output', () => {
+    const cache = new ResultCache({ maxEntries: 10, ttlMs: 60000 });
+    const base = key(cache);
+    expect(key(cache, { env: { B: '2', A: '1' } })).toBe(base);
+    expect(key(cache, { stdin: 'x' })).not.toBe(base);
+    expect(key(cache, { version: '3.12' })).not.toBe(base);
+    expect(key(cache, { args: ['-v'] })).not.toBe(base);
+    expect(key(cache, { sources: { 'util.py': '' } })).not.toBe(base);
+    expect(key(cache, { profile: { cpu: true } })).not.toBe(base);
+    expect(key(cache, {}, [{ path: 'data.csv', sha256: 'a' }])).not.toBe(key(cache, {}, [{ path: 'data.csv', sha256: 'b' }]));
+    expect(cache.key({ request, limits: { ...DEFAULT_LIMITS, memory_mb: 128 }, isolation: 'container', files: [] })).not.toBe(base);
+    expect(cache.key({ request, limits: DEFAULT_LIMITS, isolation: 'gvisor', files: [] })).not.toBe(base);
+  });
+
+  it('drops the least recently used and expired results and never keeps canceled runs or artifacts', async () => {
+    const cache = new ResultCache({ maxEntries: 2, ttlMs: 30 });
+    cache.set('a', run('run_a'));
+    cache.set('b', run('run_b'));
+    expect(cache.get('a')?.id).toBe('run_a');
+    cache.set('c', run('run_c'));
+    expect(cache.get('b')).toBeNull();
+    expect(cache.get('a')?.id).toBe('run_a');
+    cache.set('d', run('run_d', { status: 'canceled' }));
+    cache.set('e', run('run_e', { artifacts: [{ name: 'plot.png' }] as RunRecord['artifacts'] }));
+    expect(cache.get('d')).toBeNull();
+    expect(cache.get('e')).toBeNull();
+    await new Promise((resolve) => setTimeout(resolve, 40));
+    expect(cache.get('a')).toBeNull();
+    expect(cache.stats()).toEqual({ entries: 1, max_entries: 2, hits: 2, misses: 4 });
+  });
+});
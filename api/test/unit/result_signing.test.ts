@@ -0,0 +1,26 @@
+import crypto from 'node:crypto';
+import { ResultSigner, verifyResult } from '../../src/core/result_signing.js';
+
+describe('ResultSigner', () => {
+  const pem = (type: 'ed25519' | 'x25519') =>
+    crypto.generateKeyPairSync(type as 'ed25519').privateKey.export({ type: 'pkcs8', format: 'pem' }).toString();
+
+  it('signs results so that any reordering verifies and any change does not', () => {
+    const signer = new ResultSigner(pem('ed25519'));
+    expect(signer.key.key_id).toMatch(/^[0-9a-f]{16}$/);
+    const result = { verdict: 'AC', passed: 2, total: 2, cases: [{ index: 0, stdout: 'ok\n' }], compile: null, signature: null };
+    const signed = { ...result, signature: signer.sign(result) };
+    expect(signed.signature).toMatchObject({ algorithm: 'ed25519', key_id: signer.key.key_id });
+    expect(verifyResult(signed, signer.key)).toBe(true);
+    const { verdict, ...rest } = signed;
+    expect(verifyResult({ ...rest, verdict }, signer.key)).toBe(true);
+    expect(verifyResult({ ...signed, verdict: 'WA' }, signer.key)).toBe(false);
+    expect(verifyResult({ ...signed, cases: [{ index: 0, stdout: 'ok' }] }, signer.key)).toBe(false);
+    expect(verifyResult(signed, new ResultSigner(pem('ed25519')).key)).toBe(false);
+    expect(verifyResult(result, signer.key)).toBe(false);
+  });
+
+  it('only takes Ed25519 keys', () => {
+    expect(() => new ResultSigner(pem('x25519'))).toThrow('result signing key must be an Ed25519 private key, not x25519');
+  });
+});
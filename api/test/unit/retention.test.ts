@@ -0,0 +1,93 @@
+import crypto from 'node:crypto';
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { FilesystemObjectStore } from '../../src/core/object_store.js';
+import { ResultSigner, verifyResult } from '../../src/core/result_signing.js';
+import { RetentionSweeper } from '../../src/core/retention.js';
+import type { RetentionAction } from '../../src/core/retention.js';
+import { RunStore } from '../../src/core/run_store.js';
+import { ArtifactStorage } from '../../src/core/storage.js';
+import type { RunRecord } from '../../src/core/types.js';
+import { Logger } from '../../src/util/logger.js';
+
+describe('RetentionSweeper', () => {
+  const DAY = 24 * 3600000;
+  const logger = new Logger({ test: 'retention' });
+  let tmpDir: string;
+  let store: RunStore;
+  let storage: ArtifactStorage;
+  let archive: FilesystemObjectStore;
+
+  const sweeper = (action: RetentionAction, signer?: ResultSigner) =>
+    new RetentionSweeper({ maxAgeMs: DAY, action, archive, store, artifacts: storage, signer, batchSize: 1 }, logger);
+
+  // A finished run with one artifact in the storage directory.
+  const finishRun = async (id: string) => {
+    const source = path.join(tmpDir, `${id}.txt`);
+    fs.writeFileSync(source, `output of ${id}`);
+    const artifact = await storage.storeArtifact(source, 'out.txt', { contentType: 'text/plain' });
+    await store.saveSubmission({
+      id,
+      api_key: 'dev',
+      language: 'python',
+      request: { language: 'python', code: 'print(1)' },
+      created_at: new Date().toISOString()
+    });
+    await store.appendEvent(id, { seq: 0, type: 'submitted', at: new Date().toISOString(), data: {} });
+    await store.save({ id, status: 'succeeded', language: 'python', artifacts: [artifact], signature: null } as unknown as RunRecord);
+    return artifact;
+  };
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'retention-'));
+    store = new RunStore();
+    storage = new ArtifactStorage({ baseDir: tmpDir, baseUrl: 'http://localhost:8080', signingKey: 'key', urlTtlSeconds: 600 });
+    archive = new FilesystemObjectStore(path.join(tmpDir, 'archive'), () => '');
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('archives expired executions with their artifacts and restores them on demand', async () => {
+    const artifact = await finishRun('run_a');
+    await finishRun('run_b');
+    const { privateKey } = crypto.generateKeyPairSync('ed25519');
+    const signer = new ResultSigner(privateKey.export({ type: 'pkcs8', format: 'pem' }).toString());
+    const retention = sweeper('archive', signer);
+
+    expect(await retention.sweep(Date.now())).toEqual({ archived: 0, deleted: 0, failed: 0 });
+    // Batches of one continue until the store has nothing left to expire.
+    expect(await retention.sweep(Date.now() + 2 * DAY)).toEqual({ archived: 2, deleted: 0, failed: 0 });
+    expect(await store.get('run_a')).toBeNull();
+    expect(await store.listEvents('run_a')).toEqual([]);
+    const fileId = /\/v1\/files\/([^?]+)/.exec(artifact.url)?.[1] as string;
+    expect(() => storage.resolveArtifact(fileId)).toThrow('artifact not found');
+    expect(await retention.isArchived('run_a')).toBe(true);
+
+    expect(await retention.restore('run_a')).toBe(true);
+    const restored = await store.get('run_a');
+    expect(restored?.artifacts).toMatchObject([{ name: 'out.txt', sha256: artifact.sha256 }]);
+    expect(fs.readFileSync(storage.resolveArtifact(fileId).path, 'utf8')).toBe('output of run_a');
+    expect(verifyResult(restored as RunRecord, signer.key)).toBe(true);
+    expect((await store.getSubmission('run_a'))?.api_key).toBe('dev');
+    expect(await store.listEvents('run_a')).toHaveLength(1);
+    expect(await retention.isArchived('run_a')).toBe(false);
+    expect(await retention.restore('run_a')).toBe(false);
+    // Restoring starts the retention period over.
+    expect(await retention.sweep(Date.now() + DAY / 2)).toEqual({ archived: 0, deleted: 0, failed: 0 });
+    expect(retention.stats()).toMatchObject({ sweeps: 3, archived: 2, restored: 1, failed: 0 });
+  });
+
+  it('deletes expired executions outright when asked to', async () => {
+    const artifact = await finishRun('run_a');
+    await store.saveError('run_e', 'sandbox failed');
+    const retention = sweeper('delete');
+    expect(await retention.sweep(Date.now() + 2 * DAY)).toEqual({ archived: 0, deleted: 2, failed: 0 });
+    expect(await store.get('run_a')).toBeNull();
+    expect(await store.getError('run_e')).toBeNull();
+    expect(() => storage.resolveArtifact(/\/v1\/files\/([^?]+)/.exec(artifact.url)?.[1] as string)).toThrow('artifact not found');
+    expect(await retention.isArchived('run_a')).toBe(false);
+  });
+});
@@ -0,0 +1,56 @@
+import { RunnerRegistry, createDefaultRegistry } from '../../src/core/runners.js';
+
+describe('RunnerRegistry', () => {
+  it('registers the builtin languages', () => {
+    const registry = createDefaultRegistry();
+    expect(registry.list().map((runner) => runner.language)).toEqual(['python', 'node', 'typescript', 'ruby', 'php', 'go', 'rust', 'java', 'kotlin', 'c', 'cpp', 'bash', 'sh', 'sql', 'wasm']);
+    expect(registry.forExtension('.sh')).toMatchObject({ language: 'bash', entryFile: 'main.sh', noexecTmp: true });
+    expect(registry.require('sh').image).toBe(registry.require('bash').image);
+    expect(registry.forExtension('.go')?.entryFile).toBe('main.go');
+    expect(registry.forExtension('.ts')).toMatchObject({ language: 'typescript', image: registry.require('node').image, compiled: true });
+  });
+
+  it('shares one module cache between Go manifests and applies deployment settings', () => {
+    const registry = createDefaultRegistry();
+    expect(registry.require('go')).toMatchObject({ dependencyFile: 'go.mod', dependencyLockFiles: ['go.sum'], sharedDependencies: true });
+    registry.configure('go', { settings: { proxy: 'https://goproxy.example.com' }, offlineDependencies: true });
+    expect(registry.require('go')).toMatchObject({
+      language: 'go',
+      entryFile: 'main.go',
+      settings: { proxy: 'https://goproxy.example.com' },
+      offlineDependencies: true
+    });
+    expect(() => registry.configure('cobol', {})).toThrow('unsupported language');
+  });
+
+  it('hides disabled runners until they are enabled again', () => {
+    const registry = createDefaultRegistry();
+    registry.setEnabled('ruby', false);
+    expect(registry.get('ruby')).toBeNull();
+    expect(() => registry.require('ruby')).toThrow('unsupported language');
+    expect(registry.forExtension('.rb')).toBeNull();
+    expect(registry.list().map((runner) => runner.language)).not.toContain('ruby');
+    expect(registry.all().map((runner) => runner.language)).toContain('ruby');
+    // Deployment settings still reach a disabled runner.
+    registry.configure('ruby', { settings: { gems: 'none' } });
+    registry.setEnabled('ruby', true);
+    expect(registry.require('ruby').settings).toEqual({ gems: 'none' });
+    expect(() => registry.setEnabled('cobol', false)).toThrow('no runner for cobol');
+  });
+
+  it('accepts third-party runners and rejects duplicates', () => {
+    const registry = new RunnerRegistry();
+    const definition = {
+      language: 'lua',
+      image: 'example/lua-runner:latest',
+      entryFile: 'main.lua',
+      extensions: ['.lua'],
+      pidsLimit: 32,
+      versionCommand: ['lua', '-v']
+    };
+    registry.register(definition);
+    expect(registry.require('lua').image).toBe('example/lua-runner:latest');
+    expect(() => registry.register(definition)).toThrow('runner already registered: lua');
+    expect(() => registry.require('cobol')).toThrow('unsupported language');
+  });
+});
@@ -0,0 +1,58 @@
+import { RuntimeSettings } from '../../src/core/runtime_settings.js';
+import { DEFAULT_LIMITS, MAX_LIMITS, mergeLimits } from '../../src/core/limits.js';
+import type { LimitPolicy } from '../../src/core/limits.js';
+import { RunStore } from '../../src/core/run_store.js';
+import { createDefaultRegistry } from '../../src/core/runners.js';
+import { Logger } from '../../src/util/logger.js';
+
+describe('RuntimeSettings', () => {
+  const logger = new Logger({ test: 'runtime-settings' });
+  const open = (store: RunStore, policy: LimitPolicy) => {
+    const registry = createDefaultRegistry();
+    // As languages.enabled leaves it out.
+    registry.setEnabled('php', false);
+    return { registry, settings: new RuntimeSettings({ registry, store, limits: policy }, logger) };
+  };
+
+  it('switches languages on and off and keeps the change for the next start', async () => {
+    const store = new RunStore();
+    const { registry, settings } = open(store, { defaults: { ...DEFAULT_LIMITS }, max: { ...MAX_LIMITS } });
+    await settings.refresh();
+    await settings.setEnabled('ruby', false);
+    await settings.setEnabled('php', true);
+    expect(registry.get('ruby')).toBeNull();
+    expect(registry.get('php')).not.toBeNull();
+    expect(settings.overrides().languages).toEqual({ ruby: { enabled: false }, php: { enabled: true } });
+    // Back to what the configuration says, so nothing is left to override.
+    await settings.setEnabled('ruby', true);
+    expect(settings.overrides().languages).toEqual({ php: { enabled: true } });
+
+    const restarted = open(store, { defaults: { ...DEFAULT_LIMITS }, max: { ...MAX_LIMITS } });
+    await restarted.settings.refresh();
+    expect(restarted.registry.get('php')).not.toBeNull();
+    await expect(settings.setEnabled('cobol', true)).rejects.toMatchObject({ output: { statusCode: 404 } });
+  });
+
+  it('changes the limits runs get in place and refuses defaults above the maxima', async () => {
+    const policy: LimitPolicy = { defaults: { ...DEFAULT_LIMITS }, max: { ...MAX_LIMITS } };
+    const { settings } = open(new RunStore(), policy);
+    await settings.refresh();
+    await settings.updateLimits({ defaults: { timeout_ms: 8000 }, max: { memory_mb: 1024 } });
+    expect(mergeLimits(undefined, { policy })).toMatchObject({ timeout_ms: 8000 });
+    expect(mergeLimits({ memory_mb: 1024 }, { policy }).memory_mb).toBe(1024);
+
+    await expect(settings.updateLimits({ defaults: { timeout_ms: 20000 } })).rejects.toMatchObject({
+      message: 'defaults.timeout_ms exceeds maximum of 10000',
+      data: { code: 'limit_exceeds_maximum' }
+    });
+    await expect(settings.updateLimits({ max: { wall_ms: 5 } } as never)).rejects.toMatchObject({ message: 'unknown limit wall_ms' });
+    await expect(settings.updateLimits({ defaults: { memory_mb: -1 } })).rejects.toMatchObject({
+      message: 'defaults.memory_mb must be a positive integer or null'
+    });
+    expect(policy.defaults.timeout_ms).toBe(8000);
+
+    await settings.updateLimits({ defaults: { timeout_ms: null } });
+    expect(policy.defaults.timeout_ms).toBe(DEFAULT_LIMITS.timeout_ms);
+    expect(settings.overrides().limits).toEqual({ defaults: {}, max: { memory_mb: 1024 } });
+  });
+});
@@ -0,0 +1,151 @@
+import { RunStore } from '../../src/core/run_store.js';
+import { Scheduler } from '../../src/core/scheduler.js';
+import type { SchedulerOptions } from '../../src/core/scheduler.js';
+import type { RunRecord, RunRequest } from '../../src/core/types.js';
+import type { WebhookDispatcher, WebhookEvent } from '../../src/core/webhooks.js';
+import { Logger } from '../../src/util/logger.js';
+
+describe('Scheduler', () => {
+  const MINUTE = 60000;
+  const logger = new Logger({ test: 'scheduler' });
+  let store: RunStore;
+  let started: string[];
+  let finish: Map<string, (status: RunRecord['status']) => void>;
+  let delivered: WebhookEvent[];
+  let revoked: Set<string>;
+
+  // Runs stay in flight until the test finishes them.
+  const orchestrator: SchedulerOptions['orchestrator'] = {
+    checkRequest: (request: RunRequest) => {
+      if (request.language !== 'python') {
+        throw new Error(`unsupported language: ${request.language}`);
+      }
+    },
+    startRun: (request, apiKey) => {
+      const id = `run_${started.length + 1}`;
+      started.push(id);
+      void store.saveSubmission({ id, api_key: apiKey, language: request.language!, request, created_at: new Date().toISOString() });
+      const done = new Promise<RunRecord>((resolve) => {
+        finish.set(id, (status) => {
+          const run = { id, status, artifacts: [] } as unknown as RunRecord;
+          void store.save(run).then(() => resolve(run));
+        });
+      });
+      return { id, done };
+    },
+    getActiveRun: () => null
+  } as SchedulerOptions['orchestrator'];
+
+  const webhooks = {
+    validateUrl: (value: unknown) => String(value),
+    deliver: async (_url: string, event: WebhookEvent) => {
+      delivered.push(event);
+      return true;
+    }
+  } as unknown as WebhookDispatcher;
+
+  const scheduler = () => new Scheduler({
+    store,
+    orchestrator,
+    keyPolicy: { policy: (apiKey) => (revoked.has(apiKey) ? undefined : { label: 'dev', rateLimitRps: 5, burst: 10 }) },
+    webhooks,
+    maxPerKey: 2,
+    historyLimit: 10
+  }, logger);
+
+  const create = (target: Scheduler, fields: Record<string, unknown> = {}) =>
+    target.create('dev', { name: 'nightly', cron: '*/5 * * * *', request: { language: 'python', code: 'print(1)' }, ...fields });
+
+  // Lets the runs' completions and the notifications they trigger go through.
+  const settle = () => new Promise((resolve) => setTimeout(resolve, 10));
+
+  beforeEach(() => {
+    store = new RunStore();
+    started = [];
+    finish = new Map();
+    delivered = [];
+    revoked = new Set();
+  });
+
+  it('starts due occurrences once and records them in the history', async () => {
+    const target = scheduler();
+    const schedule = await create(target, { notify: { url: 'https://hooks.example.com/nightly', on: ['succeeded'] } });
+    const due = Date.parse(schedule.next_run_at);
+    expect(await target.tick(due - 1)).toEqual({ started: 0, skipped: 0, queued: 0, failed: 0 });
+    // A second server on the same store finds nothing left to start.
+    const [first, second] = await Promise.all([target.tick(due), scheduler().tick(due)]);
+    expect(first.started + second.started).toBe(1);
+    expect(started).toEqual(['run_1']);
+    const stored = await target.get('dev', schedule.id);
+    expect(stored.last_execution_id).toBe('run_1');
+    expect(Date.parse(stored.next_run_at)).toBe(due + 5 * MINUTE);
+
+    expect((await target.history('dev', schedule.id, 10))[0]).toMatchObject({ outcome: 'started', execution_id: 'run_1', status: 'running' });
+    finish.get('run_1')!('succeeded');
+    await settle();
+    expect((await target.history('dev', schedule.id, 10))[0].status).toBe('succeeded');
+    expect(delivered.map((event) => [event.type, event.id])).toEqual([['schedule.succeeded', schedule.id]]);
+  });
+
+  it('skips occurrences while the previous one runs, or queues one of them', async () => {
+    const target = scheduler();
+    const skipping = await create(target, { notify: { url: 'https://hooks.example.com/s' } });
+    const queueing = await create(target, { name: 'queued', overlap: 'queue' });
+    const due = Date.parse(skipping.next_run_at);
+    await target.tick(due);
+    expect(started).toEqual(['run_1', 'run_2']);
+
+    expect(await target.tick(due + 5 * MINUTE)).toEqual({ started: 0, skipped: 1, queued: 1, failed: 0 });
+    // Only one occurrence waits; the next is skipped.
+    expect(await target.tick(due + 10 * MINUTE)).toEqual({ started: 0, skipped: 2, queued: 0, failed: 0 });
+    finish.get('run_1')!('failed');
+    finish.get('run_2')!('succeeded');
+    await settle();
+    expect(await target.tick(due + 11 * MINUTE)).toEqual({ started: 1, skipped: 0, queued: 0, failed: 0 });
+    expect(started).toEqual(['run_1', 'run_2', 'run_3']);
+
+    const history = await target.history('dev', queueing.id, 10);
+    expect(history.map((run) => [run.outcome, run.scheduled_at])).toEqual([
+      ['started', new Date(due + 5 * MINUTE).toISOString()],
+      ['skipped', new Date(due + 10 * MINUTE).toISOString()],
+      ['queued', new Date(due + 5 * MINUTE).toISOString()],
+      ['started', new Date(due).toISOString()]
+    ]);
+    expect(delivered.map((event) => event.type)).toEqual(['schedule.skipped', 'schedule.skipped', 'schedule.failed']);
+    expect(target.stats().occurrences).toEqual({ started: 3, skipped: 3, queued: 1, failed: 0 });
+  });
+
+  it('fails occurrences of revoked keys and collapses missed ones', async () => {
+    const target = scheduler();
+    const schedule = await create(target);
+    const due = Date.parse(schedule.next_run_at);
+    revoked.add('dev');
+    // An hour of missed occurrences is one.
+    expect(await target.tick(due + 60 * MINUTE)).toEqual({ started: 0, skipped: 0, queued: 0, failed: 1 });
+    expect(started).toEqual([]);
+    const [failed] = await target.history('dev', schedule.id, 10);
+    expect(failed).toMatchObject({ outcome: 'failed', execution_id: null, error: 'the api key of the schedule was revoked' });
+    expect(Date.parse((await target.get('dev', schedule.id)).next_run_at)).toBe(due + 65 * MINUTE);
+  });
+
+  it('validates schedules and keeps them to their key', async () => {
+    const target = scheduler();
+    await expect(create(target, { cron: '0 25 * * *' })).rejects.toThrow('cron hour must be from 0 to 23, got 25');
+    await expect(create(target, { request: { language: 'cobol' } })).rejects.toThrow('unsupported language: cobol');
+    await expect(create(target, { overlap: 'always' })).rejects.toThrow('overlap must be one of skip, queue');
+    await expect(create(target, { notify: { url: 'https://x.test', on: ['done'] } })).rejects.toThrow('notify.on must list some of');
+    await expect(create(target, { name: '' })).rejects.toThrow('name must be a non-empty string');
+    const schedule = await create(target);
+    await create(target, { name: 'second' });
+    await expect(create(target)).rejects.toThrow('an api key can have at most 2 schedules');
+
+    await expect(target.get('other', schedule.id)).rejects.toThrow('schedule not found');
+    await expect(target.update('dev', schedule.id, { request: { language: 'python' } })).rejects.toThrow('request cannot be changed');
+    const disabled = await target.update('dev', schedule.id, { enabled: false, cron: '@daily' });
+    expect(disabled).toMatchObject({ enabled: false, cron: '@daily', revision: 2 });
+    await target.tick(Date.parse(disabled.next_run_at));
+    expect(await target.history('dev', schedule.id, 10)).toEqual([]);
+    await target.delete('dev', schedule.id);
+    expect((await target.list('dev')).map((listed) => listed.name)).toEqual(['second']);
+  });
+});
@@ -0,0 +1,47 @@
+import { SCHEMA_VERSION, checkRequestVersion, decodeRunRecord } from '../../src/core/schema.js';
+
+describe('checkRequestVersion', () => {
+  it('accepts requests without a version or with a supported one', () => {
+    expect(() => checkRequestVersion({ language: 'python', code: 'print(1)' })).not.toThrow();
+    expect(() => checkRequestVersion({ language: 'python', code: 'print(1)', schema_version: SCHEMA_VERSION })).not.toThrow();
+  });
+
+  it('refuses versions newer than the server speaks', () => {
+    expect(() => checkRequestVersion({ language: 'python', schema_version: SCHEMA_VERSION + 1 })).toThrow('is not supported');
+  });
+
+  it('rejects versions that are not positive integers', () => {
+    for (const version of [0, 1.5, '1'] as unknown[]) {
+      expect(() => checkRequestVersion({ language: 'python', schema_version: version as number })).toThrow('positive integer');
+    }
+  });
+});
+
+describe('decodeRunRecord', () => {
+  it('keeps fields it does not know and the version that wrote them', () => {
+    const run = decodeRunRecord({ schema_version: SCHEMA_VERSION + 1, id: 'run_1', status: 'succeeded', energy_mj: 12 });
+    expect(run.schema_version).toBe(SCHEMA_VERSION + 1);
+    expect((run as unknown as Record<string, unknown>).energy_mj).toBe(12);
+    expect(run.results).toBeNull();
+  });
+
+  it('does not override fields the record has', () => {
+    const run = decodeRunRecord({ id: 'run_1', timeout: { stage: 'soft', grace_ms: 5, stdout_bytes: 0, stderr_bytes: 0, flushed_bytes: 0 } });
+    expect(run.timeout?.stage).toBe('soft');
+  });
+
+  it('works out why runs from before termination was recorded ended', () => {
+    const limits = { timeout_ms: 5000, memory_mb: 256 };
+    expect(decodeRunRecord({ id: 'run_1', status: 'oom', exit_code: 137, limit_exceeded: 'memory', limits }).termination).toEqual({
+      verdict: 'memory_limit',
+      signal: null,
+      explanation: "The program ran out of memory: it went over its 256 MB and was killed by the kernel's OOM killer."
+    });
+    expect(decodeRunRecord({ id: 'run_2', status: 'failed', exit_code: 139, limits }).termination.verdict).toBe('exited_nonzero');
+  });
+
+  it('rejects anything but a JSON object', () => {
+    expect(() => decodeRunRecord([])).toThrow('JSON object');
+    expect(() => decodeRunRecord(null)).toThrow('JSON object');
+  });
+});
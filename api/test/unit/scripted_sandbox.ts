@@ -0,0 +1,55 @@
+import path from 'node:path';
+import { Orchestrator } from '../../src/core/orchestrator.js';
+import type { OrchestratorOptions } from '../../src/core/orchestrator.js';
+import { ArtifactStorage } from '../../src/core/storage.js';
+import { Logger } from '../../src/util/logger.js';
+import type { SandboxRunner, SandboxRunSpec, SandboxResult } from '../../src/core/types.js';
+
+// How a scripted run turns out, over a run that succeeded in 5 ms with 2 ms of CPU and 8 MB.
+// `count` is the number of runs so far, this one included.
+export type Script = (spec: SandboxRunSpec, count: number) => Partial<SandboxResult> | Promise<Partial<SandboxResult>>;
+
+// Runs nothing: records each spec and answers it from the script, for tests of what drives many
+// runs through an orchestrator. Go runs report a 50 ms build first, which fails for code
+// containing `syntax error` without the script being asked.
+export class ScriptedSandbox implements SandboxRunner {
+  public readonly specs: SandboxRunSpec[] = [];
+
+  constructor(private readonly script: Script) {}
+
+  async run(spec: SandboxRunSpec): Promise<SandboxResult> {
+    this.specs.push(spec);
+    const compile =
+      spec.language === 'go' ? { exit_code: spec.code.includes('syntax error') ? 1 : 0, stdout: '', stderr: '', duration_ms: 50 } : null;
+    const result: SandboxResult = {
+      status: 'succeeded',
+      exitCode: 0,
+      limitExceeded: null,
+      stdout: Buffer.alloc(0),
+      stderr: Buffer.alloc(0),
+      usage: { wall_ms: 5, cpu_ms: 2, max_rss_mb: 8 },
+      artifacts: [],
+      compile
+    };
+    if (compile?.exit_code) {
+      return { ...result, status: 'failed', exitCode: 1 };
+    }
+    return { ...result, ...(await this.script(spec, this.specs.length)) };
+  }
+}
+
+// An orchestrator running `sandbox`, with its work root and artifact storage under tmpDir.
+export function scriptedOrchestrator(tmpDir: string, sandbox: SandboxRunner, overrides: Partial<OrchestratorOptions> = {}) {
+  return new Orchestrator({
+    workRoot: path.join(tmpDir, 'sandbox'),
+    artifactStorage: new ArtifactStorage({
+      baseDir: path.join(tmpDir, 'storage'),
+      baseUrl: 'http://localhost:8080',
+      signingKey: 'test-key',
+      urlTtlSeconds: 600
+    }),
+    sandboxRunner: sandbox,
+    logger: new Logger({ test: 'orchestrator' }),
+    ...overrides
+  });
+}
@@ -0,0 +1,475 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { RunStore } from '../../src/core/run_store.js';
+import type { RunRecord } from '../../src/core/types.js';
+import type { ApiKeyStore, ExecutionFilter, ExecutionStore, ScheduleRecord, ScheduleStore, SettingsStore, SubmissionRecord } from '../../src/store/store.js';
+
+function record(id: string): RunRecord {
+  return {
+    schema_version: 1,
+    id,
+    status: 'succeeded',
+    exit_code: 0,
+    limit_exceeded: null,
+    timeout: null,
+    termination: { verdict: 'exited', signal: null, explanation: 'The program exited normally.' },
+    stdout: 'hi\n',
+    stderr: '',
+    truncated: false,
+    dropped_bytes: { stdout: 0, stderr: 0 },
+    phases: { compile: null, run: { exit_code: 0, stdout: 'hi\n', stderr: '', duration_ms: 12 } },
+    usage: { wall_ms: 12, cpu_ms: 4, max_rss_mb: 8 },
+    artifacts: [
+      {
+        name: 'plot.png',
+        size: 3,
+        sha256: 'abc',
+        url: 'http://localhost:8080/v1/files/file_1?sig=x',
+        expires_at: '2026-01-01T00:10:00.000Z',
+        content_type: 'image/png',
+        content: 'AAAA'
+      }
+    ],
+    artifacts_skipped: [],
+    tests: null,
+    coverage: null,
+    diagnostics: null,
+    results: null,
+    limits: {
+      timeout_ms: 5000,
+      kill_grace_ms: 1000,
+      memory_mb: 256,
+      cpu_ms: 5000,
+      max_output_bytes: 1024,
+      max_stdout_bytes: 1024,
+      max_stderr_bytes: 1024,
+      max_artifact_bytes: 1024,
+      max_artifact_files: 5,
+      max_artifact_file_bytes: 1024,
+      disk_mb: 1,
+      max_processes: 8,
+      max_open_files: 64,
+      core_dump_mb: 0
+    },
+    created_at: '2026-01-01T00:00:00.000Z',
+    queue_wait_ms: 0,
+    language: 'python',
+    detected_language: null,
+    mode: 'run',
+    isolation: 'container',
+    network: { mode: 'none' },
+    version: null,
+    toolchain: null,
+    code_sha256: 'def',
+    cached_from: null,
+    retries: [],
+    metadata: {},
+    annotations: {},
+    policy_violations: [],
+    cost: { cpu_seconds: 0.004, memory_gb_seconds: 0.0075, sandbox_seconds: 0.03, units: 0.0115 },
+    signature: null
+  };
+}
+
+// Behaviour every backend shares.
+function describeStore(name: string, open: (dir: string) => Promise<ExecutionStore & ApiKeyStore & SettingsStore & ScheduleStore>) {
+  describe(name, () => {
+    let tmpDir: string;
+    let store: ExecutionStore & ApiKeyStore & SettingsStore & ScheduleStore;
+
+    beforeEach(async () => {
+      tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'store-'));
+      store = await open(tmpDir);
+    });
+
+    afterEach(async () => {
+      await store.close();
+      fs.rmSync(tmpDir, { recursive: true, force: true });
+    });
+
+    it('stores run records without inline artifact contents', async () => {
+      await store.saveSubmission({
+        id: 'run_a',
+        api_key: 'dev',
+        language: 'python',
+        request: { language: 'python', code: 'print(1)' },
+        created_at: '2026-01-01T00:00:00.000Z'
+      });
+      expect(await store.get('run_a')).toBeNull();
+      await store.save(record('run_a'));
+      const stored = await store.get('run_a');
+      expect(stored?.stdout).toBe('hi\n');
+      const { content: _content, ...artifact } = record('run_a').artifacts[0];
+      expect(stored?.artifacts).toEqual([artifact]);
+      expect(await store.getError('run_a')).toBeNull();
+    });
+
+    it('records errors and fails unfinished submissions', async () => {
+      await store.saveError('run_b', 'sandbox failed');
+      expect(await store.getError('run_b')).toBe('sandbox failed');
+      expect(await store.get('run_b')).toBeNull();
+
+      const base = { api_key: 'dev', language: 'python', request: { language: 'python', code: 'print(1)' } };
+      await store.saveSubmission({ ...base, id: 'run_old', created_at: '2026-01-01T00:00:00.000Z' });
+      await store.saveSubmission({ ...base, id: 'run_new', created_at: '2026-01-02T00:00:00.000Z' });
+      await store.saveSubmission({ ...base, id: 'run_done', created_at: '2026-01-01T00:00:00.000Z' });
+      await store.save(record('run_done'));
+      expect(await store.failUnfinished('2026-01-01T12:00:00.000Z', 'interrupted')).toBe(1);
+      expect(await store.getError('run_old')).toBe('interrupted');
+      expect(await store.getError('run_new')).toBeNull();
+      expect(await store.getError('run_done')).toBeNull();
+    });
+
+    it('keeps issued api keys and counts submissions by key', async () => {
+      const key = {
+        id: 'key_1',
+        token_sha256: 'f00d',
+        label: 'pro',
+        rate_limit_rps: 2.5,
+        burst: 20,
+        monthly_executions: 1000,
+        max_timeout_ms: null,
+        max_memory_mb: 1024,
+        tenant: 'acme',
+        max_concurrent: 4,
+        created_at: '2026-01-01T00:00:00.000Z'
+      };
+      await store.saveApiKey(key);
+      await store.saveApiKey({ ...key, label: 'team' });
+      expect(await store.listApiKeys()).toEqual([{ ...key, label: 'team' }]);
+      expect(await store.deleteApiKey('key_1')).toBe(true);
+      expect(await store.deleteApiKey('key_1')).toBe(false);
+
+      const base = { language: 'python', request: { language: 'python', code: 'print(1)' } };
+      await store.saveSubmission({ ...base, id: 'run_1', api_key: 'a', created_at: '2025-12-31T23:59:59.000Z' });
+      await store.saveSubmission({ ...base, id: 'run_2', api_key: 'a', created_at: '2026-01-01T00:00:00.000Z' });
+      await store.saveSubmission({ ...base, id: 'run_3', api_key: 'a', created_at: '2026-01-05T00:00:00.000Z' });
+      await store.saveSubmission({ ...base, id: 'run_4', api_key: 'b', created_at: '2026-01-05T00:00:00.000Z' });
+      expect(await store.countSubmissions('2026-01-01T00:00:00.000Z')).toEqual({ a: 2, b: 1 });
+    });
+
+    it('adds up the cost of finished executions by key, tenant and day', async () => {
+      const base = { language: 'python', request: { language: 'python', code: 'print(1)' } };
+      const finish = async (id: string, submission: Partial<SubmissionRecord>, units: number) => {
+        await store.saveSubmission({ ...base, id, api_key: 'a', created_at: '2026-01-01T10:00:00.000Z', ...submission });
+        await store.save({ ...record(id), cost: { cpu_seconds: units / 2, memory_gb_seconds: units / 4, sandbox_seconds: units, units } });
+      };
+      await finish('run_1', { tenant: 'acme' }, 1);
+      await finish('run_2', { tenant: 'acme', created_at: '2026-01-02T10:00:00.000Z' }, 2);
+      await finish('run_3', { api_key: 'b', created_at: '2026-01-02T11:00:00.000Z' }, 4);
+      await finish('run_4', { created_at: '2026-02-01T00:00:00.000Z' }, 8);
+      // Unfinished and errored executions cost nothing, and neither do runs no submission owns.
+      await store.saveSubmission({ ...base, id: 'run_5', api_key: 'a', created_at: '2026-01-01T10:00:00.000Z' });
+      await store.saveSubmission({ ...base, id: 'run_6', api_key: 'a', created_at: '2026-01-01T10:00:00.000Z' });
+      await store.saveError('run_6', 'sandbox failed');
+      await store.save({ ...record('run_7'), cost: { cpu_seconds: 1, memory_gb_seconds: 1, sandbox_seconds: 1, units: 16 } });
+      const january = { since: '2026-01-01T00:00:00.000Z', until: '2026-02-01T00:00:00.000Z' };
+
+      expect(await store.sumCosts({ ...january, group_by: [] })).toEqual([
+        { executions: 3, cpu_seconds: 3.5, memory_gb_seconds: 1.75, sandbox_seconds: 7, units: 7 }
+      ]);
+      expect((await store.sumCosts({ ...january, group_by: ['tenant', 'day'] })).map(({ tenant, day, executions, units }) => [tenant, day, executions, units])).toEqual([
+        [null, '2026-01-02', 1, 4],
+        ['acme', '2026-01-01', 1, 1],
+        ['acme', '2026-01-02', 1, 2]
+      ]);
+      expect(await store.sumCosts({ ...january, api_key: 'a', group_by: ['api_key'] })).toMatchObject([{ api_key: 'a', executions: 2, units: 3 }]);
+      expect(await store.sumCosts({ ...january, tenant: 'acme', group_by: ['day'] })).toMatchObject([{ day: '2026-01-01' }, { day: '2026-01-02' }]);
+      expect(await store.sumCosts({ since: '2026-03-01T00:00:00.000Z', until: '2026-04-01T00:00:00.000Z', group_by: ['day'] })).toEqual([]);
+    });
+
+    it('keeps settings saved at runtime', async () => {
+      expect(await store.getSetting('runtime')).toBeNull();
+      const value = { disabled: ['ruby'], limits: { defaults: { timeout_ms: 3000 } } };
+      await store.saveSetting('runtime', value);
+      value.disabled.push('php');
+      await store.saveSetting('other', 1);
+      expect(await store.getSetting('runtime')).toEqual({ disabled: ['ruby'], limits: { defaults: { timeout_ms: 3000 } } });
+      await store.saveSetting('runtime', { disabled: [] });
+      expect(await store.getSetting('runtime')).toEqual({ disabled: [] });
+    });
+
+    it('finds submissions by idempotency key', async () => {
+      const base = { api_key: 'dev', language: 'python', request: { language: 'python', code: 'print(1)' } };
+      await store.saveSubmission({ ...base, id: 'run_old', created_at: '2026-01-01T00:00:00.000Z', idempotency_key: 'k' });
+      await store.saveSubmission({ ...base, id: 'run_new', created_at: '2026-01-03T00:00:00.000Z', idempotency_key: 'k' });
+      await store.saveSubmission({ ...base, id: 'run_other', created_at: '2026-01-03T00:00:00.000Z' });
+      expect(await store.findSubmission('dev', 'k', '2026-01-02T00:00:00.000Z')).toMatchObject({ id: 'run_new', request: base.request });
+      expect(await store.findSubmission('dev', 'k', '2026-01-04T00:00:00.000Z')).toBeNull();
+      expect(await store.findSubmission('someone-else', 'k', '2026-01-01T00:00:00.000Z')).toBeNull();
+    });
+
+    it('reads back submissions by ID', async () => {
+      const request = { language: 'python', code: 'print(1)', env: { A: '1' } };
+      await store.saveSubmission({ id: 'run_sub', api_key: 'dev', language: 'python', request, created_at: '2026-01-01T00:00:00.000Z' });
+      expect(await store.getSubmission('run_sub')).toMatchObject({ id: 'run_sub', api_key: 'dev', request });
+      expect(await store.getSubmission('run_unknown')).toBeNull();
+    });
+
+    it('hands requeued submissions to one claimant and keeps them from failing as interrupted', async () => {
+      const base = { api_key: 'dev', language: 'python', request: { language: 'python', code: 'print(1)' } };
+      await store.saveSubmission({ ...base, id: 'run_later', created_at: '2026-01-02T00:00:00.000Z' });
+      await store.saveSubmission({ ...base, id: 'run_first', created_at: '2026-01-01T00:00:00.000Z' });
+      await store.saveSubmission({ ...base, id: 'run_done', created_at: '2026-01-01T00:00:00.000Z' });
+      await store.save(record('run_done'));
+      for (const id of ['run_later', 'run_first', 'run_done']) {
+        await store.requeueSubmission(id);
+      }
+      expect(await store.failUnfinished('2026-01-03T00:00:00.000Z', 'interrupted')).toBe(0);
+      const claimed = await store.claimRequeued();
+      expect(claimed.map((submission) => submission.id)).toEqual(['run_first', 'run_later']);
+      expect(claimed[0]).toMatchObject({ api_key: 'dev', request: base.request, created_at: '2026-01-01T00:00:00.000Z' });
+      expect(await store.claimRequeued()).toEqual([]);
+      // Claimed submissions are unfinished again.
+      expect(await store.failUnfinished('2026-01-03T00:00:00.000Z', 'interrupted')).toBe(2);
+    });
+
+    it('keeps audit events in order per execution', async () => {
+      await store.appendEvent('run_ev', { seq: 0, type: 'submitted', at: '2026-01-01T00:00:00.000Z', data: { language: 'go' } });
+      await store.appendEvent('run_ev', { seq: 1, type: 'queued', at: '2026-01-01T00:00:00.005Z', data: { ahead: 2, running: 4 } });
+      await store.appendEvent('run_other', { seq: 0, type: 'submitted', at: '2026-01-01T00:00:01.000Z', data: {} });
+      expect(await store.listEvents('run_ev')).toEqual([
+        { seq: 0, type: 'submitted', at: '2026-01-01T00:00:00.000Z', data: { language: 'go' } },
+        { seq: 1, type: 'queued', at: '2026-01-01T00:00:00.005Z', data: { ahead: 2, running: 4 } }
+      ]);
+      expect(await store.listEvents('run_unknown')).toEqual([]);
+    });
+
+    it('pages through a key\'s executions newest first', async () => {
+      const base = { language: 'python', request: { language: 'python', code: 'print(1)' } };
+      await store.saveSubmission({ ...base, api_key: 'dev', id: 'run_1', created_at: '2026-01-01T00:00:00.000Z' });
+      await store.saveSubmission({ ...base, api_key: 'dev', id: 'run_2', created_at: '2026-01-02T00:00:00.000Z' });
+      await store.saveSubmission({ ...base, api_key: 'dev', id: 'run_3', created_at: '2026-01-02T00:00:00.000Z' });
+      await store.saveSubmission({ ...base, api_key: 'other', id: 'run_4', created_at: '2026-01-03T00:00:00.000Z' });
+      await store.save(record('run_1'));
+      await store.saveError('run_2', 'sandbox failed');
+      const first = await store.listExecutions({ api_key: 'dev' }, 2);
+      expect(first.map(({ id, status }) => [id, status])).toEqual([
+        ['run_3', 'pending'],
+        ['run_2', 'error']
+      ]);
+      expect(first[0]).toEqual({
+        id: 'run_3', language: 'python', status: 'pending', created_at: '2026-01-02T00:00:00.000Z', finished_at: null, tenant: null, tags: [], metadata: {}
+      });
+      const rest = await store.listExecutions({ api_key: 'dev' }, 2, { created_at: first[1].created_at, id: first[1].id });
+      expect(rest.map(({ id, status }) => [id, status])).toEqual([['run_1', 'succeeded']]);
+      expect(rest[0].finished_at).not.toBeNull();
+    });
+
+    it('filters listed executions by tenant, language, status, tag, metadata and creation time', async () => {
+      const submit = (id: string, fields: Partial<SubmissionRecord>, tags?: string[], metadata?: Record<string, string>) => store.saveSubmission({
+        id,
+        api_key: 'dev',
+        language: 'python',
+        request: { language: fields.language ?? 'python', code: 'x', tags, metadata },
+        created_at: '2026-01-01T00:00:00.000Z',
+        ...fields
+      });
+      await submit('run_a', { tenant: 'acme', created_at: '2026-01-01T00:00:00.000Z' }, ['course:cs101', 'hw1'], { assignment_id: 'hw1', student_id: 's1' });
+      await submit('run_b', { tenant: 'acme', language: 'go', created_at: '2026-01-02T00:00:00.000Z' }, ['hw1'], { assignment_id: 'hw1', student_id: 's2' });
+      await submit('run_c', { tenant: 'globex', api_key: 'other', created_at: '2026-01-03T00:00:00.000Z' }, ['hw2']);
+      await store.save(record('run_a'));
+      await store.saveError('run_b', 'sandbox failed');
+      const ids = async (filter: ExecutionFilter) => (await store.listExecutions(filter, 10)).map((execution) => execution.id);
+
+      expect(await ids({})).toEqual(['run_c', 'run_b', 'run_a']);
+      expect(await ids({ tenant: 'acme' })).toEqual(['run_b', 'run_a']);
+      expect(await ids({ api_key: 'dev', language: 'go' })).toEqual(['run_b']);
+      expect(await ids({ statuses: ['succeeded', 'error'] })).toEqual(['run_b', 'run_a']);
+      expect(await ids({ statuses: ['pending', 'requeued'] })).toEqual(['run_c']);
+      expect(await ids({ tag: 'hw1' })).toEqual(['run_b', 'run_a']);
+      expect(await ids({ tag: 'hw' })).toEqual([]);
+      expect(await ids({ created_after: '2026-01-02T00:00:00.000Z', created_before: '2026-01-03T00:00:00.000Z' })).toEqual(['run_b']);
+      expect(await ids({ metadata: { assignment_id: 'hw1' } })).toEqual(['run_b', 'run_a']);
+      expect(await ids({ metadata: { assignment_id: 'hw1', student_id: 's1' } })).toEqual(['run_a']);
+      expect(await ids({ metadata: { commit_sha: 'abc' } })).toEqual([]);
+      const [listed] = await store.listExecutions({ tag: 'course:cs101' }, 1);
+      expect(listed).toMatchObject({ id: 'run_a', tenant: 'acme', tags: ['course:cs101', 'hw1'], metadata: { assignment_id: 'hw1', student_id: 's1' } });
+      // Pages keep to the filter.
+      const [first] = await store.listExecutions({ tenant: 'acme' }, 1);
+      expect(await store.listExecutions({ tenant: 'acme' }, 10, first)).toMatchObject([{ id: 'run_a' }]);
+    });
+
+    it('finds executions by how much of their fingerprint they share', async () => {
+      const submit = (id: string, created_at: string, fields: Partial<SubmissionRecord> = {}, metadata?: Record<string, string>) => store.saveSubmission({
+        id,
+        api_key: 'dev',
+        language: 'python',
+        request: { language: fields.language ?? 'python', code: 'x', metadata },
+        created_at,
+        ...fields
+      });
+      await submit('run_a', '2026-01-01T00:00:00.000Z', {}, { assignment_id: 'hw1' });
+      await submit('run_b', '2026-01-02T00:00:00.000Z', {}, { assignment_id: 'hw1' });
+      await submit('run_c', '2026-01-03T00:00:00.000Z', {}, { assignment_id: 'hw2' });
+      await submit('run_go', '2026-01-04T00:00:00.000Z', { language: 'go' });
+      await submit('run_other', '2026-01-05T00:00:00.000Z', { api_key: 'other' });
+      await store.saveFingerprint('run_a', [1, 2, 3, 4]);
+      // Saving again replaces the fingerprint.
+      await store.saveFingerprint('run_b', [9]);
+      await store.saveFingerprint('run_b', [1, 2, 3, 5]);
+      await store.saveFingerprint('run_c', [1, 2, 3, 4]);
+      await store.saveFingerprint('run_go', [1, 2, 3, 4]);
+      await store.saveFingerprint('run_other', [1, 2, 3, 4]);
+      expect(await store.getFingerprint('run_b')).toEqual([1, 2, 3, 5]);
+      expect(await store.getFingerprint('run_unknown')).toEqual([]);
+
+      const query = { hashes: [1, 2, 3, 4], threshold: 0.5, exclude_id: 'run_a', filter: { api_key: 'dev', language: 'python' } };
+      const found = await store.findSimilar(query, 10);
+      expect(found.map(({ id, shared, similarity }) => [id, shared, similarity])).toEqual([['run_c', 4, 1], ['run_b', 3, 0.6]]);
+      expect(found[1]).toMatchObject({ language: 'python', status: 'pending', metadata: { assignment_id: 'hw1' }, created_at: '2026-01-02T00:00:00.000Z' });
+      expect((await store.findSimilar({ ...query, threshold: 0.8 }, 10)).map((match) => match.id)).toEqual(['run_c']);
+      expect((await store.findSimilar(query, 1)).map((match) => match.id)).toEqual(['run_c']);
+      expect((await store.findSimilar({ ...query, filter: { ...query.filter, metadata: { assignment_id: 'hw1' } } }, 10)).map((match) => match.id)).toEqual(['run_b']);
+      expect((await store.findSimilar({ ...query, filter: { api_key: 'dev' } }, 10)).map((match) => match.id)).toEqual(['run_go', 'run_c', 'run_b']);
+      expect(await store.findSimilar({ ...query, hashes: [7, 8] }, 10)).toEqual([]);
+
+      await store.deleteExecution('run_c');
+      expect(await store.getFingerprint('run_c')).toEqual([]);
+      expect((await store.findSimilar(query, 10)).map((match) => match.id)).toEqual(['run_b']);
+    });
+
+    it('lists finished executions oldest first and deletes them whole', async () => {
+      const base = { api_key: 'dev', language: 'python', request: { language: 'python', code: 'print(1)' } };
+      await store.saveSubmission({ ...base, id: 'run_pending', created_at: '2026-01-01T00:00:00.000Z' });
+      await store.saveSubmission({ ...base, id: 'run_x', created_at: '2026-01-01T00:00:00.000Z' });
+      await store.save(record('run_x'));
+      await new Promise((resolve) => setTimeout(resolve, 5));
+      await store.saveError('run_y', 'sandbox failed');
+      await store.appendEvent('run_x', { seq: 0, type: 'submitted', at: '2026-01-01T00:00:00.000Z', data: {} });
+      const later = new Date(Date.now() + 60000).toISOString();
+      expect(await store.listFinished(later, 10)).toEqual(['run_x', 'run_y']);
+      expect(await store.listFinished(later, 1)).toEqual(['run_x']);
+      expect(await store.listFinished('2026-01-01T00:00:00.000Z', 10)).toEqual([]);
+      await store.deleteExecution('run_x');
+      expect(await store.get('run_x')).toBeNull();
+      expect(await store.getSubmission('run_x')).toBeNull();
+      expect(await store.listEvents('run_x')).toEqual([]);
+      expect(await store.listFinished(later, 10)).toEqual(['run_y']);
+    });
+
+    it('saves schedules only over the revision before and keeps their latest occurrences', async () => {
+      const schedule: ScheduleRecord = {
+        id: 'sch_a',
+        api_key: 'dev',
+        name: 'nightly',
+        cron: '0 3 * * *',
+        request: { language: 'python', code: 'print(1)' },
+        overlap: 'skip',
+        notify: null,
+        enabled: true,
+        created_at: '2026-01-01T00:00:00.000Z',
+        next_run_at: '2026-01-01T03:00:00.000Z',
+        last_execution_id: null,
+        queued_at: null,
+        revision: 1
+      };
+      expect(await store.saveSchedule(schedule)).toBe(true);
+      expect(await store.saveSchedule(schedule)).toBe(false);
+      expect(await store.saveSchedule({ ...schedule, id: 'sch_b', api_key: 'other', created_at: '2026-01-02T00:00:00.000Z' })).toBe(true);
+      expect(await store.saveSchedule({ ...schedule, enabled: false, revision: 2 })).toBe(true);
+      expect(await store.saveSchedule({ ...schedule, name: 'stale', revision: 2 })).toBe(false);
+      expect(await store.getSchedule('sch_a')).toEqual({ ...schedule, enabled: false, revision: 2 });
+      expect((await store.listSchedules()).map((listed) => listed.id)).toEqual(['sch_a', 'sch_b']);
+      expect((await store.listSchedules('other')).map((listed) => listed.id)).toEqual(['sch_b']);
+
+      const occurrence = (scheduledAt: string) => ({
+        schedule_id: 'sch_a',
+        scheduled_at: scheduledAt,
+        recorded_at: scheduledAt,
+        outcome: 'skipped' as const,
+        execution_id: null,
+        error: null
+      });
+      for (const day of ['01', '02', '03']) {
+        await store.appendScheduleRun(occurrence(`2026-01-${day}T03:00:00.000Z`), 2);
+      }
+      expect((await store.listScheduleRuns('sch_a', 10)).map((run) => run.scheduled_at)).toEqual(['2026-01-03T03:00:00.000Z', '2026-01-02T03:00:00.000Z']);
+      expect(await store.listScheduleRuns('sch_a', 1)).toEqual([occurrence('2026-01-03T03:00:00.000Z')]);
+      expect(await store.deleteSchedule('sch_a')).toBe(true);
+      expect(await store.deleteSchedule('sch_a')).toBe(false);
+      expect(await store.getSchedule('sch_a')).toBeNull();
+      expect(await store.listScheduleRuns('sch_a', 10)).toEqual([]);
+    });
+  });
+}
+
+describeStore('RunStore', async () => new RunStore());
+
+// node:sqlite ships with Node 22.
+const hasSqlite = Number(process.versions.node.split('.')[0]) >= 22;
+(hasSqlite ? describe : describe.skip)('SqliteStore', () => {
+  describeStore('persistence', async (dir) => {
+    const { SqliteStore } = await import('../../src/store/sqlite.js');
+    return new SqliteStore(path.join(dir, 'executions.db'));
+  });
+
+  it('keeps executions across reopening the database', async () => {
+    const { SqliteStore } = await import('../../src/store/sqlite.js');
+    const tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'store-'));
+    const file = path.join(tmpDir, 'data', 'executions.db');
+    const first = new SqliteStore(file);
+    await first.save(record('run_c'));
+    await first.close();
+    const second = new SqliteStore(file);
+    expect((await second.get('run_c'))?.id).toBe('run_c');
+    await second.close();
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('indexes the configured metadata keys and filters through them', async () => {
+    const { SqliteStore } = await import('../../src/store/sqlite.js');
+    const { DatabaseSync } = await import('node:sqlite');
+    const tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'store-'));
+    const file = path.join(tmpDir, 'executions.db');
+    const store = new SqliteStore(file, { metadataIndexes: ['assignment_id'] });
+    await store.saveSubmission({
+      id: 'run_m',
+      api_key: 'dev',
+      language: 'python',
+      request: { language: 'python', code: 'x', metadata: { assignment_id: 'hw3' } },
+      created_at: '2026-01-01T00:00:00.000Z'
+    });
+    expect((await store.listExecutions({ metadata: { assignment_id: 'hw3' } }, 10)).map((execution) => execution.id)).toEqual(['run_m']);
+    const db = new DatabaseSync(file);
+    const plan = db
+      .prepare("EXPLAIN QUERY PLAN SELECT id FROM executions WHERE json_extract(metadata, '$.assignment_id') = ? ORDER BY created_at DESC")
+      .all('hw3') as Array<{ detail: string }>;
+    expect(plan.map((step) => step.detail).join('\n')).toContain('executions_metadata_assignment_id_created_at');
+    db.close();
+    await store.close();
+    expect(() => new SqliteStore(file, { metadataIndexes: ["x') OR 1=1 --"] })).toThrow('invalid metadata key');
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('upgrades records written before records were versioned', async () => {
+    const { SqliteStore } = await import('../../src/store/sqlite.js');
+    const { DatabaseSync } = await import('node:sqlite');
+    const tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'store-'));
+    const file = path.join(tmpDir, 'executions.db');
+    const store = new SqliteStore(file);
+    const db = new DatabaseSync(file);
+    const legacy = {
+      id: 'run_old',
+      status: 'succeeded',
+      exit_code: 0,
+      stdout: 'hi\n',
+      stderr: '',
+      usage: { wall_ms: 12, cpu_ms: 4, max_rss_mb: 8 },
+      limits: record('run_old').limits,
+      created_at: '2025-01-01T00:00:00.000Z',
+      language: 'python',
+      code_sha256: 'def'
+    };
+    db.prepare(
+      "INSERT INTO executions (id, api_key, language, status, request, record, created_at) VALUES (?, '', 'python', 'succeeded', 'null', ?, ?)"
+    ).run('run_old', JSON.stringify(legacy), legacy.created_at);
+    db.close();
+    const run = await store.get('run_old');
+    expect(run).toMatchObject({ schema_version: 1, timeout: null, truncated: false, mode: 'run', artifacts: [], diagnostics: null });
+    expect(run?.phases.run).toEqual({ exit_code: 0, stdout: 'hi\n', stderr: '', duration_ms: 12 });
+    await store.close();
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+});
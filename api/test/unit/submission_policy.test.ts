@@ -0,0 +1,95 @@
+import { SubmissionPolicy } from '../../src/core/submission_policy.js';
+import type { SourceError } from '../../src/core/submission_policy.js';
+
+// The per-file errors a rejected submission carries in its Boom data.
+function errorsOf(policy: SubmissionPolicy, request: Parameters<SubmissionPolicy['validate']>[0]): SourceError[] {
+  try {
+    policy.validate(request);
+  } catch (err) {
+    return (err as { data: { errors: SourceError[] } }).data.errors;
+  }
+  return [];
+}
+
+describe('SubmissionPolicy', () => {
+  it('accepts ordinary sources and uploads', () => {
+    const policy = new SubmissionPolicy();
+    expect(() =>
+      policy.validate({
+        code: 'print("héllo")\n',
+        sources: { 'pkg/util.py': 'x = 1\r\n\tprint(x)', 'README.md': '# notes' },
+        files: [{ id: 'file_abc', path: 'data/input.csv' }]
+      })
+    ).not.toThrow();
+  });
+
+  it('rejects paths that leave the run directory or use the runners\' names', () => {
+    const policy = new SubmissionPolicy();
+    const errors = errorsOf(policy, {
+      sources: {
+        '../evil.py': '',
+        '/etc/passwd': '',
+        'a\\b.py': '',
+        'a//b.py': '',
+        './main.py': '',
+        'bad\u0001name': '',
+        'outputs/x.py': '',
+        '.run_started': '',
+        'pkg': '',
+        'pkg/mod.py': ''
+      },
+      files: [{ id: 'file_abc', path: '../escape.txt' }]
+    });
+    expect(errors.map((error) => [error.path, error.reason])).toEqual([
+      ['../evil.py', 'invalid_path'],
+      ['/etc/passwd', 'invalid_path'],
+      ['a\\b.py', 'invalid_path'],
+      ['a//b.py', 'invalid_path'],
+      ['./main.py', 'invalid_path'],
+      ['bad\u0001name', 'invalid_path'],
+      ['outputs/x.py', 'reserved_name'],
+      ['.run_started', 'reserved_name'],
+      ['pkg', 'path_conflict'],
+      ['files[0]', 'invalid_path']
+    ]);
+    expect(() => policy.validate({ sources: { '../evil.py': '' } })).toThrow('invalid source path: ../evil.py');
+  });
+
+  it('enforces the file count and the per-file and total sizes', () => {
+    const policy = new SubmissionPolicy({ maxFiles: 2, maxBytes: 2048, maxFileBytes: 1024 });
+    expect(errorsOf(policy, { sources: { a: '', b: '', c: '' } })).toEqual([
+      { path: null, reason: 'too_many_files', message: 'sources exceeds 2 files' }
+    ]);
+    expect(errorsOf(policy, { code: 'x'.repeat(1025), sources: { a: 'x'.repeat(1000), b: 'x'.repeat(100) } })).toEqual([
+      { path: 'code', reason: 'too_large', message: 'code exceeds 1 KiB' },
+      { path: null, reason: 'total_too_large', message: 'code exceeds 2 KiB' }
+    ]);
+  });
+
+  it('rejects binary contents and text that is not valid UTF-8 unless binary is allowed', () => {
+    const request = { code: 'ok', sources: { 'blob.bin': 'a\u0000b', 'broken.txt': 'a\uD800b' } };
+    expect(errorsOf(new SubmissionPolicy(), request).map((error) => [error.path, error.reason])).toEqual([
+      ['blob.bin', 'binary'],
+      ['broken.txt', 'invalid_utf8']
+    ]);
+    expect(errorsOf(new SubmissionPolicy({ allowBinary: true }), request).map((error) => [error.path, error.reason])).toEqual([
+      ['broken.txt', 'invalid_utf8']
+    ]);
+  });
+
+  it('reports every error at once with a code callers can match', () => {
+    const policy = new SubmissionPolicy();
+    let caught: unknown;
+    try {
+      policy.validate({ sources: { '../a': '', 'b': 1 as never } });
+    } catch (err) {
+      caught = err;
+    }
+    expect(caught).toMatchObject({
+      message: 'invalid source path: ../a; source b must be a string',
+      output: { statusCode: 400 },
+      data: { code: 'invalid_submission' }
+    });
+    expect(() => policy.validate({ sources: ['main.py'] as never })).toThrow('sources must be an object of strings');
+  });
+});
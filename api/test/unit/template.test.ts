@@ -0,0 +1,95 @@
+import { expandTemplate, remapCoverage, remapDiagnostics, remapOutput, validateTemplate } from '../../src/core/template.js';
+import type { Diagnostic } from '../../src/core/types.js';
+
+const harness = ['import sys', '', 'class Solution:', '    {{code}}', '', 'print(Solution().solve(sys.stdin.read()))', ''].join('\n');
+const code = 'def solve(self, data):\n    return data.upper()\n';
+
+function diagnostic(line: number | null, column: number | null, file = 'main.py'): Diagnostic {
+  return { source: 'compile', file, line, column, code: null, severity: 'error', message: 'bad' };
+}
+
+describe('templates', () => {
+  it('indents the code to the placeholder and maps lines back onto it', () => {
+    const { source, map } = expandTemplate({ source: harness }, code, 'main.py');
+    expect(source.split('\n').slice(2, 6)).toEqual([
+      'class Solution:',
+      '    def solve(self, data):',
+      '        return data.upper()',
+      ''
+    ]);
+    expect(
+      remapDiagnostics([diagnostic(1, 1), diagnostic(4, 9), diagnostic(5, 16), diagnostic(7, 1), diagnostic(5, 3, 'util.py'), diagnostic(null, null)], map).map(
+        ({ line, column, origin }) => [line, column, origin ?? null]
+      )
+    ).toEqual([
+      [1, 1, 'template'],
+      [1, 5, 'code'],
+      [2, 12, 'code'],
+      [6, 1, 'template'],
+      [5, 3, null],
+      [null, null, null]
+    ]);
+  });
+
+  it('injects inline placeholders without indenting and honours custom markers', () => {
+    const { source, map } = expandTemplate({ source: 'int main() { return /*CODE*/; }', placeholder: '/*CODE*/' }, '1 +\n1', 'main.c');
+    expect(source).toBe('int main() { return 1 +\n1; }');
+    expect(remapDiagnostics([diagnostic(1, 21, 'main.c'), diagnostic(1, 3, 'main.c'), diagnostic(2, 1, 'main.c')], map).map((d) => [d.line, d.column, d.origin])).toEqual([
+      [1, 1, 'code'],
+      [1, 3, 'template'],
+      [2, 1, 'code']
+    ]);
+  });
+
+  it('counts coverage of the entry file over the code\'s own lines', () => {
+    const { map } = expandTemplate({ source: 'package main\n{{code}}\nfunc main() { run() }\n' }, 'func run() {\n\tprintln(1)\n}', 'main.go');
+    const report = remapCoverage(
+      {
+        tool: 'go',
+        covered_lines: 4,
+        total_lines: 6,
+        percent: 66.67,
+        files: [
+          { file: 'main.go', covered_lines: 3, total_lines: 4, percent: 75, covered: [2, 3, 5], missed: [4] },
+          { file: 'util.go', covered_lines: 1, total_lines: 2, percent: 50, covered: [1], missed: [2] }
+        ]
+      },
+      map
+    );
+    expect(report).toMatchObject({ covered_lines: 3, total_lines: 5, percent: 60 });
+    expect(report.files[0]).toEqual({ file: 'main.go', covered_lines: 2, total_lines: 3, percent: 66.67, covered: [1, 2], missed: [3] });
+  });
+
+  it('points file and line references in tracebacks and compiler output at the submitted lines', () => {
+    const { map } = expandTemplate({ source: harness }, code, 'main.py');
+    const traceback = [
+      'Traceback (most recent call last):',
+      '  File "/workspace/main.py", line 7, in <module>',
+      '  File "/workspace/main.py", line 5, in solve',
+      '  File "/workspace/not_main.py", line 5, in other',
+      'main.py:4:9: E999 hidden',
+      'tmp/main.py(5)'
+    ].join('\n');
+    expect(remapOutput(traceback, map).split('\n')).toEqual([
+      'Traceback (most recent call last):',
+      '  File "<template>", line 6, in <module>',
+      '  File "/workspace/main.py", line 2, in solve',
+      '  File "/workspace/not_main.py", line 5, in other',
+      'main.py:1:5: E999 hidden',
+      'tmp/main.py(2)'
+    ]);
+    const php = expandTemplate({ source: '<?php\n{{code}}\n' }, 'echo $x;', 'main.php').map;
+    expect(remapOutput('Warning: Undefined variable $x in /workspace/main.php on line 2', php)).toBe(
+      'Warning: Undefined variable $x in /workspace/main.php on line 1'
+    );
+  });
+
+  it('validates the template and requires code', () => {
+    expect(() => validateTemplate({ code: 'x', template: { source: 'a {{code}} b' } })).not.toThrow();
+    expect(() => validateTemplate({ code: 'x', template: 'a' as never })).toThrow('template must be an object');
+    expect(() => validateTemplate({ code: 'x', template: { source: 1 as never } })).toThrow('template.source must be a string');
+    expect(() => validateTemplate({ code: 'x', template: { source: 'a', placeholder: '' } })).toThrow('template.placeholder must be a non-empty string');
+    expect(() => validateTemplate({ code: 'x', template: { source: '{{code}} {{code}}' } })).toThrow('template.source must contain {{code}} exactly once');
+    expect(() => validateTemplate({ template: { source: '{{code}}' } })).toThrow('template requires code');
+  });
+});
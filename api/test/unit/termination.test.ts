@@ -0,0 +1,68 @@
+import { classifyTermination } from '../../src/core/termination.js';
+import type { Outcome } from '../../src/core/termination.js';
+import type { RunLimits } from '../../src/core/types.js';
+
+const limits: RunLimits = {
+  timeout_ms: 2000,
+  kill_grace_ms: 500,
+  memory_mb: 128,
+  cpu_ms: 1500,
+  max_output_bytes: 1024,
+  max_stdout_bytes: 1024,
+  max_stderr_bytes: 1024,
+  max_artifact_bytes: 1024,
+  max_artifact_files: 5,
+  max_artifact_file_bytes: 1024,
+  disk_mb: 16,
+  max_processes: 32,
+  max_open_files: 64,
+  core_dump_mb: 0
+};
+
+function outcome(overrides: Partial<Outcome>): Outcome {
+  return { status: 'succeeded', exitCode: 0, limitExceeded: null, exitSignal: null, compile: null, ...overrides };
+}
+
+describe('classifyTermination', () => {
+  it('names the crash a signal points to', () => {
+    const crashes = ['SIGSEGV', 'SIGBUS', 'SIGFPE', 'SIGABRT', 'SIGILL', 'SIGPIPE'].map((signal) =>
+      classifyTermination(outcome({ status: 'failed', exitCode: 128, exitSignal: signal }), limits)
+    );
+    expect(crashes.map(({ verdict, signal }) => [verdict, signal])).toEqual([
+      ['segmentation_fault', 'SIGSEGV'],
+      ['bus_error', 'SIGBUS'],
+      ['floating_point_exception', 'SIGFPE'],
+      ['aborted', 'SIGABRT'],
+      ['illegal_instruction', 'SIGILL'],
+      ['signaled', 'SIGPIPE']
+    ]);
+    expect(crashes[0].explanation).toContain('null or dangling pointer');
+    expect(crashes[2].explanation).toContain('division or remainder by zero');
+    expect(crashes[5].explanation).toBe('The program was ended by SIGPIPE.');
+  });
+
+  it('puts the limit that stopped a run before the signal it was stopped with', () => {
+    expect(classifyTermination(outcome({ status: 'oom', exitCode: 137, limitExceeded: 'memory', exitSignal: 'SIGKILL' }), limits)).toEqual({
+      verdict: 'memory_limit',
+      signal: null,
+      explanation: "The program ran out of memory: it went over its 128 MB and was killed by the kernel's OOM killer."
+    });
+    expect(classifyTermination(outcome({ status: 'killed', exitCode: 152, limitExceeded: 'cpu_time', exitSignal: 'SIGXCPU' }), limits)).toMatchObject({
+      verdict: 'cpu_limit',
+      signal: null,
+      explanation: 'The program used up its 1500 ms of CPU time and was killed.'
+    });
+    expect(classifyTermination(outcome({ status: 'timeout', exitCode: 124, limitExceeded: 'wall_time' }), limits).verdict).toBe('time_limit');
+    expect(classifyTermination(outcome({ status: 'killed', exitCode: 1, limitExceeded: 'processes' }), limits).explanation).toContain('more than 32 processes');
+    // Truncated output does not stop the program.
+    expect(classifyTermination(outcome({ limitExceeded: 'output' }), limits).verdict).toBe('exited');
+  });
+
+  it('tells ordinary exits, failed builds and cancellations apart', () => {
+    expect(classifyTermination(outcome({}), limits).verdict).toBe('exited');
+    expect(classifyTermination(outcome({ status: 'failed', exitCode: 3 }), limits).explanation).toBe('The program exited with code 3.');
+    const compile = { exit_code: 1, stdout: '', stderr: 'error', duration_ms: 10 };
+    expect(classifyTermination(outcome({ status: 'failed', exitCode: 1, compile }), limits).verdict).toBe('compile_error');
+    expect(classifyTermination(outcome({ status: 'canceled', exitSignal: 'SIGKILL' }), limits)).toMatchObject({ verdict: 'canceled', signal: null });
+  });
+});
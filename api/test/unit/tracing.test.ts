@@ -0,0 +1,100 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { Orchestrator } from '../../src/core/orchestrator.js';
+import { ArtifactStorage } from '../../src/core/storage.js';
+import { formatTraceparent, parseTraceparent, toOtlp, Tracer } from '../../src/tracing/tracer.js';
+import type { SpanData } from '../../src/tracing/tracer.js';
+import { Logger } from '../../src/util/logger.js';
+
+describe('trace context', () => {
+  it('parses and formats traceparent headers', () => {
+    const header = '00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01';
+    expect(parseTraceparent(header)).toEqual({
+      traceId: '4bf92f3577b34da6a3ce929d0e0e4736',
+      spanId: '00f067aa0ba902b7',
+      sampled: true
+    });
+    expect(formatTraceparent(parseTraceparent(header)!)).toBe(header);
+    expect(parseTraceparent([header.replace(/01$/, '00')])?.sampled).toBe(false);
+    expect(parseTraceparent(undefined)).toBeNull();
+    expect(parseTraceparent('00-00000000000000000000000000000000-00f067aa0ba902b7-01')).toBeNull();
+    expect(parseTraceparent('garbage')).toBeNull();
+  });
+
+  it('converts spans to OTLP JSON', () => {
+    const span: SpanData = {
+      name: 'run',
+      kind: 'internal',
+      traceId: 'a'.repeat(32),
+      spanId: 'b'.repeat(16),
+      parentSpanId: null,
+      startMs: 1000,
+      endMs: 1500,
+      attributes: { 'run.exit_code': 1, ok: false },
+      error: 'failed'
+    };
+    const otlp = toOtlp([span], 'svc');
+    expect(otlp.resourceSpans[0].resource.attributes).toEqual([{ key: 'service.name', value: { stringValue: 'svc' } }]);
+    expect(otlp.resourceSpans[0].scopeSpans[0].spans[0]).toMatchObject({
+      name: 'run',
+      kind: 1,
+      startTimeUnixNano: '1000000000',
+      endTimeUnixNano: '1500000000',
+      attributes: [
+        { key: 'run.exit_code', value: { intValue: '1' } },
+        { key: 'ok', value: { boolValue: false } }
+      ],
+      status: { code: 2, message: 'failed' }
+    });
+  });
+});
+
+describe('Orchestrator tracing', () => {
+  let tmpDir: string;
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'trace-'));
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('records a span per pipeline stage under the caller trace', async () => {
+    const spans: SpanData[] = [];
+    const orchestrator = new Orchestrator({
+      workRoot: path.join(tmpDir, 'sandbox'),
+      artifactStorage: new ArtifactStorage({
+        baseDir: path.join(tmpDir, 'storage'),
+        baseUrl: 'http://localhost:8080',
+        signingKey: 'test-key',
+        urlTtlSeconds: 600
+      }),
+      sandboxRunner: {
+        run: async () => ({
+          status: 'succeeded',
+          exitCode: 0,
+          stdout: Buffer.from('ok'),
+          stderr: Buffer.alloc(0),
+          compile: { exit_code: 0, stdout: '', stderr: '', duration_ms: 0 },
+          usage: { wall_ms: 0, cpu_ms: 0, max_rss_mb: 1 },
+          artifacts: []
+        })
+      },
+      logger: new Logger({ test: 'tracing' }),
+      tracer: new Tracer({ export: (exported) => spans.push(...exported) })
+    });
+    const parent = parseTraceparent('00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01');
+    const run = await orchestrator.createRun({ language: 'go', code: 'package main' }, 'dev', { traceParent: parent });
+
+    const byName = Object.fromEntries(spans.map((span) => [span.name, span]));
+    expect(Object.keys(byName).sort()).toEqual(['artifacts', 'compile', 'execution', 'queue', 'run', 'sandbox', 'sandbox.setup']);
+    expect(spans.every((span) => span.traceId === parent?.traceId)).toBe(true);
+    expect(byName.execution.parentSpanId).toBe(parent?.spanId);
+    expect(byName.execution.attributes).toMatchObject({ 'run.id': run.id, 'run.status': 'succeeded' });
+    expect(byName.queue.parentSpanId).toBe(byName.execution.spanId);
+    expect(byName.compile.parentSpanId).toBe(byName.sandbox.spanId);
+    expect(byName.run.parentSpanId).toBe(byName.sandbox.spanId);
+  });
+});
@@ -0,0 +1,70 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { VersionManager, imageRepository } from '../../src/core/versions.js';
+import { Logger } from '../../src/util/logger.js';
+import type { RunnerDefinition } from '../../src/core/runners.js';
+
+const runner: RunnerDefinition = {
+  language: 'go',
+  image: 'code-executor-runner-go:latest',
+  entryFile: 'main.go',
+  extensions: ['.go'],
+  pidsLimit: 64,
+  versionCommand: ['go', 'version']
+};
+
+describe('VersionManager', () => {
+  let tmpDir: string;
+  let cli: string;
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'versions-'));
+    cli = path.join(tmpDir, 'docker');
+    // Fake CLI with 1.21 and 1.22 installed; 1.23 can be pulled.
+    fs.writeFileSync(
+      cli,
+      [
+        '#!/bin/sh',
+        'case "$1 $2" in',
+        '  "image inspect") case "$3" in *:1.21|*:1.22) exit 0;; *) exit 1;; esac;;',
+        '  "image ls") printf "latest\\n1.22\\n1.21\\n";;',
+        '  "pull code-executor-runner-go:1.23") exit 0;;',
+        '  *) exit 1;;',
+        'esac'
+      ].join('\n'),
+      { mode: 0o755 }
+    );
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('uses the default image without a version', async () => {
+    const versions = new VersionManager({ cli }, new Logger({ test: 'versions' }));
+    await expect(versions.resolve(runner)).resolves.toBe('code-executor-runner-go:latest');
+  });
+
+  it('resolves installed versions to tagged images', async () => {
+    const versions = new VersionManager({ cli }, new Logger({ test: 'versions' }));
+    await expect(versions.resolve(runner, '1.22')).resolves.toBe('code-executor-runner-go:1.22');
+    await expect(versions.available(runner)).resolves.toEqual(['1.21', '1.22']);
+  });
+
+  it('pulls missing versions only when enabled', async () => {
+    const offline = new VersionManager({ cli }, new Logger({ test: 'versions' }));
+    await expect(offline.resolve(runner, '1.23')).rejects.toMatchObject({
+      message: 'unsupported go version: 1.23',
+      data: { code: 'unsupported_version', supported: ['1.21', '1.22'] }
+    });
+    const pulling = new VersionManager({ cli, pull: true }, new Logger({ test: 'versions' }));
+    await expect(pulling.resolve(runner, '1.23')).resolves.toBe('code-executor-runner-go:1.23');
+  });
+
+  it('strips tags but keeps registry ports', () => {
+    expect(imageRepository('registry.local:5000/runner-go:dev')).toBe('registry.local:5000/runner-go');
+    expect(imageRepository('registry.local:5000/runner-go')).toBe('registry.local:5000/runner-go');
+    expect(imageRepository('registry.local:5000/runner-go@sha256:0123abcd')).toBe('registry.local:5000/runner-go');
+  });
+});
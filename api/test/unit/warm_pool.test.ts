@@ -0,0 +1,96 @@
+import { EventEmitter } from 'node:events';
+import { DEFAULT_LIMITS } from '../../src/core/limits.js';
+import { WarmPool } from '../../src/core/warm_pool.js';
+import type { WarmPoolKey, WarmPoolOptions, WarmSandbox } from '../../src/core/warm_pool.js';
+import { Logger } from '../../src/util/logger.js';
+
+class FakeSandbox implements WarmSandbox {
+  private readonly events = new EventEmitter();
+  public stopped = false;
+  public discarded = false;
+
+  onExit(listener: () => void) {
+    this.events.once('exit', listener);
+  }
+
+  stop() {
+    this.stopped = true;
+    this.exit();
+  }
+
+  discard() {
+    this.discarded = true;
+  }
+
+  exit() {
+    this.events.emit('exit');
+  }
+}
+
+describe('WarmPool', () => {
+  const key: WarmPoolKey = { language: 'python', isolation: 'gvisor', limits: DEFAULT_LIMITS };
+  let launched: FakeSandbox[];
+
+  const pool = (options: WarmPoolOptions) =>
+    new WarmPool(options, () => {
+      const sandbox = new FakeSandbox();
+      launched.push(sandbox);
+      return sandbox;
+    }, new Logger({ test: 'warm-pool' }));
+
+  beforeEach(() => {
+    launched = [];
+  });
+
+  it('leases pre-booted sandboxes and refills eagerly', () => {
+    const warm = pool({ size: 2 });
+    expect(warm.lease(key)).toBeNull();
+    expect(launched).toHaveLength(2);
+    expect(warm.lease(key)).toBe(launched[0]);
+    expect(launched).toHaveLength(3);
+    expect(warm.lease({ ...key, limits: { ...DEFAULT_LIMITS, memory_mb: 512 } })).toBeNull();
+    expect(warm.lease({ ...key, limits: { ...DEFAULT_LIMITS, max_processes: 256 } })).toBeNull();
+    expect(warm.lease({ ...key, isolation: 'container' })).toBeNull();
+    expect(warm.stats()).toMatchObject({ idle: 6, hits: 1, misses: 3, launched: 7 });
+  });
+
+  it('refills lazily once the run has finished', () => {
+    const warm = pool({ size: 1, refill: 'lazy', isolation: ['container'] });
+    const containerKey: WarmPoolKey = { ...key, isolation: 'container' };
+    warm.fill(containerKey);
+    expect(warm.lease(containerKey)).toBe(launched[0]);
+    expect(launched).toHaveLength(1);
+    warm.finished(containerKey);
+    expect(launched).toHaveLength(2);
+  });
+
+  it('drops sandboxes that exit while idle without replacing them', () => {
+    const warm = pool({ size: 1 });
+    warm.fill(key);
+    launched[0].exit();
+    expect(launched[0].discarded).toBe(true);
+    expect(warm.stats().idle).toBe(0);
+    expect(launched).toHaveLength(1);
+  });
+
+  it('stops idle sandboxes and pools no more once closed', async () => {
+    const warm = pool({ size: 2 });
+    warm.fill(key);
+    await warm.close();
+    expect(launched.every((sandbox) => sandbox.stopped && sandbox.discarded)).toBe(true);
+    expect(warm.lease(key)).toBeNull();
+    expect(launched).toHaveLength(2);
+    expect(warm.stats().idle).toBe(0);
+  });
+
+  it('recycles sandboxes that sat idle too long', async () => {
+    const warm = pool({ size: 1, maxIdleMs: 5 });
+    warm.fill(key);
+    await new Promise((resolve) => setTimeout(resolve, 20));
+    expect(launched[0].stopped).toBe(true);
+    expect(launched[0].discarded).toBe(true);
+    expect(launched.length).toBeGreaterThanOrEqual(2);
+    expect(warm.stats().recycled).toBeGreaterThanOrEqual(1);
+    expect(warm.stats().idle).toBe(1);
+  });
+});
@@ -0,0 +1,102 @@
+import fs from 'node:fs';
+import os from 'node:os';
+import path from 'node:path';
+import { WasmSandbox } from '../../src/core/wasm_sandbox.js';
+import { Logger } from '../../src/util/logger.js';
+import type { SandboxResult, SandboxRunSpec, SandboxRunner } from '../../src/core/types.js';
+
+describe('WasmSandbox', () => {
+  let tmpDir: string;
+  let runtime: string;
+  let delegated: SandboxRunSpec[];
+  const next: SandboxRunner = {
+    async run(spec) {
+      delegated.push(spec);
+      return { status: 'succeeded', exitCode: 0, limitExceeded: null, stdout: Buffer.from(''), stderr: Buffer.from(''), artifacts: [] } as SandboxResult;
+    }
+  };
+
+  const spec = (overrides: Partial<SandboxRunSpec> = {}): SandboxRunSpec => ({
+    id: 'run_test',
+    language: 'wasm',
+    mode: 'run',
+    code: 'AGFzbQEAAAA=',
+    sources: {},
+    stdin: 'input',
+    build: {},
+    isolation: 'wasm',
+    network: { mode: 'none' },
+    args: ['a'],
+    env: {},
+    workdir: path.join(tmpDir, 'work'),
+    limits: {
+      timeout_ms: 5000,
+      kill_grace_ms: 1000,
+      memory_mb: 128,
+      cpu_ms: 5000,
+      max_output_bytes: 1024,
+      max_stdout_bytes: 1024,
+      max_stderr_bytes: 1024,
+      max_artifact_bytes: 1024,
+      max_artifact_files: 5,
+      max_artifact_file_bytes: 1024,
+      disk_mb: 1,
+      max_processes: 1,
+      max_open_files: 64,
+      core_dump_mb: 0
+    },
+    stagedFiles: [],
+    mounts: [],
+    ...overrides
+  });
+
+  const sandbox = (options: { runtime?: string; fuel?: number } = { runtime }) =>
+    new WasmSandbox({ ...options, next }, new Logger({ test: 'wasm-sandbox' }));
+
+  beforeEach(() => {
+    tmpDir = fs.mkdtempSync(path.join(os.tmpdir(), 'wasm-'));
+    delegated = [];
+    // Stands in for wasirun: keeps the spec line, echoes the module and writes usage.json.
+    runtime = path.join(tmpDir, 'wasirun');
+    fs.writeFileSync(
+      runtime,
+      [
+        '#!/bin/sh',
+        'head -n 1 > spec.json',
+        'mkdir -p outputs',
+        'cat main.wasm',
+        'echo \'{"wall_ms":1,"cpu_ms":2,"user_cpu_ms":2,"system_cpu_ms":0,"max_rss_mb":1,"limit_exceeded":null,"toolchain":"wazero"}\' > usage.json'
+      ].join('\n'),
+      { mode: 0o755 }
+    );
+  });
+
+  afterEach(() => {
+    fs.rmSync(tmpDir, { recursive: true, force: true });
+  });
+
+  it('hands other isolation levels to the next sandbox', async () => {
+    await sandbox().run(spec({ language: 'c', isolation: 'gvisor' }));
+    expect(delegated.map((run) => run.isolation)).toEqual(['gvisor']);
+  });
+
+  it('runs the module under the runtime with the spec line', async () => {
+    const result = await sandbox({ runtime, fuel: 1000 }).run(spec());
+    expect(delegated).toEqual([]);
+    expect(result.status).toBe('succeeded');
+    expect(result.stdout.toString()).toBe('AGFzbQEAAAA=');
+    expect(result.toolchain).toBe('wazero');
+    const sent = JSON.parse(fs.readFileSync(path.join(tmpDir, 'work', 'spec.json'), 'utf8'));
+    expect(sent.args).toEqual(['a']);
+    expect(sent.stdin).toBe('input');
+    expect(sent.settings).toEqual({ fuel: '1000' });
+  });
+
+  it('refuses wasm runs it cannot serve', async () => {
+    await expect(sandbox({}).run(spec())).rejects.toThrow('isolation wasm is not enabled on this server');
+    await expect(sandbox().run(spec({ network: { mode: 'loopback' } }))).rejects.toThrow('isolation wasm has no network access');
+    await expect(sandbox().run(spec({ mode: 'test' }))).rejects.toThrow('test mode is not available with isolation wasm');
+    await expect(sandbox().run(spec({ mode: 'check' }))).rejects.toThrow('check mode is not available with isolation wasm');
+    await expect(sandbox().run(spec({ profile: { cpu: true } }))).rejects.toThrow('profiling is not available with isolation wasm');
+  });
+});
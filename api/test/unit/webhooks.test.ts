@@ -0,0 +1,65 @@
+import http from 'node:http';
+import type { AddressInfo } from 'node:net';
+import { signPayload, WebhookDispatcher } from '../../src/core/webhooks.js';
+import { Logger } from '../../src/util/logger.js';
+
+describe('WebhookDispatcher', () => {
+  let server: http.Server;
+  let url: string;
+  let statuses: number[];
+  let received: Array<{ headers: http.IncomingHttpHeaders; body: string }>;
+
+  beforeEach(async () => {
+    received = [];
+    statuses = [];
+    server = http.createServer((req, res) => {
+      let body = '';
+      req.on('data', (chunk) => (body += chunk));
+      req.on('end', () => {
+        received.push({ headers: req.headers, body });
+        res.statusCode = statuses.shift() ?? 204;
+        res.end();
+      });
+    });
+    await new Promise<void>((resolve) => server.listen(0, '127.0.0.1', resolve));
+    url = `http://127.0.0.1:${(server.address() as AddressInfo).port}/hook`;
+  });
+
+  afterEach(async () => {
+    await new Promise((resolve) => server.close(resolve));
+  });
+
+  const dispatcher = (maxAttempts = 3) =>
+    new WebhookDispatcher({ secret: 'shh', maxAttempts, initialBackoffMs: 5 }, new Logger({ test: 'webhooks' }));
+
+  it('signs deliveries and retries server errors', async () => {
+    statuses = [503, 500];
+    const delivered = await dispatcher().deliver(url, { type: 'execution.completed', id: 'run_1', data: { status: 'succeeded' } });
+    expect(delivered).toBe(true);
+    expect(received).toHaveLength(3);
+    const last = received[2];
+    expect(JSON.parse(last.body)).toEqual({ type: 'execution.completed', id: 'run_1', data: { status: 'succeeded' } });
+    expect(last.headers['x-webhook-signature']).toBe(
+      `sha256=${signPayload('shh', Number(last.headers['x-webhook-timestamp']), last.body)}`
+    );
+    expect(new Set(received.map((delivery) => delivery.headers['x-webhook-delivery'])).size).toBe(1);
+  });
+
+  it('gives up on client errors and after the last attempt', async () => {
+    statuses = [410];
+    expect(await dispatcher().deliver(url, { type: 'execution.failed', id: 'run_2', data: {} })).toBe(false);
+    expect(received).toHaveLength(1);
+    statuses = [500, 500];
+    expect(await dispatcher(2).deliver(url, { type: 'execution.failed', id: 'run_3', data: {} })).toBe(false);
+    expect(received).toHaveLength(3);
+  });
+
+  it('validates callback URLs', () => {
+    const restricted = new WebhookDispatcher({ secret: 'shh', allowedHosts: ['*.example.com'] }, new Logger({ test: 'webhooks' }));
+    expect(restricted.validateUrl('https://grader.example.com/done')).toBe('https://grader.example.com/done');
+    expect(() => restricted.validateUrl('https://evil.test/done')).toThrow('callback host not allowed: evil.test');
+    expect(() => dispatcher().validateUrl('file:///etc/passwd')).toThrow('must use http or https');
+    expect(() => dispatcher().validateUrl('https://user:pw@example.com')).toThrow('must not contain credentials');
+    expect(() => dispatcher().validateUrl('not a url')).toThrow('callback_url must be a URL');
+  });
+});
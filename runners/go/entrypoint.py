@@ -1,15 +1,65 @@
 #!/usr/bin/env python3
+import hashlib
 import json
 import os
+import re
 import resource
+import shutil
+import signal
 import subprocess
 import sys
+import threading
 import time
 from pathlib import Path
 
-WORKDIR = Path('/work')
-SPEC = json.load(sys.stdin)
+# runner_common.py sits next to the entrypoint in the image and in runners/ for the process backend.
+sys.path.append(str(Path(__file__).resolve().parent.parent))
+from runner_common import oom_kills, stop_in_two_stages
+
+
+def read_spec():
+    # The spec is the first line of stdin. It is read straight from fd 0 so that whatever follows,
+    # an interactive session's live input, is left for relay_stdin rather than buffered away.
+    data = b''
+    while b'\n' not in data:
+        chunk = os.read(0, 65536)
+        if not chunk:
+            break
+        data += chunk
+    line, _, rest = data.partition(b'\n')
+    return json.loads(line), rest
+
+
+SPEC, STDIN_REST = read_spec()
+# The process backend runs entrypoints directly on the host and passes its own workdir.
+WORKDIR = Path(SPEC.get('workdir') or '/work')
 LIMITS = SPEC.get('limits', {})
+# Test mode builds the package's test binary in place of main and reports its test cases.
+TEST_MODE = SPEC.get('mode') == 'test'
+# Compile mode stops after the build and check mode builds without keeping the binary (the go
+# command has no cheaper way to type-check); neither gets as far as running the program.
+MODE = SPEC.get('mode', 'run')
+# Coverage builds the test binary with -cover and keeps its profile as an artifact.
+COVERAGE = TEST_MODE and bool(SPEC.get('coverage'))
+COVER_PROFILE = WORKDIR / 'outputs' / 'coverage' / 'coverage.out'
+SETTINGS = SPEC.get('settings', {})
+# The shared module cache the API mounts read-only for runs that submitted a go.mod.
+MODULE_CACHE = Path('/deps/mod')
+
+if SPEC.get('mode') == 'setup':
+    # Modules are downloaded in their own networked container into the module cache, which every
+    # manifest shares; the build itself later runs with the proxy turned off.
+    os.environ['HOME'] = '/tmp'
+    os.environ['GOPATH'] = '/tmp/go'
+    os.environ['GOCACHE'] = '/tmp/go-cache'
+    os.environ['GOMODCACHE'] = str(MODULE_CACHE)
+    # Keep extracted modules writable so the cache can be pruned from the host.
+    os.environ['GOFLAGS'] = '-modcacherw'
+    os.environ['GOTOOLCHAIN'] = 'local'
+    if SETTINGS.get('proxy'):
+        os.environ['GOPROXY'] = SETTINGS['proxy']
+    download = subprocess.run(['go', 'mod', 'download'], cwd=SPEC.get('manifest_dir', '/deps'))
+    sys.exit(download.returncode)
 
 os.chdir(WORKDIR)
 
@@ -17,11 +67,20 @@ os.chdir(WORKDIR)
 env = {key: value for key, value in SPEC.get('env', {}).items()}
 os.environ.clear()
 os.environ.update(env)
-os.environ['HOME'] = '/work'
-os.environ['TMPDIR'] = '/work/tmp'
+os.environ['HOME'] = str(WORKDIR)
+os.environ['TMPDIR'] = str(WORKDIR / 'tmp')
 os.environ['PATH'] = '/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin:/usr/local/go/bin'
-os.environ['GOPATH'] = '/work/tmp/go'
-os.environ['GOCACHE'] = '/work/tmp/go-cache'
+os.environ['GOPATH'] = str(WORKDIR / 'tmp' / 'go')
+os.environ['GOCACHE'] = str(WORKDIR / 'tmp' / 'go-cache')
+if MODULE_CACHE.is_dir():
+    os.environ['GOMODCACHE'] = str(MODULE_CACHE)
+# Builds never download anything: modules come from the cache or vendor/, and go.sum entries the
+# submission left out are taken from the cache, which was verified against the checksum database
+# when it was filled.
+os.environ['GOPROXY'] = 'off'
+os.environ['GOSUMDB'] = 'off'
+os.environ['GOTOOLCHAIN'] = 'local'
+os.environ['GOFLAGS'] = '-mod=vendor' if Path('vendor/modules.txt').exists() else '-mod=mod'
 # Set Go memory limit to work in constrained environments
 os.environ['GOMEMLIMIT'] = f"{LIMITS.get('memory_mb', 256) * 1024 * 1024}B"
 # Disable memory profiling to reduce overhead
@@ -30,6 +89,17 @@ os.environ['GOGC'] = '50'
 Path('tmp').mkdir(parents=True, exist_ok=True)
 Path('outputs').mkdir(parents=True, exist_ok=True)
 
+
+def toolchain_version():
+    try:
+        probe = subprocess.run(['go', 'version'], capture_output=True, timeout=5)
+        return probe.stdout.decode('utf8', errors='replace').strip() or None
+    except (OSError, subprocess.SubprocessError):
+        return None
+
+
+TOOLCHAIN = toolchain_version()
+
 # Set resource limits
 memory_bytes = int(LIMITS.get('memory_mb', 256) * 1024 * 1024)
 cpu_ms = int(LIMITS.get('cpu_ms', 5000))
@@ -38,72 +108,708 @@ cpu_quota_seconds = max(1, cpu_ms // 1000 or 1)
 # resource.setrlimit(resource.RLIMIT_AS, (memory_bytes, memory_bytes))
 resource.setrlimit(resource.RLIMIT_DATA, (memory_bytes, memory_bytes))
 resource.setrlimit(resource.RLIMIT_FSIZE, (50 * 1024 * 1024, 50 * 1024 * 1024))
-resource.setrlimit(resource.RLIMIT_NPROC, (256, 256))
-resource.setrlimit(resource.RLIMIT_NOFILE, (256, 256))
+# RLIMIT_NPROC backs up the container's --pids-limit where there is no pids cgroup.
+max_processes = int(LIMITS.get('max_processes', 256))
+resource.setrlimit(resource.RLIMIT_NPROC, (max_processes, max_processes))
+max_open_files = int(LIMITS.get('max_open_files', 256))
+resource.setrlimit(resource.RLIMIT_NOFILE, (max_open_files, max_open_files))
+# Core dumps stay off unless the run asks for them, and never exceed what the host allows.
+core_bytes = int(LIMITS.get('core_dump_mb', 0)) * 1024 * 1024
+core_hard = resource.getrlimit(resource.RLIMIT_CORE)[1]
+if core_hard != resource.RLIM_INFINITY:
+    core_bytes = min(core_bytes, core_hard)
+resource.setrlimit(resource.RLIMIT_CORE, (core_bytes, core_bytes))
 resource.setrlimit(resource.RLIMIT_CPU, (cpu_quota_seconds, cpu_quota_seconds))
 
+
+def pids_refused():
+    # How many forks the container's cgroup pids controller has refused so far (cgroup v2, then v1).
+    try:
+        group = next((line[3:] for line in Path('/proc/self/cgroup').read_text().splitlines() if line.startswith('0::')), '')
+    except OSError:
+        group = ''
+    candidates = [Path('/sys/fs/cgroup') / group.lstrip('/') / 'pids.events', Path('/sys/fs/cgroup/pids/pids.events')]
+    for events in candidates:
+        try:
+            for line in events.read_text().splitlines():
+                key, _, value = line.partition(' ')
+                if key == 'max':
+                    return int(value)
+        except (OSError, ValueError):
+            continue
+    return 0
+
+
+# A fork refused from here on means the run hit max_processes.
+PIDS_REFUSED_AT_START = pids_refused()
+
+
+# An OOM kill from here on means the run hit memory_mb.
+OOM_KILLS_AT_START = oom_kills()
+
+BUILD_DIR = Path('.build')
+CACHED_COMPILE = {'exit_code': 0, 'duration_ms': 0, 'stdout': '', 'stderr': '', 'cached': True}
+
+
+def publish_build(outputs):
+    # Copy the compiled outputs into .build/ for the API's compilation cache. The digest is taken
+    # before any submission code runs, so the API can refuse a build the program rewrote.
+    BUILD_DIR.mkdir(exist_ok=True)
+    for source, name in outputs:
+        if Path(source).is_dir():
+            shutil.copytree(source, BUILD_DIR / name, dirs_exist_ok=True)
+        elif Path(source).exists():
+            shutil.copy2(source, BUILD_DIR / name)
+    names = sorted(p.relative_to(BUILD_DIR).as_posix() for p in BUILD_DIR.rglob('*') if p.is_file())
+    digest = hashlib.sha256()
+    for name in names:
+        contents = hashlib.sha256((BUILD_DIR / name).read_bytes()).hexdigest()
+        digest.update(f'{name}\0{contents}\n'.encode('utf8'))
+    return digest.hexdigest()
+
+
+def restore_build(outputs):
+    # The API restored this exact build from its compilation cache into .build/.
+    for name, dest in outputs:
+        if (BUILD_DIR / name).is_dir():
+            shutil.copytree(BUILD_DIR / name, dest, dirs_exist_ok=True)
+        elif (BUILD_DIR / name).exists():
+            shutil.copy2(BUILD_DIR / name, dest)
+
+
+LINT = SPEC.get('lint')
+LINT_TIMEOUT = 10
+POSITION = re.compile(r'^(.*?):(\d+)(?::(\d+))?$')
+COMPILE_ERROR = re.compile(r'^(\S+\.go):(\d+):(\d+): (.*)$')
+
+
+def relative_path(file):
+    # Tools report absolute paths; diagnostics name files the way the submission did.
+    try:
+        return Path(file).resolve().relative_to(WORKDIR.resolve()).as_posix()
+    except ValueError:
+        return file
+
+
+def diagnostic(source, file, line, column, code, severity, message):
+    return {
+        'source': source,
+        'file': relative_path(file),
+        'line': int(line) if line else None,
+        'column': int(column) if column else None,
+        'code': code,
+        'severity': severity,
+        'message': message
+    }
+
+
+def json_values(text):
+    # go vet and go list print one JSON document after another, vet with `# package` lines between.
+    decoder = json.JSONDecoder()
+    text = '\n'.join(line for line in text.splitlines() if not line.startswith('#'))
+    values, offset = [], 0
+    while True:
+        while offset < len(text) and text[offset].isspace():
+            offset += 1
+        if offset >= len(text):
+            return values
+        try:
+            value, offset = decoder.raw_decode(text, offset)
+        except ValueError:
+            return values
+        values.append(value)
+
+
+def run_tool(command, env=None):
+    try:
+        proc = subprocess.run(command, capture_output=True, timeout=LINT_TIMEOUT, env=env)
+    except (OSError, subprocess.TimeoutExpired):
+        return None
+    return proc
+
+
+def vet_diagnostics():
+    # Type errors make vet print plain text instead of JSON; the build reports those. The JSON goes
+    # to stderr before Go 1.24 and to stdout since.
+    proc = run_tool(['go', 'vet', '-json', './...'])
+    output = (proc.stdout + b'\n' + proc.stderr).decode('utf8', errors='replace') if proc else ''
+    found = []
+    for value in json_values(output):
+        for analyzers in value.values():
+            for analyzer, findings in analyzers.items():
+                for finding in findings if isinstance(findings, list) else []:
+                    match = POSITION.match(finding.get('posn', ''))
+                    file, line, column = match.groups() if match else (finding.get('posn', ''), None, None)
+                    found.append(diagnostic('vet', file, line, column, analyzer, 'warning', finding.get('message', '')))
+    return found
+
+
+def staticcheck_diagnostics():
+    if not shutil.which('staticcheck'):
+        return []
+    env = dict(os.environ, XDG_CACHE_HOME=str(WORKDIR / 'tmp' / 'cache'))
+    proc = run_tool(['staticcheck', '-f', 'json', './...'], env)
+    found = []
+    for value in json_values(proc.stdout.decode('utf8', errors='replace')) if proc else []:
+        # staticcheck repeats compile errors under the code `compile`; the build reports those.
+        if not isinstance(value, dict) or value.get('code') == 'compile':
+            continue
+        location = value.get('location', {})
+        severity = 'error' if value.get('severity') == 'error' else 'warning'
+        found.append(diagnostic(
+            'staticcheck', location.get('file', ''), location.get('line'), location.get('column'),
+            value.get('code'), severity, value.get('message', '')
+        ))
+    return found
+
+
+def excluded_files():
+    # Files left out by their build constraints (e.g. `//go:build ignore`), which are easy to miss.
+    proc = run_tool(['go', 'list', '-e', '-json', './...'])
+    found = []
+    for package in json_values(proc.stdout.decode('utf8', errors='replace')) if proc else []:
+        for name in package.get('IgnoredGoFiles', []) if isinstance(package, dict) else []:
+            found.append(diagnostic(
+                'build', str(Path(package.get('Dir', '.')) / name), None, None, None, 'warning',
+                'excluded by build constraints'
+            ))
+    return found
+
+
+def compile_diagnostics(stderr):
+    found = []
+    for line in stderr.decode('utf8', errors='replace').splitlines():
+        match = COMPILE_ERROR.match(line)
+        if match:
+            file, line_number, column, message = match.groups()
+            found.append(diagnostic('compile', file, line_number, column, None, 'error', message))
+    return found
+
+
+# Multi-file submissions are built as one module; synthesize go.mod when the caller did not
+# supply one so local packages can be imported as "submission/<dir>".
+if not Path('go.mod').exists():
+    Path('go.mod').write_text('module submission\n\ngo 1.21\n')
+
+# LINT PHASE
+# Static checks run before the build when the request asks for them. Their findings are reported
+# as diagnostics and never stop the program from running.
+DIAGNOSTICS = []
+if LINT is not None:
+    DIAGNOSTICS += excluded_files()
+    if LINT.get('vet', True):
+        DIAGNOSTICS += vet_diagnostics()
+    if LINT.get('staticcheck'):
+        DIAGNOSTICS += staticcheck_diagnostics()
+
+# PROFILING
+# Profiles are compiled into the program: an overlay renames the submission's main and adds one
+# that starts the CPU profile, calls it, and writes both profiles once it returns or panics. The
+# SIGTERM sent at the wall-clock limit writes them too, so a run that times out still has them;
+# a program that calls os.Exit itself skips them.
+PROFILE = SPEC.get('profile') or {}
+PROFILES_DIR = Path('outputs') / 'profiles'
+if PROFILE.get('cpu') or PROFILE.get('heap'):
+    PROFILES_DIR.mkdir(parents=True, exist_ok=True)
+MAIN_FUNC = re.compile(r'^func main\(\)', re.M)
+PROFILE_MAIN = """package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"syscall"
+)
+
+func main() {
+	// Resolved before the program can change directory.
+	cpuPath, heapPath := %(cpu)s, %(heap)s
+	if cpuPath != "" {
+		cpuPath, _ = filepath.Abs(cpuPath)
+	}
+	if heapPath != "" {
+		heapPath, _ = filepath.Abs(heapPath)
+	}
+	var cpu *os.File
+	if cpuPath != "" {
+		if file, err := os.Create(cpuPath); err == nil && pprof.StartCPUProfile(file) == nil {
+			cpu = file
+		}
+	}
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			if cpu != nil {
+				pprof.StopCPUProfile()
+				cpu.Close()
+			}
+			if heapPath != "" {
+				if file, err := os.Create(heapPath); err == nil {
+					runtime.GC()
+					pprof.Lookup("heap").WriteTo(file, 0)
+					file.Close()
+				}
+			}
+		})
+	}
+	terminated := make(chan os.Signal, 1)
+	signal.Notify(terminated, syscall.SIGTERM)
+	go func() {
+		<-terminated
+		stop()
+		signal.Reset(syscall.SIGTERM)
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+	defer stop()
+	codexecProfiledMain()
+}
+"""
+
+
+def profile_overlay():
+    # Writes the overlay for `go build -overlay`, which leaves the submission's own files alone.
+    # Returns None when nothing was asked for or no top-level file declares main.
+    if not (PROFILE.get('cpu') or PROFILE.get('heap')):
+        return None
+    overlay_dir = WORKDIR / 'tmp' / 'profile'
+    overlay_dir.mkdir(parents=True, exist_ok=True)
+    replace = {}
+    for file in sorted(Path('.').glob('*.go')):
+        if file.name.endswith('_test.go'):
+            continue
+        source = file.read_text(encoding='utf8', errors='replace')
+        if MAIN_FUNC.search(source):
+            renamed = overlay_dir / file.name
+            renamed.write_text(MAIN_FUNC.sub('func codexecProfiledMain()', source, count=1), encoding='utf8')
+            replace[str(WORKDIR / file.name)] = str(renamed)
+            break
+    if not replace:
+        sys.stderr.write('profile: no func main found; running without profiling\n')
+        return None
+    # Relative to the run directory, so a cached build works wherever the run directory is.
+    # json.dumps gives valid Go string literals for them.
+    paths = {
+        'cpu': json.dumps(str(PROFILES_DIR / 'cpu.pprof') if PROFILE.get('cpu') else ''),
+        'heap': json.dumps(str(PROFILES_DIR / 'heap.pprof') if PROFILE.get('heap') else '')
+    }
+    (overlay_dir / 'profile_main.go').write_text(PROFILE_MAIN % paths, encoding='utf8')
+    replace[str(WORKDIR / 'codexec_profile_main.go')] = str(overlay_dir / 'profile_main.go')
+    overlay = overlay_dir / 'overlay.json'
+    overlay.write_text(json.dumps({'Replace': replace}))
+    return overlay
+
+
 # COMPILATION PHASE
+output_limit = int(LIMITS.get('max_output_bytes', 1024 * 1024))
+# Each stream has its own cap, max_output_bytes unless set. With on_output_limit=kill the program
+# is stopped at the first byte past a cap instead of having the rest of its output discarded.
+stream_limits = {
+    'stdout': int(LIMITS.get('max_stdout_bytes', output_limit)),
+    'stderr': int(LIMITS.get('max_stderr_bytes', output_limit)),
+}
+KILL_ON_OUTPUT_LIMIT = SPEC.get('on_output_limit') == 'kill'
 compile_start = time.time()
-# Use build flags to reduce memory usage during compilation
-compile_cmd = ['go', 'build', '-ldflags', '-s -w', '-o', 'main', 'main.go']
-
-compile_proc = subprocess.Popen(
-    compile_cmd, 
-    stdout=subprocess.PIPE, 
-    stderr=subprocess.PIPE,
-    text=False
-)
+PREBUILT = bool(SPEC.get('prebuilt')) and (BUILD_DIR / 'main').exists() and MODE != 'check'
+if PREBUILT:
+    restore_build([('main', 'main')])
+    compile_phase = CACHED_COMPILE
+    BUILD_DIGEST = None
+else:
+    # Use build flags to reduce memory usage during compilation
+    compile_cmd = ['go', 'build', '-ldflags', '-s -w', '-o', 'main', '.']
+    overlay = profile_overlay() if MODE == 'run' else None
+    if overlay:
+        compile_cmd[2:2] = ['-overlay', str(overlay)]
+    if TEST_MODE:
+        compile_cmd = ['go', 'test', '-c', '-o', 'main', '.']
+        if COVERAGE:
+            compile_cmd[3:3] = ['-cover']
+    elif MODE == 'check':
+        compile_cmd = ['go', 'build', '-o', os.devnull, '.']
 
-try:
-    # Give compilation 10 seconds max
-    compile_stdout, compile_stderr = compile_proc.communicate(timeout=10)
-except subprocess.TimeoutExpired:
-    compile_proc.kill()
-    sys.stderr.buffer.write(b'Compilation timed out\n')
-    sys.exit(124)
+    compile_proc = subprocess.Popen(
+        compile_cmd, 
+        stdout=subprocess.PIPE, 
+        stderr=subprocess.PIPE,
+        text=False
+    )
 
-# Check compilation result
-if compile_proc.returncode != 0:
-    # Compilation failed - report compilation errors
-    sys.stderr.buffer.write(b'Compilation failed:\n')
-    sys.stderr.buffer.write(compile_stderr[:LIMITS.get('max_output_bytes', 1024 * 1024)])
-    sys.exit(1)
+    def compile_report(exit_code, stdout, stderr):
+        # Compile output is reported separately from the program's streams so callers can tell
+        # build failures from runtime failures.
+        return {
+            'exit_code': exit_code,
+            'duration_ms': int((time.time() - compile_start) * 1000),
+            'stdout': stdout[:output_limit].decode('utf8', errors='replace'),
+            'stderr': stderr[:output_limit].decode('utf8', errors='replace')
+        }
+
+    try:
+        # Give compilation 10 seconds max
+        compile_stdout, compile_stderr = compile_proc.communicate(timeout=10)
+    except subprocess.TimeoutExpired:
+        compile_proc.kill()
+        compile_stdout, compile_stderr = compile_proc.communicate()
+        sys.stderr.buffer.write(b'Compilation timed out\n')
+        Path('usage.json').write_text(json.dumps({
+            'wall_ms': 0,
+            'compile_ms': int((time.time() - compile_start) * 1000),
+            'cpu_ms': 0,
+            'max_rss_mb': 0,
+            'limit_exceeded': 'wall_time',
+            'toolchain': TOOLCHAIN,
+            'compile': compile_report(None, compile_stdout, compile_stderr),
+            'diagnostics': DIAGNOSTICS
+        }))
+        sys.exit(124)
+
+    compile_phase = compile_report(compile_proc.returncode, compile_stdout, compile_stderr)
+
+    # Check compilation result
+    if compile_proc.returncode != 0:
+        # Compilation failed - report compilation errors
+        sys.stderr.buffer.write(b'Compilation failed:\n')
+        sys.stderr.buffer.write(compile_stderr[:output_limit])
+        Path('usage.json').write_text(json.dumps({
+            'wall_ms': 0,
+            'compile_ms': compile_phase['duration_ms'],
+            'cpu_ms': 0,
+            'max_rss_mb': 0,
+            'limit_exceeded': None,
+            'toolchain': TOOLCHAIN,
+            'compile': compile_phase,
+            'diagnostics': DIAGNOSTICS + compile_diagnostics(compile_stderr)
+        }))
+        sys.exit(1)
+    BUILD_DIGEST = publish_build([('main', 'main')]) if MODE != 'check' else None
 
 compile_time = time.time() - compile_start
 
+if MODE in ('compile', 'check'):
+    Path('usage.json').write_text(json.dumps({
+        'wall_ms': 0,
+        'compile_ms': int(compile_time * 1000),
+        'cpu_ms': 0,
+        'max_rss_mb': 0,
+        'limit_exceeded': None,
+        'toolchain': TOOLCHAIN,
+        'compile': compile_phase,
+        'diagnostics': DIAGNOSTICS,
+        'build_digest': BUILD_DIGEST
+    }))
+    sys.exit(0)
+
 # EXECUTION PHASE
 run_cmd = ['./main'] + SPEC.get('args', [])
+if TEST_MODE:
+    # test2json is what `go test -json` runs the binary under; args go to the test binary, so
+    # callers can pass e.g. -test.run=TestName.
+    run_cmd = ['go', 'tool', 'test2json', '-t', './main', '-test.v=test2json'] + SPEC.get('args', [])
+    if COVERAGE:
+        COVER_PROFILE.parent.mkdir(parents=True, exist_ok=True)
+        run_cmd.append(f'-test.coverprofile={COVER_PROFILE}')
+dropped = {'stdout': 0, 'stderr': 0}
+# Output forwarded from each stream, up to its cap.
+captured = {'stdout': 0, 'stderr': 0}
+test_events = []
+
+
+def drop(name, count):
+    # Counts the bytes of a chunk that did not fit under the stream's cap.
+    if count and KILL_ON_OUTPUT_LIMIT:
+        kill_group()
+    dropped[name] += count
+
+
+def pump(name, source, sink, limit):
+    # Forward output as it is produced so progress reaches the caller live, capped at the limit.
+    written = 0
+    while True:
+        chunk = os.read(source.fileno(), 65536)
+        if not chunk:
+            break
+        part = chunk[: max(0, limit - written)]
+        if part:
+            sink.write(part)
+            sink.flush()
+            written += len(part)
+            captured[name] += len(part)
+        drop(name, len(chunk) - len(part))
+
+
+def pump_test_events(name, source, sink, limit):
+    # test2json writes one JSON event per line. The events are kept for the test report and their
+    # Output text is forwarded, so stdout reads like `go test -v`.
+    written = 0
+    for line in source:
+        try:
+            event = json.loads(line)
+        except ValueError:
+            event = None
+        if isinstance(event, dict):
+            test_events.append(event)
+            chunk = event.get('Output', '').encode('utf8')
+        else:
+            chunk = line
+        part = chunk[: max(0, limit - written)]
+        if part:
+            sink.write(part)
+            sink.flush()
+            written += len(part)
+            captured[name] += len(part)
+        drop(name, len(chunk) - len(part))
+
+
+COVER_BLOCK = re.compile(r'^(.+):(\d+)\.\d+,(\d+)\.(\d+) (\d+) (\d+)$')
+
+
+def module_path():
+    match = re.search(r'^module\s+(\S+)', Path('go.mod').read_text(encoding='utf8', errors='replace'), re.M)
+    return match.group(1).strip('"') if match else ''
+
+
+def coverage_report():
+    # Line coverage from the cover profile, whose blocks name files by import path: a line counts
+    # as covered when any block spanning it ran, the way editors shade a profile. A block ending
+    # at column 1 stops short of the closing brace on its last line, and blocks without statements
+    # (an empty function body) have no lines to count.
+    if not COVER_PROFILE.exists():
+        return None
+    prefix = module_path() + '/'
+    lines = {}
+    for entry in COVER_PROFILE.read_text(encoding='utf8', errors='replace').splitlines()[1:]:
+        match = COVER_BLOCK.match(entry)
+        if not match:
+            continue
+        name, start, end, end_column, statements, count = match.groups()
+        if int(statements) == 0:
+            continue
+        name = name[len(prefix):] if name.startswith(prefix) else name
+        hits = lines.setdefault(name, {})
+        last = int(end) - 1 if int(end_column) <= 1 and int(end) > int(start) else int(end)
+        for line in range(int(start), last + 1):
+            hits[line] = hits.get(line, False) or int(count) > 0
+    files = {}
+    for name, hits in lines.items():
+        files[name] = ([line for line in sorted(hits) if hits[line]], [line for line in sorted(hits) if not hits[line]])
+    return summarize_coverage('go', files)
+
+
+def summarize_coverage(tool, files):
+    # files maps each file to its covered and missed line numbers.
+    def percent(covered, total):
+        return round(covered * 100 / total, 2) if total else 100.0
+
+    entries = []
+    for name in sorted(files):
+        covered, missed = files[name]
+        total = len(covered) + len(missed)
+        entries.append({
+            'file': name,
+            'covered_lines': len(covered),
+            'total_lines': total,
+            'percent': percent(len(covered), total),
+            'covered': covered,
+            'missed': missed
+        })
+    covered_lines = sum(entry['covered_lines'] for entry in entries)
+    total_lines = sum(entry['total_lines'] for entry in entries)
+    return {
+        'tool': tool,
+        'covered_lines': covered_lines,
+        'total_lines': total_lines,
+        'percent': percent(covered_lines, total_lines),
+        'files': entries
+    }
+
+
+def test_cases():
+    # Language-neutral test cases: name, passed/failed/skipped, duration and failure message.
+    output = {}
+    cases = []
+    for event in test_events:
+        name = event.get('Test')
+        if not name:
+            continue
+        action = event.get('Action')
+        if action == 'output':
+            text = event.get('Output', '')
+            if not text.startswith(('=== ', '--- ')):
+                output.setdefault(name, []).append(text)
+        elif action in ('pass', 'fail', 'skip'):
+            status = {'pass': 'passed', 'fail': 'failed', 'skip': 'skipped'}[action]
+            message = ''.join(output.get(name, [])).strip() if status != 'passed' else ''
+            cases.append({
+                'name': name,
+                'status': status,
+                'duration_ms': int(float(event.get('Elapsed') or 0) * 1000),
+                'message': message or None
+            })
+    return cases
+
+
+def feed_stdin(sink, payload):
+    # Write the caller-supplied stdin and close it so programs reading until EOF terminate.
+    try:
+        if payload:
+            sink.write(payload)
+    except BrokenPipeError:
+        pass
+    finally:
+        try:
+            sink.close()
+        except BrokenPipeError:
+            pass
+
+
+def relay_stdin(sink):
+    # Interactive sessions forward the caller's input as it arrives until they close it.
+    try:
+        if STDIN_REST:
+            sink.write(STDIN_REST)
+            sink.flush()
+        while True:
+            chunk = os.read(0, 65536)
+            if not chunk:
+                break
+            sink.write(chunk)
+            sink.flush()
+    except BrokenPipeError:
+        pass
+    finally:
+        try:
+            sink.close()
+        except BrokenPipeError:
+            pass
+
+
+def stdin_feeder(proc):
+    # The caller may never close a live session's stdin, so that relay must not block exit.
+    if SPEC.get('interactive'):
+        return threading.Thread(target=relay_stdin, args=(proc.stdin,), daemon=True)
+    return threading.Thread(target=feed_stdin, args=(proc.stdin, SPEC.get('stdin', '').encode('utf8')))
+
+
+def wait_program(proc, timeout=None):
+    # Reaps the program with wait4 to get its own rusage: RUSAGE_CHILDREN would also count the
+    # compiler and every helper process that ran before it. Raises TimeoutExpired like Popen.wait.
+    deadline = None if timeout is None else time.monotonic() + timeout
+    while True:
+        pid, status, rusage = os.wait4(proc.pid, 0 if deadline is None else os.WNOHANG)
+        if pid:
+            proc.returncode = os.waitstatus_to_exitcode(status)
+            return rusage
+        if time.monotonic() >= deadline:
+            raise subprocess.TimeoutExpired(proc.args, timeout)
+        time.sleep(0.005)
+
+
+# At the wall-clock limit the program gets SIGTERM and this long to flush its output and exit.
+KILL_GRACE = LIMITS.get('kill_grace_ms', 1000) / 1000
+
+
+def kill_group(signum=signal.SIGKILL):
+    # The program leads its own session, so this reaches every process it started as well.
+    try:
+        os.killpg(proc.pid, signum)
+    except ProcessLookupError:
+        pass
+
+
+def exit_signal(returncode):
+    # Name of the signal that ended the program, None when it exited by itself.
+    if returncode is None or returncode >= 0:
+        return None
+    try:
+        return signal.Signals(-returncode).name
+    except ValueError:
+        return f'SIG{-returncode}'
+
+
+def write_usage(start, end, rusage=None, limit_exceeded=None, timeout=None, signal_name=None):
+    # Figures of the program alone, from wait_program; zero when it never ran.
+    if pids_refused() > PIDS_REFUSED_AT_START:
+        # A refused fork explains whatever followed it, a timeout included.
+        limit_exceeded = 'processes'
+    user_ms = int(rusage.ru_utime * 1000) if rusage else 0
+    system_ms = int(rusage.ru_stime * 1000) if rusage else 0
+    usage = {
+        'wall_ms': int((end - start) * 1000),
+        'compile_ms': int(compile_time * 1000),
+        'cpu_ms': user_ms + system_ms,
+        'user_cpu_ms': user_ms,
+        'system_cpu_ms': system_ms,
+        # ru_maxrss is in KiB on Linux.
+        'max_rss_mb': int(rusage.ru_maxrss / 1024) if rusage else 0,
+        'limit_exceeded': limit_exceeded,
+        'timeout': timeout,
+        'signal': signal_name,
+        'dropped_bytes': dict(dropped),
+        'toolchain': TOOLCHAIN,
+        'compile': compile_phase,
+        'build_digest': BUILD_DIGEST,
+        'diagnostics': DIAGNOSTICS
+    }
+    if TEST_MODE:
+        usage['tests'] = test_cases()
+    if TEST_MODE and COVERAGE:
+        usage['coverage'] = coverage_report()
+    Path('usage.json').write_text(json.dumps(usage))
+    return usage
+
+
+if TEST_MODE and not Path('main').exists():
+    # `go test -c` writes no binary for a package without test files.
+    sys.stdout.write('no test files\n')
+    write_usage(time.time(), time.time())
+    sys.exit(0)
+
+# Tells the API that the build is done and the program is starting.
+Path('.run_started').touch()
 start = time.time()
-proc = subprocess.Popen(run_cmd, stdout=subprocess.PIPE, stderr=subprocess.PIPE, text=False)
+proc = subprocess.Popen(
+    run_cmd, stdin=subprocess.PIPE, stdout=subprocess.PIPE, stderr=subprocess.PIPE, text=False, start_new_session=True
+)
+stdin_feeder(proc).start()
+pumps = [
+    threading.Thread(
+        target=pump_test_events if TEST_MODE else pump,
+        args=('stdout', proc.stdout, sys.stdout.buffer, stream_limits['stdout'])
+    ),
+    threading.Thread(target=pump, args=('stderr', proc.stderr, sys.stderr.buffer, stream_limits['stderr'])),
+]
+for thread in pumps:
+    thread.start()
 
 try:
     timeout = LIMITS.get('timeout_ms', 5000) / 1000
-    stdout, stderr = proc.communicate(timeout=timeout)
+    rusage = wait_program(proc, timeout)
 except subprocess.TimeoutExpired:
-    proc.kill()
-    stdout, stderr = proc.communicate()
+    rusage, timeout_report = stop_in_two_stages(proc, KILL_GRACE, kill_group, wait_program, captured, pumps)
     sys.stderr.buffer.write(b'Execution timed out\n')
+    write_usage(start, time.time(), rusage, 'wall_time', timeout_report)
     sys.exit(124)
 
 end = time.time()
+# Background processes the program left behind would keep its output open.
+kill_group()
+for thread in pumps:
+    thread.join()
 
-# Truncate output if needed
-stdout = stdout[:int(LIMITS.get('max_output_bytes', 1024 * 1024))]
-stderr = stderr[:int(LIMITS.get('max_output_bytes', 1024 * 1024))]
-
-sys.stdout.buffer.write(stdout)
-if stderr:
-    sys.stderr.buffer.write(stderr)
-
-# Report usage including compilation time
-children_usage = resource.getrusage(resource.RUSAGE_CHILDREN)
-cpu_ms = int((children_usage.ru_utime + children_usage.ru_stime) * 1000)
-usage = {
-    'wall_ms': int((end - start) * 1000),
-    'compile_ms': int(compile_time * 1000),
-    'cpu_ms': cpu_ms,
-    'max_rss_mb': int(children_usage.ru_maxrss / 1024)
-}
-Path('usage.json').write_text(json.dumps(usage))
+limit_exceeded = None
+program_signal = exit_signal(proc.returncode)
+usage = write_usage(start, end, rusage, signal_name=program_signal)
+if proc.returncode == -signal.SIGKILL and oom_kills() > OOM_KILLS_AT_START:
+    limit_exceeded = 'memory'
+elif proc.returncode in (-signal.SIGXCPU, -signal.SIGKILL) and usage['cpu_ms'] >= cpu_quota_seconds * 1000:
+    limit_exceeded = 'cpu_time'
+elif dropped['stdout'] or dropped['stderr']:
+    limit_exceeded = 'output'
+if limit_exceeded:
+    write_usage(start, end, rusage, limit_exceeded, signal_name=program_signal)
 
-sys.exit(proc.returncode or 0)
+# A program ended by a signal exits as a shell reports it, 128 plus the signal's number.
+sys.exit(128 - proc.returncode if proc.returncode < 0 else proc.returncode)
@@ -0,0 +1,530 @@
+#!/usr/bin/env python3
+import hashlib
+import json
+import re
+import os
+import resource
+import shutil
+import signal
+import subprocess
+import sys
+import threading
+import time
+from pathlib import Path
+
+# runner_common.py sits next to the entrypoint in the image and in runners/ for the process backend.
+sys.path.append(str(Path(__file__).resolve().parent.parent))
+from runner_common import oom_kills, stop_in_two_stages
+
+
+def read_spec():
+    # The spec is the first line of stdin. It is read straight from fd 0 so that whatever follows,
+    # an interactive session's live input, is left for relay_stdin rather than buffered away.
+    data = b''
+    while b'\n' not in data:
+        chunk = os.read(0, 65536)
+        if not chunk:
+            break
+        data += chunk
+    line, _, rest = data.partition(b'\n')
+    return json.loads(line), rest
+
+
+SPEC, STDIN_REST = read_spec()
+# The process backend runs entrypoints directly on the host and passes its own workdir.
+WORKDIR = Path(SPEC.get('workdir') or '/work')
+LIMITS = SPEC.get('limits', {})
+# Compile mode stops after the build, without running the program.
+COMPILE_ONLY = SPEC.get('mode') == 'compile'
+DEPS = Path('/deps')
+M2_REPO = DEPS / 'm2'
+
+if SPEC.get('mode') == 'setup':
+    # Maven resolves dependencies in its own networked container with the cache mounted at
+    # /deps; the build itself later runs offline against that repository.
+    os.environ['HOME'] = '/tmp'
+    resolve = subprocess.run([
+        'mvn', '-q', '-B', '-f', str(DEPS / 'pom.xml'), f'-Dmaven.repo.local={M2_REPO}',
+        'dependency:go-offline'
+    ])
+    sys.exit(resolve.returncode)
+
+os.chdir(WORKDIR)
+
+# Setup environment
+env = {key: value for key, value in SPEC.get('env', {}).items()}
+os.environ.clear()
+os.environ.update(env)
+os.environ['HOME'] = str(WORKDIR)
+os.environ['TMPDIR'] = str(WORKDIR / 'tmp')
+os.environ['PATH'] = '/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin:/opt/java/openjdk/bin'
+# Derive the JVM heap from the memory limit, leaving headroom for metaspace, thread stacks and
+# the JIT so the JVM throws OutOfMemoryError before the container is OOM-killed.
+heap_mb = max(16, int(LIMITS.get('memory_mb', 256) * 0.6))
+JVM_FLAGS = [f'-Xmx{heap_mb}m', '-XX:+UseSerialGC', '-XX:TieredStopAtLevel=1', '-Xss1m']
+os.environ['MAVEN_OPTS'] = ' '.join(JVM_FLAGS)
+
+Path('tmp').mkdir(parents=True, exist_ok=True)
+Path('outputs').mkdir(parents=True, exist_ok=True)
+
+
+def toolchain_version():
+    try:
+        probe = subprocess.run(['java', '-version'], capture_output=True, timeout=5)
+        # java -version reports on stderr
+        lines = probe.stderr.decode('utf8', errors='replace').strip().splitlines()
+        return lines[0] if lines else None
+    except (OSError, subprocess.SubprocessError):
+        return None
+
+
+TOOLCHAIN = toolchain_version()
+
+# Set resource limits
+memory_bytes = int(LIMITS.get('memory_mb', 256) * 1024 * 1024)
+cpu_ms = int(LIMITS.get('cpu_ms', 5000))
+cpu_quota_seconds = max(1, cpu_ms // 1000 or 1)
+# RLIMIT_AS/RLIMIT_DATA are left unset: the JVM reserves far more address space than it uses,
+# so memory is bounded by -Xmx and the container limit instead.
+resource.setrlimit(resource.RLIMIT_FSIZE, (50 * 1024 * 1024, 50 * 1024 * 1024))
+# RLIMIT_NPROC backs up the container's --pids-limit where there is no pids cgroup.
+max_processes = int(LIMITS.get('max_processes', 256))
+resource.setrlimit(resource.RLIMIT_NPROC, (max_processes, max_processes))
+max_open_files = int(LIMITS.get('max_open_files', 1024))
+resource.setrlimit(resource.RLIMIT_NOFILE, (max_open_files, max_open_files))
+# Core dumps stay off unless the run asks for them, and never exceed what the host allows.
+core_bytes = int(LIMITS.get('core_dump_mb', 0)) * 1024 * 1024
+core_hard = resource.getrlimit(resource.RLIMIT_CORE)[1]
+if core_hard != resource.RLIM_INFINITY:
+    core_bytes = min(core_bytes, core_hard)
+resource.setrlimit(resource.RLIMIT_CORE, (core_bytes, core_bytes))
+resource.setrlimit(resource.RLIMIT_CPU, (cpu_quota_seconds, cpu_quota_seconds))
+
+
+def pids_refused():
+    # How many forks the container's cgroup pids controller has refused so far (cgroup v2, then v1).
+    try:
+        group = next((line[3:] for line in Path('/proc/self/cgroup').read_text().splitlines() if line.startswith('0::')), '')
+    except OSError:
+        group = ''
+    candidates = [Path('/sys/fs/cgroup') / group.lstrip('/') / 'pids.events', Path('/sys/fs/cgroup/pids/pids.events')]
+    for events in candidates:
+        try:
+            for line in events.read_text().splitlines():
+                key, _, value = line.partition(' ')
+                if key == 'max':
+                    return int(value)
+        except (OSError, ValueError):
+            continue
+    return 0
+
+
+# A fork refused from here on means the run hit max_processes.
+PIDS_REFUSED_AT_START = pids_refused()
+
+
+# An OOM kill from here on means the run hit memory_mb.
+OOM_KILLS_AT_START = oom_kills()
+
+BUILD_DIR = Path('.build')
+CACHED_COMPILE = {'exit_code': 0, 'duration_ms': 0, 'stdout': '', 'stderr': '', 'cached': True}
+
+
+def publish_build(outputs):
+    # Copy the compiled outputs into .build/ for the API's compilation cache. The digest is taken
+    # before any submission code runs, so the API can refuse a build the program rewrote.
+    BUILD_DIR.mkdir(exist_ok=True)
+    for source, name in outputs:
+        if Path(source).is_dir():
+            shutil.copytree(source, BUILD_DIR / name, dirs_exist_ok=True)
+        elif Path(source).exists():
+            shutil.copy2(source, BUILD_DIR / name)
+    names = sorted(p.relative_to(BUILD_DIR).as_posix() for p in BUILD_DIR.rglob('*') if p.is_file())
+    digest = hashlib.sha256()
+    for name in names:
+        contents = hashlib.sha256((BUILD_DIR / name).read_bytes()).hexdigest()
+        digest.update(f'{name}\0{contents}\n'.encode('utf8'))
+    return digest.hexdigest()
+
+
+def restore_build(outputs):
+    # The API restored this exact build from its compilation cache into .build/.
+    for name, dest in outputs:
+        if (BUILD_DIR / name).is_dir():
+            shutil.copytree(BUILD_DIR / name, dest, dirs_exist_ok=True)
+        elif (BUILD_DIR / name).exists():
+            shutil.copy2(BUILD_DIR / name, dest)
+
+# javac prints `Main.java:3: error: cannot find symbol`, then the source line and a caret under
+# the column; Maven prints `[ERROR] /work/src/main/java/Main.java:[3,28] cannot find symbol`.
+JAVAC_MESSAGE = re.compile(r'^(.+\.java):(\d+): (error|warning): (.*)$')
+MAVEN_MESSAGE = re.compile(r'^\[(ERROR|WARNING)\] (.+\.java):\[(\d+),(\d+)\] (.*)$')
+# Details under a message, such as `  symbol:   variable x`, with Maven's prefix when present.
+MESSAGE_DETAIL = re.compile(r'^(?:\[(?:ERROR|WARNING)\])?\s{2,}(\w+:\s.*)$')
+
+
+def relative_path(file):
+    # Diagnostics name files the way the submission did.
+    try:
+        return Path(file).resolve().relative_to(WORKDIR.resolve()).as_posix()
+    except ValueError:
+        return file
+
+
+def compile_diagnostics(output):
+    found = []
+    lines = output.decode('utf8', errors='replace').splitlines()
+    for index, line in enumerate(lines):
+        javac = JAVAC_MESSAGE.match(line)
+        maven = MAVEN_MESSAGE.match(line)
+        if javac:
+            file, line_number, severity, message = javac.groups()
+            caret = lines[index + 2] if index + 2 < len(lines) else ''
+            column = caret.index('^') + 1 if caret.strip() == '^' else None
+            details = lines[index + 3:]
+        elif maven:
+            severity, file, line_number, column, message = maven.groups()
+            severity = severity.lower()
+            details = lines[index + 1:]
+        else:
+            continue
+        # javac prefixes lint warnings with their -Xlint key, e.g. `[removal]`.
+        lint = re.match(r'^\[([\w-]+)\] ', message)
+        if lint:
+            message = message[lint.end():]
+        for detail in details:
+            match = MESSAGE_DETAIL.match(detail)
+            if not match:
+                break
+            message += '\n' + match.group(1)
+        item = {
+            'source': 'compile',
+            'file': relative_path(file),
+            'line': int(line_number),
+            'column': int(column) if column else None,
+            'code': lint.group(1) if lint else None,
+            'severity': severity,
+            'message': message
+        }
+        # Maven repeats every error in its build failure summary.
+        if item not in found:
+            found.append(item)
+    return found
+
+
+# COMPILATION PHASE
+output_limit = int(LIMITS.get('max_output_bytes', 1024 * 1024))
+# Each stream has its own cap, max_output_bytes unless set. With on_output_limit=kill the program
+# is stopped at the first byte past a cap instead of having the rest of its output discarded.
+stream_limits = {
+    'stdout': int(LIMITS.get('max_stdout_bytes', output_limit)),
+    'stderr': int(LIMITS.get('max_stderr_bytes', output_limit)),
+}
+KILL_ON_OUTPUT_LIMIT = SPEC.get('on_output_limit') == 'kill'
+compile_start = time.time()
+MAVEN = Path('pom.xml').exists()
+PREBUILT = bool(SPEC.get('prebuilt')) and (BUILD_DIR / 'classes').is_dir()
+if PREBUILT:
+    restore_build([('classes', 'target/classes' if MAVEN else 'tmp/classes'), ('classpath.txt', 'tmp/classpath.txt')])
+    compile_phase = CACHED_COMPILE
+    BUILD_DIGEST = None
+    DIAGNOSTICS = []
+else:
+    if MAVEN:
+        # Maven projects build offline against the dependency repository resolved during setup.
+        compile_cmd = [
+            'mvn', '-q', '-B', '-o', f'-Dmaven.repo.local={M2_REPO}', 'compile',
+            'dependency:build-classpath', '-Dmdep.outputFile=tmp/classpath.txt'
+        ]
+    else:
+        # Single- and multi-file submissions compile every .java file in the workdir.
+        Path('tmp/classes').mkdir(parents=True, exist_ok=True)
+        compile_cmd = ['javac', '-J' + JVM_FLAGS[0], '-d', 'tmp/classes', *sorted(str(p) for p in Path('.').rglob('*.java') if not str(p).startswith(('tmp/', 'inputs/', 'outputs/')))]
+
+    compile_proc = subprocess.Popen(
+        compile_cmd, 
+        stdout=subprocess.PIPE, 
+        stderr=subprocess.PIPE,
+        text=False
+    )
+
+    def compile_report(exit_code, stdout, stderr):
+        # Compile output is reported separately from the program's streams so callers can tell
+        # build failures from runtime failures.
+        return {
+            'exit_code': exit_code,
+            'duration_ms': int((time.time() - compile_start) * 1000),
+            'stdout': stdout[:output_limit].decode('utf8', errors='replace'),
+            'stderr': stderr[:output_limit].decode('utf8', errors='replace')
+        }
+
+    try:
+        # JVM startup makes builds slower than most toolchains; give compilation 30 seconds max
+        compile_stdout, compile_stderr = compile_proc.communicate(timeout=30)
+    except subprocess.TimeoutExpired:
+        compile_proc.kill()
+        compile_stdout, compile_stderr = compile_proc.communicate()
+        sys.stderr.buffer.write(b'Compilation timed out\n')
+        Path('usage.json').write_text(json.dumps({
+            'wall_ms': 0,
+            'compile_ms': int((time.time() - compile_start) * 1000),
+            'cpu_ms': 0,
+            'max_rss_mb': 0,
+            'limit_exceeded': 'wall_time',
+            'toolchain': TOOLCHAIN,
+            'compile': compile_report(None, compile_stdout, compile_stderr),
+            'diagnostics': compile_diagnostics(compile_stdout + compile_stderr)
+        }))
+        sys.exit(124)
+
+    compile_phase = compile_report(compile_proc.returncode, compile_stdout, compile_stderr)
+    # Maven reports build errors on stdout
+    DIAGNOSTICS = compile_diagnostics(compile_stdout + compile_stderr)
+
+    # Check compilation result
+    if compile_proc.returncode != 0:
+        # Compilation failed - report compilation errors
+        sys.stderr.buffer.write(b'Compilation failed:\n')
+        # Maven reports build errors on stdout
+        sys.stderr.buffer.write((compile_stdout + compile_stderr)[:output_limit])
+        Path('usage.json').write_text(json.dumps({
+            'wall_ms': 0,
+            'compile_ms': compile_phase['duration_ms'],
+            'cpu_ms': 0,
+            'max_rss_mb': 0,
+            'limit_exceeded': None,
+            'toolchain': TOOLCHAIN,
+            'compile': compile_phase,
+            'diagnostics': DIAGNOSTICS
+        }))
+        sys.exit(1)
+    BUILD_DIGEST = publish_build([('target/classes' if MAVEN else 'tmp/classes', 'classes'), ('tmp/classpath.txt', 'classpath.txt')])
+
+compile_time = time.time() - compile_start
+
+if COMPILE_ONLY:
+    Path('usage.json').write_text(json.dumps({
+        'wall_ms': 0,
+        'compile_ms': int(compile_time * 1000),
+        'cpu_ms': 0,
+        'max_rss_mb': 0,
+        'limit_exceeded': None,
+        'toolchain': TOOLCHAIN,
+        'compile': compile_phase,
+        'diagnostics': DIAGNOSTICS,
+        'build_digest': BUILD_DIGEST
+    }))
+    sys.exit(0)
+
+
+def main_class():
+    # Maven projects may name their entry point via <mainClass> or <exec.mainClass>.
+    if MAVEN:
+        match = re.search(r'<(?:exec\.)?mainClass>\s*([\w.$]+)\s*</', Path('pom.xml').read_text())
+        if match:
+            return match.group(1)
+    return 'Main'
+
+
+# EXECUTION PHASE
+if MAVEN:
+    classpath = 'target/classes'
+    if Path('tmp/classpath.txt').exists():
+        classpath += ':' + Path('tmp/classpath.txt').read_text().strip()
+else:
+    classpath = 'tmp/classes'
+run_cmd = ['java', *JVM_FLAGS, '-cp', classpath, main_class()] + SPEC.get('args', [])
+dropped = {'stdout': 0, 'stderr': 0}
+# Output forwarded from each stream, up to its cap.
+captured = {'stdout': 0, 'stderr': 0}
+
+
+def drop(name, count):
+    # Counts the bytes of a chunk that did not fit under the stream's cap.
+    if count and KILL_ON_OUTPUT_LIMIT:
+        kill_group()
+    dropped[name] += count
+
+
+def pump(name, source, sink, limit):
+    # Forward output as it is produced so progress reaches the caller live, capped at the limit.
+    written = 0
+    while True:
+        chunk = os.read(source.fileno(), 65536)
+        if not chunk:
+            break
+        part = chunk[: max(0, limit - written)]
+        if part:
+            sink.write(part)
+            sink.flush()
+            written += len(part)
+            captured[name] += len(part)
+        drop(name, len(chunk) - len(part))
+
+
+def feed_stdin(sink, payload):
+    # Write the caller-supplied stdin and close it so programs reading until EOF terminate.
+    try:
+        if payload:
+            sink.write(payload)
+    except BrokenPipeError:
+        pass
+    finally:
+        try:
+            sink.close()
+        except BrokenPipeError:
+            pass
+
+
+def relay_stdin(sink):
+    # Interactive sessions forward the caller's input as it arrives until they close it.
+    try:
+        if STDIN_REST:
+            sink.write(STDIN_REST)
+            sink.flush()
+        while True:
+            chunk = os.read(0, 65536)
+            if not chunk:
+                break
+            sink.write(chunk)
+            sink.flush()
+    except BrokenPipeError:
+        pass
+    finally:
+        try:
+            sink.close()
+        except BrokenPipeError:
+            pass
+
+
+def stdin_feeder(proc):
+    # The caller may never close a live session's stdin, so that relay must not block exit.
+    if SPEC.get('interactive'):
+        return threading.Thread(target=relay_stdin, args=(proc.stdin,), daemon=True)
+    return threading.Thread(target=feed_stdin, args=(proc.stdin, SPEC.get('stdin', '').encode('utf8')))
+
+
+def wait_program(proc, timeout=None):
+    # Reaps the program with wait4 to get its own rusage: RUSAGE_CHILDREN would also count the
+    # compiler and every helper process that ran before it. Raises TimeoutExpired like Popen.wait.
+    deadline = None if timeout is None else time.monotonic() + timeout
+    while True:
+        pid, status, rusage = os.wait4(proc.pid, 0 if deadline is None else os.WNOHANG)
+        if pid:
+            proc.returncode = os.waitstatus_to_exitcode(status)
+            return rusage
+        if time.monotonic() >= deadline:
+            raise subprocess.TimeoutExpired(proc.args, timeout)
+        time.sleep(0.005)
+
+
+# At the wall-clock limit the program gets SIGTERM and this long to flush its output and exit.
+KILL_GRACE = LIMITS.get('kill_grace_ms', 1000) / 1000
+
+
+def kill_group(signum=signal.SIGKILL):
+    # The program leads its own session, so this reaches every process it started as well.
+    try:
+        os.killpg(proc.pid, signum)
+    except ProcessLookupError:
+        pass
+
+
+def exit_signal(returncode):
+    # Name of the signal that ended the program, None when it exited by itself.
+    if returncode is None or returncode >= 0:
+        return None
+    try:
+        return signal.Signals(-returncode).name
+    except ValueError:
+        return f'SIG{-returncode}'
+
+
+def write_usage(start, end, rusage=None, limit_exceeded=None, timeout=None, signal_name=None):
+    # Figures of the program alone, from wait_program; zero when it never ran.
+    if pids_refused() > PIDS_REFUSED_AT_START:
+        # A refused fork explains whatever followed it, a timeout included.
+        limit_exceeded = 'processes'
+    user_ms = int(rusage.ru_utime * 1000) if rusage else 0
+    system_ms = int(rusage.ru_stime * 1000) if rusage else 0
+    usage = {
+        'wall_ms': int((end - start) * 1000),
+        'compile_ms': int(compile_time * 1000),
+        'cpu_ms': user_ms + system_ms,
+        'user_cpu_ms': user_ms,
+        'system_cpu_ms': system_ms,
+        # ru_maxrss is in KiB on Linux.
+        'max_rss_mb': int(rusage.ru_maxrss / 1024) if rusage else 0,
+        'limit_exceeded': limit_exceeded,
+        'timeout': timeout,
+        'signal': signal_name,
+        'dropped_bytes': dict(dropped),
+        'toolchain': TOOLCHAIN,
+        'compile': compile_phase,
+        'diagnostics': DIAGNOSTICS,
+        'build_digest': BUILD_DIGEST
+    }
+    Path('usage.json').write_text(json.dumps(usage))
+    return usage
+
+
+def fixed_clock(env):
+    # libfaketime settings that start the program's wall clock at, or hold it to, the time the run
+    # asked for in EXECUTOR_FAKE_TIME. The monotonic clock stays real, so sleeps and the time limit
+    # behave as usual.
+    fake_time = env.pop('EXECUTOR_FAKE_TIME', None)
+    if not fake_time:
+        return {}
+    candidates = [*Path('/usr/lib').glob('*/faketime/libfaketime.so.1'), Path('/usr/lib/faketime/libfaketime.so.1')]
+    library = next((path for path in candidates if path.exists()), None)
+    if library is None:
+        sys.stderr.write('a fixed clock needs libfaketime, which this runner image does not have\n')
+        sys.exit(1)
+    return {'LD_PRELOAD': str(library), 'FAKETIME': fake_time, 'FAKETIME_DONT_FAKE_MONOTONIC': '1'}
+
+
+# Only the program runs against a fixed clock; the build kept the real one.
+os.environ.update(fixed_clock(os.environ))
+# Tells the API that the build is done and the program is starting.
+Path('.run_started').touch()
+start = time.time()
+proc = subprocess.Popen(
+    run_cmd, stdin=subprocess.PIPE, stdout=subprocess.PIPE, stderr=subprocess.PIPE, text=False, start_new_session=True
+)
+stdin_feeder(proc).start()
+pumps = [
+    threading.Thread(target=pump, args=('stdout', proc.stdout, sys.stdout.buffer, stream_limits['stdout'])),
+    threading.Thread(target=pump, args=('stderr', proc.stderr, sys.stderr.buffer, stream_limits['stderr'])),
+]
+for thread in pumps:
+    thread.start()
+
+try:
+    timeout = LIMITS.get('timeout_ms', 5000) / 1000
+    rusage = wait_program(proc, timeout)
+except subprocess.TimeoutExpired:
+    rusage, timeout_report = stop_in_two_stages(proc, KILL_GRACE, kill_group, wait_program, captured, pumps)
+    sys.stderr.buffer.write(b'Execution timed out\n')
+    write_usage(start, time.time(), rusage, 'wall_time', timeout_report)
+    sys.exit(124)
+
+end = time.time()
+# Background processes the program left behind would keep its output open.
+kill_group()
+for thread in pumps:
+    thread.join()
+
+limit_exceeded = None
+program_signal = exit_signal(proc.returncode)
+usage = write_usage(start, end, rusage, signal_name=program_signal)
+if proc.returncode == -signal.SIGKILL and oom_kills() > OOM_KILLS_AT_START:
+    limit_exceeded = 'memory'
+elif proc.returncode in (-signal.SIGXCPU, -signal.SIGKILL) and usage['cpu_ms'] >= cpu_quota_seconds * 1000:
+    limit_exceeded = 'cpu_time'
+elif dropped['stdout'] or dropped['stderr']:
+    limit_exceeded = 'output'
+if limit_exceeded:
+    write_usage(start, end, rusage, limit_exceeded, signal_name=program_signal)
+
+# A program ended by a signal exits as a shell reports it, 128 plus the signal's number.
+sys.exit(128 - proc.returncode if proc.returncode < 0 else proc.returncode)
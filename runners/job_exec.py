@@ -0,0 +1,191 @@
+#!/usr/bin/env python3
+# Runs the runner entrypoint inside a Windows job object under a restricted token. The process
+# sandbox backend uses this on Windows in place of seccomp_exec.py:
+#
+#   job_exec.py '{"workdir": "C:\\runs\\run_1", "memory_mb": 256, "max_processes": 32, "cpu_ms": 5000}' cmd args...
+#
+# The job caps committed memory, live processes and CPU time across everything the entrypoint
+# starts, and kills all of it once this launcher exits or is terminated. The token drops every
+# privilege and runs at low integrity, so outside the work directory, which is relabelled low
+# here, the run cannot write to the files of the user the API runs as.
+import ctypes
+import json
+import subprocess
+import sys
+from ctypes import wintypes
+
+kernel32 = ctypes.WinDLL('kernel32', use_last_error=True)
+advapi32 = ctypes.WinDLL('advapi32', use_last_error=True)
+# Handles are pointer-sized, which ctypes' default int would truncate.
+kernel32.CreateJobObjectW.restype = wintypes.HANDLE
+kernel32.GetCurrentProcess.restype = wintypes.HANDLE
+kernel32.GetStdHandle.restype = wintypes.HANDLE
+kernel32.SetInformationJobObject.argtypes = [wintypes.HANDLE, ctypes.c_int, ctypes.c_void_p, wintypes.DWORD]
+kernel32.AssignProcessToJobObject.argtypes = [wintypes.HANDLE, wintypes.HANDLE]
+kernel32.TerminateProcess.argtypes = [wintypes.HANDLE, wintypes.UINT]
+kernel32.ResumeThread.argtypes = [wintypes.HANDLE]
+kernel32.WaitForSingleObject.argtypes = [wintypes.HANDLE, wintypes.DWORD]
+kernel32.GetExitCodeProcess.argtypes = [wintypes.HANDLE, ctypes.POINTER(wintypes.DWORD)]
+advapi32.OpenProcessToken.argtypes = [wintypes.HANDLE, wintypes.DWORD, ctypes.POINTER(wintypes.HANDLE)]
+
+TOKEN_ALL_ACCESS = 0xF01FF
+DISABLE_MAX_PRIVILEGE = 0x1
+LUA_TOKEN = 0x4
+TOKEN_INTEGRITY_LEVEL = 25
+SE_GROUP_INTEGRITY = 0x20
+LOW_INTEGRITY_SID = 'S-1-16-4096'
+
+JOB_OBJECT_BASIC_UI_RESTRICTIONS = 4
+JOB_OBJECT_EXTENDED_LIMIT_INFORMATION = 9
+JOB_OBJECT_LIMIT_ACTIVE_PROCESS = 0x8
+JOB_OBJECT_LIMIT_JOB_TIME = 0x4
+JOB_OBJECT_LIMIT_JOB_MEMORY = 0x200
+JOB_OBJECT_LIMIT_DIE_ON_UNHANDLED_EXCEPTION = 0x400
+JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE = 0x2000
+# Desktop, display settings, clipboard, global atoms, user handles and system parameters.
+JOB_OBJECT_UILIMIT_ALL = 0xFF
+
+CREATE_SUSPENDED = 0x4
+CREATE_UNICODE_ENVIRONMENT = 0x400
+STARTF_USESTDHANDLES = 0x100
+STD_HANDLES = (-10, -11, -12)
+INFINITE = 0xFFFFFFFF
+
+
+class IoCounters(ctypes.Structure):
+    _fields_ = [(name, ctypes.c_ulonglong) for name in (
+        'ReadOperationCount', 'WriteOperationCount', 'OtherOperationCount',
+        'ReadTransferCount', 'WriteTransferCount', 'OtherTransferCount')]
+
+
+class BasicLimitInformation(ctypes.Structure):
+    _fields_ = [
+        ('PerProcessUserTimeLimit', ctypes.c_longlong),
+        ('PerJobUserTimeLimit', ctypes.c_longlong),
+        ('LimitFlags', wintypes.DWORD),
+        ('MinimumWorkingSetSize', ctypes.c_size_t),
+        ('MaximumWorkingSetSize', ctypes.c_size_t),
+        ('ActiveProcessLimit', wintypes.DWORD),
+        ('Affinity', ctypes.c_size_t),
+        ('PriorityClass', wintypes.DWORD),
+        ('SchedulingClass', wintypes.DWORD),
+    ]
+
+
+class ExtendedLimitInformation(ctypes.Structure):
+    _fields_ = [
+        ('BasicLimitInformation', BasicLimitInformation),
+        ('IoInfo', IoCounters),
+        ('ProcessMemoryLimit', ctypes.c_size_t),
+        ('JobMemoryLimit', ctypes.c_size_t),
+        ('PeakProcessMemoryUsed', ctypes.c_size_t),
+        ('PeakJobMemoryUsed', ctypes.c_size_t),
+    ]
+
+
+class SidAndAttributes(ctypes.Structure):
+    _fields_ = [('Sid', ctypes.c_void_p), ('Attributes', wintypes.DWORD)]
+
+
+class StartupInfo(ctypes.Structure):
+    _fields_ = [
+        ('cb', wintypes.DWORD), ('lpReserved', wintypes.LPWSTR), ('lpDesktop', wintypes.LPWSTR),
+        ('lpTitle', wintypes.LPWSTR), ('dwX', wintypes.DWORD), ('dwY', wintypes.DWORD),
+        ('dwXSize', wintypes.DWORD), ('dwYSize', wintypes.DWORD), ('dwXCountChars', wintypes.DWORD),
+        ('dwYCountChars', wintypes.DWORD), ('dwFillAttribute', wintypes.DWORD), ('dwFlags', wintypes.DWORD),
+        ('wShowWindow', wintypes.WORD), ('cbReserved2', wintypes.WORD), ('lpReserved2', ctypes.c_void_p),
+        ('hStdInput', wintypes.HANDLE), ('hStdOutput', wintypes.HANDLE), ('hStdError', wintypes.HANDLE),
+    ]
+
+
+class ProcessInformation(ctypes.Structure):
+    _fields_ = [
+        ('hProcess', wintypes.HANDLE), ('hThread', wintypes.HANDLE),
+        ('dwProcessId', wintypes.DWORD), ('dwThreadId', wintypes.DWORD),
+    ]
+
+
+def check(result, call):
+    if not result:
+        raise ctypes.WinError(ctypes.get_last_error(), f'{call} failed')
+    return result
+
+
+def create_job(spec):
+    job = check(kernel32.CreateJobObjectW(None, None), 'CreateJobObject')
+    info = ExtendedLimitInformation()
+    basic = info.BasicLimitInformation
+    basic.LimitFlags = (
+        JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE | JOB_OBJECT_LIMIT_DIE_ON_UNHANDLED_EXCEPTION
+        | JOB_OBJECT_LIMIT_ACTIVE_PROCESS | JOB_OBJECT_LIMIT_JOB_MEMORY | JOB_OBJECT_LIMIT_JOB_TIME
+    )
+    basic.ActiveProcessLimit = spec['max_processes']
+    # User-mode CPU time of the whole job, in 100 ns units.
+    basic.PerJobUserTimeLimit = spec['cpu_ms'] * 10000
+    info.JobMemoryLimit = spec['memory_mb'] * 1024 * 1024
+    check(kernel32.SetInformationJobObject(
+        job, JOB_OBJECT_EXTENDED_LIMIT_INFORMATION, ctypes.byref(info), ctypes.sizeof(info)), 'SetInformationJobObject')
+    ui = wintypes.DWORD(JOB_OBJECT_UILIMIT_ALL)
+    check(kernel32.SetInformationJobObject(
+        job, JOB_OBJECT_BASIC_UI_RESTRICTIONS, ctypes.byref(ui), ctypes.sizeof(ui)), 'SetInformationJobObject')
+    return job
+
+
+def restricted_token():
+    token = wintypes.HANDLE()
+    check(advapi32.OpenProcessToken(kernel32.GetCurrentProcess(), TOKEN_ALL_ACCESS, ctypes.byref(token)), 'OpenProcessToken')
+    restricted = wintypes.HANDLE()
+    check(advapi32.CreateRestrictedToken(
+        token, DISABLE_MAX_PRIVILEGE | LUA_TOKEN, 0, None, 0, None, 0, None, ctypes.byref(restricted)), 'CreateRestrictedToken')
+    sid = ctypes.c_void_p()
+    check(advapi32.ConvertStringSidToSidW(LOW_INTEGRITY_SID, ctypes.byref(sid)), 'ConvertStringSidToSid')
+    label = SidAndAttributes(sid, SE_GROUP_INTEGRITY)
+    check(advapi32.SetTokenInformation(
+        restricted, TOKEN_INTEGRITY_LEVEL, ctypes.byref(label), ctypes.sizeof(label) + advapi32.GetLengthSid(sid)), 'SetTokenInformation')
+    return restricted
+
+
+def launch(spec, command):
+    # A low-integrity process may only write to objects labelled low, so the work directory gets
+    # that label, inherited by everything created under it.
+    subprocess.run(['icacls', spec['workdir'], '/setintegritylevel', '(OI)(CI)low'], check=True, stdout=subprocess.DEVNULL)
+    job = create_job(spec)
+    token = restricted_token()
+    startup = StartupInfo()
+    startup.cb = ctypes.sizeof(startup)
+    startup.dwFlags = STARTF_USESTDHANDLES
+    startup.hStdInput, startup.hStdOutput, startup.hStdError = (kernel32.GetStdHandle(handle) for handle in STD_HANDLES)
+    process = ProcessInformation()
+    # Started suspended so that it is in the job before it can run anything of its own.
+    check(advapi32.CreateProcessAsUserW(
+        token, None, subprocess.list2cmdline(command), None, None, True,
+        CREATE_SUSPENDED | CREATE_UNICODE_ENVIRONMENT, None, spec['workdir'],
+        ctypes.byref(startup), ctypes.byref(process)), 'CreateProcessAsUser')
+    try:
+        check(kernel32.AssignProcessToJobObject(job, process.hProcess), 'AssignProcessToJobObject')
+    except OSError:
+        kernel32.TerminateProcess(process.hProcess, 126)
+        raise
+    kernel32.ResumeThread(process.hThread)
+    kernel32.WaitForSingleObject(process.hProcess, INFINITE)
+    code = wintypes.DWORD()
+    kernel32.GetExitCodeProcess(process.hProcess, ctypes.byref(code))
+    # Exiting closes the job handle, which kills whatever the entrypoint left running.
+    return code.value
+
+
+def main():
+    if len(sys.argv) < 3:
+        sys.stderr.write('usage: job_exec.py <limits-json> <command> [args...]\n')
+        sys.exit(2)
+    try:
+        code = launch(json.loads(sys.argv[1]), sys.argv[2:])
+    except (OSError, KeyError, ValueError, subprocess.CalledProcessError) as err:
+        # Never fall back to running the entrypoint unconfined.
+        sys.stderr.write(f'job: {err}\n')
+        sys.exit(126)
+    sys.exit(code)
+
+
+if __name__ == '__main__':
+    main()
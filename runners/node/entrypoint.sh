@@ -1,11 +1,67 @@
 #!/usr/bin/env node
-const { readFileSync, mkdirSync, writeFileSync } = require('fs');
+const { existsSync, readFileSync, readSync, readdirSync, mkdirSync, statSync, symlinkSync, writeFileSync } = require('fs');
 const { chdir, env, exit } = require('process');
-const { spawn } = require('child_process');
+const { spawn, spawnSync } = require('child_process');
+const { createHash } = require('crypto');
+const { constants } = require('os');
+const path = require('path');
 
-const spec = JSON.parse(readFileSync(0, 'utf8'));
+// Packages installed with `npm install -g`, next to the node binary in the image.
+const GLOBAL_MODULES = path.join(path.dirname(process.execPath), '..', 'lib', 'node_modules');
+function loadTypescript() {
+  try {
+    return require(path.join(GLOBAL_MODULES, 'typescript'));
+  } catch (_) {
+    return null;
+  }
+}
+// Containers started for TypeScript runs load the compiler before the spec arrives, so a warm
+// one has it ready by the time its run does.
+let typescript = env.RUNNER_PRELOAD === 'typescript' ? loadTypescript() : undefined;
+
+// The spec is the first line of stdin; in interactive sessions whatever follows is the program's
+// live input, so read only up to the newline and keep the remainder for the child.
+function readSpec() {
+  const chunks = [];
+  const buffer = Buffer.alloc(65536);
+  for (;;) {
+    let n;
+    try {
+      n = readSync(0, buffer, 0, buffer.length, null);
+    } catch (err) {
+      if (err.code === 'EAGAIN') continue;
+      throw err;
+    }
+    if (n === 0) break;
+    chunks.push(Buffer.from(buffer.subarray(0, n)));
+    if (buffer.subarray(0, n).includes(10)) break;
+  }
+  const data = Buffer.concat(chunks);
+  const newline = data.indexOf(10);
+  const end = newline === -1 ? data.length : newline;
+  return [JSON.parse(data.subarray(0, end).toString('utf8')), data.subarray(end + 1)];
+}
+
+const [spec, stdinRest] = readSpec();
 const limits = spec.limits || {};
-chdir('/work');
+// Compile mode stops after the TypeScript build and check mode only parses (JavaScript) or
+// type-checks (TypeScript) the sources; neither gets as far as running the program.
+const mode = spec.mode || 'run';
+
+if (spec.mode === 'setup') {
+  // Dependency installation runs in its own networked container with the cache mounted at
+  // /deps. Lifecycle scripts are skipped so no submission-controlled code runs with network.
+  const install = spawnSync('npm', ['install', '--no-audit', '--no-fund', '--ignore-scripts'], {
+    cwd: '/deps',
+    stdio: 'inherit',
+    env: { ...env, HOME: '/tmp', npm_config_cache: '/tmp/npm-cache' }
+  });
+  exit(install.status === null ? 1 : install.status);
+}
+
+// The process backend runs entrypoints directly on the host and passes its own workdir.
+const workdir = spec.workdir || '/work';
+chdir(workdir);
 
 const allowedEnv = spec.env || {};
 for (const key of Object.keys(process.env)) {
@@ -14,13 +70,18 @@ for (const key of Object.keys(process.env)) {
 for (const [key, value] of Object.entries(allowedEnv)) {
   env[key] = value;
 }
-env['HOME'] = '/work';
-env['TMPDIR'] = '/work/tmp';
+env['HOME'] = workdir;
+env['TMPDIR'] = `${workdir}/tmp`;
 env['PATH'] = '/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin';
 
 mkdirSync('tmp', { recursive: true });
 mkdirSync('outputs', { recursive: true });
 
+// Expose the cached dependency layer (mounted read-only) to both require() and import.
+if (existsSync('/deps/node_modules') && !existsSync('node_modules')) {
+  symlinkSync('/deps/node_modules', 'node_modules', 'dir');
+}
+
 const HZ = 100; // Linux clock ticks per second (typical)
 function readCpuJiffies(pid) {
   try {
@@ -31,7 +92,7 @@ function readCpuJiffies(pid) {
     const utime = parseInt(rest[11] || '0', 10);
     const stime = parseInt(rest[12] || '0', 10);
     if (Number.isNaN(utime) || Number.isNaN(stime)) return null;
-    return utime + stime;
+    return { utime, stime };
   } catch (_) {
     return null;
   }
@@ -47,15 +108,327 @@ function readVmHWMKb(pid) {
   }
 }
 
-const args = ['main.js', '--', ...((spec.args || []))];
-const child = spawn('node', args, { stdio: ['ignore', 'pipe', 'pipe'] });
-const stdoutChunks = [];
-const stderrChunks = [];
-child.stdout.on('data', (chunk) => stdoutChunks.push(chunk));
-child.stderr.on('data', (chunk) => stderrChunks.push(chunk));
+// How many forks the container's cgroup pids controller has refused so far (cgroup v2, then v1).
+function pidsRefused() {
+  let group = '';
+  try {
+    group = readFileSync('/proc/self/cgroup', 'utf8').split('\n').find((line) => line.startsWith('0::'))?.slice(3) || '';
+  } catch (_) {
+    // No cgroup information; only the v1 path is left to try.
+  }
+  for (const events of [`/sys/fs/cgroup${group.replace(/\/$/, '')}/pids.events`, '/sys/fs/cgroup/pids/pids.events']) {
+    try {
+      const match = readFileSync(events, 'utf8').match(/^max (\d+)$/m);
+      if (match) return parseInt(match[1], 10);
+    } catch (_) {
+      // Not this cgroup version.
+    }
+  }
+  return 0;
+}
+
+// How many processes the kernel OOM killer has killed in the container's memory cgroup so far,
+// from the oom_kills.sh every runner shares: next to this file in the image, in runners/ for the
+// process backend.
+const OOM_KILLS_SCRIPT = [__dirname, path.dirname(__dirname)].map((dir) => path.join(dir, 'oom_kills.sh')).find(existsSync);
+function oomKills() {
+  const count = OOM_KILLS_SCRIPT ? spawnSync('/bin/sh', [OOM_KILLS_SCRIPT], { encoding: 'utf8', timeout: 5000 }).stdout : '';
+  return parseInt(count, 10) || 0;
+}
+
+const outputLimit = limits.max_output_bytes || 1024 * 1024;
+// Each stream has its own cap, max_output_bytes unless set. With on_output_limit=kill the program
+// is stopped at the first byte past a cap instead of having the rest of its output discarded.
+const streamLimits = {
+  stdout: limits.max_stdout_bytes || outputLimit,
+  stderr: limits.max_stderr_bytes || outputLimit
+};
+const killOnOutputLimit = spec.on_output_limit === 'kill';
+
+// TypeScript entry points (main.ts without a main.js) are type-checked and compiled into .build/,
+// which the API's compilation cache restores for identical submissions. A tsc from the
+// submission's package.json is used when present, the image's compiler otherwise. The build
+// carries source maps, and the program runs with them, so stack traces point into main.ts.
+const BUILD_DIR = '.build';
+const CACHED_COMPILE = { exit_code: 0, duration_ms: 0, stdout: '', stderr: '', cached: true };
+
+// tsc ignores tsconfig.json when given files to compile, so a submission with one is built as its
+// project, as compileInProcess does, with the module and target filled in where it sets none.
+function compileWithTsc(emit) {
+  const output = emit ? ['--outDir', BUILD_DIR, '--rootDir', '.', '--sourceMap'] : ['--noEmit'];
+  let input = ['--module', 'commonjs', '--target', 'es2020', 'main.ts'];
+  let moduleType = 'commonjs';
+  if (existsSync('tsconfig.json')) {
+    const shown = spawnSync('node_modules/.bin/tsc', ['-p', 'tsconfig.json', '--showConfig'], { encoding: 'utf8', timeout: 10000 });
+    let compilerOptions = {};
+    try {
+      compilerOptions = JSON.parse(shown.stdout).compilerOptions || {};
+    } catch {
+      // An invalid tsconfig.json is reported by the build below.
+    }
+    input = ['-p', 'tsconfig.json'];
+    if (!compilerOptions.module) {
+      input.push('--module', 'commonjs');
+    } else if (String(compilerOptions.module).toLowerCase() !== 'commonjs') {
+      moduleType = 'module';
+    }
+    if (!compilerOptions.target) {
+      input.push('--target', 'es2020');
+    }
+  }
+  const tsc = spawnSync('node_modules/.bin/tsc', [...input, ...output], {
+    encoding: 'utf8',
+    timeout: 10000
+  });
+  return { exitCode: tsc.status, stdout: tsc.stdout || '', stderr: tsc.stderr || '', module: moduleType };
+}
+
+// Compiles with the compiler API in this process, honouring the submission's tsconfig.json
+// apart from where and whether output is written. Type errors fail the build as they do tsc.
+function compileInProcess(emit) {
+  const ts = typescript === undefined ? loadTypescript() : typescript;
+  if (!ts) {
+    return { exitCode: 1, stdout: '', stderr: 'TypeScript is not installed in this runner\n', module: 'commonjs' };
+  }
+  const host = { getCanonicalFileName: (name) => name, getCurrentDirectory: () => workdir, getNewLine: () => '\n' };
+  const config = existsSync('tsconfig.json') ? ts.readConfigFile('tsconfig.json', ts.sys.readFile) : { config: {} };
+  if (config.error) {
+    return { exitCode: 1, stdout: ts.formatDiagnostics([config.error], host), stderr: '', module: 'commonjs' };
+  }
+  const parsed = ts.parseJsonConfigFileContent(config.config, ts.sys, workdir);
+  const options = {
+    target: ts.ScriptTarget.ES2022,
+    module: ts.ModuleKind.CommonJS,
+    esModuleInterop: true,
+    resolveJsonModule: true,
+    skipLibCheck: true,
+    typeRoots: [path.join(GLOBAL_MODULES, '@types'), path.join(workdir, 'node_modules', '@types')],
+    ...parsed.options,
+    rootDir: workdir,
+    outDir: path.join(workdir, BUILD_DIR),
+    noEmit: !emit,
+    noEmitOnError: true,
+    sourceMap: emit,
+    inlineSourceMap: false,
+    incremental: false
+  };
+  const program = ts.createProgram(existsSync('tsconfig.json') && parsed.fileNames.length > 0 ? parsed.fileNames : ['main.ts'], options);
+  const emitted = program.emit();
+  const diagnostics = [...ts.getPreEmitDiagnostics(program), ...emitted.diagnostics];
+  const errors = diagnostics.filter((diagnostic) => diagnostic.category === ts.DiagnosticCategory.Error);
+  return {
+    // tsc's status when it finds errors.
+    exitCode: errors.length > 0 ? 2 : 0,
+    stdout: ts.formatDiagnostics(diagnostics, host),
+    stderr: '',
+    module: options.module === ts.ModuleKind.CommonJS ? 'commonjs' : 'module'
+  };
+}
+
+// The emitted files go into the API's compilation cache. The digest is taken before any
+// submission code runs, so the API can refuse a build the program rewrote.
+function publishBuild(moduleType) {
+  // The submission's own package.json may say "type": "module"; the build states what it emitted.
+  writeFileSync(`${BUILD_DIR}/package.json`, JSON.stringify({ type: moduleType }));
+  const names = readdirSync(BUILD_DIR, { recursive: true })
+    .map(String)
+    .filter((name) => statSync(path.join(BUILD_DIR, name)).isFile())
+    .map((name) => name.split(path.sep).join('/'))
+    .sort();
+  const digest = createHash('sha256');
+  for (const name of names) {
+    const contents = createHash('sha256').update(readFileSync(path.join(BUILD_DIR, name))).digest('hex');
+    digest.update(`${name}\0${contents}\n`);
+  }
+  return digest.digest('hex');
+}
+
+// Parses every JavaScript file of the submission with `node --check`, the JavaScript side of
+// check mode; reported like a build, with the files that fail to parse on stderr.
+function checkScripts() {
+  const scripts = readdirSync('.', { recursive: true })
+    .map(String)
+    .filter((name) => /\.(js|mjs|cjs)$/.test(name) && !/^(node_modules|tmp|inputs|outputs)(\/|$)/.test(name))
+    .sort();
+  let exitCode = 0;
+  let stderr = '';
+  for (const script of scripts) {
+    const check = spawnSync('node', ['--check', script], { encoding: 'utf8', timeout: 10000 });
+    if (check.status !== 0) {
+      exitCode = 1;
+      stderr += check.stderr || `${script}: check failed\n`;
+    }
+  }
+  return { exitCode, stdout: '', stderr };
+}
+
+let entry = 'main.js';
+let compilePhase = null;
+let buildDigest = null;
+const typescriptEntry = !existsSync('main.js') && existsSync('main.ts');
+if (mode === 'check' && !typescriptEntry) {
+  const checkStart = Date.now();
+  const checked = checkScripts();
+  compilePhase = {
+    exit_code: checked.exitCode,
+    duration_ms: Date.now() - checkStart,
+    stdout: '',
+    stderr: checked.stderr.slice(0, outputLimit)
+  };
+  if (checked.exitCode !== 0) {
+    process.stderr.write(compilePhase.stderr);
+    writeFileSync('usage.json', JSON.stringify({ wall_ms: 0, cpu_ms: 0, max_rss_mb: 0, limit_exceeded: null, compile: compilePhase }));
+    exit(1);
+  }
+} else if (typescriptEntry) {
+  entry = `${BUILD_DIR}/main.js`;
+  if (spec.prebuilt && existsSync(entry) && mode !== 'check') {
+    compilePhase = CACHED_COMPILE;
+  } else {
+    const compileStart = Date.now();
+    const emit = mode !== 'check';
+    const compiled = existsSync('node_modules/.bin/tsc') ? compileWithTsc(emit) : compileInProcess(emit);
+    compilePhase = {
+      exit_code: compiled.exitCode,
+      duration_ms: Date.now() - compileStart,
+      stdout: compiled.stdout.slice(0, outputLimit),
+      stderr: compiled.stderr.slice(0, outputLimit)
+    };
+    if (compiled.exitCode !== 0) {
+      process.stderr.write('Compilation failed:\n');
+      process.stderr.write(compilePhase.stdout + compilePhase.stderr);
+      writeFileSync('usage.json', JSON.stringify({
+        wall_ms: 0,
+        cpu_ms: 0,
+        user_cpu_ms: 0,
+        system_cpu_ms: 0,
+        max_rss_mb: 0,
+        limit_exceeded: null,
+        compile: compilePhase
+      }));
+      exit(1);
+    }
+    buildDigest = emit ? publishBuild(compiled.module) : null;
+  }
+}
+
+if (mode === 'compile' || mode === 'check') {
+  writeFileSync('usage.json', JSON.stringify({
+    wall_ms: 0,
+    cpu_ms: 0,
+    max_rss_mb: 0,
+    limit_exceeded: null,
+    compile: compilePhase,
+    build_digest: buildDigest
+  }));
+  exit(0);
+}
+
+const cpuSeconds = Math.max(1, Math.floor((limits.cpu_ms || 5000) / 1000));
+// Keep V8's heap inside the container memory limit so large allocations fail with a JS
+// heap error instead of the whole container being OOM-killed.
+const heapMb = Math.max(16, Math.floor((limits.memory_mb || 256) * 0.75));
+// V8 writes the requested profiles under outputs/profiles/ as the program exits. A preload turns
+// the SIGTERM sent at the wall-clock limit into an exit, unless the program handles it itself, so
+// a run that times out still writes them.
+const profile = spec.profile || {};
+const profileFlags = [];
+if (profile.cpu || profile.heap) {
+  const profilesDir = path.join(workdir, 'outputs', 'profiles');
+  mkdirSync(profilesDir, { recursive: true });
+  const preload = path.join(workdir, 'tmp', 'profile-exit.js');
+  writeFileSync(preload, "process.once('SIGTERM', () => process.listenerCount('SIGTERM') === 0 && process.exit(143));\n");
+  profileFlags.push('--require', preload);
+  if (profile.cpu) profileFlags.push('--cpu-prof', `--cpu-prof-dir=${profilesDir}`, '--cpu-prof-name=cpu.cpuprofile');
+  if (profile.heap) profileFlags.push('--heap-prof', `--heap-prof-dir=${profilesDir}`, '--heap-prof-name=heap.heapprofile');
+}
+const sourceMapFlags = typescriptEntry ? ['--enable-source-maps'] : [];
+let args = [`--max-old-space-size=${heapMb}`, ...sourceMapFlags, ...profileFlags, entry, '--', ...((spec.args || []))];
+if (spec.interactive && !existsSync(entry)) {
+  // A session without code gets the REPL; -i keeps it interactive on a pipe.
+  args = [`--max-old-space-size=${heapMb}`, '-i'];
+}
+// libfaketime starts the program's wall clock at, or holds it to, the time the run asked for in
+// EXECUTOR_FAKE_TIME. The monotonic clock stays real, so timers and the time limit behave.
+const fakeTime = env.EXECUTOR_FAKE_TIME;
+delete env.EXECUTOR_FAKE_TIME;
+if (fakeTime) {
+  const candidates = readdirSync('/usr/lib').map((dir) => path.join('/usr/lib', dir, 'faketime', 'libfaketime.so.1'));
+  const library = [...candidates, '/usr/lib/faketime/libfaketime.so.1'].find((candidate) => existsSync(candidate));
+  if (!library) {
+    process.stderr.write('a fixed clock needs libfaketime, which this runner image does not have\n');
+    exit(1);
+  }
+  Object.assign(env, { LD_PRELOAD: library, FAKETIME: fakeTime, FAKETIME_DONT_FAKE_MONOTONIC: '1' });
+}
+// V8 seeds Math.random from --random-seed, where 0 stands for a random seed, so seeds are moved
+// into 1..2^31-1.
+const randomSeed = env.EXECUTOR_RANDOM_SEED;
+delete env.EXECUTOR_RANDOM_SEED;
+if (randomSeed !== undefined) {
+  args.unshift(`--random-seed=${(Number(randomSeed) % 2147483647) + 1}`);
+}
+// RLIMIT_NPROC backs up the container's --pids-limit where there is no pids cgroup.
+const maxProcesses = limits.max_processes || 32;
+const maxOpenFiles = limits.max_open_files || 256;
+// ulimit counts core sizes in 512-byte blocks.
+const coreBlocks = (limits.core_dump_mb || 0) * 2048;
+// A fork refused from here on means the run hit max_processes.
+const pidsRefusedAtStart = pidsRefused();
+// An OOM kill from here on means the run hit memory_mb.
+const oomKillsAtStart = oomKills();
+// node cannot set rlimits itself, so apply the CPU, process, file and core budgets through the
+// shell before exec; dash calls the process limit -p, other shells -u. Core dumps stay off when
+// the host allows less than the run asked for.
+const rlimits =
+  'ulimit -t "$0" && { ulimit -p "$1" 2>/dev/null || ulimit -u "$1"; } && ulimit -n "$2" && ' +
+  '{ ulimit -c "$3" 2>/dev/null || ulimit -c 0; } && shift 3 && exec "$@"';
+// The program leads its own session so that signalling its process group reaches everything it
+// started.
+// Tells the API that the build, if any, is done and the program is starting.
+writeFileSync('.run_started', '');
+const child = spawn('sh', ['-c', rlimits, String(cpuSeconds), String(maxProcesses), String(maxOpenFiles), String(coreBlocks), 'node', ...args], {
+  stdio: ['pipe', 'pipe', 'pipe'],
+  detached: true
+});
+function signalGroup(name) {
+  try {
+    process.kill(-child.pid, name);
+  } catch {
+    // The group is already gone.
+  }
+}
+// Programs may exit without draining stdin; ignore the resulting EPIPE.
+child.stdin.on('error', () => undefined);
+if (spec.interactive) {
+  // Relay the session's input until the caller closes it.
+  child.stdin.write(stdinRest);
+  process.stdin.pipe(child.stdin);
+} else {
+  child.stdin.end(spec.stdin || '');
+}
+const droppedBytes = { stdout: 0, stderr: 0 };
+// Output forwarded from each stream, up to its cap.
+const capturedBytes = { stdout: 0, stderr: 0 };
+// Forward output as it arrives so the API can stream it; anything past the cap is dropped.
+function pipeCapped(name, source, sink) {
+  let written = 0;
+  source.on('data', (chunk) => {
+    const part = chunk.subarray(0, Math.max(0, streamLimits[name] - written));
+    if (part.length < chunk.length && killOnOutputLimit) signalGroup('SIGKILL');
+    droppedBytes[name] += chunk.length - part.length;
+    if (part.length === 0) return;
+    written += part.length;
+    capturedBytes[name] += part.length;
+    sink.write(part);
+  });
+}
+pipeCapped('stdout', child.stdout, process.stdout);
+pipeCapped('stderr', child.stderr, process.stderr);
 
 const startMs = Date.now();
-let lastCpuJiffies = 0;
+// User and system CPU jiffies from the latest /proc sample.
+let lastCpuJiffies = { utime: 0, stime: 0 };
 let maxRssKb = 0;
 
 // Seed an initial sample immediately after spawn
@@ -73,24 +446,75 @@ const sampler = setInterval(() => {
   if (rss !== null) maxRssKb = Math.max(maxRssKb, rss);
 }, 50);
 
+// At the wall-clock limit the program gets SIGTERM and kill_grace_ms to flush its output and exit;
+// after that its whole process group is SIGKILLed.
+const killGraceMs = limits.kill_grace_ms ?? 1000;
 let timedOut = false;
+let hardKilled = false;
+let terminatedMs = 0;
+let flushedFrom = 0;
+let graceMs = 0;
+let hardKill;
 const timeout = setTimeout(() => {
   timedOut = true;
-  child.kill('SIGKILL');
+  terminatedMs = Date.now();
+  flushedFrom = capturedBytes.stdout + capturedBytes.stderr;
+  signalGroup('SIGTERM');
+  hardKill = setTimeout(() => {
+    hardKilled = true;
+    signalGroup('SIGKILL');
+  }, killGraceMs);
 }, (limits.timeout_ms || 5000));
 
-child.on('exit', (code) => {
+child.on('exit', () => {
+  clearTimeout(hardKill);
+  if (timedOut) graceMs = Date.now() - terminatedMs;
+  // Background processes the program left behind would keep its output open.
+  signalGroup('SIGKILL');
+});
+
+child.on('close', (code, signal) => {
   clearInterval(sampler);
   clearTimeout(timeout);
-  const limit = limits.max_output_bytes || 1024 * 1024;
-  const out = Buffer.concat(stdoutChunks).subarray(0, limit);
-  const err = Buffer.concat(stderrChunks).subarray(0, limit);
-  process.stdout.write(out);
-  process.stderr.write(err);
   const wallMs = Date.now() - startMs;
-  const cpuMs = Math.round((lastCpuJiffies || 0) * (1000 / HZ));
+  const userCpuMs = Math.round(lastCpuJiffies.utime * (1000 / HZ));
+  const systemCpuMs = Math.round(lastCpuJiffies.stime * (1000 / HZ));
+  const cpuMs = userCpuMs + systemCpuMs;
   const maxRssMb = Math.max(0, Math.round((maxRssKb || 0) / 1024));
-  const usage = { wall_ms: wallMs, cpu_ms: cpuMs, max_rss_mb: maxRssMb };
+  let limitExceeded = null;
+  if (pidsRefused() > pidsRefusedAtStart) {
+    // A refused fork explains whatever followed it, a timeout included.
+    limitExceeded = 'processes';
+  } else if (timedOut) {
+    limitExceeded = 'wall_time';
+  } else if (signal === 'SIGKILL' && oomKills() > oomKillsAtStart) {
+    limitExceeded = 'memory';
+  } else if ((signal === 'SIGXCPU' || signal === 'SIGKILL') && cpuMs >= cpuSeconds * 1000) {
+    limitExceeded = 'cpu_time';
+  } else if (droppedBytes.stdout > 0 || droppedBytes.stderr > 0) {
+    limitExceeded = 'output';
+  }
+  const usage = {
+    wall_ms: wallMs,
+    cpu_ms: cpuMs,
+    user_cpu_ms: userCpuMs,
+    system_cpu_ms: systemCpuMs,
+    max_rss_mb: maxRssMb,
+    limit_exceeded: limitExceeded,
+    timeout: timedOut ? {
+      stage: hardKilled ? 'hard' : 'soft',
+      grace_ms: graceMs,
+      stdout_bytes: capturedBytes.stdout,
+      stderr_bytes: capturedBytes.stderr,
+      flushed_bytes: capturedBytes.stdout + capturedBytes.stderr - flushedFrom
+    } : null,
+    // The signal that ended the program, unless it was the one stopping it at the time limit.
+    signal: timedOut ? null : signal,
+    dropped_bytes: droppedBytes,
+    compile: compilePhase,
+    build_digest: buildDigest
+  };
   writeFileSync('usage.json', JSON.stringify(usage));
-  exit((timedOut ? 124 : (code || 0)));
+  // A program ended by a signal exits as a shell reports it, 128 plus the signal's number.
+  exit(timedOut ? 124 : signal ? 128 + constants.signals[signal] : (code || 0));
 });
@@ -0,0 +1,14 @@
+#!/bin/sh
+# Prints how many processes the kernel OOM killer has killed in the container's memory cgroup so
+# far (cgroup v2, then v1), or 0 when neither can be read. Every runner image copies this next to
+# its entrypoint, whatever the entrypoint is written in, which runs it before the program starts
+# and once it has exited; the process backend finds it in runners/.
+group=$(sed -n 's/^0:://p' /proc/self/cgroup 2>/dev/null)
+for events in "/sys/fs/cgroup${group%/}/memory.events" /sys/fs/cgroup/memory/memory.oom_control; do
+  count=$(sed -n 's/^oom_kill \([0-9][0-9]*\)$/\1/p' "$events" 2>/dev/null)
+  if [ -n "$count" ]; then
+    echo "$count"
+    exit 0
+  fi
+done
+echo 0
@@ -1,16 +1,19 @@
 #!/usr/bin/env php
 <?php
-$spec = json_decode(stream_get_contents(STDIN), true);
+// The spec is the first line of stdin; in interactive sessions the rest is the program's live input.
+$spec = json_decode(fgets(STDIN), true);
 $limits = $spec['limits'] ?? [];
-chdir('/work');
+// The process backend runs entrypoints directly on the host and passes its own workdir.
+$workdir = $spec['workdir'] ?? '/work';
+chdir($workdir);
 
 $_ENV = [];
 foreach ($spec['env'] ?? [] as $key => $value) {
     putenv($key . '=' . $value);
     $_ENV[$key] = $value;
 }
-putenv('HOME=/work');
-putenv('TMPDIR=/work/tmp');
+putenv('HOME=' . $workdir);
+putenv('TMPDIR=' . $workdir . '/tmp');
 putenv('PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin');
 
 if (!is_dir('tmp')) { mkdir('tmp', 0700, true); }
@@ -27,12 +30,48 @@ function read_cpu_jiffies($pid) {
         $parts = preg_split('/\s+/', $rest);
         $utime = isset($parts[11]) ? (int)$parts[11] : 0;
         $stime = isset($parts[12]) ? (int)$parts[12] : 0;
-        return $utime + $stime;
+        return [$utime, $stime];
     } catch (Throwable $e) {
         return null;
     }
 }
 
+// How many forks the container's cgroup pids controller has refused so far (cgroup v2, then v1).
+function pids_refused() {
+    $cgroup = @file_get_contents('/proc/self/cgroup');
+    $group = $cgroup !== false && preg_match('/^0::(.*)$/m', $cgroup, $m) ? $m[1] : '';
+    foreach (['/sys/fs/cgroup' . rtrim($group, '/') . '/pids.events', '/sys/fs/cgroup/pids/pids.events'] as $events) {
+        $contents = @file_get_contents($events);
+        if ($contents !== false && preg_match('/^max (\d+)$/m', $contents, $m)) {
+            return (int)$m[1];
+        }
+    }
+    return 0;
+}
+
+// How many processes the kernel OOM killer has killed in the container's memory cgroup so far,
+// from the oom_kills.sh every runner shares: next to this file in the image, in runners/ for the
+// process backend.
+function oom_kills() {
+    foreach ([__DIR__, dirname(__DIR__)] as $dir) {
+        if (is_file("$dir/oom_kills.sh")) {
+            return (int)shell_exec('/bin/sh ' . escapeshellarg("$dir/oom_kills.sh"));
+        }
+    }
+    return 0;
+}
+
+// Linux signal numbers by name, for reporting what ended the program; PHP only has the
+// constants with the pcntl extension.
+function signal_name($number) {
+    $names = [
+        1 => 'SIGHUP', 2 => 'SIGINT', 3 => 'SIGQUIT', 4 => 'SIGILL', 5 => 'SIGTRAP', 6 => 'SIGABRT', 7 => 'SIGBUS',
+        8 => 'SIGFPE', 9 => 'SIGKILL', 10 => 'SIGUSR1', 11 => 'SIGSEGV', 12 => 'SIGUSR2', 13 => 'SIGPIPE',
+        14 => 'SIGALRM', 15 => 'SIGTERM', 24 => 'SIGXCPU', 25 => 'SIGXFSZ', 31 => 'SIGSYS'
+    ];
+    return $names[$number] ?? "SIG$number";
+}
+
 function read_vm_hwm_kb($pid) {
     try {
         $status = @file_get_contents("/proc/$pid/status");
@@ -46,7 +85,86 @@ function read_vm_hwm_kb($pid) {
     }
 }
 
-$cmd = ['php', 'main.php', '--'];
+// Check mode only lints the sources with `php -l`, without running the program.
+if (($spec['mode'] ?? 'run') === 'check') {
+    $checkStart = microtime(true);
+    $scripts = [];
+    $files = new RecursiveIteratorIterator(new RecursiveDirectoryIterator('.', FilesystemIterator::SKIP_DOTS));
+    foreach ($files as $file) {
+        $name = substr($file->getPathname(), 2);
+        if ($file->getExtension() === 'php' && !preg_match('#^(tmp|inputs|outputs)/#', $name)) {
+            $scripts[] = $name;
+        }
+    }
+    sort($scripts);
+    $exitCode = 0;
+    $checkOutput = '';
+    foreach ($scripts as $script) {
+        exec('php -l ' . escapeshellarg($script) . ' 2>&1', $lines, $status);
+        if ($status !== 0) {
+            $exitCode = 1;
+            $checkOutput .= implode("\n", $lines) . "\n";
+        }
+        $lines = [];
+    }
+    $compile = [
+        'exit_code' => $exitCode,
+        'duration_ms' => (int)((microtime(true) - $checkStart) * 1000),
+        'stdout' => '',
+        'stderr' => substr($checkOutput, 0, (int)($limits['max_output_bytes'] ?? 1024 * 1024))
+    ];
+    fwrite(STDERR, $compile['stderr']);
+    file_put_contents('usage.json', json_encode([
+        'wall_ms' => 0,
+        'cpu_ms' => 0,
+        'max_rss_mb' => 0,
+        'limit_exceeded' => null,
+        'compile' => $compile
+    ]));
+    exit($exitCode);
+}
+
+$cpuSeconds = max(1, intdiv((int)($limits['cpu_ms'] ?? 5000), 1000));
+// RLIMIT_NPROC backs up the container's --pids-limit where there is no pids cgroup.
+$maxProcesses = (int)($limits['max_processes'] ?? 32);
+$maxOpenFiles = (int)($limits['max_open_files'] ?? 256);
+// ulimit counts core sizes in 512-byte blocks.
+$coreBlocks = (int)($limits['core_dump_mb'] ?? 0) * 2048;
+// A fork refused from here on means the run hit max_processes.
+$pidsRefusedAtStart = pids_refused();
+// An OOM kill from here on means the run hit memory_mb.
+$oomKillsAtStart = oom_kills();
+// Apply the CPU, process, file and core budgets through the shell before exec since proc_open
+// cannot set rlimits; dash calls the process limit -p, other shells -u, and core dumps stay off
+// when the host allows less than the run asked for. setsid gives the program a session of its
+// own, so signalling its process group reaches everything it started.
+$rlimits = 'ulimit -t "$0" && { ulimit -p "$1" 2>/dev/null || ulimit -u "$1"; } && ulimit -n "$2" && '
+    . '{ ulimit -c "$3" 2>/dev/null || ulimit -c 0; } && shift 3 && exec "$@"';
+// libfaketime starts the program's wall clock at, or holds it to, the time the run asked for in
+// EXECUTOR_FAKE_TIME. The monotonic clock stays real, so sleeps and the time limit behave.
+$fakeTime = getenv('EXECUTOR_FAKE_TIME');
+putenv('EXECUTOR_FAKE_TIME');
+if ($fakeTime !== false && $fakeTime !== '') {
+    $candidates = array_merge(glob('/usr/lib/*/faketime/libfaketime.so.1') ?: [], ['/usr/lib/faketime/libfaketime.so.1']);
+    $library = current(array_filter($candidates, 'file_exists'));
+    if ($library === false) {
+        fwrite(STDERR, "a fixed clock needs libfaketime, which this runner image does not have\n");
+        exit(1);
+    }
+    putenv('LD_PRELOAD=' . $library);
+    putenv('FAKETIME=' . $fakeTime);
+    putenv('FAKETIME_DONT_FAKE_MONOTONIC=1');
+}
+// mt_rand, rand, shuffle, array_rand and str_shuffle share the Mersenne Twister seeded here
+// before the program's first line.
+$phpFlags = [];
+$randomSeed = getenv('EXECUTOR_RANDOM_SEED');
+putenv('EXECUTOR_RANDOM_SEED');
+if ($randomSeed !== false) {
+    file_put_contents($workdir . '/tmp/seed.php', '<?php mt_srand(' . (int)$randomSeed . ');');
+    $phpFlags = ['-d', 'auto_prepend_file=' . $workdir . '/tmp/seed.php'];
+}
+$cmd = ['setsid', 'sh', '-c', $rlimits, (string)$cpuSeconds, (string)$maxProcesses, (string)$maxOpenFiles, (string)$coreBlocks, 'php', ...$phpFlags, 'main.php', '--'];
 foreach (($spec['args'] ?? []) as $arg) {
     $cmd[] = $arg;
 }
@@ -57,12 +175,74 @@ if (!is_resource($process)) {
     exit(1);
 }
 [$stdinPipe, $stdoutPipe, $stderrPipe] = $pipes;
-fclose($stdinPipe);
+function signal_group($pid, $signal) {
+    if ($pid) {
+        @posix_kill(-$pid, $signal);
+    }
+}
+stream_set_blocking($stdinPipe, false);
+stream_set_blocking($stdoutPipe, false);
+stream_set_blocking($stderrPipe, false);
+
+$limit = $limits['max_output_bytes'] ?? 1024 * 1024;
+// Each stream has its own cap, max_output_bytes unless set. With on_output_limit=kill the program
+// is stopped at the first byte past a cap instead of having the rest of its output discarded.
+$streamLimits = [1 => $limits['max_stdout_bytes'] ?? $limit, 2 => $limits['max_stderr_bytes'] ?? $limit];
+$killOnOutputLimit = ($spec['on_output_limit'] ?? null) === 'kill';
+$written = [1 => 0, 2 => 0];
+$dropped = [1 => 0, 2 => 0];
+// Forward output as it arrives so the API can stream it; anything past the cap is dropped.
+function pump($source, $sink, $limit, &$written, &$dropped) {
+    while (($chunk = fread($source, 65536)) !== false && $chunk !== '') {
+        if ($written >= $limit) {
+            $dropped += strlen($chunk);
+            continue;
+        }
+        $part = substr($chunk, 0, $limit - $written);
+        $dropped += strlen($chunk) - strlen($part);
+        fwrite($sink, $part);
+        $written += strlen($part);
+    }
+}
+
+// Feed stdin incrementally alongside output draining so large payloads cannot deadlock.
+$interactive = !empty($spec['interactive']);
+$stdinPayload = $interactive ? '' : (string)($spec['stdin'] ?? '');
+$stdinOpen = $interactive;
+if ($interactive) {
+    stream_set_blocking(STDIN, false);
+}
+function feed_stdin(&$pipe, &$payload, $keepOpen) {
+    if (!is_resource($pipe)) {
+        return;
+    }
+    if ($payload !== '') {
+        $n = @fwrite($pipe, $payload);
+        if ($n === false) {
+            $payload = '';
+        } elseif ($n > 0) {
+            $payload = (string)substr($payload, $n);
+        }
+    }
+    if ($payload === '' && !$keepOpen) {
+        fclose($pipe);
+        $pipe = null;
+    }
+}
 
 $timeout = ($limits['timeout_ms'] ?? 5000) / 1000.0;
+// At the wall-clock limit the program gets SIGTERM and kill_grace_ms to flush its output and exit;
+// after that its whole process group is SIGKILLed.
+$killGrace = ($limits['kill_grace_ms'] ?? 1000) / 1000.0;
 $start = microtime(true);
 $status = null;
-$cpuJiffies = 0;
+$pid = null;
+$timedOut = false;
+$hardKilled = false;
+$terminatedAt = null;
+$flushedFrom = 0;
+// User and system CPU jiffies from the latest /proc sample.
+$cpuJiffies = [0, 0];
 $maxRssKb = 0;
 while (true) {
     $status = proc_get_status($process);
@@ -70,38 +250,91 @@ while (true) {
         break;
     }
     $pid = $status['pid'] ?? null;
+    if ($stdinOpen) {
+        // Relay the session's input until the caller closes it.
+        $chunk = fread(STDIN, 65536);
+        if ($chunk !== false && $chunk !== '') {
+            $stdinPayload .= $chunk;
+        } elseif (feof(STDIN)) {
+            $stdinOpen = false;
+        }
+    }
+    feed_stdin($stdinPipe, $stdinPayload, $stdinOpen);
+    pump($stdoutPipe, STDOUT, $streamLimits[1], $written[1], $dropped[1]);
+    pump($stderrPipe, STDERR, $streamLimits[2], $written[2], $dropped[2]);
+    if ($killOnOutputLimit && ($dropped[1] > 0 || $dropped[2] > 0)) {
+        signal_group($pid, 9);
+    }
     if ($pid) {
         $cj = read_cpu_jiffies($pid);
         if ($cj !== null) { $cpuJiffies = $cj; }
         $rss = read_vm_hwm_kb($pid);
         if ($rss !== null && $rss > $maxRssKb) { $maxRssKb = $rss; }
     }
-    if ((microtime(true) - $start) > $timeout) {
-        proc_terminate($process, 9);
+    if (!$timedOut && (microtime(true) - $start) > $timeout) {
+        $timedOut = true;
+        $terminatedAt = microtime(true);
+        $flushedFrom = $written[1] + $written[2];
+        signal_group($pid, 15);
+    } elseif ($timedOut && (microtime(true) - $terminatedAt) > $killGrace) {
+        $hardKilled = true;
+        signal_group($pid, 9);
         $status = proc_get_status($process);
-        $status['exitcode'] = 124;
         break;
     }
     usleep(10000);
 }
+$graceMs = $timedOut ? (int)round((microtime(true) - $terminatedAt) * 1000) : 0;
+// Background processes the program left behind would keep its output open.
+signal_group($pid, 9);
+if ($timedOut) {
+    $status['exitcode'] = 124;
+}
 
-$stdout = stream_get_contents($stdoutPipe);
-$stderr = stream_get_contents($stderrPipe);
+if (is_resource($stdinPipe)) { fclose($stdinPipe); }
+stream_set_blocking($stdoutPipe, true);
+stream_set_blocking($stderrPipe, true);
+pump($stdoutPipe, STDOUT, $streamLimits[1], $written[1], $dropped[1]);
+pump($stderrPipe, STDERR, $streamLimits[2], $written[2], $dropped[2]);
 if (is_resource($stdoutPipe)) { fclose($stdoutPipe); }
 if (is_resource($stderrPipe)) { fclose($stderrPipe); }
 
-$limit = $limits['max_output_bytes'] ?? 1024 * 1024;
-$stdout = substr($stdout ?? '', 0, $limit);
-$stderr = substr($stderr ?? '', 0, $limit);
-
-fwrite(STDOUT, $stdout);
-fwrite(STDERR, $stderr);
-
+$userCpuMs = (int)round($cpuJiffies[0] * (1000 / $HZ));
+$systemCpuMs = (int)round($cpuJiffies[1] * (1000 / $HZ));
+$cpuMs = $userCpuMs + $systemCpuMs;
+// The signal that ended the program, unless it was the one stopping it at the time limit.
+$exitSignal = !$timedOut && !empty($status['signaled']) ? signal_name($status['termsig']) : null;
+$limitExceeded = null;
+if (pids_refused() > $pidsRefusedAtStart) {
+    // A refused fork explains whatever followed it, a timeout included.
+    $limitExceeded = 'processes';
+} elseif ($timedOut) {
+    $limitExceeded = 'wall_time';
+} elseif ($exitSignal === 'SIGKILL' && oom_kills() > $oomKillsAtStart) {
+    $limitExceeded = 'memory';
+} elseif (!empty($status['signaled']) && in_array($status['termsig'], [9, 24], true) && $cpuMs >= $cpuSeconds * 1000) {
+    $limitExceeded = 'cpu_time';
+} elseif ($dropped[1] > 0 || $dropped[2] > 0) {
+    $limitExceeded = 'output';
+}
 $usage = [
     'wall_ms' => (int)round((microtime(true) - $start) * 1000),
-    'cpu_ms' => (int)round(($cpuJiffies ?? 0) * (1000 / $HZ)),
-    'max_rss_mb' => (int)max(0, round(($maxRssKb ?? 0) / 1024))
+    'cpu_ms' => $cpuMs,
+    'user_cpu_ms' => $userCpuMs,
+    'system_cpu_ms' => $systemCpuMs,
+    'max_rss_mb' => (int)max(0, round(($maxRssKb ?? 0) / 1024)),
+    'limit_exceeded' => $limitExceeded,
+    'timeout' => $timedOut ? [
+        'stage' => $hardKilled ? 'hard' : 'soft',
+        'grace_ms' => $graceMs,
+        'stdout_bytes' => $written[1],
+        'stderr_bytes' => $written[2],
+        'flushed_bytes' => $written[1] + $written[2] - $flushedFrom
+    ] : null,
+    'signal' => $exitSignal,
+    'dropped_bytes' => ['stdout' => $dropped[1], 'stderr' => $dropped[2]]
 ];
 file_put_contents('usage.json', json_encode($usage));
 
-exit($status['exitcode'] ?? 0);
+// A program ended by a signal exits as a shell reports it, 128 plus the signal's number.
+exit($exitSignal !== null ? 128 + $status['termsig'] : ($status['exitcode'] ?? 0));
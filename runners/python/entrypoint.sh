@@ -2,22 +2,62 @@
 import json
 import os
 import resource
+import signal
 import subprocess
 import sys
+import threading
 import time
+import xml.etree.ElementTree as ElementTree
 from pathlib import Path
 
-WORKDIR = Path('/work')
-SPEC = json.load(sys.stdin)
+# runner_common.py sits next to the entrypoint in the image and in runners/ for the process backend.
+sys.path.append(str(Path(__file__).resolve().parent.parent))
+from runner_common import oom_kills, stop_in_two_stages
+
+
+def read_spec():
+    # The spec is the first line of stdin. It is read straight from fd 0 so that whatever follows,
+    # an interactive session's live input, is left for relay_stdin rather than buffered away.
+    data = b''
+    while b'\n' not in data:
+        chunk = os.read(0, 65536)
+        if not chunk:
+            break
+        data += chunk
+    line, _, rest = data.partition(b'\n')
+    return json.loads(line), rest
+
+
+SPEC, STDIN_REST = read_spec()
+# The process backend runs entrypoints directly on the host and passes its own workdir.
+WORKDIR = Path(SPEC.get('workdir') or '/work')
 LIMITS = SPEC.get('limits', {})
+SETTINGS = SPEC.get('settings', {})
+INTERPRETER = SETTINGS.get('interpreter', 'python3')
+DEPS = Path('/deps')
+
+if SPEC.get('mode') == 'setup':
+    # Dependency installation runs in its own networked container with the cache mounted at
+    # /deps; no submission code executes here.
+    os.environ['HOME'] = '/tmp'
+    os.environ['PIP_DISABLE_PIP_VERSION_CHECK'] = '1'
+    venv = subprocess.run([INTERPRETER, '-m', 'venv', str(DEPS / 'venv')])
+    if venv.returncode != 0:
+        sys.exit(venv.returncode)
+    # Wheels only: building an sdist would run its setup.py while network access is available.
+    install = subprocess.run([
+        str(DEPS / 'venv' / 'bin' / 'pip'), 'install', '--no-cache-dir', '--only-binary=:all:',
+        '-r', str(DEPS / 'requirements.txt')
+    ])
+    sys.exit(install.returncode)
 
 os.chdir(WORKDIR)
 
 env = {key: value for key, value in SPEC.get('env', {}).items()}
 os.environ.clear()
 os.environ.update(env)
-os.environ['HOME'] = '/work'
-os.environ['TMPDIR'] = '/work/tmp'
+os.environ['HOME'] = str(WORKDIR)
+os.environ['TMPDIR'] = str(WORKDIR / 'tmp')
 os.environ['PATH'] = '/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin'
 
 (Path('tmp')).mkdir(parents=True, exist_ok=True)
@@ -29,36 +69,463 @@ cpu_quota_seconds = max(1, cpu_ms // 1000 or 1)
 resource.setrlimit(resource.RLIMIT_AS, (memory_bytes, memory_bytes))
 resource.setrlimit(resource.RLIMIT_DATA, (memory_bytes, memory_bytes))
 resource.setrlimit(resource.RLIMIT_FSIZE, (50 * 1024 * 1024, 50 * 1024 * 1024))
-resource.setrlimit(resource.RLIMIT_NPROC, (32, 32))
-resource.setrlimit(resource.RLIMIT_NOFILE, (256, 256))
+# RLIMIT_NPROC backs up the container's --pids-limit where there is no pids cgroup.
+max_processes = int(LIMITS.get('max_processes', 32))
+resource.setrlimit(resource.RLIMIT_NPROC, (max_processes, max_processes))
+max_open_files = int(LIMITS.get('max_open_files', 256))
+resource.setrlimit(resource.RLIMIT_NOFILE, (max_open_files, max_open_files))
+# Core dumps stay off unless the run asks for them, and never exceed what the host allows.
+core_bytes = int(LIMITS.get('core_dump_mb', 0)) * 1024 * 1024
+core_hard = resource.getrlimit(resource.RLIMIT_CORE)[1]
+if core_hard != resource.RLIM_INFINITY:
+    core_bytes = min(core_bytes, core_hard)
+resource.setrlimit(resource.RLIMIT_CORE, (core_bytes, core_bytes))
 resource.setrlimit(resource.RLIMIT_CPU, (cpu_quota_seconds, cpu_quota_seconds))
 
-cmd = ['python3', 'main.py', '--', *SPEC.get('args', [])]
+
+def pids_refused():
+    # How many forks the container's cgroup pids controller has refused so far (cgroup v2, then v1).
+    try:
+        group = next((line[3:] for line in Path('/proc/self/cgroup').read_text().splitlines() if line.startswith('0::')), '')
+    except OSError:
+        group = ''
+    candidates = [Path('/sys/fs/cgroup') / group.lstrip('/') / 'pids.events', Path('/sys/fs/cgroup/pids/pids.events')]
+    for events in candidates:
+        try:
+            for line in events.read_text().splitlines():
+                key, _, value = line.partition(' ')
+                if key == 'max':
+                    return int(value)
+        except (OSError, ValueError):
+            continue
+    return 0
+
+
+# A fork refused from here on means the run hit max_processes.
+PIDS_REFUSED_AT_START = pids_refused()
+
+
+# An OOM kill from here on means the run hit memory_mb.
+OOM_KILLS_AT_START = oom_kills()
+
+# Use the cached virtualenv when the sandbox mounted one for this run's requirements.txt
+venv_python = DEPS / 'venv' / 'bin' / 'python'
+python_bin = str(venv_python) if venv_python.exists() else INTERPRETER
+cmd = [python_bin, 'main.py', '--', *SPEC.get('args', [])]
+if SPEC.get('interactive') and not Path('main.py').exists():
+    # A session without code gets an interpreter prompt; -i keeps it interactive on a pipe.
+    cmd = [python_bin, '-i', '-q']
+
+# Test mode runs the submission's tests instead of main.py: pytest when it is installed (e.g. via
+# requirements.txt), otherwise unittest discovery. Both leave the cases in tmp/ for report_tests.
+TEST_MODE = SPEC.get('mode') == 'test'
+JUNIT_REPORT = Path('tmp/tests.xml')
+UNITTEST_REPORT = Path('tmp/tests.json')
+UNITTEST_HARNESS = '''
+import json, sys, time, unittest
+
+class Result(unittest.TextTestResult):
+    cases = []
+
+    def startTest(self, test):
+        self.started = time.time()
+        super().startTest(test)
+
+    def record(self, test, status, message=None):
+        duration_ms = int((time.time() - self.started) * 1000)
+        self.cases.append({'name': test.id(), 'status': status, 'duration_ms': duration_ms, 'message': message})
+
+    def addSuccess(self, test):
+        super().addSuccess(test)
+        self.record(test, 'passed')
+
+    def addFailure(self, test, err):
+        super().addFailure(test, err)
+        self.record(test, 'failed', self._exc_info_to_string(err, test))
+
+    def addError(self, test, err):
+        super().addError(test, err)
+        self.record(test, 'failed', self._exc_info_to_string(err, test))
+
+    def addSkip(self, test, reason):
+        super().addSkip(test, reason)
+        self.record(test, 'skipped', reason)
+
+    def addExpectedFailure(self, test, err):
+        super().addExpectedFailure(test, err)
+        self.record(test, 'passed')
+
+    def addUnexpectedSuccess(self, test):
+        super().addUnexpectedSuccess(test)
+        self.record(test, 'failed', 'unexpected success')
+
+suite = unittest.defaultTestLoader.discover('.', pattern='test*.py')
+result = unittest.TextTestRunner(stream=sys.stdout, verbosity=2, resultclass=Result).run(suite)
+with open('tmp/tests.json', 'w') as report:
+    json.dump(Result.cases, report)
+sys.exit(0 if result.wasSuccessful() else 1)
+'''
+# Check mode only compiles every source file to bytecode in memory, which catches syntax errors,
+# and never runs the program.
+CHECK_HARNESS = '''
+import pathlib, sys
+failed = False
+for path in sorted(pathlib.Path('.').rglob('*.py')):
+    if path.parts[0] in ('tmp', 'inputs', 'outputs'):
+        continue
+    try:
+        compile(path.read_bytes(), str(path), 'exec', dont_inherit=True)
+    except (SyntaxError, ValueError) as err:
+        failed = True
+        where = f'{err.filename}:{err.lineno}:{err.offset}' if isinstance(err, SyntaxError) else str(path)
+        print(f'{where}: {err.__class__.__name__}: {getattr(err, "msg", err)}', file=sys.stderr)
+sys.exit(1 if failed else 0)
+'''
+if SPEC.get('mode') == 'check':
+    check_start = time.time()
+    try:
+        check = subprocess.run([python_bin, '-c', CHECK_HARNESS], capture_output=True, timeout=10)
+        exit_code, check_stderr = check.returncode, check.stderr
+    except subprocess.TimeoutExpired as err:
+        exit_code, check_stderr = None, (err.stderr or b'') + b'Check timed out\n'
+    compile_phase = {
+        'exit_code': exit_code,
+        'duration_ms': int((time.time() - check_start) * 1000),
+        'stdout': '',
+        'stderr': check_stderr[:1024 * 1024].decode('utf8', errors='replace')
+    }
+    sys.stderr.write(compile_phase['stderr'])
+    Path('usage.json').write_text(json.dumps({
+        'wall_ms': 0,
+        'cpu_ms': 0,
+        'max_rss_mb': 0,
+        'limit_exceeded': None if exit_code is not None else 'wall_time',
+        'compile': compile_phase
+    }))
+    sys.exit(0 if exit_code == 0 else 1)
+
+# A CPU profile runs main.py under cProfile and leaves its stats in outputs/profiles/, for pstats or
+# snakeviz. The SIGTERM sent at the wall-clock limit ends the program with SystemExit so a run that
+# times out still writes them; an os._exit or a SIGTERM handler of the program's own does not.
+PROFILE_HARNESS = '''
+import cProfile, os, runpy, signal, sys
+output = os.path.abspath(sys.argv[1])
+sys.argv = sys.argv[2:]
+def terminated(signum, frame):
+    raise SystemExit(128 + signum)
+signal.signal(signal.SIGTERM, terminated)
+profiler = cProfile.Profile()
+profiler.enable()
+try:
+    runpy.run_path('main.py', run_name='__main__')
+finally:
+    profiler.disable()
+    profiler.dump_stats(output)
+'''
+if (SPEC.get('profile') or {}).get('cpu') and Path('main.py').exists():
+    Path('outputs/profiles').mkdir(parents=True, exist_ok=True)
+    cmd = [python_bin, '-c', PROFILE_HARNESS, 'outputs/profiles/cpu.pstats', 'main.py', '--', *SPEC.get('args', [])]
+
+# Coverage runs the tests under coverage.py, from the image or requirements.txt, measuring the
+# submission's own files other than its tests; its JSON report is kept under outputs/coverage/.
+COVERAGE = TEST_MODE and bool(SPEC.get('coverage'))
+COVERAGE_DATA = Path('tmp/.coverage')
+COVERAGE_JSON = Path('outputs/coverage/coverage.json')
+COVERAGE_OMIT = 'tmp/*,inputs/*,outputs/*,test_*.py,*_test.py,*/test_*.py,*/*_test.py,tests/*,conftest.py'
+
+if TEST_MODE:
+    has_pytest = subprocess.run([python_bin, '-c', 'import pytest'], capture_output=True).returncode == 0
+    if has_pytest:
+        cmd = [python_bin, '-m', 'pytest', '-p', 'no:cacheprovider', f'--junitxml={JUNIT_REPORT}', *SPEC.get('args', [])]
+    else:
+        cmd = [python_bin, '-c', UNITTEST_HARNESS, *SPEC.get('args', [])]
+    if COVERAGE and subprocess.run([python_bin, '-c', 'import coverage'], capture_output=True).returncode != 0:
+        sys.stderr.write('coverage: coverage.py is not installed; add coverage to requirements.txt\n')
+        COVERAGE = False
+    if COVERAGE:
+        measure = [python_bin, '-m', 'coverage', 'run', f'--data-file={COVERAGE_DATA}', '--source=.', f'--omit={COVERAGE_OMIT}']
+        if has_pytest:
+            cmd = [*measure, *cmd[1:]]
+        else:
+            # coverage run takes a script or a module, not -c.
+            harness = Path('tmp/unittest_harness.py')
+            harness.write_text(UNITTEST_HARNESS)
+            cmd = [*measure, str(harness), *SPEC.get('args', [])]
+output_limit = int(LIMITS.get('max_output_bytes', 1024 * 1024))
+# Each stream has its own cap, max_output_bytes unless set. With on_output_limit=kill the program
+# is stopped at the first byte past a cap instead of having the rest of its output discarded.
+stream_limits = {
+    'stdout': int(LIMITS.get('max_stdout_bytes', output_limit)),
+    'stderr': int(LIMITS.get('max_stderr_bytes', output_limit)),
+}
+KILL_ON_OUTPUT_LIMIT = SPEC.get('on_output_limit') == 'kill'
+os.environ['PYTHONUNBUFFERED'] = '1'
+dropped = {'stdout': 0, 'stderr': 0}
+# Output forwarded from each stream, up to its cap.
+captured = {'stdout': 0, 'stderr': 0}
+
+
+def drop(name, count):
+    # Counts the bytes of a chunk that did not fit under the stream's cap.
+    if count and KILL_ON_OUTPUT_LIMIT:
+        kill_group()
+    dropped[name] += count
+
+
+def pump(name, source, sink, limit):
+    # Forward output as it is produced so the API can stream it, dropping anything past the cap.
+    written = 0
+    while True:
+        chunk = os.read(source.fileno(), 65536)
+        if not chunk:
+            break
+        part = chunk[: max(0, limit - written)]
+        if part:
+            sink.write(part)
+            sink.flush()
+            written += len(part)
+            captured[name] += len(part)
+        drop(name, len(chunk) - len(part))
+
+
+def feed_stdin(sink, payload):
+    # Write the caller-supplied stdin and close it so programs reading until EOF terminate.
+    try:
+        if payload:
+            sink.write(payload)
+    except BrokenPipeError:
+        pass
+    finally:
+        try:
+            sink.close()
+        except BrokenPipeError:
+            pass
+
+
+def relay_stdin(sink):
+    # Interactive sessions forward the caller's input as it arrives until they close it.
+    try:
+        if STDIN_REST:
+            sink.write(STDIN_REST)
+            sink.flush()
+        while True:
+            chunk = os.read(0, 65536)
+            if not chunk:
+                break
+            sink.write(chunk)
+            sink.flush()
+    except BrokenPipeError:
+        pass
+    finally:
+        try:
+            sink.close()
+        except BrokenPipeError:
+            pass
+
+
+def stdin_feeder(proc):
+    # The caller may never close a live session's stdin, so that relay must not block exit.
+    if SPEC.get('interactive'):
+        return threading.Thread(target=relay_stdin, args=(proc.stdin,), daemon=True)
+    return threading.Thread(target=feed_stdin, args=(proc.stdin, SPEC.get('stdin', '').encode('utf8')))
+
+
+def report_tests():
+    # Language-neutral test cases: name, passed/failed/skipped, duration and failure message.
+    if UNITTEST_REPORT.exists():
+        return json.loads(UNITTEST_REPORT.read_text())
+    if not JUNIT_REPORT.exists():
+        return []
+    cases = []
+    for case in ElementTree.parse(JUNIT_REPORT).getroot().iter('testcase'):
+        name = '.'.join(part for part in (case.get('classname'), case.get('name')) if part)
+        status, message = 'passed', None
+        for child in case:
+            if child.tag in ('failure', 'error'):
+                status, message = 'failed', child.text or child.get('message')
+            elif child.tag == 'skipped':
+                status, message = 'skipped', child.get('message')
+        cases.append({
+            'name': name,
+            'status': status,
+            'duration_ms': int(float(case.get('time') or 0) * 1000),
+            'message': message
+        })
+    return cases
+
+
+def wait_program(proc, timeout=None):
+    # Reaps the program with wait4 to get its own rusage: RUSAGE_CHILDREN would also count the
+    # compiler and every helper process that ran before it. Raises TimeoutExpired like Popen.wait.
+    deadline = None if timeout is None else time.monotonic() + timeout
+    while True:
+        pid, status, rusage = os.wait4(proc.pid, 0 if deadline is None else os.WNOHANG)
+        if pid:
+            proc.returncode = os.waitstatus_to_exitcode(status)
+            return rusage
+        if time.monotonic() >= deadline:
+            raise subprocess.TimeoutExpired(proc.args, timeout)
+        time.sleep(0.005)
+
+
+# At the wall-clock limit the program gets SIGTERM and this long to flush its output and exit.
+KILL_GRACE = LIMITS.get('kill_grace_ms', 1000) / 1000
+
+
+def kill_group(signum=signal.SIGKILL):
+    # The program leads its own session, so this reaches every process it started as well.
+    try:
+        os.killpg(proc.pid, signum)
+    except ProcessLookupError:
+        pass
+
+
+def coverage_report():
+    # Line coverage in the shape every runner reports, from coverage.py's JSON report. Computed
+    # once, however many times the usage is written.
+    global COVERAGE_REPORT
+    if COVERAGE_REPORT is not None or not COVERAGE_DATA.exists():
+        return COVERAGE_REPORT
+    COVERAGE_JSON.parent.mkdir(parents=True, exist_ok=True)
+    try:
+        subprocess.run(
+            [python_bin, '-m', 'coverage', 'json', f'--data-file={COVERAGE_DATA}', '-o', str(COVERAGE_JSON), '-q'],
+            capture_output=True,
+            timeout=10
+        )
+        measured = json.loads(COVERAGE_JSON.read_text())
+    except (OSError, ValueError, subprocess.SubprocessError):
+        return None
+    files = []
+    for name in sorted(measured.get('files', {})):
+        entry = measured['files'][name]
+        covered, missed = sorted(entry.get('executed_lines', [])), sorted(entry.get('missing_lines', []))
+        total = len(covered) + len(missed)
+        files.append({
+            'file': name,
+            'covered_lines': len(covered),
+            'total_lines': total,
+            'percent': round(len(covered) * 100 / total, 2) if total else 100.0,
+            'covered': covered,
+            'missed': missed
+        })
+    covered_lines = sum(entry['covered_lines'] for entry in files)
+    total_lines = sum(entry['total_lines'] for entry in files)
+    COVERAGE_REPORT = {
+        'tool': 'coverage.py',
+        'covered_lines': covered_lines,
+        'total_lines': total_lines,
+        'percent': round(covered_lines * 100 / total_lines, 2) if total_lines else 100.0,
+        'files': files
+    }
+    return COVERAGE_REPORT
+
+
+COVERAGE_REPORT = None
+
+
+def exit_signal(returncode):
+    # Name of the signal that ended the program, None when it exited by itself.
+    if returncode is None or returncode >= 0:
+        return None
+    try:
+        return signal.Signals(-returncode).name
+    except ValueError:
+        return f'SIG{-returncode}'
+
+
+def write_usage(start, end, rusage=None, limit_exceeded=None, timeout=None, signal_name=None):
+    # Figures of the program alone, from wait_program; zero when it never ran.
+    if pids_refused() > PIDS_REFUSED_AT_START:
+        # A refused fork explains whatever followed it, a timeout included.
+        limit_exceeded = 'processes'
+    user_ms = int(rusage.ru_utime * 1000) if rusage else 0
+    system_ms = int(rusage.ru_stime * 1000) if rusage else 0
+    usage = {
+        'wall_ms': int((end - start) * 1000),
+        'cpu_ms': user_ms + system_ms,
+        'user_cpu_ms': user_ms,
+        'system_cpu_ms': system_ms,
+        # ru_maxrss is in KiB on Linux.
+        'max_rss_mb': int(rusage.ru_maxrss / 1024) if rusage else 0,
+        'limit_exceeded': limit_exceeded,
+        'timeout': timeout,
+        'signal': signal_name,
+        'dropped_bytes': dict(dropped)
+    }
+    if TEST_MODE:
+        usage['tests'] = report_tests()
+    if COVERAGE:
+        usage['coverage'] = coverage_report()
+    (Path('usage.json')).write_text(json.dumps(usage))
+    return usage
+
+
+def fixed_clock(env):
+    # libfaketime settings that start the program's wall clock at, or hold it to, the time the run
+    # asked for in EXECUTOR_FAKE_TIME. The monotonic clock stays real, so sleeps and the time limit
+    # behave as usual.
+    fake_time = env.pop('EXECUTOR_FAKE_TIME', None)
+    if not fake_time:
+        return {}
+    candidates = [*Path('/usr/lib').glob('*/faketime/libfaketime.so.1'), Path('/usr/lib/faketime/libfaketime.so.1')]
+    library = next((path for path in candidates if path.exists()), None)
+    if library is None:
+        sys.stderr.write('a fixed clock needs libfaketime, which this runner image does not have\n')
+        sys.exit(1)
+    return {'LD_PRELOAD': str(library), 'FAKETIME': fake_time, 'FAKETIME_DONT_FAKE_MONOTONIC': '1'}
+
+
+def seeded_random(env):
+    # Seeds the random module through a sitecustomize ahead of anything the program imports, and
+    # fixes str and bytes hashing, and with it set iteration order, to the same seed.
+    seed = env.pop('EXECUTOR_RANDOM_SEED', None)
+    if seed is None:
+        return {}
+    hook = WORKDIR / 'tmp' / 'seed'
+    hook.mkdir(parents=True, exist_ok=True)
+    (hook / 'sitecustomize.py').write_text(f'import random\nrandom.seed({int(seed)})\n')
+    return {'PYTHONHASHSEED': seed, 'PYTHONPATH': os.pathsep.join(filter(None, [str(hook), env.get('PYTHONPATH')]))}
+
+
+os.environ.update(fixed_clock(os.environ))
+os.environ.update(seeded_random(os.environ))
 start = time.time()
-proc = subprocess.Popen(cmd, stdout=subprocess.PIPE, stderr=subprocess.PIPE, text=False)
+proc = subprocess.Popen(
+    cmd, stdin=subprocess.PIPE, stdout=subprocess.PIPE, stderr=subprocess.PIPE, text=False, start_new_session=True
+)
+stdin_feeder(proc).start()
+pumps = [
+    threading.Thread(target=pump, args=('stdout', proc.stdout, sys.stdout.buffer, stream_limits['stdout'])),
+    threading.Thread(target=pump, args=('stderr', proc.stderr, sys.stderr.buffer, stream_limits['stderr'])),
+]
+for thread in pumps:
+    thread.start()
 try:
     timeout = LIMITS.get('timeout_ms', 5000) / 1000
-    stdout, stderr = proc.communicate(timeout=timeout)
+    rusage = wait_program(proc, timeout)
 except subprocess.TimeoutExpired:
-    proc.kill()
-    stdout, stderr = proc.communicate()
+    rusage, timeout_report = stop_in_two_stages(proc, KILL_GRACE, kill_group, wait_program, captured, pumps)
     sys.stderr.buffer.write(b'Execution timed out')
+    write_usage(start, time.time(), rusage, 'wall_time', timeout_report)
     sys.exit(124)
 end = time.time()
+# Background processes the program left behind would keep its output open.
+kill_group()
+for thread in pumps:
+    thread.join()
 
-stdout = stdout[: int(LIMITS.get('max_output_bytes', 1024 * 1024))]
-stderr = stderr[: int(LIMITS.get('max_output_bytes', 1024 * 1024))]
-
-sys.stdout.buffer.write(stdout)
-sys.stderr.buffer.write(stderr)
-
-children_usage = resource.getrusage(resource.RUSAGE_CHILDREN)
-cpu_ms = int((children_usage.ru_utime + children_usage.ru_stime) * 1000)
-usage = {
-    'wall_ms': int((end - start) * 1000),
-    'cpu_ms': cpu_ms,
-    'max_rss_mb': int(children_usage.ru_maxrss / 1024)
-}
-(Path('usage.json')).write_text(json.dumps(usage))
+limit_exceeded = None
+program_signal = exit_signal(proc.returncode)
+usage = write_usage(start, end, rusage, signal_name=program_signal)
+if proc.returncode == -signal.SIGKILL and oom_kills() > OOM_KILLS_AT_START:
+    limit_exceeded = 'memory'
+elif proc.returncode in (-signal.SIGXCPU, -signal.SIGKILL) and usage['cpu_ms'] >= cpu_quota_seconds * 1000:
+    limit_exceeded = 'cpu_time'
+elif dropped['stdout'] or dropped['stderr']:
+    limit_exceeded = 'output'
+if limit_exceeded:
+    write_usage(start, end, rusage, limit_exceeded, signal_name=program_signal)
 
-sys.exit(proc.returncode or 0)
+# A program ended by a signal exits as a shell reports it, 128 plus the signal's number.
+sys.exit(128 - proc.returncode if proc.returncode < 0 else proc.returncode)
@@ -4,14 +4,17 @@ require 'fileutils'
 require 'open3'
 require 'timeout'
 
-spec = JSON.parse($stdin.read)
+# The spec is the first line of stdin; in interactive sessions the rest is the program's live input.
+spec = JSON.parse($stdin.gets)
 limits = spec['limits'] || {}
-Dir.chdir('/work')
+# The process backend runs entrypoints directly on the host and passes its own workdir.
+workdir = spec['workdir'] || '/work'
+Dir.chdir(workdir)
 
 ENV.clear
 (spec['env'] || {}).each { |k, v| ENV[k] = v }
-ENV['HOME'] = '/work'
-ENV['TMPDIR'] = '/work/tmp'
+ENV['HOME'] = workdir
+ENV['TMPDIR'] = File.join(workdir, 'tmp')
 ENV['PATH'] = '/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin'
 
 FileUtils.mkdir_p('tmp')
@@ -26,7 +29,7 @@ def read_cpu_jiffies(pid)
     rest = stat[(rp + 2)..-1].strip.split(/\s+/)
     utime = Integer(rest[11] || '0') rescue 0
     stime = Integer(rest[12] || '0') rescue 0
-    utime + stime
+    [utime, stime]
   rescue
     nil
   end
@@ -43,30 +46,170 @@ def read_vm_hwm_kb(pid)
   end
 end
 
+# How many forks the container's cgroup pids controller has refused so far (cgroup v2, then v1).
+def pids_refused
+  group = (File.read('/proc/self/cgroup')[/^0::(.*)$/, 1] || '') rescue ''
+  ["/sys/fs/cgroup#{group.chomp('/')}/pids.events", '/sys/fs/cgroup/pids/pids.events'].each do |events|
+    match = (File.read(events) rescue '').match(/^max (\d+)$/)
+    return Integer(match[1]) if match
+  end
+  0
+end
+
+# How many processes the kernel OOM killer has killed in the container's memory cgroup so far,
+# from the oom_kills.sh every runner shares: next to this file in the image, in runners/ for the
+# process backend.
+OOM_KILLS_SCRIPT = [__dir__, File.dirname(__dir__)].map { |dir| File.join(dir, 'oom_kills.sh') }.find { |script| File.file?(script) }
+
+def oom_kills
+  return 0 unless OOM_KILLS_SCRIPT
+
+  Integer(IO.popen(['/bin/sh', OOM_KILLS_SCRIPT], &:read).strip, exception: false) || 0
+rescue SystemCallError
+  0
+end
+
+# Check mode only parses the sources with `ruby -c`, without running the program.
+if spec['mode'] == 'check'
+  check_start = Process.clock_gettime(Process::CLOCK_MONOTONIC, :millisecond)
+  scripts = Dir.glob('**/*.rb').reject { |name| name.start_with?('tmp/', 'inputs/', 'outputs/') }.sort
+  exit_code = 0
+  check_stderr = +''
+  scripts.each do |script|
+    out, status = Open3.capture2e('ruby', '-c', script)
+    next if status.success?
+
+    exit_code = 1
+    check_stderr << out
+  end
+  compile_phase = {
+    exit_code: exit_code,
+    duration_ms: Process.clock_gettime(Process::CLOCK_MONOTONIC, :millisecond) - check_start,
+    stdout: '',
+    stderr: check_stderr.byteslice(0, limits['max_output_bytes'] || 1024 * 1024).scrub
+  }
+  $stderr.write(compile_phase[:stderr])
+  File.write('usage.json', JSON.generate({ wall_ms: 0, cpu_ms: 0, max_rss_mb: 0, limit_exceeded: nil, compile: compile_phase }))
+  exit(exit_code)
+end
+
 cmd = ['ruby', 'main.rb', '--', *(spec['args'] || [])]
-stdout_str = ''
-stderr_str = ''
+# libfaketime starts the program's wall clock at, or holds it to, the time the run asked for in
+# EXECUTOR_FAKE_TIME. The monotonic clock stays real, so sleeps and the time limit behave.
+fake_time = ENV.delete('EXECUTOR_FAKE_TIME')
+if fake_time && !fake_time.empty?
+  library = [*Dir.glob('/usr/lib/*/faketime/libfaketime.so.1'), '/usr/lib/faketime/libfaketime.so.1'].find { |path| File.exist?(path) }
+  unless library
+    $stderr.write("a fixed clock needs libfaketime, which this runner image does not have\n")
+    exit(1)
+  end
+  ENV.update('LD_PRELOAD' => library, 'FAKETIME' => fake_time, 'FAKETIME_DONT_FAKE_MONOTONIC' => '1')
+end
+# rand, shuffle, sample and the like draw from the default generator, seeded before the
+# program's first line.
+random_seed = ENV.delete('EXECUTOR_RANDOM_SEED')
+if random_seed
+  seed_file = File.join(workdir, 'tmp', 'seed.rb')
+  File.write(seed_file, "srand(#{Integer(random_seed)})\n")
+  cmd.insert(1, '-r', seed_file)
+end
 status = nil
+output_limit = limits['max_output_bytes'] || 1024 * 1024
+# Each stream has its own cap, max_output_bytes unless set. With on_output_limit=kill the program
+# is stopped at the first byte past a cap instead of having the rest of its output discarded.
+stdout_limit = limits['max_stdout_bytes'] || output_limit
+stderr_limit = limits['max_stderr_bytes'] || output_limit
+kill_on_output_limit = spec['on_output_limit'] == 'kill'
+cpu_seconds = [(limits['cpu_ms'] || 5000) / 1000, 1].max
+# RLIMIT_NPROC backs up the container's --pids-limit where there is no pids cgroup.
+max_processes = limits['max_processes'] || 32
+max_open_files = limits['max_open_files'] || 256
+# Core dumps stay off unless the run asks for them, and never exceed what the host allows.
+core_bytes = (limits['core_dump_mb'] || 0) * 1024 * 1024
+core_hard = Process.getrlimit(:CORE)[1]
+core_bytes = [core_bytes, core_hard].min unless core_hard == Process::RLIM_INFINITY
+# A fork refused from here on means the run hit max_processes.
+pids_refused_at_start = pids_refused
+# An OOM kill from here on means the run hit memory_mb.
+oom_kills_at_start = oom_kills
+
+# Output forwarded from each stream, up to its cap.
+CAPTURED = { stdout: 0, stderr: 0 }
+
+# Forward output as it arrives so the API can stream it; anything past the cap is dropped.
+# Returns [written, dropped] byte counts; on_overflow runs for every chunk that did not fit.
+def pump(stream, source, sink, limit, on_overflow)
+  written = 0
+  dropped = 0
+  loop do
+    chunk = source.readpartial(65_536)
+    part = chunk.byteslice(0, [limit - written, 0].max) || ''
+    on_overflow.call if part.bytesize < chunk.bytesize
+    dropped += chunk.bytesize - part.bytesize
+    next if part.empty?
+    sink.write(part)
+    sink.flush
+    written += part.bytesize
+    CAPTURED[stream] += part.bytesize
+  end
+rescue EOFError, IOError
+  [written, dropped]
+end
+
+# The program leads its own process group, so this reaches every process it started as well.
+def signal_group(signal, pid)
+  Process.kill(signal, -pid)
+rescue StandardError
+  nil
+end
 
 start_ms = (Process.clock_gettime(Process::CLOCK_MONOTONIC, :millisecond) rescue (Time.now.to_f * 1000).to_i)
-cpu_jiffies = 0
+# User and system CPU jiffies from the latest /proc sample.
+cpu_jiffies = [0, 0]
 max_rss_kb = 0
 
-Open3.popen3(*cmd) do |stdin, stdout, stderr, wait_thr|
-  stdin.close
+Open3.popen3(*cmd, rlimit_cpu: cpu_seconds, rlimit_nproc: max_processes, rlimit_nofile: max_open_files, rlimit_core: core_bytes,
+                      pgroup: true) do |stdin, stdout, stderr, wait_thr|
   pid = wait_thr.pid
 
-  out_thread = Thread.new { stdout_str = stdout.read.to_s }
-  err_thread = Thread.new { stderr_str = stderr.read.to_s }
+  in_thread = Thread.new do
+    if spec['interactive']
+      # Relay the session's input until the caller closes it.
+      loop do
+        stdin.write($stdin.readpartial(65536))
+        stdin.flush
+      end
+    else
+      stdin.write(spec['stdin'] || '')
+    end
+  rescue Errno::EPIPE, IOError, EOFError
+    nil
+  ensure
+    stdin.close unless stdin.closed?
+  end
+
+  overflow = lambda do
+    signal_group('KILL', pid) if kill_on_output_limit
+  end
+  out_thread = Thread.new { pump(:stdout, stdout, $stdout, stdout_limit, overflow) }
+  err_thread = Thread.new { pump(:stderr, stderr, $stderr, stderr_limit, overflow) }
 
+  # At the wall-clock limit the program gets SIGTERM and kill_grace_ms to flush its output and
+  # exit; after that its whole process group is SIGKILLed.
+  kill_grace = (limits['kill_grace_ms'] || 1000) / 1000.0
   timed_out = false
+  stage = nil
+  grace_ms = 0
+  flushed_from = 0
   timeout_thread = Thread.new do
     sleep((limits['timeout_ms'] || 5000) / 1000.0)
-    begin
-      Process.kill('KILL', pid)
-      timed_out = true
-    rescue StandardError
-    end
+    timed_out = true
+    flushed_from = CAPTURED.values.sum
+    terminated_ms = Process.clock_gettime(Process::CLOCK_MONOTONIC, :millisecond)
+    signal_group('TERM', pid)
+    stage = wait_thr.join(kill_grace) ? 'soft' : 'hard'
+    signal_group('KILL', pid)
+    grace_ms = Process.clock_gettime(Process::CLOCK_MONOTONIC, :millisecond) - terminated_ms
   end
 
   sampler = Thread.new do
@@ -81,24 +224,57 @@ Open3.popen3(*cmd) do |stdin, stdout, stderr, wait_thr|
   end
 
   status = wait_thr.value
-  timeout_thread.kill
+  in_thread.kill
+  timed_out ? timeout_thread.join : timeout_thread.kill
+  # Background processes the program left behind would keep its output open.
+  signal_group('KILL', pid)
   sampler.join
-  out_thread.join
-  err_thread.join
+  _, stdout_dropped = out_thread.value
+  stderr_written, stderr_dropped = err_thread.value
 
-  if timed_out && (stderr_str.nil? || stderr_str.empty?)
-    stderr_str = 'Execution timed out'
+  if timed_out && stderr_written.to_i.zero?
+    $stderr.write('Execution timed out')
   end
 
-  limit = limits['max_output_bytes'] || 1024 * 1024
-  $stdout.write((stdout_str || '').byteslice(0, limit) || '')
-  $stderr.write((stderr_str || '').byteslice(0, limit) || '')
-
   wall_ms = ((Process.clock_gettime(Process::CLOCK_MONOTONIC, :millisecond) rescue (Time.now.to_f * 1000).to_i) - start_ms)
-  cpu_ms = ((cpu_jiffies || 0) * (1000.0 / HZ)).round
+  user_cpu_ms = (cpu_jiffies[0] * (1000.0 / HZ)).round
+  system_cpu_ms = (cpu_jiffies[1] * (1000.0 / HZ)).round
+  cpu_ms = user_cpu_ms + system_cpu_ms
   max_rss_mb = [[max_rss_kb || 0, 0].max / 1024.0].max.round
-  usage = { wall_ms: wall_ms, cpu_ms: cpu_ms, max_rss_mb: max_rss_mb }
+  # The signal that ended the program, unless it was the one stopping it at the time limit.
+  exit_signal = !timed_out && status&.signaled? ? "SIG#{Signal.signame(status.termsig)}" : nil
+  limit_exceeded =
+    if pids_refused > pids_refused_at_start
+      # A refused fork explains whatever followed it, a timeout included.
+      'processes'
+    elsif timed_out
+      'wall_time'
+    elsif exit_signal == 'SIGKILL' && oom_kills > oom_kills_at_start
+      'memory'
+    elsif status&.signaled? && %w[XCPU KILL].include?(Signal.signame(status.termsig)) && cpu_ms >= cpu_seconds * 1000
+      'cpu_time'
+    elsif stdout_dropped.to_i.positive? || stderr_dropped.to_i.positive?
+      'output'
+    end
+  usage = {
+    wall_ms: wall_ms,
+    cpu_ms: cpu_ms,
+    user_cpu_ms: user_cpu_ms,
+    system_cpu_ms: system_cpu_ms,
+    max_rss_mb: max_rss_mb,
+    limit_exceeded: limit_exceeded,
+    timeout: timed_out ? {
+      stage: stage,
+      grace_ms: grace_ms,
+      stdout_bytes: CAPTURED[:stdout],
+      stderr_bytes: CAPTURED[:stderr],
+      flushed_bytes: CAPTURED.values.sum - flushed_from
+    } : nil,
+    signal: exit_signal,
+    dropped_bytes: { stdout: stdout_dropped.to_i, stderr: stderr_dropped.to_i }
+  }
   File.write('usage.json', JSON.generate(usage))
 
-  exit(timed_out ? 124 : (status && status.exitstatus ? status.exitstatus : 0))
+  # A program ended by a signal exits as a shell reports it, 128 plus the signal's number.
+  exit(timed_out ? 124 : exit_signal ? 128 + status.termsig : (status && status.exitstatus ? status.exitstatus : 0))
 end
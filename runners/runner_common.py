@@ -0,0 +1,47 @@
+# Helpers the Python runner entrypoints share. Every image copies this next to its entrypoint;
+# the process backend runs entrypoints from runners/<language>/ and finds it in runners/.
+import signal
+import subprocess
+import time
+from pathlib import Path
+
+# Shared with the runners not written in Python, which is why it is a shell script.
+OOM_KILLS_SCRIPT = Path(__file__).with_name('oom_kills.sh')
+
+
+def oom_kills():
+    # How many processes the kernel OOM killer has killed in the container's memory cgroup so far.
+    try:
+        return int(subprocess.run(['/bin/sh', str(OOM_KILLS_SCRIPT)], capture_output=True, timeout=5).stdout)
+    except (OSError, ValueError, subprocess.SubprocessError):
+        return 0
+
+
+def stop_in_two_stages(proc, grace, kill_group, wait, captured, pumps):
+    # Stops a program past the wall-clock limit in two stages: SIGTERM, then SIGKILL for its whole
+    # process group once `grace` seconds run out. kill_group(signum) signals the group and
+    # wait(proc, timeout) reaps the program for its rusage, raising TimeoutExpired like Popen.wait;
+    # `captured` counts the output the pumps forwarded per stream. Returns the rusage and which
+    # stage ended it, with how much output it left and how much of that came after SIGTERM.
+    flushed_from = captured['stdout'] + captured['stderr']
+    terminated = time.monotonic()
+    kill_group(signal.SIGTERM)
+    try:
+        rusage = wait(proc, grace)
+        stage = 'soft'
+    except subprocess.TimeoutExpired:
+        kill_group()
+        rusage = wait(proc)
+        stage = 'hard'
+    grace_ms = int((time.monotonic() - terminated) * 1000)
+    # Whatever it left running would keep its output open.
+    kill_group()
+    for thread in pumps:
+        thread.join()
+    return rusage, {
+        'stage': stage,
+        'grace_ms': grace_ms,
+        'stdout_bytes': captured['stdout'],
+        'stderr_bytes': captured['stderr'],
+        'flushed_bytes': captured['stdout'] + captured['stderr'] - flushed_from
+    }
@@ -0,0 +1,521 @@
+#!/usr/bin/env python3
+import hashlib
+import json
+import os
+import resource
+import shutil
+import signal
+import subprocess
+import sys
+import threading
+import time
+from pathlib import Path
+
+# runner_common.py sits next to the entrypoint in the image and in runners/ for the process backend.
+sys.path.append(str(Path(__file__).resolve().parent.parent))
+from runner_common import oom_kills, stop_in_two_stages
+
+
+def read_spec():
+    # The spec is the first line of stdin. It is read straight from fd 0 so that whatever follows,
+    # an interactive session's live input, is left for relay_stdin rather than buffered away.
+    data = b''
+    while b'\n' not in data:
+        chunk = os.read(0, 65536)
+        if not chunk:
+            break
+        data += chunk
+    line, _, rest = data.partition(b'\n')
+    return json.loads(line), rest
+
+
+SPEC, STDIN_REST = read_spec()
+# The process backend runs entrypoints directly on the host and passes its own workdir.
+WORKDIR = Path(SPEC.get('workdir') or '/work')
+LIMITS = SPEC.get('limits', {})
+# Compile mode stops after the build and check mode only type-checks the crate (no code
+# generation); neither gets as far as running the program.
+MODE = SPEC.get('mode', 'run')
+
+os.chdir(WORKDIR)
+
+# Setup environment
+env = {key: value for key, value in SPEC.get('env', {}).items()}
+os.environ.clear()
+os.environ.update(env)
+os.environ['HOME'] = str(WORKDIR)
+os.environ['TMPDIR'] = str(WORKDIR / 'tmp')
+os.environ['PATH'] = '/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin:/usr/local/cargo/bin'
+os.environ['RUSTUP_HOME'] = '/usr/local/rustup'
+# Crates are vendored into the image (if at all); keep cargo state inside the writable workdir
+os.environ['CARGO_HOME'] = str(WORKDIR / 'tmp' / 'cargo')
+os.environ['CARGO_TARGET_DIR'] = str(WORKDIR / 'tmp' / 'target')
+
+Path('tmp').mkdir(parents=True, exist_ok=True)
+Path('outputs').mkdir(parents=True, exist_ok=True)
+
+
+def toolchain_version():
+    try:
+        probe = subprocess.run(['rustc', '--version'], capture_output=True, timeout=5)
+        return probe.stdout.decode('utf8', errors='replace').strip() or None
+    except (OSError, subprocess.SubprocessError):
+        return None
+
+
+TOOLCHAIN = toolchain_version()
+
+# Set resource limits
+memory_bytes = int(LIMITS.get('memory_mb', 256) * 1024 * 1024)
+cpu_ms = int(LIMITS.get('cpu_ms', 5000))
+cpu_quota_seconds = max(1, cpu_ms // 1000 or 1)
+# RLIMIT_AS is left unset: rustc reserves large virtual ranges it never touches
+resource.setrlimit(resource.RLIMIT_DATA, (memory_bytes, memory_bytes))
+resource.setrlimit(resource.RLIMIT_FSIZE, (50 * 1024 * 1024, 50 * 1024 * 1024))
+# RLIMIT_NPROC backs up the container's --pids-limit where there is no pids cgroup.
+max_processes = int(LIMITS.get('max_processes', 256))
+resource.setrlimit(resource.RLIMIT_NPROC, (max_processes, max_processes))
+max_open_files = int(LIMITS.get('max_open_files', 256))
+resource.setrlimit(resource.RLIMIT_NOFILE, (max_open_files, max_open_files))
+# Core dumps stay off unless the run asks for them, and never exceed what the host allows.
+core_bytes = int(LIMITS.get('core_dump_mb', 0)) * 1024 * 1024
+core_hard = resource.getrlimit(resource.RLIMIT_CORE)[1]
+if core_hard != resource.RLIM_INFINITY:
+    core_bytes = min(core_bytes, core_hard)
+resource.setrlimit(resource.RLIMIT_CORE, (core_bytes, core_bytes))
+resource.setrlimit(resource.RLIMIT_CPU, (cpu_quota_seconds, cpu_quota_seconds))
+
+
+def pids_refused():
+    # How many forks the container's cgroup pids controller has refused so far (cgroup v2, then v1).
+    try:
+        group = next((line[3:] for line in Path('/proc/self/cgroup').read_text().splitlines() if line.startswith('0::')), '')
+    except OSError:
+        group = ''
+    candidates = [Path('/sys/fs/cgroup') / group.lstrip('/') / 'pids.events', Path('/sys/fs/cgroup/pids/pids.events')]
+    for events in candidates:
+        try:
+            for line in events.read_text().splitlines():
+                key, _, value = line.partition(' ')
+                if key == 'max':
+                    return int(value)
+        except (OSError, ValueError):
+            continue
+    return 0
+
+
+# A fork refused from here on means the run hit max_processes.
+PIDS_REFUSED_AT_START = pids_refused()
+
+
+# An OOM kill from here on means the run hit memory_mb.
+OOM_KILLS_AT_START = oom_kills()
+
+BUILD_DIR = Path('.build')
+CACHED_COMPILE = {'exit_code': 0, 'duration_ms': 0, 'stdout': '', 'stderr': '', 'cached': True}
+
+
+def publish_build(outputs):
+    # Copy the compiled outputs into .build/ for the API's compilation cache. The digest is taken
+    # before any submission code runs, so the API can refuse a build the program rewrote.
+    BUILD_DIR.mkdir(exist_ok=True)
+    for source, name in outputs:
+        if Path(source).is_dir():
+            shutil.copytree(source, BUILD_DIR / name, dirs_exist_ok=True)
+        elif Path(source).exists():
+            shutil.copy2(source, BUILD_DIR / name)
+    names = sorted(p.relative_to(BUILD_DIR).as_posix() for p in BUILD_DIR.rglob('*') if p.is_file())
+    digest = hashlib.sha256()
+    for name in names:
+        contents = hashlib.sha256((BUILD_DIR / name).read_bytes()).hexdigest()
+        digest.update(f'{name}\0{contents}\n'.encode('utf8'))
+    return digest.hexdigest()
+
+
+def restore_build(outputs):
+    # The API restored this exact build from its compilation cache into .build/.
+    for name, dest in outputs:
+        if (BUILD_DIR / name).is_dir():
+            shutil.copytree(BUILD_DIR / name, dest, dirs_exist_ok=True)
+        elif (BUILD_DIR / name).exists():
+            shutil.copy2(BUILD_DIR / name, dest)
+
+
+# COMPILATION PHASE
+output_limit = int(LIMITS.get('max_output_bytes', 1024 * 1024))
+# Each stream has its own cap, max_output_bytes unless set. With on_output_limit=kill the program
+# is stopped at the first byte past a cap instead of having the rest of its output discarded.
+stream_limits = {
+    'stdout': int(LIMITS.get('max_stdout_bytes', output_limit)),
+    'stderr': int(LIMITS.get('max_stderr_bytes', output_limit)),
+}
+KILL_ON_OUTPUT_LIMIT = SPEC.get('on_output_limit') == 'kill'
+compile_start = time.time()
+PREBUILT = bool(SPEC.get('prebuilt')) and (BUILD_DIR / 'main').exists() and MODE != 'check'
+if PREBUILT:
+    restore_build([('main', 'main')])
+    compile_phase = CACHED_COMPILE
+    BUILD_DIGEST = None
+    DIAGNOSTICS = []
+else:
+    # Crates (Cargo.toml present) build with cargo offline; otherwise main.rs is compiled directly and
+    # may pull in sibling files with `mod`.
+    # Both report diagnostics as JSON, which compiler_output turns back into the usual text.
+    if Path('Cargo.toml').exists() and MODE == 'check':
+        compile_cmd = ['cargo', 'check', '--release', '--offline', '--quiet', '--message-format=json']
+    elif Path('Cargo.toml').exists():
+        compile_cmd = ['cargo', 'build', '--release', '--offline', '--quiet', '--message-format=json']
+    elif MODE == 'check':
+        compile_cmd = ['rustc', '--edition', '2021', '--error-format=json', '--emit=metadata', '-o', 'tmp/main.rmeta', 'main.rs']
+    else:
+        compile_cmd = ['rustc', '--edition', '2021', '-O', '--error-format=json', '-o', 'main', 'main.rs']
+
+    compile_proc = subprocess.Popen(
+        compile_cmd, 
+        stdout=subprocess.PIPE, 
+        stderr=subprocess.PIPE,
+        text=False
+    )
+
+    def compiler_output(stdout, stderr):
+        # rustc prints one JSON diagnostic per line on stderr; cargo wraps them in `compiler-message`
+        # records on stdout among records about artifacts. Returns the diagnostics, then both
+        # streams as they read without JSON output, each diagnostic's rendered text on stderr.
+        diagnostics, streams = [], {'stdout': [], 'stderr': []}
+        for name, data in (('stdout', stdout), ('stderr', stderr)):
+            for line in data.decode('utf8', errors='replace').splitlines(keepends=True):
+                try:
+                    record = json.loads(line)
+                except ValueError:
+                    record = None
+                if not isinstance(record, dict):
+                    streams[name].append(line)
+                    continue
+                message = record.get('message') if record.get('reason') == 'compiler-message' else record
+                if not isinstance(message, dict) or 'level' not in message:
+                    continue
+                streams['stderr'].append(message.get('rendered') or '')
+                primary = next((span for span in message.get('spans', []) if span.get('is_primary')), None)
+                # Notes and summaries such as `aborting due to 1 previous error` point at no code.
+                if primary is None or message['level'] not in ('error', 'warning'):
+                    continue
+                diagnostics.append({
+                    'source': 'compile',
+                    'file': primary.get('file_name', ''),
+                    'line': primary.get('line_start'),
+                    'column': primary.get('column_start'),
+                    'code': (message.get('code') or {}).get('code'),
+                    'severity': message['level'],
+                    'message': message.get('message', '')
+                })
+        return diagnostics, ''.join(streams['stdout']).encode('utf8'), ''.join(streams['stderr']).encode('utf8')
+
+    def compile_report(exit_code, stdout, stderr):
+        # Compile output is reported separately from the program's streams so callers can tell
+        # build failures from runtime failures.
+        return {
+            'exit_code': exit_code,
+            'duration_ms': int((time.time() - compile_start) * 1000),
+            'stdout': stdout[:output_limit].decode('utf8', errors='replace'),
+            'stderr': stderr[:output_limit].decode('utf8', errors='replace')
+        }
+
+    try:
+        # rustc is slower than most toolchains; give compilation 20 seconds max
+        compile_stdout, compile_stderr = compile_proc.communicate(timeout=20)
+    except subprocess.TimeoutExpired:
+        compile_proc.kill()
+        DIAGNOSTICS, compile_stdout, compile_stderr = compiler_output(*compile_proc.communicate())
+        sys.stderr.buffer.write(b'Compilation timed out\n')
+        Path('usage.json').write_text(json.dumps({
+            'wall_ms': 0,
+            'compile_ms': int((time.time() - compile_start) * 1000),
+            'cpu_ms': 0,
+            'max_rss_mb': 0,
+            'limit_exceeded': 'wall_time',
+            'toolchain': TOOLCHAIN,
+            'compile': compile_report(None, compile_stdout, compile_stderr),
+            'diagnostics': DIAGNOSTICS
+        }))
+        sys.exit(124)
+
+    DIAGNOSTICS, compile_stdout, compile_stderr = compiler_output(compile_stdout, compile_stderr)
+    compile_phase = compile_report(compile_proc.returncode, compile_stdout, compile_stderr)
+
+    # Check compilation result
+    if compile_proc.returncode != 0:
+        # Compilation failed - report compilation errors
+        sys.stderr.buffer.write(b'Compilation failed:\n')
+        sys.stderr.buffer.write(compile_stderr[:output_limit])
+        Path('usage.json').write_text(json.dumps({
+            'wall_ms': 0,
+            'compile_ms': compile_phase['duration_ms'],
+            'cpu_ms': 0,
+            'max_rss_mb': 0,
+            'limit_exceeded': None,
+            'toolchain': TOOLCHAIN,
+            'compile': compile_phase,
+            'diagnostics': DIAGNOSTICS
+        }))
+        sys.exit(1)
+
+compile_time = time.time() - compile_start
+
+
+def cargo_binary():
+    # cargo names the binary after the package; pick the executable it produced.
+    release = WORKDIR / 'tmp' / 'target' / 'release'
+    for candidate in sorted(release.iterdir()):
+        if candidate.is_file() and os.access(candidate, os.X_OK):
+            return str(candidate)
+    return './main'
+
+
+# A cached crate build was restored as ./main alongside rustc builds.
+binary = cargo_binary() if Path('Cargo.toml').exists() and not PREBUILT and MODE != 'check' else './main'
+if not PREBUILT and MODE != 'check':
+    BUILD_DIGEST = publish_build([(binary, 'main')])
+
+if MODE in ('compile', 'check'):
+    Path('usage.json').write_text(json.dumps({
+        'wall_ms': 0,
+        'compile_ms': int(compile_time * 1000),
+        'cpu_ms': 0,
+        'max_rss_mb': 0,
+        'limit_exceeded': None,
+        'toolchain': TOOLCHAIN,
+        'compile': compile_phase,
+        'diagnostics': DIAGNOSTICS,
+        'build_digest': BUILD_DIGEST if MODE == 'compile' else None
+    }))
+    sys.exit(0)
+
+# EXECUTION PHASE
+run_cmd = [binary] + SPEC.get('args', [])
+dropped = {'stdout': 0, 'stderr': 0}
+# Output forwarded from each stream, up to its cap.
+captured = {'stdout': 0, 'stderr': 0}
+
+
+def drop(name, count):
+    # Counts the bytes of a chunk that did not fit under the stream's cap.
+    if count and KILL_ON_OUTPUT_LIMIT:
+        kill_group()
+    dropped[name] += count
+
+
+def pump(name, source, sink, limit):
+    # Forward output as it is produced so progress reaches the caller live, capped at the limit.
+    written = 0
+    while True:
+        chunk = os.read(source.fileno(), 65536)
+        if not chunk:
+            break
+        part = chunk[: max(0, limit - written)]
+        if part:
+            sink.write(part)
+            sink.flush()
+            written += len(part)
+            captured[name] += len(part)
+        drop(name, len(chunk) - len(part))
+
+
+def feed_stdin(sink, payload):
+    # Write the caller-supplied stdin and close it so programs reading until EOF terminate.
+    try:
+        if payload:
+            sink.write(payload)
+    except BrokenPipeError:
+        pass
+    finally:
+        try:
+            sink.close()
+        except BrokenPipeError:
+            pass
+
+
+def relay_stdin(sink):
+    # Interactive sessions forward the caller's input as it arrives until they close it.
+    try:
+        if STDIN_REST:
+            sink.write(STDIN_REST)
+            sink.flush()
+        while True:
+            chunk = os.read(0, 65536)
+            if not chunk:
+                break
+            sink.write(chunk)
+            sink.flush()
+    except BrokenPipeError:
+        pass
+    finally:
+        try:
+            sink.close()
+        except BrokenPipeError:
+            pass
+
+
+def stdin_feeder(proc):
+    # The caller may never close a live session's stdin, so that relay must not block exit.
+    if SPEC.get('interactive'):
+        return threading.Thread(target=relay_stdin, args=(proc.stdin,), daemon=True)
+    return threading.Thread(target=feed_stdin, args=(proc.stdin, SPEC.get('stdin', '').encode('utf8')))
+
+
+def wait_program(proc, timeout=None):
+    # Reaps the program with wait4 to get its own rusage: RUSAGE_CHILDREN would also count the
+    # compiler and every helper process that ran before it. Raises TimeoutExpired like Popen.wait.
+    deadline = None if timeout is None else time.monotonic() + timeout
+    while True:
+        pid, status, rusage = os.wait4(proc.pid, 0 if deadline is None else os.WNOHANG)
+        if pid:
+            proc.returncode = os.waitstatus_to_exitcode(status)
+            return rusage
+        if time.monotonic() >= deadline:
+            raise subprocess.TimeoutExpired(proc.args, timeout)
+        time.sleep(0.005)
+
+
+# At the wall-clock limit the program gets SIGTERM and this long to flush its output and exit.
+KILL_GRACE = LIMITS.get('kill_grace_ms', 1000) / 1000
+
+
+def kill_group(signum=signal.SIGKILL):
+    # The program leads its own session, so this reaches every process it started as well.
+    try:
+        os.killpg(proc.pid, signum)
+    except ProcessLookupError:
+        pass
+
+
+def exit_signal(returncode):
+    # Name of the signal that ended the program, None when it exited by itself.
+    if returncode is None or returncode >= 0:
+        return None
+    try:
+        return signal.Signals(-returncode).name
+    except ValueError:
+        return f'SIG{-returncode}'
+
+
+def write_usage(start, end, rusage=None, limit_exceeded=None, timeout=None, signal_name=None):
+    # Figures of the program alone, from wait_program; zero when it never ran.
+    if pids_refused() > PIDS_REFUSED_AT_START:
+        # A refused fork explains whatever followed it, a timeout included.
+        limit_exceeded = 'processes'
+    user_ms = int(rusage.ru_utime * 1000) if rusage else 0
+    system_ms = int(rusage.ru_stime * 1000) if rusage else 0
+    usage = {
+        'wall_ms': int((end - start) * 1000),
+        'compile_ms': int(compile_time * 1000),
+        'cpu_ms': user_ms + system_ms,
+        'user_cpu_ms': user_ms,
+        'system_cpu_ms': system_ms,
+        # ru_maxrss is in KiB on Linux.
+        'max_rss_mb': int(rusage.ru_maxrss / 1024) if rusage else 0,
+        'limit_exceeded': limit_exceeded,
+        'timeout': timeout,
+        'signal': signal_name,
+        'dropped_bytes': dict(dropped),
+        'toolchain': TOOLCHAIN,
+        'compile': compile_phase,
+        'diagnostics': DIAGNOSTICS,
+        'build_digest': BUILD_DIGEST
+    }
+    Path('usage.json').write_text(json.dumps(usage))
+    return usage
+
+
+def fixed_clock(env):
+    # libfaketime settings that start the program's wall clock at, or hold it to, the time the run
+    # asked for in EXECUTOR_FAKE_TIME. The monotonic clock stays real, so sleeps and the time limit
+    # behave as usual.
+    fake_time = env.pop('EXECUTOR_FAKE_TIME', None)
+    if not fake_time:
+        return {}
+    candidates = [*Path('/usr/lib').glob('*/faketime/libfaketime.so.1'), Path('/usr/lib/faketime/libfaketime.so.1')]
+    library = next((path for path in candidates if path.exists()), None)
+    if library is None:
+        sys.stderr.write('a fixed clock needs libfaketime, which this runner image does not have\n')
+        sys.exit(1)
+    return {'LD_PRELOAD': str(library), 'FAKETIME': fake_time, 'FAKETIME_DONT_FAKE_MONOTONIC': '1'}
+
+
+# Signals whose default action dumps core.
+CORE_SIGNALS = (
+    signal.SIGSEGV, signal.SIGBUS, signal.SIGABRT, signal.SIGFPE, signal.SIGILL, signal.SIGTRAP, signal.SIGSYS, signal.SIGQUIT
+)
+MAX_BACKTRACE_BYTES = 64 * 1024
+
+
+def collect_crash(returncode, binary, since):
+    # With core_dump_mb set, a crash leaves its core, which the kernel already cut off at the
+    # limit, and the stack trace gdb reads from it under outputs/crash/, where they become
+    # artifacts. The kernel only writes cores into the working directory when the host's
+    # core_pattern is a plain file name such as `core`; with a pipe to a crash handler there is
+    # nothing to collect.
+    if core_bytes == 0 or returncode >= 0 or -returncode not in CORE_SIGNALS:
+        return
+    cores = [path for path in Path('.').glob('core*') if path.is_file() and path.stat().st_mtime >= since]
+    if not cores:
+        return
+    crash_dir = Path('outputs/crash')
+    crash_dir.mkdir(parents=True, exist_ok=True)
+    core = crash_dir / 'core'
+    shutil.move(str(max(cores, key=lambda path: path.stat().st_mtime)), core)
+    if shutil.which('gdb') is None:
+        return
+    try:
+        trace = subprocess.run(['gdb', '--batch', '-nx', '-ex', 'bt', binary, str(core)], capture_output=True, timeout=5)
+    except subprocess.TimeoutExpired:
+        return
+    (crash_dir / 'backtrace.txt').write_bytes(trace.stdout[:MAX_BACKTRACE_BYTES])
+
+
+# Only the program runs against a fixed clock; the build kept the real one.
+os.environ.update(fixed_clock(os.environ))
+# Tells the API that the build is done and the program is starting.
+Path('.run_started').touch()
+start = time.time()
+proc = subprocess.Popen(
+    run_cmd, stdin=subprocess.PIPE, stdout=subprocess.PIPE, stderr=subprocess.PIPE, text=False, start_new_session=True
+)
+stdin_feeder(proc).start()
+pumps = [
+    threading.Thread(target=pump, args=('stdout', proc.stdout, sys.stdout.buffer, stream_limits['stdout'])),
+    threading.Thread(target=pump, args=('stderr', proc.stderr, sys.stderr.buffer, stream_limits['stderr'])),
+]
+for thread in pumps:
+    thread.start()
+
+try:
+    timeout = LIMITS.get('timeout_ms', 5000) / 1000
+    rusage = wait_program(proc, timeout)
+except subprocess.TimeoutExpired:
+    rusage, timeout_report = stop_in_two_stages(proc, KILL_GRACE, kill_group, wait_program, captured, pumps)
+    sys.stderr.buffer.write(b'Execution timed out\n')
+    write_usage(start, time.time(), rusage, 'wall_time', timeout_report)
+    sys.exit(124)
+
+end = time.time()
+# Background processes the program left behind would keep its output open.
+kill_group()
+for thread in pumps:
+    thread.join()
+
+limit_exceeded = None
+program_signal = exit_signal(proc.returncode)
+usage = write_usage(start, end, rusage, signal_name=program_signal)
+if proc.returncode == -signal.SIGKILL and oom_kills() > OOM_KILLS_AT_START:
+    limit_exceeded = 'memory'
+elif proc.returncode in (-signal.SIGXCPU, -signal.SIGKILL) and usage['cpu_ms'] >= cpu_quota_seconds * 1000:
+    limit_exceeded = 'cpu_time'
+elif dropped['stdout'] or dropped['stderr']:
+    limit_exceeded = 'output'
+if limit_exceeded:
+    write_usage(start, end, rusage, limit_exceeded, signal_name=program_signal)
+
+collect_crash(proc.returncode, binary, start)
+
+# A program ended by a signal exits as a shell reports it, 128 plus the signal's number.
+sys.exit(128 - proc.returncode if proc.returncode < 0 else proc.returncode)
@@ -0,0 +1,95 @@
+#!/usr/bin/env python3
+# Loads a seccomp-bpf deny-list and execs the runner entrypoint under it. The process sandbox
+# backend uses this in place of the container runtime's profile:
+#
+#   seccomp_exec.py '{"arch": "x86_64", "syscalls": [101], "socket_families": [2, 10]}' cmd args...
+#
+# Denied syscalls and socket(2) calls for the listed address families fail with EPERM. A filter
+# cannot be removed once loaded and is inherited across fork and exec.
+import ctypes
+import json
+import os
+import struct
+import sys
+
+# AUDIT_ARCH_* value and socket(2) number per architecture.
+ARCHES = {
+    'x86_64': (0xC000003E, 41),
+    'aarch64': (0xC00000B7, 198),
+}
+X32_SYSCALL_BIT = 0x40000000
+
+BPF_LD_W_ABS = 0x20
+BPF_JEQ_K = 0x15
+BPF_JGE_K = 0x35
+BPF_RET_K = 0x06
+SECCOMP_RET_KILL_PROCESS = 0x80000000
+SECCOMP_RET_ERRNO = 0x00050000
+SECCOMP_RET_ALLOW = 0x7FFF0000
+EPERM = 1
+
+# Offsets into struct seccomp_data; args[0] is read as its low word, both arches being little endian.
+DATA_NR = 0
+DATA_ARCH = 4
+DATA_ARG0 = 16
+
+PR_SET_NO_NEW_PRIVS = 38
+PR_SET_SECCOMP = 22
+SECCOMP_MODE_FILTER = 2
+
+
+def build_filter(arch, syscalls, socket_families):
+    audit_arch, socket_nr = ARCHES[arch]
+    deny = (BPF_RET_K, 0, 0, SECCOMP_RET_ERRNO | EPERM)
+    program = [
+        # Syscall numbers differ per ABI, so anything not made through the expected one is killed.
+        (BPF_LD_W_ABS, 0, 0, DATA_ARCH),
+        (BPF_JEQ_K, 1, 0, audit_arch),
+        (BPF_RET_K, 0, 0, SECCOMP_RET_KILL_PROCESS),
+        (BPF_LD_W_ABS, 0, 0, DATA_NR),
+    ]
+    if arch == 'x86_64':
+        # x32 calls share the x86_64 audit arch and would bypass the numbers below.
+        program += [(BPF_JGE_K, 0, 1, X32_SYSCALL_BIT), deny]
+    for nr in syscalls:
+        program += [(BPF_JEQ_K, 0, 1, nr), deny]
+    if socket_families:
+        # Non-socket calls jump over the family checks straight to the final allow.
+        program += [(BPF_JEQ_K, 0, 1 + 2 * len(socket_families), socket_nr), (BPF_LD_W_ABS, 0, 0, DATA_ARG0)]
+        for family in socket_families:
+            program += [(BPF_JEQ_K, 0, 1, family), deny]
+    program.append((BPF_RET_K, 0, 0, SECCOMP_RET_ALLOW))
+    return b''.join(struct.pack('<HBBI', *instruction) for instruction in program), len(program)
+
+
+class SockFprog(ctypes.Structure):
+    _fields_ = [('len', ctypes.c_ushort), ('filter', ctypes.c_char_p)]
+
+
+def load_filter(spec):
+    code, length = build_filter(spec['arch'], spec.get('syscalls', []), spec.get('socket_families', []))
+    libc = ctypes.CDLL(None, use_errno=True)
+    libc.prctl.argtypes = [ctypes.c_int, ctypes.c_ulong, ctypes.c_void_p, ctypes.c_ulong, ctypes.c_ulong]
+    # Required to install a filter without CAP_SYS_ADMIN; it also stops setuid binaries regaining privileges.
+    if libc.prctl(PR_SET_NO_NEW_PRIVS, 1, None, 0, 0) != 0:
+        raise OSError(ctypes.get_errno(), 'prctl(PR_SET_NO_NEW_PRIVS) failed')
+    program = SockFprog(length, code)
+    if libc.prctl(PR_SET_SECCOMP, SECCOMP_MODE_FILTER, ctypes.cast(ctypes.pointer(program), ctypes.c_void_p), 0, 0) != 0:
+        raise OSError(ctypes.get_errno(), 'prctl(PR_SET_SECCOMP) failed')
+
+
+def main():
+    if len(sys.argv) < 3:
+        sys.stderr.write('usage: seccomp_exec.py <filter-json> <command> [args...]\n')
+        sys.exit(2)
+    try:
+        load_filter(json.loads(sys.argv[1]))
+    except (OSError, KeyError, ValueError) as err:
+        # Never fall back to running the entrypoint unfiltered.
+        sys.stderr.write(f'seccomp: {err}\n')
+        sys.exit(126)
+    os.execvp(sys.argv[2], sys.argv[2:])
+
+
+if __name__ == '__main__':
+    main()
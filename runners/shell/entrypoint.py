@@ -0,0 +1,362 @@
+#!/usr/bin/env python3
+import json
+import os
+import resource
+import shutil
+import signal
+import subprocess
+import sys
+import threading
+import time
+from pathlib import Path
+
+# runner_common.py sits next to the entrypoint in the image and in runners/ for the process backend.
+sys.path.append(str(Path(__file__).resolve().parent.parent))
+from runner_common import oom_kills, stop_in_two_stages
+
+# Commands a script may call by name. The image links them into TOOLBOX, which is the script's
+# whole PATH; shells are left out so a restricted script cannot start an unrestricted one.
+TOOLS = [
+    'awk', 'base64', 'basename', 'bc', 'cat', 'chmod', 'cksum', 'cmp', 'comm', 'cp', 'cut', 'date',
+    'diff', 'dirname', 'du', 'env', 'expand', 'expr', 'factor', 'find', 'fold', 'grep', 'gzip', 'head',
+    'id', 'join', 'jq', 'ln', 'ls', 'md5sum', 'mkdir', 'mktemp', 'mv', 'nl', 'numfmt', 'od', 'paste',
+    'printf', 'readlink', 'realpath', 'rev', 'rm', 'rmdir', 'sed', 'seq', 'sha1sum', 'sha256sum',
+    'shuf', 'sleep', 'sort', 'split', 'stat', 'tac', 'tail', 'tar', 'tee', 'touch', 'tr', 'truncate',
+    'tsort', 'uname', 'unexpand', 'uniq', 'wc', 'xargs', 'yes', 'zcat'
+]
+TOOLBOX = Path('/opt/shell/bin')
+
+
+def install_toolbox(target):
+    # Run by the Dockerfile; the process backend builds a toolbox of the host's tools per run.
+    target.mkdir(parents=True, exist_ok=True)
+    for tool in TOOLS:
+        found = shutil.which(tool)
+        if found and not (target / tool).exists():
+            (target / tool).symlink_to(found)
+
+
+if len(sys.argv) == 3 and sys.argv[1] == '--install-toolbox':
+    install_toolbox(Path(sys.argv[2]))
+    sys.exit(0)
+
+
+def read_spec():
+    # The spec is the first line of stdin. It is read straight from fd 0 so that whatever follows,
+    # an interactive session's live input, is left for relay_stdin rather than buffered away.
+    data = b''
+    while b'\n' not in data:
+        chunk = os.read(0, 65536)
+        if not chunk:
+            break
+        data += chunk
+    line, _, rest = data.partition(b'\n')
+    return json.loads(line), rest
+
+
+SPEC, STDIN_REST = read_spec()
+# The process backend runs entrypoints directly on the host and passes its own workdir.
+WORKDIR = Path(SPEC.get('workdir') or '/work')
+LIMITS = SPEC.get('limits', {})
+SETTINGS = SPEC.get('settings', {})
+SHELL = 'sh' if SPEC.get('language') == 'sh' else 'bash'
+# Restricted bash (rbash) refuses cd, command names with a slash, output redirection, exec and
+# changes to PATH, so the script only reaches the toolbox; write files with tee instead.
+RESTRICTED = SHELL == 'bash' and SETTINGS.get('restricted', 'true') == 'true'
+
+os.chdir(WORKDIR)
+Path('tmp').mkdir(parents=True, exist_ok=True)
+Path('outputs').mkdir(parents=True, exist_ok=True)
+
+if not TOOLBOX.is_dir():
+    TOOLBOX = WORKDIR / 'tmp' / '.toolbox'
+    install_toolbox(TOOLBOX)
+
+env = {key: value for key, value in SPEC.get('env', {}).items()}
+env['HOME'] = str(WORKDIR)
+# The container backend mounts a noexec tmpfs at /tmp, so nothing a script drops there can be
+# executed; the process backend has no such mount and keeps temp files in the workdir.
+env['TMPDIR'] = '/tmp' if os.access('/tmp', os.W_OK) and SPEC.get('workdir') is None else str(WORKDIR / 'tmp')
+env['PATH'] = str(TOOLBOX)
+env['SHELL'] = shutil.which(SHELL) or f'/bin/{SHELL}'
+
+
+def toolchain_version():
+    # The image's sh is busybox ash, which has no --version; busybox names its own version.
+    command = ['bash', '--version'] if SHELL == 'bash' else ['sh', '-c', 'busybox | head -n 1']
+    try:
+        probe = subprocess.run(command, capture_output=True, timeout=5)
+        return probe.stdout.decode('utf8', errors='replace').strip().splitlines()[0]
+    except (OSError, subprocess.SubprocessError, IndexError):
+        return None
+
+
+TOOLCHAIN = toolchain_version()
+
+if SPEC.get('mode') == 'check':
+    # Check mode only parses the script with -n, which runs none of its commands.
+    check_start = time.time()
+    try:
+        check = subprocess.run([env['SHELL'], '-n', 'main.sh'], capture_output=True, timeout=10, env=env)
+        exit_code, check_stderr = check.returncode, check.stderr
+    except subprocess.TimeoutExpired as err:
+        exit_code, check_stderr = None, (err.stderr or b'') + b'Check timed out\n'
+    compile_phase = {
+        'exit_code': exit_code,
+        'duration_ms': int((time.time() - check_start) * 1000),
+        'stdout': '',
+        'stderr': check_stderr[:int(LIMITS.get('max_output_bytes', 1024 * 1024))].decode('utf8', errors='replace')
+    }
+    sys.stderr.write(compile_phase['stderr'])
+    Path('usage.json').write_text(json.dumps({
+        'wall_ms': 0,
+        'cpu_ms': 0,
+        'max_rss_mb': 0,
+        'limit_exceeded': None if exit_code is not None else 'wall_time',
+        'toolchain': TOOLCHAIN,
+        'compile': compile_phase
+    }))
+    sys.exit(0 if exit_code == 0 else 1)
+
+# Set resource limits
+memory_bytes = int(LIMITS.get('memory_mb', 256) * 1024 * 1024)
+cpu_ms = int(LIMITS.get('cpu_ms', 5000))
+cpu_quota_seconds = max(1, cpu_ms // 1000 or 1)
+resource.setrlimit(resource.RLIMIT_AS, (memory_bytes, memory_bytes))
+resource.setrlimit(resource.RLIMIT_FSIZE, (50 * 1024 * 1024, 50 * 1024 * 1024))
+# RLIMIT_NPROC backs up the container's --pids-limit where there is no pids cgroup.
+max_processes = int(LIMITS.get('max_processes', 64))
+resource.setrlimit(resource.RLIMIT_NPROC, (max_processes, max_processes))
+max_open_files = int(LIMITS.get('max_open_files', 256))
+resource.setrlimit(resource.RLIMIT_NOFILE, (max_open_files, max_open_files))
+# Core dumps stay off unless the run asks for them, and never exceed what the host allows.
+core_bytes = int(LIMITS.get('core_dump_mb', 0)) * 1024 * 1024
+core_hard = resource.getrlimit(resource.RLIMIT_CORE)[1]
+if core_hard != resource.RLIM_INFINITY:
+    core_bytes = min(core_bytes, core_hard)
+resource.setrlimit(resource.RLIMIT_CORE, (core_bytes, core_bytes))
+resource.setrlimit(resource.RLIMIT_CPU, (cpu_quota_seconds, cpu_quota_seconds))
+
+
+def pids_refused():
+    # How many forks the container's cgroup pids controller has refused so far (cgroup v2, then v1).
+    try:
+        group = next((line[3:] for line in Path('/proc/self/cgroup').read_text().splitlines() if line.startswith('0::')), '')
+    except OSError:
+        group = ''
+    candidates = [Path('/sys/fs/cgroup') / group.lstrip('/') / 'pids.events', Path('/sys/fs/cgroup/pids/pids.events')]
+    for events in candidates:
+        try:
+            for line in events.read_text().splitlines():
+                key, _, value = line.partition(' ')
+                if key == 'max':
+                    return int(value)
+        except (OSError, ValueError):
+            continue
+    return 0
+
+
+# A fork refused from here on means the run hit max_processes.
+PIDS_REFUSED_AT_START = pids_refused()
+
+
+# An OOM kill from here on means the run hit memory_mb.
+OOM_KILLS_AT_START = oom_kills()
+
+output_limit = int(LIMITS.get('max_output_bytes', 1024 * 1024))
+# Each stream has its own cap, max_output_bytes unless set. With on_output_limit=kill the program
+# is stopped at the first byte past a cap instead of having the rest of its output discarded.
+stream_limits = {
+    'stdout': int(LIMITS.get('max_stdout_bytes', output_limit)),
+    'stderr': int(LIMITS.get('max_stderr_bytes', output_limit)),
+}
+KILL_ON_OUTPUT_LIMIT = SPEC.get('on_output_limit') == 'kill'
+dropped = {'stdout': 0, 'stderr': 0}
+# Output forwarded from each stream, up to its cap.
+captured = {'stdout': 0, 'stderr': 0}
+
+# --noprofile and --norc keep startup files out; sh reads none when not interactive.
+run_cmd = [env['SHELL']] + (['--noprofile', '--norc'] if SHELL == 'bash' else []) + (['-r'] if RESTRICTED else [])
+run_cmd += ['main.sh'] + SPEC.get('args', [])
+
+
+def kill_group(signum=signal.SIGKILL):
+    # The script runs in its own session, so this reaches every command it started as well.
+    try:
+        os.killpg(proc.pid, signum)
+    except ProcessLookupError:
+        pass
+
+
+def drop(name, count):
+    # Counts the bytes of a chunk that did not fit under the stream's cap.
+    if count and KILL_ON_OUTPUT_LIMIT:
+        kill_group()
+    dropped[name] += count
+
+
+def pump(name, source, sink, limit):
+    # Forward output as it is produced so progress reaches the caller live, capped at the limit.
+    written = 0
+    while True:
+        chunk = os.read(source.fileno(), 65536)
+        if not chunk:
+            break
+        part = chunk[: max(0, limit - written)]
+        if part:
+            sink.write(part)
+            sink.flush()
+            written += len(part)
+            captured[name] += len(part)
+        drop(name, len(chunk) - len(part))
+
+
+def feed_stdin(sink, data):
+    try:
+        sink.write(data)
+    except BrokenPipeError:
+        pass
+    finally:
+        try:
+            sink.close()
+        except BrokenPipeError:
+            pass
+
+
+def relay_stdin(sink):
+    # Interactive sessions forward the caller's input as it arrives until they close it.
+    try:
+        if STDIN_REST:
+            sink.write(STDIN_REST)
+            sink.flush()
+        while True:
+            chunk = os.read(0, 65536)
+            if not chunk:
+                break
+            sink.write(chunk)
+            sink.flush()
+    except BrokenPipeError:
+        pass
+    finally:
+        try:
+            sink.close()
+        except BrokenPipeError:
+            pass
+
+
+def stdin_feeder(proc):
+    # The caller may never close a live session's stdin, so that relay must not block exit.
+    if SPEC.get('interactive'):
+        return threading.Thread(target=relay_stdin, args=(proc.stdin,), daemon=True)
+    return threading.Thread(target=feed_stdin, args=(proc.stdin, SPEC.get('stdin', '').encode('utf8')))
+
+
+def wait_program(proc, timeout=None):
+    # Reaps the script with wait4 for its own rusage, which includes the commands it waited for.
+    # Raises TimeoutExpired like Popen.wait.
+    deadline = None if timeout is None else time.monotonic() + timeout
+    while True:
+        pid, status, rusage = os.wait4(proc.pid, 0 if deadline is None else os.WNOHANG)
+        if pid:
+            proc.returncode = os.waitstatus_to_exitcode(status)
+            return rusage
+        if time.monotonic() >= deadline:
+            raise subprocess.TimeoutExpired(proc.args, timeout)
+        time.sleep(0.005)
+
+
+# At the wall-clock limit the script gets SIGTERM and this long to flush its output and exit.
+KILL_GRACE = LIMITS.get('kill_grace_ms', 1000) / 1000
+
+
+def exit_signal(returncode):
+    # Name of the signal that ended the program, None when it exited by itself.
+    if returncode is None or returncode >= 0:
+        return None
+    try:
+        return signal.Signals(-returncode).name
+    except ValueError:
+        return f'SIG{-returncode}'
+
+
+def write_usage(start, end, rusage=None, limit_exceeded=None, timeout=None, signal_name=None):
+    if pids_refused() > PIDS_REFUSED_AT_START:
+        # A refused fork explains whatever followed it, a timeout included.
+        limit_exceeded = 'processes'
+    user_ms = int(rusage.ru_utime * 1000) if rusage else 0
+    system_ms = int(rusage.ru_stime * 1000) if rusage else 0
+    usage = {
+        'wall_ms': int((end - start) * 1000),
+        'cpu_ms': user_ms + system_ms,
+        'user_cpu_ms': user_ms,
+        'system_cpu_ms': system_ms,
+        # ru_maxrss is in KiB on Linux.
+        'max_rss_mb': int(rusage.ru_maxrss / 1024) if rusage else 0,
+        'limit_exceeded': limit_exceeded,
+        'timeout': timeout,
+        'signal': signal_name,
+        'dropped_bytes': dict(dropped),
+        'toolchain': TOOLCHAIN
+    }
+    Path('usage.json').write_text(json.dumps(usage))
+    return usage
+
+
+def fixed_clock(env):
+    # libfaketime settings that start the program's wall clock at, or hold it to, the time the run
+    # asked for in EXECUTOR_FAKE_TIME. The monotonic clock stays real, so sleeps and the time limit
+    # behave as usual.
+    fake_time = env.pop('EXECUTOR_FAKE_TIME', None)
+    if not fake_time:
+        return {}
+    candidates = [*Path('/usr/lib').glob('*/faketime/libfaketime.so.1'), Path('/usr/lib/faketime/libfaketime.so.1')]
+    library = next((path for path in candidates if path.exists()), None)
+    if library is None:
+        sys.stderr.write('a fixed clock needs libfaketime, which this runner image does not have\n')
+        sys.exit(1)
+    return {'LD_PRELOAD': str(library), 'FAKETIME': fake_time, 'FAKETIME_DONT_FAKE_MONOTONIC': '1'}
+
+
+env.update(fixed_clock(env))
+start = time.time()
+proc = subprocess.Popen(
+    run_cmd, stdin=subprocess.PIPE, stdout=subprocess.PIPE, stderr=subprocess.PIPE, env=env, start_new_session=True
+)
+stdin_feeder(proc).start()
+pumps = [
+    threading.Thread(target=pump, args=('stdout', proc.stdout, sys.stdout.buffer, stream_limits['stdout'])),
+    threading.Thread(target=pump, args=('stderr', proc.stderr, sys.stderr.buffer, stream_limits['stderr'])),
+]
+for thread in pumps:
+    thread.start()
+
+try:
+    timeout = LIMITS.get('timeout_ms', 5000) / 1000
+    rusage = wait_program(proc, timeout)
+except subprocess.TimeoutExpired:
+    # SIGTERM reaches the script's whole session first, giving a `trap` the chance to clean up.
+    rusage, timeout_report = stop_in_two_stages(proc, KILL_GRACE, kill_group, wait_program, captured, pumps)
+    sys.stderr.buffer.write(b'Execution timed out\n')
+    write_usage(start, time.time(), rusage, 'wall_time', timeout_report)
+    sys.exit(124)
+
+end = time.time()
+# Background jobs the script left behind would keep its output open.
+kill_group()
+for thread in pumps:
+    thread.join()
+
+limit_exceeded = None
+program_signal = exit_signal(proc.returncode)
+usage = write_usage(start, end, rusage, signal_name=program_signal)
+if proc.returncode == -signal.SIGKILL and oom_kills() > OOM_KILLS_AT_START:
+    limit_exceeded = 'memory'
+elif proc.returncode in (-signal.SIGXCPU, -signal.SIGKILL) and usage['cpu_ms'] >= cpu_quota_seconds * 1000:
+    limit_exceeded = 'cpu_time'
+elif dropped['stdout'] or dropped['stderr']:
+    limit_exceeded = 'output'
+if limit_exceeded:
+    write_usage(start, end, rusage, limit_exceeded, signal_name=program_signal)
+
+# A program ended by a signal exits as a shell reports it, 128 plus the signal's number.
+sys.exit(128 - proc.returncode if proc.returncode < 0 else proc.returncode)
@@ -0,0 +1,408 @@
+#!/usr/bin/env python3
+import datetime
+import decimal
+import json
+import os
+import re
+import resource
+import shutil
+import signal
+import sqlite3
+import subprocess
+import sys
+import tempfile
+import threading
+import time
+from pathlib import Path
+
+# runner_common.py sits next to the entrypoint in the image and in runners/ for the process backend.
+sys.path.append(str(Path(__file__).resolve().parent.parent))
+from runner_common import oom_kills, stop_in_two_stages
+
+
+def split_statements(script, engine):
+    # Splits a script at the semicolons outside strings, quoted identifiers, comments and (for
+    # Postgres) dollar quotes, yielding (line, statement). SQLite trigger bodies hold semicolons
+    # of their own, so a SQLite statement also has to be complete by sqlite3's own reckoning.
+    i, line, start, start_line = 0, 1, None, 1
+    while i < len(script):
+        char = script[i]
+        if script.startswith('--', i):
+            end = script.find('\n', i)
+            end = len(script) if end == -1 else end
+        elif script.startswith('/*', i):
+            end = script.find('*/', i + 2)
+            end = len(script) if end == -1 else end + 2
+        else:
+            # Comments before a statement are not part of it.
+            if start is None and not char.isspace():
+                start, start_line = i, line
+            if char in '\'"`':
+                end = script.find(char, i + 1)
+                while end != -1 and script[end + 1:end + 2] == char:
+                    end = script.find(char, end + 2)
+                end = len(script) if end == -1 else end + 1
+            elif char == '$' and engine == 'postgres' and (tag := re.match(r'\$(?:[A-Za-z_]\w*)?\$', script[i:])):
+                end = script.find(tag.group(0), i + len(tag.group(0)))
+                end = len(script) if end == -1 else end + len(tag.group(0))
+            elif char == ';' and (engine != 'sqlite' or sqlite3.complete_statement(script[start:i + 1])):
+                if start < i:
+                    yield start_line, script[start:i + 1].strip()
+                start, end = None, i + 1
+            else:
+                end = i + 1
+        line += script.count('\n', i, end)
+        i = end
+    if start is not None:
+        yield start_line, script[start:].strip()
+
+
+def json_value(value):
+    # Rows are returned as JSON, so values without a JSON type are given their SQL text form.
+    if value is None or isinstance(value, (bool, int, str)):
+        return value
+    if isinstance(value, float):
+        return value if value == value and value not in (float('inf'), float('-inf')) else str(value)
+    if isinstance(value, (bytes, bytearray, memoryview)):
+        return '\\x' + bytes(value).hex()
+    if isinstance(value, (datetime.date, datetime.time)):
+        return value.isoformat()
+    if isinstance(value, decimal.Decimal):
+        return str(value)
+    if isinstance(value, (list, dict)):
+        return json.loads(json.dumps(value, default=str))
+    return str(value)
+
+
+def text_value(value):
+    return '' if value is None else str(value)
+
+
+def execute(engine, target, results_path, results_limit):
+    # The worker: runs the fixture, then each statement of main.sql, under the run's rlimits.
+    if engine == 'sqlite':
+        connection = sqlite3.connect(':memory:', isolation_level=None)
+    else:
+        import psycopg2
+        connection = psycopg2.connect(host=target, dbname='postgres', user='postgres')
+        connection.autocommit = True
+    cursor = connection.cursor()
+
+    fixture = Path('tmp/fixture.sql')
+    if fixture.exists():
+        for line, statement in split_statements(fixture.read_text(), engine):
+            try:
+                cursor.execute(statement)
+            except Exception as err:
+                sys.stderr.write(f'fixture: line {line}: {err}'.rstrip() + '\n')
+                Path(results_path).write_text('[]')
+                return 1
+
+    results = []
+    budget = results_limit
+    failed = False
+    # At the wall-clock limit the worker gets SIGTERM. The statement running then is interrupted,
+    # which both engines allow from another thread, and the results so far are still reported.
+    terminated = threading.Event()
+    signal.pthread_sigmask(signal.SIG_BLOCK, {signal.SIGTERM})
+
+    def interrupt():
+        signal.sigwait({signal.SIGTERM})
+        terminated.set()
+        if engine == 'sqlite':
+            connection.interrupt()
+        else:
+            connection.cancel()
+
+    threading.Thread(target=interrupt, daemon=True).start()
+    try:
+        for line, statement in split_statements(Path('main.sql').read_text(), engine):
+            if terminated.is_set():
+                break
+            result = {'statement': statement, 'line': line, 'columns': None, 'rows': [], 'rows_affected': None, 'truncated': False, 'error': None}
+            results.append(result)
+            try:
+                cursor.execute(statement)
+            except Exception as err:
+                message = str(err).strip()
+                result['error'] = message
+                sys.stderr.write(f'Error: line {line}: {message}\n')
+                sys.stderr.flush()
+                failed = True
+                continue
+            if cursor.description is not None:
+                result['columns'] = [column[0] for column in cursor.description]
+                print('|'.join(result['columns']))
+                for row in cursor:
+                    values = [json_value(value) for value in row]
+                    size = len(json.dumps(values))
+                    if size > budget:
+                        # Rows past max_output_bytes are left out of the result, not just the output.
+                        result['truncated'] = True
+                        break
+                    budget -= size
+                    result['rows'].append(values)
+                    print('|'.join(text_value(value) for value in row))
+                sys.stdout.flush()
+            if cursor.rowcount is not None and cursor.rowcount >= 0:
+                result['rows_affected'] = cursor.rowcount
+    except Exception:
+        # Interrupted while fetching rows.
+        if not terminated.is_set():
+            raise
+    finally:
+        Path(results_path).write_text(json.dumps(results))
+    connection.close()
+    if terminated.is_set():
+        return 128 + signal.SIGTERM
+    return 1 if failed else 0
+
+
+if len(sys.argv) == 6 and sys.argv[1] == '--execute':
+    sys.exit(execute(sys.argv[2], sys.argv[3], sys.argv[4], int(sys.argv[5])))
+
+
+def read_spec():
+    # The spec is the first line of stdin; statements take no input of their own.
+    return json.loads(sys.stdin.buffer.readline())
+
+
+SPEC = read_spec()
+# The process backend runs entrypoints directly on the host and passes its own workdir.
+WORKDIR = Path(SPEC.get('workdir') or '/work')
+LIMITS = SPEC.get('limits', {})
+SQL = SPEC.get('sql') or {}
+ENGINE = SQL.get('engine') or 'sqlite'
+
+os.chdir(WORKDIR)
+Path('tmp').mkdir(parents=True, exist_ok=True)
+Path('outputs').mkdir(parents=True, exist_ok=True)
+if SQL.get('fixture'):
+    Path('tmp/fixture.sql').write_text(SQL['fixture'])
+
+env = {key: value for key, value in SPEC.get('env', {}).items()}
+env['HOME'] = str(WORKDIR)
+env['PATH'] = '/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin'
+env['PYTHONIOENCODING'] = 'utf8'
+
+
+def postgres_bin():
+    # Debian installs the server binaries in a versioned directory off the PATH.
+    found = shutil.which('initdb') or next(iter(sorted(Path('/usr/lib/postgresql').glob('*/bin/initdb'), reverse=True)), None)
+    return Path(found).parent if found else None
+
+
+def toolchain_version():
+    if ENGINE == 'sqlite':
+        return f'SQLite {sqlite3.sqlite_version}'
+    try:
+        probe = subprocess.run([str(postgres_bin() / 'postgres'), '--version'], capture_output=True, timeout=5)
+        return probe.stdout.decode('utf8', errors='replace').strip() or None
+    except (OSError, subprocess.SubprocessError, TypeError):
+        return None
+
+
+# An OOM kill from here on means the run hit memory_mb.
+OOM_KILLS_AT_START = oom_kills()
+
+TOOLCHAIN = toolchain_version()
+output_limit = int(LIMITS.get('max_output_bytes', 1024 * 1024))
+# Each stream has its own cap, max_output_bytes unless set. With on_output_limit=kill the worker
+# is stopped at the first byte past a cap instead of having the rest of its output discarded.
+stream_limits = {
+    'stdout': int(LIMITS.get('max_stdout_bytes', output_limit)),
+    'stderr': int(LIMITS.get('max_stderr_bytes', output_limit)),
+}
+KILL_ON_OUTPUT_LIMIT = SPEC.get('on_output_limit') == 'kill'
+dropped = {'stdout': 0, 'stderr': 0}
+# Output forwarded from each stream, up to its cap.
+captured = {'stdout': 0, 'stderr': 0}
+results = []
+
+
+def exit_signal(returncode):
+    # Name of the signal that ended the program, None when it exited by itself.
+    if returncode is None or returncode >= 0:
+        return None
+    try:
+        return signal.Signals(-returncode).name
+    except ValueError:
+        return f'SIG{-returncode}'
+
+
+def write_usage(start, end, rusage=None, limit_exceeded=None, timeout=None, signal_name=None):
+    user_ms = int(rusage.ru_utime * 1000) if rusage else 0
+    system_ms = int(rusage.ru_stime * 1000) if rusage else 0
+    usage = {
+        'wall_ms': int((end - start) * 1000),
+        'cpu_ms': user_ms + system_ms,
+        'user_cpu_ms': user_ms,
+        'system_cpu_ms': system_ms,
+        # ru_maxrss is in KiB on Linux.
+        'max_rss_mb': int(rusage.ru_maxrss / 1024) if rusage else 0,
+        'limit_exceeded': limit_exceeded,
+        'timeout': timeout,
+        'signal': signal_name,
+        'dropped_bytes': dict(dropped),
+        'toolchain': TOOLCHAIN,
+        'results': results
+    }
+    Path('usage.json').write_text(json.dumps(usage))
+    return usage
+
+
+# DATABASE PHASE
+# SQLite databases live in the worker's memory. Postgres gets a throwaway cluster in the workdir
+# that only listens on a unix socket and is stopped with the run.
+PGDATA = WORKDIR / 'tmp' / 'pgdata'
+SOCKET_DIR = None
+if ENGINE == 'postgres':
+    bindir = postgres_bin()
+    if bindir is None:
+        sys.stderr.write('postgres is not installed in this runner\n')
+        write_usage(time.time(), time.time())
+        sys.exit(1)
+    # Socket paths are limited to 107 bytes, which a deep process-backend workdir can exceed.
+    SOCKET_DIR = str(WORKDIR / 'tmp' / 'pg') if len(str(WORKDIR)) < 80 else tempfile.mkdtemp(prefix='pg')
+    Path(SOCKET_DIR).mkdir(parents=True, exist_ok=True)
+    setup = [
+        [str(bindir / 'initdb'), '-D', str(PGDATA), '-U', 'postgres', '--auth=trust', '--no-sync', '-E', 'UTF8'],
+        [str(bindir / 'pg_ctl'), '-D', str(PGDATA), '-w', '-s', '-l', str(WORKDIR / 'tmp' / 'postgres.log'), '-o',
+         f"-c listen_addresses='' -k {SOCKET_DIR} -c fsync=off -c shared_buffers=16MB -c max_connections=5", 'start'],
+    ]
+    for command in setup:
+        started = subprocess.run(command, capture_output=True, env=env)
+        if started.returncode != 0:
+            sys.stderr.buffer.write(b'postgres failed to start\n' + started.stderr[:output_limit])
+            write_usage(time.time(), time.time())
+            sys.exit(1)
+
+
+def stop_postgres():
+    if ENGINE == 'postgres':
+        subprocess.run([str(postgres_bin() / 'pg_ctl'), '-D', str(PGDATA), '-s', '-m', 'immediate', 'stop'], capture_output=True)
+
+
+# Set resource limits
+memory_bytes = int(LIMITS.get('memory_mb', 256) * 1024 * 1024)
+cpu_ms = int(LIMITS.get('cpu_ms', 5000))
+cpu_quota_seconds = max(1, cpu_ms // 1000 or 1)
+
+
+def limit_worker():
+    # Applied to the worker only; the Postgres server is bounded by the container instead.
+    resource.setrlimit(resource.RLIMIT_AS, (memory_bytes, memory_bytes))
+    resource.setrlimit(resource.RLIMIT_FSIZE, (50 * 1024 * 1024, 50 * 1024 * 1024))
+    max_open_files = int(LIMITS.get('max_open_files', 256))
+    resource.setrlimit(resource.RLIMIT_NOFILE, (max_open_files, max_open_files))
+    # Core dumps stay off unless the run asks for them, and never exceed what the host allows.
+    core_bytes = int(LIMITS.get('core_dump_mb', 0)) * 1024 * 1024
+    core_hard = resource.getrlimit(resource.RLIMIT_CORE)[1]
+    if core_hard != resource.RLIM_INFINITY:
+        core_bytes = min(core_bytes, core_hard)
+    resource.setrlimit(resource.RLIMIT_CORE, (core_bytes, core_bytes))
+    resource.setrlimit(resource.RLIMIT_CPU, (cpu_quota_seconds, cpu_quota_seconds))
+
+
+def kill_group(signum=signal.SIGKILL):
+    # The worker runs in its own session, so this reaches anything it started as well.
+    try:
+        os.killpg(proc.pid, signum)
+    except ProcessLookupError:
+        pass
+
+
+def drop(name, count):
+    # Counts the bytes of a chunk that did not fit under the stream's cap.
+    if count and KILL_ON_OUTPUT_LIMIT:
+        kill_group()
+    dropped[name] += count
+
+
+def pump(name, source, sink, limit):
+    # Forward output as it is produced so progress reaches the caller live, capped at the limit.
+    written = 0
+    while True:
+        chunk = os.read(source.fileno(), 65536)
+        if not chunk:
+            break
+        part = chunk[: max(0, limit - written)]
+        if part:
+            sink.write(part)
+            sink.flush()
+            written += len(part)
+            captured[name] += len(part)
+        drop(name, len(chunk) - len(part))
+
+
+def wait_worker(proc, timeout=None):
+    # Reaps the worker with wait4 for its own rusage. Raises TimeoutExpired like Popen.wait.
+    deadline = None if timeout is None else time.monotonic() + timeout
+    while True:
+        pid, status, rusage = os.wait4(proc.pid, 0 if deadline is None else os.WNOHANG)
+        if pid:
+            proc.returncode = os.waitstatus_to_exitcode(status)
+            return rusage
+        if time.monotonic() >= deadline:
+            raise subprocess.TimeoutExpired(proc.args, timeout)
+        time.sleep(0.005)
+
+
+# At the wall-clock limit the worker gets SIGTERM and this long to write its results and exit.
+KILL_GRACE = LIMITS.get('kill_grace_ms', 1000) / 1000
+
+
+def read_results():
+    try:
+        return json.loads(Path('tmp/results.json').read_text())
+    except (OSError, ValueError):
+        return []
+
+
+# EXECUTION PHASE
+# Results are capped at max_output_bytes like the output that mirrors them.
+run_cmd = [sys.executable, __file__, '--execute', ENGINE, SOCKET_DIR or '', 'tmp/results.json', str(output_limit)]
+start = time.time()
+proc = subprocess.Popen(
+    run_cmd, stdin=subprocess.DEVNULL, stdout=subprocess.PIPE, stderr=subprocess.PIPE, env=env,
+    preexec_fn=limit_worker, start_new_session=True
+)
+pumps = [
+    threading.Thread(target=pump, args=('stdout', proc.stdout, sys.stdout.buffer, stream_limits['stdout'])),
+    threading.Thread(target=pump, args=('stderr', proc.stderr, sys.stderr.buffer, stream_limits['stderr'])),
+]
+for thread in pumps:
+    thread.start()
+
+try:
+    timeout = LIMITS.get('timeout_ms', 5000) / 1000
+    rusage = wait_worker(proc, timeout)
+except subprocess.TimeoutExpired:
+    rusage, timeout_report = stop_in_two_stages(proc, KILL_GRACE, kill_group, wait_worker, captured, pumps)
+    stop_postgres()
+    # Whatever a worker that stopped in time reported counts; one that was killed left none.
+    results = read_results()
+    sys.stderr.buffer.write(b'Execution timed out\n')
+    write_usage(start, time.time(), rusage, 'wall_time', timeout_report)
+    sys.exit(124)
+
+end = time.time()
+for thread in pumps:
+    thread.join()
+stop_postgres()
+
+results = read_results()
+limit_exceeded = None
+program_signal = exit_signal(proc.returncode)
+usage = write_usage(start, end, rusage, signal_name=program_signal)
+if proc.returncode == -signal.SIGKILL and oom_kills() > OOM_KILLS_AT_START:
+    limit_exceeded = 'memory'
+elif proc.returncode in (-signal.SIGXCPU, -signal.SIGKILL) and usage['cpu_ms'] >= cpu_quota_seconds * 1000:
+    limit_exceeded = 'cpu_time'
+elif dropped['stdout'] or dropped['stderr'] or any(result['truncated'] for result in results):
+    limit_exceeded = 'output'
+if limit_exceeded:
+    write_usage(start, end, rusage, limit_exceeded, signal_name=program_signal)
+
+# A program ended by a signal exits as a shell reports it, 128 plus the signal's number.
+sys.exit(128 - proc.returncode if proc.returncode < 0 else proc.returncode)
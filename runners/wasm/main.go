@@ -0,0 +1,532 @@
+// Command wasirun is the entrypoint of runs with isolation `wasm`. It takes a precompiled
+// WebAssembly module, or compiles C and C++ submissions to one with wasi-sdk, and runs it under
+// wazero's WASI runtime on the API host: the module only sees the WASI calls wazero implements,
+// its own linear memory and the run directory's inputs/, outputs/ and tmp/.
+//
+// It speaks the same protocol as the container entrypoints: the spec is the first line of stdin
+// and the run's usage is left in usage.json in the run directory.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+type runSpec struct {
+	Language string `json:"language"`
+	Build    struct {
+		Std          string `json:"std"`
+		Optimization string `json:"optimization"`
+	} `json:"build"`
+	Args          []string          `json:"args"`
+	Env           map[string]string `json:"env"`
+	Limits        runLimits         `json:"limits"`
+	Stdin         string            `json:"stdin"`
+	Interactive   bool              `json:"interactive"`
+	OnOutputLimit string            `json:"on_output_limit"`
+	Settings      map[string]string `json:"settings"`
+	Workdir       string            `json:"workdir"`
+}
+
+type runLimits struct {
+	TimeoutMs      int64 `json:"timeout_ms"`
+	CPUMs          int64 `json:"cpu_ms"`
+	MemoryMB       int64 `json:"memory_mb"`
+	MaxOutputBytes int64 `json:"max_output_bytes"`
+	MaxStdoutBytes int64 `json:"max_stdout_bytes"`
+	MaxStderrBytes int64 `json:"max_stderr_bytes"`
+}
+
+type phase struct {
+	ExitCode   int    `json:"exit_code"`
+	DurationMs int64  `json:"duration_ms"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+}
+
+type usage struct {
+	WallMs        int64            `json:"wall_ms"`
+	CPUMs         int64            `json:"cpu_ms"`
+	UserCPUMs     int64            `json:"user_cpu_ms"`
+	SystemCPUMs   int64            `json:"system_cpu_ms"`
+	MaxRSSMB      int64            `json:"max_rss_mb"`
+	LimitExceeded *string          `json:"limit_exceeded"`
+	Timeout       *timeoutReport   `json:"timeout"`
+	DroppedBytes  map[string]int64 `json:"dropped_bytes"`
+	Toolchain     string           `json:"toolchain"`
+	Compile       *phase           `json:"compile"`
+}
+
+// How a module that reached its wall-clock limit was stopped, as the timeout of usage.json.
+type timeoutReport struct {
+	Stage        string `json:"stage"`
+	GraceMs      int64  `json:"grace_ms"`
+	StdoutBytes  int64  `json:"stdout_bytes"`
+	StderrBytes  int64  `json:"stderr_bytes"`
+	FlushedBytes int64  `json:"flushed_bytes"`
+}
+
+// Why the module was stopped before it finished, as the limit_exceeded of usage.json.
+var (
+	errWallTime = errors.New("wall_time")
+	errCPUTime  = errors.New("cpu_time")
+	errOutput   = errors.New("output")
+)
+
+func main() {
+	stdin := bufio.NewReader(os.Stdin)
+	line, err := stdin.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		fail("reading spec: %v", err)
+	}
+	var spec runSpec
+	if err := json.Unmarshal(line, &spec); err != nil {
+		fail("invalid spec: %v", err)
+	}
+	applyDefaults(&spec.Limits)
+	if err := os.Chdir(spec.Workdir); err != nil {
+		fail("%v", err)
+	}
+	for _, dir := range []string{"tmp", "outputs", "inputs"} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			fail("%v", err)
+		}
+	}
+
+	report := usage{DroppedBytes: map[string]int64{"stdout": 0, "stderr": 0}, Toolchain: toolchain(spec)}
+	module, compile, err := loadModule(spec)
+	report.Compile = compile
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		writeUsage(report)
+		os.Exit(1)
+	}
+
+	var input io.Reader = strings.NewReader(spec.Stdin)
+	if spec.Interactive {
+		// Whatever follows the spec line is the session's live input.
+		input = stdin
+	}
+	os.Exit(run(spec, module, input, &report))
+}
+
+func applyDefaults(limits *runLimits) {
+	if limits.TimeoutMs == 0 {
+		limits.TimeoutMs = 5000
+	}
+	if limits.CPUMs == 0 {
+		limits.CPUMs = 5000
+	}
+	if limits.MemoryMB == 0 {
+		limits.MemoryMB = 256
+	}
+	if limits.MaxOutputBytes == 0 {
+		limits.MaxOutputBytes = 1024 * 1024
+	}
+	if limits.MaxStdoutBytes == 0 {
+		limits.MaxStdoutBytes = limits.MaxOutputBytes
+	}
+	if limits.MaxStderrBytes == 0 {
+		limits.MaxStderrBytes = limits.MaxOutputBytes
+	}
+}
+
+func toolchain(spec runSpec) string {
+	version := "wazero"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/tetratelabs/wazero" {
+				version += " " + dep.Version
+			}
+		}
+	}
+	if spec.Language == "c" || spec.Language == "cpp" {
+		if sdk := spec.Settings["wasi_sdk"]; sdk != "" {
+			out, err := exec.Command(filepath.Join(sdk, "bin", "clang"), "--version").Output()
+			if first, _, _ := strings.Cut(string(out), "\n"); err == nil && first != "" {
+				version += ", " + first
+			}
+		}
+	}
+	return version
+}
+
+// loadModule returns the module to run: main.wasm as submitted, or the wasi-sdk build of a C or
+// C++ submission together with its compile phase.
+func loadModule(spec runSpec) ([]byte, *phase, error) {
+	if spec.Language == "wasm" {
+		data, err := os.ReadFile("main.wasm")
+		if err != nil {
+			return nil, nil, err
+		}
+		// Request bodies are JSON, so modules usually arrive base64-encoded.
+		if !bytes.HasPrefix(data, []byte("\x00asm")) {
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+			if err != nil {
+				return nil, nil, errors.New("main.wasm is neither a WebAssembly module nor base64")
+			}
+			data = decoded
+		}
+		return data, nil, nil
+	}
+	sdk := spec.Settings["wasi_sdk"]
+	if sdk == "" {
+		return nil, nil, fmt.Errorf("%s runs under wasm isolation need sandbox.wasm.wasi_sdk", spec.Language)
+	}
+	compiler, extensions := "clang", []string{".c"}
+	if spec.Language == "cpp" {
+		compiler, extensions = "clang++", []string{".cpp", ".cc", ".cxx"}
+	}
+	args := []string{"--target=wasm32-wasip1", "--sysroot=" + filepath.Join(sdk, "share", "wasi-sysroot"), "-o", "tmp/main.wasm"}
+	if spec.Build.Std != "" {
+		args = append(args, "-std="+spec.Build.Std)
+	}
+	optimization := spec.Build.Optimization
+	if optimization == "" {
+		optimization = "O2"
+	}
+	args = append(args, "-"+optimization)
+	sources, err := sourceFiles(extensions)
+	if err != nil {
+		return nil, nil, err
+	}
+	args = append(args, sources...)
+
+	// wasi-sdk builds take a while to start; give compilation 30 seconds max
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, filepath.Join(sdk, "bin", compiler), args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	started := time.Now()
+	err = cmd.Run()
+	compile := &phase{DurationMs: time.Since(started).Milliseconds(), Stdout: stdout.String(), Stderr: stderr.String()}
+	if err != nil {
+		compile.ExitCode = 1
+		if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() > 0 {
+			compile.ExitCode = exit.ExitCode()
+		}
+		if ctx.Err() != nil {
+			compile.Stderr += "Compilation timed out\n"
+		}
+		return nil, compile, errors.New(strings.TrimRight(compile.Stderr, "\n"))
+	}
+	module, err := os.ReadFile("tmp/main.wasm")
+	return module, compile, err
+}
+
+// Sources are the submission's files with the language's extensions, outside the run's own dirs.
+func sourceFiles(extensions []string) ([]string, error) {
+	var sources []string
+	err := filepath.WalkDir(".", func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && (path == "tmp" || path == "inputs" || path == "outputs") {
+			return filepath.SkipDir
+		}
+		for _, extension := range extensions {
+			if !entry.IsDir() && strings.HasSuffix(path, extension) {
+				sources = append(sources, path)
+			}
+		}
+		return nil
+	})
+	return sources, err
+}
+
+func run(spec runSpec, module []byte, input io.Reader, report *usage) int {
+	ctx, stop := context.WithCancelCause(context.Background())
+	defer stop(nil)
+	memory := &memoryAllocator{limit: uint64(spec.Limits.MemoryMB) * 1024 * 1024}
+	ctx = experimental.WithMemoryAllocator(ctx, memory)
+	if fuel, err := strconv.ParseInt(spec.Settings["fuel"], 10, 64); err == nil && fuel > 0 {
+		// The listener sees every call the module makes, which is where fuel is spent.
+		ctx = experimental.WithFunctionListenerFactory(ctx, &fuelMeter{fuel: fuel, stop: stop})
+	}
+
+	config := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if dir := spec.Settings["cache_dir"]; dir != "" {
+		// Compiling a module to machine code can take longer than running it; wazero keys its
+		// cache by the module's contents and its own version.
+		if cache, err := wazero.NewCompilationCacheWithDir(dir); err == nil {
+			config = config.WithCompilationCache(cache)
+		}
+	}
+	runtime := wazero.NewRuntimeWithConfig(ctx, config)
+	defer runtime.Close(context.Background())
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+
+	compiled, err := runtime.CompileModule(ctx, module)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid module: %v\n", err)
+		writeUsage(*report)
+		return 1
+	}
+
+	stdout := &cappedWriter{sink: os.Stdout, limit: spec.Limits.MaxStdoutBytes}
+	stderr := &cappedWriter{sink: os.Stderr, limit: spec.Limits.MaxStderrBytes}
+	if spec.OnOutputLimit == "kill" {
+		stdout.onLimit = func() { stop(errOutput) }
+		stderr.onLimit = stdout.onLimit
+	}
+	fs := wazero.NewFSConfig().
+		WithReadOnlyDirMount("inputs", "/inputs").
+		WithDirMount("outputs", "/outputs").
+		WithDirMount("tmp", "/tmp")
+	moduleConfig := wazero.NewModuleConfig().
+		WithName("").
+		WithArgs(append([]string{"main.wasm"}, spec.Args...)...).
+		WithStdin(input).
+		WithStdout(stdout).
+		WithStderr(stderr).
+		WithFSConfig(fs).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithSysNanosleep().
+		WithRandSource(rand.Reader)
+	for name, value := range spec.Env {
+		moduleConfig = moduleConfig.WithEnv(name, value)
+	}
+
+	// Limits and usage cover the module's run, not its compilation.
+	started := time.Now()
+	startCPU := cpuTime()
+	wall := time.AfterFunc(time.Duration(spec.Limits.TimeoutMs)*time.Millisecond, func() { stop(errWallTime) })
+	defer wall.Stop()
+	go watchCPU(ctx, startCPU, time.Duration(spec.Limits.CPUMs)*time.Millisecond, stop)
+
+	_, err = runtime.InstantiateModule(ctx, compiled, moduleConfig)
+	elapsed := time.Since(started)
+	user, system := cpuTime().sub(startCPU)
+
+	exitCode := 0
+	var exit *sys.ExitError
+	switch {
+	case errors.As(err, &exit) && exit.ExitCode() != sys.ExitCodeContextCanceled && exit.ExitCode() != sys.ExitCodeDeadlineExceeded:
+		exitCode = int(exit.ExitCode())
+	case err != nil && context.Cause(ctx) == nil:
+		// A trap, such as unreachable or an out-of-bounds access.
+		fmt.Fprintf(stderr, "%v\n", err)
+		exitCode = 1
+	}
+
+	var limit *string
+	switch cause := context.Cause(ctx); {
+	case errors.Is(cause, errWallTime):
+		fmt.Fprintln(os.Stderr, "Execution timed out")
+		limit, exitCode = name(errWallTime), 124
+		// WASI has no signals that would let a module wind down, so there is no grace period:
+		// the module is stopped at once.
+		report.Timeout = &timeoutReport{Stage: "hard", StdoutBytes: stdout.written, StderrBytes: stderr.written}
+	case errors.Is(cause, errCPUTime):
+		// 128 + SIGXCPU, as a process over RLIMIT_CPU would end.
+		limit, exitCode = name(errCPUTime), 152
+	case errors.Is(cause, errOutput):
+		limit, exitCode = name(errOutput), 137
+	case exitCode != 0 && memory.refused():
+		// The module failed after being refused more memory.
+		limit, exitCode = strPtr("memory"), 137
+	case stdout.dropped > 0 || stderr.dropped > 0:
+		limit = name(errOutput)
+	}
+
+	report.WallMs = elapsed.Milliseconds()
+	report.UserCPUMs = user.Milliseconds()
+	report.SystemCPUMs = system.Milliseconds()
+	report.CPUMs = report.UserCPUMs + report.SystemCPUMs
+	report.MaxRSSMB = int64(memory.peak() / (1024 * 1024))
+	report.LimitExceeded = limit
+	report.DroppedBytes = map[string]int64{"stdout": stdout.dropped, "stderr": stderr.dropped}
+	writeUsage(*report)
+	return exitCode
+}
+
+func name(err error) *string {
+	return strPtr(err.Error())
+}
+
+func strPtr(value string) *string {
+	return &value
+}
+
+// fuelMeter counts the module's function calls against its fuel.
+type fuelMeter struct {
+	mu   sync.Mutex
+	fuel int64
+	stop context.CancelCauseFunc
+}
+
+func (m *fuelMeter) NewFunctionListener(api.FunctionDefinition) experimental.FunctionListener {
+	return m
+}
+
+func (m *fuelMeter) Before(context.Context, api.Module, api.FunctionDefinition, []uint64, experimental.StackIterator) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fuel--
+	if m.fuel == 0 {
+		// Running out of fuel is the module's CPU budget running out.
+		m.stop(errCPUTime)
+	}
+}
+
+func (m *fuelMeter) After(context.Context, api.Module, api.FunctionDefinition, []uint64) {}
+
+func (m *fuelMeter) Abort(context.Context, api.Module, api.FunctionDefinition, error) {}
+
+// memoryAllocator backs the module's linear memory with plain slices so memory_mb can be
+// enforced and observed: growing past the limit fails the module's memory.grow, and the
+// largest size the memory reached is the run's max_rss_mb.
+type memoryAllocator struct {
+	mu       sync.Mutex
+	limit    uint64
+	largest  uint64
+	exceeded bool
+}
+
+func (a *memoryAllocator) Allocate(capacity, _ uint64) experimental.LinearMemory {
+	return &linearMemory{allocator: a, buf: make([]byte, 0, min(capacity, a.limit))}
+}
+
+func (a *memoryAllocator) grow(size uint64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if size > a.limit {
+		a.exceeded = true
+		return false
+	}
+	a.largest = max(a.largest, size)
+	return true
+}
+
+func (a *memoryAllocator) peak() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.largest
+}
+
+func (a *memoryAllocator) refused() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.exceeded
+}
+
+type linearMemory struct {
+	allocator *memoryAllocator
+	buf       []byte
+}
+
+func (m *linearMemory) Reallocate(size uint64) []byte {
+	if !m.allocator.grow(size) {
+		return nil
+	}
+	if size > uint64(cap(m.buf)) {
+		grown := make([]byte, size, max(size, uint64(cap(m.buf))*2))
+		copy(grown, m.buf)
+		m.buf = grown
+	}
+	m.buf = m.buf[:size]
+	return m.buf
+}
+
+func (m *linearMemory) Free() {
+	m.buf = nil
+}
+
+// cappedWriter forwards output as it is produced, discarding and counting what passes limit.
+type cappedWriter struct {
+	mu      sync.Mutex
+	sink    io.Writer
+	limit   int64
+	written int64
+	dropped int64
+	onLimit func()
+}
+
+func (w *cappedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	room := max(0, w.limit-w.written)
+	part := p[:min(int64(len(p)), room)]
+	if len(part) > 0 {
+		if _, err := w.sink.Write(part); err != nil {
+			return 0, err
+		}
+		w.written += int64(len(part))
+	}
+	if dropped := int64(len(p) - len(part)); dropped > 0 {
+		w.dropped += dropped
+		if w.onLimit != nil {
+			w.onLimit()
+		}
+	}
+	return len(p), nil
+}
+
+type cpuSample struct{ user, system time.Duration }
+
+func cpuTime() cpuSample {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return cpuSample{}
+	}
+	return cpuSample{time.Duration(usage.Utime.Nano()), time.Duration(usage.Stime.Nano())}
+}
+
+func (s cpuSample) sub(start cpuSample) (time.Duration, time.Duration) {
+	return s.user - start.user, s.system - start.system
+}
+
+// watchCPU stops the module once the process has spent limit of CPU time since start. The module
+// runs on one goroutine, so this is its own time plus the runtime's.
+func watchCPU(ctx context.Context, start cpuSample, limit time.Duration, stop context.CancelCauseFunc) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			user, system := cpuTime().sub(start)
+			if user+system >= limit {
+				stop(errCPUTime)
+				return
+			}
+		}
+	}
+}
+
+func writeUsage(report usage) {
+	data, _ := json.Marshal(report)
+	if err := os.WriteFile("usage.json", data, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "writing usage.json: %v\n", err)
+	}
+}
+
+func fail(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "wasirun: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,461 @@
+// Package codeexecutor is a client for the code executor's HTTP API: typed requests and results,
+// synchronous runs, asynchronous executions that can be polled, followed as they run or canceled,
+// and the caller's execution history page by page.
+//
+// Calls that are safe to repeat are retried on connection failures, rate limiting and the
+// server's 502, 503 and 504 answers. Submissions count as such because the client sends each
+// with an Idempotency-Key, so that a retried one is answered with the original execution:
+//
+//	client := codeexecutor.New("https://executor.example.com", codeexecutor.WithAPIKey(token))
+//	result, err := client.Run(ctx, &codeexecutor.ExecutionRequest{Language: "python", Code: "print(1)"}, nil)
+package codeexecutor
+
+import (
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"iter"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy says how often and how patiently a repeatable call is tried.
+type RetryPolicy struct {
+	// MaxAttempts counts the first try; 1 turns retries off.
+	MaxAttempts int
+	// The wait before a retry doubles from MinBackoff up to MaxBackoff, with jitter. A Retry-After
+	// the server sends is waited out instead, unless it is longer than MaxBackoff, in which case
+	// the error is returned.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is what clients use unless WithRetryPolicy says otherwise.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 4, MinBackoff: 250 * time.Millisecond, MaxBackoff: 10 * time.Second}
+
+// Client calls one code executor deployment. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+	retry      RetryPolicy
+	userAgent  string
+}
+
+type Option func(*Client)
+
+// WithAPIKey sends the key as the bearer token of every request.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithHTTPClient replaces http.DefaultClient, e.g. for custom transports or proxies. Its timeout
+// also bounds streams, so leave it unset for long runs and use contexts instead.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *Client) { c.retry = policy }
+}
+
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) { c.userAgent = userAgent }
+}
+
+// New returns a client for the deployment at baseURL, e.g. http://localhost:8080.
+func New(baseURL string, options ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		retry:      DefaultRetryPolicy,
+		userAgent:  "code-executor-go",
+	}
+	for _, option := range options {
+		option(c)
+	}
+	if c.retry.MaxAttempts < 1 {
+		c.retry.MaxAttempts = 1
+	}
+	return c
+}
+
+// SubmitOptions are the per-call options of Run and Submit.
+type SubmitOptions struct {
+	// IdempotencyKey identifies the submission to the server; one is generated when empty, so
+	// retries never start a second execution.
+	IdempotencyKey string
+	// CallbackURL is posted the result once the execution finishes (Submit only), if the
+	// deployment allows callbacks.
+	CallbackURL string
+	// TraceParent is a W3C traceparent to continue the caller's trace with.
+	TraceParent string
+}
+
+// Run executes the request and waits for its result.
+func (c *Client) Run(ctx context.Context, request *ExecutionRequest, options *SubmitOptions) (*Result, error) {
+	var result Result
+	if err := c.submit(ctx, "/v1/runs", request, options, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Submit starts an asynchronous execution and returns once it is accepted. Its Result is set
+// when the Idempotency-Key was reused for an execution that has already finished.
+func (c *Client) Submit(ctx context.Context, request *ExecutionRequest, options *SubmitOptions) (*Execution, error) {
+	body, err := c.submitRaw(ctx, "/v1/executions", request, options, true)
+	if err != nil {
+		return nil, err
+	}
+	return decodeExecution(body)
+}
+
+// GetExecution returns where an execution stands, with its Result once it has finished.
+func (c *Client) GetExecution(ctx context.Context, id string) (*Execution, error) {
+	body, err := c.do(ctx, http.MethodGet, "/v1/executions/"+url.PathEscape(id), nil, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	return decodeExecution(body)
+}
+
+// GetRun returns the record of a finished run.
+func (c *Client) GetRun(ctx context.Context, id string) (*Result, error) {
+	var result Result
+	if err := c.doJSON(ctx, http.MethodGet, "/v1/runs/"+url.PathEscape(id), nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Wait polls an execution every interval (half a second when zero) until it finishes. An
+// execution that ended without a run is returned as an *ExecutionError.
+func (c *Client) Wait(ctx context.Context, id string, interval time.Duration) (*Result, error) {
+	if interval <= 0 {
+		interval = 500 * time.Millisecond
+	}
+	for {
+		execution, err := c.GetExecution(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if execution.Result != nil {
+			return execution.Result, nil
+		}
+		if execution.Status == "error" {
+			return nil, &ExecutionError{ID: id, Message: execution.Error}
+		}
+		if err := sleep(ctx, interval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Cancel asks for an in-flight execution to stop; it finishes with status canceled.
+func (c *Client) Cancel(ctx context.Context, id string) (*Execution, error) {
+	var execution Execution
+	if err := c.doJSON(ctx, http.MethodDelete, "/v1/executions/"+url.PathEscape(id), nil, &execution); err != nil {
+		return nil, err
+	}
+	return &execution, nil
+}
+
+// Restore brings back an execution the deployment's retention policy archived.
+func (c *Client) Restore(ctx context.Context, id string) (*Execution, error) {
+	body, err := c.do(ctx, http.MethodPost, "/v1/executions/"+url.PathEscape(id)+"/restore", nil, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	return decodeExecution(body)
+}
+
+// Events returns an execution's audit trail.
+func (c *Client) Events(ctx context.Context, id string) ([]Event, error) {
+	var trail struct {
+		Events []Event `json:"events"`
+	}
+	if err := c.doJSON(ctx, http.MethodGet, "/v1/executions/"+url.PathEscape(id)+"/events", nil, &trail); err != nil {
+		return nil, err
+	}
+	return trail.Events, nil
+}
+
+// ListOptions select a page of ListExecutions. Executions match every filter that is set.
+type ListOptions struct {
+	// Limit is the page size, the server's default (50) when zero.
+	Limit int
+	// Cursor is the NextCursor of the page before; empty for the first.
+	Cursor string
+	// Language is the language the executions ran as, e.g. "python".
+	Language string
+	// Statuses are how the executions ended, or "unfinished" for those still queued or running.
+	Statuses []string
+	// Tag is one of the tags the execution was submitted with.
+	Tag string
+	// Metadata are values the execution's metadata must have for each of these keys.
+	Metadata map[string]string
+	// CreatedAfter (inclusive) and CreatedBefore bound the creation time; zero for no bound.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// ListExecutions returns a page of the caller's executions, newest first.
+func (c *Client) ListExecutions(ctx context.Context, options ListOptions) (*ExecutionPage, error) {
+	path := "/v1/executions"
+	if query := listQuery(options); len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var page ExecutionPage
+	if err := c.doJSON(ctx, http.MethodGet, path, nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// SimilarOptions select the matches of Similar.
+type SimilarOptions struct {
+	// Threshold is the least similarity a match has, from 0 to 1; the server's default (0.5) when zero.
+	Threshold float64
+	// Filter narrows the matches like a listing, up to Filter.Limit of them; its Cursor is unused.
+	// Matches are of the execution's language unless Filter.Language names another.
+	Filter ListOptions
+}
+
+// Similar returns the caller's submissions whose sources resemble the execution's, most similar
+// first. The deployment must keep fingerprints (STORE_FINGERPRINTS).
+func (c *Client) Similar(ctx context.Context, id string, options SimilarOptions) (*SimilarExecutions, error) {
+	options.Filter.Cursor = ""
+	query := listQuery(options.Filter)
+	if options.Threshold > 0 {
+		query.Set("threshold", strconv.FormatFloat(options.Threshold, 'f', -1, 64))
+	}
+	path := "/v1/executions/" + url.PathEscape(id) + "/similar"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var similar SimilarExecutions
+	if err := c.doJSON(ctx, http.MethodGet, path, nil, &similar); err != nil {
+		return nil, err
+	}
+	return &similar, nil
+}
+
+func listQuery(options ListOptions) url.Values {
+	query := url.Values{}
+	if options.Limit > 0 {
+		query.Set("limit", strconv.Itoa(options.Limit))
+	}
+	if options.Cursor != "" {
+		query.Set("cursor", options.Cursor)
+	}
+	if options.Language != "" {
+		query.Set("language", options.Language)
+	}
+	if len(options.Statuses) > 0 {
+		query.Set("status", strings.Join(options.Statuses, ","))
+	}
+	if options.Tag != "" {
+		query.Set("tag", options.Tag)
+	}
+	for key, value := range options.Metadata {
+		query.Set("metadata."+key, value)
+	}
+	if !options.CreatedAfter.IsZero() {
+		query.Set("created_after", options.CreatedAfter.UTC().Format(time.RFC3339Nano))
+	}
+	if !options.CreatedBefore.IsZero() {
+		query.Set("created_before", options.CreatedBefore.UTC().Format(time.RFC3339Nano))
+	}
+	return query
+}
+
+// Executions iterates over all of the caller's executions, newest first, fetching pages as it
+// goes. It stops at the first error, which it yields.
+func (c *Client) Executions(ctx context.Context, options ListOptions) iter.Seq2[ExecutionSummary, error] {
+	return func(yield func(ExecutionSummary, error) bool) {
+		for {
+			page, err := c.ListExecutions(ctx, options)
+			if err != nil {
+				yield(ExecutionSummary{}, err)
+				return
+			}
+			for _, execution := range page.Executions {
+				if !yield(execution, nil) {
+					return
+				}
+			}
+			if page.NextCursor == "" {
+				return
+			}
+			options.Cursor = page.NextCursor
+		}
+	}
+}
+
+func (c *Client) submit(ctx context.Context, path string, request *ExecutionRequest, options *SubmitOptions, out any) error {
+	body, err := c.submitRaw(ctx, path, request, options, false)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+func (c *Client) submitRaw(ctx context.Context, path string, request *ExecutionRequest, options *SubmitOptions, callback bool) ([]byte, error) {
+	payload, header, err := submission(request, options, callback)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(ctx, http.MethodPost, path, payload, header, true)
+}
+
+// submission encodes the request, with the callback URL beside it for asynchronous executions,
+// and the headers that go with it.
+func submission(request *ExecutionRequest, options *SubmitOptions, callback bool) ([]byte, http.Header, error) {
+	if options == nil {
+		options = &SubmitOptions{}
+	}
+	if options.CallbackURL != "" && !callback {
+		return nil, nil, errors.New("code executor: a callback URL is only sent with Submit")
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	if options.CallbackURL != "" {
+		var fields map[string]any
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return nil, nil, err
+		}
+		fields["callback_url"] = options.CallbackURL
+		if payload, err = json.Marshal(fields); err != nil {
+			return nil, nil, err
+		}
+	}
+	header := http.Header{}
+	key := options.IdempotencyKey
+	if key == "" {
+		key = cryptorand.Text()
+	}
+	header.Set("Idempotency-Key", key)
+	if options.TraceParent != "" {
+		header.Set("Traceparent", options.TraceParent)
+	}
+	return payload, header, nil
+}
+
+func (c *Client) doJSON(ctx context.Context, method, path string, payload []byte, out any) error {
+	body, err := c.do(ctx, method, path, payload, nil, true)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+// do sends a request, retrying it when repeatable, and returns the body of a successful answer.
+func (c *Client) do(ctx context.Context, method, path string, payload []byte, header http.Header, repeatable bool) ([]byte, error) {
+	attempts := 1
+	if repeatable {
+		attempts = c.retry.MaxAttempts
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := c.send(ctx, method, path, payload, header)
+		var body []byte
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if err == nil && resp.StatusCode < 300 {
+			return body, nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+		} else {
+			err = decodeError(resp, body)
+		}
+		wait, retry := c.backoff(attempt, err)
+		if !retry || attempt >= attempts {
+			return nil, err
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path string, payload []byte, header http.Header) (*http.Response, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	return c.httpClient.Do(req)
+}
+
+// backoff says whether the outcome of an attempt is worth retrying and how long to wait first.
+func (c *Client) backoff(attempt int, err error) (time.Duration, bool) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		default:
+			return 0, false
+		}
+		if apiErr.RetryAfter > 0 {
+			return apiErr.RetryAfter, apiErr.RetryAfter <= c.retry.MaxBackoff
+		}
+	}
+	wait := c.retry.MinBackoff << (attempt - 1)
+	if wait <= 0 || wait > c.retry.MaxBackoff {
+		wait = c.retry.MaxBackoff
+	}
+	// Equal jitter: at least half the wait, so that clients retrying together spread out.
+	return wait/2 + rand.N(wait/2+1), true
+}
+
+func decodeExecution(body []byte) (*Execution, error) {
+	var execution Execution
+	if err := json.Unmarshal(body, &execution); err != nil {
+		return nil, err
+	}
+	if Finished(execution.Status) {
+		execution.Result = &Result{}
+		if err := json.Unmarshal(body, execution.Result); err != nil {
+			return nil, err
+		}
+	}
+	return &execution, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,209 @@
+package codeexecutor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var quickRetries = WithRetryPolicy(RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+
+func TestRunRetriesWithTheSameIdempotencyKey(t *testing.T) {
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		if len(keys) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error":"server is draining","data":{"code":"draining"}}`)
+			return
+		}
+		var request ExecutionRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Code != "print(1)" {
+			t.Errorf("request = %+v, %v", request, err)
+		}
+		fmt.Fprint(w, `{"id":"run_1","status":"succeeded","exit_code":0,"stdout":"1\n","artifacts":[{"name":"a.txt","content":"aGk="}]}`)
+	}))
+	defer server.Close()
+
+	client := New(server.URL, WithAPIKey("secret"), quickRetries)
+	result, err := client.Run(context.Background(), &ExecutionRequest{Language: "python", Code: "print(1)"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stdout != "1\n" || *result.ExitCode != 0 || string(result.Artifacts[0].Content) != "hi" {
+		t.Errorf("result = %+v", result)
+	}
+	if len(keys) != 2 || keys[0] == "" || keys[0] != keys[1] {
+		t.Errorf("idempotency keys = %q", keys)
+	}
+}
+
+func TestErrorsThatRetriesCannotFix(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path == "/v1/executions/run_quota" {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"error":"monthly quota exceeded"}`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":"execution is archived","data":{"code":"archived"}}`)
+	}))
+	defer server.Close()
+
+	client := New(server.URL, quickRetries)
+	_, err := client.GetExecution(context.Background(), "run_old")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || !IsNotFound(err) || apiErr.Code() != "archived" || calls != 1 {
+		t.Errorf("err = %v after %d calls", err, calls)
+	}
+	// Waiting an hour is longer than the policy allows.
+	_, err = client.GetExecution(context.Background(), "run_quota")
+	if !errors.As(err, &apiErr) || apiErr.RetryAfter != time.Hour || calls != 2 {
+		t.Errorf("err = %v after %d calls", err, calls)
+	}
+}
+
+func TestWaitPollsUntilTheExecutionFinishes(t *testing.T) {
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		switch {
+		case r.URL.Path == "/v1/executions/run_bad":
+			fmt.Fprint(w, `{"id":"run_bad","status":"error","error":"sandbox failed"}`)
+		case polls < 3:
+			fmt.Fprint(w, `{"id":"run_1","status":"running","language":"go","created_at":"2026-01-01T00:00:00.000Z"}`)
+		default:
+			fmt.Fprint(w, `{"id":"run_1","status":"failed","exit_code":2,"termination":{"verdict":"exited_nonzero","signal":null,"explanation":"x"}}`)
+		}
+	}))
+	defer server.Close()
+
+	client := New(server.URL)
+	result, err := client.Wait(context.Background(), "run_1", time.Millisecond)
+	if err != nil || result.Status != StatusFailed || result.Termination.Verdict != "exited_nonzero" || polls != 3 {
+		t.Fatalf("result = %+v, %v after %d polls", result, err, polls)
+	}
+	var failed *ExecutionError
+	if _, err := client.Wait(context.Background(), "run_bad", time.Millisecond); !errors.As(err, &failed) || failed.Message != "sandbox failed" {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestExecutionsFollowsCursors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("limit") != "2" || query.Get("status") != "failed,timeout" || query.Get("tag") != "hw1" || query.Get("metadata.student_id") != "s1" {
+			t.Errorf("query = %q", r.URL.RawQuery)
+		}
+		switch r.URL.Query().Get("cursor") {
+		case "":
+			fmt.Fprint(w, `{"executions":[{"id":"run_3","status":"running"},{"id":"run_2","status":"succeeded"}],"next_cursor":"c2"}`)
+		case "c2":
+			fmt.Fprint(w, `{"executions":[{"id":"run_1","status":"error","finished_at":"2026-01-01T00:00:00.000Z"}],"next_cursor":null}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	var ids []string
+	for execution, err := range New(server.URL).Executions(context.Background(), ListOptions{Limit: 2, Statuses: []string{"failed", "timeout"}, Tag: "hw1", Metadata: map[string]string{"student_id": "s1"}}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, execution.ID)
+	}
+	if strings.Join(ids, ",") != "run_3,run_2,run_1" {
+		t.Errorf("ids = %v", ids)
+	}
+}
+
+func TestSimilarSendsThresholdAndFilters(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/v1/executions/run_1/similar" || query.Get("threshold") != "0.8" || query.Get("metadata.assignment_id") != "hw3" || query.Has("cursor") {
+			t.Errorf("request = %s?%s", r.URL.Path, r.URL.RawQuery)
+		}
+		fmt.Fprint(w, `{"id":"run_1","fingerprint_size":40,"threshold":0.8,"matches":[{"id":"run_0","language":"python","status":"succeeded","shared":36,"similarity":0.9}]}`)
+	}))
+	defer server.Close()
+
+	options := SimilarOptions{Threshold: 0.8, Filter: ListOptions{Cursor: "ignored", Metadata: map[string]string{"assignment_id": "hw3"}}}
+	similar, err := New(server.URL).Similar(context.Background(), "run_1", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if similar.FingerprintSize != 40 || len(similar.Matches) != 1 {
+		t.Fatalf("similar = %+v", similar)
+	}
+	if match := similar.Matches[0]; match.ID != "run_0" || match.Language != "python" || match.Shared != 36 || match.Similarity != 0.9 {
+		t.Errorf("match = %+v", match)
+	}
+}
+
+func TestStreamCopiesOutputUntilTheResult(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "stream=true" {
+			t.Errorf("query = %q", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: stdout\ndata: {\"data\":\"hello \"}\n\n")
+		fmt.Fprint(w, "event: stderr\ndata: {\"data\":\"warning\"}\n\n")
+		fmt.Fprint(w, "event: stdout\ndata: {\"data\":\"world\\n\"}\n\n")
+		fmt.Fprint(w, "event: result\ndata: {\"id\":\"run_1\",\"status\":\"succeeded\",\"stdout\":\"hello world\\n\"}\n\n")
+	}))
+	defer server.Close()
+
+	stream, err := New(server.URL).RunStream(context.Background(), &ExecutionRequest{Code: "print('hello world')"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	var stdout, stderr strings.Builder
+	result, err := stream.Copy(&stdout, &stderr)
+	if err != nil || result.ID != "run_1" || stdout.String() != "hello world\n" || stderr.String() != "warning" {
+		t.Fatalf("result = %+v, %v; stdout %q, stderr %q", result, err, stdout.String(), stderr.String())
+	}
+	if _, err := stream.Next(); err != io.EOF {
+		t.Errorf("after the result: %v", err)
+	}
+}
+
+func TestFollowDecodesUsageSamples(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/executions/run_1/stream" {
+			t.Errorf("path = %q", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: usage\ndata: {\"elapsed_ms\":250,\"memory_mb\":12.5,\"cpu_ms\":200,\"cpu_pct\":80}\n\n")
+		fmt.Fprint(w, "event: usage\ndata: {\"elapsed_ms\":500,\"memory_mb\":13,\"cpu_ms\":null,\"cpu_pct\":null}\n\n")
+	}))
+	defer server.Close()
+
+	stream, err := New(server.URL).Follow(context.Background(), "run_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	first, err := stream.Next()
+	if err != nil || first.Type != "usage" || first.Usage.ElapsedMs != 250 || first.Usage.MemoryMB != 12.5 || *first.Usage.CPUPct != 80 {
+		t.Fatalf("first = %+v, %v", first, err)
+	}
+	second, err := stream.Next()
+	if err != nil || second.Usage.CPUMs != nil || second.Usage.CPUPct != nil {
+		t.Fatalf("second = %+v, %v", second, err)
+	}
+}
@@ -0,0 +1,69 @@
+package codeexecutor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// APIError is a response the API answered with an error status.
+type APIError struct {
+	StatusCode int
+	// Message is the API's error, e.g. "limits.timeout_ms must be at most 30000".
+	Message string
+	// Data carries details of some errors, e.g. the policy violations of a rejected submission.
+	Data json.RawMessage
+	// RetryAfter is set on rate-limit and queue-full rejections.
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("code executor: %d %s", e.StatusCode, e.Message)
+}
+
+// Code is the `code` of the error's data, e.g. draining or archived, empty when it has none.
+func (e *APIError) Code() string {
+	var data struct {
+		Code string `json:"code"`
+	}
+	if json.Unmarshal(e.Data, &data) != nil {
+		return ""
+	}
+	return data.Code
+}
+
+// IsNotFound reports whether err is the API's answer for an unknown execution or run.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// ExecutionError is returned by Wait for an execution that ended without a run, e.g. because
+// its sandbox could not be created.
+type ExecutionError struct {
+	ID      string
+	Message string
+}
+
+func (e *ExecutionError) Error() string {
+	return fmt.Sprintf("code executor: execution %s failed: %s", e.ID, e.Message)
+}
+
+func decodeError(resp *http.Response, body []byte) error {
+	apiErr := &APIError{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	var payload struct {
+		Error string          `json:"error"`
+		Data  json.RawMessage `json:"data"`
+	}
+	if json.Unmarshal(body, &payload) == nil && payload.Error != "" {
+		apiErr.Message = payload.Error
+		apiErr.Data = payload.Data
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return apiErr
+}
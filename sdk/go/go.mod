@@ -0,0 +1,3 @@
+module github.com/arksenu/code-executor/sdk/go
+
+go 1.25.0
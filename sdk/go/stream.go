@@ -0,0 +1,158 @@
+package codeexecutor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// StreamEvent is one server-sent event of a followed execution.
+type StreamEvent struct {
+	// Type is status, stdout, stderr, usage, result or error.
+	Type string
+	// Status is the execution's state for status events: queued, compiling or running.
+	Status string
+	// Data is the chunk of output of stdout and stderr events.
+	Data string
+	// Usage is the sample of usage events, sent for runs that set UsageIntervalMs.
+	Usage *UsageSample
+	// Result is the finished run of the result event, which ends the stream.
+	Result *Result
+	// Error is why the execution failed, for the error event that ends the stream instead.
+	Error string
+}
+
+// Stream reads the events of a run or execution as the server sends them. Close it when done.
+type Stream struct {
+	// id is the followed execution's; RunStream does not know it.
+	id     string
+	body   io.ReadCloser
+	reader *bufio.Reader
+}
+
+// RunStream executes the request with its output streamed as it is produced, ending with the
+// result. Streams are not retried: output may already have been read.
+func (c *Client) RunStream(ctx context.Context, request *ExecutionRequest, options *SubmitOptions) (*Stream, error) {
+	payload, header, err := submission(request, options, false)
+	if err != nil {
+		return nil, err
+	}
+	return c.openStream(ctx, http.MethodPost, "/v1/runs?stream=true", payload, header)
+}
+
+// Follow streams an execution's state changes and the output it produces from now on. A
+// finished execution sends its final event at once.
+func (c *Client) Follow(ctx context.Context, id string) (*Stream, error) {
+	stream, err := c.openStream(ctx, http.MethodGet, "/v1/executions/"+url.PathEscape(id)+"/stream", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	stream.id = id
+	return stream, nil
+}
+
+func (c *Client) openStream(ctx context.Context, method, path string, payload []byte, header http.Header) (*Stream, error) {
+	resp, err := c.send(ctx, method, path, payload, header)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, decodeError(resp, body)
+	}
+	return &Stream{body: resp.Body, reader: bufio.NewReader(resp.Body)}, nil
+}
+
+// Next returns the next event, and io.EOF once the server has ended the stream.
+func (s *Stream) Next() (StreamEvent, error) {
+	var name string
+	var data strings.Builder
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && line == "" && name == "" {
+				return StreamEvent{}, io.EOF
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return StreamEvent{}, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			if name != "" {
+				return decodeEvent(name, data.String())
+			}
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+}
+
+// Copy writes the output events to stdout and stderr until the stream ends, and returns the
+// result; an error event comes back as an *ExecutionError.
+func (s *Stream) Copy(stdout, stderr io.Writer) (*Result, error) {
+	for {
+		event, err := s.Next()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch event.Type {
+		case "stdout":
+			_, err = io.WriteString(stdout, event.Data)
+		case "stderr":
+			_, err = io.WriteString(stderr, event.Data)
+		case "result":
+			return event.Result, nil
+		case "error":
+			return nil, &ExecutionError{ID: s.id, Message: event.Error}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *Stream) Close() error {
+	return s.body.Close()
+}
+
+func decodeEvent(name, data string) (StreamEvent, error) {
+	event := StreamEvent{Type: name}
+	var err error
+	switch name {
+	case "result":
+		event.Result = &Result{}
+		err = json.Unmarshal([]byte(data), event.Result)
+	case "usage":
+		event.Usage = &UsageSample{}
+		err = json.Unmarshal([]byte(data), event.Usage)
+	default:
+		var fields struct {
+			Status string `json:"status"`
+			Data   string `json:"data"`
+			Error  string `json:"error"`
+		}
+		err = json.Unmarshal([]byte(data), &fields)
+		event.Status, event.Data, event.Error = fields.Status, fields.Data, fields.Error
+	}
+	if err != nil {
+		return StreamEvent{}, fmt.Errorf("code executor: malformed %s event: %w", name, err)
+	}
+	return event, nil
+}
@@ -0,0 +1,406 @@
+package codeexecutor
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ExecutionRequest is what /v1/runs and /v1/executions take: the program, its input and how it
+// may run. Only Code or Sources is required; the language is detected when left out.
+type ExecutionRequest struct {
+	Language string `json:"language,omitempty"`
+	// Filename names the entry file as the caller knows it, for detecting the language.
+	Filename string `json:"filename,omitempty"`
+	// Mode is run (the default), test, compile or check.
+	Mode     string            `json:"mode,omitempty"`
+	Code     string            `json:"code,omitempty"`
+	Template *CodeTemplate     `json:"template,omitempty"`
+	Sources  map[string]string `json:"sources,omitempty"`
+	Stdin    string            `json:"stdin,omitempty"`
+	Build    *BuildOptions     `json:"build,omitempty"`
+	Lint     *LintOptions      `json:"lint,omitempty"`
+	SQL      *SQLOptions       `json:"sql,omitempty"`
+	Profile  *ProfileOptions   `json:"profile,omitempty"`
+	Coverage bool              `json:"coverage,omitempty"`
+	// Isolation is container, gvisor, microvm or wasm; the deployment's default when empty.
+	Isolation string         `json:"isolation,omitempty"`
+	Network   *NetworkPolicy `json:"network,omitempty"`
+	GPU       *GPURequest    `json:"gpu,omitempty"`
+	// Version picks a toolchain version, e.g. 1.22 for Go; see /v1/runners.
+	Version string            `json:"version,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	Files   []FileInput       `json:"files,omitempty"`
+	Mounts  []Mount           `json:"mounts,omitempty"`
+	Limits  *Limits           `json:"limits,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	// InlineArtifacts returns artifact contents in the result as well as their download URLs.
+	InlineArtifacts bool `json:"inline_artifacts,omitempty"`
+	// OnOutputLimit is truncate (the default) or kill.
+	OnOutputLimit string `json:"on_output_limit,omitempty"`
+	// Priority is interactive, normal (the default) or batch.
+	Priority string `json:"priority,omitempty"`
+	// Deterministic vouches that the output depends only on the request, so that an identical
+	// earlier run's result may be returned instead.
+	Deterministic bool                 `json:"deterministic,omitempty"`
+	Reproducible  *ReproducibleOptions `json:"reproducible,omitempty"`
+	// Tags label the execution for ListOptions.Tag to find; they don't affect the run.
+	Tags []string `json:"tags,omitempty"`
+	// Metadata is kept with the result for ListOptions.Metadata to find, e.g. an assignment ID or
+	// a commit SHA; it doesn't affect the run either.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// UsageIntervalMs samples the program's CPU and memory this often, from 100 to 60000 ms, into
+	// Result.UsageSamples and usage events on Follow's stream.
+	UsageIntervalMs int `json:"usage_interval_ms,omitempty"`
+}
+
+// CodeTemplate is a harness Code is put into before the build, at Placeholder ({{code}} when
+// empty).
+type CodeTemplate struct {
+	Source      string `json:"source"`
+	Placeholder string `json:"placeholder,omitempty"`
+}
+
+// BuildOptions are compiler options for C and C++.
+type BuildOptions struct {
+	Compiler     string   `json:"compiler,omitempty"`
+	Std          string   `json:"std,omitempty"`
+	Optimization string   `json:"optimization,omitempty"`
+	Sanitizers   []string `json:"sanitizers,omitempty"`
+}
+
+// LintOptions turns static checks on or off where the runner supports them (Go).
+type LintOptions struct {
+	Vet         *bool `json:"vet,omitempty"`
+	Staticcheck bool  `json:"staticcheck,omitempty"`
+}
+
+// SQLOptions picks the database engine of a sql run and the fixture it starts from.
+type SQLOptions struct {
+	Engine  string `json:"engine,omitempty"`
+	Fixture string `json:"fixture,omitempty"`
+}
+
+// ProfileOptions asks for profiles, returned as artifacts under profiles/.
+type ProfileOptions struct {
+	CPU  bool `json:"cpu,omitempty"`
+	Heap bool `json:"heap,omitempty"`
+}
+
+// NetworkPolicy is none (the default), loopback or allowlist with the hosts in Allow.
+type NetworkPolicy struct {
+	Mode  string   `json:"mode"`
+	Allow []string `json:"allow,omitempty"`
+}
+
+// GPURequest asks for Count GPUs, one when zero, each with VRAMMB of its memory.
+type GPURequest struct {
+	Count  int `json:"count,omitempty"`
+	VRAMMB int `json:"vram_mb,omitempty"`
+}
+
+// FileInput stages an uploaded file (an ID from /v1/files) at Path in the run directory.
+type FileInput struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+}
+
+// Mount exposes a dataset or a file under one of the server's mount roots at Path under /data,
+// read-only.
+type Mount struct {
+	Path      string `json:"path"`
+	DatasetID string `json:"dataset_id,omitempty"`
+	HostPath  string `json:"host_path,omitempty"`
+}
+
+// ReproducibleOptions fixes the program's clock at Time (RFC 3339) and seeds its random source.
+type ReproducibleOptions struct {
+	Time       string  `json:"time,omitempty"`
+	FreezeTime bool    `json:"freeze_time,omitempty"`
+	Seed       *uint32 `json:"seed,omitempty"`
+}
+
+// Limits bound a run. In a request, fields left at zero take the deployment's defaults.
+type Limits struct {
+	TimeoutMs            int64 `json:"timeout_ms,omitempty"`
+	KillGraceMs          int64 `json:"kill_grace_ms,omitempty"`
+	MemoryMB             int64 `json:"memory_mb,omitempty"`
+	CPUMs                int64 `json:"cpu_ms,omitempty"`
+	MaxOutputBytes       int64 `json:"max_output_bytes,omitempty"`
+	MaxStdoutBytes       int64 `json:"max_stdout_bytes,omitempty"`
+	MaxStderrBytes       int64 `json:"max_stderr_bytes,omitempty"`
+	MaxArtifactBytes     int64 `json:"max_artifact_bytes,omitempty"`
+	MaxArtifactFiles     int64 `json:"max_artifact_files,omitempty"`
+	MaxArtifactFileBytes int64 `json:"max_artifact_file_bytes,omitempty"`
+	DiskMB               int64 `json:"disk_mb,omitempty"`
+	MaxProcesses         int64 `json:"max_processes,omitempty"`
+	MaxOpenFiles         int64 `json:"max_open_files,omitempty"`
+	CoreDumpMB           int64 `json:"core_dump_mb,omitempty"`
+}
+
+// Run statuses; a finished Result has one of them.
+const (
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusTimeout   = "timeout"
+	StatusOOM       = "oom"
+	StatusKilled    = "killed"
+	StatusCanceled  = "canceled"
+)
+
+// Result is the record of a finished run.
+type Result struct {
+	SchemaVersion int    `json:"schema_version"`
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	ExitCode      *int   `json:"exit_code"`
+	// LimitExceeded names the limit that stopped or truncated the run: wall_time, cpu_time,
+	// memory, output, disk or processes.
+	LimitExceeded    *string           `json:"limit_exceeded"`
+	Timeout          *TimeoutReport    `json:"timeout"`
+	Termination      Termination       `json:"termination"`
+	Stdout           string            `json:"stdout"`
+	Stderr           string            `json:"stderr"`
+	Truncated        bool              `json:"truncated"`
+	DroppedBytes     map[string]int64  `json:"dropped_bytes"`
+	Phases           Phases            `json:"phases"`
+	Usage            Usage             `json:"usage"`
+	Artifacts        []Artifact        `json:"artifacts"`
+	ArtifactsSkipped []SkippedArtifact `json:"artifacts_skipped"`
+	// Tests is nil outside test mode.
+	Tests       []TestCase      `json:"tests"`
+	Coverage    json.RawMessage `json:"coverage"`
+	Diagnostics []Diagnostic    `json:"diagnostics"`
+	// Results holds the statement results of a sql run.
+	Results          []QueryResult      `json:"results"`
+	Limits           Limits             `json:"limits"`
+	CreatedAt        time.Time          `json:"created_at"`
+	QueueWaitMs      int64              `json:"queue_wait_ms"`
+	Language         string             `json:"language"`
+	DetectedLanguage *LanguageDetection `json:"detected_language"`
+	Mode             string             `json:"mode"`
+	Isolation        string             `json:"isolation"`
+	Network          NetworkPolicy      `json:"network"`
+	Version          *string            `json:"version"`
+	Toolchain        *string            `json:"toolchain"`
+	CodeSHA256       string             `json:"code_sha256"`
+	// CachedFrom is the ID of the run a deterministic request was answered with.
+	CachedFrom       *string                    `json:"cached_from"`
+	Retries          []Retry                    `json:"retries"`
+	Metadata         map[string]string          `json:"metadata"`
+	Annotations      map[string]json.RawMessage `json:"annotations"`
+	PolicyViolations []PolicyViolation          `json:"policy_violations"`
+	// UsageSamples is nil unless the request set UsageIntervalMs and the server could sample the
+	// sandbox.
+	UsageSamples *UsageSeries `json:"usage_samples"`
+	// Cost is nil for runs recorded before the server counted costs.
+	Cost *Cost `json:"cost"`
+	// Signature is nil when the deployment signs no results; see /v1/signing-keys.
+	Signature *Signature `json:"signature"`
+}
+
+// Finished reports whether status is that of a finished run rather than an execution in flight
+// or one that ended with an error.
+func Finished(status string) bool {
+	switch status {
+	case StatusSucceeded, StatusFailed, StatusTimeout, StatusOOM, StatusKilled, StatusCanceled:
+		return true
+	}
+	return false
+}
+
+// TimeoutReport says how a program that reached timeout_ms was stopped.
+type TimeoutReport struct {
+	Stage        string `json:"stage"`
+	GraceMs      int64  `json:"grace_ms"`
+	StdoutBytes  int64  `json:"stdout_bytes"`
+	StderrBytes  int64  `json:"stderr_bytes"`
+	FlushedBytes int64  `json:"flushed_bytes"`
+}
+
+// Termination says why a run ended, e.g. verdict segmentation_fault with signal SIGSEGV.
+type Termination struct {
+	Verdict     string  `json:"verdict"`
+	Signal      *string `json:"signal"`
+	Explanation string  `json:"explanation"`
+}
+
+// Phases reports the build and the program run apart; Compile is nil for interpreted languages
+// and Run is nil when the build failed.
+type Phases struct {
+	Compile *Phase `json:"compile"`
+	Run     *Phase `json:"run"`
+}
+
+type Phase struct {
+	ExitCode   *int   `json:"exit_code"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+	DurationMs int64  `json:"duration_ms"`
+	Cached     bool   `json:"cached,omitempty"`
+}
+
+type Usage struct {
+	WallMs      int64   `json:"wall_ms"`
+	CPUMs       int64   `json:"cpu_ms"`
+	UserCPUMs   *int64  `json:"user_cpu_ms,omitempty"`
+	SystemCPUMs *int64  `json:"system_cpu_ms,omitempty"`
+	MaxRSSMB    float64 `json:"max_rss_mb"`
+}
+
+// UsageSeries holds a run's usage samples, oldest first. IntervalMs is the requested interval,
+// doubled each time a long run thinned its samples to every other one.
+type UsageSeries struct {
+	IntervalMs int64         `json:"interval_ms"`
+	Samples    []UsageSample `json:"samples"`
+}
+
+// UsageSample is a reading of the sandbox while the run was in flight. CPUMs and CPUPct are nil
+// where the server cannot read CPU time; CPUPct is the share of a core used since the sample
+// before, above 100 on several cores.
+type UsageSample struct {
+	ElapsedMs int64    `json:"elapsed_ms"`
+	MemoryMB  float64  `json:"memory_mb"`
+	CPUMs     *int64   `json:"cpu_ms"`
+	CPUPct    *float64 `json:"cpu_pct"`
+}
+
+// Cost is what a run consumed, zero for a cached answer. Units weighs the other figures by the
+// deployment's rates.
+type Cost struct {
+	CPUSeconds      float64 `json:"cpu_seconds"`
+	MemoryGBSeconds float64 `json:"memory_gb_seconds"`
+	SandboxSeconds  float64 `json:"sandbox_seconds"`
+	Units           float64 `json:"units"`
+}
+
+// Artifact is a file the run left under outputs/, downloadable from URL until ExpiresAt.
+type Artifact struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	URL         string    `json:"url"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	ContentType string    `json:"content_type"`
+	// Content is set when the request asked for inline artifacts and the file was small enough.
+	Content []byte `json:"content,omitempty"`
+}
+
+type SkippedArtifact struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+}
+
+type TestCase struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	DurationMs int64   `json:"duration_ms"`
+	Message    *string `json:"message"`
+}
+
+type Diagnostic struct {
+	Source   string  `json:"source"`
+	File     string  `json:"file"`
+	Line     *int    `json:"line"`
+	Column   *int    `json:"column"`
+	Code     *string `json:"code"`
+	Severity string  `json:"severity"`
+	Message  string  `json:"message"`
+	Origin   string  `json:"origin,omitempty"`
+}
+
+type QueryResult struct {
+	Statement    string   `json:"statement"`
+	Line         int      `json:"line"`
+	Columns      []string `json:"columns"`
+	Rows         [][]any  `json:"rows"`
+	RowsAffected *int64   `json:"rows_affected"`
+	Truncated    bool     `json:"truncated"`
+	Error        *string  `json:"error"`
+}
+
+type LanguageDetection struct {
+	Language   string  `json:"language"`
+	Confidence float64 `json:"confidence"`
+	Source     string  `json:"source"`
+}
+
+// Retry is an attempt lost to a worker failure before the run was retried elsewhere.
+type Retry struct {
+	Attempt int    `json:"attempt"`
+	Worker  string `json:"worker"`
+	Error   string `json:"error"`
+}
+
+type PolicyViolation struct {
+	Rule    string `json:"rule"`
+	Action  string `json:"action"`
+	Path    string `json:"path"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Match   string `json:"match"`
+	Message string `json:"message"`
+}
+
+// Signature is the deployment's Ed25519 signature over the rest of a result.
+type Signature struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id"`
+	Value     string `json:"value"`
+}
+
+// Execution is where an execution stands: queued, compiling, running or canceling while in
+// flight, error when it ended without a run, or the run's status once finished, with the run in
+// Result.
+type Execution struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"`
+	Language  string    `json:"language"`
+	CreatedAt time.Time `json:"created_at"`
+	// Error is why an execution with status error ended.
+	Error  string  `json:"error,omitempty"`
+	Result *Result `json:"-"`
+}
+
+// ExecutionSummary is an execution as listed.
+type ExecutionSummary struct {
+	ID         string            `json:"id"`
+	Language   string            `json:"language"`
+	Status     string            `json:"status"`
+	CreatedAt  time.Time         `json:"created_at"`
+	FinishedAt *time.Time        `json:"finished_at"`
+	Tenant     *string           `json:"tenant"`
+	Tags       []string          `json:"tags"`
+	Metadata   map[string]string `json:"metadata"`
+}
+
+// ExecutionPage is one page of ListExecutions; NextCursor is empty on the last.
+type ExecutionPage struct {
+	Executions []ExecutionSummary `json:"executions"`
+	NextCursor string             `json:"next_cursor"`
+}
+
+// SimilarExecutions are what Similar found; FingerprintSize is 0 for an execution without a
+// fingerprint, which matches nothing.
+type SimilarExecutions struct {
+	ID              string             `json:"id"`
+	FingerprintSize int                `json:"fingerprint_size"`
+	Threshold       float64            `json:"threshold"`
+	Matches         []SimilarExecution `json:"matches"`
+}
+
+// SimilarExecution is a match of Similar. Shared counts the fingerprint hashes it has in common
+// with the execution compared, and Similarity is them over the hashes of either, from 0 to 1.
+type SimilarExecution struct {
+	ExecutionSummary
+	Shared     int     `json:"shared"`
+	Similarity float64 `json:"similarity"`
+}
+
+// Event is a step of an execution's audit trail.
+type Event struct {
+	Seq  int                        `json:"seq"`
+	Type string                     `json:"type"`
+	At   time.Time                  `json:"at"`
+	Data map[string]json.RawMessage `json:"data"`
+}